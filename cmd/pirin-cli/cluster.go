@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/pkg/sharding"
+)
+
+// servedByHeader names the cluster node that served a key request
+const servedByHeader = "X-Pirin-Served-By"
+
+// connectCluster fetches the ring when the server reports sharding, so get, set and del go
+// straight to the shard owning the key. Outside of a cluster, and when the ring can't be
+// fetched, every request goes to the server given on the command line, which proxies it.
+func connectCluster(settings *Settings) {
+	if settings.connected {
+		return
+	}
+	settings.connected = true
+	ctx := context.Background()
+	info, err := client.New(BuildURL(settings, "")).ServerVersion(ctx)
+	if err != nil || !info.Sharding {
+		return
+	}
+	router, err := client.NewRouter(ctx, BuildURL(settings, ""))
+	if err != nil {
+		_, _ = colorYellow.Printf("Failed to fetch the cluster ring, requests are proxied: %v\n", err)
+		return
+	}
+	settings.Router = router
+}
+
+// shardCount returns the shards of the ring, 0 outside of a cluster
+func shardCount(settings *Settings) int {
+	if settings.Router == nil {
+		return 0
+	}
+	return len(settings.Router.Ring().Shards())
+}
+
+// shardAPIURL builds an API URL on the shard owning the key, the shard is nil when the key
+// is not routed and the URL is on the server given on the command line
+func shardAPIURL(settings *Settings, key, endpoint string) (string, *sharding.Shard) {
+	if settings.Router == nil {
+		return BuildAPIURL(settings, endpoint), nil
+	}
+	shard := settings.Router.Ring().GetShard(key)
+	if shard == nil {
+		return BuildAPIURL(settings, endpoint), nil
+	}
+	base := shard.URL()
+	if settings.UseHTTPS {
+		base = "https" + strings.TrimPrefix(base, "http")
+	}
+	path := "/api/v1" + endpoint
+	if settings.DB != "" {
+		path = fmt.Sprintf("/api/v1/%s%s", settings.DB, endpoint)
+	}
+	return base + path, shard
+}
+
+// doKeyRequest sends a request for the key to the shard owning it. An unreachable owner is
+// skipped and the server given on the command line proxies the request instead.
+func doKeyRequest(method, key, endpoint, body string, expectedStatus int, settings *Settings) (*http.Response, error) {
+	connectCluster(settings)
+	reqURL, shard := shardAPIURL(settings, key, endpoint)
+	resp, err := doRequest(method, reqURL, body, expectedStatus)
+	var urlErr *url.Error
+	proxied := false
+	if shard != nil && errors.As(err, &urlErr) {
+		fmt.Println(colorYellow.Sprintf("Shard %s is unreachable, the request is proxied", shard.Name))
+		resp, err = doRequest(method, BuildAPIURL(settings, endpoint), body, expectedStatus)
+		proxied = true
+	}
+	if err != nil {
+		return nil, err
+	}
+	servedBy := resp.Header.Get(servedByHeader)
+	// a node serving a key it does not own per our ring has seen a membership change
+	if shard != nil && !proxied && servedBy != "" && servedBy != shard.Name {
+		_ = settings.Router.Refresh(context.Background())
+	}
+	if settings.ShowShard {
+		printServedBy(servedBy, proxied)
+	}
+	return resp, nil
+}
+
+func printServedBy(servedBy string, proxied bool) {
+	switch {
+	case servedBy == "":
+		fmt.Printf("%s %s\n", colorYellow.Sprint("Served by:"), "(not a cluster)")
+	case proxied:
+		fmt.Printf("%s %s (proxied)\n", colorYellow.Sprint("Served by:"), servedBy)
+	default:
+		fmt.Printf("%s %s\n", colorYellow.Sprint("Served by:"), servedBy)
+	}
+}
+
+// handleLocateCommand prints the shard owning the key and its address, with the key group
+// the key is placed by when the ring groups keys
+func handleLocateCommand(params []string, settings *Settings) error {
+	if err := checkParamCount(params, 1, "locate"); err != nil {
+		return err
+	}
+	connectCluster(settings)
+	if settings.Router == nil {
+		fmt.Printf("Not a cluster, %s:%d serves every key\n", settings.Host, settings.Port)
+		return nil
+	}
+	key := params[0]
+	ring := settings.Router.Ring()
+	shard := ring.GetShard(key)
+	if shard == nil {
+		return client.ErrNoShard
+	}
+	fmt.Printf("%s %s (%s)\n", colorYellow.Sprint("Shard:"), shard.Name, shard.URL())
+	if delimiter := ring.GroupDelimiter(); delimiter != "" {
+		if group := sharding.GroupKey(key, delimiter); group != key {
+			fmt.Printf("%s %s\n", colorYellow.Sprint("Placed by group:"), group)
+		}
+	}
+	if !shard.Serving() {
+		fmt.Printf("%s %s\n", colorYellow.Sprint("Status:"), shard.Status)
+	}
+	if shard.Mode != "" {
+		fmt.Printf("%s %s\n", colorYellow.Sprint("Mode:"), shard.Mode)
+	}
+	return nil
+}
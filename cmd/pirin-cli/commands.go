@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 )
 
@@ -11,14 +12,17 @@ type Command struct {
 	Name        string
 	Description string
 	Params      []Param
+	Flags       []Param // optional "--name value" pairs or "--name" bool flags, passed to the handler along with params
+	Variadic    bool    // the last param repeats, the command takes at least len(Params) params
 	Handler     func(params []string, settings *Settings) error
 }
 
 // Param represents a parameter for a command.
 type Param struct {
 	Name        string
-	Type        string
+	Type        string // a "bool" flag takes no value
 	Description string
+	Replaces    string // a flag given instead of this positional param
 }
 
 var CommandsRegistry = []Command{
@@ -29,6 +33,9 @@ var CommandsRegistry = []Command{
 			{Name: "key", Type: "string", Description: "The key to set"},
 			{Name: "value", Type: "string", Description: "The value to set"},
 		},
+		Flags: []Param{
+			{Name: "file", Type: "string", Description: "Read the value from a file instead, replaces <value>", Replaces: "value"},
+		},
 		Handler: handleSetCommand,
 	},
 	{
@@ -37,21 +44,187 @@ var CommandsRegistry = []Command{
 		Params: []Param{
 			{Name: "key", Type: "string", Description: "The key to retrieve"},
 		},
+		Flags: []Param{
+			{Name: "out", Type: "string", Description: "Stream the value to a file instead of printing it"},
+		},
 		Handler: handleGetCommand,
 	},
+	{
+		Name:        "locate",
+		Description: "Show the cluster shard owning a given key",
+		Params: []Param{
+			{Name: "key", Type: "string", Description: "The key to locate"},
+		},
+		Handler: handleLocateCommand,
+	},
+	{
+		Name:        "mget",
+		Description: "Retrieve the values of several keys, missing keys are marked",
+		Params: []Param{
+			{Name: "key", Type: "string", Description: "The keys to retrieve"},
+		},
+		Flags: []Param{
+			{Name: "format", Type: "string", Description: "Output format: table (default) or json"},
+		},
+		Variadic: true,
+		Handler:  handleMGetCommand,
+	},
+	{
+		Name:        "mset",
+		Description: "Set the keys and values read from a file of key<TAB>value lines",
+		Flags: []Param{
+			{Name: "file", Type: "string", Description: "File with a key<TAB>value pair on every line, required"},
+		},
+		Handler: handleMSetCommand,
+	},
 	{
 		Name:        "del",
-		Description: "Delete a given key",
+		Description: "Delete a given key, or every key under a prefix",
 		Params: []Param{
 			{Name: "key", Type: "string", Description: "The key to delete"},
 		},
+		Flags: []Param{
+			{Name: "prefix", Type: "string", Description: "Delete every key starting with the prefix, replaces <key>", Replaces: "key"},
+			{Name: "parts", Type: "string", Description: "Delete every composite key starting with the comma separated parts, replaces <key>", Replaces: "key"},
+			{Name: "dry-run", Type: "bool", Description: "With --prefix, only show how many keys would be deleted"},
+			{Name: "yes", Type: "bool", Description: "With --prefix, delete many keys without a confirmation prompt"},
+		},
 		Handler: handleDeleteCommand,
 	},
+	{
+		Name:        "keys",
+		Description: "List a page of the keys of the node, grouped up to a delimiter if one is given",
+		Flags: []Param{
+			{Name: "prefix", Type: "string", Description: "List the keys starting with the prefix"},
+			{Name: "delimiter", Type: "string", Description: "Keys with the delimiter after the prefix are shown once as a common prefix"},
+			{Name: "start-after", Type: "string", Description: "Continue after this key, the last one of the previous page"},
+			{Name: "limit", Type: "int", Description: "Keys and common prefixes shown, 100 by default"},
+			{Name: "long", Type: "bool", Description: "Show the value size next to every key, values are not read"},
+		},
+		Handler: handleKeysCommand,
+	},
 	{
 		Name:        "status",
 		Description: "Request a status from the server",
 		Params:      []Param{},
-		Handler:     handleStatusCommand,
+		Flags: []Param{
+			{Name: "format", Type: "string", Description: "Output format: table (default) or json"},
+		},
+		Handler: handleStatusCommand,
+	},
+	{
+		Name:        "analyze",
+		Description: "Report B-tree shape statistics for a given bucket",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to analyze"},
+		},
+		Flags: []Param{
+			{Name: "prefix", Type: "string", Description: "Estimate the keys and value bytes under the prefix"},
+			{Name: "parts", Type: "string", Description: "Estimate the composite keys starting with the comma separated parts, replaces --prefix"},
+			{Name: "sample", Type: "int", Description: "Keys sampled for the estimate, 100 by default"},
+		},
+		Handler: handleAnalyzeCommand,
+	},
+	{
+		Name:        "top",
+		Description: "Rank the key prefixes of a bucket up to a delimiter by key count and bytes",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to rank"},
+		},
+		Flags: []Param{
+			{Name: "delimiter", Type: "string", Description: "Keys are grouped up to the first delimiter, \":\" by default"},
+			{Name: "top", Type: "int", Description: "Prefixes shown in each ranking, 20 by default"},
+			{Name: "max-keys", Type: "int", Description: "Keys the server reads before it stops, results are then not exact"},
+			{Name: "count-only", Type: "bool", Description: "Rank by key count only, each prefix is skipped with one seek"},
+		},
+		Handler: handleTopCommand,
+	},
+	{
+		Name:        "usage",
+		Description: "Print the bytes and items of every key prefix across all buckets as CSV",
+		Flags: []Param{
+			{Name: "delimiter", Type: "string", Description: "Keys are grouped up to the first delimiter, \":\" by default"},
+			{Name: "wait", Type: "int", Description: "Seconds to wait while the server computes the report, 60 by default"},
+		},
+		Handler: handleUsageCommand,
+	},
+	{
+		Name:        "export",
+		Description: "Export a bucket with JSON values as CSV or NDJSON",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to export"},
+		},
+		Flags: []Param{
+			{Name: "format", Type: "string", Description: "Output format: csv (default) or ndjson"},
+			{Name: "fields", Type: "string", Description: "Comma separated value fields, required for csv"},
+		},
+		Handler: handleExportCommand,
+	},
+	{
+		Name:        "dumpbucket",
+		Description: "Dump a bucket in the binary dump format, to a file or straight into another server",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to dump"},
+		},
+		Flags: []Param{
+			{Name: "out", Type: "string", Description: "File the dump is written to, stdout by default"},
+			{Name: "to", Type: "string", Description: "Base url of a server the dump is loaded into instead"},
+			{Name: "as", Type: "string", Description: "With --to, the bucket loaded into, the same name by default"},
+		},
+		Handler: handleDumpBucketCommand,
+	},
+	{
+		Name:        "loadbucket",
+		Description: "Load a bucket dump into a new or empty bucket",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to load into"},
+		},
+		Flags: []Param{
+			{Name: "in", Type: "string", Description: "File the dump is read from, stdin by default"},
+		},
+		Handler: handleLoadBucketCommand,
+	},
+	{
+		Name:        "diff",
+		Description: "Compare a bucket with the same bucket on a peer node",
+		Params: []Param{
+			{Name: "bucket", Type: "string", Description: "The bucket to compare"},
+		},
+		Flags: []Param{
+			{Name: "peer", Type: "string", Description: "Base url of the peer node, required"},
+			{Name: "peer-db", Type: "string", Description: "Database on the peer, its primary database by default"},
+			{Name: "start", Type: "string", Description: "First key compared"},
+			{Name: "end", Type: "string", Description: "Keys from this one on are not compared"},
+			{Name: "max", Type: "int", Description: "Differences shown, all by default"},
+		},
+		Handler: handleDiffCommand,
+	},
+	{
+		Name:        "lock",
+		Description: "Acquire or release a lock, acquire prints the fencing token",
+		Params: []Param{
+			{Name: "action", Type: "string", Description: "acquire or release"},
+			{Name: "name", Type: "string", Description: "The lock name"},
+		},
+		Flags: []Param{
+			{Name: "ttl", Type: "duration", Description: "Lease duration for acquire, 10s by default"},
+			{Name: "token", Type: "uint", Description: "Fencing token returned by acquire, required for release"},
+		},
+		Handler: handleLockCommand,
+	},
+	{
+		Name:        "use",
+		Description: "Select a database for the following commands",
+		Params: []Param{
+			{Name: "db", Type: "string", Description: "The database name"},
+		},
+		Handler: handleUseCommand,
+	},
+	{
+		Name:        "version",
+		Description: "Show CLI and server versions",
+		Params:      []Param{},
+		Handler:     handleVersionCommand,
 	},
 }
 
@@ -65,7 +238,8 @@ func FindCommand(input string) (*Command, []string, error) {
 
 	for _, cmd := range CommandsRegistry {
 		if cmd.Name == commandName {
-			if len(params) != len(cmd.Params) {
+			flags, positional := ParseFlags(params, cmd.Flags)
+			if !cmd.acceptsParams(len(positional), flags) {
 				return nil, nil, fmt.Errorf("invalid number of parameters for command '%s'", commandName)
 			}
 			return &cmd, params, nil
@@ -73,3 +247,44 @@ func FindCommand(input string) (*Command, []string, error) {
 	}
 	return nil, nil, fmt.Errorf("unknown command: '%s'", commandName)
 }
+
+// expectedParams returns the number of positional params, a flag such as file may replace one
+func (cmd *Command) expectedParams(flags map[string]string) int {
+	expected := len(cmd.Params)
+	for _, flag := range cmd.Flags {
+		if _, ok := flags[flag.Name]; ok && flag.Replaces != "" {
+			expected--
+		}
+	}
+	return expected
+}
+
+// acceptsParams reports whether the command takes n positional params, a variadic command
+// takes the expected number or more
+func (cmd *Command) acceptsParams(n int, flags map[string]string) bool {
+	if cmd.Variadic {
+		return n >= cmd.expectedParams(flags)
+	}
+	return n == cmd.expectedParams(flags)
+}
+
+// ParseFlags splits known "--name value" flags from positional params, a bool flag is
+// set to "true" and takes no value
+func ParseFlags(params []string, known []Param) (map[string]string, []string) {
+	flags := make(map[string]string)
+	positional := make([]string, 0, len(params))
+	for idx := 0; idx < len(params); idx++ {
+		name, isFlag := strings.CutPrefix(params[idx], "--")
+		pos := slices.IndexFunc(known, func(p Param) bool { return p.Name == name })
+		switch {
+		case isFlag && pos >= 0 && known[pos].Type == "bool":
+			flags[name] = "true"
+		case isFlag && pos >= 0 && idx+1 < len(params):
+			flags[name] = params[idx+1]
+			idx++
+		default:
+			positional = append(positional, params[idx])
+		}
+	}
+	return flags, positional
+}
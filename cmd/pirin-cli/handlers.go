@@ -1,10 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
 	"io"
 	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+)
+
+const (
+	uploadThreshold = 4 * 1024 * 1024
+	uploadChunkSize = 1024 * 1024
+	// deletePrefixConfirmThreshold is the number of matching keys above which a prefix
+	// delete asks for confirmation, or requires --yes outside of interactive mode
+	deletePrefixConfirmThreshold = 100
+	// keys of one mget request, the server limit
+	mgetChunkKeys = 100
+	// pairs and key and value bytes of one batch request, the body must stay below the
+	// server value size limit
+	msetBatchPairs = 1000
+	msetBatchBytes = 512 * 1024
 )
 
 func checkParamCount(params []string, expected int, commandName string) error {
@@ -36,18 +63,34 @@ func doRequest(method, url string, body string, expectedStatus int) (*http.Respo
 		defer func() {
 			_ = resp.Body.Close()
 		}()
-		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+		return nil, &statusError{status: resp.Status, code: resp.StatusCode}
 	}
 	return resp, nil
 }
 
+// statusError is returned by doRequest for a response with another status than expected
+type statusError struct {
+	status string
+	code   int
+}
+
+func (e *statusError) Error() string {
+	return "unexpected status code: " + e.status
+}
+
 func handleSetCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "file"}})
+	if filename, ok := flags["file"]; ok {
+		if err := checkParamCount(params, 1, "set"); err != nil {
+			return err
+		}
+		return setFromFile(params[0], filename, settings)
+	}
 	if err := checkParamCount(params, 2, "set"); err != nil {
 		return err
 	}
 	key, value := params[0], params[1]
-	url := BuildURL(settings, fmt.Sprintf("/api/v1/kv/%s", key))
-	resp, err := doRequest("POST", url, value, http.StatusCreated)
+	resp, err := doKeyRequest("POST", key, fmt.Sprintf("/kv/%s", key), value, http.StatusCreated, settings)
 	if err != nil {
 		return err
 	}
@@ -57,12 +100,92 @@ func handleSetCommand(params []string, settings *Settings) error {
 	return nil
 }
 
+// setFromFile sends small files in a single request and uses chunked upload above uploadThreshold
+func setFromFile(key, filename string, settings *Settings) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() <= uploadThreshold {
+		value, readErr := io.ReadAll(file)
+		if readErr != nil {
+			return readErr
+		}
+		resp, reqErr := doKeyRequest("POST", key, fmt.Sprintf("/kv/%s", key), string(value), http.StatusCreated, settings)
+		if reqErr != nil {
+			return reqErr
+		}
+		return resp.Body.Close()
+	}
+	return uploadChunked(key, file, settings)
+}
+
+func uploadChunked(key string, file io.Reader, settings *Settings) error {
+	resp, err := doRequest("POST", BuildAPIURL(settings, "/kv/"+url.PathEscape(key)+"/upload"), "", http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadID string `json:"upload_id"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&upload)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	chunk := make([]byte, uploadChunkSize)
+	offset := 0
+	for {
+		n, readErr := io.ReadFull(file, chunk)
+		if n > 0 {
+			chunkURL := BuildAPIURL(settings, fmt.Sprintf("/uploads/%s?offset=%d", url.PathEscape(upload.UploadID), offset))
+			resp, err = doRequest("PUT", chunkURL, string(chunk[:n]), http.StatusOK)
+			if err != nil {
+				return err
+			}
+			_ = resp.Body.Close()
+			offset += n
+		}
+		if readErr == io.EOF || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	resp, err = doRequest("POST", BuildAPIURL(settings, fmt.Sprintf("/uploads/%s/commit", url.PathEscape(upload.UploadID))), "", http.StatusCreated)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
 func handleGetCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "out"}})
 	if err := checkParamCount(params, 1, "get"); err != nil {
 		return err
 	}
-	url := BuildURL(settings, fmt.Sprintf("/api/v1/kv/%s", params[0]))
-	resp, err := doRequest("GET", url, "", http.StatusOK)
+	key := params[0]
+	if out, ok := flags["out"]; ok {
+		return downloadValue(key, out, false, settings)
+	}
+	resp, err := doKeyRequest("GET", key, fmt.Sprintf("/kv/%s", key), "", http.StatusOK, settings)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == http.StatusRequestEntityTooLarge {
+		// the server refuses to put the value into a JSON document, it is streamed instead
+		out := url.PathEscape(key)
+		fmt.Println(colorYellow.Sprintf("The value is too large to print, saving it to %s", out))
+		return downloadValue(key, out, true, settings)
+	}
 	if err != nil {
 		return err
 	}
@@ -73,26 +196,438 @@ func handleGetCommand(params []string, settings *Settings) error {
 	return nil
 }
 
+// downloadValue streams the value bytes of the key into the file, a new file only keeps an
+// existing one from being overwritten
+func downloadValue(key, filename string, newFile bool, settings *Settings) error {
+	connectCluster(settings)
+	reqURL, _ := shardAPIURL(settings, key, fmt.Sprintf("/kv/%s", key))
+	req, err := http.NewRequest(http.MethodGet, reqURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{status: resp.Status, code: resp.StatusCode}
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if newFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+	file, err := os.OpenFile(filename, flag, 0o644)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save the value: %w", err)
+	}
+	fmt.Printf("Saved %d bytes to %s\n", written, filename)
+	return nil
+}
+
+// mgetItem is a key read by mget, Value is nil for a missing key
+type mgetItem struct {
+	Key   string  `json:"key"`
+	Value *string `json:"value,omitempty"`
+	Found bool    `json:"found"`
+}
+
+// errMultiKeyUnavailable is returned by the mget and batch endpoints of a cluster node
+var errMultiKeyUnavailable = errors.New("multi-key requests are not available")
+
+// handleMGetCommand prints the values of the keys in the order given, with the server mget
+// endpoint if it has one and key by key otherwise
+func handleMGetCommand(params []string, settings *Settings) error {
+	flags, keys := ParseFlags(params, []Param{{Name: "format"}})
+	if len(keys) == 0 {
+		return fmt.Errorf("invalid number of parameters for 'mget' command")
+	}
+	format := flags["format"]
+	if format != "" && format != "table" && format != "json" {
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	items, err := mget(keys, settings)
+	if err != nil {
+		return err
+	}
+	if format == "json" {
+		PrintJSON(items)
+		return nil
+	}
+	PrintMGet(items)
+	return nil
+}
+
+func mget(keys []string, settings *Settings) ([]mgetItem, error) {
+	if serverHasFeature(settings, "mget") {
+		items, err := mgetBatched(keys, settings)
+		if !errors.Is(err, errMultiKeyUnavailable) {
+			return items, err
+		}
+	}
+	items := make([]mgetItem, 0, len(keys))
+	for _, key := range keys {
+		value, found, err := getValue(key, settings)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, mgetItem{Key: key, Value: value, Found: found})
+	}
+	return items, nil
+}
+
+// mgetBatched reads the keys with an mget request for every mgetChunkKeys keys
+func mgetBatched(keys []string, settings *Settings) ([]mgetItem, error) {
+	items := make([]mgetItem, 0, len(keys))
+	for chunk := range slices.Chunk(keys, mgetChunkKeys) {
+		resp, err := http.Get(BuildAPIURL(settings, "/mget?"+url.Values{"key": chunk}.Encode()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send request: %w", err)
+		}
+		var body struct {
+			Items []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Found bool   `json:"found"`
+			} `json:"items"`
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&body)
+		case http.StatusConflict:
+			err = errMultiKeyUnavailable
+		default:
+			err = fmt.Errorf("unexpected status code: %s", resp.Status)
+		}
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range body.Items {
+			result := mgetItem{Key: item.Key, Found: item.Found}
+			if item.Found {
+				result.Value = &item.Value
+			}
+			items = append(items, result)
+		}
+	}
+	return items, nil
+}
+
+// getValue reads a key, a missing key is not an error
+func getValue(key string, settings *Settings) (*string, bool, error) {
+	resp, err := http.Get(BuildAPIURL(settings, "/kv/"+url.PathEscape(key)))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &body.Value, true, nil
+}
+
+// kvPair is a key and value of mset, in the form of a batch item
+type kvPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleMSetCommand stores the pairs of a key<TAB>value file, with the server batch endpoint
+// if it has one, a transaction for every batch, and key by key otherwise
+func handleMSetCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "file"}})
+	if err := checkParamCount(params, 0, "mset"); err != nil {
+		return err
+	}
+	filename, ok := flags["file"]
+	if !ok {
+		return errors.New("mset requires --file")
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	pairs, err := readPairs(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	stored, err := mset(pairs, settings)
+	if err != nil {
+		return fmt.Errorf("stored %d of %d keys: %w", stored, len(pairs), err)
+	}
+	fmt.Printf("Stored %d keys\n", stored)
+	return nil
+}
+
+// readPairs reads lines of a key, a tab and a value, the value is the rest of the line and may
+// hold tabs. Empty lines are skipped.
+func readPairs(r io.Reader) ([]kvPair, error) {
+	reader := bufio.NewReader(r)
+	var pairs []kvPair
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line != "" {
+			key, value, found := strings.Cut(line, "\t")
+			if !found || key == "" {
+				return nil, fmt.Errorf("line %d: expected key<TAB>value", lineNum)
+			}
+			pairs = append(pairs, kvPair{Key: key, Value: value})
+		}
+		if err == io.EOF {
+			return pairs, nil
+		}
+	}
+}
+
+func mset(pairs []kvPair, settings *Settings) (int, error) {
+	stored := 0
+	if serverHasFeature(settings, "batch") {
+		var err error
+		stored, err = msetBatched(pairs, settings)
+		if !errors.Is(err, errMultiKeyUnavailable) {
+			return stored, err
+		}
+	}
+	for _, pair := range pairs[stored:] {
+		resp, err := doRequest("POST", BuildAPIURL(settings, "/kv/"+url.PathEscape(pair.Key)), pair.Value, http.StatusCreated)
+		if err != nil {
+			return stored, err
+		}
+		_ = resp.Body.Close()
+		stored++
+	}
+	return stored, nil
+}
+
+// msetBatched sends the pairs in batches of at most msetBatchPairs pairs and msetBatchBytes
+// of keys and values, a larger pair is sent alone. It returns the pairs stored.
+func msetBatched(pairs []kvPair, settings *Settings) (int, error) {
+	stored := 0
+	for stored < len(pairs) {
+		end, size := stored, 0
+		for end < len(pairs) && end-stored < msetBatchPairs &&
+			(end == stored || size+len(pairs[end].Key)+len(pairs[end].Value) <= msetBatchBytes) {
+			size += len(pairs[end].Key) + len(pairs[end].Value)
+			end++
+		}
+		body, err := json.Marshal(map[string][]kvPair{"items": pairs[stored:end]})
+		if err != nil {
+			return stored, err
+		}
+		req, err := http.NewRequest("POST", BuildAPIURL(settings, "/batch"), bytes.NewReader(body))
+		if err != nil {
+			return stored, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return stored, fmt.Errorf("failed to send request: %w", err)
+		}
+		_ = resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusCreated:
+		case http.StatusConflict:
+			return stored, errMultiKeyUnavailable
+		default:
+			return stored, fmt.Errorf("unexpected status code: %s", resp.Status)
+		}
+		stored = end
+	}
+	return stored, nil
+}
+
+// serverHasFeature reports whether the server lists the feature in /version, a server that
+// can not be asked has none
+func serverHasFeature(settings *Settings, feature string) bool {
+	info, err := client.New(BuildURL(settings, "")).ServerVersion(context.Background())
+	return err == nil && slices.Contains(info.Features, feature)
+}
+
 func handleDeleteCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "prefix"}, {Name: "parts"}, {Name: "dry-run", Type: "bool"}, {Name: "yes", Type: "bool"}})
+	if prefix, ok := prefixFlag(flags); ok {
+		if err := checkParamCount(params, 0, "del"); err != nil {
+			return err
+		}
+		return deletePrefix(prefix, flags["dry-run"] == "true", flags["yes"] == "true", settings)
+	}
 	if err := checkParamCount(params, 1, "del"); err != nil {
 		return err
 	}
-	url := BuildURL(settings, fmt.Sprintf("/api/v1/kv/%s", params[0]))
-	resp, err := doRequest("DELETE", url, "", http.StatusNoContent)
+	resp, err := doKeyRequest("DELETE", params[0], fmt.Sprintf("/kv/%s", params[0]), "", http.StatusOK, settings)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	PrintJSONResponse(resp)
+	return nil
+}
+
+// keyListResult mirrors the server key listing
+type keyListResult struct {
+	Keys           []string `json:"keys"`
+	Sizes          []int    `json:"sizes"`
+	CommonPrefixes []string `json:"common_prefixes"`
+	Next           string   `json:"next"`
+}
+
+// handleKeysCommand prints a page of keys, with --long the sizes the server reads from the
+// item references without reading the values
+func handleKeysCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "prefix"}, {Name: "delimiter"}, {Name: "start-after"},
+		{Name: "limit"}, {Name: "long", Type: "bool"}})
+	if err := checkParamCount(params, 0, "keys"); err != nil {
+		return err
+	}
+	long := flags["long"] == "true"
+	query := url.Values{"prefix": {flags["prefix"]}, "delimiter": {flags["delimiter"]}, "start_after": {flags["start-after"]}}
+	if limit, ok := flags["limit"]; ok {
+		query.Set("limit", limit)
+	}
+	if long {
+		query.Set("include_sizes", "true")
+	}
+	resp, err := doRequest("GET", BuildAPIURL(settings, "/kv?"+query.Encode()), "", http.StatusOK)
 	if err != nil {
 		return err
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
+	var result keyListResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if long && len(result.Sizes) != len(result.Keys) {
+		return errors.New("the server does not report value sizes, --long needs a newer server")
+	}
+	WriteKeys(os.Stdout, &result, long)
+	if result.Next != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "more keys follow, continue with --start-after %s\n", result.Next)
+	}
 	return nil
 }
 
+// prefixFlag returns the --prefix flag, or the composite key prefix encoded from the comma
+// separated --parts flag, so the prefix matches no key with other first parts
+func prefixFlag(flags map[string]string) (string, bool) {
+	parts, ok := flags["parts"]
+	if !ok {
+		prefix, ok := flags["prefix"]
+		return prefix, ok
+	}
+	var encoded [][]byte
+	for _, part := range strings.Split(parts, ",") {
+		encoded = append(encoded, []byte(part))
+	}
+	return string(keys.Encode(encoded...)), true
+}
+
+// deletePrefixResult mirrors the server prefix delete response
+type deletePrefixResult struct {
+	Count  int      `json:"count"`
+	Sample []string `json:"sample"`
+}
+
+// deletePrefix counts the keys under the prefix first, so a large delete is confirmed
+// before anything is removed
+func deletePrefix(prefix string, dryRun, yes bool, settings *Settings) error {
+	if prefix == "" {
+		return errors.New("--prefix must not be empty")
+	}
+	matched, err := requestDeletePrefix(prefix, true, settings)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		fmt.Printf("%d keys would be deleted\n", matched.Count)
+		for _, key := range matched.Sample {
+			fmt.Printf("  %s\n", key)
+		}
+		if len(matched.Sample) < matched.Count {
+			fmt.Printf("  ... and %d more\n", matched.Count-len(matched.Sample))
+		}
+		return nil
+	}
+	if matched.Count == 0 {
+		fmt.Println("No keys match the prefix")
+		return nil
+	}
+	if matched.Count > deletePrefixConfirmThreshold && !yes {
+		if settings.Confirm == nil {
+			return fmt.Errorf("%d keys match prefix %q, pass --yes to delete them", matched.Count, prefix)
+		}
+		if !settings.Confirm(fmt.Sprintf("Delete %d keys matching prefix %q? [y/N] ", matched.Count, prefix)) {
+			fmt.Println("Nothing deleted")
+			return nil
+		}
+	}
+	deleted, err := requestDeletePrefix(prefix, false, settings)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted %d keys\n", deleted.Count)
+	return nil
+}
+
+func requestDeletePrefix(prefix string, dryRun bool, settings *Settings) (*deletePrefixResult, error) {
+	query := url.Values{"prefix": {prefix}, "dry_run": {strconv.FormatBool(dryRun)}}
+	resp, err := doRequest("DELETE", BuildAPIURL(settings, "/kv?"+query.Encode()), "", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var result deletePrefixResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result, nil
+}
+
 func handleStatusCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "format"}})
 	if err := checkParamCount(params, 0, "status"); err != nil {
 		return err
 	}
-	url := BuildURL(settings, "/api/v1/db/status")
+	format := flags["format"]
+	if format != "" && format != "table" && format != "json" {
+		return fmt.Errorf("unknown format: %s", format)
+	}
+	url := BuildAPIURL(settings, "/db/status")
 	resp, err := doRequest("GET", url, "", http.StatusOK)
 	if err != nil {
 		return err
@@ -100,6 +635,469 @@ func handleStatusCommand(params []string, settings *Settings) error {
 	defer func() {
 		_ = resp.Body.Close()
 	}()
+	if format == "json" {
+		PrintJSONResponse(resp)
+		return nil
+	}
+	var stat storage.DBStat
+	if err = json.NewDecoder(resp.Body).Decode(&stat); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	PrintDBStat(&stat)
+	return nil
+}
+
+func handleAnalyzeCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "prefix"}, {Name: "parts"}, {Name: "sample"}})
+	if err := checkParamCount(params, 1, "analyze"); err != nil {
+		return err
+	}
+	url := BuildAPIURL(settings, fmt.Sprintf("/db/analyze/%s", params[0]))
+	resp, err := doRequest("GET", url, "", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var stats storage.TreeStats
+	if err = json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	PrintTreeStats(&stats)
+	prefix, withPrefix := prefixFlag(flags)
+	_, withSample := flags["sample"]
+	if !withPrefix && !withSample {
+		return nil
+	}
+	sample, err := requestSample(params[0], prefix, flags["sample"], settings)
+	if err != nil {
+		return err
+	}
+	PrintSample(sample)
+	return nil
+}
+
+// sampleResult mirrors the server key sample response
+type sampleResult struct {
+	Prefix         string  `json:"prefix"`
+	Total          uint64  `json:"total"`
+	AvgValueSize   float64 `json:"avg_value_size"`
+	EstimatedBytes uint64  `json:"estimated_bytes"`
+	Keys           []struct {
+		Key  string `json:"key"`
+		Size int    `json:"size"`
+	} `json:"keys"`
+}
+
+func requestSample(bucket, prefix, n string, settings *Settings) (*sampleResult, error) {
+	query := url.Values{"prefix": {prefix}}
+	if n != "" {
+		query.Set("n", n)
+	}
+	resp, err := doRequest("GET", BuildAPIURL(settings, fmt.Sprintf("/buckets/%s/sample?%s", bucket, query.Encode())), "", http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var result sampleResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &result, nil
+}
+
+// prefixStatsResult mirrors the server prefix stats response
+type prefixStatsResult struct {
+	Delimiter string         `json:"delimiter"`
+	ByCount   []prefixResult `json:"by_count"`
+	ByBytes   []prefixResult `json:"by_bytes"`
+	Prefixes  int            `json:"prefixes"`
+	Keys      uint64         `json:"keys"`
+	Visited   int            `json:"visited"`
+	Exact     bool           `json:"exact"`
+}
+
+type prefixResult struct {
+	Prefix string `json:"prefix"`
+	Count  uint64 `json:"count"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+func handleTopCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "delimiter"}, {Name: "top"}, {Name: "max-keys"},
+		{Name: "count-only", Type: "bool"}})
+	if err := checkParamCount(params, 1, "top"); err != nil {
+		return err
+	}
+	query := url.Values{"delimiter": {":"}}
+	if delimiter, ok := flags["delimiter"]; ok {
+		query.Set("delimiter", delimiter)
+	}
+	if top, ok := flags["top"]; ok {
+		query.Set("top", top)
+	}
+	if maxKeys, ok := flags["max-keys"]; ok {
+		query.Set("max_keys", maxKeys)
+	}
+	if flags["count-only"] == "true" {
+		query.Set("bytes", "false")
+	}
+	path := fmt.Sprintf("/buckets/%s/prefix-stats?%s", url.PathEscape(params[0]), query.Encode())
+	resp, err := doRequest("GET", BuildAPIURL(settings, path), "", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	var result prefixStatsResult
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	PrintPrefixStats(&result)
+	return nil
+}
+
+// usageResult mirrors the server usage report
+type usageResult struct {
+	Delimiter  string        `json:"delimiter"`
+	ComputedAt time.Time     `json:"computed_at"`
+	Buckets    int           `json:"buckets"`
+	Prefixes   []usagePrefix `json:"prefixes"`
+	Truncated  bool          `json:"truncated"`
+}
+
+type usagePrefix struct {
+	Prefix string `json:"prefix"`
+	Bytes  uint64 `json:"bytes"`
+	Items  uint64 `json:"items"`
+}
+
+// handleUsageCommand prints the usage per prefix as CSV, while the server computes the report
+// it is polled as its Retry-After asks until --wait runs out
+func handleUsageCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "delimiter"}, {Name: "wait", Type: "int"}})
+	if err := checkParamCount(params, 0, "usage"); err != nil {
+		return err
+	}
+	query := url.Values{"delimiter": {":"}}
+	if delimiter, ok := flags["delimiter"]; ok {
+		query.Set("delimiter", delimiter)
+	}
+	wait := 60 * time.Second
+	if value, ok := flags["wait"]; ok {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("invalid --wait %q", value)
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+	usageURL := BuildAPIURL(settings, "/usage?"+query.Encode())
+	deadline := time.Now().Add(wait)
+	for {
+		resp, err := http.Get(usageURL)
+		if err != nil {
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			var result usageResult
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			_ = resp.Body.Close()
+			if err != nil {
+				return fmt.Errorf("failed to parse response: %w", err)
+			}
+			if result.Truncated {
+				_, _ = fmt.Fprintln(os.Stderr, "a bucket has too many prefixes, the smallest are missing")
+			}
+			return WriteUsageCSV(os.Stdout, &result)
+		case http.StatusAccepted:
+			_ = resp.Body.Close()
+			retry, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if err != nil || retry <= 0 {
+				retry = 1
+			}
+			pause := time.Duration(retry) * time.Second
+			if time.Now().Add(pause).After(deadline) {
+				return errors.New("the server is still computing the usage, try again later")
+			}
+			_, _ = fmt.Fprintln(os.Stderr, "the server is computing the usage...")
+			time.Sleep(pause)
+		default:
+			_ = resp.Body.Close()
+			return fmt.Errorf("unexpected status code: %s", resp.Status)
+		}
+	}
+}
+
+// handleExportCommand streams the export to stdout, the count of skipped malformed
+// values arrives in a trailer and is reported on stderr
+func handleExportCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "format"}, {Name: "fields"}})
+	if err := checkParamCount(params, 1, "export"); err != nil {
+		return err
+	}
+	query := url.Values{}
+	if format, ok := flags["format"]; ok {
+		query.Set("format", format)
+	}
+	if fields, ok := flags["fields"]; ok {
+		query.Set("fields", fields)
+	}
+	exportURL := BuildAPIURL(settings, fmt.Sprintf("/buckets/%s/export?%s", params[0], query.Encode()))
+	resp, err := doRequest("GET", exportURL, "", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if _, err = io.Copy(os.Stdout, resp.Body); err != nil {
+		return fmt.Errorf("failed to read export: %w", err)
+	}
+	rows := resp.Trailer.Get("X-Pirin-Export-Rows")
+	if rows == "" {
+		return errors.New("export was interrupted")
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "exported %s rows, skipped %s malformed values\n", rows, resp.Trailer.Get("X-Pirin-Export-Errors"))
+	return nil
+}
+
+// handleDumpBucketCommand writes the dump of the bucket to a file or stdout, or pipes it into
+// the load endpoint of the server given with --to
+func handleDumpBucketCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "out"}, {Name: "to"}, {Name: "as"}})
+	if err := checkParamCount(params, 1, "dumpbucket"); err != nil {
+		return err
+	}
+	resp, err := doRequest("GET", BuildAPIURL(settings, fmt.Sprintf("/buckets/%s/dump", params[0])), "", http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if target, ok := flags["to"]; ok {
+		bucket := params[0]
+		if as, ok := flags["as"]; ok {
+			bucket = as
+		}
+		// the target checks the end of the dump, a cut stream fails the load
+		return loadBucket(fmt.Sprintf("%s/api/v1/buckets/%s/load", strings.TrimSuffix(target, "/"), bucket), resp.Body)
+	}
+	var out io.Writer = os.Stdout
+	if filename, ok := flags["out"]; ok {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		out = file
+	}
+	if _, err = io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("failed to read dump: %w", err)
+	}
+	keys := resp.Trailer.Get("X-Pirin-Dump-Keys")
+	if keys == "" {
+		return errors.New("dump was interrupted")
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "dumped %s keys\n", keys)
+	return nil
+}
+
+// handleLoadBucketCommand sends a dump from a file or stdin to the load endpoint
+func handleLoadBucketCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "in"}})
+	if err := checkParamCount(params, 1, "loadbucket"); err != nil {
+		return err
+	}
+	var in io.Reader = os.Stdin
+	if filename, ok := flags["in"]; ok {
+		file, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		in = file
+	}
+	return loadBucket(BuildAPIURL(settings, fmt.Sprintf("/buckets/%s/load", params[0])), in)
+}
+
+// loadBucket streams the dump to the load url and prints the load job
+func loadBucket(loadURL string, dump io.Reader) error {
+	req, err := http.NewRequest("POST", loadURL, dump)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusCreated && resp.Header.Get("X-Pirin-Load-Job") == "" {
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
 	PrintJSONResponse(resp)
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("load failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// diffLine mirrors a line of the server diff stream
+type diffLine struct {
+	Key     string `json:"key"`
+	Kind    string `json:"kind"`
+	Summary *struct {
+		Compared  int    `json:"compared"`
+		OnlyInA   int    `json:"only_in_a"`
+		OnlyInB   int    `json:"only_in_b"`
+		Changed   int    `json:"changed"`
+		Equal     bool   `json:"equal"`
+		Truncated bool   `json:"truncated"`
+		Error     string `json:"error"`
+	} `json:"summary"`
+}
+
+// handleDiffCommand prints the differences as the server streams them, side a is the
+// server the CLI talks to and side b the peer
+func handleDiffCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "peer"}, {Name: "peer-db"}, {Name: "start"}, {Name: "end"}, {Name: "max"}})
+	if err := checkParamCount(params, 1, "diff"); err != nil {
+		return err
+	}
+	if flags["peer"] == "" {
+		return errors.New("diff requires --peer")
+	}
+	request := map[string]any{"peer": flags["peer"], "peer_db": flags["peer-db"], "bucket": params[0],
+		"start": flags["start"], "end": flags["end"]}
+	if maxEntries, ok := flags["max"]; ok {
+		n, err := strconv.Atoi(maxEntries)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid --max: %s", maxEntries)
+		}
+		request["max_entries"] = n
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := doRequest("POST", BuildAPIURL(settings, "/admin/diff"), string(body), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var line diffLine
+		if err = decoder.Decode(&line); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+		if summary := line.Summary; summary != nil {
+			fmt.Printf("%d keys compared, %d only here, %d only on the peer, %d changed\n",
+				summary.Compared, summary.OnlyInA, summary.OnlyInB, summary.Changed)
+			if summary.Truncated {
+				fmt.Println("more differences were not shown")
+			}
+			if summary.Error != "" {
+				return fmt.Errorf("diff stopped early: %s", summary.Error)
+			}
+			return nil
+		}
+		fmt.Printf("%-10s %s\n", line.Kind, line.Key)
+	}
+	return errors.New("diff was interrupted")
+}
+
+func handleLockCommand(params []string, settings *Settings) error {
+	flags, params := ParseFlags(params, []Param{{Name: "ttl"}, {Name: "token"}})
+	if err := checkParamCount(params, 2, "lock"); err != nil {
+		return err
+	}
+	action, name := params[0], url.PathEscape(params[1])
+	switch action {
+	case "acquire":
+		query := ""
+		if ttl, ok := flags["ttl"]; ok {
+			query = "?ttl=" + url.QueryEscape(ttl)
+		}
+		resp, err := doRequest("POST", BuildAPIURL(settings, "/locks/"+name+query), "", http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		PrintJSONResponse(resp)
+		return nil
+	case "release":
+		token, ok := flags["token"]
+		if !ok {
+			return errors.New("lock release requires --token")
+		}
+		resp, err := doRequest("DELETE", BuildAPIURL(settings, "/locks/"+name+"?token="+url.QueryEscape(token)), "", http.StatusOK)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = resp.Body.Close()
+		}()
+		PrintJSONResponse(resp)
+		return nil
+	default:
+		return fmt.Errorf("unknown lock action: %s", action)
+	}
+}
+
+func handleUseCommand(params []string, settings *Settings) error {
+	if err := checkParamCount(params, 1, "use"); err != nil {
+		return err
+	}
+	settings.DB = params[0]
+	fmt.Printf("Using database %s\n", settings.DB)
+	return nil
+}
+
+func handleVersionCommand(params []string, settings *Settings) error {
+	if err := checkParamCount(params, 0, "version"); err != nil {
+		return err
+	}
+	fmt.Printf("%s %s\n", colorYellow.Sprint("CLI version:"), version)
+	info, err := client.New(BuildURL(settings, "")).ServerVersion(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s (commit %s)\n", colorYellow.Sprint("Server version:"), info.Version, info.GitCommit)
+	fmt.Printf("%s %d.%d\n", colorYellow.Sprint("Storage format:"), info.StorageFormatMajor, info.StorageFormatMinor)
+	fmt.Printf("%s %s\n", colorYellow.Sprint("Features:"), strings.Join(info.Features, ", "))
+	warnVersionMismatch(info)
 	return nil
 }
+
+// checkServerVersion warns when the server major version differs from the CLI one,
+// an unreachable server is reported by the first command instead
+func checkServerVersion(settings *Settings) {
+	info, err := client.New(BuildURL(settings, "")).ServerVersion(context.Background())
+	if err != nil {
+		return
+	}
+	warnVersionMismatch(info)
+}
+
+func warnVersionMismatch(info *client.VersionInfo) {
+	if client.MajorVersion(info.Version) != client.MajorVersion(version) {
+		_, _ = colorYellowBold.Printf("Warning: server version %s differs from CLI version %s\n", info.Version, version)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/pkg/sharding"
+)
+
+func TestFindCommandVariadic(t *testing.T) {
+	cmd, params, err := FindCommand("mget a b --format json c")
+	require.NoError(t, err)
+	require.Equal(t, "mget", cmd.Name)
+	require.Equal(t, []string{"a", "b", "--format", "json", "c"}, params)
+	_, _, err = FindCommand("mget --format json")
+	require.Error(t, err)
+	_, _, err = FindCommand("get a b")
+	require.Error(t, err)
+	require.Equal(t, "mget <key>...", buildCommandUsage(*cmd))
+}
+
+func TestReadPairs(t *testing.T) {
+	pairs, err := readPairs(strings.NewReader("a\t1\r\n\nb\tx\ty\nempty\t\nlast\tno newline"))
+	require.NoError(t, err)
+	require.Equal(t, []kvPair{{"a", "1"}, {"b", "x\ty"}, {"empty", ""}, {"last", "no newline"}}, pairs)
+	_, err = readPairs(strings.NewReader("a\t1\nno tab\n"))
+	require.ErrorContains(t, err, "line 2")
+	_, err = readPairs(strings.NewReader("\tvalue\n"))
+	require.ErrorContains(t, err, "line 1")
+}
+
+// fakeServer serves kv requests from a map, with the mget and batch endpoints when features
+// lists them. It counts the requests by path.
+type fakeServer struct {
+	features []string
+	values   map[string]string
+	requests map[string]int
+	name     string           // cluster node name, sent as served by
+	ring     *client.RingInfo // the cluster ring, set on a sharded server
+	maxJSON  int              // longer values are refused on the JSON path, 0 has no limit
+}
+
+func (fs *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	endpoint, _, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(path, "/api/v1"), "/"), "/")
+	fs.requests[endpoint]++
+	if fs.name != "" {
+		w.Header().Set(servedByHeader, fs.name)
+	}
+	switch {
+	case path == "/version":
+		_ = json.NewEncoder(w).Encode(map[string]any{"version": version, "features": fs.features, "sharding": fs.ring != nil})
+	case path == "/cluster/ring" && fs.ring != nil:
+		_ = json.NewEncoder(w).Encode(fs.ring)
+	case path == "/api/v1/mget" && strings.Contains(strings.Join(fs.features, ","), "mget"):
+		var items []map[string]any
+		for _, key := range r.URL.Query()["key"] {
+			value, found := fs.values[key]
+			items = append(items, map[string]any{"key": key, "value": value, "found": found})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"items": items})
+	case path == "/api/v1/batch" && strings.Contains(strings.Join(fs.features, ","), "batch"):
+		var body struct {
+			Items []kvPair `json:"items"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for _, item := range body.Items {
+			fs.values[item.Key] = item.Value
+		}
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, "/api/v1/kv/"):
+		key := strings.TrimPrefix(path, "/api/v1/kv/")
+		if r.Method == http.MethodPost {
+			data, _ := io.ReadAll(r.Body)
+			fs.values[key] = string(data)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		value, found := fs.values[key]
+		switch {
+		case !found:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Header.Get("Accept") == "application/octet-stream":
+			_, _ = io.WriteString(w, value)
+		case fs.maxJSON > 0 && len(value) > fs.maxJSON:
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]string{"value": value})
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestMGetMSet(t *testing.T) {
+	pairs := "a\t1\nb\ttwo words\nc\t\n"
+	filename := filepath.Join(t.TempDir(), "pairs.txt")
+	require.NoError(t, os.WriteFile(filename, []byte(pairs), 0600))
+	expected := []mgetItem{{Key: "b", Value: ptr("two words"), Found: true}, {Key: "missing"},
+		{Key: "a", Value: ptr("1"), Found: true}, {Key: "c", Value: ptr(""), Found: true}}
+
+	for _, tt := range []struct {
+		name     string
+		features []string
+		requests map[string]int
+	}{
+		// an older server gets a request for every key
+		{"key by key", []string{"multi_db"}, map[string]int{"kv": 7}},
+		{"batched", []string{"mget", "batch"}, map[string]int{"mget": 1, "batch": 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &fakeServer{features: tt.features, values: make(map[string]string), requests: make(map[string]int)}
+			ts := httptest.NewServer(fs)
+			defer ts.Close()
+			host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+			require.NoError(t, err)
+			settings := &Settings{Host: host}
+			settings.Port, _ = strconv.Atoi(port)
+
+			out := captureStdout(t, func() {
+				require.NoError(t, handleMSetCommand([]string{"--file", filename}, settings))
+			})
+			require.Equal(t, "Stored 3 keys\n", out)
+			require.Equal(t, map[string]string{"a": "1", "b": "two words", "c": ""}, fs.values)
+
+			items, err := mget([]string{"b", "missing", "a", "c"}, settings)
+			require.NoError(t, err)
+			require.Equal(t, expected, items)
+			delete(fs.requests, "version")
+			require.Equal(t, tt.requests, fs.requests)
+
+			out = captureStdout(t, func() {
+				require.NoError(t, handleMGetCommand([]string{"b", "missing", "--format", "json"}, settings))
+			})
+			var printed []map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &printed), out)
+			require.Equal(t, []map[string]any{{"key": "b", "value": "two words", "found": true},
+				{"key": "missing", "found": false}}, printed)
+			out = captureStdout(t, func() {
+				require.NoError(t, handleMGetCommand([]string{"b", "missing"}, settings))
+			})
+			require.Equal(t, "KEY      VALUE\nb        two words\nmissing  (not found)\n", out)
+		})
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	nodes := make([]*fakeServer, 2)
+	servers := make([]*httptest.Server, 2)
+	ring := &client.RingInfo{}
+	for i := range nodes {
+		nodes[i] = &fakeServer{name: fmt.Sprintf("node%d", i+1), values: make(map[string]string), requests: make(map[string]int), ring: ring}
+		servers[i] = httptest.NewServer(nodes[i])
+		defer servers[i].Close()
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(servers[i].URL, "http://"))
+		require.NoError(t, err)
+		portN, _ := strconv.Atoi(port)
+		ring.Shards = append(ring.Shards, &sharding.Shard{Name: nodes[i].name, Host: host, Port: portN, Status: sharding.ShardActive})
+	}
+	placement, err := sharding.NewConsistentHashFromState(ring.State())
+	require.NoError(t, err)
+	// keys owned by node2, the CLI is pointed at node1
+	var owned []string
+	for i := 0; len(owned) < 2; i++ {
+		if key := fmt.Sprintf("key%d", i); placement.GetShard(key).Name == "node2" {
+			owned = append(owned, key)
+		}
+	}
+	settings := &Settings{Host: ring.Shards[0].Host, Port: ring.Shards[0].Port, ShowShard: true}
+
+	out := captureStdout(t, func() {
+		require.NoError(t, handleSetCommand([]string{owned[0], "value"}, settings))
+	})
+	require.Equal(t, "Served by: node2\n", out)
+	require.Equal(t, map[string]string{owned[0]: "value"}, nodes[1].values)
+	require.Empty(t, nodes[0].values)
+	require.Equal(t, 2, shardCount(settings))
+
+	out = captureStdout(t, func() {
+		require.NoError(t, handleGetCommand([]string{owned[0]}, settings))
+	})
+	require.Contains(t, out, "Served by: node2\n")
+	require.Contains(t, out, `"value": "value"`)
+
+	out = captureStdout(t, func() {
+		require.NoError(t, handleLocateCommand([]string{owned[0]}, settings))
+	})
+	require.Equal(t, fmt.Sprintf("Shard: node2 (%s)\n", ring.Shards[1].URL()), out)
+
+	// node1 proxies the requests for a shard the CLI can't reach
+	servers[1].Close()
+	out = captureStdout(t, func() {
+		require.NoError(t, handleSetCommand([]string{owned[1], "other"}, settings))
+	})
+	require.Equal(t, "Shard node2 is unreachable, the request is proxied\nServed by: node1 (proxied)\n", out)
+	require.Equal(t, map[string]string{owned[1]: "other"}, nodes[0].values)
+}
+
+func TestGetLargeValue(t *testing.T) {
+	fs := &fakeServer{values: map[string]string{"small": "v", "dir/large": strings.Repeat("x", 100)}, requests: make(map[string]int), maxJSON: 10}
+	ts := httptest.NewServer(fs)
+	defer ts.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	settings := &Settings{Host: host}
+	settings.Port, _ = strconv.Atoi(port)
+	dir := t.TempDir()
+
+	out := filepath.Join(dir, "small.txt")
+	printed := captureStdout(t, func() {
+		require.NoError(t, handleGetCommand([]string{"small", "--out", out}, settings))
+	})
+	require.Equal(t, fmt.Sprintf("Saved 1 bytes to %s\n", out), printed)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "v", string(data))
+
+	// a value the server won't encode is saved to a file named after the key
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+	printed = captureStdout(t, func() {
+		require.NoError(t, handleGetCommand([]string{"dir/large"}, settings))
+	})
+	require.Equal(t, "The value is too large to print, saving it to dir%2Flarge\nSaved 100 bytes to dir%2Flarge\n", printed)
+	data, err = os.ReadFile(filepath.Join(dir, "dir%2Flarge"))
+	require.NoError(t, err)
+	require.Len(t, data, 100)
+	// the file is not overwritten
+	captureStdout(t, func() {
+		require.ErrorIs(t, handleGetCommand([]string{"dir/large"}, settings), os.ErrExist)
+	})
+}
+
+func ptr(s string) *string {
+	return &s
+}
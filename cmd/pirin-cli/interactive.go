@@ -43,6 +43,7 @@ func interactiveMode(settings *Settings) {
 		}
 	}
 
+	connectCluster(settings)
 	rl, err := setupReadline(settings, historyPath)
 	if err != nil {
 		panic(err)
@@ -51,11 +52,18 @@ func interactiveMode(settings *Settings) {
 		_ = rl.Close()
 	}()
 
+	settings.Confirm = func(question string) bool {
+		return confirm(rl, question)
+	}
+	checkServerVersion(settings)
 	handleUserInput(rl, settings)
 }
 
 func setupReadline(settings *Settings, historyPath string) (*readline.Instance, error) {
 	prompt := fmt.Sprintf("%s:%d> ", settings.Host, settings.Port)
+	if shards := shardCount(settings); shards > 0 {
+		prompt = fmt.Sprintf("%s:%d [cluster, %d shards]> ", settings.Host, settings.Port, shards)
+	}
 
 	rl, err := readline.NewEx(&readline.Config{
 		Prompt:      prompt,
@@ -68,6 +76,23 @@ func setupReadline(settings *Settings, historyPath string) (*readline.Instance,
 	return rl, err
 }
 
+// confirm asks the question in place of the prompt, the answer is not kept in the history
+func confirm(rl *readline.Instance, question string) bool {
+	prompt := rl.Config.Prompt
+	rl.SetPrompt(question)
+	rl.HistoryDisable()
+	defer func() {
+		rl.HistoryEnable()
+		rl.SetPrompt(prompt)
+	}()
+	answer, err := rl.Readline()
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
 func handleUserInput(rl *readline.Instance, settings *Settings) {
 	for {
 		line, err := rl.Readline()
@@ -99,8 +124,12 @@ func handleUserInput(rl *readline.Instance, settings *Settings) {
 					fmt.Printf("%s %s\n", colorYellow.Sprint("Description:"), colorGreen.Sprint(cmd.Description))
 					if len(cmd.Params) > 0 {
 						_, _ = colorYellow.Println("Parameters:")
-						for _, param := range cmd.Params {
-							fmt.Printf(" <%s: %s>\n", colorCyan.Sprint(param.Name), colorGreen.Sprint(param.Description))
+						for i, param := range cmd.Params {
+							name := param.Name
+							if cmd.Variadic && i == len(cmd.Params)-1 {
+								name += "..."
+							}
+							fmt.Printf(" <%s: %s>\n", colorCyan.Sprint(name), colorGreen.Sprint(param.Description))
 						}
 					} else {
 						_, _ = colorYellow.Println("This command has no parameters.")
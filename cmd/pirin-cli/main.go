@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/timson/pirindb/pkg/client"
 	"os"
 )
 
@@ -10,6 +11,14 @@ type Settings struct {
 	Host     string
 	Port     int
 	UseHTTPS bool
+	DB       string
+	// Confirm asks the user a yes or no question, it is nil when there is no one to ask
+	Confirm func(question string) bool
+	// ShowShard prints the cluster node that served each key request
+	ShowShard bool
+	// Router sends key requests to the owning shard, nil outside of a cluster
+	Router    *client.Router
+	connected bool // connectCluster ran
 }
 
 const (
@@ -21,6 +30,9 @@ func buildCommandUsage(cmd Command) string {
 	for _, param := range cmd.Params {
 		usage += fmt.Sprintf(" <%s>", param.Name)
 	}
+	if cmd.Variadic {
+		usage += "..."
+	}
 	return usage
 }
 
@@ -43,16 +55,38 @@ func main() {
 	rootCmd.PersistentFlags().StringVar(&settings.Host, "host", "localhost", "Hostname for the server")
 	rootCmd.PersistentFlags().IntVar(&settings.Port, "port", 4321, "Port for the server")
 	rootCmd.PersistentFlags().BoolVar(&settings.UseHTTPS, "https", false, "Use HTTPS protocol")
+	rootCmd.PersistentFlags().StringVar(&settings.DB, "db", "", "Database name (server primary database by default)")
+	rootCmd.PersistentFlags().BoolVar(&settings.ShowShard, "show-shard", false, "Print the cluster node that served each key request")
 
 	for _, cmd := range CommandsRegistry {
 		command := cmd
-		rootCmd.AddCommand(&cobra.Command{
+		flagValues := make(map[string]*string)
+		boolFlags := make(map[string]*bool)
+		cobraCmd := &cobra.Command{
 			Use:   buildCommandUsage(command),
 			Short: command.Description,
 			Run: func(c *cobra.Command, args []string) {
-				if len(args) != len(command.Params) {
-					_, _ = colorRed.Printf("Invalid number of arguments. Expected %d but got %d\n",
-						len(command.Params), len(args))
+				positional := len(args)
+				flags := make(map[string]string)
+				for name, value := range flagValues {
+					if c.Flags().Changed(name) {
+						flags[name] = *value
+						args = append([]string{"--" + name, *value}, args...)
+					}
+				}
+				for name, value := range boolFlags {
+					if c.Flags().Changed(name) && *value {
+						flags[name] = "true"
+						args = append([]string{"--" + name}, args...)
+					}
+				}
+				if !command.acceptsParams(positional, flags) {
+					atLeast := ""
+					if command.Variadic {
+						atLeast = "at least "
+					}
+					_, _ = colorRed.Printf("Invalid number of arguments. Expected %s%d but got %d\n",
+						atLeast, command.expectedParams(flags), positional)
 					return
 				}
 				err := command.Handler(args, &settings)
@@ -60,7 +94,15 @@ func main() {
 					_, _ = colorRed.Printf("Command error: %v\n", err)
 				}
 			},
-		})
+		}
+		for _, flag := range command.Flags {
+			if flag.Type == "bool" {
+				boolFlags[flag.Name] = cobraCmd.Flags().Bool(flag.Name, false, flag.Description)
+				continue
+			}
+			flagValues[flag.Name] = cobraCmd.Flags().String(flag.Name, "", flag.Description)
+		}
+		rootCmd.AddCommand(cobraCmd)
 	}
 
 	if err := rootCmd.Execute(); err != nil {
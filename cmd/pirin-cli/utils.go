@@ -1,11 +1,20 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
 	"github.com/mattn/go-colorable"
 	json "github.com/neilotoole/jsoncolor"
+	"github.com/timson/pirindb/storage"
+	"io"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func BuildURL(settings *Settings, endpoint string) string {
@@ -16,14 +25,27 @@ func BuildURL(settings *Settings, endpoint string) string {
 	return fmt.Sprintf("%s://%s:%d%s", protocol, settings.Host, settings.Port, endpoint)
 }
 
+// BuildAPIURL builds an API URL for the selected database, the server primary
+// database is used when none is selected
+func BuildAPIURL(settings *Settings, endpoint string) string {
+	if settings.DB == "" {
+		return BuildURL(settings, "/api/v1"+endpoint)
+	}
+	return BuildURL(settings, fmt.Sprintf("/api/v1/%s%s", settings.DB, endpoint))
+}
+
 func PrintJSONResponse(resp *http.Response) {
 	var data any
-	var enc *json.Encoder
-
 	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 		fmt.Println("Failed to parse response:", err)
 		return
 	}
+	PrintJSON(data)
+}
+
+// PrintJSON prints the data as indented JSON, colored on a terminal
+func PrintJSON(data any) {
+	var enc *json.Encoder
 	if json.IsColorTerminal(os.Stdout) {
 		out := colorable.NewColorable(os.Stdout) // needed for Windows
 		enc = json.NewEncoder(out)
@@ -38,3 +60,167 @@ func PrintJSONResponse(resp *http.Response) {
 		fmt.Println("Failed to encode response:", err)
 	}
 }
+
+// PrintMGet prints the keys and values of mget in a table, tabs and line breaks in them are
+// escaped so every key takes one row
+func PrintMGet(items []mgetItem) {
+	escape := strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KEY\tVALUE")
+	for _, item := range items {
+		value := colorRed.Sprint("(not found)")
+		if item.Found {
+			value = escape.Replace(*item.Value)
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\n", escape.Replace(item.Key), value)
+	}
+	_ = w.Flush()
+}
+
+// WriteKeys writes the keys and common prefixes of a listing one per line, long adds a column
+// with the value size, the size of a common prefix is shown as "-"
+func WriteKeys(w io.Writer, list *keyListResult, long bool) {
+	if !long {
+		for _, key := range list.Keys {
+			_, _ = fmt.Fprintln(w, key)
+		}
+		for _, prefix := range list.CommonPrefixes {
+			_, _ = fmt.Fprintln(w, prefix)
+		}
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for i, key := range list.Keys {
+		_, _ = fmt.Fprintf(tw, "%d\t%s\n", list.Sizes[i], key)
+	}
+	for _, prefix := range list.CommonPrefixes {
+		_, _ = fmt.Fprintf(tw, "-\t%s\n", prefix)
+	}
+	_ = tw.Flush()
+}
+
+func PrintTreeStats(stats *storage.TreeStats) {
+	fmt.Printf("%s %d\n\n", colorYellow.Sprint("Depth:"), stats.Depth)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "LEVEL\tNODES\tAVG FILL\tMIN FILL")
+	for level, levelStats := range stats.Levels {
+		_, _ = fmt.Fprintf(w, "%d\t%d\t%.1f%%\t%.1f%%\n",
+			level, levelStats.NodesN, levelStats.AvgFill*100, levelStats.MinFill*100)
+	}
+	_ = w.Flush()
+
+	printHistogram("Items per leaf", "ITEMS", "LEAVES", stats.LeafItems)
+	printHistogram("Blob chain length", "PAGES", "BLOBS", stats.BlobChainPages)
+}
+
+// PrintSample prints the estimate of the keys under a prefix and the sampled keys
+func PrintSample(sample *sampleResult) {
+	fmt.Printf("\n%s %q\n", colorYellow.Sprint("Prefix"), sample.Prefix)
+	fmt.Printf("  keys: %d, avg value size: %.1f B, estimated value bytes: %d\n",
+		sample.Total, sample.AvgValueSize, sample.EstimatedBytes)
+	if len(sample.Keys) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SAMPLED KEY\tSIZE")
+	for _, key := range sample.Keys {
+		_, _ = fmt.Fprintf(w, "%s\t%d\n", key.Key, key.Size)
+	}
+	_ = w.Flush()
+}
+
+// PrintPrefixStats prints the prefix rankings and whether the scan saw the whole bucket
+// WriteUsageCSV writes the usage report as CSV, a header and a row per prefix
+func WriteUsageCSV(w io.Writer, usage *usageResult) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"prefix", "bytes", "items", "computed_at"})
+	computedAt := usage.ComputedAt.UTC().Format(time.RFC3339)
+	for _, prefix := range usage.Prefixes {
+		_ = out.Write([]string{prefix.Prefix, strconv.FormatUint(prefix.Bytes, 10),
+			strconv.FormatUint(prefix.Items, 10), computedAt})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func PrintPrefixStats(stats *prefixStatsResult) {
+	fmt.Printf("%d prefixes, %d keys, %d keys read\n", stats.Prefixes, stats.Keys, stats.Visited)
+	if !stats.Exact {
+		fmt.Println(colorYellow.Sprint("The scan stopped at its budget, later prefixes are missing"))
+	}
+	rankings := []struct {
+		title    string
+		prefixes []prefixResult
+	}{{"By key count", stats.ByCount}, {"By bytes", stats.ByBytes}}
+	for _, ranking := range rankings {
+		if len(ranking.prefixes) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s\n", colorYellow.Sprint(ranking.title))
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "PREFIX\tKEYS\tBYTES")
+		for _, prefix := range ranking.prefixes {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%d\n", prefix.Prefix, prefix.Count, prefix.Bytes)
+		}
+		_ = w.Flush()
+	}
+}
+
+func printHistogram(title, keyHeader, valueHeader string, histogram map[int]int) {
+	fmt.Printf("\n%s\n", colorYellow.Sprint(title))
+	if len(histogram) == 0 {
+		fmt.Println("  (empty)")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "%s\t%s\n", keyHeader, valueHeader)
+	for _, key := range slices.Sorted(maps.Keys(histogram)) {
+		_, _ = fmt.Fprintf(w, "%d\t%d\n", key, histogram[key])
+	}
+	_ = w.Flush()
+}
+
+func PrintDBStat(stat *storage.DBStat) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "%s\t%d used / %d free / %d total\n", colorYellow.Sprint("Pages:"), stat.UsedPageN, stat.FreePageN, stat.TotalPageNum)
+	_, _ = fmt.Fprintf(w, "%s\t%d bytes used / %d bytes total\n", colorYellow.Sprint("Size:"), stat.UsedDBSize, stat.TotalDBSize)
+	_, _ = fmt.Fprintf(w, "%s\t%d\n", colorYellow.Sprint("Read transactions:"), stat.TxN)
+	_, _ = fmt.Fprintf(w, "%s\t%d commits, %d pages written, %d fsyncs\n", colorYellow.Sprint("Commits:"),
+		stat.Commit.Commits, stat.Commit.PagesWritten, stat.Commit.Fsyncs)
+	_ = w.Flush()
+
+	durability := stat.Durability
+	fmt.Printf("\n%s\n", colorYellow.Sprint("Durability"))
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(w, "Sync mode\t%s\n", durability.SyncMode)
+	_, _ = fmt.Fprintf(w, "Tx log\t%s (%d bytes)\n", durability.TxLogPath, durability.TxLogSize)
+	_, _ = fmt.Fprintf(w, "Last sync\t%s\n", formatTime(durability.LastSync))
+	_, _ = fmt.Fprintf(w, "Last tx log sync\t%s\n", formatTime(durability.LastTxLogSync))
+	shutdown := "clean"
+	if !durability.CleanShutdown {
+		shutdown = "unclean"
+	}
+	_, _ = fmt.Fprintf(w, "Last shutdown\t%s\n", shutdown)
+	recovery := durability.Recovery
+	switch {
+	case !durability.RecoveryEnabled:
+		_, _ = fmt.Fprintln(w, "Recovery\tdisabled")
+	case recovery.At.IsZero():
+		_, _ = fmt.Fprintln(w, "Recovery\tnot run")
+	default:
+		_, _ = fmt.Fprintf(w, "Recovery\t%s: %d records, %d pages applied, %d skipped\n",
+			formatTime(recovery.At), recovery.Records, recovery.Pages, recovery.SkippedRecords)
+		if recovery.Error != "" {
+			_, _ = fmt.Fprintf(w, "Recovery error\t%s\n", recovery.Error)
+		}
+	}
+	_ = w.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	require.NoError(t, w.Close())
+	return string(<-done)
+}
+
+func TestPrintJSONResponseCompressed(t *testing.T) {
+	value := strings.Repeat("compressible ", 200)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server encodes only when asked, as pirindb does
+		require.Contains(t, r.Header.Get("Accept-Encoding"), "gzip")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		require.NoError(t, json.NewEncoder(gz).Encode(map[string]string{"key": "foo", "value": value}))
+		require.NoError(t, gz.Close())
+	}))
+	defer ts.Close()
+
+	resp, err := doRequest(http.MethodGet, ts.URL+"/api/v1/kv/foo", "", http.StatusOK)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.True(t, resp.Uncompressed, "the transport decodes the body")
+
+	out := captureStdout(t, func() { PrintJSONResponse(resp) })
+	var printed map[string]string
+	require.NoError(t, json.Unmarshal([]byte(out), &printed), out)
+	require.Equal(t, map[string]string{"key": "foo", "value": value}, printed)
+}
+
+func TestPrefixFlag(t *testing.T) {
+	prefix, ok := prefixFlag(map[string]string{"prefix": "sess:"})
+	require.True(t, ok)
+	require.Equal(t, "sess:", prefix)
+	prefix, ok = prefixFlag(map[string]string{"parts": "acme,order"})
+	require.True(t, ok)
+	require.Equal(t, "acme\x00\x01order\x00\x01", prefix)
+	_, ok = prefixFlag(map[string]string{})
+	require.False(t, ok)
+}
+
+func TestWriteUsageCSV(t *testing.T) {
+	var out strings.Builder
+	usage := &usageResult{
+		ComputedAt: time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC),
+		Prefixes:   []usagePrefix{{Prefix: "acme:", Bytes: 1200, Items: 3}, {Prefix: "a,b:", Bytes: 10, Items: 1}},
+	}
+	require.NoError(t, WriteUsageCSV(&out, usage))
+	require.Equal(t, "prefix,bytes,items,computed_at\n"+
+		"acme:,1200,3,2026-01-31T12:00:00Z\n"+
+		"\"a,b:\",10,1,2026-01-31T12:00:00Z\n", out.String())
+}
+
+func TestWriteKeys(t *testing.T) {
+	list := &keyListResult{Keys: []string{"a/b", "a/blob"}, Sizes: []int{5, 10000}, CommonPrefixes: []string{"a/d/"}}
+	var out strings.Builder
+	WriteKeys(&out, list, false)
+	require.Equal(t, "a/b\na/blob\na/d/\n", out.String())
+	out.Reset()
+	WriteKeys(&out, list, true)
+	require.Equal(t, "5      a/b\n10000  a/blob\n-      a/d/\n", out.String())
+}
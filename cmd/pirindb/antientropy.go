@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
+)
+
+// Range digests let two nodes find the part of the key space they disagree about without
+// sending every key. The keys of the main bucket are split into ranges by their first two
+// bytes, the digest of a range is the XOR of an XXH64 of every key and its value checksum,
+// kept per shard owning the keys on the current ring. Digests are cached per range and a
+// commit drops the cached digests of the ranges it touched.
+
+// keyRanges splits the key space into ranges by the first two bytes of the keys
+type keyRanges struct {
+	starts [][]byte // first key of each range, nil for the first range
+}
+
+// newKeyRanges returns n ranges of about the same share of the two byte prefixes, n is at
+// most 65536
+func newKeyRanges(n int) keyRanges {
+	starts := make([][]byte, n)
+	for i := 1; i < n; i++ {
+		starts[i] = binary.BigEndian.AppendUint16(nil, uint16((i*65536+n-1)/n))
+	}
+	return keyRanges{starts: starts}
+}
+
+func (ranges keyRanges) count() int {
+	return len(ranges.starts)
+}
+
+// bounds returns the first key of the range and the first key after it, nil for open ends
+func (ranges keyRanges) bounds(i int) (start, end []byte) {
+	if i+1 < len(ranges.starts) {
+		end = ranges.starts[i+1]
+	}
+	return ranges.starts[i], end
+}
+
+// of returns the range holding the key
+func (ranges keyRanges) of(key []byte) int {
+	return sort.Search(len(ranges.starts), func(i int) bool {
+		return bytes.Compare(ranges.starts[i], key) > 0
+	}) - 1
+}
+
+// rangeDigest sums up the keys of a range owned by one shard
+type rangeDigest struct {
+	Keys int
+	Sum  uint64
+}
+
+// keyDigest hashes the key with its value checksum, the checksum has a fixed size so no
+// other key and value hash the same bytes
+func keyDigest(key, value []byte) uint64 {
+	hash := storage.NewValueHash()
+	_, _ = hash.Write(key)
+	_, _ = hash.Write(binary.LittleEndian.AppendUint64([]byte{0}, storage.ValueChecksum(value)))
+	return hash.Sum64()
+}
+
+// digestCache holds the range digests of the primary database by owner, computed with the
+// ring of ring. A commit bumps the generation of the ranges it touched, a digest computed
+// while its generation changed is returned but not cached.
+type digestCache struct {
+	lock     sync.Mutex
+	ranges   keyRanges
+	ring     string   // binary ring the cached digests were computed with
+	gens     []uint64 // by range
+	digests  map[int]map[string]rangeDigest
+	computed int // ranges computed since the start, the ones served from the cache are not counted
+}
+
+func newDigestCache(ranges int) *digestCache {
+	return &digestCache{
+		ranges:  newKeyRanges(ranges),
+		gens:    make([]uint64, ranges),
+		digests: make(map[int]map[string]rangeDigest),
+	}
+}
+
+// invalidate is the commit hook of the cache
+func (cache *digestCache) invalidate(event *storage.CommitEvent) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if slices.Contains(event.Buckets, string(DBBucket)) {
+		cache.reset()
+		return
+	}
+	for _, key := range event.Keys[string(DBBucket)] {
+		i := cache.ranges.of(key)
+		cache.gens[i]++
+		delete(cache.digests, i)
+	}
+}
+
+// reset drops every cached digest, the lock is held
+func (cache *digestCache) reset() {
+	for i := range cache.gens {
+		cache.gens[i]++
+	}
+	clear(cache.digests)
+}
+
+// lookup returns the cached digests of the range, or the generation to store them with
+func (cache *digestCache) lookup(ring string, i int) (map[string]rangeDigest, uint64, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if ring != cache.ring {
+		cache.reset()
+		cache.ring = ring
+	}
+	digests, ok := cache.digests[i]
+	return digests, cache.gens[i], ok
+}
+
+// store caches the digests of the range unless a commit or a new ring came in between
+func (cache *digestCache) store(ring string, i int, gen uint64, digests map[string]rangeDigest) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.computed++
+	if ring == cache.ring && gen == cache.gens[i] {
+		cache.digests[i] = digests
+	}
+}
+
+// setupDigests creates the digest cache of the primary database and its commit hook, like
+// the read caches before the router serves a request
+func (srv *Server) setupDigests() {
+	if srv.digests != nil || !srv.clusterEnabled() {
+		return
+	}
+	srv.digests = newDigestCache(srv.digestRanges())
+	srv.DBs.Primary().OnCommit(srv.digests.invalidate)
+}
+
+// digestRanges returns the number of ranges the key space is split into
+func (srv *Server) digestRanges() int {
+	if srv.Config.Cluster.DigestRanges < 1 {
+		return defaultDigestRanges
+	}
+	return srv.Config.Cluster.DigestRanges
+}
+
+// rangeDigests returns the digests of the range by owner, from the cache or computed in
+// read transactions of digestBatchSize keys
+func (srv *Server) rangeDigests(i int) (map[string]rangeDigest, error) {
+	ringData, err := srv.Ring.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	ring := string(ringData)
+	digests, gen, ok := srv.digests.lookup(ring, i)
+	if ok {
+		return digests, nil
+	}
+	digests = make(map[string]rangeDigest)
+	from, end := srv.digests.ranges.bounds(i)
+	for {
+		read := 0
+		err = srv.DBs.Primary().View(func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket(DBBucket)
+			if err != nil {
+				return err
+			}
+			cursor := bucket.Cursor()
+			var k, v []byte
+			if from == nil {
+				k, v = cursor.First()
+			} else {
+				k, v = cursor.Seek(from)
+			}
+			for ; k != nil && read < digestBatchSize; k, v = cursor.Next() {
+				if end != nil && bytes.Compare(k, end) >= 0 {
+					break
+				}
+				owner := ""
+				if shard := srv.Ring.GetShard(string(k)); shard != nil {
+					owner = shard.Name
+				}
+				digest := digests[owner]
+				digest.Keys++
+				digest.Sum ^= keyDigest(k, v)
+				digests[owner] = digest
+				from = k
+				read++
+			}
+			from = append(bytes.Clone(from), 0) // smallest key after the last one
+			return cursor.Err()
+		})
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if read < digestBatchSize {
+			break
+		}
+	}
+	srv.digests.store(ring, i, gen, digests)
+	return digests, nil
+}
+
+// digestsFor returns the digests of the ranges for the owner, every range if keyRange is
+// negative
+func (srv *Server) digestsFor(owner string, keyRange int) (*client.RangeDigests, error) {
+	resp := &client.RangeDigests{Ranges: srv.digests.ranges.count(), Owner: owner, Digests: []client.RangeDigest{}}
+	first, last := 0, resp.Ranges-1
+	if keyRange >= 0 {
+		first, last = keyRange, keyRange
+	}
+	for i := first; i <= last; i++ {
+		digests, err := srv.rangeDigests(i)
+		if err != nil {
+			return nil, err
+		}
+		start, end := srv.digests.ranges.bounds(i)
+		digest := digests[owner]
+		resp.Digests = append(resp.Digests, client.RangeDigest{
+			Range:  i,
+			Start:  start,
+			End:    end,
+			Keys:   digest.Keys,
+			Digest: formatChecksum(digest.Sum),
+		})
+	}
+	return resp, nil
+}
+
+// handleRangeDigest returns the digests of the keys this node holds for the owner, this
+// node by default, of one range or of all of them
+func (srv *Server) handleRangeDigest(w http.ResponseWriter, r *http.Request) {
+	if srv.digests == nil {
+		_ = render.Render(w, r, ErrClusterDisabled())
+		return
+	}
+	query := r.URL.Query()
+	owner := query.Get("owner")
+	if owner == "" {
+		owner = srv.Config.Cluster.NodeName
+	}
+	keyRange := -1
+	if query.Has("range") {
+		var err error
+		keyRange, err = strconv.Atoi(query.Get("range"))
+		if err != nil || keyRange < 0 || keyRange >= srv.digests.ranges.count() {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	resp, err := srv.digestsFor(owner, keyRange)
+	switch {
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to compute range digests", "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, resp)
+}
+
+// AntiEntropyReport describes the last comparison with the previous ring
+type AntiEntropyReport struct {
+	Previous       []string  `json:"previous"` // members of the ring before its last membership change
+	Runs           int       `json:"runs"`
+	LastRun        time.Time `json:"last_run,omitempty"`
+	RangesCompared int       `json:"ranges_compared"`
+	RangesSkipped  int       `json:"ranges_skipped"` // unchanged on the peer since their last sync
+	Mismatched     int       `json:"ranges_mismatched"`
+	KeysCopied     int       `json:"keys_copied"`
+	Conflicts      int       `json:"conflicts"` // keys whose values differ, they are left as they are
+	Errors         []string  `json:"errors,omitempty"`
+	// ReadRepair counts the reads served from the previous ring, see Server.repairRead
+	ReadRepair ReadRepairStats `json:"read_repair"`
+}
+
+// antiEntropyState remembers the members of the ring before its last membership change, the
+// shards that owned the keys this node owns now. It is kept in memory only.
+type antiEntropyState struct {
+	running    sync.Mutex // held by a run, it alone reads and writes synced
+	lock       sync.Mutex
+	previous   []*sharding.Shard
+	generation int                       // counts the changes of previous
+	synced     map[string]map[int]string // peer digest of each range at its last complete sync, by peer
+	report     AntiEntropyReport
+}
+
+// setPrevious replaces the previous ring, the ranges are compared again with its members. It
+// returns the generation of the previous ring.
+func (state *antiEntropyState) setPrevious(shards []*sharding.Shard) int {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.previous = shards
+	state.generation++
+	state.synced = make(map[string]map[int]string)
+	return state.generation
+}
+
+// membersChanged reports whether the shards are not the members of the ring, a changed mode
+// or address is not a membership change
+func membersChanged(ring *sharding.ConsistentHash, shards []*sharding.Shard) bool {
+	members := ring.Shards()
+	if len(members) != len(shards) {
+		return true
+	}
+	for _, shard := range shards {
+		if !slices.ContainsFunc(members, func(member *sharding.Shard) bool { return member.Name == shard.Name }) {
+			return true
+		}
+	}
+	return false
+}
+
+// antiEntropyLoop compares the ranges with the previous ring until stop is closed
+func (srv *Server) antiEntropyLoop(stop chan struct{}, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if srv.ready.Load() {
+				srv.runAntiEntropy(ctx)
+			}
+		}
+	}
+}
+
+// runAntiEntropy compares the digests of the keys this node owns with the digests the members
+// of the previous ring hold for it. A range that differs is walked like a diff, keys found
+// only on the peer are copied here and keys with other values are counted as conflicts.
+// Values carry no timestamps, so no side can win a conflict, and a key deleted here comes
+// back while the peer still holds it. A run without errors completes the ring change, reads
+// stop consulting the previous ring.
+func (srv *Server) runAntiEntropy(ctx context.Context) AntiEntropyReport {
+	state := &srv.antiEntropy
+	state.running.Lock()
+	defer state.running.Unlock()
+	state.lock.Lock()
+	previous, synced, generation := state.previous, state.synced, state.generation
+	report := AntiEntropyReport{Runs: state.report.Runs + 1, LastRun: time.Now().UTC()}
+	state.lock.Unlock()
+
+	self := srv.Config.Cluster.NodeName
+	for _, peer := range previous {
+		if peer.Name == self || ctx.Err() != nil {
+			continue
+		}
+		if err := srv.syncPeer(ctx, peer, synced, &report); err != nil {
+			srv.Logger.Warn("anti-entropy failed", "peer", peer.Name, "error", err)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", peer.Name, err))
+		}
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.report = report
+	if len(report.Errors) == 0 && ctx.Err() == nil {
+		srv.readRepair.end(generation)
+	}
+	return report
+}
+
+// syncPeer compares every range with the peer, synced holds the peer digests of the ranges
+// synced before
+func (srv *Server) syncPeer(ctx context.Context, peer *sharding.Shard, synced map[string]map[int]string, report *AntiEntropyReport) error {
+	self := srv.Config.Cluster.NodeName
+	remote, err := client.New(peer.URL()).RangeDigests(ctx, self, -1)
+	if err != nil {
+		return err
+	}
+	if remote.Ranges != srv.digests.ranges.count() || len(remote.Digests) != remote.Ranges {
+		return fmt.Errorf("peer splits keys into %d ranges, this node into %d", remote.Ranges, srv.digests.ranges.count())
+	}
+	local, err := srv.digestsFor(self, -1)
+	if err != nil {
+		return err
+	}
+	for i, digest := range remote.Digests {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if last, ok := synced[peer.Name][i]; digest.Keys == 0 || (ok && last == digest.Digest) {
+			report.RangesSkipped++
+			continue
+		}
+		report.RangesCompared++
+		if local.Digests[i].Digest == digest.Digest {
+			markSynced(synced, peer.Name, i, digest.Digest)
+			continue
+		}
+		report.Mismatched++
+		if err = srv.syncRange(ctx, peer, i, report); err != nil {
+			return fmt.Errorf("range %d: %w", i, err)
+		}
+		markSynced(synced, peer.Name, i, digest.Digest)
+	}
+	return nil
+}
+
+func markSynced(synced map[string]map[int]string, peer string, i int, digest string) {
+	if synced[peer] == nil {
+		synced[peer] = make(map[int]string)
+	}
+	synced[peer][i] = digest
+}
+
+// syncRange walks the keys of the range on both nodes and copies the keys this node owns
+// that only the peer holds
+func (srv *Server) syncRange(ctx context.Context, peer *sharding.Shard, i int, report *AntiEntropyReport) error {
+	db := srv.DBs.Primary()
+	start, end := srv.digests.ranges.bounds(i)
+	local, err := DigestBatch(db, string(DBBucket), start, end, digestBatchSize)
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		local, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+	remote, err := openPeerDigests(ctx, &DiffRequest{Peer: peer.URL(), Bucket: string(DBBucket), Start: string(start), End: string(end)})
+	if err != nil {
+		if remote != nil {
+			remote.close()
+		}
+		return err
+	}
+	defer remote.close()
+
+	self := srv.Config.Cluster.NodeName
+	_, err = walkDiff(db, string(DBBucket), local, end, remote, func() error { return ctx.Err() }, func(key []byte, kind storage.DiffKind) error {
+		if owner := srv.Ring.GetShard(string(key)); owner == nil || owner.Name != self {
+			return nil
+		}
+		switch kind {
+		case storage.DiffOnlyInB:
+			copied, err := srv.copyFromPeer(ctx, peer, string(key))
+			if copied {
+				report.KeysCopied++
+			}
+			return err
+		case storage.DiffChanged:
+			report.Conflicts++
+		}
+		return nil
+	})
+	return err
+}
+
+// copyFromPeer reads the key from the peer and stores it unless a write created it meanwhile
+func (srv *Server) copyFromPeer(ctx context.Context, peer *sharding.Shard, key string) (bool, error) {
+	value, found, err := srv.fetchFromPeer(ctx, peer, key)
+	if err != nil || !found {
+		return false, err // not found when deleted since the digests were read
+	}
+	return PutIfAbsent(srv.DBs.Primary(), key, value, labeled("anti-entropy"))
+}
+
+// fetchFromPeer reads the key from the primary database of the peer
+func (srv *Server) fetchFromPeer(ctx context.Context, peer *sharding.Shard, key string) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peer.URL()+"/api/v1/kv/"+url.PathEscape(key), nil)
+	if err != nil {
+		return "", false, err
+	}
+	// the peer serves its own copy instead of proxying the request back to the owner
+	req.Header.Set(forwardedByHeader, srv.Config.Cluster.NodeName)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", false, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var value GetResponse
+	if err = json.NewDecoder(resp.Body).Decode(&value); err != nil {
+		return "", false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return value.Value, true, nil
+}
+
+// handleAntiEntropy reports the last comparison with the previous ring
+func (srv *Server) handleAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	if !srv.clusterEnabled() {
+		_ = render.Render(w, r, ErrClusterDisabled())
+		return
+	}
+	srv.antiEntropy.lock.Lock()
+	report := srv.antiEntropy.report
+	report.Previous = []string{}
+	for _, shard := range srv.antiEntropy.previous {
+		report.Previous = append(report.Previous, shard.Name)
+	}
+	srv.antiEntropy.lock.Unlock()
+	report.ReadRepair = srv.readRepair.stats()
+	render.JSON(w, r, &report)
+}
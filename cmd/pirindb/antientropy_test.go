@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/pkg/client"
+)
+
+func TestKeyRanges(t *testing.T) {
+	keys := [][]byte{nil, {0}, {0, 0, 1}, []byte("a"), []byte("a\x00"), []byte("mid"), {0x80}, {0xff, 0xff}, {0xff, 0xff, 0xff}}
+	for _, n := range []int{1, 3, 256, 1000, 65536} {
+		ranges := newKeyRanges(n)
+		require.Equal(t, n, ranges.count())
+		for _, key := range keys {
+			i := ranges.of(key)
+			start, end := ranges.bounds(i)
+			require.LessOrEqual(t, bytes.Compare(start, key), 0, "n=%d key=%q", n, key)
+			require.True(t, end == nil || bytes.Compare(key, end) < 0, "n=%d key=%q", n, key)
+		}
+		_, end := ranges.bounds(n - 1)
+		require.Nil(t, end)
+	}
+}
+
+// putSpread writes n keys spread over the first byte, so they fall into many ranges
+func putSpread(t *testing.T, node *testNode, n int) []string {
+	t.Helper()
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("%c-key-%d", 'a'+i%26, i)
+		require.NoError(t, Put(node.srv.DBs.Primary(), key, "value-"+key, labeled("test")))
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestRangeDigestCache(t *testing.T) {
+	node := startTestNode(t, "node1", &ClusterConfig{})
+	require.NoError(t, node.srv.Bootstrap(context.Background()))
+	putSpread(t, node, 100)
+	digests := node.srv.digests
+
+	all, err := client.New(node.ts.URL).RangeDigests(context.Background(), "", -1)
+	require.NoError(t, err)
+	require.Equal(t, defaultDigestRanges, all.Ranges)
+	require.Len(t, all.Digests, defaultDigestRanges)
+	keys := 0
+	for _, digest := range all.Digests {
+		keys += digest.Keys
+	}
+	require.Equal(t, 100, keys)
+	require.Equal(t, defaultDigestRanges, digests.computed)
+
+	// cached ranges are not read again, a put only drops the range of its key
+	_, err = node.srv.digestsFor("node1", -1)
+	require.NoError(t, err)
+	require.Equal(t, defaultDigestRanges, digests.computed)
+	require.NoError(t, Put(node.srv.DBs.Primary(), "b-key-1", "changed", labeled("test")))
+	i := digests.ranges.of([]byte("b-key-1"))
+	one, err := client.New(node.ts.URL).RangeDigests(context.Background(), "node1", i)
+	require.NoError(t, err)
+	require.Len(t, one.Digests, 1)
+	require.Equal(t, all.Digests[i].Keys, one.Digests[0].Keys)
+	require.NotEqual(t, all.Digests[i].Digest, one.Digests[0].Digest)
+	require.Equal(t, defaultDigestRanges+1, digests.computed)
+
+	// the same keys and values give the same digest
+	require.NoError(t, Put(node.srv.DBs.Primary(), "b-key-1", "value-b-key-1", labeled("test")))
+	again, err := node.srv.digestsFor("node1", i)
+	require.NoError(t, err)
+	require.Equal(t, all.Digests[i].Digest, again.Digests[0].Digest)
+
+	// keys of other owners are digested apart
+	other, err := node.srv.digestsFor("node2", -1)
+	require.NoError(t, err)
+	for _, digest := range other.Digests {
+		require.Zero(t, digest.Keys)
+	}
+
+	resp, err := http.Get(node.ts.URL + fmt.Sprintf("/cluster/digest?range=%d", defaultDigestRanges))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestAntiEntropy(t *testing.T) {
+	ctx := context.Background()
+	node1 := startTestNode(t, "node1", &ClusterConfig{})
+	require.NoError(t, node1.srv.Bootstrap(ctx))
+	keys := putSpread(t, node1, 300)
+
+	// node2 takes over part of the keys, they stay on node1 until anti-entropy copies them
+	node2 := startTestNode(t, "node2", &ClusterConfig{SeedURL: node1.ts.URL})
+	require.NoError(t, node2.srv.Bootstrap(ctx))
+	var moved []string
+	for _, key := range keys {
+		if node2.srv.Ring.GetShard(key).Name == "node2" {
+			moved = append(moved, key)
+		}
+	}
+	require.NotEmpty(t, moved)
+
+	report := node2.srv.runAntiEntropy(ctx)
+	require.Empty(t, report.Errors)
+	require.Equal(t, len(moved), report.KeysCopied)
+	require.Zero(t, report.Conflicts)
+	require.Positive(t, report.Mismatched)
+	for _, key := range moved {
+		value, ok := Get(node2.srv.DBs.Primary(), key)
+		require.True(t, ok, key)
+		require.Equal(t, "value-"+key, value)
+	}
+	local, err := node2.srv.digestsFor("node2", -1)
+	require.NoError(t, err)
+	remote, err := client.New(node1.ts.URL).RangeDigests(ctx, "node2", -1)
+	require.NoError(t, err)
+	require.Equal(t, remote.Digests, local.Digests)
+
+	// ranges the peer did not change since the last sync are skipped, new writes on node2 do
+	// not make them differ
+	require.NoError(t, Put(node2.srv.DBs.Primary(), moved[0]+"-new", "new", labeled("test")))
+	report = node2.srv.runAntiEntropy(ctx)
+	require.Empty(t, report.Errors)
+	require.Zero(t, report.RangesCompared)
+	require.Equal(t, defaultDigestRanges, report.RangesSkipped)
+
+	// a value changed on the previous owner is a conflict and is not copied
+	require.NoError(t, Put(node1.srv.DBs.Primary(), moved[0], "stale", labeled("test")))
+	report = node2.srv.runAntiEntropy(ctx)
+	require.Empty(t, report.Errors)
+	require.Equal(t, 1, report.RangesCompared)
+	require.Equal(t, 1, report.Mismatched)
+	require.Equal(t, 1, report.Conflicts)
+	require.Zero(t, report.KeysCopied)
+	value, _ := Get(node2.srv.DBs.Primary(), moved[0])
+	require.Equal(t, "value-"+moved[0], value)
+
+	resp, err := http.Get(node2.ts.URL + "/cluster/anti-entropy")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var status AntiEntropyReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	require.Equal(t, []string{"node1"}, status.Previous)
+	require.Equal(t, 3, status.Runs)
+	require.Equal(t, 1, status.Conflicts)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/timson/pirindb/storage"
+)
+
+// audit sink kinds, see AuditConfig
+const (
+	auditSinkFile    = "file"
+	auditSinkWebhook = "webhook"
+)
+
+// AuditRecord describes one successful mutating request. There is no authentication and no
+// hybrid clock yet, records carry the wall clock time and the request id only.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+	Node      string    `json:"node,omitempty"`
+	Client    string    `json:"client,omitempty"` // the address told by trusted proxies behind them
+	Op        string    `json:"op"`
+	DB        string    `json:"db"`
+	Bucket    string    `json:"bucket,omitempty"`
+	Key       string    `json:"key,omitempty"` // redacted by the audit key mode
+	ValueSize int64     `json:"value_size,omitempty"`
+	Status    int       `json:"status"`
+}
+
+// auditSink stores encoded batches of NDJSON records, it is only called from the
+// auditor goroutine
+type auditSink interface {
+	Write(batch []byte) error
+	Close() error
+}
+
+// Auditor moves records from request handlers to the sink, handlers only enqueue into
+// a bounded buffer and records that don't fit are dropped and counted
+type Auditor struct {
+	sink      auditSink
+	sinkName  string
+	fields    map[string]bool // nil writes every field
+	batchSize int
+	logger    *slog.Logger
+	queue     chan AuditRecord
+	done      chan struct{}
+	written   atomic.Uint64
+	dropped   atomic.Uint64 // the buffer was full
+	failed    atomic.Uint64 // the sink returned an error
+}
+
+// NewAuditor opens the sink selected by the config, nil config or empty sink disables audit
+func NewAuditor(cfg *AuditConfig, logger *slog.Logger) (*Auditor, error) {
+	if cfg == nil || cfg.Sink == "" {
+		return nil, nil
+	}
+	var sink auditSink
+	switch cfg.Sink {
+	case auditSinkFile:
+		fileSink, err := openAuditFile(cfg.Path, cfg.MaxSize, cfg.MaxFiles)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	case auditSinkWebhook:
+		sink = &auditWebhook{url: cfg.URL, retries: cfg.Retries, client: &http.Client{Timeout: auditWebhookTimeout}}
+	default:
+		return nil, fmt.Errorf("unknown audit sink: %s", cfg.Sink)
+	}
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = defaultAuditBuffer
+	}
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultAuditBatchSize
+	}
+	a := &Auditor{
+		sink:      sink,
+		sinkName:  cfg.Sink,
+		batchSize: batchSize,
+		logger:    logger,
+		queue:     make(chan AuditRecord, buffer),
+		done:      make(chan struct{}),
+	}
+	if len(cfg.Fields) > 0 {
+		a.fields = make(map[string]bool, len(cfg.Fields))
+		for _, field := range cfg.Fields {
+			a.fields[field] = true
+		}
+	}
+	go a.run()
+	return a, nil
+}
+
+// Record enqueues a record without waiting
+func (a *Auditor) Record(rec AuditRecord) {
+	select {
+	case a.queue <- rec:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Close writes the queued records and closes the sink, Record must not be called after it
+func (a *Auditor) Close() error {
+	close(a.queue)
+	<-a.done
+	return a.sink.Close()
+}
+
+// Stats returns the audit counters
+func (a *Auditor) Stats() AuditStatsResponse {
+	return AuditStatsResponse{
+		Sink:    a.sinkName,
+		Queued:  len(a.queue),
+		Written: a.written.Load(),
+		Dropped: a.dropped.Load(),
+		Failed:  a.failed.Load(),
+	}
+}
+
+func (a *Auditor) run() {
+	defer close(a.done)
+	var buf bytes.Buffer
+	for rec := range a.queue {
+		buf.Reset()
+		count := 0
+		for {
+			if err := a.encode(&buf, &rec); err != nil {
+				a.logger.Error("failed to encode audit record", "error", err)
+				a.failed.Add(1)
+			} else {
+				count++
+			}
+			if count >= a.batchSize || len(a.queue) == 0 {
+				break
+			}
+			rec = <-a.queue
+		}
+		if count == 0 {
+			continue
+		}
+		if err := a.sink.Write(buf.Bytes()); err != nil {
+			a.logger.Error("failed to write audit records", "sink", a.sinkName, "records", count, "error", err)
+			a.failed.Add(uint64(count))
+			continue
+		}
+		a.written.Add(uint64(count))
+	}
+}
+
+// encode appends the record as one NDJSON line with the configured fields
+func (a *Auditor) encode(buf *bytes.Buffer, rec *AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if a.fields != nil {
+		var values map[string]json.RawMessage
+		if err = json.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		for name := range values {
+			if !a.fields[name] {
+				delete(values, name)
+			}
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return err
+		}
+	}
+	buf.Write(data)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// auditFile appends records to a local file, the file is rotated to path.1, path.2, ...
+// once it grows past maxSize and maxFiles rotated files are kept
+type auditFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openAuditFile(path string, maxSize int64, maxFiles int) (*auditFile, error) {
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = defaultAuditMaxFiles
+	}
+	f := &auditFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *auditFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *auditFile) Write(batch []byte) error {
+	if f.size > 0 && f.size+int64(len(batch)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(batch)
+	f.size += int64(n)
+	return err
+}
+
+func (f *auditFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *auditFile) Close() error {
+	return f.file.Close()
+}
+
+// auditWebhook posts each batch as an NDJSON body, a failed post is retried with
+// a growing delay before the batch is given up
+type auditWebhook struct {
+	url     string
+	retries int
+	client  *http.Client
+}
+
+func (h *auditWebhook) Write(batch []byte) error {
+	var err error
+	delay := auditRetryDelay
+	for attempt := 0; ; attempt++ {
+		if err = h.post(batch); err == nil || attempt >= h.retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (h *auditWebhook) post(batch []byte) error {
+	resp, err := h.client.Post(h.url, "application/x-ndjson", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *auditWebhook) Close() error {
+	return nil
+}
+
+// countingBody counts the request body bytes read by the handler
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// audit records successful requests of the handler as op, requests proxied to the owner
+// shard are recorded by the owner, so it goes after routeKey
+func (srv *Server) audit(op string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if srv.Auditor == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &countingBody{ReadCloser: r.Body}
+			r.Body = body
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if status >= http.StatusMultipleChoices {
+				return
+			}
+			rec := AuditRecord{
+				Time:      time.Now().UTC(),
+				RequestID: middleware.GetReqID(r.Context()),
+				Client:    clientIP(r),
+				Op:        op,
+				DB:        chi.URLParam(r, "db"),
+				Bucket:    chi.URLParam(r, "bucket"),
+				ValueSize: body.n,
+				Status:    status,
+			}
+			if rec.DB == "" {
+				rec.DB = srv.DBs.PrimaryName()
+			}
+			if rec.Bucket == "" {
+				rec.Bucket = string(DBBucket)
+			}
+			// a prefix delete is recorded with its prefix as the key
+			key := chi.URLParam(r, "key")
+			if key == "" {
+				key = r.URL.Query().Get("prefix")
+			}
+			if key != "" {
+				rec.Key = storage.RedactKey(srv.auditKeyMode(), []byte(key))
+			}
+			if srv.Config.Cluster != nil {
+				rec.Node = srv.Config.Cluster.NodeName
+			}
+			srv.Auditor.Record(rec)
+		})
+	}
+}
+
+// auditKeyMode is the key redaction of audit records, the log key mode unless overridden
+func (srv *Server) auditKeyMode() storage.LogKeyMode {
+	if srv.Config.Audit != nil && srv.Config.Audit.KeyMode != "" {
+		return srv.Config.Audit.KeyMode
+	}
+	return srv.Config.Server.LogKeyMode
+}
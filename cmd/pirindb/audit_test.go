@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func readAuditFile(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	var records []map[string]any
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var rec map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &rec))
+		records = append(records, rec)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestAuditFile(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	auditPath := storage.TempFileName(".audit")
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+		_ = os.Remove(auditPath)
+	})
+	srv.Config.Audit = &AuditConfig{Sink: auditSinkFile, Path: auditPath, KeyMode: storage.LogKeyHash}
+	auditor, err := NewAuditor(srv.Config.Audit, srv.Logger)
+	require.NoError(t, err)
+	srv.Auditor = auditor
+
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	do := func(method, path, body string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("X-Request-Id", "req-"+method)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/api/v1/kv/secret", "value"))
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/api/v1/kv/secret:append", "-more"))
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/api/v1/kv/secret", ""))
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/api/v1/kv/secret", ""))
+	require.Equal(t, http.StatusOK, do(http.MethodPut, "/api/v1/buckets/main/quota", `{"max_keys": 10}`))
+	// failed requests are not recorded
+	require.Equal(t, http.StatusNotFound, do(http.MethodPut, "/api/v1/buckets/missing/quota", `{"max_keys": 10}`))
+
+	require.NoError(t, srv.Auditor.Close())
+	stats := srv.Auditor.Stats()
+	require.EqualValues(t, 4, stats.Written)
+	require.Zero(t, stats.Dropped)
+
+	records := readAuditFile(t, auditPath)
+	require.Len(t, records, 4)
+	var ops []string
+	for _, rec := range records {
+		ops = append(ops, rec["op"].(string))
+		require.Equal(t, srv.DBs.PrimaryName(), rec["db"])
+		require.NotEmpty(t, rec["time"])
+		require.Less(t, rec["status"], float64(http.StatusMultipleChoices))
+	}
+	require.Equal(t, []string{"put", "append", "delete", "set_quota"}, ops)
+	require.Equal(t, "req-POST", records[0]["request_id"])
+	require.Equal(t, "main", records[0]["bucket"])
+	require.EqualValues(t, len("value"), records[0]["value_size"])
+	require.EqualValues(t, len("-more"), records[1]["value_size"])
+	// keys follow the audit key mode
+	hashed := storage.RedactKey(storage.LogKeyHash, []byte("secret"))
+	require.Equal(t, hashed, records[0]["key"])
+	require.Equal(t, hashed, records[2]["key"])
+	require.NotContains(t, records[3], "key")
+}
+
+func TestAuditFileRotation(t *testing.T) {
+	path := storage.TempFileName(".audit")
+	t.Cleanup(func() {
+		for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+			_ = os.Remove(name)
+		}
+	})
+	sink, err := openAuditFile(path, 100, 2)
+	require.NoError(t, err)
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		require.NoError(t, sink.Write(line))
+	}
+	require.NoError(t, sink.Close())
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := os.ReadFile(name)
+		require.NoError(t, err)
+		require.Equal(t, line, data, name)
+	}
+	require.NoFileExists(t, path+".3")
+}
+
+func TestAuditFields(t *testing.T) {
+	path := storage.TempFileName(".audit")
+	t.Cleanup(func() { _ = os.Remove(path) })
+	auditor, err := NewAuditor(&AuditConfig{Sink: auditSinkFile, Path: path, Fields: []string{"op", "key"}}, createLogger("ERROR"))
+	require.NoError(t, err)
+	auditor.Record(AuditRecord{Op: "put", DB: "default", Key: "foo", ValueSize: 3, Status: http.StatusCreated})
+	require.NoError(t, auditor.Close())
+	require.Equal(t, []map[string]any{{"op": "put", "key": "foo"}}, readAuditFile(t, path))
+}
+
+func TestAuditWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	var calls atomic.Int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		require.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, strings.Split(strings.TrimSpace(string(body)), "\n")...)
+		mu.Unlock()
+	}))
+	defer hook.Close()
+
+	auditor, err := NewAuditor(&AuditConfig{Sink: auditSinkWebhook, URL: hook.URL, Retries: 2}, createLogger("ERROR"))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		auditor.Record(AuditRecord{Op: "put", Key: fmt.Sprintf("key-%d", i), Status: http.StatusCreated})
+	}
+	require.NoError(t, auditor.Close())
+	require.EqualValues(t, 3, auditor.Stats().Written)
+	require.Len(t, received, 3)
+	for i, line := range received {
+		var rec AuditRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &rec))
+		require.Equal(t, fmt.Sprintf("key-%d", i), rec.Key)
+	}
+}
+
+func TestAuditDropsWhenFull(t *testing.T) {
+	release := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer hook.Close()
+
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	auditor, err := NewAuditor(&AuditConfig{Sink: auditSinkWebhook, URL: hook.URL, Buffer: 2, BatchSize: 1}, srv.Logger)
+	require.NoError(t, err)
+	srv.Auditor = auditor
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	// the sink is stuck, puts still succeed and the overflow is counted
+	for i := 0; i < 10; i++ {
+		resp, err := http.Post(ts.URL+fmt.Sprintf("/api/v1/kv/key-%d", i), "text/plain", bytes.NewBufferString("v"))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	resp, err := http.Get(ts.URL + "/audit")
+	require.NoError(t, err)
+	var stats AuditStatsResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	_ = resp.Body.Close()
+	require.Equal(t, auditSinkWebhook, stats.Sink)
+	require.GreaterOrEqual(t, stats.Dropped, uint64(7))
+
+	close(release)
+	require.NoError(t, auditor.Close())
+	stats = auditor.Stats()
+	require.EqualValues(t, 10, stats.Written+stats.Dropped)
+}
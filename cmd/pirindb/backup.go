@@ -0,0 +1,252 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/v4/disk"
+	"github.com/timson/pirindb/storage"
+)
+
+// snapshot files are named <db>-<time>.db, the time sorts in name order
+const snapshotTimeLayout = "20060102T150405.000Z"
+
+var (
+	ErrBackupDisabled   = errors.New("backups are not configured")
+	ErrBackupRunning    = errors.New("a snapshot is already running")
+	ErrBackupNoHeadroom = errors.New("not enough free disk space for a snapshot")
+)
+
+// BackupStatus reports the snapshots of a database, a failure keeps the last success
+type BackupStatus struct {
+	LastSuccess    time.Time `json:"last_success"`
+	LastFile       string    `json:"last_file,omitempty"`
+	LastSize       int64     `json:"last_size"`
+	LastDurationMs float64   `json:"last_duration_ms"`
+	LastFailure    time.Time `json:"last_failure"`
+	LastError      string    `json:"last_error,omitempty"`
+	Snapshots      int       `json:"snapshots"` // snapshots kept in the directory
+}
+
+// backupState lets one snapshot run at a time, scheduled or triggered by an admin
+type backupState struct {
+	running atomic.Bool
+	lock    sync.Mutex
+	status  map[string]BackupStatus
+}
+
+func (state *backupState) update(name string, fn func(status *BackupStatus)) BackupStatus {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.status == nil {
+		state.status = make(map[string]BackupStatus)
+	}
+	status := state.status[name]
+	fn(&status)
+	state.status[name] = status
+	return status
+}
+
+func (state *backupState) snapshot() map[string]BackupStatus {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	statuses := make(map[string]BackupStatus, len(state.status))
+	for name, status := range state.status {
+		statuses[name] = status
+	}
+	return statuses
+}
+
+// runBackups snapshots every served database into the backup directory and rotates old
+// snapshots, a database failing does not stop the others. The status of each database is
+// returned with the failures joined, ErrBackupRunning while another run is not finished.
+func (srv *Server) runBackups(now time.Time) (map[string]BackupStatus, error) {
+	cfg := srv.Config.Backup
+	if cfg == nil || cfg.Dir == "" {
+		return nil, ErrBackupDisabled
+	}
+	if !srv.backups.running.CompareAndSwap(false, true) {
+		return nil, ErrBackupRunning
+	}
+	defer srv.backups.running.Store(false)
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, err
+	}
+	statuses := make(map[string]BackupStatus)
+	var failures []error
+	for _, name := range srv.DBs.Names() {
+		db, ok := srv.DBs.Get(name)
+		if !ok {
+			continue
+		}
+		start := time.Now()
+		path, size, err := writeSnapshot(db, cfg, name, now)
+		var kept int
+		if err == nil {
+			kept, err = rotateSnapshots(cfg.Dir, name, cfg.Retain)
+		}
+		statuses[name] = srv.backups.update(name, func(status *BackupStatus) {
+			if err != nil {
+				status.LastFailure = now
+				status.LastError = err.Error()
+				return
+			}
+			status.LastSuccess = now
+			status.LastFile = path
+			status.LastSize = size
+			status.LastDurationMs = float64(time.Since(start).Microseconds()) / 1000
+			status.LastError = ""
+			status.Snapshots = kept
+		})
+		if err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", name, err))
+		}
+		switch {
+		case errors.Is(err, ErrBackupNoHeadroom):
+			srv.Logger.Warn("Snapshot skipped", "db", name, "error", err)
+		case err != nil:
+			srv.Logger.Error("Snapshot failed", "db", name, "error", err)
+		default:
+			srv.Logger.Info("Snapshot written", "db", name, "path", path, "size", size,
+				"duration", time.Since(start))
+		}
+	}
+	return statuses, errors.Join(failures...)
+}
+
+// writeSnapshot copies the database into a temporary file, fsyncs and verifies it, and only
+// then renames it to its snapshot name
+func writeSnapshot(db *storage.DB, cfg *BackupConfig, name string, now time.Time) (string, int64, error) {
+	dbSize := db.Stat(storage.WithBuckets(false)).TotalDBSize
+	usage, err := disk.Usage(cfg.Dir)
+	if err != nil {
+		return "", 0, fmt.Errorf("could not check free disk space: %w", err)
+	}
+	if needed := dbSize + uint64(cfg.MinFreeBytes); usage.Free < needed {
+		return "", 0, fmt.Errorf("%w: %d bytes free, %d needed", ErrBackupNoHeadroom, usage.Free, needed)
+	}
+
+	path := filepath.Join(cfg.Dir, fmt.Sprintf("%s-%s.db", name, now.UTC().Format(snapshotTimeLayout)))
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+	var size int64
+	err = db.View(func(tx *storage.Tx) error {
+		size, err = tx.WriteTo(file)
+		return err
+	})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = verifySnapshot(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", 0, err
+	}
+	return path, size, syncDir(cfg.Dir)
+}
+
+// verifySnapshot opens the snapshot read only and checks its trees
+func verifySnapshot(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	db, err := storage.OpenReader(file, info.Size(), nil)
+	if err != nil {
+		return fmt.Errorf("snapshot does not open: %w", err)
+	}
+	defer func() { _ = db.Close() }()
+	if err = db.Check(); err != nil {
+		return fmt.Errorf("snapshot check failed: %w", err)
+	}
+	return nil
+}
+
+// syncDir fsyncs the directory so a renamed snapshot survives a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	return file.Sync()
+}
+
+// rotateSnapshots removes all but the newest retain snapshots of the database and temporary
+// files left by a crashed run, retain 0 keeps them all. It returns the snapshots kept.
+func rotateSnapshots(dir string, name string, retain int) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		stamp, found := strings.CutPrefix(entry.Name(), name+"-")
+		if !found {
+			continue
+		}
+		if stamp, found = strings.CutSuffix(stamp, ".db.tmp"); found {
+			if _, err = time.Parse(snapshotTimeLayout, stamp); err == nil {
+				_ = os.Remove(filepath.Join(dir, entry.Name()))
+			}
+			continue
+		}
+		if stamp, found = strings.CutSuffix(stamp, ".db"); !found {
+			continue
+		}
+		// another database named with this one as a prefix does not parse
+		if _, err = time.Parse(snapshotTimeLayout, stamp); err == nil {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	slices.Sort(snapshots)
+	if retain <= 0 || len(snapshots) <= retain {
+		return len(snapshots), nil
+	}
+	for _, snapshot := range snapshots[:len(snapshots)-retain] {
+		if err = os.Remove(filepath.Join(dir, snapshot)); err != nil {
+			return 0, err
+		}
+	}
+	return retain, nil
+}
+
+// backupLoop snapshots the databases every interval until stop is closed
+func (srv *Server) backupLoop(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			// failures of a database are logged by runBackups
+			if _, err := srv.runBackups(now); errors.Is(err, ErrBackupRunning) {
+				srv.Logger.Warn("Snapshot skipped, the previous one is still running")
+			}
+		}
+	}
+}
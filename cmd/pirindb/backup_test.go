@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestBackups(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	_, err := srv.runBackups(time.Now())
+	require.ErrorIs(t, err, ErrBackupDisabled)
+
+	dir := filepath.Join(t.TempDir(), "backups")
+	srv.Config.Backup = &BackupConfig{Dir: dir, Retain: 2}
+	require.NoError(t, Put(srv.DBs.Primary(), "foo", "bar", labeled("test")))
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		statuses, err := srv.runBackups(start.Add(time.Duration(i) * time.Hour))
+		require.NoError(t, err)
+		require.Empty(t, statuses[defaultDBName].LastError)
+	}
+	// a leftover of a crashed run is removed with the rotation
+	leftover := filepath.Join(dir, defaultDBName+"-20260101T000000.000Z.db.tmp")
+	require.NoError(t, os.WriteFile(leftover, []byte("partial"), 0o600))
+	statuses, err := srv.runBackups(start.Add(3 * time.Hour))
+	require.NoError(t, err)
+	status := statuses[defaultDBName]
+	require.Equal(t, 2, status.Snapshots)
+	require.Equal(t, filepath.Join(dir, defaultDBName+"-20260102T060405.000Z.db"), status.LastFile)
+	require.NoFileExists(t, leftover)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.Equal(t, []string{defaultDBName + "-20260102T050405.000Z.db", defaultDBName + "-20260102T060405.000Z.db"}, names)
+
+	// the snapshot holds the data and opens as a clean database
+	file, err := os.Open(status.LastFile)
+	require.NoError(t, err)
+	defer func() { _ = file.Close() }()
+	info, err := file.Stat()
+	require.NoError(t, err)
+	require.EqualValues(t, status.LastSize, info.Size())
+	snapshot, err := storage.OpenReader(file, info.Size(), nil)
+	require.NoError(t, err)
+	require.True(t, snapshot.DurabilityInfo().CleanShutdown)
+	value, found := Get(snapshot, "foo")
+	require.True(t, found)
+	require.Equal(t, "bar", value)
+	require.NoError(t, snapshot.Close())
+
+	// one run at a time, and no snapshot without headroom
+	srv.backups.running.Store(true)
+	_, err = srv.runBackups(time.Now())
+	require.ErrorIs(t, err, ErrBackupRunning)
+	srv.backups.running.Store(false)
+	srv.Config.Backup.MinFreeBytes = math.MaxInt64 / 2
+	statuses, err = srv.runBackups(time.Now())
+	require.ErrorIs(t, err, ErrBackupNoHeadroom)
+	require.Contains(t, statuses[defaultDBName].LastError, "not enough free disk space")
+	require.Equal(t, status.LastSuccess, statuses[defaultDBName].LastSuccess, "the last success is kept")
+	require.False(t, statuses[defaultDBName].LastFailure.IsZero())
+}
+
+func TestBackupEndpoint(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.AdminToken = "secret"
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	url := ts.URL + "/api/v1/admin/backup"
+
+	status, code := modeRequest(t, http.MethodPost, url, "", "secret")
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "backups_disabled", code)
+
+	srv.Config.Backup = &BackupConfig{Dir: t.TempDir()}
+	status, _ = modeRequest(t, http.MethodPost, url, "", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = modeRequest(t, http.MethodPost, url, "", "secret")
+	require.Equal(t, http.StatusOK, status)
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var backups BackupResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&backups))
+	require.False(t, backups.Running)
+	require.Positive(t, backups.Databases[defaultDBName].LastSize)
+	require.FileExists(t, backups.Databases[defaultDBName].LastFile)
+
+	srv.Config.Backup.MinFreeBytes = math.MaxInt64 / 2
+	status, code = modeRequest(t, http.MethodPost, url, "", "secret")
+	require.Equal(t, http.StatusInsufficientStorage, status)
+	require.Equal(t, "snapshot_failed", code)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/list"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+// cacheEntryOverhead approximates the memory of an entry besides its strings
+const cacheEntryOverhead = 128
+
+// CacheStats reports the read cache of a database, stale serves are hits a verification
+// found different from storage and should stay zero
+type CacheStats struct {
+	Enabled       bool     `json:"enabled"`
+	Buckets       []string `json:"buckets,omitempty"`
+	Entries       int      `json:"entries"`
+	Bytes         int64    `json:"bytes"`
+	MaxBytes      int64    `json:"max_bytes"`
+	Hits          uint64   `json:"hits"`
+	Misses        uint64   `json:"misses"`
+	Bypasses      uint64   `json:"bypasses"`
+	HitRate       float64  `json:"hit_rate"`
+	Evictions     uint64   `json:"evictions"`
+	Invalidations uint64   `json:"invalidations"`
+	Verified      uint64   `json:"verified"`
+	StaleServes   uint64   `json:"stale_serves"`
+}
+
+type cacheKey struct {
+	bucket string
+	key    string
+}
+
+type cacheEntry struct {
+	key      cacheKey
+	value    string
+	checksum string
+}
+
+func (entry *cacheEntry) size() int64 {
+	return int64(len(entry.key.bucket) + len(entry.key.key) + len(entry.value) + len(entry.checksum) + cacheEntryOverhead)
+}
+
+// readCache answers GETs of the enabled buckets of a database from memory, least recently
+// used entries are evicted above maxBytes. The commit hook of the database invalidates the
+// changed keys before the commit is visible. Every invalidation bumps the epoch of the
+// bucket: a GET fills the cache only when the epoch did not change since before its read,
+// so a commit racing the read can not leave the old value behind.
+type readCache struct {
+	lock        sync.Mutex
+	buckets     map[string]bool
+	maxBytes    int64
+	verifyEvery uint64
+	size        int64
+	lru         *list.List // of *cacheEntry, the front is the most recently used
+	entries     map[cacheKey]*list.Element
+	epochs      map[string]uint64
+	stats       CacheStats
+}
+
+func newReadCache(cfg *CacheConfig) *readCache {
+	cache := &readCache{
+		buckets:     make(map[string]bool, len(cfg.Buckets)),
+		maxBytes:    cfg.MaxBytes,
+		verifyEvery: uint64(cfg.VerifyEvery),
+		lru:         list.New(),
+		entries:     make(map[cacheKey]*list.Element),
+		epochs:      make(map[string]uint64),
+	}
+	if cache.maxBytes <= 0 {
+		cache.maxBytes = defaultCacheMaxBytes
+	}
+	for _, bucket := range cfg.Buckets {
+		cache.buckets[bucket] = true
+	}
+	return cache
+}
+
+func (cache *readCache) enabled(bucket string) bool {
+	return cache.buckets[bucket]
+}
+
+// get returns the cached entry and whether the hit is to be verified against storage, the
+// epoch of the bucket is returned on a miss as well
+func (cache *readCache) get(bucket, key string) (entry cacheEntry, epoch uint64, verify bool, ok bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	epoch = cache.epochs[bucket]
+	element, ok := cache.entries[cacheKey{bucket, key}]
+	if !ok {
+		cache.stats.Misses++
+		return cacheEntry{}, epoch, false, false
+	}
+	cache.stats.Hits++
+	cache.lru.MoveToFront(element)
+	verify = cache.verifyEvery > 0 && cache.stats.Hits%cache.verifyEvery == 0
+	return *element.Value.(*cacheEntry), epoch, verify, true
+}
+
+// put caches the value read while the bucket was at epoch, a value larger than the cache or
+// read before a later invalidation is dropped
+func (cache *readCache) put(bucket, key string, value, checksum string, epoch uint64) {
+	entry := &cacheEntry{key: cacheKey{bucket, key}, value: value, checksum: checksum}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.epochs[bucket] != epoch || entry.size() > cache.maxBytes {
+		return
+	}
+	if element, ok := cache.entries[entry.key]; ok {
+		cache.remove(element)
+	}
+	cache.entries[entry.key] = cache.lru.PushFront(entry)
+	cache.size += entry.size()
+	for cache.size > cache.maxBytes {
+		cache.remove(cache.lru.Back())
+		cache.stats.Evictions++
+	}
+}
+
+func (cache *readCache) remove(element *list.Element) {
+	entry := cache.lru.Remove(element).(*cacheEntry)
+	delete(cache.entries, entry.key)
+	cache.size -= entry.size()
+}
+
+// invalidate is the commit hook of the database, it drops the changed keys of the enabled
+// buckets and every key of a bucket changed as a whole
+func (cache *readCache) invalidate(event *storage.CommitEvent) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for _, bucket := range event.Buckets {
+		if !cache.enabled(bucket) {
+			continue
+		}
+		cache.epochs[bucket]++
+		for key, element := range cache.entries {
+			if key.bucket == bucket {
+				cache.remove(element)
+				cache.stats.Invalidations++
+			}
+		}
+	}
+	for bucket, keys := range event.Keys {
+		if !cache.enabled(bucket) {
+			continue
+		}
+		cache.epochs[bucket]++
+		for _, key := range keys {
+			if element, ok := cache.entries[cacheKey{bucket, string(key)}]; ok {
+				cache.remove(element)
+				cache.stats.Invalidations++
+			}
+		}
+	}
+}
+
+// verify compares a hit with storage, a difference not explained by a commit since the hit
+// is a stale serve: the entry is dropped and the stored value is to be returned instead
+func (cache *readCache) verify(db *storage.DB, hit cacheEntry, epoch uint64) (storedValue, bool, error) {
+	stored, err := readValue(db, []byte(hit.key.bucket), hit.key.key)
+	if err != nil {
+		return stored, false, err
+	}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.stats.Verified++
+	if cache.epochs[hit.key.bucket] != epoch || (stored.found && stored.value == hit.value && stored.checksum == hit.checksum) {
+		return stored, false, nil
+	}
+	cache.stats.StaleServes++
+	if element, ok := cache.entries[hit.key]; ok {
+		cache.remove(element)
+	}
+	return stored, true, nil
+}
+
+func (cache *readCache) bypassed() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.stats.Bypasses++
+}
+
+func (cache *readCache) getStats() CacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	stats := cache.stats
+	stats.Enabled = true
+	for bucket := range cache.buckets {
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+	slices.Sort(stats.Buckets)
+	stats.Entries = len(cache.entries)
+	stats.Bytes = cache.size
+	stats.MaxBytes = cache.maxBytes
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// setupCaches creates the read caches of the registered databases and their commit hooks.
+// The router builds them before it serves a request: a hook sees the write transactions
+// started after it was registered, so no commit can miss the cache.
+func (srv *Server) setupCaches() {
+	cfg := srv.Config.Cache
+	if srv.caches != nil || cfg == nil || len(cfg.Buckets) == 0 {
+		return
+	}
+	srv.caches = make(map[string]*readCache)
+	for _, name := range srv.DBs.Names() {
+		db, ok := srv.DBs.Get(name)
+		if !ok {
+			continue
+		}
+		cache := newReadCache(cfg)
+		db.OnCommit(cache.invalidate)
+		srv.caches[name] = cache
+	}
+}
+
+// requestCache returns the read cache of the request database, nil without one
+func (srv *Server) requestCache(r *http.Request) *readCache {
+	name := chi.URLParam(r, "db")
+	if name == "" {
+		name = srv.DBs.PrimaryName()
+	}
+	return srv.caches[name]
+}
+
+// noCache reports whether the request asks to skip the cache
+func noCache(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedLookup reads a key of the main bucket through the read cache of the database, the
+// cache header of the response tells whether the cache answered
+func (srv *Server) cachedLookup(w http.ResponseWriter, r *http.Request, db *storage.DB, key string) (string, string, bool, error) {
+	cache := srv.requestCache(r)
+	bucket := string(DBBucket)
+	if cache == nil || !cache.enabled(bucket) {
+		return LookupWithChecksum(db, key)
+	}
+	if noCache(r) {
+		cache.bypassed()
+		w.Header().Set(cacheHeader, "bypass")
+		return LookupWithChecksum(db, key)
+	}
+	hit, epoch, verify, ok := cache.get(bucket, key)
+	if !ok {
+		w.Header().Set(cacheHeader, "miss")
+		stored, err := readValue(db, DBBucket, key)
+		if err == nil && stored.found && !stored.expiring {
+			cache.put(bucket, key, stored.value, stored.checksum, epoch)
+		}
+		return stored.value, stored.checksum, stored.found, err
+	}
+	w.Header().Set(cacheHeader, "hit")
+	if verify {
+		stored, stale, err := cache.verify(db, hit, epoch)
+		if err != nil {
+			return "", "", false, err
+		}
+		if stale {
+			srv.Logger.Error("read cache served a stale value", "key", srv.redactKey(key))
+			return stored.value, stored.checksum, stored.found, nil
+		}
+	}
+	return hit.value, hit.checksum, true, nil
+}
+
+func (srv *Server) handleCacheStats(w http.ResponseWriter, r *http.Request) {
+	if _, ok := srv.requestDB(r); !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	cache := srv.requestCache(r)
+	if cache == nil {
+		render.JSON(w, r, &CacheStats{})
+		return
+	}
+	render.JSON(w, r, cache.getStats())
+}
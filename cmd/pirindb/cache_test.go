@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func setupCacheServer(t *testing.T, cfg *CacheConfig) (*Server, string) {
+	srv, filename, txLogPath := setupTestServer(t)
+	srv.Config.Cache = cfg
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	return srv, ts.URL + "/api/v1"
+}
+
+// cachedGet returns the status, the value and the cache header of a GET
+func cachedGet(t *testing.T, url string, noCache bool) (int, string, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if noCache {
+		req.Header.Set("Cache-Control", "no-cache")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var get GetResponse
+	_ = json.NewDecoder(resp.Body).Decode(&get)
+	return resp.StatusCode, get.Value, resp.Header.Get(cacheHeader)
+}
+
+func TestReadCache(t *testing.T) {
+	srv, url := setupCacheServer(t, &CacheConfig{Buckets: []string{string(DBBucket)}, VerifyEvery: 1})
+	db := srv.DBs.Primary()
+	require.NoError(t, Put(db, "foo", "bar", labeled("test")))
+
+	status, value, source := cachedGet(t, url+"/kv/foo", false)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "bar", value)
+	require.Equal(t, "miss", source)
+	_, value, source = cachedGet(t, url+"/kv/foo", false)
+	require.Equal(t, "bar", value)
+	require.Equal(t, "hit", source)
+	_, _, source = cachedGet(t, url+"/kv/foo", true)
+	require.Equal(t, "bypass", source)
+
+	// commits invalidate the key before they are visible
+	require.NoError(t, Put(db, "foo", "baz", labeled("test")))
+	_, value, source = cachedGet(t, url+"/kv/foo", false)
+	require.Equal(t, "baz", value)
+	require.Equal(t, "miss", source)
+	_, err := Delete(db, "foo", labeled("test"))
+	require.NoError(t, err)
+	status, _, _ = cachedGet(t, url+"/kv/foo", false)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// keys under an expiry rule vanish without a commit and are not cached
+	require.NoError(t, Put(db, "tmp:1", "value", labeled("test")))
+	require.NoError(t, ExpirePrefix(db, string(DBBucket), "tmp:", time.Now().Add(time.Hour), labeled("test")))
+	cachedGet(t, url+"/kv/tmp:1", false)
+	_, _, source = cachedGet(t, url+"/kv/tmp:1", false)
+	require.Equal(t, "miss", source)
+
+	stats := srv.caches[defaultDBName].getStats()
+	require.EqualValues(t, 1, stats.Hits)
+	require.EqualValues(t, 5, stats.Misses)
+	require.EqualValues(t, 1, stats.Bypasses)
+	require.EqualValues(t, 1, stats.Verified)
+	require.Zero(t, stats.StaleServes)
+	require.Zero(t, stats.Entries)
+
+	// a value changed behind the cache is caught by the verification
+	require.NoError(t, Put(db, "other", "old", labeled("test")))
+	cachedGet(t, url+"/kv/other", false)
+	cache := srv.caches[defaultDBName]
+	cache.lock.Lock()
+	element := cache.entries[cacheKey{string(DBBucket), "other"}]
+	element.Value.(*cacheEntry).value = "stale"
+	cache.lock.Unlock()
+	_, value, _ = cachedGet(t, url+"/kv/other", false)
+	require.Equal(t, "old", value)
+	require.EqualValues(t, 1, cache.getStats().StaleServes)
+
+	resp, err := http.Get(url + "/db/cache")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	require.True(t, stats.Enabled)
+	require.Equal(t, []string{string(DBBucket)}, stats.Buckets)
+	require.Positive(t, stats.HitRate)
+}
+
+func TestReadCacheBounded(t *testing.T) {
+	cache := newReadCache(&CacheConfig{Buckets: []string{"kv"}, MaxBytes: 3 * (cacheEntryOverhead + 11)})
+	for _, key := range []string{"key1", "key2", "key3"} {
+		_, epoch, _, _ := cache.get("kv", key)
+		cache.put("kv", key, "value", "", epoch)
+	}
+	_, _, _, ok := cache.get("kv", "key1")
+	require.True(t, ok)
+	_, epoch, _, _ := cache.get("kv", "key4")
+	cache.put("kv", "key4", "value", "", epoch)
+	_, _, _, ok = cache.get("kv", "key2")
+	require.False(t, ok, "the least recently used entry is evicted")
+	require.EqualValues(t, 1, cache.getStats().Evictions)
+
+	// a read that raced a commit does not fill the cache
+	_, epoch, _, _ = cache.get("kv", "key5")
+	cache.invalidate(&storage.CommitEvent{Keys: map[string][][]byte{"kv": {[]byte("key5")}}})
+	cache.put("kv", "key5", "old", "", epoch)
+	_, _, _, ok = cache.get("kv", "key5")
+	require.False(t, ok)
+	cache.invalidate(&storage.CommitEvent{Buckets: []string{"kv"}})
+	require.Zero(t, cache.getStats().Entries)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/timson/pirindb/storage"
+)
+
+var (
+	// HealthBucket holds the canary key, it is written and removed again by every canary run
+	HealthBucket = []byte("__health")
+	canaryKey    = []byte("canary")
+)
+
+// CanaryResult is the outcome of the last canary write of a database
+type CanaryResult struct {
+	OK        bool      `json:"ok"`
+	At        time.Time `json:"at"`
+	LatencyMs float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"` // the storage error of a failed run
+}
+
+// runCanary writes the canary key, deletes it in a second transaction and fsyncs the file,
+// so a database that can't commit or sync is caught before clients write to it
+func runCanary(db *storage.DB, now time.Time) error {
+	err := db.UpdateLabeled("canary", func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(HealthBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(canaryKey, []byte(now.UTC().Format(time.RFC3339Nano)))
+	})
+	if err != nil {
+		return err
+	}
+	err = db.UpdateLabeled("canary", func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(HealthBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Remove(canaryKey)
+	})
+	if err != nil {
+		return err
+	}
+	return db.Sync()
+}
+
+// checkCanaries runs the canary in every writable database and keeps the results for the
+// readiness check. Transient errors say the database is busy, not broken, the previous
+// result is kept.
+func (srv *Server) checkCanaries() {
+	for _, name := range srv.DBs.Names() {
+		db, ok := srv.DBs.Get(name)
+		if !ok || db.ReadOnly() {
+			continue
+		}
+		start := time.Now()
+		err := runCanary(db, start)
+		if storage.IsTransient(err) {
+			srv.Logger.Warn("Canary write skipped", "db", name, "error", err)
+			continue
+		}
+		result := CanaryResult{OK: err == nil, At: start, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		previous, known := srv.canaries.Swap(name, result)
+		switch {
+		case err != nil:
+			srv.Logger.Error("Canary write failed", "db", name, "error", err)
+		case known && !previous.(CanaryResult).OK:
+			srv.Logger.Info("Canary write recovered", "db", name, "latency_ms", result.LatencyMs)
+		}
+	}
+}
+
+// canaryResults returns the last canary result of every database that ran one
+func (srv *Server) canaryResults() map[string]CanaryResult {
+	results := make(map[string]CanaryResult)
+	srv.canaries.Range(func(name, result any) bool {
+		results[name.(string)] = result.(CanaryResult)
+		return true
+	})
+	return results
+}
+
+// canaryLoop repeats the canary write until stop is closed
+func (srv *Server) canaryLoop(stop chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			srv.checkCanaries()
+		}
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
+)
+
+var (
+	// ShardingBucket persists the ring in the primary database, one shard per key
+	ShardingBucket = []byte(storage.InternalBucketPrefix + "sharding")
+)
+
+const (
+	// forwardedByHeader marks requests proxied to the owner shard, they are never forwarded again
+	forwardedByHeader = "X-Pirin-Forwarded-By"
+	// servedByHeader names the node that served a key request
+	servedByHeader    = "X-Pirin-Served-By"
+	joinRetryInterval = time.Second
+)
+
+// LoadRing reads the shards persisted in the database
+func LoadRing(db *storage.DB) ([]*sharding.Shard, error) {
+	shards := make([]*sharding.Shard, 0)
+	err := db.ForEach(ShardingBucket, func(k, v []byte) error {
+		var shard sharding.Shard
+		if err := json.Unmarshal(v, &shard); err != nil {
+			return err
+		}
+		shards = append(shards, &shard)
+		return nil
+	})
+	return shards, err
+}
+
+// SaveRing makes the persisted ring equal to shards
+func SaveRing(db *storage.DB, shards []*sharding.Shard) error {
+	return db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(ShardingBucket)
+		if err != nil {
+			return err
+		}
+		keep := make(map[string]bool, len(shards))
+		for _, shard := range shards {
+			keep[shard.Name] = true
+		}
+		var stale [][]byte
+		err = bucket.ForEach(func(k, v []byte) error {
+			if !keep[string(k)] {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range stale {
+			if err = bucket.Remove(key); err != nil {
+				return err
+			}
+		}
+		for _, shard := range shards {
+			data, err := json.Marshal(shard)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(shard.Name), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// clusterEnabled reports whether the node is a member of a sharded cluster
+func (srv *Server) clusterEnabled() bool {
+	return srv.Config.Cluster != nil && srv.Config.Cluster.NodeName != ""
+}
+
+// shardID is the id of the node in generated keys, the configured one or a hash of the node
+// name, 0 outside a cluster
+func (srv *Server) shardID() uint32 {
+	if !srv.clusterEnabled() {
+		return 0
+	}
+	if srv.Config.Cluster.ShardID != 0 {
+		return srv.Config.Cluster.ShardID
+	}
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(srv.Config.Cluster.NodeName))
+	return hash.Sum32()
+}
+
+// keyGenerator returns the generator of the node, its clock is shared by all databases
+func (srv *Server) keyGenerator() *keys.Generator {
+	srv.keyGenOnce.Do(func() {
+		srv.keyGen = keys.NewGenerator(keys.NewClock(), srv.shardID())
+	})
+	return srv.keyGen
+}
+
+// selfShard describes this node as it is advertised to other members
+func (srv *Server) selfShard() *sharding.Shard {
+	host := srv.Config.Cluster.AdvertiseHost
+	if host == "" {
+		host = srv.Config.Server.Host
+	}
+	shard := &sharding.Shard{
+		Name:     srv.Config.Cluster.NodeName,
+		Host:     host,
+		Port:     srv.Config.Server.Port,
+		BasePath: srv.basePath(),
+		Status:   sharding.ShardActive,
+	}
+	if mode := srv.Mode(); mode != ModeReadWrite {
+		shard.Mode = string(mode)
+	}
+	return shard
+}
+
+// syncRing applies the shard list to the ring and persists it, the node keeps advertising
+// its own mode whatever the list says. On a membership change the members before it are
+// remembered for anti-entropy and read repair, a node without a ring takes the other members.
+func (srv *Server) syncRing(shards []*sharding.Shard) error {
+	self := srv.selfShard()
+	var others []*sharding.Shard
+	for i, shard := range shards {
+		if shard.Name == self.Name && shard.Mode != self.Mode {
+			shardCopy := *shard
+			shardCopy.Mode = self.Mode
+			shards[i] = &shardCopy
+		}
+		if shard.Name != self.Name {
+			others = append(others, shard)
+		}
+	}
+	if previous := srv.Ring.Shards(); len(previous) == 0 {
+		srv.beginRingChange(others)
+	} else if membersChanged(srv.Ring, shards) {
+		srv.beginRingChange(previous)
+	}
+	srv.Ring.Sync(shards)
+	return SaveRing(srv.DBs.Primary(), srv.Ring.Shards())
+}
+
+// Bootstrap builds the ring before the node reports ready. The persisted ring is loaded
+// first, then static shards from the config replace it, or the node registers with the
+// seed and takes the ring the seed returns. A node without shards and seed starts a new
+// cluster. Joining is retried until the context is done.
+func (srv *Server) Bootstrap(ctx context.Context) error {
+	if !srv.clusterEnabled() {
+		srv.ready.Store(true)
+		return nil
+	}
+	persisted, err := LoadRing(srv.DBs.Primary())
+	if err != nil {
+		return err
+	}
+	srv.Ring.Sync(persisted)
+
+	self := srv.selfShard()
+	switch {
+	case len(srv.Config.Shards) > 0:
+		shards := make([]*sharding.Shard, 0, len(srv.Config.Shards))
+		for _, shardCfg := range srv.Config.Shards {
+			shards = append(shards, &sharding.Shard{
+				Name:     shardCfg.Name,
+				Host:     shardCfg.Host,
+				Port:     shardCfg.Port,
+				BasePath: strings.TrimSuffix(shardCfg.BasePath, "/"),
+				Status:   sharding.ShardActive,
+			})
+		}
+		err = srv.syncRing(shards)
+	case srv.Config.Cluster.SeedURL != "":
+		var shards []*sharding.Shard
+		shards, err = srv.joinSeed(ctx, self)
+		if err == nil {
+			err = srv.syncRing(shards)
+		}
+	default:
+		srv.Ring.Add(self)
+		err = SaveRing(srv.DBs.Primary(), srv.Ring.Shards())
+	}
+	if err != nil {
+		return err
+	}
+	srv.ready.Store(true)
+	srv.Logger.Info("cluster ring ready", "node", self.Name, "shards", len(srv.Ring.Shards()))
+	return nil
+}
+
+func (srv *Server) joinSeed(ctx context.Context, self *sharding.Shard) ([]*sharding.Shard, error) {
+	seed := client.New(srv.Config.Cluster.SeedURL)
+	for {
+		shards, err := seed.JoinCluster(ctx, self)
+		if err == nil {
+			return shards, nil
+		}
+		srv.Logger.Warn("failed to join cluster", "seed", srv.Config.Cluster.SeedURL, "error", err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(joinRetryInterval):
+		}
+	}
+}
+
+func (srv *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !srv.ready.Load() {
+		render.Status(r, http.StatusServiceUnavailable)
+		render.JSON(w, r, HealthResponse{Status: "bootstrapping"})
+		return
+	}
+	resp := HealthResponse{Status: "ok", Mode: srv.Mode(), Canary: srv.canaryResults()}
+	var failed []string
+	for _, name := range srv.DBs.Names() {
+		if db, ok := srv.DBs.Get(name); ok {
+			if db.WriteStall().Stalled {
+				resp.WriteStalled = append(resp.WriteStalled, name)
+			}
+			for _, warning := range db.SoftLimits().Warnings {
+				resp.Warnings = append(resp.Warnings, HealthWarning{DB: name, Kind: string(warning.Kind), Message: warning.Message})
+			}
+		}
+		if result, ok := resp.Canary[name]; ok && !result.OK {
+			failed = append(failed, name)
+		}
+	}
+	switch {
+	case resp.Mode == ModeMaintenance:
+		// the node serves no data, load balancers take it out of rotation
+		resp.Status = string(resp.Mode)
+		render.Status(r, http.StatusServiceUnavailable)
+	case len(failed) > 0:
+		// the disk or the file is broken, the node must not take writes
+		resp.Status = "canary_failed"
+		resp.Error = failed[0] + ": " + resp.Canary[failed[0]].Error
+		render.Status(r, http.StatusServiceUnavailable)
+	case resp.Mode == ModeReadOnly:
+		resp.Status = string(resp.Mode)
+	case len(resp.WriteStalled) > 0:
+		resp.Status = "write_stalled"
+	}
+	render.JSON(w, r, resp)
+}
+
+func (srv *Server) handleRing(w http.ResponseWriter, r *http.Request) {
+	state := srv.Ring.State()
+	render.JSON(w, r, &client.RingInfo{
+		Version:        state.Version,
+		VirtualNodes:   state.VirtualNodes,
+		Shards:         state.Shards,
+		GroupDelimiter: state.GroupDelimiter,
+	})
+}
+
+// handleJoin adds the shard to the ring and pushes the new ring to the other members.
+// A shard joining again with the same name keeps its place on the ring.
+func (srv *Server) handleJoin(w http.ResponseWriter, r *http.Request) {
+	var shard sharding.Shard
+	if err := json.NewDecoder(r.Body).Decode(&shard); err != nil || shard.Name == "" || shard.Host == "" || shard.Port <= 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	if shard.Status == "" {
+		shard.Status = sharding.ShardActive
+	}
+	var known *sharding.Shard
+	previous := srv.Ring.Shards()
+	for _, member := range previous {
+		if member.Name == shard.Name {
+			known = member
+		}
+	}
+	if known == nil {
+		srv.beginRingChange(previous)
+	}
+	srv.Ring.Add(&shard)
+	shards := srv.Ring.Shards()
+	if err := SaveRing(srv.DBs.Primary(), shards); err != nil {
+		srv.Logger.Error("failed to save ring", "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	if known == nil || *known != shard {
+		srv.Logger.Info("shard joined", "shard", shard.Name, "url", shard.URL())
+		srv.pushRing(r.Context(), shards, shard.Name)
+	}
+	render.JSON(w, r, &client.RingInfo{Shards: shards})
+}
+
+// pushRing sends the ring to every member except this node and the joining shard,
+// unreachable members pick the ring up when they join again
+func (srv *Server) pushRing(ctx context.Context, shards []*sharding.Shard, joined string) {
+	for _, member := range shards {
+		if member.Name == joined || member.Name == srv.Config.Cluster.NodeName {
+			continue
+		}
+		if _, err := client.New(member.URL()).PushRing(ctx, shards); err != nil {
+			srv.Logger.Warn("failed to push ring", "shard", member.Name, "error", err)
+		}
+	}
+}
+
+func (srv *Server) handleRingUpdate(w http.ResponseWriter, r *http.Request) {
+	var ring client.RingInfo
+	if err := json.NewDecoder(r.Body).Decode(&ring); err != nil || len(ring.Shards) == 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	if err := srv.syncRing(ring.Shards); err != nil {
+		srv.Logger.Error("failed to save ring", "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &client.RingInfo{Shards: srv.Ring.Shards()})
+}
+
+// Read consistency levels selected with the consistency query parameter
+const (
+	ConsistencyOwner = "owner" // always read from the ring owner, default
+	ConsistencyAny   = "any"   // a replica holding the key may serve it locally
+)
+
+// replicas returns the number of shards holding a copy of each key, the owner included
+func (srv *Server) replicas() int {
+	if srv.Config.Cluster.Replicas < 1 {
+		return 1
+	}
+	return srv.Config.Cluster.Replicas
+}
+
+// isReplica reports whether this node is one of the shards holding the key
+func (srv *Server) isReplica(key string) bool {
+	for _, shard := range srv.Ring.GetShards(key, srv.replicas()) {
+		if shard.Name == srv.Config.Cluster.NodeName {
+			return true
+		}
+	}
+	return false
+}
+
+// serveLocal reports whether a read may skip the owner: consistency=any and this node
+// is a replica with a local copy of the key
+func (srv *Server) serveLocal(r *http.Request, key string) bool {
+	if r.Method != http.MethodGet || r.URL.Query().Get("consistency") != ConsistencyAny || !srv.isReplica(key) {
+		return false
+	}
+	db, ok := srv.requestDB(r)
+	if !ok {
+		return false
+	}
+	_, found := Get(db, key)
+	return found
+}
+
+// routeKey proxies key requests to the shard owning the key, request and response bodies
+// are streamed and never held in memory whole. Requests already forwarded
+// by another node and requests to a node outside of a cluster are served locally, reads
+// with consistency=any are served locally by a replica holding the key.
+func (srv *Server) routeKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !srv.clusterEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		switch r.URL.Query().Get("consistency") {
+		case "", ConsistencyOwner, ConsistencyAny:
+		default:
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		key := chi.URLParam(r, "key")
+		owner := srv.Ring.GetShard(key)
+		if r.Header.Get(forwardedByHeader) != "" || owner == nil ||
+			owner.Name == srv.Config.Cluster.NodeName || srv.serveLocal(r, key) {
+			w.Header().Set(servedByHeader, srv.Config.Cluster.NodeName)
+			next.ServeHTTP(w, r)
+			return
+		}
+		srv.forward(w, r, owner)
+	})
+}
+
+// routeUpload sends upload chunk and commit requests to the node holding the upload, the
+// node that started it is named in the upload id
+func (srv *Server) routeUpload(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !srv.clusterEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		node := uploadNode(chi.URLParam(r, "id"))
+		if r.Header.Get(forwardedByHeader) != "" || node == "" || node == srv.Config.Cluster.NodeName {
+			w.Header().Set(servedByHeader, srv.Config.Cluster.NodeName)
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, shard := range srv.Ring.Shards() {
+			if shard.Name == node {
+				srv.forward(w, r, shard)
+				return
+			}
+		}
+		// the node left the ring, its staged chunks left with it
+		_ = render.Render(w, r, ErrUploadNotFoundResponse())
+	})
+}
+
+// forward proxies the request to the shard, request and response bodies are streamed
+func (srv *Server) forward(w http.ResponseWriter, r *http.Request, owner *sharding.Shard) {
+	// the owner advertises its mode with the ring, a refused request is not forwarded
+	if ownerMode := NodeMode(owner.Mode); ownerMode == ModeMaintenance || (!ownerMode.acceptsWrites() && isMutating(r)) {
+		_ = render.Render(w, r, ErrModeResponse(ownerMode))
+		return
+	}
+	target, err := url.Parse(owner.URL())
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	// the client's Accept-Encoding is forwarded and an encoded owner response passes
+	// through, without one the transport asks the owner for gzip and decodes it
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Header.Set(forwardedByHeader, srv.Config.Cluster.NodeName)
+			// the owner records the request under the same id in its audit log
+			pr.Out.Header.Set(middleware.RequestIDHeader, middleware.GetReqID(pr.In.Context()))
+			setForwarded(pr.Out, pr.In)
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				// a body without Content-Length outgrew the value limit while streaming
+				_ = render.Render(w, r, ErrValueTooLarge())
+				return
+			}
+			srv.Logger.Error("failed to proxy request", "shard", owner.Name, "error", err)
+			_ = render.Render(w, r, ErrBadGateway())
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// fanOutDeletePrefix repeats the prefix delete on every other shard, a prefix spans the
+// whole ring. Counts are summed into resp, a key copied to replicas is counted by each.
+func (srv *Server) fanOutDeletePrefix(r *http.Request, resp *DeletePrefixResponse) error {
+	resp.Shards = map[string]int{srv.Config.Cluster.NodeName: resp.Count}
+	for _, shard := range srv.Ring.Shards() {
+		if shard.Name == srv.Config.Cluster.NodeName {
+			continue
+		}
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodDelete, shard.URL()+r.URL.RequestURI(), nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(forwardedByHeader, srv.Config.Cluster.NodeName)
+		req.Header.Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		setForwarded(req, r)
+		// Accept-Encoding is left unset, the transport asks for gzip and decodes the body
+		shardResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", shard.Name, err)
+		}
+		var result DeletePrefixResponse
+		err = json.NewDecoder(shardResp.Body).Decode(&result)
+		_ = shardResp.Body.Close()
+		if shardResp.StatusCode != http.StatusOK {
+			return fmt.Errorf("shard %s: unexpected status code: %s", shard.Name, shardResp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("shard %s: failed to parse response: %w", shard.Name, err)
+		}
+		resp.Shards[shard.Name] = result.Count
+		resp.Count += result.Count
+		for _, key := range result.Sample {
+			if len(resp.Sample) < deletePrefixSampleSize {
+				resp.Sample = append(resp.Sample, key)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,692 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/pkg/client"
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
+)
+
+type testNode struct {
+	srv *Server
+	ts  *httptest.Server
+}
+
+// startTestNode serves a cluster node on a random port, the node is not bootstrapped
+func startTestNode(t *testing.T, name string, cluster *ClusterConfig, configure ...func(cfg *Config)) *testNode {
+	t.Helper()
+	filename := storage.TempFileName(".db")
+	db, err := storage.Open(filename, nil)
+	require.NoError(t, err)
+	txLogPath := db.GetOptions().TxLogPath
+
+	cluster.NodeName = name
+	cfg := &Config{
+		Server:  &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		Cluster: cluster,
+		DB:      &DatabaseConfig{Filename: filename},
+	}
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	ts := httptest.NewServer(srv.buildRouter())
+	_, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	require.NoError(t, err)
+	cfg.Server.Port, _ = strconv.Atoi(port)
+
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	return &testNode{srv: srv, ts: ts}
+}
+
+func TestClusterBootstrap(t *testing.T) {
+	seed := startTestNode(t, "node1", &ClusterConfig{})
+	resp, err := http.Get(seed.ts.URL + "/health/ready")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	require.NoError(t, seed.srv.Bootstrap(context.Background()))
+	nodes := []*testNode{seed}
+	for _, name := range []string{"node2", "node3"} {
+		node := startTestNode(t, name, &ClusterConfig{SeedURL: seed.ts.URL})
+		require.NoError(t, node.srv.Bootstrap(context.Background()))
+		nodes = append(nodes, node)
+	}
+
+	requireRing := func() {
+		for _, node := range nodes {
+			require.Len(t, node.srv.Ring.Shards(), 3)
+			require.Equal(t, 3*sharding.DefaultVirtualNodes, node.srv.Ring.Points())
+			persisted, err := LoadRing(node.srv.DBs.Primary())
+			require.NoError(t, err)
+			require.Equal(t, node.srv.Ring.Shards(), persisted)
+
+			resp, err := http.Get(node.ts.URL + "/health/ready")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			_ = resp.Body.Close()
+		}
+	}
+	requireRing()
+
+	// every key is written through some node and lands on its owner only
+	owners := make(map[string]int)
+	for i := 0; i < 60; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		entry := nodes[i%len(nodes)]
+		resp, err := http.Post(entry.ts.URL+"/api/v1/kv/"+key, "text/plain", bytes.NewBufferString("value-"+key))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		_ = resp.Body.Close()
+
+		owner := seed.srv.Ring.GetShard(key)
+		owners[owner.Name]++
+		for _, node := range nodes {
+			_, found := Get(node.srv.DBs.Primary(), key)
+			require.Equal(t, node.srv.Config.Cluster.NodeName == owner.Name, found, key)
+
+			resp, err = http.Get(node.ts.URL + "/api/v1/kv/" + key)
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var getResp GetResponse
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&getResp))
+			_ = resp.Body.Close()
+			require.Equal(t, "value-"+key, getResp.Value)
+		}
+	}
+	require.Len(t, owners, 3)
+
+	// a restarted node finds itself in the persisted ring and joins without new virtual nodes
+	restarted := nodes[1]
+	restarted.srv.ready.Store(false)
+	restarted.srv.Ring = sharding.NewConsistentHash(0)
+	require.NoError(t, restarted.srv.Bootstrap(context.Background()))
+	requireRing()
+}
+
+func TestClusterStaticShards(t *testing.T) {
+	node := startTestNode(t, "node1", &ClusterConfig{})
+	node.srv.Config.Shards = []*ShardConfig{
+		{Name: "node1", Host: "127.0.0.1", Port: node.srv.Config.Server.Port},
+		{Name: "node2", Host: "127.0.0.1", Port: 1},
+	}
+	require.NoError(t, node.srv.Bootstrap(context.Background()))
+	require.Len(t, node.srv.Ring.Shards(), 2)
+
+	// keys owned by an unreachable shard fail instead of being stored locally
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if node.srv.Ring.GetShard(key).Name != "node2" {
+			continue
+		}
+		resp, err := http.Post(node.ts.URL+"/api/v1/kv/"+key, "text/plain", bytes.NewBufferString("value"))
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		_ = resp.Body.Close()
+		break
+	}
+}
+
+// startTestCluster bootstraps nodes joining the first one
+func startTestCluster(t *testing.T, size int, replicas int) []*testNode {
+	t.Helper()
+	var nodes []*testNode
+	for i := 0; i < size; i++ {
+		cluster := &ClusterConfig{Replicas: replicas}
+		if i > 0 {
+			cluster.SeedURL = nodes[0].ts.URL
+		}
+		node := startTestNode(t, fmt.Sprintf("node%d", i+1), cluster)
+		require.NoError(t, node.srv.Bootstrap(context.Background()))
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func TestClusterReadConsistency(t *testing.T) {
+	nodes := startTestCluster(t, 3, 2)
+	byName := make(map[string]*testNode)
+	for _, node := range nodes {
+		byName[node.srv.Config.Cluster.NodeName] = node
+	}
+	const key = "profile"
+	shards := nodes[0].srv.Ring.GetShards(key, 3)
+	owner, replica, other := byName[shards[0].Name], byName[shards[1].Name], byName[shards[2].Name]
+
+	require.NoError(t, Put(owner.srv.DBs.Primary(), key, "fresh", labeled("test")))
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		entry       *testNode
+		consistency client.Consistency
+		value       string
+		servedBy    *testNode
+	}{
+		{"owner default", replica, client.ConsistencyDefault, "fresh", owner},
+		{"any without local copy", replica, client.ConsistencyAny, "fresh", owner},
+		{"any on non replica", other, client.ConsistencyAny, "fresh", owner},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := client.New(tt.entry.ts.URL).Get(ctx, key, tt.consistency)
+			require.NoError(t, err)
+			require.Equal(t, tt.value, result.Value)
+			require.Equal(t, tt.servedBy.srv.Config.Cluster.NodeName, result.ServedBy)
+		})
+	}
+
+	// a replica holding an older copy serves it only when the client allows it
+	require.NoError(t, Put(replica.srv.DBs.Primary(), key, "stale", labeled("test")))
+	result, err := client.New(replica.ts.URL).Get(ctx, key, client.ConsistencyAny)
+	require.NoError(t, err)
+	require.Equal(t, "stale", result.Value)
+	require.Equal(t, replica.srv.Config.Cluster.NodeName, result.ServedBy)
+	result, err = client.New(replica.ts.URL).Get(ctx, key, client.ConsistencyOwner)
+	require.NoError(t, err)
+	require.Equal(t, "fresh", result.Value)
+	require.Equal(t, owner.srv.Config.Cluster.NodeName, result.ServedBy)
+
+	resp, err := http.Get(replica.ts.URL + "/api/v1/kv/" + key + "?consistency=strong")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+func TestClusterAppend(t *testing.T) {
+	nodes := startTestCluster(t, 3, 1)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("list:%d", i)
+		for _, node := range nodes {
+			resp, err := http.Post(node.ts.URL+"/api/v1/kv/"+key+":append", "text/plain", bytes.NewBufferString("x"))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			require.Equal(t, nodes[0].srv.Ring.GetShard(key).Name, resp.Header.Get(servedByHeader))
+			_ = resp.Body.Close()
+		}
+		result, err := client.New(nodes[0].ts.URL).Get(context.Background(), key, client.ConsistencyDefault)
+		require.NoError(t, err)
+		require.Equal(t, "xxx", result.Value)
+	}
+}
+
+func TestClusterUpload(t *testing.T) {
+	nodes := startTestCluster(t, 3, 1)
+	byName := make(map[string]*testNode)
+	for _, node := range nodes {
+		byName[node.srv.Config.Cluster.NodeName] = node
+	}
+	const key = "video"
+	shards := nodes[0].srv.Ring.GetShards(key, 3)
+	owner, first, second := byName[shards[0].Name], byName[shards[1].Name], byName[shards[2].Name]
+
+	// every step enters through another node, all of them are served by the owner
+	resp, err := http.Post(first.ts.URL+"/api/v1/kv/"+key+"/upload", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, owner.srv.Config.Cluster.NodeName, resp.Header.Get(servedByHeader))
+	var upload UploadResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&upload))
+	_ = resp.Body.Close()
+	require.Equal(t, owner.srv.Config.Cluster.NodeName, uploadNode(upload.UploadID))
+
+	for i, entry := range []*testNode{second, first} {
+		req, err := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/api/v1/uploads/%s?offset=%d", entry.ts.URL, upload.UploadID, i*3), bytes.NewBufferString("abc"))
+		require.NoError(t, err)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, owner.srv.Config.Cluster.NodeName, resp.Header.Get(servedByHeader))
+		_ = resp.Body.Close()
+	}
+	resp, err = http.Post(second.ts.URL+"/api/v1/uploads/"+upload.UploadID+"/commit", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	value, found := Get(owner.srv.DBs.Primary(), key)
+	require.True(t, found)
+	require.Equal(t, "abcabc", value)
+	for _, node := range []*testNode{first, second} {
+		_, found = Get(node.srv.DBs.Primary(), key)
+		require.False(t, found)
+	}
+
+	// an upload of a node that left the ring is gone with it
+	resp, err = http.Post(first.ts.URL+"/api/v1/uploads/node9."+upload.UploadID[len(owner.srv.Config.Cluster.NodeName)+1:]+"/commit", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+func TestClusterDeletePrefix(t *testing.T) {
+	nodes := startTestCluster(t, 3, 1)
+	for i := range 30 {
+		key := fmt.Sprintf("sess:%02d", i)
+		owner := nodes[0].srv.Ring.GetShard(key)
+		for _, node := range nodes {
+			if node.srv.Config.Cluster.NodeName == owner.Name {
+				require.NoError(t, Put(node.srv.DBs.Primary(), key, "value", labeled("test")))
+			}
+		}
+	}
+
+	deletePrefix := func(query string) DeletePrefixResponse {
+		req, err := http.NewRequest(http.MethodDelete, nodes[1].ts.URL+"/api/v1/kv"+query, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var result DeletePrefixResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	result := deletePrefix("?prefix=sess:&dry_run=true")
+	require.Equal(t, 30, result.Count)
+	require.Len(t, result.Shards, 3)
+	require.Len(t, result.Sample, deletePrefixSampleSize)
+
+	result = deletePrefix("?prefix=sess:")
+	require.Equal(t, 30, result.Count)
+	total := 0
+	for _, count := range result.Shards {
+		total += count
+	}
+	require.Equal(t, 30, total)
+	for _, node := range nodes {
+		count, _, err := DeletePrefix(node.srv.DBs.Primary(), "sess:", true, labeled("test"))
+		require.NoError(t, err)
+		require.Zero(t, count)
+	}
+}
+
+// repeatReader is an endless source of one byte, values built from it never sit in memory
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// startProxyTestNode serves a node whose ring also holds a fake owner shard, keys owned by
+// the fake shard are proxied to owner
+func startProxyTestNode(t *testing.T, owner *httptest.Server) (*testNode, string) {
+	t.Helper()
+	node := startTestNode(t, "node1", &ClusterConfig{})
+	_, port, err := net.SplitHostPort(owner.Listener.Addr().String())
+	require.NoError(t, err)
+	ownerPort, _ := strconv.Atoi(port)
+	node.srv.Config.Shards = []*ShardConfig{
+		{Name: "node1", Host: "127.0.0.1", Port: node.srv.Config.Server.Port},
+		{Name: "owner", Host: "127.0.0.1", Port: ownerPort},
+	}
+	require.NoError(t, node.srv.Bootstrap(context.Background()))
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if node.srv.Ring.GetShard(key).Name == "owner" {
+			return node, key
+		}
+	}
+}
+
+func TestClusterProxyStreamsLargeValues(t *testing.T) {
+	const size = 256 * 1024 * 1024
+	var received atomic.Int64
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Owner", "yes")
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			_, _ = io.Copy(w, io.LimitReader(repeatReader('v'), size))
+			return
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Store(n)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer owner.Close()
+	node, key := startProxyTestNode(t, owner)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	req, err := http.NewRequest(http.MethodPost, node.ts.URL+"/api/v1/kv/"+key, io.LimitReader(repeatReader('v'), size))
+	require.NoError(t, err)
+	req.ContentLength = size
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, "yes", resp.Header.Get("X-Owner"))
+	require.EqualValues(t, size, received.Load())
+
+	resp, err = http.Get(node.ts.URL + "/api/v1/kv/" + key)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.EqualValues(t, size, resp.ContentLength)
+	n, err := io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.EqualValues(t, size, n)
+
+	runtime.ReadMemStats(&after)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(size/8),
+		"the proxying node streams values instead of buffering them")
+}
+
+func TestClusterProxyValueLimit(t *testing.T) {
+	var requests atomic.Int32
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer owner.Close()
+	node, key := startProxyTestNode(t, owner)
+	node.srv.Config.Server.MaxValueSize = 1024 * 1024
+
+	post := func(body io.Reader, contentLength int64) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, node.ts.URL+"/api/v1/kv/"+key, body)
+		require.NoError(t, err)
+		req.ContentLength = contentLength
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// a declared size over the limit is rejected before the owner is contacted
+	resp := post(io.LimitReader(repeatReader('v'), 2*1024*1024), 2*1024*1024)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	require.Zero(t, requests.Load())
+
+	// a body without Content-Length fails once it outgrows the limit
+	resp = post(io.LimitReader(repeatReader('v'), 2*1024*1024), -1)
+	require.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	resp = post(io.LimitReader(repeatReader('v'), 1024), 1024)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+}
+
+func TestClusterProxyCompression(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"value": "compressible"}`), 1000)
+	var acceptEncoding atomic.Value
+	owner := httptest.NewServer(compressResponses(0)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding.Store(r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	})))
+	defer owner.Close()
+	node, key := startProxyTestNode(t, owner)
+	node.srv.Config.Server.Compression = true
+	ts := httptest.NewServer(node.srv.buildRouter())
+	defer ts.Close()
+
+	// a client without Accept-Encoding gets a plain body, the hop to the owner is encoded
+	raw := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := raw.Get(ts.URL + "/api/v1/kv/" + key)
+	require.NoError(t, err)
+	data, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, "gzip", acceptEncoding.Load())
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.Equal(t, body, data)
+
+	// an encoded owner response passes through without being encoded twice
+	resp, err = http.Get(ts.URL + "/api/v1/kv/" + key)
+	require.NoError(t, err)
+	data, err = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.True(t, resp.Uncompressed)
+	require.Equal(t, body, data)
+}
+
+func TestBucketAppendAcrossShards(t *testing.T) {
+	nodes := []*testNode{
+		startTestNode(t, "node1", &ClusterConfig{ShardID: 1}),
+		startTestNode(t, "node2", &ClusterConfig{}),
+	}
+	require.NotEqual(t, nodes[0].srv.shardID(), nodes[1].srv.shardID())
+
+	// both shards generate keys at once, every key is new
+	const goroutines, perGoroutine = 8, 25
+	type appended struct {
+		node int
+		resp GeneratedKeyResponse
+	}
+	results := make(chan appended, len(nodes)*goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for n := range nodes {
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < perGoroutine; i++ {
+					resp, err := http.Post(nodes[n].ts.URL+"/api/v1/buckets/events/append", "text/plain",
+						bytes.NewBufferString(fmt.Sprintf("event-%d-%d-%d", n, g, i)))
+					if !assert.NoError(t, err) {
+						return
+					}
+					var body GeneratedKeyResponse
+					assert.Equal(t, http.StatusCreated, resp.StatusCode)
+					assert.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+					_ = resp.Body.Close()
+					results <- appended{node: n, resp: body}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(results)
+
+	seen := make(map[string]bool)
+	for result := range results {
+		require.False(t, seen[result.resp.Key], "duplicate key %s", result.resp.Key)
+		seen[result.resp.Key] = true
+		key, err := hex.DecodeString(result.resp.Key)
+		require.NoError(t, err)
+		parsed, err := keys.ParseGeneratedKey(key)
+		require.NoError(t, err)
+		require.Equal(t, nodes[result.node].srv.shardID(), parsed.Shard)
+		require.WithinDuration(t, time.Now(), result.resp.Time, time.Minute)
+		require.NoError(t, nodes[result.node].srv.DBs.Primary().View(func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket([]byte("events"))
+			require.NoError(t, err)
+			_, found := bucket.Get(key)
+			require.True(t, found)
+			return nil
+		}))
+	}
+	require.Len(t, seen, len(nodes)*goroutines*perGoroutine)
+
+	// keys of a shard sort in the order they were made
+	require.NoError(t, nodes[0].srv.DBs.Primary().View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte("events"))
+		require.NoError(t, err)
+		var last uint64
+		cursor := bucket.Cursor()
+		for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+			parsed, err := keys.ParseGeneratedKey(key)
+			require.NoError(t, err)
+			require.Greater(t, parsed.Timestamp, last)
+			last = parsed.Timestamp
+		}
+		return nil
+	}))
+
+	resp, err := http.Post(nodes[0].ts.URL+"/api/v1/buckets/__locks/append", "text/plain", bytes.NewBufferString("x"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode, "internal buckets are refused")
+}
+
+func TestClusterKeyGroups(t *testing.T) {
+	var nodes []*testNode
+	join := func() {
+		cluster := &ClusterConfig{GroupDelimiter: ":"}
+		if len(nodes) > 0 {
+			cluster.SeedURL = nodes[0].ts.URL
+		}
+		node := startTestNode(t, fmt.Sprintf("node%d", len(nodes)+1), cluster)
+		require.NoError(t, node.srv.Bootstrap(context.Background()))
+		nodes = append(nodes, node)
+	}
+	for range 3 {
+		join()
+	}
+	ring, err := http.Get(nodes[1].ts.URL + "/cluster/ring")
+	require.NoError(t, err)
+	var info client.RingInfo
+	require.NoError(t, json.NewDecoder(ring.Body).Decode(&info))
+	_ = ring.Body.Close()
+	require.Equal(t, ":", info.GroupDelimiter)
+
+	// the keys of a group are written through different nodes and all land on one shard
+	suffixes := []string{"config", "checksum", "version"}
+	owners := make(map[string]bool)
+	for g := range 10 {
+		group := fmt.Sprintf("%d-app", g)
+		var owner string
+		for i, suffix := range suffixes {
+			entry := nodes[i%len(nodes)]
+			resp, err := http.Post(entry.ts.URL+"/api/v1/kv/"+group+":"+suffix, "text/plain", bytes.NewBufferString(suffix))
+			require.NoError(t, err)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			_ = resp.Body.Close()
+			if owner == "" {
+				owner = resp.Header.Get(servedByHeader)
+			}
+			require.Equal(t, owner, resp.Header.Get(servedByHeader), group+":"+suffix)
+		}
+		owners[owner] = true
+	}
+	require.Greater(t, len(owners), 1, "groups are spread over the shards")
+
+	// after a node joins every node places each group on a single shard
+	join()
+	for g := range 10 {
+		group := fmt.Sprintf("%d-app", g)
+		for _, node := range nodes {
+			owner := node.srv.Ring.GetShard(group + ":" + suffixes[0])
+			for _, suffix := range suffixes[1:] {
+				require.Equal(t, owner.Name, node.srv.Ring.GetShard(group+":"+suffix).Name)
+			}
+			require.Equal(t, owner.Name, nodes[0].srv.Ring.GetShard(group+":"+suffixes[0]).Name)
+		}
+	}
+}
+
+func TestClusterClientRouting(t *testing.T) {
+	var nodes []*testNode
+	for i := range 3 {
+		cluster := &ClusterConfig{VirtualNodes: 32, GroupDelimiter: ":"}
+		if i > 0 {
+			cluster.SeedURL = nodes[0].ts.URL
+		}
+		node := startTestNode(t, fmt.Sprintf("node%d", i+1), cluster)
+		require.NoError(t, node.srv.Bootstrap(context.Background()))
+		nodes = append(nodes, node)
+	}
+	router, err := client.NewRouter(context.Background(), nodes[2].ts.URL)
+	require.NoError(t, err)
+	require.Equal(t, nodes[0].srv.Ring.State(), router.Ring().State())
+
+	// the client places keys as the nodes do and reads them from the owner without a proxy hop
+	for i := range 30 {
+		key := fmt.Sprintf("group-%d:key", i)
+		resp, err := http.Post(nodes[i%len(nodes)].ts.URL+"/api/v1/kv/"+key, "text/plain", bytes.NewBufferString(key))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		owner := resp.Header.Get(servedByHeader)
+		require.Equal(t, owner, router.Ring().GetShard(key).Name, key)
+
+		result, err := router.Get(context.Background(), key, client.ConsistencyOwner)
+		require.NoError(t, err)
+		require.Equal(t, key, result.Value)
+		require.Equal(t, owner, result.ServedBy)
+	}
+
+	// a refresh picks up a shard that joined
+	node := startTestNode(t, "node4", &ClusterConfig{VirtualNodes: 32, GroupDelimiter: ":", SeedURL: nodes[0].ts.URL})
+	require.NoError(t, node.srv.Bootstrap(context.Background()))
+	require.Len(t, router.Ring().Shards(), 3)
+	require.NoError(t, router.Refresh(context.Background()))
+	require.Equal(t, node.srv.Ring.State(), router.Ring().State())
+}
+
+func TestClusterBasePath(t *testing.T) {
+	var nodes []*testNode
+	for i := range 3 {
+		cluster := &ClusterConfig{}
+		if i > 0 {
+			cluster.SeedURL = nodes[0].ts.URL + "/pirin"
+		}
+		node := startTestNode(t, fmt.Sprintf("node%d", i+1), cluster, func(cfg *Config) {
+			cfg.Server.BasePath = "/pirin"
+			cfg.Server.TrustedProxies = []string{"127.0.0.1"}
+		})
+		require.NoError(t, node.srv.Bootstrap(context.Background()))
+		nodes = append(nodes, node)
+	}
+	for _, node := range nodes {
+		require.Len(t, node.srv.Ring.Shards(), 3)
+		for _, shard := range node.srv.Ring.Shards() {
+			require.Equal(t, "/pirin", shard.BasePath)
+		}
+	}
+
+	// requests are proxied to the owner below its base path, prefix deletes fan out the same way
+	for i := range 10 {
+		key := fmt.Sprintf("key-%d", i)
+		entry := nodes[i%len(nodes)]
+		resp, err := http.Post(entry.ts.URL+"/pirin/api/v1/kv/"+key, "text/plain", bytes.NewBufferString("value"))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		require.Equal(t, nodes[0].srv.Ring.GetShard(key).Name, resp.Header.Get(servedByHeader))
+	}
+	req, err := http.NewRequest(http.MethodDelete, nodes[0].ts.URL+"/pirin/api/v1/kv?prefix=key-", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	var deleted DeletePrefixResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleted))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	total := 0
+	for _, count := range deleted.Shards {
+		total += count
+	}
+	require.Equal(t, 10, total)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// responseEncoder produces one content coding, encoders are listed in the order the server
+// prefers them when the client accepts several
+type responseEncoder struct {
+	name      string
+	newWriter func(w io.Writer) encodeWriter
+}
+
+// encodeWriter is a compressing writer that can push out a partial stream
+type encodeWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// zstd is not built in, the module doesn't depend on a zstd encoder yet
+var responseEncoders = []responseEncoder{
+	{name: "gzip", newWriter: func(w io.Writer) encodeWriter { return gzip.NewWriter(w) }},
+}
+
+// compressedTypes are content types that don't shrink when compressed again
+var compressedTypes = []string{
+	"application/gzip", "application/x-gzip", "application/zstd", "application/zip",
+	"application/x-7z-compressed", "application/x-bzip2", "application/x-xz",
+	"image/", "video/", "audio/",
+}
+
+// negotiateEncoding picks the preferred encoder accepted by the Accept-Encoding header,
+// a coding with q=0 is refused, nil means the response is sent as is
+func negotiateEncoding(header string) *responseEncoder {
+	if header == "" {
+		return nil
+	}
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		accepted[coding] = q > 0
+	}
+	for i, encoder := range responseEncoders {
+		allowed, listed := accepted[encoder.name]
+		if !listed {
+			allowed = accepted["*"]
+		}
+		if allowed {
+			return &responseEncoders[i]
+		}
+	}
+	return nil
+}
+
+// compressResponses encodes response bodies for clients that accept it, bodies shorter
+// than minSize, bodies already encoded (responses proxied from the owner shard), bodies
+// serving byte ranges and compressed content types are sent as is
+func compressResponses(minSize int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoder := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+			if encoder == nil || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoder: encoder, minSize: minSize, status: http.StatusOK}
+			next.ServeHTTP(cw, r)
+			// not deferred, after a panic the recoverer writes its response unencoded
+			cw.close()
+		})
+	}
+}
+
+// compressWriter holds the start of the body until minSize bytes decide whether the
+// response is worth encoding, the status is sent together with that decision
+type compressWriter struct {
+	http.ResponseWriter
+	encoder *responseEncoder
+	minSize int
+	status  int
+	buf     []byte
+	decided bool
+	enc     encodeWriter // nil when the body is sent as is
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if status < http.StatusOK {
+		// informational responses go out right away and don't start the body
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	if !bodyAllowed(status) {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		if len(cw.buf)+len(p) < cw.minSize {
+			cw.buf = append(cw.buf, p...)
+			return len(p), nil
+		}
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush encodes a streamed body whatever its size so far, a response flushed before the
+// end is expected to be long
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// decide sends the status and headers, then the held part of the body
+func (cw *compressWriter) decide(compress bool) {
+	cw.decided = true
+	header := cw.Header()
+	// a body that serves byte ranges keeps its bytes, the ranges refer to them
+	if compress && bodyAllowed(cw.status) && header.Get("Content-Encoding") == "" &&
+		header.Get("Accept-Ranges") == "" && !isCompressedType(header.Get("Content-Type")) {
+		if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+			// detected on the plain body, the server would sniff the encoded one otherwise
+			header.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", cw.encoder.name)
+		cw.enc = cw.encoder.newWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) > 0 {
+		buf := cw.buf
+		cw.buf = nil
+		if cw.enc != nil {
+			_, _ = cw.enc.Write(buf)
+		} else {
+			_, _ = cw.ResponseWriter.Write(buf)
+		}
+	}
+}
+
+// close sends a body shorter than minSize as is and finishes an encoded one
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		_ = cw.enc.Close()
+	}
+}
+
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func isCompressedType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,38 +1,257 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/go-playground/validator/v10"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
 	"strings"
+	"time"
 )
 
 type ServerConfig struct {
-	Host     string `mapstructure:"host" validate:"required,hostname|ip"`
-	Port     int    `mapstructure:"port" validate:"required,min=1,max=65535"`
-	LogLevel string `mapstructure:"log_level" validate:"required,oneof=INFO WARNING DEBUG ERROR"`
+	Host       string             `mapstructure:"host" validate:"required,hostname|ip"`
+	Port       int                `mapstructure:"port" validate:"required,min=1,max=65535"`
+	LogLevel   string             `mapstructure:"log_level" validate:"required,oneof=INFO WARNING DEBUG ERROR"`
+	UploadTTL  time.Duration      `mapstructure:"upload_ttl"`
+	LogKeyMode storage.LogKeyMode `mapstructure:"log_key_mode" validate:"omitempty,oneof=full hash none"`
+	// MaxValueSize limits a single put body, larger bodies are rejected before they are proxied
+	MaxValueSize int64 `mapstructure:"max_value_size" validate:"min=0"`
+	// larger values get 413 on the JSON GET path instead of being encoded whole, 0 disables
+	MaxJSONValueSize int64 `mapstructure:"max_json_value_size" validate:"min=0"`
+	// read transaction limits applied to every database, a stuck request can't block writers
+	MaxOpenReaders    int           `mapstructure:"max_open_readers" validate:"min=0"`
+	WaitForReader     bool          `mapstructure:"wait_for_reader"`
+	MaxReaderDuration time.Duration `mapstructure:"max_reader_duration" validate:"min=0"`
+	// writes get 503 while the p95 commit time or the write queue is over the limit, 0 disables
+	CommitStallThreshold time.Duration `mapstructure:"commit_stall_threshold" validate:"min=0"`
+	MaxWriteQueue        int           `mapstructure:"max_write_queue" validate:"min=0"`
+	// write endpoints run their transaction up to WriteRetryAttempts times while it fails with a
+	// transient error, the backoff doubles after every attempt
+	WriteRetryAttempts int           `mapstructure:"write_retry_attempts" validate:"min=0"`
+	WriteRetryBackoff  time.Duration `mapstructure:"write_retry_backoff" validate:"min=0"`
+	// a canary key is written and deleted in every database on startup and then every
+	// CanaryInterval, a failure fails readiness, 0 runs it on startup only
+	CanaryInterval time.Duration `mapstructure:"canary_interval" validate:"min=0"`
+	// Sessions enables write transactions kept open across requests under /api/v1/tx, a session
+	// holds the write lock of its database for up to SessionTTL
+	Sessions   bool          `mapstructure:"sessions"`
+	SessionTTL time.Duration `mapstructure:"session_ttl" validate:"min=0,max=30s"`
+	// DELETE of a bucket moves it to the trash unless ?soft=false, trashed buckets are purged
+	// TrashRetention after, 0 keeps them until purged through /admin/trash
+	SoftDeleteBuckets bool          `mapstructure:"soft_delete_buckets"`
+	TrashRetention    time.Duration `mapstructure:"trash_retention" validate:"min=0"`
+	// usage reports are cached for UsageTTL, a request after it starts a new computation
+	UsageTTL time.Duration `mapstructure:"usage_ttl" validate:"min=0"`
+	// Mode applies until the mode is set at runtime, the runtime mode is persisted
+	Mode       NodeMode `mapstructure:"mode" validate:"omitempty,oneof=read_write read_only maintenance"`
+	AdminToken string   `mapstructure:"admin_token"` // admin endpoints require it as bearer token when set
+	// values are stored with a checksum, returned as ETag, and verified on reads when set
+	ValueChecksums       bool `mapstructure:"value_checksums"`
+	VerifyValueChecksums bool `mapstructure:"verify_value_checksums"`
+
+	// responses are gzipped for clients that accept it, shorter bodies are sent as is
+	Compression        bool `mapstructure:"compression"`
+	CompressionMinSize int  `mapstructure:"compression_min_size" validate:"min=0"`
+
+	// BasePath serves every route under the prefix, for a proxy forwarding /pirin/ to the node
+	BasePath string `mapstructure:"base_path" validate:"omitempty,startswith=/"`
+	// X-Forwarded-For, X-Real-IP and X-Forwarded-Proto are believed from these CIDRs or
+	// addresses only, other clients are logged and audited with their own address
+	TrustedProxies []string `mapstructure:"trusted_proxies" validate:"dive,cidr|ip"`
 }
 
+// ShardConfig is a static ring member, static shards replace the persisted ring on startup
 type ShardConfig struct {
-	Name  string
-	Index int
+	Name string `mapstructure:"name" validate:"required"`
+	Host string `mapstructure:"host" validate:"required,hostname|ip"`
+	Port int    `mapstructure:"port" validate:"required,min=1,max=65535"`
+	// BasePath is the server.base_path of the shard
+	BasePath string `mapstructure:"base_path" validate:"omitempty,startswith=/"`
+}
+
+// ClusterConfig enables sharding, the node joins the ring under NodeName
+type ClusterConfig struct {
+	NodeName      string `mapstructure:"node_name"`
+	SeedURL       string `mapstructure:"seed_url" validate:"omitempty,url"`
+	AdvertiseHost string `mapstructure:"advertise_host" validate:"omitempty,hostname|ip"`
+	VirtualNodes  int    `mapstructure:"virtual_nodes" validate:"min=0"`
+	Replicas      int    `mapstructure:"replicas" validate:"min=0"` // shards holding each key, the owner included
+	// ShardID goes into the keys generated by the node, unique ids keep them unique across
+	// shards, 0 derives one from NodeName
+	ShardID uint32 `mapstructure:"shard_id"`
+	// GroupDelimiter places keys containing it by the group before it, so the keys of a group
+	// share their shards. Empty disables groups, every node must use the same delimiter.
+	GroupDelimiter string `mapstructure:"group_delimiter"`
+	// DigestRanges splits the key space for range digests and anti-entropy, every node must
+	// use the same number. AntiEntropyInterval compares the ranges with the members of the
+	// previous ring, 0 disables it.
+	DigestRanges        int           `mapstructure:"digest_ranges" validate:"min=0,max=65536"`
+	AntiEntropyInterval time.Duration `mapstructure:"anti_entropy_interval" validate:"min=0"`
 }
 
 type DatabaseConfig struct {
-	Filename string `mapstructure:"filename" validate:"required"`
+	Name       string          `mapstructure:"name" validate:"required,alphanum"`
+	Filename   string          `mapstructure:"filename" validate:"required"`
+	TxLogPath  string          `mapstructure:"tx_log"`
+	NoRecovery bool            `mapstructure:"no_recovery"`
+	MaxSize    uint64          `mapstructure:"max_size"` // database file size limit in bytes, 0 is unlimited
+	Schemas    []*SchemaConfig `mapstructure:"schemas" validate:"dive"`
+	// values written to a bucket through the key API are rewritten by its transforms first
+	Transforms []*TransformConfig `mapstructure:"transforms" validate:"dive"`
+	// a missing file fails the startup unless must_exist = false, so a typo in the filename
+	// does not start an empty database
+	MustExist *bool `mapstructure:"must_exist"`
+	// buckets whose last key is removed are deleted, the main bucket is created again on a put
+	AutoDeleteEmptyBuckets bool `mapstructure:"auto_delete_empty_buckets"`
+	// a file of an older format is migrated at startup instead of failing it
+	AutoMigrate bool `mapstructure:"auto_migrate"`
+	// a damaged freelist is rebuilt from the reachable pages at startup instead of failing it
+	RebuildFreelist bool `mapstructure:"rebuild_freelist"`
+	// soft limits report a warning in /health/ready and the stats above them, 0 disables each
+	SizeWarnRatio    float64 `mapstructure:"size_warn_ratio" validate:"min=0,max=1"` // of max_size
+	FreelistWarnRuns int     `mapstructure:"freelist_warn_runs" validate:"min=0"`
+	TxLogWarnBytes   int64   `mapstructure:"tx_log_warn_bytes" validate:"min=0"`
+}
+
+// SchemaConfig checks the values written to a bucket against a JSON schema file
+type SchemaConfig struct {
+	Bucket string `mapstructure:"bucket" validate:"required"`
+	File   string `mapstructure:"file" validate:"required"`
+}
+
+// TransformConfig lists the transforms run in order on the values written to a bucket through
+// the key API. Values above MaxSize (1MB if 0) are not transformed. A strict chain refuses
+// a value a transform can't handle with 422, otherwise the transform is skipped.
+type TransformConfig struct {
+	Bucket  string   `mapstructure:"bucket" validate:"required"`
+	Apply   []string `mapstructure:"apply" validate:"required,dive,oneof=trim_nul utf8 utf8_replace json_canonical"`
+	Strict  bool     `mapstructure:"strict"`
+	MaxSize int      `mapstructure:"max_size" validate:"min=0"`
+}
+
+// PartitionConfig stores a logical bucket as one bucket per time window, named like
+// events_2024_06_01. Windows ending more than Retain ago ("30d", "720h") are dropped whole,
+// an empty Retain keeps them. The bucket listing shows the logical bucket only.
+type PartitionConfig struct {
+	Partition string `mapstructure:"partition" validate:"required,oneof=hourly daily monthly"`
+	Retain    string `mapstructure:"retain"`
+}
+
+// AuditConfig selects the sink of the audit log, an empty sink disables it
+type AuditConfig struct {
+	Sink    string             `mapstructure:"sink" validate:"omitempty,oneof=file webhook"`
+	Fields  []string           `mapstructure:"fields" validate:"dive,oneof=time request_id node client op db bucket key value_size status"`
+	KeyMode storage.LogKeyMode `mapstructure:"key_mode" validate:"omitempty,oneof=full hash none"` // server.log_key_mode if empty
+	Buffer  int                `mapstructure:"buffer" validate:"min=0"`                            // records waiting for the sink, more are dropped
+	// file sink, rotated past MaxSize bytes keeping MaxFiles old files
+	Path     string `mapstructure:"path" validate:"required_if=Sink file"`
+	MaxSize  int64  `mapstructure:"max_size" validate:"min=0"`
+	MaxFiles int    `mapstructure:"max_files" validate:"min=0"`
+	// webhook sink, batches of up to BatchSize records are posted as NDJSON
+	URL       string `mapstructure:"url" validate:"required_if=Sink webhook,omitempty,url"`
+	BatchSize int    `mapstructure:"batch_size" validate:"min=0"`
+	Retries   int    `mapstructure:"retries" validate:"min=0"`
+}
+
+// BackupConfig schedules snapshots of every database into Dir, they are also taken on demand
+// with POST /api/v1/admin/backup
+type BackupConfig struct {
+	Interval time.Duration `mapstructure:"interval" validate:"min=0"` // 0 takes snapshots on demand only
+	Retain   int           `mapstructure:"retain" validate:"min=0"`   // snapshots kept per database, 0 keeps all
+	Dir      string        `mapstructure:"dir" validate:"required_with=Interval"`
+	// a snapshot is skipped unless the disk keeps MinFreeBytes free after it
+	MinFreeBytes int64 `mapstructure:"min_free_bytes" validate:"min=0"`
+}
+
+// CacheConfig enables the read cache of GETs for the listed buckets, keys are read over HTTP
+// from the main bucket. A request with Cache-Control: no-cache skips the cache.
+type CacheConfig struct {
+	Buckets  []string `mapstructure:"buckets"` // no buckets disables the cache
+	MaxBytes int64    `mapstructure:"max_bytes" validate:"min=0"`
+	// every VerifyEvery-th hit is compared with storage to count stale serves, 0 never
+	VerifyEvery int `mapstructure:"verify_every" validate:"min=0"`
 }
 
 type Config struct {
-	Server *ServerConfig
-	Shards []*ShardConfig
-	DB     *DatabaseConfig
+	Server    *ServerConfig
+	Cluster   *ClusterConfig
+	Audit     *AuditConfig
+	Backup    *BackupConfig
+	Cache     *CacheConfig
+	Shards    []*ShardConfig `validate:"dive"`
+	DB        *DatabaseConfig
+	Databases []*DatabaseConfig `validate:"dive"`
+	// Buckets partitions logical buckets by time, in every database
+	Buckets map[string]*PartitionConfig `validate:"dive"`
+}
+
+// storageOptions converts database config entry to storage options, key redaction
+// and reader limits are shared by the server and all databases
+func (c *DatabaseConfig) storageOptions(server *ServerConfig) *storage.Options {
+	return storage.DefaultOptions().
+		WithMustExist(c.mustExist()).
+		WithRecovery(!c.NoRecovery).
+		WithTxLogPath(c.TxLogPath).
+		WithMaxSize(c.MaxSize).
+		WithLogKeyMode(server.LogKeyMode).
+		WithMaxOpenReaders(server.MaxOpenReaders, server.WaitForReader).
+		WithMaxReaderDuration(server.MaxReaderDuration).
+		WithWriteStall(server.CommitStallThreshold, server.MaxWriteQueue).
+		WithValueChecksums(server.ValueChecksums, server.VerifyValueChecksums).
+		WithAutoDeleteEmptyBuckets(c.AutoDeleteEmptyBuckets).
+		WithAutoMigrate(c.AutoMigrate, nil).
+		WithFreelistRebuild(c.RebuildFreelist).
+		WithSoftLimits(c.SizeWarnRatio, c.FreelistWarnRuns, c.TxLogWarnBytes)
+}
+
+func (c *DatabaseConfig) mustExist() bool {
+	return c.MustExist == nil || *c.MustExist
+}
+
+// openMode names how the database file is opened, for the startup log
+func (c *DatabaseConfig) openMode() string {
+	if c.mustExist() {
+		return "must_exist"
+	}
+	return "create_if_missing"
 }
 
 func initDefaults() {
 	viper.SetDefault("server.host", "127.0.0.1")
 	viper.SetDefault("server.port", 4321)
+	viper.SetDefault("db.name", defaultDBName)
 	viper.SetDefault("db.filename", "pirin.db")
+	viper.SetDefault("db.must_exist", true) // also makes PIRINDB_DB_MUST_EXIST work
 	viper.SetDefault("server.log_level", "INFO")
+	viper.SetDefault("server.upload_ttl", defaultUploadTTL)
+	viper.SetDefault("server.max_value_size", maxUploadSize)
+	viper.SetDefault("server.max_json_value_size", defaultMaxJSONValueSize)
+	viper.SetDefault("server.log_key_mode", string(storage.LogKeyFull))
+	viper.SetDefault("server.max_open_readers", defaultMaxOpenReaders)
+	viper.SetDefault("server.max_reader_duration", defaultMaxReaderDuration)
+	viper.SetDefault("server.write_retry_attempts", storage.DefaultRetryPolicy().MaxAttempts)
+	viper.SetDefault("server.write_retry_backoff", storage.DefaultRetryPolicy().Backoff)
+	viper.SetDefault("server.canary_interval", defaultCanaryInterval)
+	viper.SetDefault("server.usage_ttl", defaultUsageTTL)
+	viper.SetDefault("server.session_ttl", defaultSessionTTL)
+	viper.SetDefault("server.compression", true)
+	viper.SetDefault("server.compression_min_size", defaultCompressionMinSize)
+	viper.SetDefault("cluster.virtual_nodes", sharding.DefaultVirtualNodes)
+	viper.SetDefault("cluster.replicas", 1)
+	viper.SetDefault("cluster.digest_ranges", defaultDigestRanges)
+	viper.SetDefault("audit.buffer", defaultAuditBuffer)
+	viper.SetDefault("audit.max_size", defaultAuditMaxSize)
+	viper.SetDefault("audit.max_files", defaultAuditMaxFiles)
+	viper.SetDefault("audit.batch_size", defaultAuditBatchSize)
+	viper.SetDefault("audit.retries", defaultAuditRetries)
+	viper.SetDefault("backup.retain", defaultBackupRetain)
+	viper.SetDefault("backup.min_free_bytes", defaultBackupMinFree)
+	viper.SetDefault("cache.max_bytes", defaultCacheMaxBytes)
+	viper.SetDefault("cache.verify_every", defaultCacheVerifyEvery)
 }
 
 func setupFlags(cmd *cobra.Command) {
@@ -72,5 +291,73 @@ func loadConfig(cfgFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	// a database named like a route segment would shadow the route under /{db}
+	reserved := dbRouteSegments()
+	names := map[string]bool{cfg.DB.Name: true}
+	for _, dbCfg := range append([]*DatabaseConfig{cfg.DB}, cfg.Databases...) {
+		if reserved[dbCfg.Name] {
+			return nil, fmt.Errorf("database name %s is reserved for a route", dbCfg.Name)
+		}
+	}
+	for _, dbCfg := range cfg.Databases {
+		if names[dbCfg.Name] {
+			return nil, fmt.Errorf("duplicate database name: %s", dbCfg.Name)
+		}
+		names[dbCfg.Name] = true
+	}
+	for _, dbCfg := range append([]*DatabaseConfig{cfg.DB}, cfg.Databases...) {
+		for _, schemaCfg := range dbCfg.Schemas {
+			if isInternalBucket(schemaCfg.Bucket) {
+				return nil, fmt.Errorf("database %s: bucket %s is internal and has no schema", dbCfg.Name, schemaCfg.Bucket)
+			}
+		}
+		transformed := make(map[string]bool)
+		for _, transformCfg := range dbCfg.Transforms {
+			if isInternalBucket(transformCfg.Bucket) {
+				return nil, fmt.Errorf("database %s: bucket %s is internal and has no transforms", dbCfg.Name, transformCfg.Bucket)
+			}
+			if transformed[transformCfg.Bucket] {
+				return nil, fmt.Errorf("database %s: duplicate transforms for bucket %s", dbCfg.Name, transformCfg.Bucket)
+			}
+			transformed[transformCfg.Bucket] = true
+		}
+	}
+	for name, partitionCfg := range cfg.Buckets {
+		if isInternalBucket(name) || name == string(DBBucket) {
+			return nil, fmt.Errorf("bucket %s can't be partitioned", name)
+		}
+		if partitionCfg.Retain == "" {
+			continue
+		}
+		if retain, err := parseRetention(partitionCfg.Retain); err != nil || retain <= 0 {
+			return nil, fmt.Errorf("bucket %s: invalid retain %q", name, partitionCfg.Retain)
+		}
+	}
+	if err = validateCluster(&cfg); err != nil {
+		return nil, err
+	}
 	return &cfg, nil
 }
+
+func validateCluster(cfg *Config) error {
+	if cfg.Cluster == nil || cfg.Cluster.NodeName == "" {
+		if len(cfg.Shards) > 0 || (cfg.Cluster != nil && cfg.Cluster.SeedURL != "") {
+			return errors.New("cluster.node_name is required to join a cluster")
+		}
+		return nil
+	}
+	if len(cfg.Shards) > 0 && cfg.Cluster.SeedURL != "" {
+		return errors.New("static shards and cluster.seed_url are mutually exclusive")
+	}
+	shardNames := make(map[string]bool, len(cfg.Shards))
+	for _, shardCfg := range cfg.Shards {
+		if shardNames[shardCfg.Name] {
+			return fmt.Errorf("duplicate shard name: %s", shardCfg.Name)
+		}
+		shardNames[shardCfg.Name] = true
+	}
+	if len(cfg.Shards) > 0 && !shardNames[cfg.Cluster.NodeName] {
+		return fmt.Errorf("node %s is not listed in shards", cfg.Cluster.NodeName)
+	}
+	return nil
+}
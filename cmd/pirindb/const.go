@@ -1,8 +1,17 @@
 package main
 
+import "time"
+
+// gitCommit is set at build time with -ldflags "-X main.gitCommit=..."
+var gitCommit = "unknown"
+
+// serverFeatures lists optional capabilities reported by the /version endpoint
+var serverFeatures = []string{"multi_db", "tree_stats", "sync_modes", "cluster", "locks", "key_listing", "prefix_delete", "append", "quotas", "compression", "audit", "diff", "checksums", "modes", "compact_blobs", "schemas", "sampling", "canary", "backups", "sessions", "cache", "generated_keys", "key_groups", "retention", "prefix_stats", "usage", "mget", "batch", "key_sizes", "bucket_events"}
+
 const (
-	version = "0.0.2"
-	logo    = `
+	version       = "0.0.2"
+	defaultDBName = "default"
+	logo          = `
     ____   _        _         ____   ____ 
    / __ \ (_)_____ (_)____   / __ \ / __ )
   / /_/ // // ___// // __ \ / / / // __  |
@@ -10,3 +19,113 @@ const (
 /_/    /_//_/   /_//_/ /_//_____//_____/
 `
 )
+
+// defaultMaxJSONValueSize is the largest value the JSON GET path returns, see ServerConfig
+const defaultMaxJSONValueSize = 1024 * 1024
+
+// read transaction limits, see ServerConfig
+const (
+	defaultMaxOpenReaders    = 512
+	defaultMaxReaderDuration = time.Minute
+)
+
+// Retry-After of a write refused with 503 write_stalled
+const writeStallRetryAfter = time.Second
+
+// pause between canary writes, see ServerConfig
+const defaultCanaryInterval = 10 * time.Second
+
+// usage reports are served from the cache this long, a bucket ranks this many prefixes
+const (
+	defaultUsageTTL  = time.Hour
+	maxUsagePrefixes = 100_000
+	usageRetryAfter  = 5 * time.Second
+)
+
+// responses shorter than this are not worth compressing
+const defaultCompressionMinSize = 1024
+
+// page size of the bucket listing
+const (
+	defaultBucketListLimit = 100
+	maxBucketListLimit     = 1000
+)
+
+// page size of the key listing, keys and common prefixes count together
+const (
+	defaultKeyListLimit = 100
+	maxKeyListLimit     = 1000
+	defaultSampleSize   = 100
+	maxSampleSize       = 1000
+	defaultEventsLimit  = 20
+	maxEventsLimit      = 1000
+)
+
+// keys of one mget request, items of one batch request
+const (
+	maxMGetKeys   = 100
+	maxBatchItems = 1000
+)
+
+// prefix statistics rank at most maxPrefixStatsTop prefixes, the scan of the bucket stops at
+// the key or the time budget and reports its results as not exact
+const (
+	defaultPrefixStatsTop     = 20
+	maxPrefixStatsTop         = 1000
+	defaultPrefixStatsMaxKeys = 1_000_000
+	prefixStatsTimeout        = 5 * time.Second
+)
+
+// audit log defaults, see AuditConfig
+const (
+	defaultAuditBuffer    = 10000
+	defaultAuditMaxSize   = 100 * 1024 * 1024
+	defaultAuditMaxFiles  = 5
+	defaultAuditBatchSize = 100
+	defaultAuditRetries   = 3
+	auditRetryDelay       = 100 * time.Millisecond
+	auditWebhookTimeout   = 10 * time.Second
+)
+
+// sessions hold the write lock of their database between requests, so they are short:
+// the TTL is capped and a database runs at most one session at a time
+const (
+	defaultSessionTTL = 5 * time.Second
+	maxSessionTTL     = 30 * time.Second
+)
+
+// snapshot defaults, see BackupConfig
+const (
+	defaultBackupRetain  = 7
+	defaultBackupMinFree = 256 * 1024 * 1024
+)
+
+// read cache defaults, see CacheConfig
+const (
+	defaultCacheMaxBytes    = 64 * 1024 * 1024
+	defaultCacheVerifyEvery = 1000
+)
+
+// keys returned by a prefix delete dry run to show what would be deleted
+const deletePrefixSampleSize = 10
+
+// appendSuffix turns POST /kv/{key} into an append to the value, it is reserved in keys
+// written over HTTP
+const appendSuffix = ":append"
+
+// checksumHeader carries the value checksum as 16 hex digits: a PUT with it is refused with
+// 422 when the body does not match, a GET returns the checksum stored with the value
+const checksumHeader = "X-Pirin-Checksum"
+
+// cacheHeader tells whether the read cache answered a GET: hit, miss or bypass
+const cacheHeader = "X-Pirin-Cache"
+
+// ranges the key space is split into for range digests, see ClusterConfig.DigestRanges
+const defaultDigestRanges = 256
+
+// a read missing here waits this long for the previous owner of the key during a ring change,
+// deletes recorded beyond maxReadRepairTombstones stop read repair until the change completes
+const (
+	readRepairTimeout       = 250 * time.Millisecond
+	maxReadRepairTombstones = 100_000
+)
@@ -1,60 +1,478 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
+	"hash"
+	"io"
+	"strings"
+	"time"
 )
 
-func Status(db *storage.DB) *storage.DBStat {
-	return db.Stat()
+// purgeExpiredLimit bounds keys deleted by one sweeper run in a database
+const purgeExpiredLimit = 10000
+
+// retentionSweepChunk is how many keys one transaction of a retention sweep deletes, the
+// sweep of a bucket stops at purgeExpiredLimit keys per run
+const retentionSweepChunk = 1000
+
+// writeOptions label the write transaction of an operation and retry it while it fails with a
+// transient error such as a write stall, until the attempts run out or the request is gone
+type writeOptions struct {
+	ctx   context.Context
+	label string
+	retry storage.RetryPolicy
+	actor string // recorded in bucket events, storage.EmbeddedActor when empty
 }
 
-func Put(db *storage.DB, key string, value string) error {
-	tx := db.Begin(true)
-	defer tx.Rollback()
-	bucket, err := tx.CreateBucketIfNotExists(DBBucket)
-	if err != nil {
+// labeled returns write options without retries
+func labeled(label string) writeOptions {
+	return writeOptions{ctx: context.Background(), label: label}
+}
+
+// update runs fn in a write transaction, fn has to be idempotent as it runs once per attempt
+func (opts writeOptions) update(db *storage.DB, fn func(tx *storage.Tx) error) error {
+	return db.UpdateLabeledWithRetry(opts.ctx, opts.retry, opts.label, func(tx *storage.Tx) error {
+		tx.SetActor(opts.actor)
+		return fn(tx)
+	})
+}
+
+func Status(db *storage.DB, withBuckets bool) *storage.DBStat {
+	return db.Stat(storage.WithBuckets(withBuckets))
+}
+
+// ListBuckets returns one page of bucket stats and the name to continue after, empty on the last page
+func ListBuckets(db *storage.DB, startAfter string, limit int) ([]storage.NamedBucketStat, string, error) {
+	var stats []storage.NamedBucketStat
+	var next []byte
+	err := db.View(func(tx *storage.Tx) error {
+		var start []byte
+		if startAfter != "" {
+			start = []byte(startAfter)
+		}
+		var err error
+		stats, next, err = tx.BucketStatsPage(start, limit)
 		return err
-	}
-	err = bucket.Put([]byte(key), []byte(value))
-	if err != nil {
+	})
+	return stats, string(next), err
+}
+
+// ListKeys returns one page of keys under the prefix, keys with the delimiter after the prefix
+// are grouped into common prefixes. A positive offset skips that many keys under the prefix
+// without iterating them, withSizes adds the value sizes of the keys. A database without the
+// key bucket has no keys.
+func ListKeys(db *storage.DB, prefix, delimiter, startAfter string, offset uint64, limit int, withSizes bool) (storage.DelimitedList, error) {
+	var list storage.DelimitedList
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		var start []byte
+		if startAfter != "" {
+			start = []byte(startAfter)
+		}
+		if offset > 0 {
+			rank, err := bucket.Rank([]byte(prefix))
+			if err != nil {
+				return err
+			}
+			// the page starts after the last skipped key
+			last, found, err := bucket.KeyAt(rank + offset - 1)
+			if err != nil {
+				return err
+			}
+			if !found || !strings.HasPrefix(string(last), prefix) {
+				return nil
+			}
+			start = last
+		}
+		if withSizes {
+			list, err = bucket.ListDelimitedSizes([]byte(prefix), []byte(delimiter), start, limit)
+		} else {
+			list, err = bucket.ListDelimitedAfter([]byte(prefix), []byte(delimiter), start, limit)
+		}
 		return err
+	})
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		return storage.DelimitedList{}, nil
 	}
-	err = tx.Commit()
-	if err != nil {
+	return list, err
+}
+
+// SampleKeys picks up to n random keys under the prefix with their value sizes and counts
+// the keys under the prefix
+func SampleKeys(db *storage.DB, bucketName string, prefix string, n int) ([]storage.ItemInfo, uint64, error) {
+	var sample []storage.ItemInfo
+	var total uint64
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		if total, err = bucket.CountPrefix([]byte(prefix)); err != nil {
+			return err
+		}
+		sample, err = bucket.Sample([]byte(prefix), n)
+		return err
+	})
+	return sample, total, err
+}
+
+// BucketEvents returns up to limit lifecycle events of the bucket, the newest first. A deleted
+// bucket keeps its events, a bucket without any has none.
+func BucketEvents(db *storage.DB, bucketName string, limit int) ([]storage.BucketEvent, error) {
+	var events []storage.BucketEvent
+	err := db.View(func(tx *storage.Tx) error {
+		var err error
+		events, err = tx.BucketEvents([]byte(bucketName), limit)
 		return err
+	})
+	return events, err
+}
+
+// PrefixStats ranks the first-level key prefixes of a bucket within the budget of opts
+func PrefixStats(db *storage.DB, bucketName string, opts storage.PrefixStatsOptions) (storage.PrefixStats, error) {
+	var stats storage.PrefixStats
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		stats, err = bucket.PrefixStats(opts)
+		return err
+	})
+	return stats, err
+}
+
+func Analyze(db *storage.DB, bucket string) (storage.TreeStats, error) {
+	return db.TreeStats([]byte(bucket))
+}
+
+// ensureMainBucket creates the main bucket when the server opens a database, writes then
+// find it without creating it. Server buckets of files written before they were internal are
+// renamed, see legacyBuckets.
+func ensureMainBucket(db *storage.DB) error {
+	return db.UpdateLabeled("create main bucket", func(tx *storage.Tx) error {
+		if err := renameLegacyBuckets(tx); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(DBBucket)
+		return err
+	})
+}
+
+// legacyBuckets maps the names of server buckets before they took storage.InternalBucketPrefix,
+// which keeps them out of bucket listings, stats, quotas and events, to their names now
+var legacyBuckets = map[string][]byte{
+	"sharding": ShardingBucket,
+	"_locks":   LocksBucket,
+	"_node":    NodeBucket,
+	"_uploads": UploadsBucket,
+}
+
+// renameLegacyBuckets moves the server buckets to their internal names, a bucket is renamed
+// with its sequence, so lock fencing tokens keep growing
+func renameLegacyBuckets(tx *storage.Tx) error {
+	for legacy, name := range legacyBuckets {
+		if !tx.BucketExists([]byte(legacy)) || tx.BucketExists(name) {
+			continue
+		}
+		if err := tx.RenameBucket([]byte(legacy), name); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func Delete(db *storage.DB, key string) bool {
-	tx := db.Begin(true)
-	defer tx.Rollback()
-	bucket, _ := tx.GetBucket(DBBucket)
-	err := bucket.Remove([]byte(key))
-	if err != nil {
-		return false
+// mainBucket returns the main bucket in a write transaction. It exists since the database
+// was opened and is only created again after it was deleted, by a drained bucket under
+// auto_delete_empty_buckets.
+func mainBucket(tx *storage.Tx) (*storage.Bucket, error) {
+	if !tx.BucketExists(DBBucket) {
+		return tx.CreateBucket(DBBucket)
 	}
-	err = tx.Commit()
+	return tx.GetBucket(DBBucket)
+}
+
+func Put(db *storage.DB, key string, value string, opts writeOptions) error {
+	return PutReader(db, key, strings.NewReader(value), len(value), nil, opts)
+}
+
+// PutIfAbsent stores the value unless the key exists, it reports whether the value was stored
+func PutIfAbsent(db *storage.DB, key string, value string, opts writeOptions) (bool, error) {
+	stored := false
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		_, found, err := bucket.Lookup([]byte(key))
+		if err != nil || found {
+			stored = false
+			return err
+		}
+		stored = true
+		return bucket.Put([]byte(key), []byte(value))
+	})
+	return stored, err
+}
+
+// PutReader stores size bytes read from r, a value stored as a blob is copied from r
+// straight into its pages. With an expected checksum the value read is checked before the
+// commit, a mismatch returns storage.ErrChecksumMismatch and nothing is stored. Transient
+// errors fail the transaction before r is read, so a retry reads it from the start.
+func PutReader(db *storage.DB, key string, r io.Reader, size int, expected *uint64, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		value := r
+		var digest hash.Hash64
+		if expected != nil {
+			digest = storage.NewValueHash()
+			value = io.TeeReader(r, digest)
+		}
+		if err = bucket.PutReader([]byte(key), value, size); err != nil {
+			return err
+		}
+		if expected != nil && digest.Sum64() != *expected {
+			return fmt.Errorf("%w: expected %016x, received %016x", storage.ErrChecksumMismatch, *expected, digest.Sum64())
+		}
+		return nil
+	})
+}
+
+// Append adds data to the end of the value stored at the key, a missing key is created.
+// It returns the new value size, storage.ErrValueTooLarge if it would exceed maxSize.
+func Append(db *storage.DB, key string, data []byte, maxSize int64, opts writeOptions) (int, error) {
+	size := 0
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Merge([]byte(key), func(old []byte) ([]byte, error) {
+			if int64(len(old)+len(data)) > maxSize {
+				return nil, storage.ErrValueTooLarge
+			}
+			value := append(old, data...)
+			size = len(value)
+			return value, nil
+		})
+	})
+	return size, err
+}
+
+// PutGenerated stores the value under a new key of the generator in the bucket, which is
+// created if needed, and returns the key
+func PutGenerated(db *storage.DB, bucketName string, gen *keys.Generator, value []byte, opts writeOptions) ([]byte, error) {
+	var key []byte
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		// a retried transaction takes a new key, the old one is never reused
+		key = gen.Next()
+		return bucket.Put(key, value)
+	})
+	return key, err
+}
+
+// SetBucketQuota replaces the quota of the bucket, a zero quota removes it
+func SetBucketQuota(db *storage.DB, bucketName string, quota storage.BucketQuota, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.SetQuota(quota)
+	})
+}
+
+// SetBucketRetention replaces the retention of the bucket, a zero retainFor removes it
+func SetBucketRetention(db *storage.DB, bucketName string, retainFor time.Duration, format storage.RetentionKeys, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.SetRetention(retainFor, format)
+	})
+}
+
+// CompactBlobs rewrites fragmented blob chains of the bucket, at most maxBytes of values per call
+func CompactBlobs(db *storage.DB, bucketName string, maxBytes int64, opts writeOptions) (storage.CompactReport, error) {
+	var report storage.CompactReport
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		report, err = bucket.CompactBlobs(tx, maxBytes)
+		return err
+	})
+	return report, err
+}
+
+// PutBatch stores the pairs in one transaction, nothing is stored if one fails
+func PutBatch(db *storage.DB, items []BatchItem, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err = bucket.Put([]byte(item.Key), []byte(item.Value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete removes the key and reports whether it existed, a missing key is not an error.
+// storage.ErrBucketNotFound is returned if nothing was ever stored in the database.
+func Delete(db *storage.DB, key string, opts writeOptions) (bool, error) {
+	existed := false
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		err = bucket.Remove([]byte(key))
+		if errors.Is(err, storage.ErrNodeNotFound) {
+			existed = false
+			return nil
+		}
+		existed = err == nil
+		return err
+	})
 	if err != nil {
-		return false
+		return false, err
 	}
-	return true
+	return existed, nil
 }
 
-func Get(db *storage.DB, key string) (string, bool) {
-	tx := db.Begin(false)
-	defer tx.Rollback()
-	bucket, err := tx.GetBucket(DBBucket)
+// DeletePrefix removes every key starting with the prefix and returns the number of
+// removed keys. A dry run only counts them and returns the first keys as a sample.
+func DeletePrefix(db *storage.DB, prefix string, dryRun bool, opts writeOptions) (int, []string, error) {
+	count := 0
+	var sample []string
+	var err error
+	if dryRun {
+		err = db.View(func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket(DBBucket)
+			if err != nil {
+				return err
+			}
+			cursor := bucket.Cursor()
+			for k, _ := cursor.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = cursor.Next() {
+				if count < deletePrefixSampleSize {
+					sample = append(sample, string(k))
+				}
+				count++
+			}
+			return cursor.Err()
+		})
+	} else {
+		err = opts.update(db, func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket(DBBucket)
+			if err != nil {
+				return err
+			}
+			count, err = bucket.DeletePrefix([]byte(prefix))
+			return err
+		})
+	}
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		return 0, nil, nil
+	}
 	if err != nil {
-		return "", false
+		return 0, nil, err
 	}
-	value, isFound := bucket.Get([]byte(key))
-	if !isFound {
-		return "", false
+	return count, sample, nil
+}
+
+// Get returns the value of the key, a key that can't be read is reported as missing
+func Get(db *storage.DB, key string) (string, bool) {
+	value, err := db.Get(DBBucket, []byte(key))
+	return string(value), err == nil
+}
+
+// Lookup works as Get and returns read errors, such as storage.ErrTooManyReaders.
+// A database without the key bucket has no keys and is not an error.
+func Lookup(db *storage.DB, key string) (string, bool, error) {
+	value, _, isFound, err := LookupWithChecksum(db, key)
+	return value, isFound, err
+}
+
+// LookupWithChecksum works as Lookup and also returns the checksum stored with the value
+// as 16 hex digits, empty for a value stored without one
+func LookupWithChecksum(db *storage.DB, key string) (string, string, bool, error) {
+	stored, err := readValue(db, DBBucket, key)
+	return stored.value, stored.checksum, stored.found, err
+}
+
+// storedValue is a value read with its checksum, expiring is set for a key under a prefix
+// expiry rule of its bucket
+type storedValue struct {
+	value    string
+	checksum string
+	found    bool
+	expiring bool
+}
+
+// readValue reads the key of the bucket, a missing bucket reads as a missing key
+func readValue(db *storage.DB, bucketName []byte, key string) (storedValue, error) {
+	var stored storedValue
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		value, found, err := bucket.Lookup([]byte(key))
+		if err != nil || !found {
+			return err
+		}
+		stored.value, stored.found = string(value), true
+		for _, rule := range bucket.PrefixRules() {
+			stored.expiring = stored.expiring || strings.HasPrefix(key, string(rule.Prefix))
+		}
+		sum, ok, err := bucket.Checksum([]byte(key))
+		if ok {
+			stored.checksum = formatChecksum(sum)
+		}
+		return err
+	})
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		return storedValue{}, nil
 	}
-	err = tx.Commit()
 	if err != nil {
-		return "", false
+		return storedValue{}, err
 	}
-	return string(value), true
+	return stored, nil
+}
+
+// formatChecksum formats a value checksum the way X-Pirin-Checksum carries it
+func formatChecksum(sum uint64) string {
+	return fmt.Sprintf("%016x", sum)
+}
+
+// ExpirePrefix sets a prefix expiration rule on the bucket
+func ExpirePrefix(db *storage.DB, bucketName string, prefix string, expireAt time.Time, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		return bucket.SetPrefixTTL([]byte(prefix), expireAt)
+	})
 }
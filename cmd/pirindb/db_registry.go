@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/timson/pirindb/storage"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// DBRegistry keeps all databases served by the process, addressed by name.
+// The primary database serves the legacy routes without a database prefix.
+type DBRegistry struct {
+	lock    sync.RWMutex
+	primary string
+	dbs     map[string]*storage.DB
+}
+
+func NewDBRegistry(primary string, db *storage.DB) *DBRegistry {
+	return &DBRegistry{
+		primary: primary,
+		dbs:     map[string]*storage.DB{primary: db},
+	}
+}
+
+func (reg *DBRegistry) Add(name string, db *storage.DB) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if _, ok := reg.dbs[name]; ok {
+		return fmt.Errorf("database %s already registered", name)
+	}
+	reg.dbs[name] = db
+	return nil
+}
+
+// Get returns the database by name, empty name resolves to the primary database
+func (reg *DBRegistry) Get(name string) (*storage.DB, bool) {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	if name == "" {
+		name = reg.primary
+	}
+	db, ok := reg.dbs[name]
+	return db, ok
+}
+
+func (reg *DBRegistry) Primary() *storage.DB {
+	db, _ := reg.Get(reg.primary)
+	return db
+}
+
+func (reg *DBRegistry) PrimaryName() string {
+	return reg.primary
+}
+
+func (reg *DBRegistry) Names() []string {
+	reg.lock.RLock()
+	defer reg.lock.RUnlock()
+	names := make([]string, 0, len(reg.dbs))
+	for name := range reg.dbs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// CloseAll closes every registered database, errors are collected so one failing
+// database does not prevent the others from being closed
+func (reg *DBRegistry) CloseAll(logger *slog.Logger) error {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	var errs []error
+	for name, db := range reg.dbs {
+		if err := db.Close(); err != nil {
+			logger.Error("Failed to close database", "db", name, "error", err)
+			errs = append(errs, fmt.Errorf("close %s: %w", name, err))
+			continue
+		}
+		logger.Info("Database closed", "db", name)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+const (
+	// digestBatchSize bounds digests computed in one read transaction, the lock is
+	// released while a batch is streamed or compared
+	digestBatchSize = 1000
+
+	digestKeysTrailer = "X-Pirin-Digest-Keys"
+)
+
+// KeyDigestResponse is one line of the digest stream, values are compared by size and
+// SHA-256 so they do not travel between nodes
+type KeyDigestResponse struct {
+	Key  []byte `json:"key"`
+	Size int    `json:"size"`
+	Sum  string `json:"sum"`
+}
+
+// DiffRequest compares a bucket of this node with the same bucket on a peer node
+type DiffRequest struct {
+	Peer       string `json:"peer"`    // base url of the peer, like http://10.0.0.2:4321
+	PeerDB     string `json:"peer_db"` // database on the peer, its primary database by default
+	Bucket     string `json:"bucket"`
+	Start      string `json:"start"`       // first key compared
+	End        string `json:"end"`         // keys from end on are not compared
+	MaxEntries int    `json:"max_entries"` // differences streamed, 0 streams all, counting goes on
+}
+
+// DiffLineResponse is one line of the diff stream: a difference, or the summary ending
+// the stream. Side a is the node serving the request, side b the peer.
+type DiffLineResponse struct {
+	Key     string               `json:"key,omitempty"`
+	Kind    storage.DiffKind     `json:"kind,omitempty"`
+	Summary *DiffSummaryResponse `json:"summary,omitempty"`
+}
+
+type DiffSummaryResponse struct {
+	Compared  int    `json:"compared"`
+	OnlyInA   int    `json:"only_in_a"`
+	OnlyInB   int    `json:"only_in_b"`
+	Changed   int    `json:"changed"`
+	Equal     bool   `json:"equal"`
+	Truncated bool   `json:"truncated"`       // more differences than max_entries
+	Error     string `json:"error,omitempty"` // the comparison stopped early, counts are partial
+}
+
+// DigestBatch computes digests of up to limit keys of the bucket from the key on and
+// before end, in one read transaction
+func DigestBatch(db *storage.DB, bucketName string, from, end []byte, limit int) ([]KeyDigestResponse, error) {
+	digests := make([]KeyDigestResponse, 0, limit)
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		var k, v []byte
+		if from == nil {
+			k, v = cursor.First()
+		} else {
+			k, v = cursor.Seek(from)
+		}
+		for ; k != nil && len(digests) < limit; k, v = cursor.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				break
+			}
+			sum := sha256.Sum256(v)
+			digests = append(digests, KeyDigestResponse{Key: bytes.Clone(k), Size: len(v), Sum: hex.EncodeToString(sum[:])})
+		}
+		return cursor.Err()
+	})
+	return digests, err
+}
+
+// digestRange returns the optional start and end query parameters
+func digestRange(query url.Values) (start, end []byte) {
+	if query.Has("start") {
+		start = []byte(query.Get("start"))
+	}
+	if query.Has("end") {
+		end = []byte(query.Get("end"))
+	}
+	return start, end
+}
+
+// handleDigests streams the digests of the bucket keys as NDJSON, the number of keys
+// arrives in a trailer so a client can tell a complete stream from a cut one
+func (srv *Server) handleDigests(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	start, end := digestRange(r.URL.Query())
+	digests, err := DigestBatch(db, bucket, start, end, digestBatchSize)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", digestKeysTrailer)
+	w.WriteHeader(http.StatusOK)
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	sent := 0
+	for err == nil && len(digests) > 0 {
+		for _, digest := range digests {
+			if err = encoder.Encode(&digest); err != nil {
+				break
+			}
+		}
+		sent += len(digests)
+		if err == nil {
+			err = buffered.Flush()
+		}
+		if err != nil || r.Context().Err() != nil || len(digests) < digestBatchSize {
+			break
+		}
+		next := append(digests[len(digests)-1].Key, 0) // smallest key after the last one
+		digests, err = DigestBatch(db, bucket, next, end, digestBatchSize)
+	}
+	if err != nil {
+		srv.Logger.Error("digest stream failed", "bucket", bucket, "error", err)
+		return
+	}
+	w.Header().Set(digestKeysTrailer, strconv.Itoa(sent))
+}
+
+// peerDigests reads the digest stream of the peer one key at a time
+type peerDigests struct {
+	resp    *http.Response
+	decoder *json.Decoder
+	next    *KeyDigestResponse // nil once the stream is done
+	read    int
+}
+
+// openPeerDigests requests the digest stream of the bucket from the peer, the request id of
+// the context is passed on
+func openPeerDigests(ctx context.Context, req *DiffRequest) (*peerDigests, error) {
+	path := "/api/v1"
+	if req.PeerDB != "" {
+		path += "/" + url.PathEscape(req.PeerDB)
+	}
+	query := url.Values{}
+	if req.Start != "" {
+		query.Set("start", req.Start)
+	}
+	if req.End != "" {
+		query.Set("end", req.End)
+	}
+	reqURL := fmt.Sprintf("%s%s/buckets/%s/digests?%s", strings.TrimSuffix(req.Peer, "/"), path, url.PathEscape(req.Bucket), query.Encode())
+	peerReq, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if id := middleware.GetReqID(ctx); id != "" {
+		peerReq.Header.Set(middleware.RequestIDHeader, id)
+	}
+	resp, err := http.DefaultClient.Do(peerReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	peer := &peerDigests{resp: resp, decoder: json.NewDecoder(resp.Body)}
+	return peer, peer.advance()
+}
+
+func (peer *peerDigests) advance() error {
+	var digest KeyDigestResponse
+	err := peer.decoder.Decode(&digest)
+	if errors.Is(err, io.EOF) {
+		peer.next = nil
+		// the trailer is only sent after the whole stream
+		if peer.resp.Trailer.Get(digestKeysTrailer) != strconv.Itoa(peer.read) {
+			return errors.New("peer digest stream was interrupted")
+		}
+		return nil
+	}
+	if err != nil {
+		peer.next = nil
+		return fmt.Errorf("failed to parse peer digests: %w", err)
+	}
+	peer.next = &digest
+	peer.read++
+	return nil
+}
+
+func (peer *peerDigests) close() {
+	_ = peer.resp.Body.Close()
+}
+
+// handleDiff compares a bucket with the same bucket on a peer node by a merge walk over
+// both digest streams, differences are streamed as NDJSON and a summary ends the stream
+func (srv *Server) handleDiff(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var req DiffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bucket == "" || req.MaxEntries < 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	if peerURL, err := url.Parse(req.Peer); err != nil || (peerURL.Scheme != "http" && peerURL.Scheme != "https") || peerURL.Host == "" {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	var start, end []byte
+	if req.Start != "" {
+		start = []byte(req.Start)
+	}
+	if req.End != "" {
+		end = []byte(req.End)
+	}
+	local, err := DigestBatch(db, req.Bucket, start, end, digestBatchSize)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	peer, err := openPeerDigests(r.Context(), &req)
+	if err != nil {
+		srv.Logger.Error("failed to read peer digests", "peer", req.Peer, "error", err)
+		if peer != nil {
+			peer.close()
+		}
+		_ = render.Render(w, r, ErrPeerUnavailable())
+		return
+	}
+	defer peer.close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	summary := &DiffSummaryResponse{}
+	emit := func(key []byte, kind storage.DiffKind) error {
+		switch kind {
+		case storage.DiffOnlyInA:
+			summary.OnlyInA++
+		case storage.DiffOnlyInB:
+			summary.OnlyInB++
+		case storage.DiffChanged:
+			summary.Changed++
+		}
+		if req.MaxEntries > 0 && summary.OnlyInA+summary.OnlyInB+summary.Changed > req.MaxEntries {
+			summary.Truncated = true
+			return nil
+		}
+		return encoder.Encode(&DiffLineResponse{Key: string(key), Kind: kind})
+	}
+
+	summary.Compared, err = walkDiff(db, req.Bucket, local, end, peer, func() error {
+		// the batch is done, hand the written differences to the client before the next one
+		if err := buffered.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	}, emit)
+	if err != nil {
+		srv.Logger.Error("diff failed", "bucket", req.Bucket, "peer", req.Peer, "error", err)
+		summary.Error = err.Error()
+	}
+	summary.Equal = err == nil && summary.OnlyInA+summary.OnlyInB+summary.Changed == 0
+	_ = encoder.Encode(&DiffLineResponse{Summary: summary})
+	_ = buffered.Flush()
+}
+
+// walkDiff merges the local digests of the bucket, starting with the batch local and read up
+// to end, with the digest stream of the peer and calls emit for every difference. batchDone
+// is called before the next local batch is read. It returns the keys found on both sides.
+func walkDiff(db *storage.DB, bucket string, local []KeyDigestResponse, end []byte, peer *peerDigests,
+	batchDone func() error, emit func(key []byte, kind storage.DiffKind) error) (int, error) {
+	compared, i := 0, 0
+	var err error
+	for err == nil {
+		if i == len(local) && len(local) == digestBatchSize {
+			if err = batchDone(); err != nil {
+				break
+			}
+			next := append(local[len(local)-1].Key, 0) // smallest key after the last one
+			if local, err = DigestBatch(db, bucket, next, end, digestBatchSize); err != nil {
+				break
+			}
+			i = 0
+		}
+		if i == len(local) && peer.next == nil {
+			break
+		}
+		var order int
+		switch {
+		case peer.next == nil:
+			order = -1
+		case i == len(local):
+			order = 1
+		default:
+			order = bytes.Compare(local[i].Key, peer.next.Key)
+		}
+		switch {
+		case order < 0:
+			err = emit(local[i].Key, storage.DiffOnlyInA)
+			i++
+		case order > 0:
+			if err = emit(peer.next.Key, storage.DiffOnlyInB); err == nil {
+				err = peer.advance()
+			}
+		default:
+			compared++
+			if local[i].Size != peer.next.Size || local[i].Sum != peer.next.Sum {
+				err = emit(local[i].Key, storage.DiffChanged)
+			}
+			i++
+			if err == nil {
+				err = peer.advance()
+			}
+		}
+	}
+	return compared, err
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func fillDiffNode(t *testing.T, node *testNode, fn func(bucket *storage.Bucket) error) {
+	t.Helper()
+	db, ok := node.srv.DBs.Get(node.srv.DBs.PrimaryName())
+	require.True(t, ok)
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 2500; i++ {
+			key := fmt.Sprintf("user_%05d", i)
+			if err = bucket.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return fn(bucket)
+	}))
+}
+
+func requestDiff(t *testing.T, node *testNode, req DiffRequest) (int, []DiffLineResponse) {
+	t.Helper()
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	resp, err := http.Post(node.ts.URL+"/api/v1/admin/diff", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	require.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	var lines []DiffLineResponse
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var line DiffLineResponse
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		lines = append(lines, line)
+	}
+	require.NoError(t, scanner.Err())
+	return resp.StatusCode, lines
+}
+
+func TestDiffNodes(t *testing.T) {
+	nodeA := startTestNode(t, "a", &ClusterConfig{})
+	nodeB := startTestNode(t, "b", &ClusterConfig{})
+	fillDiffNode(t, nodeA, func(bucket *storage.Bucket) error {
+		if err := bucket.Put([]byte("user_00010"), []byte("changed")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("user_01500_extra"), []byte("a"))
+	})
+	fillDiffNode(t, nodeB, func(bucket *storage.Bucket) error {
+		if err := bucket.Remove([]byte("user_02000")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("zz"), []byte("b"))
+	})
+
+	status, lines := requestDiff(t, nodeA, DiffRequest{Peer: nodeB.ts.URL, Bucket: "users"})
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, []DiffLineResponse{
+		{Key: "user_00010", Kind: storage.DiffChanged},
+		{Key: "user_01500_extra", Kind: storage.DiffOnlyInA},
+		{Key: "user_02000", Kind: storage.DiffOnlyInA},
+		{Key: "zz", Kind: storage.DiffOnlyInB},
+		{Summary: &DiffSummaryResponse{Compared: 2499, OnlyInA: 2, OnlyInB: 1, Changed: 1}},
+	}, lines)
+
+	// a range without differences, and a limit on the streamed entries
+	_, lines = requestDiff(t, nodeA, DiffRequest{Peer: nodeB.ts.URL + "/", Bucket: "users", Start: "user_00011", End: "user_01500"})
+	require.Equal(t, []DiffLineResponse{{Summary: &DiffSummaryResponse{Compared: 1489, Equal: true}}}, lines)
+	_, lines = requestDiff(t, nodeA, DiffRequest{Peer: nodeB.ts.URL, Bucket: "users", MaxEntries: 1})
+	require.Len(t, lines, 2)
+	require.Equal(t, &DiffSummaryResponse{Compared: 2499, OnlyInA: 2, OnlyInB: 1, Changed: 1, Truncated: true}, lines[1].Summary)
+
+	status, _ = requestDiff(t, nodeA, DiffRequest{Peer: nodeB.ts.URL, Bucket: "missing"})
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = requestDiff(t, nodeA, DiffRequest{Peer: "not a url", Bucket: "users"})
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestDiff(t, nodeA, DiffRequest{Peer: nodeB.ts.URL, PeerDB: "missing", Bucket: "users"})
+	require.Equal(t, http.StatusBadGateway, status)
+}
+
+func TestDigests(t *testing.T) {
+	node := startTestNode(t, "a", &ClusterConfig{})
+	fillDiffNode(t, node, func(bucket *storage.Bucket) error { return nil })
+
+	resp, err := http.Get(node.ts.URL + "/api/v1/buckets/users/digests?start=user_00100&end=user_02100")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	decoder := json.NewDecoder(resp.Body)
+	var digests []KeyDigestResponse
+	for decoder.More() {
+		var digest KeyDigestResponse
+		require.NoError(t, decoder.Decode(&digest))
+		digests = append(digests, digest)
+	}
+	require.Len(t, digests, 2000)
+	require.Equal(t, []byte("user_00100"), digests[0].Key)
+	require.Equal(t, len("user_00100"), digests[0].Size)
+	require.Len(t, digests[0].Sum, 64)
+	require.Equal(t, "2000", resp.Trailer.Get(digestKeysTrailer))
+}
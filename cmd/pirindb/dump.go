@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/timson/pirindb/storage"
+)
+
+// A bucket dump is the binary stream of its keys and values in key order:
+//
+//	header  "PRNDUMP" and the format version byte
+//	record  1, uvarint key size, key, uvarint value size, value
+//	end     0, uint64 records, uint32 CRC-32 (IEEE) of the stream before the end byte
+//
+// Values are written as they are, binary values survive, and a cut stream is told from a
+// complete one by its missing end.
+
+const (
+	dumpMagic   = "PRNDUMP"
+	dumpVersion = 1
+
+	dumpRecordEnd   = 0
+	dumpRecordValue = 1
+
+	// dumpBatchSize bounds keys read in one read transaction and held in memory, the lock is
+	// released while a batch is written to the client
+	dumpBatchSize = 256
+	// a load commits every loadBatchKeys keys or once loadBatchBytes of values are read
+	loadBatchKeys  = 1000
+	loadBatchBytes = 4 * 1024 * 1024
+	// finished load jobs are reported for loadJobTTL
+	loadJobTTL = time.Hour
+
+	dumpKeysTrailer = "X-Pirin-Dump-Keys"
+	loadJobHeader   = "X-Pirin-Load-Job"
+)
+
+var (
+	ErrMalformedDump  = errors.New("malformed bucket dump")
+	ErrBucketNotEmpty = errors.New("bucket is not empty")
+)
+
+// dumpWriter writes the records of a dump
+type dumpWriter struct {
+	w       *bufio.Writer
+	crc     hash.Hash32
+	out     io.Writer // w and crc
+	records uint64
+}
+
+func newDumpWriter(w io.Writer) (*dumpWriter, error) {
+	dump := &dumpWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	dump.out = io.MultiWriter(dump.w, dump.crc)
+	_, err := io.WriteString(dump.out, dumpMagic+string(rune(dumpVersion)))
+	return dump, err
+}
+
+func (dump *dumpWriter) write(key, value []byte) error {
+	record := []byte{dumpRecordValue}
+	record = binary.AppendUvarint(record, uint64(len(key)))
+	record = append(record, key...)
+	record = binary.AppendUvarint(record, uint64(len(value)))
+	if _, err := dump.out.Write(record); err != nil {
+		return err
+	}
+	dump.records++
+	_, err := dump.out.Write(value)
+	return err
+}
+
+// close writes the end of the dump and flushes it
+func (dump *dumpWriter) close() error {
+	end := []byte{dumpRecordEnd}
+	end = binary.LittleEndian.AppendUint64(end, dump.records)
+	end = binary.LittleEndian.AppendUint32(end, dump.crc.Sum32())
+	if _, err := dump.w.Write(end); err != nil {
+		return err
+	}
+	return dump.w.Flush()
+}
+
+// dumpReader reads the records of a dump, values larger than maxValue are refused
+type dumpReader struct {
+	in       checksummedReader
+	maxValue int64
+	records  uint64
+}
+
+func newDumpReader(r io.Reader, maxValue int64) (*dumpReader, error) {
+	dump := &dumpReader{in: checksummedReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}, maxValue: maxValue}
+	header := make([]byte, len(dumpMagic)+1)
+	if _, err := io.ReadFull(dump.in, header); err != nil || string(header[:len(dumpMagic)]) != dumpMagic {
+		return nil, fmt.Errorf("%w: no dump header", ErrMalformedDump)
+	}
+	if header[len(dumpMagic)] != dumpVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrMalformedDump, header[len(dumpMagic)])
+	}
+	return dump, nil
+}
+
+// next returns the next record, io.EOF after the end was read and checked
+func (dump *dumpReader) next() (key, value []byte, err error) {
+	sum := dump.in.crc.Sum32()
+	kind, err := dump.in.ReadByte()
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: the stream ends before its end record", ErrMalformedDump)
+	}
+	switch kind {
+	case dumpRecordEnd:
+		end := make([]byte, 12)
+		if _, err = io.ReadFull(dump.in, end); err != nil {
+			return nil, nil, fmt.Errorf("%w: short end record", ErrMalformedDump)
+		}
+		if records := binary.LittleEndian.Uint64(end); records != dump.records {
+			return nil, nil, fmt.Errorf("%w: %d records read, the end counts %d", ErrMalformedDump, dump.records, records)
+		}
+		if binary.LittleEndian.Uint32(end[8:]) != sum {
+			return nil, nil, fmt.Errorf("%w: checksum mismatch", ErrMalformedDump)
+		}
+		return nil, nil, io.EOF
+	case dumpRecordValue:
+	default:
+		return nil, nil, fmt.Errorf("%w: unknown record %d", ErrMalformedDump, kind)
+	}
+	keySize, err := binary.ReadUvarint(dump.in)
+	if err != nil || keySize == 0 || keySize >= storage.MaxKeySize {
+		return nil, nil, fmt.Errorf("%w: bad key size", ErrMalformedDump)
+	}
+	key = make([]byte, keySize)
+	if _, err = io.ReadFull(dump.in, key); err != nil {
+		return nil, nil, fmt.Errorf("%w: short key", ErrMalformedDump)
+	}
+	valueSize, err := binary.ReadUvarint(dump.in)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: bad value size", ErrMalformedDump)
+	}
+	if valueSize > uint64(dump.maxValue) {
+		return nil, nil, fmt.Errorf("%w: a value of %d bytes exceeds %d", storage.ErrValueTooLarge, valueSize, dump.maxValue)
+	}
+	value = make([]byte, valueSize)
+	if _, err = io.ReadFull(dump.in, value); err != nil {
+		return nil, nil, fmt.Errorf("%w: short value", ErrMalformedDump)
+	}
+	dump.records++
+	return key, value, nil
+}
+
+// checksummedReader adds the bytes read to the checksum of the stream
+type checksummedReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (c checksummedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	_, _ = c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c checksummedReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		_, _ = c.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// handleDump streams the bucket as a dump, read dumpBatchSize keys at a time. Like the export
+// it is not a point in time snapshot, the number of keys arrives in a trailer.
+func (srv *Server) handleDump(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	rows, err := ExportBatch(db, bucket, nil, dumpBatchSize)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", dumpKeysTrailer)
+	w.WriteHeader(http.StatusOK)
+	dump, err := newDumpWriter(w)
+	for err == nil && len(rows) > 0 {
+		for _, row := range rows {
+			if err = dump.write(row.key, row.value); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = dump.w.Flush()
+		}
+		if flusher, ok := w.(http.Flusher); ok && err == nil {
+			flusher.Flush()
+		}
+		if err != nil || r.Context().Err() != nil || len(rows) < dumpBatchSize {
+			break
+		}
+		next := append(rows[len(rows)-1].key, 0) // smallest key after the last one
+		rows, err = ExportBatch(db, bucket, next, dumpBatchSize)
+	}
+	if err == nil && r.Context().Err() == nil {
+		err = dump.close()
+	}
+	if err != nil {
+		// the status is sent already, the client sees a stream without its end
+		srv.Logger.Error("dump failed", "bucket", bucket, "error", err)
+		return
+	}
+	w.Header().Set(dumpKeysTrailer, strconv.FormatUint(dump.records, 10))
+}
+
+// LoadJob is the progress of a bucket load, see handleLoad
+type LoadJob struct {
+	ID         string    `json:"id"`
+	DB         string    `json:"db"`
+	Bucket     string    `json:"bucket"`
+	State      string    `json:"state"` // running, done or failed
+	Keys       int       `json:"keys"`  // committed so far
+	Bytes      int64     `json:"bytes"` // of the committed values
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+}
+
+// loadJobs keeps the running loads and the finished ones for loadJobTTL
+type loadJobs struct {
+	lock sync.Mutex
+	jobs map[string]*LoadJob
+}
+
+// start registers a job, an id of a running job is refused
+func (loads *loadJobs) start(job *LoadJob) bool {
+	loads.lock.Lock()
+	defer loads.lock.Unlock()
+	if loads.jobs == nil {
+		loads.jobs = make(map[string]*LoadJob)
+	}
+	for id, known := range loads.jobs {
+		if known.State != "running" && time.Since(known.FinishedAt) > loadJobTTL {
+			delete(loads.jobs, id)
+		}
+	}
+	if known, ok := loads.jobs[job.ID]; ok && known.State == "running" {
+		return false
+	}
+	loads.jobs[job.ID] = job
+	return true
+}
+
+// update changes the job under the lock
+func (loads *loadJobs) update(job *LoadJob, fn func(job *LoadJob)) {
+	loads.lock.Lock()
+	defer loads.lock.Unlock()
+	fn(job)
+}
+
+// get returns a copy of the job
+func (loads *loadJobs) get(id string) (LoadJob, bool) {
+	loads.lock.Lock()
+	defer loads.lock.Unlock()
+	job, ok := loads.jobs[id]
+	if !ok {
+		return LoadJob{}, false
+	}
+	return *job, true
+}
+
+// handleLoad ingests a dump into the bucket, which is created if missing and must be empty.
+// Keys must arrive in order, they are committed loadBatchKeys at a time, so a failed load
+// leaves the keys before the failure in the bucket. The job id is the job query parameter or
+// a new one, GET /loads/{id} reports the progress while the request runs.
+func (srv *Server) handleLoad(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucketName := chi.URLParam(r, "bucket")
+	if isInternalBucket(bucketName) {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	dbName := chi.URLParam(r, "db")
+	if dbName == "" {
+		dbName = srv.DBs.PrimaryName()
+	}
+	job := &LoadJob{ID: r.URL.Query().Get("job"), DB: dbName, Bucket: bucketName, State: "running", StartedAt: time.Now().UTC()}
+	if job.ID == "" {
+		job.ID = uuid.New().String()
+	}
+	if !srv.loads.start(job) {
+		_ = render.Render(w, r, ErrLoadRunningResponse())
+		return
+	}
+	w.Header().Set(loadJobHeader, job.ID)
+
+	err := srv.loadDump(r, db, job)
+	status := http.StatusCreated
+	srv.loads.update(job, func(job *LoadJob) {
+		job.State, job.FinishedAt = "done", time.Now().UTC()
+		if err != nil {
+			job.State, job.Error = "failed", err.Error()
+		}
+	})
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrBucketNotEmpty):
+		status = http.StatusConflict
+	case errors.Is(err, ErrMalformedDump), errors.Is(err, storage.ErrValueTooLarge),
+		errors.Is(err, storage.ErrKeyTooLarge):
+		status = http.StatusBadRequest
+	default:
+		srv.Logger.Error("load failed", "bucket", bucketName, "job", job.ID, "error", err)
+		status = http.StatusInternalServerError
+	}
+	result, _ := srv.loads.get(job.ID)
+	render.Status(r, status)
+	render.JSON(w, r, &result)
+}
+
+// loadDump checks the bucket is empty and commits the records of the dump in batches
+func (srv *Server) loadDump(r *http.Request, db *storage.DB, job *LoadJob) error {
+	opts := srv.writeOptions(r)
+	opts.label = "bucket_load"
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(job.Bucket))
+		if err != nil {
+			return err
+		}
+		if k, _ := bucket.Cursor().First(); k != nil {
+			return fmt.Errorf("%w: %s", ErrBucketNotEmpty, job.Bucket)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dump, err := newDumpReader(r.Body, srv.maxValueSize())
+	if err != nil {
+		return err
+	}
+
+	var last []byte
+	for done := false; !done; {
+		var keys, values [][]byte
+		size := 0
+		for len(keys) < loadBatchKeys && size < loadBatchBytes {
+			key, value, err := dump.next()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if last != nil && bytes.Compare(key, last) <= 0 {
+				return fmt.Errorf("%w: keys out of order", ErrMalformedDump)
+			}
+			last = key
+			keys, values = append(keys, key), append(values, value)
+			size += len(value)
+		}
+		if len(keys) == 0 {
+			break
+		}
+		// the batch is read before the write lock is taken, a slow client does not hold it
+		err = opts.update(db, func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket([]byte(job.Bucket))
+			if err != nil {
+				return err
+			}
+			for i, key := range keys {
+				if err = bucket.Put(key, values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		srv.loads.update(job, func(job *LoadJob) {
+			job.Keys += len(keys)
+			job.Bytes += int64(size)
+		})
+	}
+	return nil
+}
+
+// handleLoadStatus reports a running or recently finished load
+func (srv *Server) handleLoadStatus(w http.ResponseWriter, r *http.Request) {
+	job, ok := srv.loads.get(chi.URLParam(r, "id"))
+	if !ok {
+		_ = render.Render(w, r, ErrLoadNotFoundResponse())
+		return
+	}
+	render.JSON(w, r, &job)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func requestLoad(t *testing.T, node *testNode, bucket, job string, dump []byte) (int, LoadJob) {
+	t.Helper()
+	url := fmt.Sprintf("%s/api/v1/buckets/%s/load", node.ts.URL, bucket)
+	if job != "" {
+		url += "?job=" + job
+	}
+	resp, err := http.Post(url, "application/octet-stream", bytes.NewReader(dump))
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var result LoadJob
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	require.Equal(t, result.ID, resp.Header.Get(loadJobHeader))
+	return resp.StatusCode, result
+}
+
+func TestDumpLoad(t *testing.T) {
+	nodeA := startTestNode(t, "a", &ClusterConfig{})
+	nodeB := startTestNode(t, "b", &ClusterConfig{})
+	large := bytes.Repeat([]byte{0, 1, 0xff, 'x'}, 25_000) // a blob
+	require.NoError(t, nodeA.srv.DBs.Primary().Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("files"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 3*dumpBatchSize+10; i++ {
+			value := []byte{byte(i), 0, 0xfe, byte(i >> 8)} // not valid UTF-8
+			if err = bucket.Put([]byte(fmt.Sprintf("file_%05d", i)), value); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("large"), large)
+	}))
+
+	resp, err := http.Get(nodeA.ts.URL + "/api/v1/buckets/files/dump")
+	require.NoError(t, err)
+	dump, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, fmt.Sprint(3*dumpBatchSize+11), resp.Trailer.Get(dumpKeysTrailer))
+
+	status, job := requestLoad(t, nodeB, "copy", "job-1", dump)
+	require.Equal(t, http.StatusCreated, status, job.Error)
+	require.Equal(t, "done", job.State)
+	require.Equal(t, "job-1", job.ID)
+	require.Equal(t, 3*dumpBatchSize+11, job.Keys)
+	expected, err := ExportBatch(nodeA.srv.DBs.Primary(), "files", nil, 1000)
+	require.NoError(t, err)
+	loaded, err := ExportBatch(nodeB.srv.DBs.Primary(), "copy", nil, 1000)
+	require.NoError(t, err)
+	require.Equal(t, expected, loaded)
+
+	resp, err = http.Get(nodeB.ts.URL + "/api/v1/loads/job-1")
+	require.NoError(t, err)
+	var polled LoadJob
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&polled))
+	_ = resp.Body.Close()
+	require.Equal(t, job, polled)
+
+	// a bucket with keys is refused, nothing is written to it
+	status, job = requestLoad(t, nodeB, "copy", "", dump)
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "failed", job.State)
+	require.Zero(t, job.Keys)
+
+	// a cut or damaged stream fails the load after the batches before the damage
+	status, job = requestLoad(t, nodeB, "cut", "", dump[:len(dump)-5])
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, "failed", job.State)
+	require.Contains(t, job.Error, ErrMalformedDump.Error())
+	require.Zero(t, job.Keys) // all keys are in the one batch the damage failed
+	damaged := bytes.Clone(dump)
+	damaged[len(damaged)-20]++
+	status, job = requestLoad(t, nodeB, "damaged", "", damaged)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, job.Error, "checksum mismatch")
+	status, _ = requestLoad(t, nodeB, "other", "", []byte("not a dump"))
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = requestLoad(t, nodeB, string(ShardingBucket), "", dump)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	resp, err = http.Get(nodeB.ts.URL + "/api/v1/loads/unknown")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
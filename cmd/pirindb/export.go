@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+const (
+	// exportBatchSize bounds rows read in one read transaction and held in memory,
+	// the lock is released while a batch is written to the client
+	exportBatchSize = 1000
+
+	exportRowsTrailer   = "X-Pirin-Export-Rows"
+	exportErrorsTrailer = "X-Pirin-Export-Errors"
+)
+
+type exportRow struct {
+	key   []byte
+	value []byte
+}
+
+// ExportBatch reads up to limit rows of the bucket starting at the key in one read
+// transaction, values are copied so they outlive the transaction
+func ExportBatch(db *storage.DB, bucketName string, from []byte, limit int) ([]exportRow, error) {
+	rows := make([]exportRow, 0, limit)
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte(bucketName))
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		var k, v []byte
+		if from == nil {
+			k, v = cursor.First()
+		} else {
+			k, v = cursor.Seek(from)
+		}
+		for ; k != nil && len(rows) < limit; k, v = cursor.Next() {
+			rows = append(rows, exportRow{key: bytes.Clone(k), value: bytes.Clone(v)})
+		}
+		return cursor.Err()
+	})
+	return rows, err
+}
+
+// exportWriter renders rows in one of the export formats
+type exportWriter interface {
+	header() error
+	// row writes the key and the fields of the value
+	row(key []byte, value map[string]json.RawMessage) error
+	flush() error
+}
+
+type csvExport struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (e *csvExport) header() error {
+	return e.w.Write(append([]string{"key"}, e.fields...))
+}
+
+func (e *csvExport) row(key []byte, value map[string]json.RawMessage) error {
+	record := make([]string, 0, len(e.fields)+1)
+	record = append(record, string(key))
+	for _, field := range e.fields {
+		record = append(record, csvCell(value[field]))
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExport) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvCell renders strings unquoted, missing fields and null as empty cells and any other
+// JSON value as compact JSON text
+func csvCell(raw json.RawMessage) string {
+	if len(raw) == 0 || string(raw) == "null" {
+		return ""
+	}
+	var s string
+	if raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return string(raw)
+	}
+	return buf.String()
+}
+
+type ndjsonExport struct {
+	w      *bufio.Writer
+	fields []string
+}
+
+func (e *ndjsonExport) header() error {
+	return nil
+}
+
+// row writes {"key": ..., "value": {...}}, the value keeps only the requested fields,
+// all fields are kept if none were requested
+func (e *ndjsonExport) row(key []byte, value map[string]json.RawMessage) error {
+	if len(e.fields) > 0 {
+		projected := make(map[string]json.RawMessage, len(e.fields))
+		for _, field := range e.fields {
+			if raw, ok := value[field]; ok {
+				projected[field] = raw
+			} else {
+				projected[field] = json.RawMessage("null")
+			}
+		}
+		value = projected
+	}
+	data, err := json.Marshal(struct {
+		Key   string                     `json:"key"`
+		Value map[string]json.RawMessage `json:"value"`
+	}{string(key), value})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *ndjsonExport) flush() error {
+	return e.w.Flush()
+}
+
+// handleExport streams the bucket as CSV or NDJSON. Values must be JSON objects, other
+// values are skipped and counted in the X-Pirin-Export-Errors trailer. The bucket is read
+// in batches, each in its own read transaction, so a slow client never holds the lock and
+// the export is not a point in time snapshot.
+func (srv *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	var fields []string
+	if param := r.URL.Query().Get("fields"); param != "" {
+		fields = strings.Split(param, ",")
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if (format != "csv" && format != "ndjson") || (format == "csv" && len(fields) == 0) {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+
+	readBatch := func(from []byte) ([]exportRow, error) {
+		return ExportBatch(db, bucket, from, exportBatchSize)
+	}
+	if pb := srv.partitions[bucket]; pb != nil {
+		readBatch = func(from []byte) ([]exportRow, error) {
+			return ExportPartitioned(db, bucket, pb.partition, from, exportBatchSize)
+		}
+	}
+	rows, err := readBatch(nil)
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	}
+	if errors.Is(err, storage.ErrTooManyReaders) {
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+
+	buffered := bufio.NewWriter(w)
+	var out exportWriter
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		out = &csvExport{w: csv.NewWriter(buffered), fields: fields}
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		out = &ndjsonExport{w: buffered, fields: fields}
+	}
+	w.Header().Set("Trailer", exportRowsTrailer+", "+exportErrorsTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	exported, malformed := 0, 0
+	err = out.header()
+	for err == nil && len(rows) > 0 {
+		for _, row := range rows {
+			var value map[string]json.RawMessage
+			if json.Unmarshal(row.value, &value) != nil || value == nil {
+				malformed++
+				continue
+			}
+			if err = out.row(row.key, value); err != nil {
+				break
+			}
+			exported++
+		}
+		// writing blocks while the client is slow, this is the only place a batch waits
+		if err == nil {
+			err = out.flush()
+		}
+		if err == nil {
+			err = buffered.Flush()
+		}
+		if flusher, ok := w.(http.Flusher); ok && err == nil {
+			flusher.Flush()
+		}
+		if err != nil || r.Context().Err() != nil || len(rows) < exportBatchSize {
+			break
+		}
+		next := append(rows[len(rows)-1].key, 0) // smallest key after the last one
+		rows, err = readBatch(next)
+	}
+	if err != nil {
+		// the status is sent already, the client sees a body without trailers
+		srv.Logger.Error("export failed", "bucket", bucket, "error", err)
+		return
+	}
+	w.Header().Set(exportRowsTrailer, strconv.Itoa(exported))
+	w.Header().Set(exportErrorsTrailer, strconv.Itoa(malformed))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const (
+	forwardedForHeader   = "X-Forwarded-For"
+	forwardedProtoHeader = "X-Forwarded-Proto"
+	realIPHeader         = "X-Real-IP"
+)
+
+// forwardedClient is the client of a request as told by trusted proxies
+type forwardedClient struct {
+	ip     string
+	scheme string
+}
+
+type forwardedClientKey struct{}
+
+// parseTrustedProxies reads server.trusted_proxies, a single address is a /32 or /128
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trustedProxy reports whether forwarded headers sent from the address are believed
+func (srv *Server) trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range srv.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClient finds the client address and scheme of the request. X-Forwarded-For,
+// X-Real-IP and X-Forwarded-Proto are only read from trusted proxies, headers sent by
+// anyone else are ignored so a client can't pass for another address. X-Forwarded-For is
+// read from the right, the first address that is not a trusted proxy is the client.
+func (srv *Server) resolveClient(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := forwardedClient{ip: remoteIP(r.RemoteAddr), scheme: "http"}
+		if r.TLS != nil {
+			client.scheme = "https"
+		}
+		if peer, err := netip.ParseAddr(client.ip); err == nil && srv.trustedProxy(peer) {
+			if ip, ok := srv.forwardedFor(r); ok {
+				client.ip = ip
+			}
+			proto, _, _ := strings.Cut(r.Header.Get(forwardedProtoHeader), ",")
+			if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+				client.scheme = proto
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), forwardedClientKey{}, client)))
+	})
+}
+
+// forwardedFor returns the client address told by the proxies in front of the node
+func (srv *Server) forwardedFor(r *http.Request) (string, bool) {
+	var hops []string
+	for _, value := range r.Header.Values(forwardedForHeader) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !srv.trustedProxy(addr) {
+			break
+		}
+	}
+	if client != "" {
+		return client, true
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get(realIPHeader))); err == nil {
+		return addr.Unmap().String(), true
+	}
+	return "", false
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// clientIP returns the client address of the request, behind trusted proxies the one they tell
+func clientIP(r *http.Request) string {
+	if client, ok := r.Context().Value(forwardedClientKey{}).(forwardedClient); ok {
+		return client.ip
+	}
+	return remoteIP(r.RemoteAddr)
+}
+
+// requestScheme returns the scheme the client used, behind trusted proxies the one they tell
+func requestScheme(r *http.Request) string {
+	if client, ok := r.Context().Value(forwardedClientKey{}).(forwardedClient); ok {
+		return client.scheme
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// setForwarded passes the client of the request on to another node
+func setForwarded(out *http.Request, in *http.Request) {
+	out.Header.Set(forwardedForHeader, clientIP(in))
+	out.Header.Set(forwardedProtoHeader, requestScheme(in))
+}
+
+// basePath returns server.base_path without a trailing slash, empty when the router is
+// served at the root
+func (srv *Server) basePath() string {
+	return strings.TrimSuffix(srv.Config.Server.BasePath, "/")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestResolveClient(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	require.NoError(t, err)
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	srv := &Server{trustedProxies: trusted}
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		ip      string
+		scheme  string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7", "http"},
+		{"spoofed by a client", "203.0.113.7:5000", map[string]string{
+			forwardedForHeader: "198.51.100.1", realIPHeader: "198.51.100.2", forwardedProtoHeader: "https",
+		}, "203.0.113.7", "http"},
+		{"trusted proxy", "10.0.0.5:5000", map[string]string{
+			forwardedForHeader: "198.51.100.1", forwardedProtoHeader: "HTTPS",
+		}, "198.51.100.1", "https"},
+		{"chain of proxies", "10.0.0.5:5000", map[string]string{
+			forwardedForHeader: "198.51.100.66, 198.51.100.1, 192.168.1.1",
+		}, "198.51.100.1", "http"},
+		{"only trusted hops", "[fd00::1]:5000", map[string]string{
+			forwardedForHeader: "10.1.1.1, 10.2.2.2",
+		}, "10.1.1.1", "http"},
+		{"real ip", "192.168.1.1:5000", map[string]string{
+			realIPHeader: "198.51.100.3", forwardedProtoHeader: "gopher",
+		}, "198.51.100.3", "http"},
+		{"garbage", "10.0.0.5:5000", map[string]string{
+			forwardedForHeader: "not an address",
+		}, "10.0.0.5", "http"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			req.RemoteAddr = tc.remote
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			var ip, scheme string
+			srv.resolveClient(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ip, scheme = clientIP(r), requestScheme(r)
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			require.Equal(t, tc.ip, ip)
+			require.Equal(t, tc.scheme, scheme)
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	auditPath := storage.TempFileName(".audit")
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+		_ = os.Remove(auditPath)
+	})
+	srv.Config.Server.BasePath = "/pirin/"
+	srv.Config.Audit = &AuditConfig{Sink: auditSinkFile, Path: auditPath}
+	auditor, err := NewAuditor(srv.Config.Audit, srv.Logger)
+	require.NoError(t, err)
+	srv.Auditor = auditor
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	do := func(method, path, body string) int {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(forwardedForHeader, "198.51.100.1")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/pirin/health", ""))
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/health", ""))
+	require.Equal(t, http.StatusNotFound, do(http.MethodGet, "/api/v1/kv/key", ""))
+	require.Equal(t, http.StatusCreated, do(http.MethodPost, "/pirin/api/v1/kv/key", "value"))
+	require.Equal(t, http.StatusOK, do(http.MethodGet, "/pirin/api/v1/kv/key", ""))
+	// admin routes are recognized below the base path
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/pirin/api/v1/admin/mode", `{"mode":"maintenance"}`))
+	require.Equal(t, http.StatusServiceUnavailable, do(http.MethodGet, "/pirin/api/v1/kv/key", ""))
+	require.Equal(t, http.StatusOK, do(http.MethodPost, "/pirin/api/v1/admin/mode", `{"mode":"read_write"}`))
+
+	// the test client is only believed once it is a trusted proxy
+	srv.trustedProxies, err = parseTrustedProxies([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, "/pirin/api/v1/kv/key", ""))
+
+	require.NoError(t, srv.Auditor.Close())
+	var clients []any
+	for _, rec := range readAuditFile(t, auditPath) {
+		clients = append(clients, rec["client"])
+	}
+	require.Equal(t, []any{"127.0.0.1", "127.0.0.1", "127.0.0.1", "198.51.100.1"}, clients)
+}
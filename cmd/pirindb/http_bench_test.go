@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"testing"
+
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+// benchServer serves a database without fsync, so the handler overhead is not hidden by the
+// disk. With main the main bucket is created as on startup.
+func benchServer(b *testing.B, main bool) http.Handler {
+	filename := storage.TempFileName(".db")
+	opts := storage.DefaultOptions().WithSyncMode(storage.SyncNever).WithUnsafeSync(true)
+	db, err := storage.Open(filename, opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = db.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	})
+	if main {
+		if err = ensureMainBucket(db); err != nil {
+			b.Fatal(err)
+		}
+	}
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	return NewServer(cfg, db, createLogger("ERROR")).buildRouter()
+}
+
+// BenchmarkHTTPPut measures a PUT through the router, go test -bench HTTP ./cmd/pirindb
+func BenchmarkHTTPPut(b *testing.B) {
+	router := benchServer(b, true)
+	value := bytes.Repeat([]byte("v"), 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/api/v1/kv/key-%d", i%10000), bytes.NewReader(value))
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusCreated {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func BenchmarkHTTPGet(b *testing.B) {
+	router := benchServer(b, true)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/kv/key", bytes.NewReader([]byte("value")))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/kv/key", nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+// heapWriter discards the response and samples the heap on every write, the buffered status
+// is written once with all of it in memory, the streamed one every few kilobytes
+type heapWriter struct {
+	header http.Header
+	sample []metrics.Sample
+	peak   uint64
+}
+
+func newHeapWriter() *heapWriter {
+	return &heapWriter{header: make(http.Header), sample: []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}}
+}
+
+func (w *heapWriter) heap() uint64 {
+	metrics.Read(w.sample)
+	return w.sample[0].Value.Uint64()
+}
+
+func (w *heapWriter) Header() http.Header { return w.header }
+func (w *heapWriter) WriteHeader(int)     {}
+
+func (w *heapWriter) Write(p []byte) (int, error) {
+	w.peak = max(w.peak, w.heap())
+	return len(p), nil
+}
+
+// BenchmarkStatus compares the streamed status with the status marshaled whole, peak-heap-B of
+// the streamed one is bounded by a batch of bucket stats while the buffered one grows with the
+// buckets, go test -bench Status -run None ./cmd/pirindb
+func BenchmarkStatus(b *testing.B) {
+	gc := debug.SetGCPercent(5) // keep garbage out of the sampled heap
+	defer debug.SetGCPercent(gc)
+	for _, buckets := range []int{100, 1000, 10000} {
+		filename := storage.TempFileName(".db")
+		db, err := storage.Open(filename, storage.DefaultOptions().WithSyncMode(storage.SyncNever).WithUnsafeSync(true))
+		if err != nil {
+			b.Fatal(err)
+		}
+		err = db.Update(func(tx *storage.Tx) error {
+			for i := 0; i < buckets; i++ {
+				if _, err := tx.CreateBucket([]byte(fmt.Sprintf("tenant-%06d", i))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/db/status", nil)
+		handlers := map[string]func(w http.ResponseWriter){
+			"streamed": func(w http.ResponseWriter) { _ = writeStatus(w, req, db) },
+			"buffered": func(w http.ResponseWriter) { render.JSON(w, req, Status(db, true)) },
+		}
+		for _, name := range []string{"streamed", "buffered"} {
+			b.Run(fmt.Sprintf("%s/buckets=%d", name, buckets), func(b *testing.B) {
+				b.ReportAllocs()
+				var peak uint64
+				for i := 0; i < b.N; i++ {
+					w := newHeapWriter()
+					runtime.GC()
+					base := w.heap()
+					handlers[name](w)
+					peak = max(peak, w.peak-min(base, w.peak))
+				}
+				b.ReportMetric(float64(peak), "peak-heap-B")
+			})
+		}
+		_ = db.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	}
+}
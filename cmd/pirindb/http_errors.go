@@ -1,13 +1,19 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"github.com/go-chi/render"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type ErrResponse struct {
 	HTTPStatusCode int    `json:"-"`
 	Status         string `json:"status"`
+	Code           string `json:"code,omitempty"` // machine readable error, set where status alone is ambiguous
+	Key            string `json:"key,omitempty"`  // redacted according to the log key mode
 }
 
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -15,6 +21,19 @@ func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// ErrLockResponse tells a client when the held lock expires, so it knows when to retry
+type ErrLockResponse struct {
+	ErrResponse
+	Expires time.Time `json:"expires"`
+}
+
+// ErrDetailResponse carries the storage error text, the exceeded quota and the usage against
+// it or the reason a validator refused a value
+type ErrDetailResponse struct {
+	ErrResponse
+	Detail string `json:"detail"`
+}
+
 func ErrInvalidRequest() render.Renderer {
 	return &ErrResponse{
 		HTTPStatusCode: http.StatusBadRequest,
@@ -22,10 +41,126 @@ func ErrInvalidRequest() render.Renderer {
 	}
 }
 
-func ErrNotFound() render.Renderer {
+func ErrNotFound(key string) render.Renderer {
 	return &ErrResponse{
 		HTTPStatusCode: http.StatusNotFound,
 		Status:         "Key not found",
+		Code:           "key_not_found",
+		Key:            key,
+	}
+}
+
+func ErrBucketNotFound() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Bucket not found",
+		Code:           "bucket_not_found",
+	}
+}
+
+func ErrBucketExists() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Bucket already exists",
+		Code:           "bucket_exists",
+	}
+}
+
+func ErrDatabaseNotFound() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Database not found",
+	}
+}
+
+func ErrUploadNotFoundResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Upload not found",
+	}
+}
+
+func ErrUploadOffsetResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Chunk offset does not match upload size",
+	}
+}
+
+func ErrUploadTooLargeResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusRequestEntityTooLarge,
+		Status:         "Upload too large",
+	}
+}
+
+func ErrValueTooLarge() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusRequestEntityTooLarge,
+		Status:         "Value too large",
+		Code:           "value_too_large",
+	}
+}
+
+// ErrValueTooLargeForJSON reports a value above server.max_json_value_size on the JSON GET
+// path, the detail points to the ways of reading it
+func ErrValueTooLargeForJSON(size, limit int64) render.Renderer {
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusRequestEntityTooLarge,
+			Status:         "Value too large",
+			Code:           "value_too_large",
+		},
+		Detail: fmt.Sprintf("value of %d bytes is above the JSON limit of %d bytes, read it with Accept: application/octet-stream (Range requests are supported) or preview it with ?max_bytes=", size, limit),
+	}
+}
+
+// ErrQuotaExceeded reports a write refused by a bucket quota or the database size limit,
+// the storage error text carries the limit and the usage
+func ErrQuotaExceeded(err error) render.Renderer {
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusInsufficientStorage,
+			Status:         "Quota exceeded",
+			Code:           "quota_exceeded",
+		},
+		Detail: err.Error(),
+	}
+}
+
+// ErrValueRejected reports a value refused by the validator of its bucket, the detail names
+// the violation
+func ErrValueRejected(err error) render.Renderer {
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusUnprocessableEntity,
+			Status:         "Value rejected",
+			Code:           "value_rejected",
+		},
+		Detail: err.Error(),
+	}
+}
+
+// ErrPrefixExpired reports a write under an expired prefix rule of the bucket, the key
+// would be hidden and purged, it can be written once the sweeper dropped the rule
+func ErrPrefixExpired() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Key is under an expired prefix",
+		Code:           "prefix_expired",
+	}
+}
+
+// ErrTransformFailed reports a value a strict transform of its bucket refused, the detail
+// names the transform and the reason
+func ErrTransformFailed(err error) render.Renderer {
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusUnprocessableEntity,
+			Status:         "Value rejected by transform",
+			Code:           "transform_failed",
+		},
+		Detail: err.Error(),
 	}
 }
 
@@ -36,9 +171,250 @@ func ErrRequestTimeout() render.Renderer {
 	}
 }
 
+// ErrStalledResponse tells a client to retry a write once the database keeps up again
+type ErrStalledResponse struct {
+	ErrResponse
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *ErrStalledResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Retry-After", strconv.Itoa(int(e.RetryAfter.Seconds())))
+	return e.ErrResponse.Render(w, r)
+}
+
+// ErrWriteStalled reports a write refused while commits are slow or the write queue is full,
+// reads are still served
+func ErrWriteStalled() render.Renderer {
+	return &ErrStalledResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusServiceUnavailable,
+			Status:         "Writes stalled",
+			Code:           "write_stalled",
+		},
+		RetryAfter: writeStallRetryAfter,
+	}
+}
+
+func ErrChecksumMismatch() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusUnprocessableEntity,
+		Status:         "Value does not match the checksum",
+		Code:           "checksum_mismatch",
+	}
+}
+
+// ErrRangeNotSatisfiable refuses a Range starting past the end of the value
+func ErrRangeNotSatisfiable() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusRequestedRangeNotSatisfiable,
+		Status:         "Range not satisfiable",
+		Code:           "range_not_satisfiable",
+	}
+}
+
+// ErrValueCorrupted reports a stored value that does not match its stored checksum
+func ErrValueCorrupted() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusInternalServerError,
+		Status:         "Stored value is corrupted",
+		Code:           "value_corrupted",
+	}
+}
+
+// ErrModeResponse refuses a request the node mode does not serve, the code is the mode
+func ErrModeResponse(mode NodeMode) render.Renderer {
+	status := "Node is read only"
+	if mode == ModeMaintenance {
+		status = "Node is in maintenance"
+	}
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		Status:         status,
+		Code:           string(mode),
+	}
+}
+
+func ErrUnauthorized() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusUnauthorized,
+		Status:         "Unauthorized",
+		Code:           "unauthorized",
+	}
+}
+
+func ErrTooManyReaders() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusServiceUnavailable,
+		Status:         "Too many open read transactions",
+		Code:           "too_many_readers",
+	}
+}
+
+// ErrLockHeldResponse reports the current lease, its token is not usable by the caller
+func ErrLockHeldResponse(lease *Lease) render.Renderer {
+	return &ErrLockResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusConflict,
+			Status:         "Lock is held",
+			Code:           "lock_held",
+		},
+		Expires: lease.Expires,
+	}
+}
+
+func ErrLockNotHeldResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Lock is not held",
+		Code:           "lock_not_held",
+	}
+}
+
+func ErrLockMismatchResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Lock is held with another token",
+		Code:           "lock_token_mismatch",
+	}
+}
+
+func ErrBackupDisabledResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Backups are not configured",
+		Code:           "backups_disabled",
+	}
+}
+
+func ErrBackupRunningResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "A snapshot is already running",
+		Code:           "backup_running",
+	}
+}
+
+func ErrUsageRunningResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Usage is already being computed",
+		Code:           "usage_running",
+	}
+}
+
+// ErrSnapshotFailed reports the databases a triggered snapshot failed for, with 507 when the
+// disk lacks the headroom
+func ErrSnapshotFailed(err error) render.Renderer {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrBackupNoHeadroom) {
+		status = http.StatusInsufficientStorage
+	}
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: status,
+			Status:         "Snapshot failed",
+			Code:           "snapshot_failed",
+		},
+		Detail: err.Error(),
+	}
+}
+
+func ErrSessionsDisabled() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusForbidden,
+		Status:         "Sessions are disabled",
+		Code:           "sessions_disabled",
+	}
+}
+
+func ErrSessionsInCluster() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Sessions are not available in a cluster",
+		Code:           "sessions_unavailable",
+	}
+}
+
+func ErrMultiKeyInCluster() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "Multi-key requests are not available in a cluster",
+		Code:           "multi_key_unavailable",
+	}
+}
+
+func ErrSessionActiveResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "A session is already open in the database",
+		Code:           "session_active",
+	}
+}
+
+func ErrSessionNotFoundResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Session not found",
+		Code:           "session_not_found",
+	}
+}
+
+// ErrSessionAbortedResponse reports the failed write or commit that rolled a session back,
+// keys in storage errors are already redacted by the log key mode
+func ErrSessionAbortedResponse(err error) render.Renderer {
+	return &ErrDetailResponse{
+		ErrResponse: ErrResponse{
+			HTTPStatusCode: http.StatusConflict,
+			Status:         "Session aborted",
+			Code:           "session_aborted",
+		},
+		Detail: err.Error(),
+	}
+}
+
+func ErrLoadRunningResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "A load with this job id is already running",
+		Code:           "load_running",
+	}
+}
+
+func ErrLoadNotFoundResponse() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusNotFound,
+		Status:         "Load job not found",
+		Code:           "load_not_found",
+	}
+}
+
+func ErrClusterDisabled() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusConflict,
+		Status:         "The node is not a member of a cluster",
+		Code:           "cluster_disabled",
+	}
+}
+
 func ErrInternalServerError() render.Renderer {
 	return &ErrResponse{
 		HTTPStatusCode: http.StatusInternalServerError,
 		Status:         "Internal Server Error",
 	}
 }
+
+func ErrBadGateway() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusBadGateway,
+		Status:         "Owner shard unavailable",
+		Code:           "shard_unavailable",
+	}
+}
+
+func ErrPeerUnavailable() render.Renderer {
+	return &ErrResponse{
+		HTTPStatusCode: http.StatusBadGateway,
+		Status:         "Peer node unavailable",
+		Code:           "peer_unavailable",
+	}
+}
@@ -1,48 +1,353 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type GetResponse struct {
-	Value  string `json:"value"`
-	Status string `json:"status"`
+	Value    string `json:"value"`
+	Checksum string `json:"checksum,omitempty"` // stored with the value when server.value_checksums is on
+	// a preview asked for with max_bytes holds the start of the value only, Size is the whole
+	Truncated bool   `json:"truncated,omitempty"`
+	Size      int64  `json:"size,omitempty"`
+	Status    string `json:"status"`
 }
 
 type PutResponse struct {
+	Key        string   `json:"key"`
+	Status     string   `json:"status"`
+	Transforms []string `json:"transforms,omitempty"` // the transforms of the bucket that ran on the value
+}
+
+type AppendResponse struct {
 	Key    string `json:"key"`
+	Size   int    `json:"size"` // value size after the append
 	Status string `json:"status"`
 }
 
+// GeneratedKeyResponse returns the key made for a bucket append as hex, in the byte order
+type GeneratedKeyResponse struct {
+	Bucket     string    `json:"bucket"`
+	Key        string    `json:"key"`
+	Time       time.Time `json:"time"` // the clock time in the key
+	Status     string    `json:"status"`
+	Transforms []string  `json:"transforms,omitempty"`
+}
+
 type DeleteResponse struct {
-	Key    string `json:"key"`
+	Key     string `json:"key"`
+	Status  string `json:"status"`
+	Existed bool   `json:"existed"`
+}
+
+// DeletePrefixResponse reports keys deleted by a prefix delete, or counted by a dry run
+type DeletePrefixResponse struct {
+	Prefix string         `json:"prefix"`
+	Count  int            `json:"count"`
+	DryRun bool           `json:"dry_run"`
+	Sample []string       `json:"sample,omitempty"` // first keys that would be deleted, dry run only
+	Shards map[string]int `json:"shards,omitempty"` // count per shard when fanned out to a cluster
+}
+
+type UploadResponse struct {
+	UploadID string `json:"upload_id"`
+	Key      string `json:"key,omitempty"`
+	Size     int    `json:"size"`
+}
+
+// ExpireRequest expires keys under Prefix after TTLSeconds, zero TTL removes the rule
+type ExpireRequest struct {
+	Prefix     string `json:"prefix"`
+	TTLSeconds int64  `json:"ttl_seconds"`
+}
+
+type ExpireResponse struct {
+	Bucket   string     `json:"bucket"`
+	Prefix   string     `json:"prefix"`
+	ExpireAt *time.Time `json:"expire_at,omitempty"`
+	Status   string     `json:"status"`
+}
+
+type BucketQuotaRequest struct {
+	MaxKeys  uint64 `json:"max_keys"`  // 0 is unlimited
+	MaxBytes uint64 `json:"max_bytes"` // 0 is unlimited
+}
+
+type BucketQuotaResponse struct {
+	Bucket   string `json:"bucket"`
+	MaxKeys  uint64 `json:"max_keys"`
+	MaxBytes uint64 `json:"max_bytes"`
+	Status   string `json:"status"`
+}
+
+// BucketRetentionRequest deletes keys older than RetainFor, like "720h" or "30d", the keys
+// start with a time as Keys tells: "generated" (default) or "time". "0" removes the retention.
+type BucketRetentionRequest struct {
+	RetainFor string `json:"retain_for"`
+	Keys      string `json:"keys"`
+}
+
+type BucketRetentionResponse struct {
+	Bucket           string `json:"bucket"`
+	RetainForSeconds int64  `json:"retain_for_seconds"`
+	Keys             string `json:"keys"`
+	Status           string `json:"status"`
+}
+
+type RetentionSweepEntry struct {
+	Bucket     string    `json:"bucket"`
+	At         time.Time `json:"at"`
+	Removed    int       `json:"removed"`
+	DurationMS int64     `json:"duration_ms"`
+	Complete   bool      `json:"complete"`
+}
+
+type RetentionSweepResponse struct {
+	Buckets []RetentionSweepEntry `json:"buckets"`
+	Status  string                `json:"status"`
+}
+
+// CompactBlobsRequest rewrites fragmented blob chains of Bucket, MaxBytes bounds one call
+type CompactBlobsRequest struct {
+	Bucket   string `json:"bucket"`
+	MaxBytes int64  `json:"max_bytes"` // 0 is unlimited
+}
+
+type CompactBlobsResponse struct {
+	Bucket          string `json:"bucket"`
+	ChainsScanned   int    `json:"chains_scanned"`
+	ChainsRewritten int    `json:"chains_rewritten"`
+	PagesFreed      int    `json:"pages_freed"`
+	BytesMoved      int64  `json:"bytes_moved"`
+	Complete        bool   `json:"complete"`
+	Status          string `json:"status"`
+}
+
+type BackupResponse struct {
+	Running   bool                    `json:"running"`
+	Databases map[string]BackupStatus `json:"databases"`
+}
+
+// UsageJobResponse is returned while a usage computation runs, poll again after Retry-After
+type UsageJobResponse struct {
+	Delimiter string `json:"delimiter"`
+	Running   bool   `json:"running"`
+}
+
+type LockResponse struct {
+	Name    string    `json:"name"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Status  string    `json:"status"`
+}
+
+type BucketListEntry struct {
+	Name  string              `json:"name"`
+	Stats *storage.BucketStat `json:"stats,omitempty"`
+}
+
+type BucketListResponse struct {
+	Buckets []BucketListEntry `json:"buckets"`
+	Next    string            `json:"next,omitempty"`  // pass as start_after to get the following page
+	Trash   []TrashEntry      `json:"trash,omitempty"` // with include_trash, on the first page
+}
+
+type BucketDeleteResponse struct {
+	Bucket  string   `json:"bucket"`
+	Deleted []string `json:"deleted"` // the windows of a partitioned bucket, the bucket otherwise
+	Soft    bool     `json:"soft"`    // moved to the trash, see /admin/trash
+	Status  string   `json:"status"`
+}
+
+type TrashEntry struct {
+	Name      string              `json:"name"`
+	DeletedAt time.Time           `json:"deleted_at"`
+	Stats     *storage.BucketStat `json:"stats"`
+}
+
+type BucketRestoreResponse struct {
+	Bucket string `json:"bucket"`
 	Status string `json:"status"`
 }
 
+type BucketEventsResponse struct {
+	Bucket string                `json:"bucket"`
+	Events []storage.BucketEvent `json:"events"` // the newest first
+}
+
+type TrashListResponse struct {
+	Trash            []TrashEntry `json:"trash"`
+	RetentionSeconds int64        `json:"retention_seconds,omitempty"` // 0 keeps them until purged
+}
+
+type TrashPurgeResponse struct {
+	Purged []TrashEntry `json:"purged"`
+	Status string       `json:"status"`
+}
+
+type KeyListResponse struct {
+	Keys           []string `json:"keys"`
+	Sizes          []int    `json:"sizes,omitempty"` // value size of every key, with include_sizes
+	CommonPrefixes []string `json:"common_prefixes,omitempty"`
+	Next           string   `json:"next,omitempty"` // pass as start_after to get the following page
+	// pass as token to get the following page, the format of Bucket.ScanFrom tokens
+	NextToken string `json:"next_token,omitempty"`
+}
+
+// SampleResponse estimates the keys under a prefix from a random sample of them
+type SampleResponse struct {
+	Prefix         string               `json:"prefix"`
+	Total          uint64               `json:"total"`           // keys under the prefix, from the subtree counts
+	AvgValueSize   float64              `json:"avg_value_size"`  // mean value size of the sample
+	EstimatedBytes uint64               `json:"estimated_bytes"` // value bytes under the prefix, total times the mean
+	Keys           []SampledKeyResponse `json:"keys"`
+}
+
+type SampledKeyResponse struct {
+	Key  string `json:"key"`
+	Size int    `json:"size"`
+}
+
+// PrefixStatsResponse ranks the first-level key prefixes of a bucket
+type PrefixStatsResponse struct {
+	Delimiter string               `json:"delimiter"`
+	ByCount   []PrefixStatResponse `json:"by_count"`
+	ByBytes   []PrefixStatResponse `json:"by_bytes,omitempty"` // empty with bytes=false
+	Prefixes  int                  `json:"prefixes"`           // prefixes seen by the scan
+	Keys      uint64               `json:"keys"`               // keys under the prefixes seen
+	Visited   int                  `json:"visited"`            // keys read by the scan
+	Exact     bool                 `json:"exact"`              // false when the key or time budget stopped the scan
+}
+
+type PrefixStatResponse struct {
+	Prefix string `json:"prefix"`
+	Count  uint64 `json:"count"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+type AuditStatsResponse struct {
+	Sink    string `json:"sink"`
+	Queued  int    `json:"queued"`
+	Written uint64 `json:"written"`
+	Dropped uint64 `json:"dropped"` // the buffer was full
+	Failed  uint64 `json:"failed"`  // the sink failed after retries
+}
+
 type HealthResponse struct {
-	Status string `json:"status"`
+	Status       string                  `json:"status"`
+	Mode         NodeMode                `json:"mode,omitempty"`
+	WriteStalled []string                `json:"write_stalled,omitempty"` // databases refusing writes, reads are served
+	Canary       map[string]CanaryResult `json:"canary,omitempty"`
+	Error        string                  `json:"error,omitempty"`    // the storage error of a failed canary
+	Warnings     []HealthWarning         `json:"warnings,omitempty"` // soft limits, the node stays ready
+}
+
+// HealthWarning is a soft limit a database is above
+type HealthWarning struct {
+	DB      string `json:"db"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+type VersionResponse struct {
+	Version            string   `json:"version"`
+	GitCommit          string   `json:"git_commit"`
+	StorageFormatMajor int      `json:"storage_format_major"`
+	StorageFormatMinor int      `json:"storage_format_minor"`
+	Features           []string `json:"features"`
+	Sharding           bool     `json:"sharding"` // the node is a member of a cluster, see /cluster/ring
+}
+
+// txLabel names write transactions after the request, so a stuck writer is visible in status
+func txLabel(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
 }
 
 func (srv *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, HealthResponse{Status: "ok"})
 }
 
+func (srv *Server) handleAuditStats(w http.ResponseWriter, r *http.Request) {
+	if srv.Auditor == nil {
+		render.JSON(w, r, AuditStatsResponse{}) // an empty sink, audit is off
+		return
+	}
+	render.JSON(w, r, srv.Auditor.Stats())
+}
+
+func (srv *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	major, minor := srv.DBs.Primary().FormatVersion()
+	render.JSON(w, r, &VersionResponse{
+		Version:            version,
+		GitCommit:          gitCommit,
+		StorageFormatMajor: int(major),
+		StorageFormatMinor: int(minor),
+		Features:           serverFeatures,
+		Sharding:           srv.clusterEnabled(),
+	})
+}
+
 func (srv *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 	select {
 	case <-r.Context().Done():
 		_ = render.Render(w, r, ErrRequestTimeout())
 		return
 	default:
+		db, ok := srv.requestDB(r)
+		if !ok {
+			_ = render.Render(w, r, ErrDatabaseNotFound())
+			return
+		}
 		key := chi.URLParam(r, "key")
-		value, isFound := Get(srv.DB, key)
+		// the value bytes and the JSON document share the ETag
+		w.Header().Add("Vary", "Accept")
+		if wantsRawValue(r) {
+			srv.handleGetRaw(w, r, db, key)
+			return
+		}
+		if srv.handleGetPreview(w, r, db, key) {
+			return
+		}
+		value, checksum, isFound, err := srv.cachedLookup(w, r, db, key)
+		if errors.Is(err, storage.ErrTooManyReaders) {
+			_ = render.Render(w, r, ErrTooManyReaders())
+			return
+		}
+		if errors.Is(err, storage.ErrChecksumMismatch) {
+			srv.Logger.Error("stored value does not match its checksum", "key", srv.redactKey(key), "error", err)
+			_ = render.Render(w, r, ErrValueCorrupted())
+			return
+		}
+		if err != nil {
+			_ = render.Render(w, r, ErrInternalServerError())
+			return
+		}
+		if !isFound && srv.clusterEnabled() && db == srv.DBs.Primary() {
+			// during a ring change the key may not have moved here yet
+			value, isFound = srv.repairRead(r, key)
+		}
 		if isFound != true {
-			_ = render.Render(w, r, ErrNotFound())
+			_ = render.Render(w, r, ErrNotFound(srv.redactKey(key)))
 			return
 		}
-		render.JSON(w, r, &GetResponse{Value: value, Status: "ok"})
+		if checksum != "" {
+			w.Header().Set("ETag", `"`+checksum+`"`)
+			w.Header().Set(checksumHeader, checksum)
+		}
+		render.JSON(w, r, &GetResponse{Value: value, Checksum: checksum, Status: "ok"})
 	}
 }
 
@@ -52,15 +357,139 @@ func (srv *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		_ = render.Render(w, r, ErrRequestTimeout())
 		return
 	default:
+		db, ok := srv.requestDB(r)
+		if !ok {
+			_ = render.Render(w, r, ErrDatabaseNotFound())
+			return
+		}
 		key := chi.URLParam(r, "key")
-		deleted := Delete(srv.DB, key)
-		if !deleted {
-			_ = render.Render(w, r, ErrNotFound())
+		existed, err := Delete(db, key, srv.writeOptions(r))
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			_ = render.Render(w, r, ErrBucketNotFound())
+			return
+		}
+		if errors.Is(err, storage.ErrWriteStalled) {
+			_ = render.Render(w, r, ErrWriteStalled())
+			return
+		}
+		if err != nil {
+			_ = render.Render(w, r, ErrInternalServerError())
+			return
+		}
+		// delete is idempotent, a missing key is reported in the body, not by the status
+		render.JSON(w, r, &DeleteResponse{Key: key, Status: "ok", Existed: existed})
+	}
+}
+
+// handleDeletePrefix deletes every key under the prefix query parameter, with dry_run=true
+// it only counts them. In a cluster the request is fanned out to every shard.
+func (srv *Server) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	dryRun := false
+	if value := query.Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	if prefix == "" {
+		// deleting the whole database by accident must not be one request away
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	if !dryRun && db == srv.DBs.Primary() {
+		srv.readRepair.deletedPrefix(prefix)
+	}
+	count, sample, err := DeletePrefix(db, prefix, dryRun, srv.writeOptions(r))
+	if errors.Is(err, storage.ErrTooManyReaders) {
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	}
+	if errors.Is(err, storage.ErrWriteStalled) {
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &DeletePrefixResponse{Prefix: prefix, Count: count, DryRun: dryRun, Sample: sample}
+	if srv.clusterEnabled() && r.Header.Get(forwardedByHeader) == "" {
+		if err = srv.fanOutDeletePrefix(r, resp); err != nil {
+			srv.Logger.Error("failed to fan out prefix delete", "error", err)
+			_ = render.Render(w, r, ErrBadGateway())
 			return
 		}
-		render.Status(r, http.StatusNoContent)
-		render.JSON(w, r, &DeleteResponse{Key: key, Status: "ok"})
 	}
+	render.JSON(w, r, resp)
+}
+
+// handlePost serves POST /kv/{key} and POST /kv/{key}:append. The route pattern
+// "{key}:append" would end the key at its first colon, so the suffix is split here and
+// the key parameter is trimmed before the request is routed to the owner shard.
+func (srv *Server) handlePost(w http.ResponseWriter, r *http.Request) {
+	rctx := chi.RouteContext(r.Context())
+	for i, name := range rctx.URLParams.Keys {
+		if key, ok := strings.CutSuffix(rctx.URLParams.Values[i], appendSuffix); ok && name == "key" {
+			rctx.URLParams.Values[i] = key
+			srv.routeKey(srv.audit("append")(http.HandlerFunc(srv.handleAppend))).ServeHTTP(w, r)
+			return
+		}
+	}
+	srv.routeKey(srv.audit("put")(http.HandlerFunc(srv.handlePut))).ServeHTTP(w, r)
+}
+
+// handleAppend adds the request body to the end of the value, the result is limited
+// by the server value size limit
+func (srv *Server) handleAppend(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	key := chi.URLParam(r, "key")
+	defer func() {
+		_ = r.Body.Close()
+	}()
+	data, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	size, err := Append(db, key, data, srv.maxValueSize(), srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrValueTooLarge) || errors.Is(err, storage.ErrBlobTooLarge):
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		_ = render.Render(w, r, ErrQuotaExceeded(err))
+		return
+	case errors.Is(err, storage.ErrValueRejected):
+		_ = render.Render(w, r, ErrValueRejected(err))
+		return
+	case errors.Is(err, storage.ErrPrefixExpired):
+		_ = render.Render(w, r, ErrPrefixExpired())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &AppendResponse{Key: key, Size: size, Status: "ok"})
 }
 
 func (srv *Server) handlePut(w http.ResponseWriter, r *http.Request) {
@@ -71,28 +500,883 @@ func (srv *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 	default:
 	}
 
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
 	key := chi.URLParam(r, "key")
-	body, err := io.ReadAll(r.Body)
+	defer func() {
+		_ = r.Body.Close()
+	}()
+
+	var expected *uint64
+	if value := r.Header.Get(checksumHeader); value != "" {
+		sum, err := strconv.ParseUint(value, 16, 64)
+		if err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		expected = &sum
+	}
+	var err error
+	var applied []string
+	if chain := srv.transformChain(r, string(DBBucket)); chain != nil {
+		applied, err = putTransformed(db, key, r.Body, chain, expected, srv.writeOptions(r))
+	} else if r.ContentLength >= 0 {
+		// the size is known, a large value streams from the connection into blob pages
+		err = PutReader(db, key, r.Body, int(r.ContentLength), expected, srv.writeOptions(r))
+	} else {
+		var body []byte
+		if body, err = io.ReadAll(r.Body); err == nil {
+			err = PutReader(db, key, bytes.NewReader(body), len(body), expected, srv.writeOptions(r))
+		}
+	}
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, storage.ErrChecksumMismatch):
+		_ = render.Render(w, r, ErrChecksumMismatch())
+		return
+	case errors.As(err, &maxBytesErr) || errors.Is(err, storage.ErrValueTooLarge) || errors.Is(err, storage.ErrBlobTooLarge):
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		_ = render.Render(w, r, ErrQuotaExceeded(err))
+		return
+	case errors.Is(err, storage.ErrValueRejected):
+		_ = render.Render(w, r, ErrValueRejected(err))
+		return
+	case errors.Is(err, storage.ErrPrefixExpired):
+		_ = render.Render(w, r, ErrPrefixExpired())
+		return
+	case errors.Is(err, errTransformRejected):
+		_ = render.Render(w, r, ErrTransformFailed(err))
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		// the body was shorter than its Content-Length
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &PutResponse{Key: key, Status: "ok", Transforms: applied})
+}
+
+func (srv *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	withBuckets := true
+	if value := r.URL.Query().Get("buckets"); value != "" {
+		var err error
+		if withBuckets, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	if !withBuckets {
+		render.JSON(w, r, Status(db, false))
+		return
+	}
+	if err := writeStatus(w, r, db); err != nil {
+		srv.Logger.Error("status failed", "error", err)
+	}
+}
+
+// handleListBuckets pages through buckets by name, stats are included with with_stats=true
+func (srv *Server) handleListBuckets(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultBucketListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		limit = min(limit, maxBucketListLimit) // a larger page is cut, not refused
+	}
+	withStats := false
+	if value := query.Get("with_stats"); value != "" {
+		var err error
+		if withStats, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	includeTrash := false
+	if value := query.Get("include_trash"); value != "" {
+		var err error
+		if includeTrash, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	stats, next, err := srv.listBuckets(db, query.Get("start_after"), limit)
+	if errors.Is(err, storage.ErrTooManyReaders) {
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &BucketListResponse{Buckets: make([]BucketListEntry, 0, len(stats)), Next: next}
+	for i := range stats {
+		entry := BucketListEntry{Name: stats[i].Name}
+		if withStats {
+			entry.Stats = &stats[i].BucketStat
+		}
+		resp.Buckets = append(resp.Buckets, entry)
+	}
+	if includeTrash && query.Get("start_after") == "" {
+		trash, err := ListTrash(db)
+		if err != nil {
+			_ = render.Render(w, r, ErrInternalServerError())
+			return
+		}
+		resp.Trash = trashEntries(trash)
+	}
+	render.JSON(w, r, resp)
+}
+
+// handleListKeys lists keys of this node under prefix, with delimiter the keys below the next
+// level are returned once as a common prefix. include_sizes adds the stored value sizes.
+func (srv *Server) handleListKeys(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultKeyListLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		limit = min(limit, maxKeyListLimit)
+	}
+	startAfter := query.Get("start_after")
+	if query.Has("token") {
+		last, err := storage.DecodeScanToken([]byte(query.Get("token")))
+		if err != nil || startAfter != "" {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		startAfter = string(last)
+	}
+	var offset uint64
+	if value := query.Get("offset"); value != "" {
+		var err error
+		// an offset counts keys, it does not combine with grouping or a continuation
+		if offset, err = strconv.ParseUint(value, 10, 64); err != nil || startAfter != "" || query.Get("delimiter") != "" {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	withSizes := false
+	if value := query.Get("include_sizes"); value != "" {
+		var err error
+		if withSizes, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	list, err := ListKeys(db, query.Get("prefix"), query.Get("delimiter"), startAfter, offset, limit, withSizes)
+	if errors.Is(err, storage.ErrTooManyReaders) {
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	if err = writeKeyList(w, list); err != nil {
+		srv.Logger.Error("key listing failed", "error", err)
+	}
+}
+
+func (srv *Server) handleSample(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	query := r.URL.Query()
+	n := defaultSampleSize
+	if value := query.Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n <= 0 || n > maxSampleSize {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	prefix := query.Get("prefix")
+	sample, total, err := SampleKeys(db, chi.URLParam(r, "bucket"), prefix, n)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &SampleResponse{Prefix: prefix, Total: total, Keys: make([]SampledKeyResponse, 0, len(sample))}
+	sampledBytes := 0
+	for _, info := range sample {
+		resp.Keys = append(resp.Keys, SampledKeyResponse{Key: string(info.Key), Size: info.Size})
+		sampledBytes += info.Size
+	}
+	if len(sample) > 0 {
+		resp.AvgValueSize = float64(sampledBytes) / float64(len(sample))
+		resp.EstimatedBytes = uint64(resp.AvgValueSize * float64(total))
+	}
+	render.JSON(w, r, resp)
+}
+
+// handleBucketEvents returns the newest lifecycle events of the bucket, of a deleted one too
+func (srv *Server) handleBucketEvents(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	limit := defaultEventsLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxEventsLimit {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	bucket := chi.URLParam(r, "bucket")
+	events, err := BucketEvents(db, bucket, limit)
+	switch {
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	if events == nil {
+		events = []storage.BucketEvent{}
+	}
+	render.JSON(w, r, &BucketEventsResponse{Bucket: bucket, Events: events})
+}
+
+// handlePrefixStats ranks the prefixes of a bucket up to the delimiter by count and bytes,
+// bytes=false counts them only, which skips every prefix with one seek
+func (srv *Server) handlePrefixStats(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	query := r.URL.Query()
+	opts := storage.PrefixStatsOptions{
+		Delimiter: []byte(query.Get("delimiter")),
+		Top:       defaultPrefixStatsTop,
+		MaxKeys:   defaultPrefixStatsMaxKeys,
+		Deadline:  time.Now().Add(prefixStatsTimeout),
+	}
+	if deadline, ok := r.Context().Deadline(); ok && deadline.Before(opts.Deadline) {
+		opts.Deadline = deadline
+	}
+	var err error
+	if value := query.Get("top"); value != "" {
+		if opts.Top, err = strconv.Atoi(value); err != nil || opts.Top <= 0 || opts.Top > maxPrefixStatsTop {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	if value := query.Get("max_keys"); value != "" {
+		opts.MaxKeys, err = strconv.Atoi(value)
+		if err != nil || opts.MaxKeys <= 0 || opts.MaxKeys > defaultPrefixStatsMaxKeys {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	if value := query.Get("bytes"); value != "" {
+		withBytes, err := strconv.ParseBool(value)
+		if err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		opts.CountsOnly = !withBytes
+	}
+	if len(opts.Delimiter) == 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	stats, err := PrefixStats(db, chi.URLParam(r, "bucket"), opts)
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &PrefixStatsResponse{
+		Delimiter: string(opts.Delimiter),
+		ByCount:   prefixStatsResponse(stats.ByCount),
+		ByBytes:   prefixStatsResponse(stats.ByBytes),
+		Prefixes:  stats.Prefixes,
+		Keys:      stats.Keys,
+		Visited:   stats.Visited,
+		Exact:     stats.Exact,
+	}
+	render.JSON(w, r, resp)
+}
+
+func prefixStatsResponse(stats []storage.PrefixStat) []PrefixStatResponse {
+	resp := make([]PrefixStatResponse, 0, len(stats))
+	for _, stat := range stats {
+		resp = append(resp, PrefixStatResponse{Prefix: string(stat.Prefix), Count: stat.Count, Bytes: stat.Bytes})
+	}
+	return resp
+}
+
+func (srv *Server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	stats, err := Analyze(db, bucket)
+	if errors.Is(err, storage.ErrBucketNotFound) {
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	}
 	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, stats)
+}
+
+func (srv *Server) handleExpire(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var req ExpireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLSeconds < 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	var expireAt time.Time
+	if req.TTLSeconds > 0 {
+		expireAt = time.Now().Add(time.Duration(req.TTLSeconds) * time.Second)
+	}
+	err := ExpirePrefix(db, bucket, req.Prefix, expireAt, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrPrefixTooLarge), errors.Is(err, storage.ErrTooManyPrefixRules):
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &ExpireResponse{Bucket: bucket, Prefix: req.Prefix, Status: "ok"}
+	if !expireAt.IsZero() {
+		resp.ExpireAt = &expireAt
+	}
+	render.JSON(w, r, resp)
+}
+
+// handleBucketAppend stores the request body under a new time ordered key of the bucket
+func (srv *Server) handleBucketAppend(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	if isInternalBucket(bucket) {
 		_ = render.Render(w, r, ErrInvalidRequest())
 		return
 	}
 	defer func() {
 		_ = r.Body.Close()
 	}()
+	data, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	var applied []string
+	if chain := srv.transformChain(r, bucket); chain != nil {
+		if data, applied, err = chain.apply(data); err != nil {
+			_ = render.Render(w, r, ErrTransformFailed(err))
+			return
+		}
+	}
+	key, err := PutGenerated(db, srv.writeBucket(bucket), srv.keyGenerator(), data, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrValueTooLarge) || errors.Is(err, storage.ErrBlobTooLarge):
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		_ = render.Render(w, r, ErrQuotaExceeded(err))
+		return
+	case errors.Is(err, storage.ErrValueRejected):
+		_ = render.Render(w, r, ErrValueRejected(err))
+		return
+	case errors.Is(err, storage.ErrPrefixExpired):
+		_ = render.Render(w, r, ErrPrefixExpired())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	parsed, _ := keys.ParseGeneratedKey(key)
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &GeneratedKeyResponse{
+		Bucket:     bucket,
+		Key:        hex.EncodeToString(key),
+		Time:       keys.ClockTime(parsed.Timestamp),
+		Status:     "ok",
+		Transforms: applied,
+	})
+}
 
-	value := string(body)
-	err = Put(srv.DB, key, value)
+// handleSetQuota replaces the quota of the bucket, zero limits remove it
+func (srv *Server) handleSetQuota(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var req BucketQuotaRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	quota := storage.BucketQuota{MaxKeys: req.MaxKeys, MaxBytes: req.MaxBytes}
+	err := SetBucketQuota(db, bucket, quota, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrReservedBucketName):
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &BucketQuotaResponse{Bucket: bucket, MaxKeys: req.MaxKeys, MaxBytes: req.MaxBytes, Status: "ok"})
+}
+
+// retentionKeys maps the keys field of a retention request to the key format
+var retentionKeys = map[string]storage.RetentionKeys{
+	"":          storage.RetainGeneratedKeys,
+	"generated": storage.RetainGeneratedKeys,
+	"time":      storage.RetainTimeKeys,
+}
+
+// parseRetention reads a retention like "30d" or "720h", Go durations with a days suffix
+func parseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err
+	}
+	return time.ParseDuration(value)
+}
+
+// handleSetRetention replaces the retention of the bucket, the sweeper deletes expired keys
+func (srv *Server) handleSetRetention(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var req BucketRetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	retainFor, err := parseRetention(req.RetainFor)
+	format, known := retentionKeys[req.Keys]
+	if err != nil || retainFor < 0 || !known {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	err = SetBucketRetention(db, bucket, retainFor, format, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrBadBucketOptions):
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	keyFormat := req.Keys
+	if keyFormat == "" {
+		keyFormat = "generated"
+	}
+	render.JSON(w, r, &BucketRetentionResponse{Bucket: bucket, RetainForSeconds: int64(retainFor / time.Second), Keys: keyFormat, Status: "ok"})
+}
+
+// handleRetentionSweep runs a retention sweep of the database now, like the sweeper does
+func (srv *Server) handleRetentionSweep(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	sweeps, err := db.SweepRetention(time.Now(), retentionSweepChunk, purgeExpiredLimit)
+	switch {
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to sweep retention", "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	resp := &RetentionSweepResponse{Buckets: make([]RetentionSweepEntry, 0, len(sweeps)), Status: "ok"}
+	for name, sweep := range sweeps {
+		resp.Buckets = append(resp.Buckets, RetentionSweepEntry{
+			Bucket:     name,
+			At:         sweep.At,
+			Removed:    sweep.Removed,
+			DurationMS: sweep.Duration.Milliseconds(),
+			Complete:   sweep.Complete,
+		})
+	}
+	slices.SortFunc(resp.Buckets, func(a, b RetentionSweepEntry) int { return strings.Compare(a.Bucket, b.Bucket) })
+	render.JSON(w, r, resp)
+}
+
+// handleCompactBlobs runs one bounded compaction pass over the blobs of a bucket, callers
+// repeat it until complete is true
+func (srv *Server) handleCompactBlobs(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var req CompactBlobsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Bucket == "" || req.MaxBytes < 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	report, err := CompactBlobs(db, req.Bucket, req.MaxBytes, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to compact blobs", "bucket", req.Bucket, "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &CompactBlobsResponse{
+		Bucket:          req.Bucket,
+		ChainsScanned:   report.ChainsScanned,
+		ChainsRewritten: report.ChainsRewritten,
+		PagesFreed:      report.PagesFreed,
+		BytesMoved:      report.BytesMoved,
+		Complete:        report.Complete,
+		Status:          "ok",
+	})
+}
+
+// usageDB resolves the database and the delimiter of a usage request, the name is the one
+// the registry knows it by
+func (srv *Server) usageDB(w http.ResponseWriter, r *http.Request) (string, *storage.DB, string, bool) {
+	name := chi.URLParam(r, "db")
+	if name == "" {
+		name = srv.DBs.PrimaryName()
+	}
+	db, ok := srv.DBs.Get(name)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return "", nil, "", false
+	}
+	delimiter := r.URL.Query().Get("delimiter")
+	if delimiter == "" {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return "", nil, "", false
+	}
+	return name, db, delimiter, true
+}
+
+// handleUsage serves the cached usage report of the delimiter, a missing or expired report
+// starts a computation in background and is answered with 202 until it is cached. A read only
+// database has no cache, its usage is computed in the request.
+func (srv *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	name, db, delimiter, ok := srv.usageDB(w, r)
+	if !ok {
+		return
+	}
+	if db.ReadOnly() {
+		report, err := ComputeUsage(db, delimiter, time.Now(), 0)
+		if err != nil {
+			_ = render.Render(w, r, ErrInternalServerError())
+			return
+		}
+		if err = writeUsage(w, report); err != nil {
+			srv.Logger.Error("usage failed", "db", name, "error", err)
+		}
+		return
+	}
+	report, err := cachedUsage(db, delimiter, time.Now())
 	if err != nil {
 		_ = render.Render(w, r, ErrInternalServerError())
 		return
 	}
+	if report != nil {
+		// the cached report is served as it was stored, it is not decoded and encoded again
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(report)
+		return
+	}
+	if err = srv.startUsage(name, db, delimiter); err != nil && !errors.Is(err, ErrUsageRunning) {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(usageRetryAfter.Seconds())))
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, &UsageJobResponse{Delimiter: delimiter, Running: true})
+}
+
+// handleUsageRefresh computes the usage of the delimiter again, a cached report is served
+// until the new one replaces it
+func (srv *Server) handleUsageRefresh(w http.ResponseWriter, r *http.Request) {
+	name, db, delimiter, ok := srv.usageDB(w, r)
+	if !ok {
+		return
+	}
+	if db.ReadOnly() {
+		srv.handleUsage(w, r)
+		return
+	}
+	if err := srv.startUsage(name, db, delimiter); errors.Is(err, ErrUsageRunning) {
+		_ = render.Render(w, r, ErrUsageRunningResponse())
+		return
+	}
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, &UsageJobResponse{Delimiter: delimiter, Running: true})
+}
 
+func (srv *Server) handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, &BackupResponse{Running: srv.backups.running.Load(), Databases: srv.backups.snapshot()})
+}
+
+// handleBackup snapshots every database now, the same way as the scheduler
+func (srv *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	statuses, err := srv.runBackups(time.Now())
+	switch {
+	case errors.Is(err, ErrBackupDisabled):
+		_ = render.Render(w, r, ErrBackupDisabledResponse())
+		return
+	case errors.Is(err, ErrBackupRunning):
+		_ = render.Render(w, r, ErrBackupRunningResponse())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrSnapshotFailed(err))
+		return
+	}
+	render.JSON(w, r, &BackupResponse{Databases: statuses})
+}
+
+func (srv *Server) handleUploadStart(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	key := chi.URLParam(r, "key")
+	node := ""
+	if srv.clusterEnabled() {
+		node = srv.Config.Cluster.NodeName
+	}
+	id, err := StartUpload(db, node, key, srv.uploadTTL(), srv.writeOptions(r))
+	if err != nil {
+		_ = render.Render(w, r, uploadErrRenderer(err))
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &UploadResponse{UploadID: id, Key: key})
+}
+
+func (srv *Server) handleUploadChunk(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	id := chi.URLParam(r, "id")
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	chunk, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadChunkSize))
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	defer func() {
+		_ = r.Body.Close()
+	}()
+
+	size, err := AppendUpload(db, id, offset, chunk, srv.writeOptions(r))
+	if err != nil {
+		_ = render.Render(w, r, uploadErrRenderer(err))
+		return
+	}
+	render.JSON(w, r, &UploadResponse{UploadID: id, Size: size})
+}
+
+func (srv *Server) handleUploadCommit(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	key, err := CommitUpload(db, chi.URLParam(r, "id"), srv.writeOptions(r))
+	if err != nil {
+		_ = render.Render(w, r, uploadErrRenderer(err))
+		return
+	}
 	render.Status(r, http.StatusCreated)
 	render.JSON(w, r, &PutResponse{Key: key, Status: "ok"})
 }
 
-func (srv *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
-	status := Status(srv.DB)
-	render.JSON(w, r, status)
+// handleLockAcquire takes the lock named by the key parameter, so cluster routing sends
+// all requests for one lock to the same shard
+func (srv *Server) handleLockAcquire(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	ttl := defaultLockTTL
+	if value := r.URL.Query().Get("ttl"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil || ttl <= 0 || ttl > maxLockTTL {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	name := chi.URLParam(r, "key")
+	lease, err := AcquireLock(db, name, ttl, srv.writeOptions(r))
+	if errors.Is(err, ErrLockHeld) {
+		_ = render.Render(w, r, ErrLockHeldResponse(lease))
+		return
+	}
+	if errors.Is(err, storage.ErrWriteStalled) {
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &LockResponse{Name: name, Token: lease.Token, Expires: lease.Expires, Status: "ok"})
+}
+
+func (srv *Server) handleLockRelease(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	token, err := strconv.ParseUint(r.URL.Query().Get("token"), 10, 64)
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	name := chi.URLParam(r, "key")
+	err = ReleaseLock(db, name, token, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, ErrLockNotHeld):
+		_ = render.Render(w, r, ErrLockNotHeldResponse())
+	case errors.Is(err, ErrLockMismatch):
+		_ = render.Render(w, r, ErrLockMismatchResponse())
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+	default:
+		render.JSON(w, r, &LockResponse{Name: name, Token: token, Status: "ok"})
+	}
+}
+
+func uploadErrRenderer(err error) render.Renderer {
+	switch {
+	case errors.Is(err, ErrUploadNotFound):
+		return ErrUploadNotFoundResponse()
+	case errors.Is(err, ErrUploadOffset):
+		return ErrUploadOffsetResponse()
+	case errors.Is(err, ErrUploadTooLarge):
+		return ErrUploadTooLargeResponse()
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return ErrQuotaExceeded(err)
+	case errors.Is(err, storage.ErrValueRejected):
+		return ErrValueRejected(err)
+	case errors.Is(err, storage.ErrPrefixExpired):
+		return ErrPrefixExpired()
+	case errors.Is(err, storage.ErrWriteStalled):
+		return ErrWriteStalled()
+	default:
+		return ErrInternalServerError()
+	}
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/timson/pirindb/storage"
+	"time"
+)
+
+const (
+	defaultLockTTL = 10 * time.Second
+	maxLockTTL     = 24 * time.Hour
+)
+
+var (
+	// LocksBucket holds lease records under the lock name, the bucket sequence issues fencing tokens
+	LocksBucket = []byte(storage.InternalBucketPrefix + "locks")
+
+	ErrLockHeld     = errors.New("lock is held")
+	ErrLockNotHeld  = errors.New("lock is not held")
+	ErrLockMismatch = errors.New("lock is held with another token")
+)
+
+type lockRecord struct {
+	Token   uint64 `json:"token"`
+	Expires int64  `json:"expires"` // unix nanoseconds
+}
+
+// Lease is a held lock. Tokens grow with every acquisition of any lock in the database,
+// downstream writes pass the token so writes of a holder that lost the lease are rejected.
+type Lease struct {
+	Name    string
+	Token   uint64
+	Expires time.Time
+}
+
+// getLockRecord returns the record of a held lock, expired and malformed records are free
+func getLockRecord(bucket *storage.Bucket, name string, now time.Time) (*lockRecord, bool) {
+	data, found := bucket.Get([]byte(name))
+	if !found {
+		return nil, false
+	}
+	return parseLockRecord(data, now)
+}
+
+func parseLockRecord(data []byte, now time.Time) (*lockRecord, bool) {
+	var record lockRecord
+	if json.Unmarshal(data, &record) != nil || record.Expires <= now.UnixNano() {
+		return nil, false
+	}
+	return &record, true
+}
+
+// AcquireLock takes the lock for ttl. A held lock fails with ErrLockHeld and the current lease,
+// an expired one is taken over as if it was released.
+func AcquireLock(db *storage.DB, name string, ttl time.Duration, opts writeOptions) (*Lease, error) {
+	now := time.Now()
+	var lease *Lease
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(LocksBucket)
+		if err != nil {
+			return err
+		}
+		if record, held := getLockRecord(bucket, name, now); held {
+			lease = &Lease{Name: name, Token: record.Token, Expires: time.Unix(0, record.Expires)}
+			return ErrLockHeld
+		}
+		token, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		record := lockRecord{Token: token, Expires: now.Add(ttl).UnixNano()}
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return err
+		}
+		lease = &Lease{Name: name, Token: token, Expires: time.Unix(0, record.Expires)}
+		return bucket.Put([]byte(name), data)
+	})
+	return lease, err
+}
+
+// ReleaseLock drops the lock if it is held with the token
+func ReleaseLock(db *storage.DB, name string, token uint64, opts writeOptions) error {
+	now := time.Now()
+	return opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(LocksBucket)
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			return ErrLockNotHeld
+		}
+		if err != nil {
+			return err
+		}
+		record, held := getLockRecord(bucket, name, now)
+		if !held {
+			return ErrLockNotHeld
+		}
+		if record.Token != token {
+			return ErrLockMismatch
+		}
+		return bucket.Remove([]byte(name))
+	})
+}
+
+// ExpireLocks removes lock records past their TTL, acquisition ignores them already
+func ExpireLocks(db *storage.DB, now time.Time) (int, error) {
+	expired := 0
+	err := db.UpdateLabeled("expire locks", func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(LocksBucket)
+		if err != nil {
+			return nil
+		}
+		names := make([][]byte, 0)
+		err = bucket.ForEach(func(k, v []byte) error {
+			if _, held := parseLockRecord(v, now); !held {
+				names = append(names, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = bucket.Remove(name); err != nil {
+				return err
+			}
+		}
+		expired = len(names)
+		return nil
+	})
+	return expired, err
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/timson/pirindb/storage"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 )
 
@@ -21,13 +24,49 @@ func runServer(cfgFile string) {
 
 	logger := createLogger(config.Server.LogLevel)
 	storage.SetLogger(logger)
-	db, DBErr := storage.Open(config.DB.Filename, nil)
+	db, DBErr := storage.Open(config.DB.Filename, config.DB.storageOptions(config.Server))
 	if DBErr != nil {
-		fmt.Printf("Error opening database:\n  %v\n", DBErr)
+		reportOpenError(config.DB.Name, DBErr)
+		os.Exit(1)
+	}
+	logOpened(logger, config.DB)
+	if err = ensureMainBucket(db); err != nil {
+		fmt.Println("Error creating main bucket:", err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+	if err = config.DB.applySchemas(db); err != nil {
+		fmt.Println("Error loading schemas:", err)
+		_ = db.Close()
 		os.Exit(1)
 	}
 
 	server := NewServer(config, db, logger)
+	if server.Auditor, err = NewAuditor(config.Audit, logger); err != nil {
+		fmt.Println("Error opening audit log:", err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+	for _, dbCfg := range config.Databases {
+		tenantDB, tenantErr := storage.Open(dbCfg.Filename, dbCfg.storageOptions(config.Server))
+		if tenantErr == nil {
+			if tenantErr = ensureMainBucket(tenantDB); tenantErr == nil {
+				tenantErr = dbCfg.applySchemas(tenantDB)
+			}
+			if tenantErr == nil {
+				tenantErr = server.DBs.Add(dbCfg.Name, tenantDB)
+			}
+			if tenantErr != nil {
+				_ = tenantDB.Close()
+			}
+		}
+		if tenantErr != nil {
+			reportOpenError(dbCfg.Name, tenantErr)
+			_ = server.DBs.CloseAll(logger)
+			os.Exit(1)
+		}
+		logOpened(logger, dbCfg)
+	}
 
 	go func() {
 		if err = server.Start(); err != nil {
@@ -48,6 +87,47 @@ func runServer(cfgFile string) {
 	logger.Info("Shutdown complete")
 }
 
+// openErrorHint tells the operator what to do about a database that failed to open,
+// empty for errors without a known remedy
+func openErrorHint(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrNotADatabase):
+		return "The file is not a PirinDB database, check the filename in the config."
+	case errors.Is(err, storage.ErrTruncatedDatabase):
+		return "The file is shorter than the database it holds, restore it from a backup."
+	case errors.Is(err, storage.ErrNewerFormat):
+		return "The file was written by a newer PirinDB, upgrade the server."
+	case errors.Is(err, storage.ErrOlderFormat):
+		return "The file was written by a PirinDB version this server no longer reads."
+	case errors.Is(err, storage.ErrMigrationRequired):
+		return "Stop the server and run pirindb migrate, or set auto_migrate = true in the database config."
+	case errors.Is(err, storage.ErrFreelistCorrupted):
+		return "The freelist is damaged, set rebuild_freelist = true in the database config to rebuild it."
+	case errors.Is(err, storage.ErrDatabaseLocked):
+		return "Another process has the database open."
+	case errors.Is(err, storage.ErrDatabaseNotFound):
+		return "Check the filename in the config, set must_exist = false to create a new database."
+	}
+	return ""
+}
+
+// logOpened reports the resolved path of an opened database and whether it had to exist
+func logOpened(logger *slog.Logger, dbCfg *DatabaseConfig) {
+	path, err := filepath.Abs(dbCfg.Filename)
+	if err != nil {
+		path = dbCfg.Filename
+	}
+	logger.Info("database opened", "db", dbCfg.Name, "path", path, "mode", dbCfg.openMode())
+}
+
+// reportOpenError prints a database open failure to stderr, the server exits after it
+func reportOpenError(name string, err error) {
+	_, _ = fmt.Fprintf(os.Stderr, "Error opening database %s:\n  %v\n", name, err)
+	if hint := openErrorHint(err); hint != "" {
+		_, _ = fmt.Fprintf(os.Stderr, "  %s\n", hint)
+	}
+}
+
 func main() {
 	rootCmd := &cobra.Command{
 		Use:   "pirindb",
@@ -58,6 +138,8 @@ func main() {
 		},
 	}
 
+	rootCmd.AddCommand(newMigrateCmd())
+
 	initDefaults()
 	setupFlags(rootCmd)
 
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/timson/pirindb/pkg/client"
 	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
 )
 
 func setupTestServer(t *testing.T) (*Server, string, string) {
@@ -71,7 +85,11 @@ func TestCRUD(t *testing.T) {
 	req, _ := http.NewRequest("DELETE", ts.URL+"/api/v1/kv/"+key, nil)
 	resp, err = http.DefaultClient.Do(req)
 	require.NoError(t, err)
-	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var deleteResp DeleteResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleteResp))
+	_ = resp.Body.Close()
+	require.True(t, deleteResp.Existed)
 
 	// GET again — expect 404
 	resp, err = http.Get(ts.URL + "/api/v1/kv/" + key)
@@ -87,6 +105,100 @@ func TestCRUD(t *testing.T) {
 	require.NoError(t, err)
 	require.Contains(t, status.Buckets, "main")
 	require.Greater(t, status.TotalPageNum, 0)
+	require.Equal(t, txLogPath, status.Durability.TxLogPath)
+	require.Equal(t, storage.SyncAlways, status.Durability.SyncMode)
+	require.True(t, status.Durability.CleanShutdown)
+	require.False(t, status.Durability.LastTxLogSync.IsZero())
+}
+
+func TestPutValueSize(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.MaxValueSize = 64 * 1024
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	post := func(key string, body io.Reader, contentLength int64) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/kv/"+key, body)
+		require.NoError(t, err)
+		req.ContentLength = contentLength
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// a blob streams into its pages, a body without Content-Length is read whole
+	blob := strings.Repeat("b", 60*1024)
+	require.Equal(t, http.StatusCreated, post("blob", strings.NewReader(blob), int64(len(blob))))
+	require.Equal(t, http.StatusCreated, post("chunked", io.LimitReader(strings.NewReader(blob), 1000), -1))
+	value, found := Get(srv.DBs.Primary(), "blob")
+	require.True(t, found)
+	require.Equal(t, blob, value)
+	value, _ = Get(srv.DBs.Primary(), "chunked")
+	require.Equal(t, blob[:1000], value)
+
+	tooLarge := strings.Repeat("x", 65*1024)
+	require.Equal(t, http.StatusRequestEntityTooLarge, post("large", strings.NewReader(tooLarge), int64(len(tooLarge))))
+	require.Equal(t, http.StatusRequestEntityTooLarge, post("large", io.LimitReader(strings.NewReader(tooLarge), int64(len(tooLarge))), -1))
+	_, found = Get(srv.DBs.Primary(), "large")
+	require.False(t, found)
+}
+
+func TestAppend(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.MaxValueSize = 4096
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	appendValue := func(key, data string) (int, AppendResponse) {
+		resp, err := http.Post(ts.URL+"/api/v1/kv/"+key+":append", "text/plain", strings.NewReader(data))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var appendResp AppendResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&appendResp))
+		}
+		return resp.StatusCode, appendResp
+	}
+
+	// keys with colons keep them, only the suffix selects the append
+	for _, key := range []string{"log", "sess:1"} {
+		code, result := appendValue(key, "a")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, key, result.Key)
+		require.Equal(t, 1, result.Size)
+		code, result = appendValue(key, "bc")
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 3, result.Size)
+		value, found := Get(srv.DBs.Primary(), key)
+		require.True(t, found)
+		require.Equal(t, "abc", value)
+	}
+	_, found := Get(srv.DBs.Primary(), "sess:1:append")
+	require.False(t, found)
+
+	// the value grows past the inline limit and is bounded by the value size limit
+	chunk := strings.Repeat("x", 1000)
+	for i := 0; i < 4; i++ {
+		code, _ := appendValue("log", chunk)
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, _ := appendValue("log", chunk)
+	require.Equal(t, http.StatusRequestEntityTooLarge, code)
+	value, _ := Get(srv.DBs.Primary(), "log")
+	require.Equal(t, "abc"+strings.Repeat(chunk, 4), value)
 }
 
 func TestHealthCheck(t *testing.T) {
@@ -108,3 +220,1700 @@ func TestHealthCheck(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "ok", healthResponse.Status)
 }
+
+func TestAnalyze(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/api/v1/db/analyze/main")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats storage.TreeStats
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Depth)
+	require.Equal(t, map[int]int{1: 1}, stats.LeafItems)
+
+	resp, err = http.Get(ts.URL + "/api/v1/db/analyze/missing")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestMultipleDatabases(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	tenantFilename := "test_tenant.db"
+	_ = os.Remove(tenantFilename)
+	tenantDB, err := storage.Open(tenantFilename, nil)
+	require.NoError(t, err)
+	require.NoError(t, srv.DBs.Add("tenant", tenantDB))
+	t.Cleanup(func() {
+		_ = tenantDB.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+		_ = os.Remove(tenantFilename)
+		_ = os.Remove(tenantDB.GetOptions().TxLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/tenant/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(ts.URL + "/api/v1/tenant/kv/foo")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var getResp GetResponse
+	err = json.NewDecoder(resp.Body).Decode(&getResp)
+	require.NoError(t, err)
+	require.Equal(t, "bar", getResp.Value)
+
+	// legacy path is served by the primary database, which does not have the key
+	resp, err = http.Get(ts.URL + "/api/v1/kv/foo")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/api/v1/" + defaultDBName + "/kv/foo")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/api/v1/missing/db/status")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestVersion(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/version")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var versionResponse VersionResponse
+	err = json.NewDecoder(resp.Body).Decode(&versionResponse)
+	require.NoError(t, err)
+	require.Equal(t, version, versionResponse.Version)
+	major, minor := srv.DBs.Primary().FormatVersion()
+	require.Equal(t, int(major), versionResponse.StorageFormatMajor)
+	require.Equal(t, int(minor), versionResponse.StorageFormatMinor)
+	require.NotEmpty(t, versionResponse.Features)
+	require.False(t, versionResponse.Sharding)
+}
+
+func TestChunkedUpload(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	value := bytes.Repeat([]byte("0123456789"), 2000)
+	chunkSize := 7000
+
+	resp, err := http.Post(ts.URL+"/api/v1/kv/big/upload", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var uploadResp UploadResponse
+	err = json.NewDecoder(resp.Body).Decode(&uploadResp)
+	require.NoError(t, err)
+	require.NotEmpty(t, uploadResp.UploadID)
+	uploadURL := ts.URL + "/api/v1/uploads/" + uploadResp.UploadID
+
+	for offset := 0; offset < len(value); offset += chunkSize {
+		chunk := value[offset:min(offset+chunkSize, len(value))]
+		req, _ := http.NewRequest("PUT", fmt.Sprintf("%s?offset=%d", uploadURL, offset), bytes.NewReader(chunk))
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+
+	// chunk with a stale offset is rejected
+	req, _ := http.NewRequest("PUT", uploadURL+"?offset=0", bytes.NewReader(value[:10]))
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err = http.Post(uploadURL+"/commit", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/api/v1/kv/big")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var getResp GetResponse
+	err = json.NewDecoder(resp.Body).Decode(&getResp)
+	require.NoError(t, err)
+	require.Equal(t, string(value), getResp.Value)
+
+	// committed upload is gone
+	resp, err = http.Post(uploadURL+"/commit", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestExpireUploads(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	db := srv.DBs.Primary()
+
+	id, err := StartUpload(db, "", "foo", time.Minute, labeled("test"))
+	require.NoError(t, err)
+	_, err = AppendUpload(db, id, 0, []byte("bar"), labeled("test"))
+	require.NoError(t, err)
+
+	expired, err := ExpireUploads(db, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 0, expired)
+
+	expired, err = ExpireUploads(db, time.Now().Add(2*time.Minute))
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+	_, err = CommitUpload(db, id, labeled("test"))
+	require.ErrorIs(t, err, ErrUploadNotFound)
+}
+
+func TestLogKeyRedaction(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	var logs bytes.Buffer
+	srv.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	srv.Config.Server.LogKeyMode = storage.LogKeyHash
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	key := "alice@example.com"
+	resp, err := http.Get(ts.URL + "/api/v1/kv/" + key)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var errResp ErrResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	_ = resp.Body.Close()
+
+	hashed := storage.RedactKey(storage.LogKeyHash, []byte(key))
+	require.Equal(t, hashed, errResp.Key)
+	require.NotContains(t, logs.String(), key)
+	require.Contains(t, logs.String(), hashed)
+
+	srv.Config.Server.LogKeyMode = storage.LogKeyFull
+	req := httptest.NewRequest("GET", "/api/v1/kv/"+key, nil)
+	srv.buildRouter().ServeHTTP(httptest.NewRecorder(), req)
+	require.Contains(t, logs.String(), key)
+}
+
+func TestDeleteIdempotent(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	doDelete := func(key string) *http.Response {
+		req, _ := http.NewRequest("DELETE", ts.URL+"/api/v1/kv/"+key, nil)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+
+	// nothing was stored yet, the bucket is missing
+	resp := doDelete("foo")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var errResp ErrResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.Equal(t, "bucket_not_found", errResp.Code)
+
+	resp, err := http.Post(ts.URL+"/api/v1/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	for _, existed := range []bool{true, false} {
+		resp = doDelete("foo")
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		var deleteResp DeleteResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleteResp))
+		require.Equal(t, DeleteResponse{Key: "foo", Status: "ok", Existed: existed}, deleteResp)
+	}
+}
+
+func TestExpirePrefix(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	expire := func(bucket string, body string) *http.Response {
+		resp, err := http.Post(ts.URL+"/api/v1/buckets/"+bucket+"/expire", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	require.Equal(t, http.StatusNotFound, expire("main", `{"prefix":"session:","ttl_seconds":60}`).StatusCode)
+
+	db := srv.DBs.Primary()
+	for _, key := range []string{"session:1", "session:2", "user:1"} {
+		require.NoError(t, Put(db, key, "value", labeled("test")))
+	}
+	require.Equal(t, http.StatusBadRequest, expire("main", `{"prefix":"session:","ttl_seconds":-1}`).StatusCode)
+	resp := expire("main", `{"prefix":"session:","ttl_seconds":3600}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var expireResp ExpireResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&expireResp))
+	require.Equal(t, "session:", expireResp.Prefix)
+	require.WithinDuration(t, time.Now().Add(time.Hour), *expireResp.ExpireAt, time.Minute)
+
+	// rules are reported with bucket stats
+	resp, err := http.Get(ts.URL + "/api/v1/db/status")
+	require.NoError(t, err)
+	var status struct {
+		Buckets map[string]struct {
+			PrefixRules []struct{ Prefix string }
+		}
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	_ = resp.Body.Close()
+	require.Equal(t, "session:", status.Buckets["main"].PrefixRules[0].Prefix)
+
+	_, found := Get(db, "session:1")
+	require.True(t, found)
+	require.NoError(t, ExpirePrefix(db, "main", "session:", time.Now(), labeled("test")))
+	_, found = Get(db, "session:1")
+	require.False(t, found)
+	_, found = Get(db, "user:1")
+	require.True(t, found)
+
+	purged, err := db.PurgeExpired(time.Now(), purgeExpiredLimit)
+	require.NoError(t, err)
+	require.Equal(t, 2, purged)
+	require.Empty(t, Status(db, true).Buckets["main"].PrefixRules)
+}
+
+func TestBucketQuota(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	setQuota := func(bucket string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/buckets/"+bucket+"/quota", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	put := func(key string, value string) *http.Response {
+		resp, err := http.Post(ts.URL+"/api/v1/kv/"+key, "text/plain", bytes.NewBufferString(value))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	require.Equal(t, http.StatusNotFound, setQuota("main", `{"max_keys":2}`).StatusCode)
+
+	require.Equal(t, http.StatusCreated, put("a", "value").StatusCode)
+	require.Equal(t, http.StatusBadRequest, setQuota("main", `{"max_keys":-1}`).StatusCode)
+	resp := setQuota("main", `{"max_keys":2,"max_bytes":1024}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var quotaResp BucketQuotaResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&quotaResp))
+	require.Equal(t, BucketQuotaResponse{Bucket: "main", MaxKeys: 2, MaxBytes: 1024, Status: "ok"}, quotaResp)
+
+	require.Equal(t, http.StatusCreated, put("b", "value").StatusCode)
+	resp = put("c", "value")
+	require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	var errResp ErrDetailResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.Equal(t, "quota_exceeded", errResp.Code)
+	require.Contains(t, errResp.Detail, "2 of 2 keys")
+	// existing keys can still be overwritten, but not grown over the byte quota
+	require.Equal(t, http.StatusCreated, put("a", "new").StatusCode)
+	resp, err := http.Post(ts.URL+"/api/v1/kv/b:append", "text/plain", bytes.NewReader(make([]byte, 2048)))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	// usage and quota are reported together
+	stat := Status(srv.DBs.Primary(), true).Buckets["main"]
+	require.EqualValues(t, 2, stat.ItemsN)
+	require.Equal(t, storage.BucketQuota{MaxKeys: 2, MaxBytes: 1024}, stat.Quota)
+
+	require.Equal(t, http.StatusOK, setQuota("main", `{}`).StatusCode)
+	require.Equal(t, http.StatusCreated, put("c", "value").StatusCode)
+}
+
+func TestListBuckets(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	db := srv.DBs.Primary()
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		for i := 0; i < 5; i++ {
+			if _, err := tx.CreateBucket([]byte(fmt.Sprintf("tenant-%d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, Put(db, "foo", "bar", labeled("test")))
+
+	list := func(query string) (int, BucketListResponse) {
+		resp, err := http.Get(ts.URL + "/api/v1/buckets" + query)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var listResp BucketListResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&listResp))
+		}
+		return resp.StatusCode, listResp
+	}
+
+	var names []string
+	next := ""
+	for {
+		code, page := list("?limit=2&start_after=" + url.QueryEscape(next))
+		require.Equal(t, http.StatusOK, code)
+		require.LessOrEqual(t, len(page.Buckets), 2)
+		for _, entry := range page.Buckets {
+			require.Nil(t, entry.Stats)
+			names = append(names, entry.Name)
+		}
+		if page.Next == "" {
+			break
+		}
+		next = page.Next
+	}
+	require.Equal(t, []string{"main", "tenant-0", "tenant-1", "tenant-2", "tenant-3", "tenant-4"}, names)
+
+	code, page := list("?with_stats=true&limit=1")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "main", page.Buckets[0].Name)
+	require.Equal(t, uint64(1), page.Buckets[0].Stats.ItemsN)
+	require.Equal(t, "main", page.Next)
+
+	code, _ = list("?limit=0")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = list("?with_stats=maybe")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	// the cheap status leaves bucket stats out
+	resp, err := http.Get(ts.URL + "/api/v1/db/status?buckets=false")
+	require.NoError(t, err)
+	var status map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	_ = resp.Body.Close()
+	require.Nil(t, status["Buckets"])
+	require.NotZero(t, status["TotalPageNum"])
+}
+
+func TestListKeys(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	list := func(query string) (int, KeyListResponse) {
+		resp, err := http.Get(ts.URL + "/api/v1/kv" + query)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var listResp KeyListResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&listResp))
+		}
+		return resp.StatusCode, listResp
+	}
+
+	// nothing stored yet
+	code, page := list("?prefix=a/")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, page.Keys)
+
+	db := srv.DBs.Primary()
+	for _, key := range []string{"a", "a/b", "a/b/c", "a/b/d/e", "a/c", "a/d/x", "b/y"} {
+		require.NoError(t, Put(db, key, "value", labeled("test")))
+	}
+
+	code, page = list("?prefix=a/&delimiter=/")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"a/b", "a/c"}, page.Keys)
+	require.Equal(t, []string{"a/b/", "a/d/"}, page.CommonPrefixes)
+	require.Empty(t, page.Next)
+
+	var entries []string
+	next := ""
+	for {
+		code, page = list("/?prefix=a/&delimiter=/&limit=1&start_after=" + url.QueryEscape(next))
+		require.Equal(t, http.StatusOK, code)
+		entries = append(entries, page.Keys...)
+		entries = append(entries, page.CommonPrefixes...)
+		if page.Next == "" {
+			break
+		}
+		next = page.Next
+	}
+	require.Equal(t, []string{"a/b", "a/b/", "a/c", "a/d/"}, entries)
+
+	// tokens page the same way and are Bucket.ScanFrom tokens
+	entries = entries[:0]
+	token := ""
+	for {
+		code, page = list("/?prefix=a/&delimiter=/&limit=1&token=" + url.QueryEscape(token))
+		require.Equal(t, http.StatusOK, code)
+		entries = append(entries, page.Keys...)
+		entries = append(entries, page.CommonPrefixes...)
+		if page.NextToken == "" {
+			break
+		}
+		require.Equal(t, string(storage.EncodeScanToken([]byte(page.Next))), page.NextToken)
+		token = page.NextToken
+	}
+	require.Equal(t, []string{"a/b", "a/b/", "a/c", "a/d/"}, entries)
+	var scanToken []byte
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		scanToken, err = bucket.ScanFrom(nil, 3, func(k, v []byte) error { return nil })
+		return err
+	}))
+	code, page = list("?token=" + url.QueryEscape(string(scanToken)))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"a/b/d/e", "a/c", "a/d/x", "b/y"}, page.Keys)
+	code, _ = list("?token=bad")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, page = list("?prefix=a")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"a", "a/b", "a/b/c", "a/b/d/e", "a/c", "a/d/x"}, page.Keys)
+	require.Nil(t, page.Sizes)
+
+	// sizes come from the item references, a blob is not read
+	require.NoError(t, Put(db, "a/blob", strings.Repeat("x", 10000), labeled("test")))
+	code, page = list("?prefix=a/&delimiter=/&include_sizes=true")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"a/b", "a/blob", "a/c"}, page.Keys)
+	require.Equal(t, []int{5, 10000, 5}, page.Sizes)
+	code, _ = list("?include_sizes=maybe")
+	require.Equal(t, http.StatusBadRequest, code)
+	_, err := Delete(db, "a/blob", labeled("test"))
+	require.NoError(t, err)
+
+	// an offset skips keys under the prefix by their position
+	code, page = list("?prefix=a/&offset=2&limit=2")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []string{"a/b/d/e", "a/c"}, page.Keys)
+	require.Equal(t, "a/c", page.Next)
+	code, page = list("?prefix=a/&offset=5")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, page.Keys)
+	code, _ = list("?prefix=a/&delimiter=/&offset=1")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = list("?limit=0")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+// more buckets and keys than a streamed batch or a listing page hold
+func TestLargeResponses(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	const n = 2*statusBucketBatch + 7
+	db := srv.DBs.Primary()
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		main, err := tx.CreateBucketIfNotExists(DBBucket)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			bucket, err := tx.CreateBucket([]byte(fmt.Sprintf("tenant-%04d", i)))
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte("key"), bytes.Repeat([]byte("v"), i)); err != nil {
+				return err
+			}
+			if err = main.Put([]byte(fmt.Sprintf("key-%04d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	// the streamed status decodes to the status with buckets
+	resp, err := http.Get(ts.URL + "/api/v1/db/status")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var status storage.DBStat
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	_ = resp.Body.Close()
+	expected := Status(db, true)
+	require.Len(t, status.Buckets, n+1)
+	for name, stat := range expected.Buckets {
+		require.Equal(t, stat.ItemsN, status.Buckets[name].ItemsN, name)
+		require.Equal(t, stat.BytesInUse, status.Buckets[name].BytesInUse, name)
+	}
+	require.Empty(t, status.InvalidBuckets)
+	require.True(t, status.BucketsComplete)
+	require.True(t, expected.BucketsComplete)
+	require.Equal(t, expected.TotalPageNum, status.TotalPageNum)
+
+	// a larger page than the server allows is cut to its limit instead of refused
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/kv?limit=%d", ts.URL, 10*maxKeyListLimit))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var keys KeyListResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&keys))
+	_ = resp.Body.Close()
+	require.Len(t, keys.Keys, maxKeyListLimit)
+	require.Equal(t, keys.Keys[maxKeyListLimit-1], keys.Next)
+	require.NotEmpty(t, keys.NextToken)
+
+	resp, err = http.Get(fmt.Sprintf("%s/api/v1/buckets?limit=%d", ts.URL, 10*maxBucketListLimit))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var buckets BucketListResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&buckets))
+	_ = resp.Body.Close()
+	require.Len(t, buckets.Buckets, maxBucketListLimit)
+	require.NotEmpty(t, buckets.Next)
+}
+
+func TestSampleKeys(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	sample := func(bucket, query string) (int, SampleResponse) {
+		resp, err := http.Get(ts.URL + "/api/v1/buckets/" + bucket + "/sample" + query)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var sampleResp SampleResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&sampleResp))
+		}
+		return resp.StatusCode, sampleResp
+	}
+	code, _ := sample("main", "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	db := srv.DBs.Primary()
+	for i := 0; i < 500; i++ {
+		require.NoError(t, Put(db, fmt.Sprintf("user:%03d", i), strings.Repeat("v", 20), labeled("test")))
+	}
+	require.NoError(t, Put(db, "order:1", "value", labeled("test")))
+
+	code, resp := sample("main", "?prefix=user:&n=10")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Keys, 10)
+	require.EqualValues(t, 500, resp.Total)
+	require.Equal(t, 20.0, resp.AvgValueSize)
+	require.EqualValues(t, 500*20, resp.EstimatedBytes)
+	for _, key := range resp.Keys {
+		require.True(t, strings.HasPrefix(key.Key, "user:"))
+		require.Equal(t, 20, key.Size)
+	}
+
+	code, resp = sample("main", "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, resp.Keys, defaultSampleSize)
+	require.EqualValues(t, 501, resp.Total)
+	code, resp = sample("main", "?prefix=none:")
+	require.Equal(t, http.StatusOK, code)
+	require.Empty(t, resp.Keys)
+	require.Zero(t, resp.EstimatedBytes)
+	code, _ = sample("main", "?n=0")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = sample("main", fmt.Sprintf("?n=%d", maxSampleSize+1))
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestUsage(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	db := srv.DBs.Primary()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, Put(db, fmt.Sprintf("acme:%03d", i), "v", labeled("test")))
+	}
+	require.NoError(t, Put(db, "globex:1", strings.Repeat("v", 100), labeled("test")))
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("orders"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("acme:order"), []byte("vv"))
+	}))
+	require.NoError(t, runCanary(db, time.Now()))
+
+	usage := func() (int, UsageReport) {
+		resp, err := http.Get(ts.URL + "/api/v1/usage?delimiter=:")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var report UsageReport
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+		}
+		return resp.StatusCode, report
+	}
+	// the first request starts the computation
+	code, _ := usage()
+	require.Equal(t, http.StatusAccepted, code)
+	var report UsageReport
+	require.Eventually(t, func() bool {
+		code, report = usage()
+		return code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, ":", report.Delimiter)
+	require.Equal(t, 2, report.Buckets, "internal buckets are not counted")
+	require.False(t, report.Truncated)
+	require.Equal(t, []UsagePrefix{
+		{Prefix: "globex:", Bytes: 8 + 100, Items: 1},
+		{Prefix: "acme:", Bytes: 10*(8+1) + 10 + 2, Items: 11},
+	}, report.Prefixes)
+	require.Equal(t, report.ComputedAt.Add(defaultUsageTTL), report.ExpiresAt)
+
+	// the cached report is served until a refresh replaces it
+	require.NoError(t, Put(db, "initech:1", "v", labeled("test")))
+	code, cached := usage()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, report.ComputedAt, cached.ComputedAt)
+	resp, err := http.Post(ts.URL+"/api/v1/admin/usage?delimiter=:", "", nil)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		code, report = usage()
+		return code == http.StatusOK && len(report.Prefixes) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	missing, err := http.Get(ts.URL + "/api/v1/usage")
+	require.NoError(t, err)
+	_ = missing.Body.Close()
+	require.Equal(t, http.StatusBadRequest, missing.StatusCode)
+	srv.usage.wg.Wait()
+}
+
+func TestPrefixStats(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	prefixStats := func(query string) (int, PrefixStatsResponse) {
+		resp, err := http.Get(ts.URL + "/api/v1/buckets/main/prefix-stats" + query)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var statsResp PrefixStatsResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&statsResp))
+		}
+		return resp.StatusCode, statsResp
+	}
+
+	db := srv.DBs.Primary()
+	for i := 0; i < 200; i++ {
+		require.NoError(t, Put(db, fmt.Sprintf("acme:%03d", i), "v", labeled("test")))
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, Put(db, fmt.Sprintf("globex:%03d", i), strings.Repeat("v", 100), labeled("test")))
+	}
+	require.NoError(t, Put(db, "initech:1", "v", labeled("test")))
+
+	code, resp := prefixStats("?delimiter=:&top=2")
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, resp.Exact)
+	require.Equal(t, 3, resp.Prefixes)
+	require.EqualValues(t, 221, resp.Keys)
+	require.Equal(t, []PrefixStatResponse{
+		{Prefix: "acme:", Count: 200, Bytes: 200 * (8 + 1)},
+		{Prefix: "globex:", Count: 20, Bytes: 20 * (10 + 100)},
+	}, resp.ByCount)
+	require.Equal(t, "globex:", resp.ByBytes[0].Prefix)
+
+	// counting only reads one key of every prefix
+	code, resp = prefixStats("?delimiter=:&bytes=false")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, 3, resp.Visited)
+	require.Len(t, resp.ByCount, 3)
+	require.Empty(t, resp.ByBytes)
+
+	// the key budget stops the scan, the results say so
+	code, resp = prefixStats("?delimiter=:&max_keys=50")
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, resp.Exact)
+	require.Equal(t, 50, resp.Visited)
+	require.Equal(t, 1, resp.Prefixes)
+
+	for _, query := range []string{"", "?delimiter=:&top=0", "?delimiter=:&max_keys=-1", "?delimiter=:&bytes=maybe",
+		fmt.Sprintf("?delimiter=:&top=%d", maxPrefixStatsTop+1)} {
+		code, _ = prefixStats(query)
+		require.Equal(t, http.StatusBadRequest, code, query)
+	}
+	missing, err := http.Get(ts.URL + "/api/v1/buckets/missing/prefix-stats?delimiter=:")
+	require.NoError(t, err)
+	_ = missing.Body.Close()
+	require.Equal(t, http.StatusNotFound, missing.StatusCode)
+}
+
+func TestDeletePrefix(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	deletePrefix := func(query string) (int, DeletePrefixResponse) {
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/api/v1/kv"+query, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var deleteResp DeletePrefixResponse
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&deleteResp))
+		}
+		return resp.StatusCode, deleteResp
+	}
+
+	// nothing stored yet
+	code, result := deletePrefix("?prefix=sess:")
+	require.Equal(t, http.StatusOK, code)
+	require.Zero(t, result.Count)
+
+	db := srv.DBs.Primary()
+	for i := range 25 {
+		require.NoError(t, Put(db, fmt.Sprintf("sess:%02d", i), "value", labeled("test")))
+	}
+	require.NoError(t, Put(db, "sess", "value", labeled("test")))
+	require.NoError(t, Put(db, "user:1", "value", labeled("test")))
+
+	code, result = deletePrefix("?prefix=sess:&dry_run=true")
+	require.Equal(t, http.StatusOK, code)
+	require.True(t, result.DryRun)
+	require.Equal(t, 25, result.Count)
+	require.Len(t, result.Sample, deletePrefixSampleSize)
+	require.Equal(t, "sess:00", result.Sample[0])
+	_, found := Get(db, "sess:00")
+	require.True(t, found, "a dry run deletes nothing")
+
+	code, result = deletePrefix("?prefix=sess:")
+	require.Equal(t, http.StatusOK, code)
+	require.False(t, result.DryRun)
+	require.Equal(t, 25, result.Count)
+	require.Empty(t, result.Sample)
+	_, found = Get(db, "sess:00")
+	require.False(t, found)
+	_, found = Get(db, "sess")
+	require.True(t, found)
+
+	code, _ = deletePrefix("")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = deletePrefix("?prefix=a&dry_run=maybe")
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+func TestExport(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	router := srv.buildRouter()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	db := srv.DBs.Primary()
+	// more rows than one export batch
+	rows := 2*exportBatchSize + 10
+	err := db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("events"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < rows; i++ {
+			value := fmt.Sprintf(`{"a": %d, "b": "text, with \"quotes\"\nand newline", "c": {"nested": [1, 2]}}`, i)
+			if err = bucket.Put([]byte(fmt.Sprintf("event:%05d", i)), []byte(value)); err != nil {
+				return err
+			}
+		}
+		for _, malformed := range []string{"not json", `[1, 2]`, `"string"`} {
+			if err = bucket.Put([]byte("bad:"+malformed), []byte(malformed)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	get := func(query string) *http.Response {
+		resp, err := http.Get(ts.URL + "/api/v1/buckets/events/export" + query)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	require.Equal(t, http.StatusBadRequest, get("?format=csv").StatusCode)
+	require.Equal(t, http.StatusBadRequest, get("?format=xml&fields=a").StatusCode)
+	resp, err := http.Get(ts.URL + "/api/v1/buckets/missing/export?fields=a")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	resp = get("?format=csv&fields=a,b,c,missing")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	records, err := csv.NewReader(resp.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, rows+1)
+	require.Equal(t, []string{"key", "a", "b", "c", "missing"}, records[0])
+	require.Equal(t, []string{"event:00007", "7", "text, with \"quotes\"\nand newline", `{"nested":[1,2]}`, ""}, records[8])
+	require.Equal(t, strconv.Itoa(rows), resp.Trailer.Get(exportRowsTrailer))
+	require.Equal(t, "3", resp.Trailer.Get(exportErrorsTrailer))
+
+	resp = get("?format=ndjson&fields=a")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	decoder := json.NewDecoder(resp.Body)
+	lines := 0
+	for decoder.More() {
+		var line struct {
+			Key   string
+			Value map[string]int
+		}
+		require.NoError(t, decoder.Decode(&line))
+		require.Equal(t, fmt.Sprintf("event:%05d", lines), line.Key)
+		require.Equal(t, map[string]int{"a": lines}, line.Value)
+		lines++
+	}
+	require.Equal(t, rows, lines)
+	require.Equal(t, "3", resp.Trailer.Get(exportErrorsTrailer))
+}
+
+func TestTooManyReaders(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	mustExist := false
+	dbCfg := &DatabaseConfig{Filename: filename, MustExist: &mustExist}
+	serverCfg := &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR", MaxOpenReaders: 1}
+	db, err := storage.Open(filename, dbCfg.storageOptions(serverCfg))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	})
+	logger := createLogger(serverCfg.LogLevel)
+	srv := NewServer(&Config{Server: serverCfg, DB: dbCfg}, db, logger)
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	defer func() { _ = db.Close() }()
+
+	resp, err := http.Post(ts.URL+"/api/v1/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// a reader left open by a stuck request takes the only slot
+	held := make(chan *storage.Tx)
+	go func() {
+		tx, err := db.Begin(false)
+		require.NoError(t, err)
+		held <- tx
+	}()
+	tx := <-held
+
+	resp, err = http.Get(ts.URL + "/api/v1/kv/foo")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	var errResp ErrResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.Equal(t, "too_many_readers", errResp.Code)
+	_ = resp.Body.Close()
+
+	tx.Rollback()
+	resp, err = http.Get(ts.URL + "/api/v1/kv/foo")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+}
+
+func TestLocks(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	ctx := context.Background()
+	cl := client.New(ts.URL)
+
+	lease, err := cl.AcquireLock(ctx, "rebuild-index", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "rebuild-index", lease.Name)
+	require.Positive(t, lease.Token)
+	require.WithinDuration(t, time.Now().Add(time.Minute), lease.Expires, 5*time.Second)
+
+	// a held lock reports when it expires
+	resp, err := http.Post(ts.URL+"/api/v1/locks/rebuild-index?ttl=10s", "text/plain", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	var held ErrLockResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&held))
+	_ = resp.Body.Close()
+	require.Equal(t, "lock_held", held.Code)
+	require.WithinDuration(t, lease.Expires, held.Expires, time.Millisecond)
+
+	require.ErrorIs(t, cl.ReleaseLock(ctx, "rebuild-index", lease.Token+1), client.ErrLockMismatch)
+	require.NoError(t, cl.ReleaseLock(ctx, "rebuild-index", lease.Token))
+	require.ErrorIs(t, cl.ReleaseLock(ctx, "rebuild-index", lease.Token), client.ErrLockNotHeld)
+
+	// tokens keep growing, so a late write of the previous holder can be fenced off
+	next, err := cl.AcquireLock(ctx, "rebuild-index", 50*time.Millisecond)
+	require.NoError(t, err)
+	require.Greater(t, next.Token, lease.Token)
+
+	// a crashed holder does not block others once the lease expires
+	time.Sleep(100 * time.Millisecond)
+	taken, err := cl.AcquireLock(ctx, "rebuild-index", time.Minute)
+	require.NoError(t, err)
+	require.Greater(t, taken.Token, next.Token)
+	require.ErrorIs(t, cl.ReleaseLock(ctx, "rebuild-index", next.Token), client.ErrLockMismatch)
+
+	other, err := cl.AcquireLock(ctx, "other", 50*time.Millisecond)
+	require.NoError(t, err)
+	expired, err := ExpireLocks(srv.DBs.Primary(), other.Expires.Add(time.Millisecond))
+	require.NoError(t, err)
+	require.Equal(t, 1, expired)
+
+	for _, ttl := range []string{"0s", "-1s", "forever", "48h"} {
+		resp, err = http.Post(ts.URL+"/api/v1/locks/bad?ttl="+ttl, "text/plain", nil)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, ttl)
+		_ = resp.Body.Close()
+	}
+}
+
+func TestOpenErrorHint(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	require.NoError(t, os.WriteFile(filename, make([]byte, 32*1024), 0600))
+	_, err := storage.Open(filename, nil)
+	require.ErrorIs(t, err, storage.ErrNotADatabase)
+	require.Contains(t, openErrorHint(err), "not a PirinDB database")
+	require.Empty(t, openErrorHint(errors.New("disk on fire")))
+}
+
+func TestDatabaseMustExist(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	serverCfg := &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"}
+	dbCfg := &DatabaseConfig{Name: "typo", Filename: filename}
+	require.Equal(t, "must_exist", dbCfg.openMode())
+	_, err := storage.Open(filename, dbCfg.storageOptions(serverCfg))
+	require.ErrorIs(t, err, storage.ErrDatabaseNotFound)
+	require.Contains(t, openErrorHint(err), "must_exist = false")
+	require.NoFileExists(t, filename)
+
+	mustExist := false
+	dbCfg.MustExist = &mustExist
+	require.Equal(t, "create_if_missing", dbCfg.openMode())
+	db, err := storage.Open(filename, dbCfg.storageOptions(serverCfg))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	})
+	require.NoError(t, db.Close())
+}
+
+func TestLegacyBucketsRenamed(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	db, err := storage.Open(filename, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	})
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		for legacy := range legacyBuckets {
+			bucket, err := tx.CreateBucket([]byte(legacy))
+			require.NoError(t, err)
+			require.NoError(t, bucket.Put([]byte("k"), []byte(legacy)))
+		}
+		locks, err := tx.GetBucket([]byte("_locks"))
+		require.NoError(t, err)
+		_, err = locks.NextSequence()
+		return err
+	}))
+	require.NoError(t, ensureMainBucket(db))
+
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		for legacy, name := range legacyBuckets {
+			require.False(t, tx.BucketExists([]byte(legacy)))
+			bucket, err := tx.GetBucket(name)
+			require.NoError(t, err)
+			value, _ := bucket.Get([]byte("k"))
+			require.Equal(t, legacy, string(value))
+		}
+		// fencing tokens go on from the last one issued
+		locks, err := tx.GetBucket(LocksBucket)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), locks.Sequence())
+		require.Equal(t, [][]byte{DBBucket}, tx.Buckets())
+		return nil
+	}))
+	require.Len(t, Status(db, true).Buckets, 1)
+}
+
+func TestMainBucketAutoDeleted(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	mustExist := false
+	dbCfg := &DatabaseConfig{Filename: filename, MustExist: &mustExist, AutoDeleteEmptyBuckets: true}
+	db, err := storage.Open(filename, dbCfg.storageOptions(&ServerConfig{}))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = db.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(db.GetOptions().TxLogPath)
+	})
+	require.NoError(t, ensureMainBucket(db))
+
+	require.NoError(t, Put(db, "foo", "bar", labeled("test")))
+	existed, err := Delete(db, "foo", labeled("test"))
+	require.NoError(t, err)
+	require.True(t, existed)
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		require.False(t, tx.BucketExists(DBBucket), "the drained main bucket is deleted")
+		return nil
+	}))
+	_, found, err := Lookup(db, "foo")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	require.NoError(t, Put(db, "foo", "baz", labeled("test")))
+	value, found := Get(db, "foo")
+	require.True(t, found)
+	require.Equal(t, "baz", value)
+}
+
+func TestResponseCompression(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.Compression = true
+	srv.Config.Server.CompressionMinSize = defaultCompressionMinSize
+
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	value := strings.Repeat("compressible ", 500)
+	resp, err := http.Post(ts.URL+"/api/v1/kv/large", "text/plain", strings.NewReader(value))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	_ = resp.Body.Close()
+	resp, err = http.Post(ts.URL+"/api/v1/kv/small", "text/plain", strings.NewReader("tiny"))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	// a raw transport shows the encoded body as sent
+	raw := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	get := func(path, acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		require.NoError(t, err)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		resp, err := raw.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, resp.Header.Values("Vary"), "Accept-Encoding")
+		return resp, body
+	}
+
+	resp, body := get("/api/v1/kv/large", "br, gzip;q=0.8")
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "application/json", strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	require.Less(t, len(body), len(value))
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	require.NoError(t, err)
+	var getResp GetResponse
+	require.NoError(t, json.NewDecoder(gz).Decode(&getResp))
+	require.Equal(t, value, getResp.Value)
+
+	for _, acceptEncoding := range []string{"", "identity", "gzip;q=0", "br"} {
+		resp, body = get("/api/v1/kv/large", acceptEncoding)
+		require.Empty(t, resp.Header.Get("Content-Encoding"), acceptEncoding)
+		require.NoError(t, json.Unmarshal(body, &getResp))
+	}
+	// below the minimum size
+	resp, body = get("/api/v1/kv/small", "gzip")
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	require.NoError(t, json.Unmarshal(body, &getResp))
+	require.Equal(t, "tiny", getResp.Value)
+
+	// the default transport asks for gzip and decodes it, like the CLI and shard requests
+	resp, err = http.Get(ts.URL + "/api/v1/kv/large")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.True(t, resp.Uncompressed)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&getResp))
+	require.Equal(t, value, getResp.Value)
+
+	// a streamed export is encoded and keeps its trailers
+	db := srv.DBs.Primary()
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("events"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < exportBatchSize+10; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("event:%05d", i)), []byte(fmt.Sprintf(`{"a": %d}`, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	resp, err = http.Get(ts.URL + "/api/v1/buckets/events/export?format=ndjson&fields=a")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.True(t, resp.Uncompressed)
+	lines, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, exportBatchSize+10, bytes.Count(lines, []byte("\n")))
+	require.Equal(t, strconv.Itoa(exportBatchSize+10), resp.Trailer.Get(exportRowsTrailer))
+
+	// switched off
+	srv.Config.Server.Compression = false
+	plain := httptest.NewServer(srv.buildRouter())
+	defer plain.Close()
+	resp, err = http.Get(plain.URL + "/api/v1/kv/large")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.False(t, resp.Uncompressed)
+	require.Equal(t, []string{"Accept"}, resp.Header.Values("Vary")) // gets vary by the value form only
+}
+
+func TestWriteStall(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	fp := storage.NewFailpoints()
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).
+		WithFailpoints(fp).WithWriteStall(time.Millisecond, 0)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	srv.ready.Store(true)
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	put := func() *http.Response {
+		resp, err := http.Post(ts.URL+"/api/v1/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+	fp.Enable(storage.FailpointSync, storage.Delay(10*time.Millisecond))
+	for db.WriteStall().CommitP95 <= time.Millisecond || db.CommitStats().Commits < 5 {
+		require.Equal(t, http.StatusCreated, put().StatusCode)
+	}
+
+	resp := put()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "1", resp.Header.Get("Retry-After"))
+	resp, err = http.Post(ts.URL+"/api/v1/kv/foo:append", "text/plain", bytes.NewBufferString("baz"))
+	require.NoError(t, err)
+	var errResp ErrResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, "write_stalled", errResp.Code)
+
+	// reads are served and readiness reports the stall
+	resp, err = http.Get(ts.URL + "/api/v1/kv/foo")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(ts.URL + "/health/ready")
+	require.NoError(t, err)
+	var health HealthResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, HealthResponse{Status: "write_stalled", Mode: ModeReadWrite, WriteStalled: []string{defaultDBName}}, health)
+
+	resp, err = http.Get(ts.URL + "/api/v1/db/status?buckets=false")
+	require.NoError(t, err)
+	var status storage.DBStat
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	_ = resp.Body.Close()
+	require.True(t, status.WriteStall.Stalled)
+	require.EqualValues(t, 2, status.WriteStall.Rejected)
+}
+
+func TestSoftLimitWarnings(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	// tx log records are kept until the interval sync
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).
+		WithSyncMode(storage.SyncInterval).WithSyncInterval(time.Hour).WithSoftLimits(0, 0, 4096)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	srv.ready.Store(true)
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	ready := func() HealthResponse {
+		resp, err := http.Get(ts.URL + "/health/ready")
+		require.NoError(t, err)
+		var health HealthResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return health
+	}
+	require.Empty(t, ready().Warnings)
+
+	for i := 0; len(db.SoftLimits().Warnings) == 0; i++ {
+		resp, err := http.Post(fmt.Sprintf("%s/api/v1/kv/key%d", ts.URL, i), "text/plain",
+			bytes.NewBufferString(strings.Repeat("x", 512)))
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+	health := ready()
+	require.Equal(t, "ok", health.Status, "warnings keep the node ready")
+	require.Len(t, health.Warnings, 1)
+	require.Equal(t, defaultDBName, health.Warnings[0].DB)
+	require.Equal(t, string(storage.SoftLimitTxLog), health.Warnings[0].Kind)
+	require.Contains(t, health.Warnings[0].Message, "above 4096")
+
+	resp, err := http.Get(ts.URL + "/api/v1/db/status?buckets=false")
+	require.NoError(t, err)
+	var status storage.DBStat
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+	_ = resp.Body.Close()
+	require.Len(t, status.Warnings, 1)
+	require.Equal(t, 1, status.SoftLimits.Active[storage.SoftLimitTxLog])
+
+	// back under the limit once the records are synced
+	require.NoError(t, db.Sync())
+	require.Empty(t, ready().Warnings)
+}
+
+func TestWriteRetry(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).WithWriteStall(0, 1)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR", WriteRetryAttempts: 100, WriteRetryBackoff: time.Millisecond},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	// a held write lock and one waiting writer stall the writes
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	waiter := make(chan error, 1)
+	go func() { waiter <- Put(db, "queued", "value", labeled("test")) }()
+	require.Eventually(t, func() bool { return db.Stat(storage.WithBuckets(false)).WriteQueueDepth == 1 }, time.Second, time.Millisecond)
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(ts.URL+"/api/v1/kv/foo", "text/plain", bytes.NewBufferString("bar"))
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	require.Eventually(t, func() bool { return db.WriteStall().Rejected >= 2 }, time.Second, time.Millisecond)
+	tx.Rollback()
+	require.NoError(t, <-waiter)
+	require.Equal(t, http.StatusCreated, <-status, "the stall is retried")
+	value, found := Get(db, "foo")
+	require.True(t, found)
+	require.Equal(t, "bar", value)
+}
+
+func TestValueChecksums(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).WithValueChecksums(true, true)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	srv.ready.Store(true)
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	put := func(key string, body io.Reader, checksum string) int {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/v1/kv/"+key, body)
+		require.NoError(t, err)
+		if checksum != "" {
+			req.Header.Set(checksumHeader, checksum)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	get := func(key string) (*http.Response, GetResponse) {
+		resp, err := http.Get(ts.URL + "/api/v1/kv/" + key)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var getResponse GetResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&getResponse))
+		return resp, getResponse
+	}
+
+	small := "bar"
+	large := strings.Repeat("x", 3*storage.BTreePageSize)
+	for key, value := range map[string]string{"small": small, "large": large} {
+		checksum := formatChecksum(storage.ValueChecksum([]byte(value)))
+		require.Equal(t, http.StatusCreated, put(key, strings.NewReader(value), checksum))
+		resp, getResponse := get(key)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, value, getResponse.Value)
+		require.Equal(t, checksum, getResponse.Checksum)
+		require.Equal(t, `"`+checksum+`"`, resp.Header.Get("ETag"))
+		require.Equal(t, checksum, resp.Header.Get(checksumHeader))
+
+		// a mismatch is refused before the commit, the stored value stays
+		require.Equal(t, http.StatusUnprocessableEntity, put(key, strings.NewReader("other"), checksum))
+		// a body of unknown length is checked too
+		require.Equal(t, http.StatusUnprocessableEntity, put(key, io.MultiReader(strings.NewReader("other")), checksum))
+		_, getResponse = get(key)
+		require.Equal(t, value, getResponse.Value)
+	}
+	require.Equal(t, http.StatusBadRequest, put("small", strings.NewReader(small), "not hex"))
+	require.Equal(t, http.StatusCreated, put("plain", strings.NewReader(small), ""))
+}
+
+func TestCompactBlobs(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	db := srv.DBs.Primary()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, Put(db, fmt.Sprintf("blob-%d", i), strings.Repeat("v", 3*storage.BTreePageSize), labeled("test")))
+	}
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	compact := func(body string) (int, CompactBlobsResponse) {
+		resp, err := http.Post(ts.URL+"/api/v1/admin/compact-blobs", "application/json", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var compactResp CompactBlobsResponse
+		_ = json.NewDecoder(resp.Body).Decode(&compactResp)
+		return resp.StatusCode, compactResp
+	}
+	status, resp := compact(`{"bucket":"main","max_bytes":1048576}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, CompactBlobsResponse{Bucket: "main", ChainsScanned: 3, Complete: true, Status: "ok"}, resp)
+	status, _ = compact(`{"bucket":"missing"}`)
+	require.Equal(t, http.StatusNotFound, status)
+	status, _ = compact(`{"bucket":"main","max_bytes":-1}`)
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestCanary(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	fp := storage.NewFailpoints()
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).WithFailpoints(fp)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR"},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	srv.ready.Store(true)
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	ready := func() (int, HealthResponse) {
+		resp, err := http.Get(ts.URL + "/health/ready")
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var health HealthResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		return resp.StatusCode, health
+	}
+	srv.checkCanaries()
+	status, health := ready()
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "ok", health.Status)
+	require.True(t, health.Canary[defaultDBName].OK)
+	require.False(t, health.Canary[defaultDBName].At.IsZero())
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(HealthBucket)
+		require.NoError(t, err)
+		_, found := bucket.Get(canaryKey)
+		require.False(t, found, "the canary key is deleted")
+		return nil
+	}))
+
+	fp.Enable(storage.FailpointSync, func(int) error { return errors.New("input/output error") })
+	srv.checkCanaries()
+	status, health = ready()
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "canary_failed", health.Status)
+	require.False(t, health.Canary[defaultDBName].OK)
+	require.Contains(t, health.Error, defaultDBName+": ")
+	require.Contains(t, health.Error, "input/output error")
+
+	// the next run clears the failure
+	fp.Disable(storage.FailpointSync)
+	srv.checkCanaries()
+	status, health = ready()
+	require.Equal(t, http.StatusOK, status)
+	require.Empty(t, health.Canary[defaultDBName].Error)
+}
+
+func TestBucketRetention(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	setRetention := func(bucket string, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/api/v1/buckets/"+bucket+"/retention", bytes.NewBufferString(body))
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	require.Equal(t, http.StatusNotFound, setRetention("events", `{"retain_for":"30d"}`).StatusCode)
+
+	// events written one per day over the last 40 days
+	db := srv.DBs.Primary()
+	now := time.Now()
+	require.NoError(t, db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucket([]byte("events"))
+		if err != nil {
+			return err
+		}
+		for age := 0; age < 40; age++ {
+			written := now.Add(-time.Duration(age)*24*time.Hour - time.Minute)
+			key := append(keys.Uint64(keys.ClockTimestamp(written)), keys.Uint64(uint64(age))...)
+			if err = bucket.Put(key, []byte("event")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	for _, body := range []string{`{"retain_for":"30x"}`, `{"retain_for":"-1d"}`, `{"retain_for":"30d","keys":"uuid"}`} {
+		require.Equal(t, http.StatusBadRequest, setRetention("events", body).StatusCode, body)
+	}
+	resp := setRetention("events", `{"retain_for":"30d"}`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var retentionResp BucketRetentionResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&retentionResp))
+	require.Equal(t, BucketRetentionResponse{Bucket: "events", RetainForSeconds: 30 * 24 * 3600, Keys: "generated", Status: "ok"}, retentionResp)
+
+	resp, err := http.Post(ts.URL+"/api/v1/admin/retention", "application/json", nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var sweepResp RetentionSweepResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&sweepResp))
+	_ = resp.Body.Close()
+	require.Len(t, sweepResp.Buckets, 1)
+	require.Equal(t, "events", sweepResp.Buckets[0].Bucket)
+	require.Equal(t, 10, sweepResp.Buckets[0].Removed)
+	require.True(t, sweepResp.Buckets[0].Complete)
+
+	// the last sweep is reported with the bucket stats
+	resp, err = http.Get(ts.URL + "/api/v1/buckets?with_stats=true")
+	require.NoError(t, err)
+	var listResp BucketListResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&listResp))
+	_ = resp.Body.Close()
+	i := slices.IndexFunc(listResp.Buckets, func(entry BucketListEntry) bool { return entry.Name == "events" })
+	require.GreaterOrEqual(t, i, 0)
+	stats := listResp.Buckets[i].Stats
+	require.EqualValues(t, 30, stats.ItemsN)
+	require.Equal(t, 30*24*time.Hour, stats.RetainFor)
+	require.NotNil(t, stats.LastSweep)
+	require.Equal(t, 10, stats.LastSweep.Removed)
+}
+
+func TestMigrateCommand(t *testing.T) {
+	golden, err := os.ReadFile("../../storage/testdata/format_0.2.db")
+	require.NoError(t, err)
+	filename := storage.TempFileName(".db")
+	txLog := storage.TempFileName(".tlog")
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLog)
+		_ = os.Remove(filename + ".meta-0.2.bak")
+	})
+	require.NoError(t, os.WriteFile(filename, golden, 0600))
+
+	_, err = storage.Open(filename, storage.DefaultOptions().WithTxLogPath(txLog))
+	require.ErrorIs(t, err, storage.ErrMigrationRequired)
+	require.Contains(t, openErrorHint(err), "pirindb migrate")
+
+	var out bytes.Buffer
+	cmd := newMigrateCmd()
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{filename, "--tx-log", txLog})
+	require.NoError(t, cmd.Execute())
+	require.Contains(t, out.String(), "0.3      freelist ranges")
+	require.Regexp(t, `Done, \d+ steps`, out.String())
+
+	out.Reset()
+	require.NoError(t, cmd.Execute())
+	require.Contains(t, out.String(), "nothing to do")
+	// a file of an older format is refused, the migrated one opens
+	db, err := storage.Open(filename, storage.DefaultOptions().WithTxLogPath(txLog))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestReservedDBNames(t *testing.T) {
+	reserved := dbRouteSegments()
+	for _, name := range []string{"kv", "mget", "batch", "loads", "uploads", "locks", "buckets", "tx", "admin", "db", "usage"} {
+		require.True(t, reserved[name], name)
+	}
+	require.False(t, reserved["orders"])
+	require.False(t, reserved[""])
+}
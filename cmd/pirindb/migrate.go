@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/timson/pirindb/storage"
+)
+
+// newMigrateCmd runs the format migrations of a database file offline, the server must not
+// have the file open
+func newMigrateCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate <file>",
+		Short: "Upgrade a database file to the format of this build",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			txLog, _ := cmd.Flags().GetString("tx-log")
+			return runMigrate(cmd, args[0], txLog)
+		},
+	}
+	cmd.Flags().String("tx-log", "", "tx log of the database, the file name with .tlog if empty")
+	return cmd
+}
+
+func runMigrate(cmd *cobra.Command, filename string, txLog string) error {
+	out := cmd.OutOrStdout()
+	_, _ = fmt.Fprintf(out, "Migrating %s\n", filename)
+	opts := storage.DefaultOptions().WithTxLogPath(txLog)
+	steps, err := storage.Migrate(filename, opts, func(step storage.MigrationStep) {
+		_, _ = fmt.Fprintf(out, "  [%d/%d] %-8s %-24s %v\n", step.Step, step.Steps, step.Version, step.Name,
+			step.Duration.Round(time.Millisecond))
+	})
+	if err != nil {
+		if hint := openErrorHint(err); hint != "" {
+			return fmt.Errorf("%w\n  %s", err, hint)
+		}
+		return err
+	}
+	if steps == 0 {
+		_, _ = fmt.Fprintln(out, "Already at the current format, nothing to do")
+		return nil
+	}
+	_, _ = fmt.Fprintf(out, "Done, %d steps\n", steps)
+	return nil
+}
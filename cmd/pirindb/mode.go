@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+// NodeMode selects the requests a node serves, it is set at runtime with POST /api/v1/admin/mode
+// and survives restarts
+type NodeMode string
+
+const (
+	ModeReadWrite NodeMode = "read_write"
+	// ModeReadOnly refuses mutating requests, reads are served
+	ModeReadOnly NodeMode = "read_only"
+	// ModeMaintenance refuses every request except health checks, cluster and admin endpoints
+	ModeMaintenance NodeMode = "maintenance"
+)
+
+var (
+	// NodeBucket holds node settings changed at runtime in the primary database
+	NodeBucket = []byte(storage.InternalBucketPrefix + "node")
+	modeKey    = []byte("mode")
+)
+
+func (mode NodeMode) valid() bool {
+	return mode == ModeReadWrite || mode == ModeReadOnly || mode == ModeMaintenance
+}
+
+// acceptsWrites reports whether a node in the mode serves mutating requests, an empty mode
+// is advertised by nodes that predate modes
+func (mode NodeMode) acceptsWrites() bool {
+	return mode == ModeReadWrite || mode == ""
+}
+
+type ModeRequest struct {
+	Mode NodeMode `json:"mode"`
+}
+
+type ModeResponse struct {
+	Mode   NodeMode `json:"mode"`
+	Status string   `json:"status"`
+}
+
+// LoadMode returns the mode persisted in the database, false if it was never set
+func LoadMode(db *storage.DB) (NodeMode, bool, error) {
+	value, err := db.Get(NodeBucket, modeKey)
+	if errors.Is(err, storage.ErrKeyNotFound) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if mode := NodeMode(value); mode.valid() {
+		return mode, true, nil
+	}
+	return "", false, errors.New("invalid persisted mode: " + string(value))
+}
+
+// SaveMode persists the mode in the database
+func SaveMode(db *storage.DB, mode NodeMode) error {
+	return db.Put(NodeBucket, modeKey, []byte(mode))
+}
+
+// initMode applies the persisted mode, or the configured one if it was never set at runtime
+func (srv *Server) initMode() {
+	mode := ModeReadWrite
+	if srv.Config.Server.Mode != "" {
+		mode = srv.Config.Server.Mode
+	}
+	persisted, found, err := LoadMode(srv.DBs.Primary())
+	if err != nil {
+		srv.Logger.Error("failed to load persisted mode", "mode", mode, "error", err)
+	} else if found {
+		mode = persisted
+	}
+	srv.mode.Store(mode)
+	if mode != ModeReadWrite {
+		srv.Logger.Warn("node is not writable", "mode", mode)
+	}
+}
+
+// Mode returns the current mode of the node
+func (srv *Server) Mode() NodeMode {
+	return srv.mode.Load().(NodeMode)
+}
+
+// SetMode persists the mode and applies it, in a cluster the ring with the new mode of
+// the node is pushed to the other members so they stop forwarding refused requests
+func (srv *Server) SetMode(ctx context.Context, mode NodeMode) error {
+	if err := SaveMode(srv.DBs.Primary(), mode); err != nil {
+		return err
+	}
+	previous := srv.Mode()
+	srv.mode.Store(mode)
+	srv.Logger.Info("node mode changed", "mode", mode, "previous", previous)
+	if !srv.clusterEnabled() || !srv.ready.Load() {
+		return nil
+	}
+	srv.Ring.Add(srv.selfShard())
+	shards := srv.Ring.Shards()
+	if err := SaveRing(srv.DBs.Primary(), shards); err != nil {
+		return err
+	}
+	srv.pushRing(ctx, shards, "")
+	return nil
+}
+
+// modeExempt reports whether the path is served in every mode: health checks, the ring
+// exchanged between nodes and admin endpoints
+func (srv *Server) modeExempt(path string) bool {
+	if strings.HasPrefix(path, "/health") || strings.HasPrefix(path, "/cluster/") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "/api/v1/")
+	if !ok {
+		return false
+	}
+	// per database routes are mounted under /{db} too
+	if name, after, found := strings.Cut(rest, "/"); found {
+		if _, isDB := srv.DBs.Get(name); isDB && name != "" {
+			rest = after
+		}
+	}
+	return strings.HasPrefix(rest, "admin/")
+}
+
+// isMutating reports whether the request may change data, every route changing data
+// uses POST, PUT or DELETE
+func isMutating(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// enforceMode refuses requests the node mode does not serve with 503
+func (srv *Server) enforceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := srv.Mode()
+		if mode == ModeReadWrite || srv.modeExempt(r.URL.Path) || (mode == ModeReadOnly && !isMutating(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		_ = render.Render(w, r, ErrModeResponse(mode))
+	})
+}
+
+// requireAdmin checks the bearer token of admin requests when server.admin_token is set
+func (srv *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := srv.Config.Server.AdminToken
+		if token != "" {
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				_ = render.Render(w, r, ErrUnauthorized())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (srv *Server) handleGetMode(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, &ModeResponse{Mode: srv.Mode(), Status: "ok"})
+}
+
+func (srv *Server) handleSetMode(w http.ResponseWriter, r *http.Request) {
+	var req ModeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !req.Mode.valid() {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	err := srv.SetMode(r.Context(), req.Mode)
+	if errors.Is(err, storage.ErrWriteStalled) {
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	}
+	if err != nil {
+		srv.Logger.Error("failed to set mode", "mode", req.Mode, "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &ModeResponse{Mode: req.Mode, Status: "ok"})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// modeRequest sends a request and returns the status code and the error code of the body
+func modeRequest(t *testing.T, method, url, body, token string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var errResp ErrResponse
+	_ = json.NewDecoder(resp.Body).Decode(&errResp)
+	return resp.StatusCode, errResp.Code
+}
+
+func TestNodeMode(t *testing.T) {
+	node := startTestNode(t, "node1", &ClusterConfig{})
+	node.srv.Config.Cluster = nil // a single node
+	node.srv.Config.Server.AdminToken = "secret"
+	node.srv.ready.Store(true)
+	url := node.ts.URL
+	require.Equal(t, ModeReadWrite, node.srv.Mode())
+	status, _ := modeRequest(t, http.MethodPost, url+"/api/v1/kv/foo", "bar", "")
+	require.Equal(t, http.StatusCreated, status)
+
+	status, code := modeRequest(t, http.MethodPost, url+"/api/v1/admin/mode", `{"mode":"read_only"}`, "")
+	require.Equal(t, http.StatusUnauthorized, status)
+	require.Equal(t, "unauthorized", code)
+	status, _ = modeRequest(t, http.MethodPost, url+"/api/v1/admin/mode", `{"mode":"other"}`, "secret")
+	require.Equal(t, http.StatusBadRequest, status)
+	status, _ = modeRequest(t, http.MethodPost, url+"/api/v1/admin/mode", `{"mode":"read_only"}`, "secret")
+	require.Equal(t, http.StatusOK, status)
+
+	// read only: writes are refused, reads are served
+	status, code = modeRequest(t, http.MethodPost, url+"/api/v1/kv/foo", "baz", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "read_only", code)
+	status, _ = modeRequest(t, http.MethodDelete, url+"/api/v1/kv/foo", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = modeRequest(t, http.MethodGet, url+"/api/v1/kv/foo", "", "")
+	require.Equal(t, http.StatusOK, status)
+	value, _ := Get(node.srv.DBs.Primary(), "foo")
+	require.Equal(t, "bar", value)
+	var health HealthResponse
+	resp, err := http.Get(url + "/health/ready")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+	_ = resp.Body.Close()
+	require.Equal(t, HealthResponse{Status: "read_only", Mode: ModeReadOnly}, health)
+
+	// maintenance: reads are refused too, health and admin endpoints are served
+	status, _ = modeRequest(t, http.MethodPost, url+"/api/v1/admin/mode", `{"mode":"maintenance"}`, "secret")
+	require.Equal(t, http.StatusOK, status)
+	status, code = modeRequest(t, http.MethodGet, url+"/api/v1/kv/foo", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "maintenance", code)
+	status, _ = modeRequest(t, http.MethodGet, url+"/api/v1/kv", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = modeRequest(t, http.MethodGet, url+"/health/ready", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = modeRequest(t, http.MethodGet, url+"/health", "", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = modeRequest(t, http.MethodGet, url+"/api/v1/admin/mode", "", "secret")
+	require.Equal(t, http.StatusOK, status)
+
+	// the mode survives a restart and overrides the configured one
+	restarted := NewServer(node.srv.Config, node.srv.DBs.Primary(), node.srv.Logger)
+	require.Equal(t, ModeMaintenance, restarted.Mode())
+	ts := httptest.NewServer(restarted.buildRouter())
+	t.Cleanup(ts.Close)
+	status, _ = modeRequest(t, http.MethodGet, ts.URL+"/api/v1/kv/foo", "", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	status, _ = modeRequest(t, http.MethodPost, ts.URL+"/api/v1/admin/mode", `{"mode":"read_write"}`, "secret")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = modeRequest(t, http.MethodPost, ts.URL+"/api/v1/kv/foo", "baz", "")
+	require.Equal(t, http.StatusCreated, status)
+}
+
+func TestNodeModeCluster(t *testing.T) {
+	seed := startTestNode(t, "node1", &ClusterConfig{})
+	require.NoError(t, seed.srv.Bootstrap(context.Background()))
+	node := startTestNode(t, "node2", &ClusterConfig{SeedURL: seed.ts.URL})
+	require.NoError(t, node.srv.Bootstrap(context.Background()))
+
+	require.NoError(t, node.srv.SetMode(context.Background(), ModeReadOnly))
+	for _, shard := range seed.srv.Ring.Shards() {
+		if shard.Name == "node2" {
+			require.Equal(t, string(ModeReadOnly), shard.Mode)
+		}
+	}
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if candidate := fmt.Sprintf("key-%d", i); seed.srv.Ring.GetShard(candidate).Name == "node2" {
+			key = candidate
+		}
+	}
+	// the seed refuses a write owned by the read only node instead of forwarding it
+	status, code := modeRequest(t, http.MethodPost, seed.ts.URL+"/api/v1/kv/"+key, "value", "")
+	require.Equal(t, http.StatusServiceUnavailable, status)
+	require.Equal(t, "read_only", code)
+	status, _ = modeRequest(t, http.MethodGet, seed.ts.URL+"/api/v1/kv/"+key, "", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// a ring pushed back to the node keeps its own mode
+	require.NoError(t, node.srv.syncRing(seed.srv.Ring.Shards()))
+	for _, shard := range node.srv.Ring.Shards() {
+		if shard.Name == "node2" {
+			require.Equal(t, string(ModeReadOnly), shard.Mode)
+		}
+	}
+	require.NoError(t, node.srv.SetMode(context.Background(), ModeReadWrite))
+	status, _ = modeRequest(t, http.MethodPost, seed.ts.URL+"/api/v1/kv/"+key, "value", "")
+	require.Equal(t, http.StatusCreated, status)
+}
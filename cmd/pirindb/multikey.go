@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+// MGetItem is a key of an mget response, items keep the order of the request
+type MGetItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Found bool   `json:"found"`
+}
+
+type MGetResponse struct {
+	Items  []MGetItem `json:"items"`
+	Status string     `json:"status"`
+}
+
+type BatchItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type BatchRequest struct {
+	Items []BatchItem `json:"items"`
+}
+
+type BatchResponse struct {
+	Stored int    `json:"stored"`
+	Status string `json:"status"`
+	// Transforms lists by key the transforms of the main bucket that ran, keys without any are left out
+	Transforms map[string][]string `json:"transforms,omitempty"`
+}
+
+// handleMGet reads the keys given as repeated key parameters, a missing key is reported in
+// its item. In a cluster the keys may be owned by other shards, the request is refused and
+// clients read key by key.
+func (srv *Server) handleMGet(w http.ResponseWriter, r *http.Request) {
+	if srv.clusterEnabled() {
+		_ = render.Render(w, r, ErrMultiKeyInCluster())
+		return
+	}
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	keys := r.URL.Query()["key"]
+	if len(keys) == 0 || len(keys) > maxMGetKeys {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	items := make([]MGetItem, 0, len(keys))
+	for _, key := range keys {
+		value, found, err := Lookup(db, key)
+		switch {
+		case errors.Is(err, storage.ErrTooManyReaders):
+			_ = render.Render(w, r, ErrTooManyReaders())
+			return
+		case errors.Is(err, storage.ErrChecksumMismatch):
+			srv.Logger.Error("stored value does not match its checksum", "key", srv.redactKey(key), "error", err)
+			_ = render.Render(w, r, ErrValueCorrupted())
+			return
+		case err != nil:
+			_ = render.Render(w, r, ErrInternalServerError())
+			return
+		}
+		items = append(items, MGetItem{Key: key, Value: value, Found: found})
+	}
+	render.JSON(w, r, &MGetResponse{Items: items, Status: "ok"})
+}
+
+// handleBatch stores the items of a JSON body in one transaction, the body is limited by the
+// value size limit. It is refused in a cluster as mget is.
+func (srv *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	if srv.clusterEnabled() {
+		_ = render.Render(w, r, ErrMultiKeyInCluster())
+		return
+	}
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	defer func() {
+		_ = r.Body.Close()
+	}()
+	var req BatchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	}
+	if err != nil || len(req.Items) == 0 || len(req.Items) > maxBatchItems {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	for _, item := range req.Items {
+		if item.Key == "" {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	var transformed map[string][]string
+	if chain := srv.transformChain(r, string(DBBucket)); chain != nil {
+		if transformed, err = transformBatch(req.Items, chain); err != nil {
+			_ = render.Render(w, r, ErrTransformFailed(err))
+			return
+		}
+	}
+	err = PutBatch(db, req.Items, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrKeyTooLarge):
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case errors.Is(err, storage.ErrValueTooLarge) || errors.Is(err, storage.ErrBlobTooLarge):
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		_ = render.Render(w, r, ErrQuotaExceeded(err))
+		return
+	case errors.Is(err, storage.ErrValueRejected):
+		_ = render.Render(w, r, ErrValueRejected(err))
+		return
+	case errors.Is(err, storage.ErrPrefixExpired):
+		_ = render.Render(w, r, ErrPrefixExpired())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &BatchResponse{Stored: len(req.Items), Status: "ok", Transforms: transformed})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func postBatch(t *testing.T, url string, items []BatchItem) *http.Response {
+	t.Helper()
+	body, err := json.Marshal(&BatchRequest{Items: items})
+	require.NoError(t, err)
+	resp, err := http.Post(url+"/api/v1/batch", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func TestMGetBatch(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	resp := postBatch(t, ts.URL, []BatchItem{{"a", "1"}, {"b", "2\t2"}, {"c", ""}})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var stored BatchResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stored))
+	require.Equal(t, 3, stored.Stored)
+
+	resp, err := http.Get(ts.URL + "/api/v1/mget?key=b&key=missing&key=a&key=c")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var got MGetResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+	require.Equal(t, []MGetItem{
+		{Key: "b", Value: "2\t2", Found: true},
+		{Key: "missing"},
+		{Key: "a", Value: "1", Found: true},
+		{Key: "c", Found: true},
+	}, got.Items)
+
+	// a batch is one transaction, a failed item stores none of them
+	resp = postBatch(t, ts.URL, []BatchItem{{"d", "4"}, {strings.Repeat("k", 1000), "5"}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_, found := Get(srv.DBs.Primary(), "d")
+	require.False(t, found)
+	resp = postBatch(t, ts.URL, []BatchItem{{"", "1"}})
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	for _, query := range []string{"", "?key=" + strings.Repeat("a&key=", maxMGetKeys) + "a"} {
+		resp, err = http.Get(ts.URL + "/api/v1/mget" + query)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode, query)
+	}
+
+	// the keys may be owned by other shards
+	node := startTestNode(t, "node1", &ClusterConfig{})
+	resp, err = http.Get(node.ts.URL + "/api/v1/mget?key=a")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = postBatch(t, node.ts.URL, []BatchItem{{"a", "1"}})
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/timeseries"
+)
+
+// partitionedBucket is a logical bucket stored as one bucket per time window, see
+// PartitionConfig
+type partitionedBucket struct {
+	partition timeseries.Partition
+	retain    time.Duration // 0 keeps every window
+}
+
+// setupPartitions reads the partitioned buckets of the config, loadConfig validated them
+func (srv *Server) setupPartitions() {
+	if srv.partitions != nil {
+		return
+	}
+	srv.partitions = make(map[string]*partitionedBucket, len(srv.Config.Buckets))
+	for name, cfg := range srv.Config.Buckets {
+		if cfg.Partition == "" {
+			continue
+		}
+		retain, _ := parseRetention(cfg.Retain) // an empty retain fails to parse and keeps 0
+		srv.partitions[name] = &partitionedBucket{partition: timeseries.Partition(cfg.Partition), retain: retain}
+	}
+}
+
+// writeBucket returns the bucket a write to the named bucket goes to now, the window bucket
+// of a partitioned bucket
+func (srv *Server) writeBucket(name string) string {
+	if pb := srv.partitions[name]; pb != nil {
+		return timeseries.BucketName(name, pb.partition, time.Now())
+	}
+	return name
+}
+
+// logicalBucket returns the partitioned bucket a bucket is a window of, the name itself for
+// other buckets
+func (srv *Server) logicalBucket(bucket string) (string, bool) {
+	for name, pb := range srv.partitions {
+		if bucket == name {
+			return name, true
+		}
+		if _, ok := timeseries.ParseBucketName(name, pb.partition, bucket); ok {
+			return name, true
+		}
+	}
+	return bucket, false
+}
+
+// listBuckets lists a page of buckets as ListBuckets does with the windows of a partitioned
+// bucket listed as the bucket, their stats summed. The windows sort right after the bucket
+// name: a page ending within them is extended to the last one, and a next cursor naming the
+// bucket starts the following page after its windows.
+func (srv *Server) listBuckets(db *storage.DB, startAfter string, limit int) ([]storage.NamedBucketStat, string, error) {
+	if _, ok := srv.partitions[startAfter]; ok {
+		startAfter += "_~" // window names are digits and underscores, all below '~'
+	}
+	stats, next, err := ListBuckets(db, startAfter, limit)
+	if err != nil || len(srv.partitions) == 0 {
+		return stats, next, err
+	}
+	for next != "" {
+		name, partitioned := srv.logicalBucket(next)
+		if !partitioned {
+			break
+		}
+		more, moreNext, err := ListBuckets(db, next, limit)
+		if err != nil {
+			return nil, "", err
+		}
+		windows := 0
+		for ; windows < len(more); windows++ {
+			if logical, _ := srv.logicalBucket(more[windows].Name); logical != name {
+				break
+			}
+		}
+		stats = append(stats, more[:windows]...)
+		next = moreNext
+		if windows < len(more) {
+			next = name
+			break
+		}
+	}
+
+	collapsed := stats[:0:0]
+	for _, stat := range stats {
+		name, partitioned := srv.logicalBucket(stat.Name)
+		if !partitioned {
+			collapsed = append(collapsed, stat)
+			continue
+		}
+		if last := len(collapsed) - 1; last >= 0 && collapsed[last].Name == name {
+			collapsed[last].ItemsN += stat.ItemsN
+			collapsed[last].BlobsN += stat.BlobsN
+			collapsed[last].BytesInUse += stat.BytesInUse
+			continue
+		}
+		collapsed = append(collapsed, storage.NamedBucketStat{Name: name, BucketStat: storage.BucketStat{
+			ItemsN: stat.ItemsN, BlobsN: stat.BlobsN, BytesInUse: stat.BytesInUse,
+		}})
+	}
+	return collapsed, next, nil
+}
+
+// errExportBatchFull stops the merged read of a partitioned export batch
+var errExportBatchFull = errors.New("export batch is full")
+
+// ExportPartitioned reads up to limit rows of the windows of a partitioned bucket in key
+// order starting at the key, a key written in several windows has the value of the newest
+func ExportPartitioned(db *storage.DB, name string, p timeseries.Partition, from []byte, limit int) ([]exportRow, error) {
+	rows := make([]exportRow, 0, limit)
+	err := timeseries.NewReader(db, name, p).Range(time.Time{}, time.Time{}, from, func(k, v []byte) error {
+		rows = append(rows, exportRow{key: bytes.Clone(k), value: bytes.Clone(v)})
+		if len(rows) == limit {
+			return errExportBatchFull
+		}
+		return nil
+	})
+	if errors.Is(err, errExportBatchFull) {
+		err = nil
+	}
+	return rows, err
+}
+
+// expirePartitions drops the windows of the partitioned buckets past their retention
+func (srv *Server) expirePartitions(dbName string, db *storage.DB, now time.Time) {
+	for name, pb := range srv.partitions {
+		if pb.retain == 0 {
+			continue
+		}
+		dropped, err := timeseries.Expire(db, name, pb.partition, pb.retain, now)
+		if err != nil {
+			srv.Logger.Error("Failed to drop expired partitions", "db", dbName, "bucket", name, "error", err)
+		} else if len(dropped) > 0 {
+			srv.Logger.Info("Dropped expired partitions", "db", dbName, "bucket", name, "partitions", dropped)
+		}
+	}
+}
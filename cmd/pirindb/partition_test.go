@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/timeseries"
+)
+
+func TestPartitionedBucket(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Buckets = map[string]*PartitionConfig{"events": {Partition: "daily", Retain: "30d"}}
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	db := srv.DBs.Primary()
+
+	old := time.Now().AddDate(0, 0, -40)
+	writer := timeseries.NewWriter(db, "events", timeseries.Daily)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writer.PutAt(old.AddDate(0, 0, i), []byte(fmt.Sprintf("old-%d", i)), []byte(`{"n":1}`)))
+	}
+	require.NoError(t, db.Put([]byte("alpha"), []byte("k"), []byte("v")))
+	require.NoError(t, db.Put([]byte("zulu"), []byte("k"), []byte("v")))
+
+	resp, err := http.Post(ts.URL+"/api/v1/buckets/events/append", "application/json", strings.NewReader(`{"n":2}`))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	value, err := timeseries.NewReader(db, "events", timeseries.Daily).Get([]byte("old-0"))
+	require.NoError(t, err)
+	require.Equal(t, `{"n":1}`, string(value))
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		windows := timeseries.Windows(tx, "events", timeseries.Daily)
+		require.Len(t, windows, 4)
+		require.Equal(t, timeseries.BucketName("events", timeseries.Daily, time.Now()), windows[3].Bucket)
+		return nil
+	}))
+
+	// the windows are listed as the logical bucket, also when a page ends within them
+	var names []string
+	var events *storage.BucketStat
+	next := ""
+	for {
+		resp, err := http.Get(ts.URL + "/api/v1/buckets?limit=2&with_stats=true&start_after=" + url.QueryEscape(next))
+		require.NoError(t, err)
+		var page BucketListResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+		_ = resp.Body.Close()
+		for _, entry := range page.Buckets {
+			names = append(names, entry.Name)
+			if entry.Name == "events" {
+				events = entry.Stats
+			}
+		}
+		if page.Next == "" {
+			break
+		}
+		require.NotContains(t, page.Next, "events_")
+		next = page.Next
+	}
+	require.Equal(t, []string{"alpha", "events", "zulu"}, names)
+	require.NotNil(t, events)
+	require.Equal(t, uint64(4), events.ItemsN)
+
+	resp, err = http.Get(ts.URL + "/api/v1/buckets/events/export?format=ndjson")
+	require.NoError(t, err)
+	rows := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		rows++
+	}
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, 4, rows)
+
+	// windows ending more than 30 days ago are dropped, the current one stays
+	srv.expirePartitions(srv.DBs.PrimaryName(), db, time.Now())
+	require.NoError(t, db.View(func(tx *storage.Tx) error {
+		require.Len(t, timeseries.Windows(tx, "events", timeseries.Daily), 1)
+		return nil
+	}))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+)
+
+// rawChunkSize is how much of a value is read from the database per write to the client
+const rawChunkSize = 64 * 1024
+
+// wantsRawValue reports whether a GET asks for the value bytes instead of the JSON document
+func wantsRawValue(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == "application/octet-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// byteRange is the part of a value a Range header asks for
+type byteRange struct {
+	start, length int64
+}
+
+// errRangeNotSatisfiable is returned for a range starting past the end of the value
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange reads a Range header with a single bytes range: a-b, a- or the suffix -n. nil
+// means the whole value, for a missing header and for the forms the server does not serve,
+// such as several ranges, which may be ignored.
+func parseRange(header string, size int64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return &byteRange{start: size - n, length: n}, nil
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return nil, nil
+		}
+	}
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	end = min(end, size-1)
+	return &byteRange{start: start, length: end - start + 1}, nil
+}
+
+// etagMatches reports whether an If-None-Match header lists the entity tag, weak tags
+// compare as strong ones
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGetRaw serves GET /kv/{key} with Accept: application/octet-stream. The value is sent
+// as is with its Content-Length, a Range header selects a part of it and If-None-Match is
+// answered with 304 from the checksum in the key's item, without reading blob pages. The value
+// is read in one read transaction in rawChunkSize parts and is not verified against its
+// checksum. A large value for a slow client is cut off when the transaction outlives
+// server.max_reader_duration.
+func (srv *Server) handleGetRaw(w http.ResponseWriter, r *http.Request, db *storage.DB, key string) {
+	errRendered := errors.New("response rendered")
+	started := false
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		sum, ok, err := bucket.Checksum([]byte(key))
+		if err != nil {
+			return err
+		}
+		if ok {
+			etag := `"` + formatChecksum(sum) + `"`
+			w.Header().Set("ETag", etag)
+			w.Header().Set(checksumHeader, formatChecksum(sum))
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return errRendered
+			}
+		}
+		info, found, err := bucket.Info([]byte(key))
+		if err != nil {
+			return err
+		}
+		if !found {
+			return storage.ErrKeyNotFound
+		}
+		size := int64(info.Size)
+		part, err := parseRange(r.Header.Get("Range"), size)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return err
+		}
+		status := http.StatusOK
+		if part == nil {
+			part = &byteRange{length: size}
+		} else {
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", part.start, part.start+part.length-1, size))
+		}
+		// byte offsets refer to the stored value, the response is never encoded
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(part.length, 10))
+		w.WriteHeader(status)
+		started = true
+
+		buf := make([]byte, min(part.length, rawChunkSize))
+		for offset := part.start; offset < part.start+part.length; {
+			n, err := bucket.ReadAt([]byte(key), buf[:min(int64(len(buf)), part.start+part.length-offset)], offset)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			if n == 0 {
+				return fmt.Errorf("value ended at %d bytes", offset)
+			}
+			if _, err = w.Write(buf[:n]); err != nil {
+				return errRendered // the client is gone
+			}
+			offset += int64(n)
+		}
+		return nil
+	})
+	switch {
+	case err == nil || errors.Is(err, errRendered):
+	case started:
+		// the status is sent already, the client sees a body shorter than its Content-Length
+		srv.Logger.Error("failed to send value", "key", srv.redactKey(key), "error", err)
+	case errors.Is(err, errRangeNotSatisfiable):
+		_ = render.Render(w, r, ErrRangeNotSatisfiable())
+	case errors.Is(err, storage.ErrBucketNotFound) || errors.Is(err, storage.ErrKeyNotFound):
+		_ = render.Render(w, r, ErrNotFound(srv.redactKey(key)))
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+	default:
+		_ = render.Render(w, r, ErrInternalServerError())
+	}
+}
+
+// handleGetPreview serves the JSON GET of a value above the JSON limit or the max_bytes query
+// parameter: without max_bytes it is refused with 413, with it the first max_bytes bytes are
+// returned with truncated set and the size of the whole value. The size is read from the item,
+// the value is not loaded. It returns false when the value fits and the JSON path sends it.
+func (srv *Server) handleGetPreview(w http.ResponseWriter, r *http.Request, db *storage.DB, key string) bool {
+	limit := srv.Config.Server.MaxJSONValueSize
+	maxBytes := int64(-1)
+	if value := r.URL.Query().Get("max_bytes"); value != "" {
+		var err error
+		if maxBytes, err = strconv.ParseInt(value, 10, 64); err != nil || maxBytes < 0 {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return true
+		}
+	}
+	if limit == 0 && maxBytes < 0 {
+		return false
+	}
+	budget := maxBytes
+	if limit > 0 && (budget < 0 || budget > limit) {
+		budget = limit // a preview is never larger than the limit
+	}
+
+	var preview []byte
+	var size int64
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		info, found, err := bucket.Info([]byte(key))
+		if err != nil || !found || int64(info.Size) <= budget {
+			return err
+		}
+		size = int64(info.Size)
+		if maxBytes < 0 {
+			return nil
+		}
+		preview = make([]byte, budget)
+		n, err := bucket.ReadAt([]byte(key), preview, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		preview = preview[:n]
+		return nil
+	})
+	switch {
+	case errors.Is(err, storage.ErrTooManyReaders):
+		_ = render.Render(w, r, ErrTooManyReaders())
+		return true
+	case errors.Is(err, storage.ErrBucketNotFound):
+		return false
+	case err != nil:
+		_ = render.Render(w, r, ErrInternalServerError())
+		return true
+	case size == 0:
+		return false // missing or within the budget
+	case maxBytes < 0:
+		_ = render.Render(w, r, ErrValueTooLargeForJSON(size, limit))
+		return true
+	}
+	// a rune cut at the end would be replaced in the JSON string, the preview stops before it
+	for i := len(preview) - 1; i >= 0 && i >= len(preview)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(preview[i]) {
+			if !utf8.FullRune(preview[i:]) {
+				preview = preview[:i]
+			}
+			break
+		}
+	}
+	render.JSON(w, r, &GetResponse{Value: string(preview), Truncated: true, Size: size, Status: "ok"})
+	return true
+}
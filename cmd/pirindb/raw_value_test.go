@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestParseRange(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		part   *byteRange
+		err    error
+	}{
+		{"", nil, nil},
+		{"bytes=0-9", &byteRange{0, 10}, nil},
+		{"bytes=90-", &byteRange{90, 10}, nil},
+		{"bytes=95-200", &byteRange{95, 5}, nil},
+		{"bytes=-30", &byteRange{70, 30}, nil},
+		{"bytes=-300", &byteRange{0, 100}, nil},
+		{"bytes=100-", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		// forms that are not served ask for the whole value
+		{"bytes=0-1,5-6", nil, nil},
+		{"bytes=9-1", nil, nil},
+		{"items=0-1", nil, nil},
+		{"bytes=x-1", nil, nil},
+	} {
+		part, err := parseRange(tt.header, 100)
+		require.Equal(t, tt.err, err, tt.header)
+		require.Equal(t, tt.part, part, tt.header)
+	}
+}
+
+func TestGetRawValue(t *testing.T) {
+	filename := storage.TempFileName(".db")
+	opts := storage.DefaultOptions().WithTxLogPath(storage.TempFileName(".tlog")).WithValueChecksums(true, true)
+	db, err := storage.Open(filename, opts)
+	require.NoError(t, err)
+	cfg := &Config{
+		Server: &ServerConfig{Host: "127.0.0.1", LogLevel: "ERROR", Compression: true},
+		DB:     &DatabaseConfig{Filename: filename},
+	}
+	srv := NewServer(cfg, db, createLogger(cfg.Server.LogLevel))
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	value := make([]byte, 3*storage.BTreePageSize+500)
+	for i := range value {
+		value[i] = byte(i % 251)
+	}
+	require.NoError(t, Put(db, "blob", string(value), labeled("test")))
+	require.NoError(t, Put(db, "small", "small value", labeled("test")))
+
+	get := func(key string, headers ...string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/v1/kv/"+key, nil)
+		require.NoError(t, err)
+		req.Header.Set("Accept", "application/octet-stream")
+		// set by hand, the transport would decode the body otherwise
+		req.Header.Set("Accept-Encoding", "gzip")
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	resp, body := get("blob")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, value, body)
+	require.Equal(t, strconv.Itoa(len(value)), resp.Header.Get("Content-Length"))
+	require.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	require.Empty(t, resp.Header.Get("Content-Encoding"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// ranges across the end of the first and the second blob page
+	first := storage.BTreePageSize - 17
+	second := first + storage.BTreePageSize - 9
+	for _, part := range [][2]int{{first - 10, first + 10}, {0, first}, {first - 1, second + 1}, {second, len(value) - 1}} {
+		resp, body = get("blob", "Range", fmt.Sprintf("bytes=%d-%d", part[0], part[1]))
+		require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		require.Equal(t, value[part[0]:part[1]+1], body, part)
+		require.Equal(t, fmt.Sprintf("bytes %d-%d/%d", part[0], part[1], len(value)), resp.Header.Get("Content-Range"))
+		require.Equal(t, strconv.Itoa(part[1]-part[0]+1), resp.Header.Get("Content-Length"))
+	}
+
+	// a range reaching past the end is cut at it, one starting past it is refused
+	resp, body = get("blob", "Range", fmt.Sprintf("bytes=%d-%d", len(value)-5, len(value)+100))
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, value[len(value)-5:], body)
+	resp, body = get("blob", "Range", "bytes=-20")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, value[len(value)-20:], body)
+	resp, _ = get("blob", "Range", fmt.Sprintf("bytes=%d-", len(value)))
+	require.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+	require.Equal(t, fmt.Sprintf("bytes */%d", len(value)), resp.Header.Get("Content-Range"))
+	resp, body = get("small", "Range", "bytes=6-")
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	require.Equal(t, "value", string(body))
+
+	resp, body = get("blob", "If-None-Match", `"0000000000000000", `+etag)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Empty(t, body)
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+	resp, _ = get("blob", "If-None-Match", `"0000000000000000"`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp, _ = get("missing")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGetJSONValueLimit(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.MaxJSONValueSize = 2 * storage.BTreePageSize
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	db := srv.DBs.Primary()
+
+	large := strings.Repeat("x", 3*storage.BTreePageSize)
+	require.NoError(t, Put(db, "large", large, labeled("test")))
+	require.NoError(t, Put(db, "euros", strings.Repeat("€", storage.BTreePageSize), labeled("test")))
+	require.NoError(t, Put(db, "small", "value", labeled("test")))
+
+	get := func(path string) (int, map[string]any) {
+		resp, err := http.Get(ts.URL + "/api/v1/kv/" + path)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body
+	}
+
+	code, body := get("large")
+	require.Equal(t, http.StatusRequestEntityTooLarge, code)
+	require.Equal(t, "value_too_large", body["code"])
+	require.Contains(t, body["detail"], fmt.Sprintf("value of %d bytes", len(large)))
+
+	code, body = get("large?max_bytes=10")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "xxxxxxxxxx", body["value"])
+	require.Equal(t, true, body["truncated"])
+	require.Equal(t, float64(len(large)), body["size"])
+
+	// the preview stops before a rune it would cut, and is never above the limit
+	code, body = get(fmt.Sprintf("large?max_bytes=%d", len(large)-1))
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, strings.Repeat("x", 2*storage.BTreePageSize), body["value"])
+	_, body = get("euros?max_bytes=5")
+	require.Equal(t, "€", body["value"])
+	require.Equal(t, float64(3*storage.BTreePageSize), body["size"])
+
+	code, body = get("small?max_bytes=10")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "value", body["value"])
+	require.Nil(t, body["truncated"])
+	code, _ = get("small?max_bytes=-1")
+	require.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("missing?max_bytes=10")
+	require.Equal(t, http.StatusNotFound, code)
+
+	srv.Config.Server.MaxJSONValueSize = 0
+	code, body = get("large")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, large, body["value"])
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
+)
+
+// ReadRepairStats counts the reads of keys missing here that consulted the previous owner
+type ReadRepairStats struct {
+	Active   bool  `json:"active"`   // a ring change is in flight, misses consult the previous owner
+	Lookups  int64 `json:"lookups"`  // misses looked up on the previous owner
+	Repaired int64 `json:"repaired"` // values found there, served and written here
+	Skipped  int64 `json:"skipped"`  // values found there for keys deleted here during the lookup
+	Errors   int64 `json:"errors"`   // lookups that failed or timed out, the miss is served
+}
+
+// readRepairState holds the previous ring while a ring change is in flight. The change ends
+// when anti-entropy completes a run against the previous members, by then every key is
+// copied here. Without anti-entropy it lasts until the next change.
+type readRepairState struct {
+	lock       sync.Mutex
+	generation int                      // of the anti-entropy previous ring the change began with
+	ring       *sharding.ConsistentHash // nil when no change is in flight
+	tombstones map[string]struct{}      // keys deleted here since the change began
+	prefixes   []string                 // prefixes deleted here since the change began
+	full       bool                     // too many tombstones or a change of the whole bucket, repair stopped
+	hooked     bool                     // the commit hook of the primary database is registered
+	lookups    atomic.Int64
+	repaired   atomic.Int64
+	skipped    atomic.Int64
+	errors     atomic.Int64
+}
+
+// beginRingChange remembers the members of the ring before a membership change, anti-entropy
+// compares the ranges with them and reads missing here consult their owner
+func (srv *Server) beginRingChange(previous []*sharding.Shard) {
+	generation := srv.antiEntropy.setPrevious(previous)
+	var ring *sharding.ConsistentHash
+	if len(previous) > 0 {
+		ring = sharding.NewConsistentHash(srv.Config.Cluster.VirtualNodes)
+		ring.SetGroupDelimiter(srv.Config.Cluster.GroupDelimiter)
+		ring.Sync(previous)
+	}
+
+	state := &srv.readRepair
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.generation = generation
+	state.ring = ring
+	// keys deleted during a change that did not complete may still live on the members
+	if state.tombstones == nil {
+		state.tombstones = make(map[string]struct{})
+	}
+}
+
+// end stops read repair once the change began with generation is complete
+func (state *readRepairState) end(generation int) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.generation != generation {
+		return
+	}
+	state.ring = nil
+	state.tombstones = nil
+	state.prefixes = nil
+	state.full = false
+}
+
+// setupReadRepair registers the commit hook recording the tombstones of the primary database
+func (srv *Server) setupReadRepair() {
+	state := &srv.readRepair
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.hooked || !srv.clusterEnabled() {
+		return
+	}
+	state.hooked = true
+	srv.DBs.Primary().OnCommit(state.committed)
+}
+
+// committed records the keys a commit to the primary database removed while a ring change is
+// in flight, read repair never brings them back from the previous owner. Every delete goes
+// through it: DELETE requests, transaction sessions, retention and prefix expiry sweeps. A
+// change of the whole main bucket, like moving it to the trash, may delete any key.
+func (state *readRepairState) committed(event *storage.CommitEvent) {
+	removed := event.Removed[string(DBBucket)]
+	whole := slices.Contains(event.Buckets, string(DBBucket))
+	if len(removed) == 0 && !whole {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.ring == nil || state.full {
+		return
+	}
+	for _, key := range removed {
+		state.tombstones[string(key)] = struct{}{}
+	}
+	state.full = whole || len(state.tombstones)+len(state.prefixes) > maxReadRepairTombstones
+}
+
+// deletedPrefix records a prefix delete as deleted records a key
+func (state *readRepairState) deletedPrefix(prefix string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.ring == nil || state.full {
+		return
+	}
+	state.prefixes = append(state.prefixes, prefix)
+	state.full = len(state.tombstones)+len(state.prefixes) > maxReadRepairTombstones
+}
+
+// tombstoned reports whether the key was deleted here since the change began, the caller
+// holds the lock. Values carry no timestamps, so a delete here always wins over the copy of
+// the previous owner: the copy predates the change and the delete does not.
+func (state *readRepairState) tombstoned(key string) bool {
+	if state.full {
+		return true
+	}
+	if _, ok := state.tombstones[key]; ok {
+		return true
+	}
+	for _, prefix := range state.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// previousOwner returns the member that owned the key before the ring change, nil when no
+// change is in flight, the key was deleted here since or this node owned it before too
+func (state *readRepairState) previousOwner(key, self string) *sharding.Shard {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.ring == nil || state.tombstoned(key) {
+		return nil
+	}
+	owner := state.ring.GetShard(key)
+	if owner == nil || owner.Name == self {
+		return nil
+	}
+	return owner
+}
+
+func (state *readRepairState) stats() ReadRepairStats {
+	state.lock.Lock()
+	active := state.ring != nil
+	state.lock.Unlock()
+	return ReadRepairStats{
+		Active:   active,
+		Lookups:  state.lookups.Load(),
+		Repaired: state.repaired.Load(),
+		Skipped:  state.skipped.Load(),
+		Errors:   state.errors.Load(),
+	}
+}
+
+// repairRead looks up a key missing from the primary database on the owner of the previous
+// ring while a ring change is in flight. A value found there is returned and written here in
+// the background, so the next read is served locally: keys move with the reads before
+// anti-entropy reaches them. The lookup is bounded by readRepairTimeout, a failed one is a miss.
+func (srv *Server) repairRead(r *http.Request, key string) (string, bool) {
+	self := srv.Config.Cluster.NodeName
+	if owner := srv.Ring.GetShard(key); owner == nil || owner.Name != self {
+		return "", false // a replica read, or the previous owner answering a read repair
+	}
+	state := &srv.readRepair
+	peer := state.previousOwner(key, self)
+	if peer == nil {
+		return "", false
+	}
+	state.lookups.Add(1)
+	ctx, cancel := context.WithTimeout(r.Context(), readRepairTimeout)
+	defer cancel()
+	value, found, err := srv.fetchFromPeer(ctx, peer, key)
+	if err != nil {
+		state.errors.Add(1)
+		srv.Logger.Warn("read repair failed", "peer", peer.Name, "key", srv.redactKey(key), "error", err)
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	state.lock.Lock()
+	deleted := state.tombstoned(key)
+	state.lock.Unlock()
+	if deleted || srv.expiredHere(key) {
+		state.skipped.Add(1) // deleted here while the lookup was running
+		return "", false
+	}
+	state.repaired.Add(1)
+	go srv.storeRepaired(key, value)
+	return value, true
+}
+
+// expiredHere reports whether an expired prefix rule of the main bucket hides the key, the
+// copy of the previous owner was deleted here before the purge got to it
+func (srv *Server) expiredHere(key string) bool {
+	expired := false
+	_ = srv.DBs.Primary().View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return nil
+		}
+		now := time.Now()
+		for _, rule := range bucket.PrefixRules() {
+			if !now.Before(rule.ExpireAt) && bytes.HasPrefix([]byte(key), rule.Prefix) {
+				expired = true
+			}
+		}
+		return nil
+	})
+	return expired
+}
+
+// storeRepaired writes a value read from the previous owner unless the key was written or
+// deleted here meanwhile. The tombstones are checked in the write transaction: a delete
+// committed before it recorded its tombstone in its commit hook, one committed after removes
+// the value again.
+func (srv *Server) storeRepaired(key, value string) {
+	state := &srv.readRepair
+	err := labeled("read-repair").update(srv.DBs.Primary(), func(tx *storage.Tx) error {
+		state.lock.Lock()
+		deleted := state.tombstoned(key)
+		state.lock.Unlock()
+		if deleted {
+			return nil
+		}
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		_, found, err := bucket.Lookup([]byte(key))
+		if err != nil || found {
+			return err
+		}
+		return bucket.Put([]byte(key), []byte(value))
+	})
+	if err != nil {
+		srv.Logger.Warn("failed to store repaired value", "key", srv.redactKey(key), "error", err)
+	}
+}
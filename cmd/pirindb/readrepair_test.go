@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/pkg/sharding"
+	"github.com/timson/pirindb/storage"
+)
+
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func readRepairStats(t *testing.T, node *testNode) ReadRepairStats {
+	t.Helper()
+	resp, err := http.Get(node.ts.URL + "/cluster/anti-entropy")
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	var report AntiEntropyReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	return report.ReadRepair
+}
+
+func TestReadRepair(t *testing.T) {
+	ctx := context.Background()
+	node1 := startTestNode(t, "node1", &ClusterConfig{})
+	require.NoError(t, node1.srv.Bootstrap(ctx))
+	keys := putSpread(t, node1, 100)
+
+	// node2 takes over part of the keys, they stay on node1 until they are read or copied
+	node2 := startTestNode(t, "node2", &ClusterConfig{SeedURL: node1.ts.URL})
+	require.NoError(t, node2.srv.Bootstrap(ctx))
+	var moved []string
+	for _, key := range keys {
+		if node2.srv.Ring.GetShard(key).Name == "node2" {
+			moved = append(moved, key)
+		}
+	}
+	require.GreaterOrEqual(t, len(moved), 5)
+	missing := "missing"
+	for i := 0; node2.srv.Ring.GetShard(missing).Name != "node2"; i++ {
+		missing = "missing-" + strconv.Itoa(i)
+	}
+	require.True(t, readRepairStats(t, node2).Active)
+
+	// a read of a moved key is served from node1 and the value is written to node2, a read
+	// routed by node1 is repaired the same way
+	for i, url := range []string{node2.ts.URL, node1.ts.URL} {
+		key := moved[i]
+		resp, err := http.Get(url + "/api/v1/kv/" + key)
+		require.NoError(t, err)
+		var got GetResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&got))
+		_ = resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, key)
+		require.Equal(t, "value-"+key, got.Value)
+		require.Eventually(t, func() bool {
+			_, found := Get(node2.srv.DBs.Primary(), key)
+			return found
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// a key deleted on node2 is not brought back from node1, nor is a key under a deleted prefix
+	req, err := http.NewRequest(http.MethodDelete, node2.ts.URL+"/api/v1/kv/"+moved[2], nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+moved[2]))
+	_, found := Get(node1.srv.DBs.Primary(), moved[2])
+	require.True(t, found)
+	node2.srv.readRepair.deletedPrefix(moved[3][:1])
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+moved[3]))
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+missing))
+
+	// the tombstone is recorded by the commit, a key removed by any transaction counts, like
+	// the removal of a session (sessions are refused in a cluster) or of the retention sweep
+	require.NoError(t, node2.srv.DBs.Primary().Update(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if err != nil {
+			return err
+		}
+		require.ErrorIs(t, bucket.Remove([]byte(moved[4])), storage.ErrNodeNotFound)
+		return nil
+	}))
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+moved[4]))
+	_, found = Get(node1.srv.DBs.Primary(), moved[4])
+	require.True(t, found)
+
+	stats := readRepairStats(t, node2)
+	require.Equal(t, ReadRepairStats{Active: true, Lookups: 3, Repaired: 2}, stats)
+
+	// a complete anti-entropy run ends the ring change, misses are not looked up anymore
+	report := node2.srv.runAntiEntropy(ctx)
+	require.Empty(t, report.Errors)
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+missing))
+	require.Equal(t, ReadRepairStats{Lookups: 3, Repaired: 2}, readRepairStats(t, node2))
+
+	// an unreachable previous owner is a miss
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	_ = listener.Close()
+	dead := &sharding.Shard{Name: "node3", Host: "127.0.0.1", Status: sharding.ShardActive}
+	dead.Port, _ = strconv.Atoi(port)
+	node2.srv.beginRingChange([]*sharding.Shard{dead})
+	require.Equal(t, http.StatusNotFound, getStatus(t, node2.ts.URL+"/api/v1/kv/"+missing))
+	stats = readRepairStats(t, node2)
+	require.Equal(t, int64(4), stats.Lookups)
+	require.Equal(t, int64(1), stats.Errors)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/timson/pirindb/storage"
+)
+
+// Schema is the subset of JSON Schema values are checked against: type, enum, const,
+// properties, required, additionalProperties, items, the length, size and range keywords
+// and pattern. Unknown keywords are ignored, like annotations in JSON Schema.
+type Schema struct {
+	Type                 schemaTypes        `json:"type"`
+	Enum                 []any              `json:"enum"`
+	Const                any                `json:"const"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum"`
+
+	hasConst     bool
+	pattern      *regexp.Regexp
+	additional   *Schema // schema of properties not listed in Properties
+	noAdditional bool    // additionalProperties is false
+}
+
+// schemaTypes is the type keyword, one type name or a list of them
+type schemaTypes []string
+
+func (types *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*types = schemaTypes{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return errors.New("type must be a string or an array of strings")
+	}
+	*types = names
+	return nil
+}
+
+var schemaTypeNames = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+// LoadSchema reads a JSON schema file
+func LoadSchema(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := ParseSchema(data)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %w", path, err)
+	}
+	return schema, nil
+}
+
+// ParseSchema decodes a schema and compiles its patterns
+func ParseSchema(data []byte) (*Schema, error) {
+	var schema Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	if err := schema.compile(""); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+func (schema *Schema) UnmarshalJSON(data []byte) error {
+	type plainSchema Schema
+	if err := json.Unmarshal(data, (*plainSchema)(schema)); err != nil {
+		return err
+	}
+	// a const of null is a constraint too, so the keyword presence is kept apart
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	_, schema.hasConst = fields["const"]
+	return nil
+}
+
+// compile checks the keywords of the schema at path and of its subschemas
+func (schema *Schema) compile(path string) error {
+	for _, name := range schema.Type {
+		if !slices.Contains(schemaTypeNames, name) {
+			return fmt.Errorf("%s: unknown type %q", schemaPath(path), name)
+		}
+	}
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: pattern: %w", schemaPath(path), err)
+		}
+		schema.pattern = pattern
+	}
+	if len(schema.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(schema.AdditionalProperties, &allowed); err == nil {
+			schema.noAdditional = !allowed
+		} else {
+			var additional Schema
+			if err := json.Unmarshal(schema.AdditionalProperties, &additional); err != nil {
+				return fmt.Errorf("%s/additionalProperties: %w", schemaPath(path), err)
+			}
+			if err := additional.compile(path + "/additionalProperties"); err != nil {
+				return err
+			}
+			schema.additional = &additional
+		}
+	}
+	for name, property := range schema.Properties {
+		if property == nil {
+			return fmt.Errorf("%s/properties/%s: schema is null", schemaPath(path), name)
+		}
+		if err := property.compile(path + "/properties/" + name); err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		if err := schema.Items.compile(path + "/items"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+// Validate is a storage.ValueValidator: the value must be one JSON document matching the schema
+func (schema *Schema) Validate(_, value []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("value is not JSON: %w", err)
+	}
+	if decoder.More() {
+		return errors.New("value is not JSON: data after the document")
+	}
+	return schema.validate("", document)
+}
+
+// validate checks the JSON value at path, the first violation is returned
+func (schema *Schema) validate(path string, value any) error {
+	if len(schema.Type) > 0 && !slices.ContainsFunc(schema.Type, func(name string) bool { return jsonTypeMatches(name, value) }) {
+		return fmt.Errorf("%s: expected %s, got %s", schemaPath(path), strings.Join(schema.Type, " or "), jsonTypeName(value))
+	}
+	if len(schema.Enum) > 0 && !slices.ContainsFunc(schema.Enum, func(allowed any) bool { return jsonEqual(allowed, value) }) {
+		return fmt.Errorf("%s: value is not one of the enum values", schemaPath(path))
+	}
+	if schema.hasConst && !jsonEqual(schema.Const, value) {
+		return fmt.Errorf("%s: value does not equal the const value", schemaPath(path))
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		return schema.validateObject(path, value)
+	case []any:
+		return schema.validateArray(path, value)
+	case string:
+		return schema.validateString(path, value)
+	case json.Number:
+		number, _ := value.Float64()
+		return schema.validateNumber(path, number)
+	}
+	return nil
+}
+
+func (schema *Schema) validateObject(path string, object map[string]any) error {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", schemaPath(path), name)
+		}
+	}
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	slices.Sort(names) // the first violation does not depend on map order
+	for _, name := range names {
+		property, listed := schema.Properties[name]
+		switch {
+		case listed:
+		case schema.noAdditional:
+			return fmt.Errorf("%s: property %q is not allowed", schemaPath(path), name)
+		case schema.additional != nil:
+			property = schema.additional
+		default:
+			continue
+		}
+		if err := property.validate(path+"/"+name, object[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (schema *Schema) validateArray(path string, array []any) error {
+	if schema.MinItems != nil && len(array) < *schema.MinItems {
+		return fmt.Errorf("%s: %d items, at least %d required", schemaPath(path), len(array), *schema.MinItems)
+	}
+	if schema.MaxItems != nil && len(array) > *schema.MaxItems {
+		return fmt.Errorf("%s: %d items, at most %d allowed", schemaPath(path), len(array), *schema.MaxItems)
+	}
+	if schema.Items == nil {
+		return nil
+	}
+	for i, item := range array {
+		if err := schema.Items.validate(fmt.Sprintf("%s/%d", path, i), item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (schema *Schema) validateString(path string, value string) error {
+	length := utf8.RuneCountInString(value)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		return fmt.Errorf("%s: length %d, at least %d required", schemaPath(path), length, *schema.MinLength)
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return fmt.Errorf("%s: length %d, at most %d allowed", schemaPath(path), length, *schema.MaxLength)
+	}
+	if schema.pattern != nil && !schema.pattern.MatchString(value) {
+		return fmt.Errorf("%s: does not match pattern %q", schemaPath(path), schema.Pattern)
+	}
+	return nil
+}
+
+func (schema *Schema) validateNumber(path string, value float64) error {
+	switch {
+	case schema.Minimum != nil && value < *schema.Minimum:
+		return fmt.Errorf("%s: %v is less than the minimum %v", schemaPath(path), value, *schema.Minimum)
+	case schema.Maximum != nil && value > *schema.Maximum:
+		return fmt.Errorf("%s: %v is greater than the maximum %v", schemaPath(path), value, *schema.Maximum)
+	case schema.ExclusiveMinimum != nil && value <= *schema.ExclusiveMinimum:
+		return fmt.Errorf("%s: %v is not greater than %v", schemaPath(path), value, *schema.ExclusiveMinimum)
+	case schema.ExclusiveMaximum != nil && value >= *schema.ExclusiveMaximum:
+		return fmt.Errorf("%s: %v is not less than %v", schemaPath(path), value, *schema.ExclusiveMaximum)
+	}
+	return nil
+}
+
+func jsonTypeMatches(name string, value any) bool {
+	if name == "integer" {
+		number, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := number.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	return jsonTypeName(value) == name || name == "number" && jsonTypeName(value) == "integer"
+}
+
+func jsonTypeName(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// jsonEqual compares a schema value decoded without UseNumber with a document value
+func jsonEqual(schemaValue, value any) bool {
+	if number, ok := value.(json.Number); ok {
+		f, err := number.Float64()
+		expected, isNumber := schemaValue.(float64)
+		return err == nil && isNumber && f == expected
+	}
+	return reflect.DeepEqual(normalizeJSON(schemaValue), normalizeJSON(value))
+}
+
+// normalizeJSON turns the numbers of a document into float64 for the comparison
+func normalizeJSON(value any) any {
+	switch value := value.(type) {
+	case json.Number:
+		f, _ := value.Float64()
+		return f
+	case []any:
+		items := make([]any, len(value))
+		for i, item := range value {
+			items[i] = normalizeJSON(item)
+		}
+		return items
+	case map[string]any:
+		object := make(map[string]any, len(value))
+		for name, item := range value {
+			object[name] = normalizeJSON(item)
+		}
+		return object
+	}
+	return value
+}
+
+// isInternalBucket reports whether the bucket holds server state, validators are never set
+// on them. The server buckets start with storage.InternalBucketPrefix.
+func isInternalBucket(name string) bool {
+	return storage.IsInternalBucket([]byte(name))
+}
+
+// applySchemas loads the schema files of the database config and registers their validators
+func (c *DatabaseConfig) applySchemas(db *storage.DB) error {
+	for _, schemaCfg := range c.Schemas {
+		schema, err := LoadSchema(schemaCfg.File)
+		if err != nil {
+			return err
+		}
+		db.SetValidator([]byte(schemaCfg.Bucket), schema.Validate)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const userSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+		"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"score": {"type": ["number", "null"]},
+		"kind": {"const": null}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(userSchema))
+	require.NoError(t, err)
+
+	valid := []string{
+		`{"name":"ann","age":30}`,
+		`{"name":"bob","age":0,"role":"admin","tags":["a","b"],"score":1.5,"kind":null}`,
+		`{"name":"eve","age":1.0,"score":null}`,
+	}
+	for _, value := range valid {
+		require.NoError(t, schema.Validate(nil, []byte(value)), value)
+	}
+
+	invalid := map[string]string{
+		`not json`:                                     "value is not JSON",
+		`{"name":"ann","age":30} {}`:                   "data after the document",
+		`[]`:                                           "/: expected object, got array",
+		`{"name":"ann"}`:                               `missing required property "age"`,
+		`{"name":"ann","age":30,"x":1}`:                `property "x" is not allowed`,
+		`{"name":"","age":30}`:                         "/name: length 0, at least 1 required",
+		`{"name":"annabelle","age":30}`:                "/name: length 9, at most 8 allowed",
+		`{"name":"Ann","age":30}`:                      "/name: does not match pattern",
+		`{"name":"ann","age":30.5}`:                    "/age: expected integer, got number",
+		`{"name":"ann","age":-1}`:                      "/age: -1 is less than the minimum 0",
+		`{"name":"ann","age":150}`:                     "/age: 150 is not less than 150",
+		`{"name":"ann","age":30,"role":"root"}`:        "/role: value is not one of the enum values",
+		`{"name":"ann","age":30,"tags":["a",1]}`:       "/tags/1: expected string, got integer",
+		`{"name":"ann","age":30,"tags":["a","b","c"]}`: "/tags: 3 items, at most 2 allowed",
+		`{"name":"ann","age":30,"score":"high"}`:       "/score: expected number or null, got string",
+		`{"name":"ann","age":30,"kind":1}`:             "/kind: value does not equal the const value",
+	}
+	for value, detail := range invalid {
+		err = schema.Validate(nil, []byte(value))
+		require.Error(t, err, value)
+		require.Contains(t, err.Error(), detail, value)
+	}
+
+	_, err = ParseSchema([]byte(`{"type":"text"}`))
+	require.ErrorContains(t, err, `unknown type "text"`)
+	_, err = ParseSchema([]byte(`{"properties":{"a":{"pattern":"("}}}`))
+	require.ErrorContains(t, err, "/properties/a: pattern")
+}
+
+func TestSchemaValues(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	schemaFile := filepath.Join(t.TempDir(), "user.json")
+	require.NoError(t, os.WriteFile(schemaFile, []byte(userSchema), 0o600))
+	dbCfg := &DatabaseConfig{Schemas: []*SchemaConfig{{Bucket: string(DBBucket), File: schemaFile}}}
+	require.NoError(t, dbCfg.applySchemas(srv.DBs.Primary()))
+
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+
+	post := func(key string, value string) *http.Response {
+		resp, err := http.Post(ts.URL+"/api/v1/kv/"+key, "application/json", bytes.NewBufferString(value))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		return resp
+	}
+	require.Equal(t, http.StatusCreated, post("ann", `{"name":"ann","age":30}`).StatusCode)
+	resp := post("bob", `{"name":"bob","age":"old"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	var errResp ErrDetailResponse
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	require.Equal(t, "value_rejected", errResp.Code)
+	require.Contains(t, errResp.Detail, "/age: expected integer, got string")
+	_, found := Get(srv.DBs.Primary(), "bob")
+	require.False(t, found)
+
+	// an append has to leave a valid document too
+	require.Equal(t, http.StatusUnprocessableEntity, post("ann:append", `,`).StatusCode)
+	value, _ := Get(srv.DBs.Primary(), "ann")
+	require.Equal(t, `{"name":"ann","age":30}`, value)
+
+	dbCfg.Schemas[0].File = filepath.Join(t.TempDir(), "missing.json")
+	require.Error(t, dbCfg.applySchemas(srv.DBs.Primary()))
+}
@@ -4,13 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/timson/pirindb/pkg/sharding"
 	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/keys"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
 )
 
 var (
@@ -18,30 +27,130 @@ var (
 )
 
 type Server struct {
-	DB     *storage.DB
-	Logger *slog.Logger
-	Config *Config
-	Server *http.Server
+	DBs         *DBRegistry
+	Logger      *slog.Logger
+	Config      *Config
+	Server      *http.Server
+	Ring        *sharding.ConsistentHash
+	Auditor     *Auditor // nil unless an audit sink is configured
+	stopJanitor chan struct{}
+	stopCluster context.CancelFunc
+	ready       atomic.Bool  // set once the ring is bootstrapped
+	mode        atomic.Value // NodeMode
+	canaries    sync.Map     // database name -> last CanaryResult
+	backups     backupState
+	usage       usageJobs
+	loads       loadJobs
+	sessions    sessionRegistry
+	caches      map[string]*readCache                 // by database name, set up with the router
+	transforms  map[string]map[string]*transformChain // by database name and bucket, set up with the router
+	partitions  map[string]*partitionedBucket         // by logical bucket name, set up with the router
+	digests     *digestCache                          // range digests of the primary database in a cluster
+	antiEntropy antiEntropyState
+	readRepair  readRepairState
+	keyGenOnce  sync.Once
+	keyGen      *keys.Generator
+	// forwarded headers are only read from these addresses, see resolveClient
+	trustedProxies []netip.Prefix
 }
 
 func NewServer(cfg *Config, db *storage.DB, logger *slog.Logger) *Server {
-	return &Server{
+	name := cfg.DB.Name
+	if name == "" {
+		name = defaultDBName
+	}
+	virtualNodes := 0
+	if cfg.Cluster != nil {
+		virtualNodes = cfg.Cluster.VirtualNodes
+	}
+	srv := &Server{
 		Config: cfg,
-		DB:     db,
+		DBs:    NewDBRegistry(name, db),
 		Logger: logger,
+		Ring:   sharding.NewConsistentHash(virtualNodes),
+	}
+	if cfg.Cluster != nil {
+		srv.Ring.SetGroupDelimiter(cfg.Cluster.GroupDelimiter)
+	}
+	trusted, err := parseTrustedProxies(cfg.Server.TrustedProxies)
+	if err != nil {
+		logger.Warn("ignoring server.trusted_proxies", "error", err)
+	}
+	srv.trustedProxies = trusted
+	srv.initMode()
+	return srv
+}
+
+// maxValueSize returns the largest value accepted by a put
+func (srv *Server) maxValueSize() int64 {
+	if srv.Config.Server.MaxValueSize <= 0 || srv.Config.Server.MaxValueSize > maxUploadSize {
+		return maxUploadSize
+	}
+	return srv.Config.Server.MaxValueSize
+}
+
+// limitValue rejects a put body above the value size limit before it is read or proxied
+// to the owner shard, a body without Content-Length fails once it grows past the limit
+func (srv *Server) limitValue(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > srv.maxValueSize() {
+			_ = render.Render(w, r, ErrValueTooLarge())
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, srv.maxValueSize())
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestDB resolves the database addressed by the {db} route parameter,
+// requests without the parameter are served by the primary database
+func (srv *Server) requestDB(r *http.Request) (*storage.DB, bool) {
+	return srv.DBs.Get(chi.URLParam(r, "db"))
+}
+
+// redactKey returns the key as it may appear in logs and error bodies
+func (srv *Server) redactKey(key string) string {
+	return storage.RedactKey(srv.Config.Server.LogKeyMode, []byte(key))
+}
+
+// redactURL replaces the {key} route parameter in the request url according to the mode
+func redactURL(r *http.Request, mode storage.LogKeyMode) string {
+	key := chi.URLParam(r, "key")
+	if key == "" || mode == storage.LogKeyFull || mode == "" {
+		return r.URL.String()
+	}
+	u := *r.URL
+	if u.RawPath != "" {
+		// the route was matched on the escaped path, so the parameter is escaped too
+		if unescaped, err := url.PathUnescape(key); err == nil {
+			key = unescaped
+		}
 	}
+	if idx := strings.LastIndex(u.Path, "/kv/"+key); idx >= 0 {
+		idx += len("/kv/")
+		u.Path = u.Path[:idx] + storage.RedactKey(mode, []byte(key)) + u.Path[idx+len(key):]
+	}
+	u.RawPath = ""
+	return u.String()
 }
 
-func RequestLogger(logger *slog.Logger) func(next http.Handler) http.Handler {
+func RequestLogger(logger *slog.Logger, logKeyMode storage.LogKeyMode) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			startTime := time.Now()
 
 			next.ServeHTTP(w, r)
 
+			// route params are resolved by now, so the database label is available
+			dbName := chi.URLParam(r, "db")
+			if dbName == "" {
+				dbName = "primary"
+			}
 			logger.Info("Request completed",
 				slog.String("method", r.Method),
-				slog.String("url", r.URL.String()),
+				slog.String("url", redactURL(r, logKeyMode)),
+				slog.String("db", dbName),
+				slog.String("client", clientIP(r)),
 				slog.Duration("duration", time.Since(startTime)))
 		})
 	}
@@ -50,26 +159,136 @@ func RequestLogger(logger *slog.Logger) func(next http.Handler) http.Handler {
 func (srv *Server) buildRouter() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Recoverer)
-	r.Use(RequestLogger(srv.Logger))
+	r.Use(middleware.RequestID)
+	r.Use(srv.resolveClient)
+	r.Use(RequestLogger(srv.Logger, srv.Config.Server.LogKeyMode))
+	if srv.Config.Server.Compression {
+		r.Use(compressResponses(srv.Config.Server.CompressionMinSize))
+	}
+	r.Use(srv.enforceMode)
+	srv.setupCaches()
+	srv.setupTransforms()
+	srv.setupPartitions()
+	srv.setupDigests()
+	srv.setupReadRepair()
 
 	r.Route("/health", func(r chi.Router) {
 		r.Get("/", srv.handleHealth)
+		r.Get("/ready", srv.handleReady)
+	})
+	r.Route("/cluster", func(r chi.Router) {
+		r.Get("/ring", srv.handleRing)
+		r.Post("/ring", srv.handleRingUpdate)
+		r.Post("/join", srv.handleJoin)
+		r.Get("/digest", srv.handleRangeDigest)
+		r.Get("/anti-entropy", srv.handleAntiEntropy)
 	})
+	r.Get("/version", srv.handleVersion)
+	r.Get("/audit", srv.handleAuditStats)
 
 	r.Route("/api/v1", func(r chi.Router) {
-		r.Route("/kv", func(r chi.Router) {
-			r.Get("/{key}", srv.handleGet)
-			r.Post("/{key}", srv.handlePut)
-			r.Delete("/{key}", srv.handleDelete)
+		r.Route("/admin/mode", func(r chi.Router) {
+			r.Use(srv.requireAdmin)
+			r.Get("/", srv.handleGetMode)
+			r.With(srv.audit("set_mode")).Post("/", srv.handleSetMode)
 		})
-		r.Route("/db", func(r chi.Router) {
-			r.Get("/status", srv.handleStatus)
+		r.Route("/admin/backup", func(r chi.Router) {
+			r.Use(srv.requireAdmin)
+			r.Get("/", srv.handleBackupStatus)
+			r.With(srv.audit("backup")).Post("/", srv.handleBackup)
 		})
+		srv.mountDBRoutes(r)
+		r.Route("/{db}", srv.mountDBRoutes)
 	})
 
+	// behind a proxy serving the node under a prefix, routes and peers see paths without it
+	if base := srv.basePath(); base != "" {
+		return http.StripPrefix(base, r)
+	}
 	return r
 }
 
+// mountDBRoutes registers per-database routes, they are mounted both at the API root
+// (primary database) and under the /{db} prefix
+func (srv *Server) mountDBRoutes(r chi.Router) {
+	r.Route("/kv", func(r chi.Router) {
+		r.Get("/", srv.handleListKeys)
+		r.With(srv.audit("delete_prefix")).Delete("/", srv.handleDeletePrefix)
+		r.With(srv.routeKey).Get("/{key}", srv.handleGet)
+		r.With(srv.limitValue).Post("/{key}", srv.handlePost)
+		r.With(srv.routeKey, srv.audit("delete")).Delete("/{key}", srv.handleDelete)
+		r.With(srv.routeKey).Post("/{key}/upload", srv.handleUploadStart)
+	})
+	r.Get("/mget", srv.handleMGet)
+	r.With(srv.limitValue, srv.audit("batch")).Post("/batch", srv.handleBatch)
+	r.Get("/loads/{id}", srv.handleLoadStatus)
+	r.Route("/uploads/{id}", func(r chi.Router) {
+		r.Use(srv.routeUpload)
+		r.Put("/", srv.handleUploadChunk)
+		r.With(srv.audit("upload_commit")).Post("/commit", srv.handleUploadCommit)
+	})
+	r.Route("/locks/{key}", func(r chi.Router) {
+		r.With(srv.routeKey).Post("/", srv.handleLockAcquire)
+		r.With(srv.routeKey).Delete("/", srv.handleLockRelease)
+	})
+	r.Get("/buckets", srv.handleListBuckets)
+	r.Route("/buckets/{bucket}", func(r chi.Router) {
+		r.With(srv.audit("delete_bucket")).Delete("/", srv.handleDeleteBucket)
+		r.With(srv.audit("expire")).Post("/expire", srv.handleExpire)
+		r.With(srv.audit("set_quota")).Put("/quota", srv.handleSetQuota)
+		r.With(srv.audit("set_retention")).Put("/retention", srv.handleSetRetention)
+		r.Get("/export", srv.handleExport)
+		r.Get("/dump", srv.handleDump)
+		r.With(srv.audit("bucket_load")).Post("/load", srv.handleLoad)
+		r.Get("/digests", srv.handleDigests)
+		r.Get("/sample", srv.handleSample)
+		r.Get("/prefix-stats", srv.handlePrefixStats)
+		r.Get("/events", srv.handleBucketEvents)
+		r.With(srv.limitValue, srv.audit("bucket_append")).Post("/append", srv.handleBucketAppend)
+	})
+	r.Route("/tx", func(r chi.Router) {
+		r.Get("/", srv.handleSessionStats)
+		r.With(srv.audit("tx_begin")).Post("/", srv.handleSessionBegin)
+		r.Route("/{token}", func(r chi.Router) {
+			r.Get("/kv/{key}", srv.handleSessionGet)
+			r.With(srv.limitValue, srv.audit("tx_put")).Post("/kv/{key}", srv.handleSessionPut)
+			r.With(srv.audit("tx_delete")).Delete("/kv/{key}", srv.handleSessionDelete)
+			r.With(srv.audit("tx_commit")).Post("/commit", srv.handleSessionCommit)
+			r.Post("/rollback", srv.handleSessionRollback)
+		})
+	})
+	r.With(srv.requireAdmin).Post("/admin/diff", srv.handleDiff)
+	r.With(srv.requireAdmin, srv.audit("compact_blobs")).Post("/admin/compact-blobs", srv.handleCompactBlobs)
+	r.With(srv.requireAdmin, srv.audit("retention_sweep")).Post("/admin/retention", srv.handleRetentionSweep)
+	r.Route("/admin/trash", func(r chi.Router) {
+		r.Use(srv.requireAdmin)
+		r.Get("/", srv.handleListTrash)
+		r.With(srv.audit("purge_trash")).Delete("/", srv.handlePurgeTrash)
+		r.With(srv.audit("restore_bucket")).Post("/{bucket}/restore", srv.handleRestoreBucket)
+	})
+	r.Route("/db", func(r chi.Router) {
+		r.Get("/status", srv.handleStatus)
+		r.Get("/cache", srv.handleCacheStats)
+		r.Get("/analyze/{bucket}", srv.handleAnalyze)
+	})
+	r.Get("/usage", srv.handleUsage)
+	r.With(srv.requireAdmin, srv.audit("usage")).Post("/admin/usage", srv.handleUsageRefresh)
+}
+
+// dbRouteSegments returns the first path segments of the routes registered by mountDBRoutes,
+// a database named like one of them could not be told apart from the route
+func dbRouteSegments() map[string]bool {
+	r := chi.NewRouter()
+	(&Server{Config: &Config{Server: &ServerConfig{}}}).mountDBRoutes(r)
+	segments := make(map[string]bool)
+	_ = chi.Walk(r, func(_ string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		segment, _, _ := strings.Cut(strings.TrimPrefix(route, "/"), "/")
+		segments[segment] = true
+		return nil
+	})
+	return segments
+}
+
 func (srv *Server) Start() error {
 	r := srv.buildRouter()
 	srv.Logger.Info("started listening", "port", srv.Config.Server.Port, "host", srv.Config.Server.Host)
@@ -79,7 +298,35 @@ func (srv *Server) Start() error {
 	}
 	srv.Logger.Info("press Ctrl+C to exit")
 
-	if err := srv.Server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+	srv.stopJanitor = make(chan struct{})
+	go srv.expireUploadsLoop(srv.stopJanitor)
+
+	// a database that can't commit fails readiness before the node takes traffic
+	srv.checkCanaries()
+	if srv.Config.Server.CanaryInterval > 0 {
+		go srv.canaryLoop(srv.stopJanitor, srv.Config.Server.CanaryInterval)
+	}
+	if backup := srv.Config.Backup; backup != nil && backup.Interval > 0 {
+		go srv.backupLoop(srv.stopJanitor, backup.Interval)
+	}
+	if srv.clusterEnabled() && srv.Config.Cluster.AntiEntropyInterval > 0 {
+		go srv.antiEntropyLoop(srv.stopJanitor, srv.Config.Cluster.AntiEntropyInterval)
+	}
+
+	// the node must be listening before it joins, the seed pushes ring updates back to it
+	listener, err := net.Listen("tcp", srv.Server.Addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.stopCluster = cancel
+	go func() {
+		if err := srv.Bootstrap(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			srv.Logger.Error("cluster bootstrap failed", "error", err)
+		}
+	}()
+
+	if err = srv.Server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		srv.Logger.Error("HTTP server error", slog.Any("err", err))
 	}
 
@@ -88,6 +335,12 @@ func (srv *Server) Start() error {
 
 func (srv *Server) Stop() error {
 	srv.Logger.Info("Stopping HTTP server")
+	if srv.stopJanitor != nil {
+		close(srv.stopJanitor)
+	}
+	if srv.stopCluster != nil {
+		srv.stopCluster()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
@@ -97,5 +350,74 @@ func (srv *Server) Stop() error {
 	}
 
 	srv.Logger.Info("HTTP server stopped")
-	return nil
+	// an open session holds a write lock the databases wait for on close
+	srv.sessions.rollbackAll()
+	srv.usage.wg.Wait()
+	if srv.Auditor != nil {
+		if err := srv.Auditor.Close(); err != nil {
+			srv.Logger.Error("failed to close audit log", "error", err)
+		}
+	}
+	return srv.DBs.CloseAll(srv.Logger)
+}
+
+// writeOptions returns the label, the retry policy and the actor of the write transaction of
+// a request. There is no authentication, the client address stands for the principal.
+func (srv *Server) writeOptions(r *http.Request) writeOptions {
+	retry := storage.DefaultRetryPolicy()
+	retry.MaxAttempts = srv.Config.Server.WriteRetryAttempts
+	retry.Backoff = srv.Config.Server.WriteRetryBackoff
+	return writeOptions{ctx: r.Context(), label: txLabel(r), retry: retry, actor: clientIP(r)}
+}
+
+func (srv *Server) uploadTTL() time.Duration {
+	if srv.Config.Server.UploadTTL <= 0 {
+		return defaultUploadTTL
+	}
+	return srv.Config.Server.UploadTTL
+}
+
+// expireUploadsLoop periodically drops abandoned uploads, expired locks, keys expired by
+// prefix rules and keys past the retention of their bucket in every served database
+func (srv *Server) expireUploadsLoop(stop chan struct{}) {
+	ticker := time.NewTicker(uploadExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			for _, name := range srv.DBs.Names() {
+				db, _ := srv.DBs.Get(name)
+				expired, err := ExpireUploads(db, now)
+				if err != nil {
+					srv.Logger.Error("Failed to expire uploads", "db", name, "error", err)
+				} else if expired > 0 {
+					srv.Logger.Info("Expired abandoned uploads", "db", name, "count", expired)
+				}
+				if expired, err = ExpireLocks(db, now); err != nil {
+					srv.Logger.Error("Failed to expire locks", "db", name, "error", err)
+				} else if expired > 0 {
+					srv.Logger.Info("Expired locks", "db", name, "count", expired)
+				}
+				purged, err := db.PurgeExpired(now, purgeExpiredLimit)
+				if err != nil {
+					srv.Logger.Error("Failed to purge expired keys", "db", name, "error", err)
+				} else if purged > 0 {
+					srv.Logger.Info("Purged expired keys", "db", name, "count", purged)
+				}
+				sweeps, err := db.SweepRetention(now, retentionSweepChunk, purgeExpiredLimit)
+				if err != nil {
+					srv.Logger.Error("Failed to sweep retention", "db", name, "error", err)
+				}
+				for bucket, sweep := range sweeps {
+					if sweep.Removed > 0 {
+						srv.Logger.Info("Deleted keys past retention", "db", name, "bucket", bucket, "count", sweep.Removed)
+					}
+				}
+				srv.expirePartitions(name, db, now)
+				srv.purgeTrash(name, db, now)
+			}
+		}
+	}
 }
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/timson/pirindb/storage"
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionActive   = errors.New("a session is already open in the database")
+	ErrSessionAborted  = errors.New("session aborted")
+)
+
+// SessionStats counts finished sessions and how long they held the write lock
+type SessionStats struct {
+	Begun      uint64  `json:"begun"`
+	Committed  uint64  `json:"committed"`
+	RolledBack uint64  `json:"rolled_back"`
+	Expired    uint64  `json:"expired"`
+	Aborted    uint64  `json:"aborted"` // a write or the commit failed
+	LastHeldMs float64 `json:"last_held_ms"`
+	MaxHeldMs  float64 `json:"max_held_ms"`
+}
+
+type sessionEnd int
+
+const (
+	sessionCommitted sessionEnd = iota
+	sessionRolledBack
+	sessionExpired
+	sessionAborted
+)
+
+// sessionOp runs fn in the transaction of the session, or ends it with commit or rollback
+type sessionOp struct {
+	fn       func(tx *storage.Tx) error
+	write    bool // a failed write aborts the session, the transaction may hold part of it
+	commit   bool
+	rollback bool
+	result   chan error
+}
+
+// txSession is a write transaction kept open across requests. Transactions belong to the
+// goroutine that began them, so the session goroutine runs every operation sent to it.
+type txSession struct {
+	token   string
+	dbName  string
+	ops     chan sessionOp
+	done    chan struct{} // closed once the transaction is finished
+	begun   time.Time
+	expires time.Time
+}
+
+// do hands the operation to the session goroutine and waits for its result
+func (s *txSession) do(op sessionOp) error {
+	op.result = make(chan error, 1)
+	select {
+	case s.ops <- op:
+		return <-op.result
+	case <-s.done:
+		return ErrSessionNotFound
+	}
+}
+
+// sessionRegistry finds open sessions by token and by database
+type sessionRegistry struct {
+	lock    sync.Mutex
+	byToken map[string]*txSession
+	byDB    map[string]*txSession
+	stats   SessionStats
+}
+
+// reserve claims the database for a new session, ErrSessionActive if one is open
+func (reg *sessionRegistry) reserve(dbName string) (*txSession, error) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	if reg.byToken == nil {
+		reg.byToken = make(map[string]*txSession)
+		reg.byDB = make(map[string]*txSession)
+	}
+	if _, ok := reg.byDB[dbName]; ok {
+		return nil, ErrSessionActive
+	}
+	s := &txSession{
+		token:  uuid.New().String(),
+		dbName: dbName,
+		ops:    make(chan sessionOp),
+		done:   make(chan struct{}),
+	}
+	reg.byDB[dbName] = s
+	reg.byToken[s.token] = s
+	return s, nil
+}
+
+func (reg *sessionRegistry) get(token string) (*txSession, bool) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	s, ok := reg.byToken[token]
+	return s, ok
+}
+
+// release drops the session and counts how it ended, a session that never began is not counted
+func (reg *sessionRegistry) release(s *txSession, end sessionEnd, held time.Duration, begun bool) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	delete(reg.byToken, s.token)
+	delete(reg.byDB, s.dbName)
+	if !begun {
+		return
+	}
+	switch end {
+	case sessionCommitted:
+		reg.stats.Committed++
+	case sessionRolledBack:
+		reg.stats.RolledBack++
+	case sessionExpired:
+		reg.stats.Expired++
+	case sessionAborted:
+		reg.stats.Aborted++
+	}
+	reg.stats.LastHeldMs = float64(held.Microseconds()) / 1000
+	reg.stats.MaxHeldMs = max(reg.stats.MaxHeldMs, reg.stats.LastHeldMs)
+}
+
+// begin marks the session as holding the write lock from now until the TTL ends
+func (reg *sessionRegistry) begin(s *txSession, ttl time.Duration) {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	s.begun = time.Now()
+	s.expires = s.begun.Add(ttl)
+	reg.stats.Begun++
+}
+
+// open returns the open sessions and how long each one has held its database
+func (reg *sessionRegistry) open() map[string]float64 {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	held := make(map[string]float64, len(reg.byDB))
+	for name, s := range reg.byDB {
+		if !s.begun.IsZero() {
+			held[name] = float64(time.Since(s.begun).Microseconds()) / 1000
+		}
+	}
+	return held
+}
+
+func (reg *sessionRegistry) getStats() SessionStats {
+	reg.lock.Lock()
+	defer reg.lock.Unlock()
+	return reg.stats
+}
+
+// rollbackAll ends every open session, the databases can then be closed
+func (reg *sessionRegistry) rollbackAll() {
+	reg.lock.Lock()
+	open := make([]*txSession, 0, len(reg.byToken))
+	for _, s := range reg.byToken {
+		open = append(open, s)
+	}
+	reg.lock.Unlock()
+	for _, s := range open {
+		_ = s.do(sessionOp{rollback: true})
+	}
+}
+
+// sessionTTL returns how long a session may hold its transaction
+func (srv *Server) sessionTTL() time.Duration {
+	ttl := srv.Config.Server.SessionTTL
+	if ttl <= 0 {
+		return defaultSessionTTL
+	}
+	return min(ttl, maxSessionTTL)
+}
+
+// beginSession starts the session goroutine, ready reports when the write transaction began
+func (srv *Server) beginSession(dbName string, db *storage.DB) (*txSession, <-chan error, error) {
+	s, err := srv.sessions.reserve(dbName)
+	if err != nil {
+		return nil, nil, err
+	}
+	ready := make(chan error, 1)
+	go srv.runSession(s, db, ready)
+	return s, ready, nil
+}
+
+// runSession owns the transaction of the session, it runs the operations sent to it until
+// a commit, a rollback, a failed write or the TTL ends the session
+func (srv *Server) runSession(s *txSession, db *storage.DB, ready chan<- error) {
+	tx, err := db.BeginLabeled(true, "session")
+	if err != nil {
+		srv.sessions.release(s, sessionAborted, 0, false)
+		close(s.done)
+		ready <- err
+		return
+	}
+	ttl := srv.sessionTTL()
+	srv.sessions.begin(s, ttl)
+	ready <- nil
+
+	timer := time.NewTimer(ttl)
+	defer timer.Stop()
+	finish := func(end sessionEnd) {
+		srv.sessions.release(s, end, time.Since(s.begun), true)
+		close(s.done)
+	}
+	for {
+		select {
+		case op := <-s.ops:
+			switch {
+			case op.commit:
+				if err = tx.Commit(); err != nil {
+					finish(sessionAborted)
+					op.result <- fmt.Errorf("%w: %w", ErrSessionAborted, err)
+					return
+				}
+				finish(sessionCommitted)
+				op.result <- nil
+				return
+			case op.rollback:
+				tx.Rollback()
+				finish(sessionRolledBack)
+				op.result <- nil
+				return
+			}
+			if err = op.fn(tx); err != nil && op.write {
+				tx.Rollback()
+				finish(sessionAborted)
+				op.result <- fmt.Errorf("%w: %w", ErrSessionAborted, err)
+				return
+			}
+			op.result <- err
+		case <-timer.C:
+			tx.Rollback()
+			finish(sessionExpired)
+			srv.Logger.Warn("Session expired and was rolled back", "db", s.dbName, "ttl", ttl)
+			return
+		}
+	}
+}
+
+type SessionResponse struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"` // the session is rolled back unless committed by then
+	Status  string    `json:"status"`
+}
+
+type SessionStatsResponse struct {
+	Enabled bool               `json:"enabled"`
+	TTLMs   float64            `json:"ttl_ms"`
+	Open    map[string]float64 `json:"open"` // database -> ms its open session holds the write lock
+	SessionStats
+}
+
+func (srv *Server) handleSessionStats(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, &SessionStatsResponse{
+		Enabled:      srv.Config.Server.Sessions,
+		TTLMs:        float64(srv.sessionTTL().Milliseconds()),
+		Open:         srv.sessions.open(),
+		SessionStats: srv.sessions.getStats(),
+	})
+}
+
+// handleSessionBegin opens a session in the database once its write lock is free, other
+// writers of the database wait until the session ends
+func (srv *Server) handleSessionBegin(w http.ResponseWriter, r *http.Request) {
+	if !srv.Config.Server.Sessions {
+		_ = render.Render(w, r, ErrSessionsDisabled())
+		return
+	}
+	if srv.clusterEnabled() {
+		// the keys of a session may be owned by other shards
+		_ = render.Render(w, r, ErrSessionsInCluster())
+		return
+	}
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	dbName := chi.URLParam(r, "db")
+	if dbName == "" {
+		dbName = srv.DBs.PrimaryName()
+	}
+	s, ready, err := srv.beginSession(dbName, db)
+	if errors.Is(err, ErrSessionActive) {
+		_ = render.Render(w, r, ErrSessionActiveResponse())
+		return
+	}
+	select {
+	case err = <-ready:
+	case <-r.Context().Done():
+		// nobody gets the token, the session is rolled back as soon as it begins
+		go func() {
+			if <-ready == nil {
+				_ = s.do(sessionOp{rollback: true})
+			}
+		}()
+		return
+	}
+	switch {
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to begin session", "db", dbName, "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &SessionResponse{Token: s.token, Expires: s.expires, Status: "ok"})
+}
+
+// requestSession resolves the {token} route parameter to an open session
+func (srv *Server) requestSession(w http.ResponseWriter, r *http.Request) (*txSession, bool) {
+	s, ok := srv.sessions.get(chi.URLParam(r, "token"))
+	if !ok {
+		_ = render.Render(w, r, ErrSessionNotFoundResponse())
+	}
+	return s, ok
+}
+
+func (srv *Server) renderSessionError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, ErrSessionNotFound):
+		_ = render.Render(w, r, ErrSessionNotFoundResponse())
+	case errors.Is(err, ErrSessionAborted):
+		_ = render.Render(w, r, ErrSessionAbortedResponse(err))
+	default:
+		_ = render.Render(w, r, ErrInternalServerError())
+	}
+}
+
+func (srv *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := srv.requestSession(w, r)
+	if !ok {
+		return
+	}
+	key := chi.URLParam(r, "key")
+	var value string
+	var found bool
+	err := s.do(sessionOp{fn: func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data, isFound, err := bucket.Lookup([]byte(key))
+		value, found = string(data), isFound
+		return err
+	}})
+	if err != nil {
+		srv.renderSessionError(w, r, err)
+		return
+	}
+	if !found {
+		_ = render.Render(w, r, ErrNotFound(srv.redactKey(key)))
+		return
+	}
+	render.JSON(w, r, &GetResponse{Value: value, Status: "ok"})
+}
+
+// handleSessionPut stores the value in the session, the body is read before the operation so
+// a slow client does not hold the session goroutine
+func (srv *Server) handleSessionPut(w http.ResponseWriter, r *http.Request) {
+	s, ok := srv.requestSession(w, r)
+	if !ok {
+		return
+	}
+	key := chi.URLParam(r, "key")
+	defer func() {
+		_ = r.Body.Close()
+	}()
+	body, err := io.ReadAll(r.Body)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		_ = render.Render(w, r, ErrValueTooLarge())
+		return
+	}
+	if err != nil {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	err = s.do(sessionOp{write: true, fn: func(tx *storage.Tx) error {
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), body)
+	}})
+	if err != nil {
+		srv.renderSessionError(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, &PutResponse{Key: key, Status: "ok"})
+}
+
+func (srv *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
+	s, ok := srv.requestSession(w, r)
+	if !ok {
+		return
+	}
+	key := chi.URLParam(r, "key")
+	existed := false
+	err := s.do(sessionOp{write: true, fn: func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(DBBucket)
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = bucket.Remove([]byte(key))
+		if errors.Is(err, storage.ErrNodeNotFound) {
+			return nil
+		}
+		existed = err == nil
+		return err
+	}})
+	if err != nil {
+		srv.renderSessionError(w, r, err)
+		return
+	}
+	render.JSON(w, r, &DeleteResponse{Key: key, Status: "ok", Existed: existed})
+}
+
+func (srv *Server) handleSessionCommit(w http.ResponseWriter, r *http.Request) {
+	srv.endSession(w, r, sessionOp{commit: true}, "committed")
+}
+
+func (srv *Server) handleSessionRollback(w http.ResponseWriter, r *http.Request) {
+	srv.endSession(w, r, sessionOp{rollback: true}, "rolled_back")
+}
+
+func (srv *Server) endSession(w http.ResponseWriter, r *http.Request, op sessionOp, status string) {
+	s, ok := srv.requestSession(w, r)
+	if !ok {
+		return
+	}
+	if err := s.do(op); err != nil {
+		srv.renderSessionError(w, r, err)
+		return
+	}
+	render.JSON(w, r, &SessionResponse{Token: s.token, Expires: s.expires, Status: status})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/stretchr/testify/require"
+)
+
+// sessionRequest sends the request and decodes the response into out, an error body's code is returned
+func sessionRequest(t *testing.T, method, url, body string, out any) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var errResp ErrResponse
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+		return resp.StatusCode, errResp.Code
+	}
+	if out != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+	}
+	return resp.StatusCode, ""
+}
+
+func setupSessionServer(t *testing.T) (*Server, string) {
+	srv, filename, txLogPath := setupTestServer(t)
+	srv.Config.Server.Sessions = true
+	ts := httptest.NewServer(srv.buildRouter())
+	t.Cleanup(func() {
+		ts.Close()
+		srv.sessions.rollbackAll()
+		_ = srv.DBs.CloseAll(srv.Logger)
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	return srv, ts.URL + "/api/v1"
+}
+
+func TestSession(t *testing.T) {
+	srv, url := setupSessionServer(t)
+	require.NoError(t, Put(srv.DBs.Primary(), "counter", "1", labeled("test")))
+
+	var session SessionResponse
+	status, _ := sessionRequest(t, http.MethodPost, url+"/tx", "", &session)
+	require.Equal(t, http.StatusCreated, status)
+	require.NotEmpty(t, session.Token)
+	require.WithinDuration(t, time.Now().Add(defaultSessionTTL), session.Expires, time.Second)
+	status, code := sessionRequest(t, http.MethodPost, url+"/tx", "", nil)
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "session_active", code)
+
+	// get then conditional put, other writers wait for the session
+	txURL := url + "/tx/" + session.Token
+	var get GetResponse
+	status, _ = sessionRequest(t, http.MethodGet, txURL+"/kv/counter", "", &get)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, "1", get.Value)
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/kv/counter", "2", nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = sessionRequest(t, http.MethodDelete, txURL+"/kv/other", "", nil)
+	require.Equal(t, http.StatusOK, status)
+	status, code = sessionRequest(t, http.MethodGet, txURL+"/kv/missing", "", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "key_not_found", code)
+
+	written := make(chan error, 1)
+	go func() { written <- Put(srv.DBs.Primary(), "outside", "value", labeled("test")) }()
+	select {
+	case <-written:
+		t.Fatal("a write went through while the session held the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/commit", "", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.NoError(t, <-written)
+	value, _ := Get(srv.DBs.Primary(), "counter")
+	require.Equal(t, "2", value)
+	status, code = sessionRequest(t, http.MethodPost, txURL+"/commit", "", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "session_not_found", code)
+
+	// a rolled back session leaves nothing behind
+	status, _ = sessionRequest(t, http.MethodPost, url+"/tx", "", &session)
+	require.Equal(t, http.StatusCreated, status)
+	txURL = url + "/tx/" + session.Token
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/kv/counter", "3", nil)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/rollback", "", nil)
+	require.Equal(t, http.StatusOK, status)
+	value, _ = Get(srv.DBs.Primary(), "counter")
+	require.Equal(t, "2", value)
+
+	var stats SessionStatsResponse
+	status, _ = sessionRequest(t, http.MethodGet, url+"/tx", "", &stats)
+	require.Equal(t, http.StatusOK, status)
+	require.True(t, stats.Enabled)
+	require.Empty(t, stats.Open)
+	require.EqualValues(t, 2, stats.Begun)
+	require.EqualValues(t, 1, stats.Committed)
+	require.EqualValues(t, 1, stats.RolledBack)
+	require.Positive(t, stats.MaxHeldMs)
+}
+
+func TestSessionExpires(t *testing.T) {
+	srv, url := setupSessionServer(t)
+	srv.Config.Server.SessionTTL = 50 * time.Millisecond
+
+	var session SessionResponse
+	status, _ := sessionRequest(t, http.MethodPost, url+"/tx", "", &session)
+	require.Equal(t, http.StatusCreated, status)
+	txURL := url + "/tx/" + session.Token
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/kv/foo", "bar", nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	// the expired session is rolled back and frees the lock
+	require.NoError(t, Put(srv.DBs.Primary(), "after", "value", labeled("test")))
+	_, found := Get(srv.DBs.Primary(), "foo")
+	require.False(t, found)
+	status, code := sessionRequest(t, http.MethodPost, txURL+"/commit", "", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "session_not_found", code)
+	require.EqualValues(t, 1, srv.sessions.getStats().Expired)
+}
+
+func TestSessionAborted(t *testing.T) {
+	srv, url := setupSessionServer(t)
+	var session SessionResponse
+	status, _ := sessionRequest(t, http.MethodPost, url+"/tx", "", &session)
+	require.Equal(t, http.StatusCreated, status)
+	txURL := url + "/tx/" + session.Token
+	status, _ = sessionRequest(t, http.MethodPost, txURL+"/kv/foo", "bar", nil)
+	require.Equal(t, http.StatusCreated, status)
+
+	// a failed write rolls the whole session back
+	status, code := sessionRequest(t, http.MethodPost, txURL+"/kv/"+string(bytes.Repeat([]byte("k"), 4096)), "value", nil)
+	require.Equal(t, http.StatusConflict, status)
+	require.Equal(t, "session_aborted", code)
+	status, _ = sessionRequest(t, http.MethodGet, txURL+"/kv/foo", "", nil)
+	require.Equal(t, http.StatusNotFound, status)
+	_, found := Get(srv.DBs.Primary(), "foo")
+	require.False(t, found)
+	require.EqualValues(t, 1, srv.sessions.getStats().Aborted)
+}
+
+func TestSessionsDisabled(t *testing.T) {
+	srv, url := setupSessionServer(t)
+	srv.Config.Server.Sessions = false
+	status, code := sessionRequest(t, http.MethodPost, url+"/tx", "", nil)
+	require.Equal(t, http.StatusForbidden, status)
+	require.Equal(t, "sessions_disabled", code)
+
+	srv.Config.Server.SessionTTL = time.Hour
+	require.Equal(t, maxSessionTTL, srv.sessionTTL(), "the TTL is capped")
+	err := validator.New().Struct(&ServerConfig{Host: "127.0.0.1", Port: 1, LogLevel: "INFO", SessionTTL: time.Minute})
+	require.ErrorContains(t, err, "SessionTTL")
+}
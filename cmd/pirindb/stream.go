@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/timson/pirindb/storage"
+)
+
+// statusBucketBatch bounds bucket stats read in one read transaction and held in memory while
+// the status is streamed
+const statusBucketBatch = 500
+
+// jsonStream writes a JSON object piece by piece through a buffer instead of marshaling it
+// whole, so the memory of a response does not grow with the buckets or keys in it. The status
+// is sent with the first piece, an error after it can only cut the body short.
+type jsonStream struct {
+	w      http.ResponseWriter
+	buf    *bufio.Writer
+	enc    *json.Encoder
+	fields int // fields written to the object so far
+	err    error
+}
+
+func newJSONStream(w http.ResponseWriter) *jsonStream {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	buf := bufio.NewWriter(w)
+	return &jsonStream{w: w, buf: buf, enc: json.NewEncoder(buf)}
+}
+
+// open starts the object with the fields of head, the streamed fields follow with field
+func (s *jsonStream) open(head any) {
+	data, err := json.Marshal(head)
+	if err == nil && (len(data) < 2 || data[0] != '{') {
+		err = errors.New("stream head is not a JSON object")
+	}
+	if err != nil {
+		s.err = err
+		return
+	}
+	if len(data) > 2 {
+		s.fields++
+	}
+	s.raw(string(data[:len(data)-1]))
+}
+
+// field starts the next field of the object, its value is written next
+func (s *jsonStream) field(name string) {
+	if s.fields > 0 {
+		s.raw(",")
+	}
+	s.fields++
+	s.value(name)
+	s.raw(":")
+}
+
+// raw writes JSON text as it is
+func (s *jsonStream) raw(text string) {
+	if s.err == nil {
+		_, s.err = s.buf.WriteString(text)
+	}
+}
+
+func (s *jsonStream) value(v any) {
+	if s.err == nil {
+		s.err = s.enc.Encode(v)
+	}
+}
+
+// flush hands what was written so far to the client
+func (s *jsonStream) flush() error {
+	if s.err == nil {
+		s.err = s.buf.Flush()
+	}
+	if flusher, ok := s.w.(http.Flusher); ok && s.err == nil {
+		flusher.Flush()
+	}
+	return s.err
+}
+
+// close ends the object and flushes it
+func (s *jsonStream) close() error {
+	s.raw("}\n")
+	return s.flush()
+}
+
+// statusHead is the status without the bucket fields, they are streamed after it
+type statusHead struct {
+	*storage.DBStat
+	Buckets         *struct{} `json:",omitempty"`
+	BucketsComplete *struct{} `json:",omitempty"`
+	InvalidBuckets  *struct{} `json:",omitempty"`
+}
+
+// writeStatus streams the status with the stats of every bucket, read statusBucketBatch at a
+// time and flushed to the client after every batch. The body is the DBStat of Status with
+// buckets, but the buckets are not a point in time snapshot and while a writer holds the lock
+// the remaining ones are left out, BucketsComplete is false then.
+func writeStatus(w http.ResponseWriter, r *http.Request, db *storage.DB) error {
+	stream := newJSONStream(w)
+	stream.open(statusHead{DBStat: Status(db, false)})
+	stream.field("Buckets")
+	stream.raw("{")
+	first := true
+	invalid, complete, err := db.StatBuckets(statusBucketBatch, func(stats []storage.NamedBucketStat) error {
+		for i := range stats {
+			if !first {
+				stream.raw(",")
+			}
+			first = false
+			stream.value(stats[i].Name)
+			stream.raw(":")
+			stream.value(&stats[i].BucketStat)
+		}
+		if err := stream.flush(); err != nil {
+			return err
+		}
+		return r.Context().Err()
+	})
+	if err != nil {
+		return err
+	}
+	stream.raw("}")
+	stream.field("BucketsComplete")
+	stream.value(complete)
+	stream.field("InvalidBuckets")
+	stream.value(invalid)
+	return stream.close()
+}
+
+// keyListHead is the key listing without the keys and sizes, they are streamed after it
+type keyListHead struct {
+	*KeyListResponse
+	Keys  *struct{} `json:"keys,omitempty"`
+	Sizes *struct{} `json:"sizes,omitempty"`
+}
+
+// writeKeyList streams the page of keys without copying them into a response first
+func writeKeyList(w http.ResponseWriter, list storage.DelimitedList) error {
+	resp := &KeyListResponse{Next: string(list.Next)}
+	if list.Next != nil {
+		resp.NextToken = string(storage.EncodeScanToken(list.Next))
+	}
+	for _, prefix := range list.CommonPrefixes {
+		resp.CommonPrefixes = append(resp.CommonPrefixes, string(prefix))
+	}
+	stream := newJSONStream(w)
+	stream.open(keyListHead{KeyListResponse: resp})
+	stream.field("keys")
+	stream.raw("[")
+	for i, key := range list.Keys {
+		if i > 0 {
+			stream.raw(",")
+		}
+		stream.value(string(key))
+	}
+	stream.raw("]")
+	if list.Sizes != nil {
+		stream.field("sizes")
+		stream.value(list.Sizes)
+	}
+	return stream.close()
+}
+
+// usageHead is the usage report without the prefixes, they are streamed after it
+type usageHead struct {
+	*UsageReport
+	Prefixes *struct{} `json:"prefixes,omitempty"`
+}
+
+// writeUsage streams the report a prefix at a time
+func writeUsage(w http.ResponseWriter, report *UsageReport) error {
+	stream := newJSONStream(w)
+	stream.open(usageHead{UsageReport: report})
+	stream.field("prefixes")
+	stream.raw("[")
+	for i := range report.Prefixes {
+		if i > 0 {
+			stream.raw(",")
+		}
+		stream.value(&report.Prefixes[i])
+	}
+	stream.raw("]")
+	return stream.close()
+}
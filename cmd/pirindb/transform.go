@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi"
+	"github.com/timson/pirindb/storage"
+)
+
+// defaultTransformMaxSize is the largest value a transform chain rewrites without max_size
+const defaultTransformMaxSize = 1024 * 1024
+
+// valueTransform rewrites a value, it must return the same output for the same input. An
+// input it can't handle returns an error, which refuses the value under a strict chain.
+type valueTransform func(value []byte) ([]byte, error)
+
+// valueTransforms are the transforms a bucket can list, TransformConfig validates the names
+var valueTransforms = map[string]valueTransform{
+	"trim_nul":       trimNUL,
+	"utf8":           requireUTF8,
+	"utf8_replace":   replaceInvalidUTF8,
+	"json_canonical": canonicalJSON,
+}
+
+// trimNUL drops the NUL bytes devices pad values with
+func trimNUL(value []byte) ([]byte, error) {
+	return bytes.TrimRight(value, "\x00"), nil
+}
+
+// requireUTF8 refuses a value that is not valid UTF-8
+func requireUTF8(value []byte) ([]byte, error) {
+	if !utf8.Valid(value) {
+		offset := 0
+		for offset < len(value) {
+			r, size := utf8.DecodeRune(value[offset:])
+			if r == utf8.RuneError && size <= 1 {
+				break
+			}
+			offset += size
+		}
+		return nil, fmt.Errorf("invalid UTF-8 at byte %d", offset)
+	}
+	return value, nil
+}
+
+// replaceInvalidUTF8 replaces every invalid UTF-8 sequence with U+FFFD
+func replaceInvalidUTF8(value []byte) ([]byte, error) {
+	if utf8.Valid(value) {
+		return value, nil
+	}
+	return bytes.ToValidUTF8(value, []byte(string(utf8.RuneError))), nil
+}
+
+// canonicalJSON encodes a JSON document without insignificant whitespace and with the keys of
+// every object sorted, numbers are kept as written
+func canonicalJSON(value []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: data after the document")
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(out.Bytes(), []byte("\n")), nil
+}
+
+// errTransformRejected is wrapped by the errors of a strict chain refusing a value
+var errTransformRejected = errors.New("value rejected by transform")
+
+// transformChain runs the transforms configured for a bucket in order
+type transformChain struct {
+	names   []string
+	strict  bool
+	maxSize int
+}
+
+func newTransformChain(cfg *TransformConfig) *transformChain {
+	chain := &transformChain{names: cfg.Apply, strict: cfg.Strict, maxSize: cfg.MaxSize}
+	if chain.maxSize == 0 {
+		chain.maxSize = defaultTransformMaxSize
+	}
+	return chain
+}
+
+// apply returns the value after the chain and the names of the transforms that ran. A value
+// above maxSize, an input a transform refuses or an output above maxSize fails a strict chain
+// with errTransformRejected; otherwise the value is kept as sent, or the transform skipped.
+func (chain *transformChain) apply(value []byte) ([]byte, []string, error) {
+	if len(value) > chain.maxSize {
+		if chain.strict {
+			return nil, nil, fmt.Errorf("%w: value of %d bytes is above max_size %d", errTransformRejected, len(value), chain.maxSize)
+		}
+		return value, nil, nil
+	}
+	var applied []string
+	for _, name := range chain.names {
+		out, err := valueTransforms[name](value)
+		if err == nil && len(out) > chain.maxSize {
+			err = fmt.Errorf("output of %d bytes is above max_size %d", len(out), chain.maxSize)
+		}
+		if err != nil {
+			if chain.strict {
+				return nil, nil, fmt.Errorf("%w %s: %w", errTransformRejected, name, err)
+			}
+			continue
+		}
+		value = out
+		applied = append(applied, name)
+	}
+	return value, applied, nil
+}
+
+// setupTransforms builds the transform chains of the configured databases
+func (srv *Server) setupTransforms() {
+	if srv.transforms != nil {
+		return
+	}
+	srv.transforms = make(map[string]map[string]*transformChain)
+	add := func(name string, dbCfg *DatabaseConfig) {
+		if dbCfg == nil || len(dbCfg.Transforms) == 0 {
+			return
+		}
+		chains := make(map[string]*transformChain, len(dbCfg.Transforms))
+		for _, cfg := range dbCfg.Transforms {
+			chains[cfg.Bucket] = newTransformChain(cfg)
+		}
+		srv.transforms[name] = chains
+	}
+	add(srv.DBs.PrimaryName(), srv.Config.DB)
+	for _, dbCfg := range srv.Config.Databases {
+		add(dbCfg.Name, dbCfg)
+	}
+}
+
+// transformChain returns the transforms of the bucket in the request database, nil without any
+func (srv *Server) transformChain(r *http.Request, bucket string) *transformChain {
+	name := chi.URLParam(r, "db")
+	if name == "" {
+		name = srv.DBs.PrimaryName()
+	}
+	return srv.transforms[name][bucket]
+}
+
+// putTransformed reads the whole value, checks it against the expected checksum of the value
+// sent and stores it after the chain
+func putTransformed(db *storage.DB, key string, body io.Reader, chain *transformChain, expected *uint64, opts writeOptions) ([]string, error) {
+	value, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if expected != nil && storage.ValueChecksum(value) != *expected {
+		return nil, storage.ErrChecksumMismatch
+	}
+	value, applied, err := chain.apply(value)
+	if err != nil {
+		return nil, err
+	}
+	return applied, PutReader(db, key, bytes.NewReader(value), len(value), nil, opts)
+}
+
+// transformBatch runs the chain of the main bucket on the batch values in place and returns
+// the transforms that ran by key
+func transformBatch(items []BatchItem, chain *transformChain) (map[string][]string, error) {
+	transformed := make(map[string][]string)
+	for i := range items {
+		value, applied, err := chain.apply([]byte(items[i].Value))
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		items[i].Value = string(value)
+		if len(applied) > 0 {
+			transformed[items[i].Key] = applied
+		}
+	}
+	return transformed, nil
+}
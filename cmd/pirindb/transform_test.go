@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestTransformChain(t *testing.T) {
+	chain := newTransformChain(&TransformConfig{Apply: []string{"trim_nul", "utf8_replace", "json_canonical"}})
+	value, applied, err := chain.apply([]byte("{\"b\": [1.50, {\"d\":1,\"c\":\"<\xff>\"}], \"a\": null}\x00\x00"))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":null,"b":[1.50,{"c":"<`+"�"+`>","d":1}]}`, string(value))
+	require.Equal(t, []string{"trim_nul", "utf8_replace", "json_canonical"}, applied)
+	again, _, err := chain.apply(value)
+	require.NoError(t, err)
+	require.Equal(t, value, again)
+
+	// a lenient chain skips the transforms a value can't go through
+	value, applied, err = chain.apply([]byte("plain text\x00"))
+	require.NoError(t, err)
+	require.Equal(t, "plain text", string(value))
+	require.Equal(t, []string{"trim_nul", "utf8_replace"}, applied)
+
+	strict := newTransformChain(&TransformConfig{Apply: []string{"utf8", "json_canonical"}, Strict: true, MaxSize: 16})
+	_, _, err = strict.apply([]byte("ab\xffc"))
+	require.ErrorIs(t, err, errTransformRejected)
+	require.ErrorContains(t, err, "utf8: invalid UTF-8 at byte 2")
+	_, _, err = strict.apply([]byte(`{"a":1} {}`))
+	require.ErrorContains(t, err, "json_canonical: invalid JSON")
+	_, _, err = strict.apply([]byte(`{"key":"a long value"}`))
+	require.ErrorContains(t, err, "above max_size 16")
+	lenient := newTransformChain(&TransformConfig{Apply: []string{"trim_nul"}, MaxSize: 4})
+	value, applied, err = lenient.apply([]byte("long\x00\x00"))
+	require.NoError(t, err)
+	require.Equal(t, "long\x00\x00", string(value))
+	require.Empty(t, applied)
+}
+
+func TestTransformedWrites(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.DB.Transforms = []*TransformConfig{
+		{Bucket: string(DBBucket), Apply: []string{"trim_nul", "json_canonical"}, Strict: true},
+		{Bucket: "events", Apply: []string{"trim_nul"}},
+	}
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	db := srv.DBs.Primary()
+
+	post := func(path, value string, headers ...string) (*http.Response, map[string]any) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(value))
+		require.NoError(t, err)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp, body
+	}
+
+	resp, body := post("/api/v1/kv/device", "{ \"z\": 1, \"a\": 2 }\x00\x00")
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, []any{"trim_nul", "json_canonical"}, body["transforms"])
+	value, _ := Get(db, "device")
+	require.Equal(t, `{"a":2,"z":1}`, value)
+
+	resp, body = post("/api/v1/kv/broken", "not json")
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Equal(t, "transform_failed", body["code"])
+	require.Contains(t, body["detail"], "json_canonical: invalid JSON")
+	_, found := Get(db, "broken")
+	require.False(t, found)
+
+	// the checksum sent is the one of the value before the transforms
+	sent := `{"b":1, "a":0}`
+	resp, _ = post("/api/v1/kv/summed", sent, checksumHeader, formatChecksum(storage.ValueChecksum([]byte(sent))))
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	resp, _ = post("/api/v1/kv/summed", sent, checksumHeader, formatChecksum(1))
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	batch := func(items ...BatchItem) (*http.Response, map[string]any) {
+		data, err := json.Marshal(&BatchRequest{Items: items})
+		require.NoError(t, err)
+		return post("/api/v1/batch", string(data))
+	}
+	resp, body = batch(BatchItem{Key: "b1", Value: `{"y":[], "x":{}}`}, BatchItem{Key: "b2", Value: "[1]\x00"})
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, map[string]any{"b1": []any{"trim_nul", "json_canonical"}, "b2": []any{"trim_nul", "json_canonical"}}, body["transforms"])
+	value, _ = Get(db, "b1")
+	require.Equal(t, `{"x":{},"y":[]}`, value)
+	resp, body = batch(BatchItem{Key: "b3", Value: "{}"}, BatchItem{Key: "b4", Value: "{"})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	require.Contains(t, body["detail"], "item 1: value rejected by transform json_canonical")
+	_, found = Get(db, "b3")
+	require.False(t, found)
+
+	resp, body = post("/api/v1/buckets/events/append", "reading\x00\x00\x00")
+	require.Equal(t, http.StatusCreated, resp.StatusCode, fmt.Sprint(body))
+	require.Equal(t, []any{"trim_nul"}, body["transforms"])
+	require.NoError(t, db.ForEach([]byte("events"), func(k, v []byte) error {
+		require.Equal(t, "reading", string(v))
+		return nil
+	}))
+}
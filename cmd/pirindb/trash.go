@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/timeseries"
+)
+
+func trashEntries(trash []storage.TrashedBucket) []TrashEntry {
+	entries := make([]TrashEntry, 0, len(trash))
+	for i := range trash {
+		entries = append(entries, TrashEntry{Name: trash[i].Name, DeletedAt: trash[i].DeletedAt, Stats: &trash[i].BucketStat})
+	}
+	return entries
+}
+
+// ListTrash returns the buckets in the trash of the database
+func ListTrash(db *storage.DB) ([]storage.TrashedBucket, error) {
+	var trash []storage.TrashedBucket
+	err := db.View(func(tx *storage.Tx) error {
+		var err error
+		trash, err = tx.Trash()
+		return err
+	})
+	return trash, err
+}
+
+// RestoreBucket moves the newest trashed copy of the bucket back
+func RestoreBucket(db *storage.DB, bucketName string, opts writeOptions) error {
+	return opts.update(db, func(tx *storage.Tx) error {
+		return tx.RestoreBucket([]byte(bucketName))
+	})
+}
+
+// deleteBucket deletes the bucket, every window of a partitioned one, and returns the
+// buckets deleted. With soft they are moved to the trash.
+func (srv *Server) deleteBucket(db *storage.DB, name string, soft bool, opts writeOptions) ([]string, error) {
+	var deleted []string
+	err := opts.update(db, func(tx *storage.Tx) error {
+		deleted = []string{name}
+		if pb := srv.partitions[name]; pb != nil {
+			deleted = deleted[:0]
+			for _, window := range timeseries.Windows(tx, name, pb.partition) {
+				deleted = append(deleted, window.Bucket)
+			}
+		}
+		if len(deleted) == 0 {
+			return storage.ErrBucketNotFound
+		}
+		for _, bucket := range deleted {
+			if !tx.BucketExists([]byte(bucket)) {
+				return storage.ErrBucketNotFound
+			}
+			var err error
+			if soft {
+				err = tx.DeleteBucketSoft([]byte(bucket))
+			} else {
+				err = tx.DeleteBucket([]byte(bucket))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// handleDeleteBucket deletes the bucket, into the trash with soft=true, server.soft_delete_buckets
+// is the default
+func (srv *Server) handleDeleteBucket(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	if isInternalBucket(bucket) {
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	}
+	soft := srv.Config.Server.SoftDeleteBuckets
+	if value := r.URL.Query().Get("soft"); value != "" {
+		var err error
+		if soft, err = strconv.ParseBool(value); err != nil {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+	}
+	deleted, err := srv.deleteBucket(db, bucket, soft, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrReservedBucketName):
+		_ = render.Render(w, r, ErrInvalidRequest())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to delete bucket", "bucket", bucket, "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &BucketDeleteResponse{Bucket: bucket, Deleted: deleted, Soft: soft, Status: "ok"})
+}
+
+// handleListTrash lists the buckets in the trash
+func (srv *Server) handleListTrash(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	trash, err := ListTrash(db)
+	if err != nil {
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &TrashListResponse{
+		Trash:            trashEntries(trash),
+		RetentionSeconds: int64(srv.Config.Server.TrashRetention / time.Second),
+	})
+}
+
+// handleRestoreBucket moves the newest trashed copy of the bucket back
+func (srv *Server) handleRestoreBucket(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	bucket := chi.URLParam(r, "bucket")
+	err := RestoreBucket(db, bucket, srv.writeOptions(r))
+	switch {
+	case errors.Is(err, storage.ErrBucketNotFound):
+		_ = render.Render(w, r, ErrBucketNotFound())
+		return
+	case errors.Is(err, storage.ErrBucketExists):
+		_ = render.Render(w, r, ErrBucketExists())
+		return
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to restore bucket", "bucket", bucket, "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &BucketRestoreResponse{Bucket: bucket, Status: "ok"})
+}
+
+// handlePurgeTrash deletes the trashed buckets for good, with older_than only those trashed
+// longer ago
+func (srv *Server) handlePurgeTrash(w http.ResponseWriter, r *http.Request) {
+	db, ok := srv.requestDB(r)
+	if !ok {
+		_ = render.Render(w, r, ErrDatabaseNotFound())
+		return
+	}
+	var deletedBefore time.Time
+	if value := r.URL.Query().Get("older_than"); value != "" {
+		olderThan, err := parseRetention(value)
+		if err != nil || olderThan <= 0 {
+			_ = render.Render(w, r, ErrInvalidRequest())
+			return
+		}
+		deletedBefore = time.Now().Add(-olderThan)
+	}
+	purged, err := db.PurgeTrash(deletedBefore)
+	switch {
+	case errors.Is(err, storage.ErrWriteStalled):
+		_ = render.Render(w, r, ErrWriteStalled())
+		return
+	case err != nil:
+		srv.Logger.Error("failed to purge trash", "error", err)
+		_ = render.Render(w, r, ErrInternalServerError())
+		return
+	}
+	render.JSON(w, r, &TrashPurgeResponse{Purged: trashEntries(purged), Status: "ok"})
+}
+
+// purgeTrash deletes the buckets in the trash longer than server.trash_retention
+func (srv *Server) purgeTrash(dbName string, db *storage.DB, now time.Time) {
+	if srv.Config.Server.TrashRetention <= 0 {
+		return
+	}
+	purged, err := db.PurgeTrash(now.Add(-srv.Config.Server.TrashRetention))
+	if err != nil {
+		srv.Logger.Error("Failed to purge trash", "db", dbName, "error", err)
+		return
+	}
+	for _, bucket := range purged {
+		srv.Logger.Info("Purged trashed bucket", "db", dbName, "bucket", bucket.Name, "deleted_at", bucket.DeletedAt)
+	}
+}
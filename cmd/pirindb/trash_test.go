@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestBucketTrashEndpoints(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	srv.Config.Server.SoftDeleteBuckets = true
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	db := srv.DBs.Primary()
+	require.NoError(t, db.Put([]byte("orders"), []byte("k"), []byte("v")))
+	require.NoError(t, db.Put([]byte("scratch"), []byte("k"), []byte("v")))
+	url := ts.URL + "/api/v1"
+
+	status, _ := modeRequest(t, http.MethodDelete, url+"/buckets/orders", "", "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = modeRequest(t, http.MethodDelete, url+"/buckets/scratch?soft=false", "", "")
+	require.Equal(t, http.StatusOK, status)
+	status, code := modeRequest(t, http.MethodDelete, url+"/buckets/missing", "", "")
+	require.Equal(t, http.StatusNotFound, status)
+	require.Equal(t, "bucket_not_found", code)
+
+	// the trashed bucket is only listed with include_trash, the hard deleted one is gone
+	var list BucketListResponse
+	getJSON(t, url+"/buckets?include_trash=true", &list)
+	for _, entry := range list.Buckets {
+		require.NotContains(t, []string{"orders", "scratch"}, entry.Name)
+	}
+	require.Len(t, list.Trash, 1)
+	require.Equal(t, "orders", list.Trash[0].Name)
+	require.EqualValues(t, 1, list.Trash[0].Stats.ItemsN)
+	list = BucketListResponse{}
+	getJSON(t, url+"/buckets", &list)
+	require.Empty(t, list.Trash)
+
+	status, _ = modeRequest(t, http.MethodPost, url+"/admin/trash/orders/restore", "", "")
+	require.Equal(t, http.StatusOK, status)
+	value, err := db.Get([]byte("orders"), []byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, "v", string(value))
+	status, _ = modeRequest(t, http.MethodPost, url+"/admin/trash/orders/restore", "", "")
+	require.Equal(t, http.StatusNotFound, status)
+
+	// trashed buckets are purged by the expire loop after the retention
+	status, _ = modeRequest(t, http.MethodDelete, url+"/buckets/orders", "", "")
+	require.Equal(t, http.StatusOK, status)
+	var trash TrashListResponse
+	getJSON(t, url+"/admin/trash", &trash)
+	require.Len(t, trash.Trash, 1)
+	srv.Config.Server.TrashRetention = time.Hour
+	srv.purgeTrash(srv.DBs.PrimaryName(), db, time.Now())
+	getJSON(t, url+"/admin/trash", &trash)
+	require.Len(t, trash.Trash, 1)
+	srv.purgeTrash(srv.DBs.PrimaryName(), db, time.Now().Add(2*time.Hour))
+	getJSON(t, url+"/admin/trash", &trash)
+	require.Empty(t, trash.Trash)
+	require.NoError(t, db.Check())
+}
+
+func getJSON(t *testing.T, url string, out any) {
+	t.Helper()
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(out))
+}
+
+func TestBucketEventsEndpoint(t *testing.T) {
+	srv, filename, txLogPath := setupTestServer(t)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+	ts := httptest.NewServer(srv.buildRouter())
+	defer ts.Close()
+	db := srv.DBs.Primary()
+	require.NoError(t, db.Put([]byte("orders"), []byte("k"), []byte("v")))
+	url := ts.URL + "/api/v1"
+
+	status, _ := modeRequest(t, http.MethodPut, url+"/buckets/orders/quota", `{"max_keys": 10}`, "")
+	require.Equal(t, http.StatusOK, status)
+	status, _ = modeRequest(t, http.MethodDelete, url+"/buckets/orders?soft=false", "", "")
+	require.Equal(t, http.StatusOK, status)
+
+	// the events outlive the bucket, requests carry the client as the actor
+	var events BucketEventsResponse
+	getJSON(t, url+"/buckets/orders/events", &events)
+	require.Equal(t, "orders", events.Bucket)
+	require.Len(t, events.Events, 3)
+	require.Equal(t, storage.EventDropped, events.Events[0].Type)
+	require.Equal(t, "127.0.0.1", events.Events[0].Actor)
+	require.Equal(t, storage.EventQuotaChanged, events.Events[1].Type)
+	require.Equal(t, "max_keys=10 max_bytes=0", events.Events[1].Detail)
+	require.Equal(t, storage.EventCreated, events.Events[2].Type)
+	require.Equal(t, storage.EmbeddedActor, events.Events[2].Actor)
+	getJSON(t, url+"/buckets/orders/events?limit=1", &events)
+	require.Len(t, events.Events, 1)
+	getJSON(t, url+"/buckets/missing/events", &events)
+	require.Empty(t, events.Events)
+	status, _ = modeRequest(t, http.MethodGet, url+"/buckets/orders/events?limit=0", "", "")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// bucket stats carry the newest events, the events bucket is not listed
+	require.NoError(t, db.Put([]byte("orders"), []byte("k"), []byte("v")))
+	var list BucketListResponse
+	getJSON(t, url+"/buckets?with_stats=true", &list)
+	found := false
+	for _, entry := range list.Buckets {
+		require.False(t, storage.IsInternalBucket([]byte(entry.Name)), entry.Name)
+		if entry.Name == "orders" {
+			found = true
+			require.Len(t, entry.Stats.Events, 3)
+			require.Equal(t, storage.EventCreated, entry.Stats.Events[0].Type)
+		}
+	}
+	require.True(t, found)
+	status, _ = modeRequest(t, http.MethodPut, url+"/buckets/__events/quota", `{"max_keys": 10}`, "")
+	require.Equal(t, http.StatusBadRequest, status)
+}
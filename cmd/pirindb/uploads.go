@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/timson/pirindb/storage"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	defaultUploadTTL     = time.Hour
+	uploadExpireInterval = time.Minute
+	maxUploadChunkSize   = 16 * 1024 * 1024
+	maxUploadSize        = storage.OneGigabyte - 1
+	// uploadIDSeparator ends the node name in an upload id, the uuid after it has none
+	uploadIDSeparator = "."
+)
+
+var (
+	// UploadsBucket stages chunks of unfinished uploads. Session records are stored under
+	// "session/{id}", chunks under "chunk/{id}/{offset}" so they sort in upload order and
+	// the expiry scan reads the sessions only.
+	UploadsBucket = []byte(storage.InternalBucketPrefix + "uploads")
+
+	uploadSessionPrefix = []byte("session/")
+	uploadChunkPrefix   = []byte("chunk/")
+
+	ErrUploadNotFound = errors.New("upload not found")
+	ErrUploadOffset   = errors.New("chunk offset does not match upload size")
+	ErrUploadTooLarge = errors.New("upload too large")
+)
+
+type uploadSession struct {
+	Key     string `json:"key"`
+	Size    int    `json:"size"`
+	Expires int64  `json:"expires"` // unix time
+}
+
+// newUploadID names the node holding the upload in front of a random id, in a cluster the
+// chunks and the commit are routed to it, see routeUpload
+func newUploadID(node string) string {
+	if node == "" {
+		return uuid.New().String()
+	}
+	return node + uploadIDSeparator + uuid.New().String()
+}
+
+// uploadNode returns the node named in the upload id, empty for an id without one
+func uploadNode(id string) string {
+	end := strings.LastIndex(id, uploadIDSeparator)
+	if end < 0 {
+		return ""
+	}
+	return id[:end]
+}
+
+func uploadSessionKey(id string) []byte {
+	return append(bytes.Clone(uploadSessionPrefix), id...)
+}
+
+func uploadChunkKey(id string, offset int) []byte {
+	return []byte(fmt.Sprintf("%s%s/%020d", uploadChunkPrefix, id, offset))
+}
+
+func getUploadSession(bucket *storage.Bucket, id string) (*uploadSession, error) {
+	data, found := bucket.Get(uploadSessionKey(id))
+	if !found {
+		return nil, ErrUploadNotFound
+	}
+	var session uploadSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func putUploadSession(bucket *storage.Bucket, id string, session *uploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(uploadSessionKey(id), data)
+}
+
+// uploadChunkKeys returns staged chunk keys of the upload in offset order
+func uploadChunkKeys(bucket *storage.Bucket, id string) [][]byte {
+	prefix := []byte(fmt.Sprintf("%s%s/", uploadChunkPrefix, id))
+	keys := make([][]byte, 0)
+	cursor := bucket.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func removeUpload(bucket *storage.Bucket, id string) error {
+	for _, chunkKey := range uploadChunkKeys(bucket, id) {
+		if err := bucket.Remove(chunkKey); err != nil {
+			return err
+		}
+	}
+	return bucket.Remove(uploadSessionKey(id))
+}
+
+// chunkReader streams staged chunks one by one, so commit holds a single chunk in memory
+type chunkReader struct {
+	bucket  *storage.Bucket
+	keys    [][]byte
+	current []byte
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for len(cr.current) == 0 {
+		if len(cr.keys) == 0 {
+			return 0, io.EOF
+		}
+		cr.current, _ = cr.bucket.Get(cr.keys[0])
+		cr.keys = cr.keys[1:]
+	}
+	n := copy(p, cr.current)
+	cr.current = cr.current[n:]
+	return n, nil
+}
+
+// StartUpload opens an upload of the value of the key staged on this node, node is its
+// cluster name, empty outside of a cluster
+func StartUpload(db *storage.DB, node, key string, ttl time.Duration, opts writeOptions) (string, error) {
+	id := newUploadID(node)
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(UploadsBucket)
+		if err != nil {
+			return err
+		}
+		return putUploadSession(bucket, id, &uploadSession{Key: key, Expires: time.Now().Add(ttl).Unix()})
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// AppendUpload stages a chunk at the given offset and returns the new upload size
+func AppendUpload(db *storage.DB, id string, offset int, chunk []byte, opts writeOptions) (int, error) {
+	var size int
+	err := opts.update(db, func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(UploadsBucket)
+		if err != nil {
+			return ErrUploadNotFound
+		}
+		session, err := getUploadSession(bucket, id)
+		if err != nil {
+			return err
+		}
+		if offset != session.Size {
+			return ErrUploadOffset
+		}
+		if session.Size+len(chunk) > maxUploadSize {
+			return ErrUploadTooLarge
+		}
+		if err = bucket.Put(uploadChunkKey(id, offset), chunk); err != nil {
+			return err
+		}
+		session.Size += len(chunk)
+		size = session.Size
+		return putUploadSession(bucket, id, session)
+	})
+	return size, err
+}
+
+// CommitUpload atomically writes the staged value to its key and drops the upload
+func CommitUpload(db *storage.DB, id string, opts writeOptions) (string, error) {
+	var key string
+	err := opts.update(db, func(tx *storage.Tx) error {
+		staging, err := tx.GetBucket(UploadsBucket)
+		if err != nil {
+			return ErrUploadNotFound
+		}
+		session, err := getUploadSession(staging, id)
+		if err != nil {
+			return err
+		}
+		bucket, err := mainBucket(tx)
+		if err != nil {
+			return err
+		}
+		reader := &chunkReader{bucket: staging, keys: uploadChunkKeys(staging, id)}
+		if err = bucket.PutReader([]byte(session.Key), reader, session.Size); err != nil {
+			return err
+		}
+		key = session.Key
+		return removeUpload(staging, id)
+	})
+	return key, err
+}
+
+// ExpireUploads drops abandoned uploads and returns the number of removed sessions
+func ExpireUploads(db *storage.DB, now time.Time) (int, error) {
+	expired := 0
+	err := db.UpdateLabeled("expire uploads", func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(UploadsBucket)
+		if err != nil {
+			return nil
+		}
+		ids := make([]string, 0)
+		cursor := bucket.Cursor()
+		for k, v := cursor.Seek(uploadSessionPrefix); k != nil && bytes.HasPrefix(k, uploadSessionPrefix); k, v = cursor.Next() {
+			var session uploadSession
+			if json.Unmarshal(v, &session) != nil || session.Expires <= now.Unix() {
+				ids = append(ids, string(k[len(uploadSessionPrefix):]))
+			}
+		}
+		if err = cursor.Err(); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err = removeUpload(bucket, id); err != nil {
+				return err
+			}
+		}
+		expired = len(ids)
+		return nil
+	})
+	return expired, err
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timson/pirindb/storage"
+)
+
+var (
+	// UsageBucket caches usage reports by delimiter, buckets named with the __ prefix are
+	// internal and not counted
+	UsageBucket = []byte("__usage")
+
+	ErrUsageRunning = errors.New("usage is already being computed")
+)
+
+// UsagePrefix is the storage taken by a first-level prefix across all buckets
+type UsagePrefix struct {
+	Prefix string `json:"prefix"`
+	Bytes  uint64 `json:"bytes"` // keys and values, blobs by their size
+	Items  uint64 `json:"items"`
+}
+
+// UsageReport is a usage computation, served from UsageBucket until ExpiresAt
+type UsageReport struct {
+	Delimiter  string        `json:"delimiter"`
+	ComputedAt time.Time     `json:"computed_at"`
+	ExpiresAt  time.Time     `json:"expires_at"`
+	DurationMs float64       `json:"duration_ms"`
+	Buckets    int           `json:"buckets"`
+	Prefixes   []UsagePrefix `json:"prefixes"` // by bytes, largest first
+	// a bucket had more than maxUsagePrefixes prefixes, the smaller ones are missing
+	Truncated bool `json:"truncated"`
+}
+
+// usageJobs lets one computation per database and delimiter run at a time
+type usageJobs struct {
+	lock    sync.Mutex
+	running map[string]bool
+	wg      sync.WaitGroup
+}
+
+// start runs fn in background unless a job with the key runs, ErrUsageRunning then
+func (jobs *usageJobs) start(key string, fn func()) error {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	if jobs.running[key] {
+		return ErrUsageRunning
+	}
+	if jobs.running == nil {
+		jobs.running = make(map[string]bool)
+	}
+	jobs.running[key] = true
+	jobs.wg.Add(1)
+	go func() {
+		defer jobs.wg.Done()
+		defer func() {
+			jobs.lock.Lock()
+			delete(jobs.running, key)
+			jobs.lock.Unlock()
+		}()
+		fn()
+	}()
+	return nil
+}
+
+func (jobs *usageJobs) isRunning(key string) bool {
+	jobs.lock.Lock()
+	defer jobs.lock.Unlock()
+	return jobs.running[key]
+}
+
+// usageTTL returns how long a usage report is served from the cache
+func (srv *Server) usageTTL() time.Duration {
+	if srv.Config.Server.UsageTTL <= 0 {
+		return defaultUsageTTL
+	}
+	return srv.Config.Server.UsageTTL
+}
+
+// startUsage computes the usage of the database in background and caches the report
+func (srv *Server) startUsage(name string, db *storage.DB, delimiter string) error {
+	return srv.usage.start(name+"\x00"+delimiter, func() {
+		report, err := ComputeUsage(db, delimiter, time.Now(), srv.usageTTL())
+		if err == nil {
+			err = storeUsage(db, report)
+		}
+		if err != nil {
+			srv.Logger.Error("Usage computation failed", "db", name, "delimiter", delimiter, "error", err)
+			return
+		}
+		srv.Logger.Info("Usage computed", "db", name, "delimiter", delimiter, "prefixes", len(report.Prefixes),
+			"duration_ms", report.DurationMs)
+	})
+}
+
+// ComputeUsage sums the prefix stats of every bucket that is not internal by the first-level
+// prefix, each bucket in its own read transaction so a long computation holds none for long
+func ComputeUsage(db *storage.DB, delimiter string, now time.Time, ttl time.Duration) (*UsageReport, error) {
+	report := &UsageReport{Delimiter: delimiter, ComputedAt: now, ExpiresAt: now.Add(ttl)}
+	var names [][]byte
+	if err := db.View(func(tx *storage.Tx) error {
+		names = tx.Buckets()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	prefixes := make(map[string]*UsagePrefix)
+	for _, name := range names {
+		if strings.HasPrefix(string(name), "__") {
+			continue
+		}
+		var stats storage.PrefixStats
+		err := db.View(func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket(name)
+			if err != nil {
+				return err
+			}
+			stats, err = bucket.PrefixStats(storage.PrefixStatsOptions{Delimiter: []byte(delimiter), Top: maxUsagePrefixes})
+			return err
+		})
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		report.Buckets++
+		report.Truncated = report.Truncated || stats.Prefixes > maxUsagePrefixes
+		for _, stat := range stats.ByBytes {
+			prefix, ok := prefixes[string(stat.Prefix)]
+			if !ok {
+				prefix = &UsagePrefix{Prefix: string(stat.Prefix)}
+				prefixes[prefix.Prefix] = prefix
+			}
+			prefix.Bytes += stat.Bytes
+			prefix.Items += stat.Count
+		}
+	}
+	report.Prefixes = make([]UsagePrefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		report.Prefixes = append(report.Prefixes, *prefix)
+	}
+	slices.SortFunc(report.Prefixes, func(a, b UsagePrefix) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Prefix, b.Prefix)
+	})
+	report.DurationMs = float64(time.Since(now).Microseconds()) / 1000
+	return report, nil
+}
+
+// storeUsage caches the report under its delimiter
+func storeUsage(db *storage.DB, report *UsageReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return db.UpdateLabeled("usage", func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(UsageBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(report.Delimiter), data)
+	})
+}
+
+// cachedUsage returns the cached report of the delimiter as it was stored, nil if there is
+// none or it expired. Only the expiry is decoded.
+func cachedUsage(db *storage.DB, delimiter string, now time.Time) ([]byte, error) {
+	var data []byte
+	err := db.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket(UsageBucket)
+		if errors.Is(err, storage.ErrBucketNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, found, err := bucket.Lookup([]byte(delimiter))
+		if err != nil || !found {
+			return err
+		}
+		data = bytes.Clone(value)
+		return nil
+	})
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var head struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err = json.Unmarshal(data, &head); err != nil || !now.Before(head.ExpiresAt) {
+		return nil, err
+	}
+	return data, nil
+}
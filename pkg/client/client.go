@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrValueTooLarge is returned by Get for a value above the JSON limit of the server, it is
+// read with Accept: application/octet-stream instead
+var ErrValueTooLarge = errors.New("value too large for a JSON read")
+
+// Consistency selects where a read is served from in a sharded cluster
+type Consistency string
+
+const (
+	ConsistencyDefault Consistency = ""
+	// ConsistencyOwner always reads from the shard owning the key
+	ConsistencyOwner Consistency = "owner"
+	// ConsistencyAny lets a replica holding the key serve the read, it may be stale
+	ConsistencyAny Consistency = "any"
+)
+
+// Client is a minimal Go client for the pirindb HTTP API
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+}
+
+// VersionInfo mirrors the server /version response
+type VersionInfo struct {
+	Version            string   `json:"version"`
+	GitCommit          string   `json:"git_commit"`
+	StorageFormatMajor int      `json:"storage_format_major"`
+	StorageFormatMinor int      `json:"storage_format_minor"`
+	Features           []string `json:"features"`
+	// Sharding is set by cluster nodes, keys can be routed with a Router
+	Sharding bool `json:"sharding,omitempty"`
+}
+
+// GetResult is a value read from the server
+type GetResult struct {
+	Value    string
+	ServedBy string // cluster node that served the read, empty outside of a cluster
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// ServerVersion fetches server and storage format versions
+func (c *Client) ServerVersion(ctx context.Context) (*VersionInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/version", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var info VersionInfo
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &info, nil
+}
+
+// Get reads the key from the primary database with the given read consistency
+func (c *Client) Get(ctx context.Context, key string, consistency Consistency) (*GetResult, error) {
+	reqURL := c.baseURL + "/api/v1/kv/" + url.PathEscape(key)
+	if consistency != ConsistencyDefault {
+		reqURL += "?consistency=" + url.QueryEscape(string(consistency))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrKeyNotFound
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return nil, ErrValueTooLarge
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &GetResult{Value: body.Value, ServedBy: resp.Header.Get("X-Pirin-Served-By")}, nil
+}
+
+// MajorVersion returns the major component of a semver string
+func MajorVersion(version string) string {
+	major, _, _ := strings.Cut(strings.TrimPrefix(version, "v"), ".")
+	return major
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/timson/pirindb/pkg/sharding"
+)
+
+// RingInfo mirrors the server cluster ring response, it has the fields of sharding.RingState
+type RingInfo struct {
+	Version      int               `json:"version,omitempty"`       // sharding.RingFormatVersion of the node
+	VirtualNodes int               `json:"virtual_nodes,omitempty"` // per shard, 0 from nodes before it was reported
+	Shards       []*sharding.Shard `json:"shards"`
+	// GroupDelimiter is the key group delimiter of the node, empty if groups are disabled
+	GroupDelimiter string `json:"group_delimiter,omitempty"`
+}
+
+// State returns the ring state of the info, fields older nodes leave out get their defaults
+func (info *RingInfo) State() sharding.RingState {
+	state := sharding.RingState{
+		Version:        info.Version,
+		VirtualNodes:   info.VirtualNodes,
+		GroupDelimiter: info.GroupDelimiter,
+		Shards:         info.Shards,
+	}
+	if state.Version == 0 {
+		state.Version = sharding.RingFormatVersion
+	}
+	if state.VirtualNodes == 0 {
+		state.VirtualNodes = sharding.DefaultVirtualNodes
+	}
+	return state
+}
+
+// RangeDigests mirrors the server range digest response: the key space split into Ranges
+// ranges, with a digest of the keys the node holds for Owner in each
+type RangeDigests struct {
+	Ranges  int           `json:"ranges"`
+	Owner   string        `json:"owner"`
+	Digests []RangeDigest `json:"digests"`
+}
+
+// RangeDigest covers the keys from Start up to End, a nil Start or End leaves the range open
+type RangeDigest struct {
+	Range  int    `json:"range"`
+	Start  []byte `json:"start"`
+	End    []byte `json:"end"`
+	Keys   int    `json:"keys"`
+	Digest string `json:"digest"` // 16 hex digits, equal digests hold the same keys and values
+}
+
+// JoinCluster registers the shard with the node and returns the ring after the join
+func (c *Client) JoinCluster(ctx context.Context, shard *sharding.Shard) ([]*sharding.Shard, error) {
+	return c.postRing(ctx, "/cluster/join", shard)
+}
+
+// PushRing replaces the ring known by the node and returns it
+func (c *Client) PushRing(ctx context.Context, shards []*sharding.Shard) ([]*sharding.Shard, error) {
+	return c.postRing(ctx, "/cluster/ring", &RingInfo{Shards: shards})
+}
+
+// Ring fetches the ring known by the node
+func (c *Client) Ring(ctx context.Context) ([]*sharding.Shard, error) {
+	info, err := c.RingInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return info.Shards, nil
+}
+
+// RingInfo fetches the ring known by the node with its placement settings
+func (c *Client) RingInfo(ctx context.Context) (*RingInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/cluster/ring", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return c.doRingInfo(req)
+}
+
+// RangeDigests fetches the digests of the keys the node holds for the owner shard, of every
+// range or of one range when keyRange is not negative. An empty owner is the node itself.
+func (c *Client) RangeDigests(ctx context.Context, owner string, keyRange int) (*RangeDigests, error) {
+	query := url.Values{}
+	if owner != "" {
+		query.Set("owner", owner)
+	}
+	if keyRange >= 0 {
+		query.Set("range", strconv.Itoa(keyRange))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/cluster/digest?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var digests RangeDigests
+	if err = json.NewDecoder(resp.Body).Decode(&digests); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &digests, nil
+}
+
+func (c *Client) postRing(ctx context.Context, path string, body any) ([]*sharding.Shard, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	info, err := c.doRingInfo(req)
+	if err != nil {
+		return nil, err
+	}
+	return info.Shards, nil
+}
+
+func (c *Client) doRingInfo(req *http.Request) (*RingInfo, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var ring RingInfo
+	if err = json.NewDecoder(resp.Body).Decode(&ring); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &ring, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrLockHeld     = errors.New("lock is held")
+	ErrLockNotHeld  = errors.New("lock is not held")
+	ErrLockMismatch = errors.New("lock is held with another token")
+)
+
+// Lease is a held lock, Token is the fencing token to pass to downstream writes
+type Lease struct {
+	Name    string    `json:"name"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// AcquireLock takes the lock in the primary database for ttl, a held lock fails with ErrLockHeld
+func (c *Client) AcquireLock(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	reqURL := c.baseURL + "/api/v1/locks/" + url.PathEscape(name) + "?ttl=" + url.QueryEscape(ttl.String())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusConflict {
+		return nil, ErrLockHeld
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+	var lease Lease
+	if err = json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("failed to parse response: %w", err)
+	}
+	return &lease, nil
+}
+
+// ReleaseLock drops the lock if it is still held with the token
+func (c *Client) ReleaseLock(ctx context.Context, name string, token uint64) error {
+	reqURL := c.baseURL + "/api/v1/locks/" + url.PathEscape(name) + "?token=" + strconv.FormatUint(token, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, reqURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrLockNotHeld
+	case http.StatusConflict:
+		return ErrLockMismatch
+	default:
+		return fmt.Errorf("unexpected status code: %s", resp.Status)
+	}
+}
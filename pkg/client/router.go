@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/timson/pirindb/pkg/sharding"
+)
+
+var ErrNoShard = errors.New("no shard serves the key")
+
+// Router sends every key to the shard owning it, so requests skip the node that would proxy
+// them. The ring is fetched from a node and placed by the same code the nodes use, Refresh
+// fetches it again after the membership changed.
+type Router struct {
+	seed    *Client
+	lock    sync.RWMutex
+	ring    *sharding.ConsistentHash
+	clients map[string]*Client // by shard url
+}
+
+// NewRouter fetches the ring from the node at seedURL
+func NewRouter(ctx context.Context, seedURL string) (*Router, error) {
+	router := &Router{seed: New(seedURL), clients: make(map[string]*Client)}
+	if err := router.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// Refresh fetches the ring from the seed node, or from the known shards while the seed is down
+func (r *Router) Refresh(ctx context.Context) error {
+	info, err := r.seed.RingInfo(ctx)
+	if err != nil {
+		for _, shard := range r.Ring().Shards() {
+			if info, err = New(shard.URL()).RingInfo(ctx); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	ring, err := sharding.NewConsistentHashFromState(info.State())
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.ring = ring
+	return nil
+}
+
+// Ring returns the ring keys are routed by
+func (r *Router) Ring() *sharding.ConsistentHash {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.ring == nil {
+		return sharding.NewConsistentHash(0)
+	}
+	return r.ring
+}
+
+// ClientFor returns the client of the shard owning the key
+func (r *Router) ClientFor(key string) (*Client, error) {
+	shard := r.Ring().GetShard(key)
+	if shard == nil {
+		return nil, ErrNoShard
+	}
+	url := shard.URL()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	client, ok := r.clients[url]
+	if !ok {
+		client = New(url)
+		r.clients[url] = client
+	}
+	return client, nil
+}
+
+// Get reads the key from the shard owning it
+func (r *Router) Get(ctx context.Context, key string, consistency Consistency) (*GetResult, error) {
+	client, err := r.ClientFor(key)
+	if err != nil {
+		return nil, err
+	}
+	return client.Get(ctx, key, consistency)
+}
@@ -0,0 +1,191 @@
+package sharding
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// RingFormatVersion is the version of the ring encoding and of the placement: a change to
+// the hash, the virtual node names or the encoding bumps it, a ring of another version is
+// refused rather than placing keys elsewhere than the nodes do
+const RingFormatVersion = 1
+
+var ringMagic = []byte("PRNG")
+
+var (
+	ErrMalformedRing = errors.New("sharding: malformed ring")
+	ErrRingVersion   = errors.New("sharding: unsupported ring version")
+)
+
+// RingState is everything the placement of keys depends on, rings built from equal states
+// place every key on the same shards on any platform
+type RingState struct {
+	Version        int      `json:"version"`
+	VirtualNodes   int      `json:"virtual_nodes"`
+	GroupDelimiter string   `json:"group_delimiter,omitempty"`
+	Shards         []*Shard `json:"shards"` // ordered by name
+}
+
+// State returns the state of the ring, NewConsistentHashFromState builds it again
+func (ch *ConsistentHash) State() RingState {
+	return RingState{
+		Version:        RingFormatVersion,
+		VirtualNodes:   ch.VirtualNodes(),
+		GroupDelimiter: ch.GroupDelimiter(),
+		Shards:         ch.Shards(),
+	}
+}
+
+// VirtualNodes returns the number of virtual nodes placed for every shard
+func (ch *ConsistentHash) VirtualNodes() int {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	return ch.virtualNodes
+}
+
+// NewConsistentHashFromState builds the ring of the state
+func NewConsistentHashFromState(state RingState) (*ConsistentHash, error) {
+	if err := state.validate(); err != nil {
+		return nil, err
+	}
+	ch := NewConsistentHash(state.VirtualNodes)
+	ch.SetGroupDelimiter(state.GroupDelimiter)
+	ch.Sync(state.Shards)
+	return ch, nil
+}
+
+func (state *RingState) validate() error {
+	if state.Version != RingFormatVersion {
+		return fmt.Errorf("%w: %d, this build places keys with version %d", ErrRingVersion, state.Version, RingFormatVersion)
+	}
+	if state.VirtualNodes <= 0 {
+		return fmt.Errorf("%w: %d virtual nodes", ErrMalformedRing, state.VirtualNodes)
+	}
+	names := make(map[string]bool, len(state.Shards))
+	for _, shard := range state.Shards {
+		if shard == nil || shard.Name == "" {
+			return fmt.Errorf("%w: shard without a name", ErrMalformedRing)
+		}
+		if names[shard.Name] {
+			return fmt.Errorf("%w: shard %q is listed twice", ErrMalformedRing, shard.Name)
+		}
+		names[shard.Name] = true
+	}
+	return nil
+}
+
+// replace swaps the ring for the one of the state, used by the unmarshal methods
+func (ch *ConsistentHash) replace(state RingState) error {
+	ring, err := NewConsistentHashFromState(state)
+	if err != nil {
+		return err
+	}
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.virtualNodes = ring.virtualNodes
+	ch.shards = ring.shards
+	ch.points = ring.points
+	ch.owners = ring.owners
+	ch.groupDelim = ring.groupDelim
+	return nil
+}
+
+func (ch *ConsistentHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(ch.State())
+}
+
+func (ch *ConsistentHash) UnmarshalJSON(data []byte) error {
+	var state RingState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("%w: %w", ErrMalformedRing, err)
+	}
+	return ch.replace(state)
+}
+
+// MarshalBinary encodes the ring as the magic, the version byte, the virtual nodes, the group
+// delimiter and the shards by name. Numbers are uvarints, strings are prefixed by their
+// uvarint length, so the encoding does not depend on the platform.
+func (ch *ConsistentHash) MarshalBinary() ([]byte, error) {
+	state := ch.State()
+	buf := append([]byte(nil), ringMagic...)
+	buf = append(buf, byte(state.Version))
+	buf = binary.AppendUvarint(buf, uint64(state.VirtualNodes))
+	buf = appendString(buf, state.GroupDelimiter)
+	buf = binary.AppendUvarint(buf, uint64(len(state.Shards)))
+	for _, shard := range state.Shards {
+		buf = appendString(buf, shard.Name)
+		buf = appendString(buf, shard.Host)
+		buf = binary.AppendUvarint(buf, uint64(shard.Port))
+		buf = appendString(buf, string(shard.Status))
+		buf = appendString(buf, shard.Mode)
+		buf = appendString(buf, shard.BasePath)
+	}
+	return buf, nil
+}
+
+func (ch *ConsistentHash) UnmarshalBinary(data []byte) error {
+	if !bytes.HasPrefix(data, ringMagic) || len(data) == len(ringMagic) {
+		return fmt.Errorf("%w: not an encoded ring", ErrMalformedRing)
+	}
+	state := RingState{Version: int(data[len(ringMagic)])}
+	if state.Version != RingFormatVersion {
+		return fmt.Errorf("%w: %d, this build places keys with version %d", ErrRingVersion, state.Version, RingFormatVersion)
+	}
+	r := &ringReader{data: data[len(ringMagic)+1:]}
+	state.VirtualNodes = int(r.uvarint())
+	state.GroupDelimiter = r.string()
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		shard := &Shard{Name: r.string(), Host: r.string(), Port: int(r.uvarint())}
+		shard.Status, shard.Mode, shard.BasePath = ShardStatus(r.string()), r.string(), r.string()
+		state.Shards = append(state.Shards, shard)
+	}
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%w: %d trailing bytes", ErrMalformedRing, len(r.data))
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return ch.replace(state)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// ringReader decodes the binary ring, the first error sticks and later reads return zeros
+type ringReader struct {
+	data []byte
+	err  error
+}
+
+func (r *ringReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: truncated number", ErrMalformedRing)
+		return 0
+	}
+	r.data = r.data[n:]
+	return value
+}
+
+func (r *ringReader) string() string {
+	size := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if size > uint64(len(r.data)) {
+		r.err = fmt.Errorf("%w: truncated string", ErrMalformedRing)
+		return ""
+	}
+	s := string(r.data[:size])
+	r.data = r.data[size:]
+	return s
+}
@@ -0,0 +1,167 @@
+package sharding
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testRing() *ConsistentHash {
+	ring := NewConsistentHash(DefaultVirtualNodes)
+	ring.SetGroupDelimiter("/")
+	draining := testShard("node3")
+	draining.Status, draining.Mode, draining.BasePath = ShardDraining, "read_only", "/pirin"
+	ring.Sync([]*Shard{testShard("node1"), testShard("node2"), draining, testShard("node4")})
+	return ring
+}
+
+// requireSamePlacement checks that both rings send every key to the same shards
+func requireSamePlacement(t *testing.T, expected, actual *ConsistentHash) {
+	t.Helper()
+	require.Equal(t, expected.State(), actual.State())
+	require.Equal(t, expected.Points(), actual.Points())
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if i%2 == 0 {
+			key = fmt.Sprintf("group-%d/key", i)
+		}
+		require.Equal(t, expected.GetShards(key, 3), actual.GetShards(key, 3), key)
+	}
+}
+
+// the hash and the placement are pinned, a client and a server built for any architecture or
+// from any release of the same RingFormatVersion must agree on them
+func TestHashStability(t *testing.T) {
+	hashes := map[string]uint32{
+		"":           2166136261,
+		"a":          3826002220,
+		"user:42":    795573122,
+		"a#0":        4037809751,
+		"shard-1#63": 1080458689,
+	}
+	for key, hash := range hashes {
+		require.Equal(t, hash, hashKey(key), key)
+	}
+
+	ring := NewConsistentHash(DefaultVirtualNodes)
+	ring.SetGroupDelimiter("/")
+	ring.Sync([]*Shard{testShard("node1"), testShard("node2"), testShard("node3")})
+	owners := map[string]string{
+		"alpha":       "node1",
+		"bravo":       "node2",
+		"charlie":     "node1",
+		"foxtrot":     "node3",
+		"golf":        "node3",
+		"user/42":     "node2",
+		"user/43":     "node2",
+		"orders/2024": "node1",
+	}
+	for key, owner := range owners {
+		require.Equal(t, owner, ring.GetShard(key).Name, key)
+	}
+}
+
+func TestConsistentHashCollisionOrder(t *testing.T) {
+	// the virtual node shard-5177#40 hashes to the point of shard-2116#24
+	require.Equal(t, hashKey("shard-2116#24"), hashKey("shard-5177#40"))
+	first, second := testShard("shard-2116"), testShard("shard-5177")
+	points := make(map[string]int)
+	for _, shard := range []*Shard{first, second} {
+		alone := NewConsistentHash(DefaultVirtualNodes)
+		alone.Add(shard)
+		points[shard.Name] = alone.Points()
+	}
+
+	joined := NewConsistentHash(DefaultVirtualNodes)
+	joined.Add(second)
+	joined.Add(first)
+	reversed := NewConsistentHash(DefaultVirtualNodes)
+	reversed.Add(first)
+	reversed.Add(second)
+	require.Less(t, joined.Points(), points["shard-2116"]+points["shard-5177"])
+	requireSamePlacement(t, reversed, joined)
+	require.Equal(t, "shard-2116", joined.GetShard("shard-5177#40").Name, "the lower name keeps the point")
+
+	// the point goes back to the other shard once the owner leaves
+	joined.Remove("shard-2116")
+	require.Equal(t, points["shard-5177"], joined.Points())
+	require.Equal(t, "shard-5177", joined.GetShard("shard-5177#40").Name)
+}
+
+func TestRingJSONRoundTrip(t *testing.T) {
+	ring := testRing()
+	data, err := json.Marshal(ring)
+	require.NoError(t, err)
+	var state RingState
+	require.NoError(t, json.Unmarshal(data, &state))
+	require.Equal(t, RingFormatVersion, state.Version)
+	require.Equal(t, DefaultVirtualNodes, state.VirtualNodes)
+	require.Equal(t, "/", state.GroupDelimiter)
+	require.Equal(t, []string{"node1", "node2", "node3", "node4"}, shardNames(state.Shards))
+
+	var decoded ConsistentHash
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	requireSamePlacement(t, ring, &decoded)
+	fromState, err := NewConsistentHashFromState(state)
+	require.NoError(t, err)
+	requireSamePlacement(t, ring, fromState)
+
+	small := NewConsistentHash(2)
+	small.Add(testShard("a"))
+	data, err = json.Marshal(small)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"version":1,"virtual_nodes":2,"shards":[{"name":"a","host":"127.0.0.1","port":4321,"status":"active"}]}`, string(data))
+}
+
+func TestRingBinaryRoundTrip(t *testing.T) {
+	ring := testRing()
+	data, err := ring.MarshalBinary()
+	require.NoError(t, err)
+	decoded := NewConsistentHash(1)
+	decoded.Add(testShard("replaced"))
+	require.NoError(t, decoded.UnmarshalBinary(data))
+	requireSamePlacement(t, ring, decoded)
+	again, err := decoded.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, data, again)
+
+	// the encoding is pinned byte for byte
+	small := NewConsistentHash(2)
+	small.SetGroupDelimiter("/")
+	small.Add(&Shard{Name: "a", Host: "h", Port: 300, Status: ShardDraining, Mode: "read_only", BasePath: "/p"})
+	data, err = small.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, "50524e470102012f0101610168ac0208647261696e696e6709726561645f6f6e6c79022f70", hex.EncodeToString(data))
+}
+
+func TestRingDecodeErrors(t *testing.T) {
+	data, err := testRing().MarshalBinary()
+	require.NoError(t, err)
+	var ring ConsistentHash
+	require.ErrorIs(t, ring.UnmarshalBinary(nil), ErrMalformedRing)
+	require.ErrorIs(t, ring.UnmarshalBinary([]byte("PRNG")), ErrMalformedRing)
+	for _, size := range []int{5, 6, 20, len(data) - 1} {
+		require.ErrorIs(t, ring.UnmarshalBinary(data[:size]), ErrMalformedRing, size)
+	}
+	require.ErrorIs(t, ring.UnmarshalBinary(append(data, 0)), ErrMalformedRing)
+	future := append([]byte(nil), data...)
+	future[4] = RingFormatVersion + 1
+	require.ErrorIs(t, ring.UnmarshalBinary(future), ErrRingVersion)
+
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"version":2,"virtual_nodes":64}`), &ring), ErrRingVersion)
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"version":1}`), &ring), ErrMalformedRing)
+	require.ErrorIs(t, json.Unmarshal([]byte(`{"version":1,"virtual_nodes":64,"shards":[{"name":"a"},{"name":"a"}]}`), &ring), ErrMalformedRing)
+	_, err = NewConsistentHashFromState(RingState{Version: RingFormatVersion, VirtualNodes: 1, Shards: []*Shard{{}}})
+	require.ErrorIs(t, err, ErrMalformedRing)
+}
+
+func shardNames(shards []*Shard) []string {
+	names := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		names = append(names, shard.Name)
+	}
+	return names
+}
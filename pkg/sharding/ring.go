@@ -0,0 +1,267 @@
+package sharding
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultVirtualNodes = 64
+
+type ShardStatus string
+
+const (
+	ShardActive   ShardStatus = "active"
+	ShardDraining ShardStatus = "draining"
+	ShardDead     ShardStatus = "dead"
+)
+
+// Shard is a cluster node owning a part of the key space
+type Shard struct {
+	Name   string      `json:"name"`
+	Host   string      `json:"host"`
+	Port   int         `json:"port"`
+	Status ShardStatus `json:"status"`
+	// Mode is the request mode advertised by the node, like read_only, empty for read_write
+	Mode string `json:"mode,omitempty"`
+	// BasePath is the prefix the node serves its routes under, empty for the root
+	BasePath string `json:"base_path,omitempty"`
+}
+
+// URL returns the base url of the shard http api
+func (s *Shard) URL() string {
+	return fmt.Sprintf("http://%s:%d%s", s.Host, s.Port, s.BasePath)
+}
+
+// ConsistentHash maps keys to shards, every shard is placed on the ring as a fixed
+// number of virtual nodes derived from its name, so a shard always lands on the same
+// points no matter how many times it is added. Safe for concurrent use.
+type ConsistentHash struct {
+	lock         sync.RWMutex
+	virtualNodes int
+	shards       map[string]*Shard
+	points       []uint32          // sorted virtual node hashes
+	owners       map[uint32]string // virtual node hash -> shard name
+	groupDelim   string            // keys containing it are placed by their group, empty disables groups
+}
+
+func NewConsistentHash(virtualNodes int) *ConsistentHash {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &ConsistentHash{
+		virtualNodes: virtualNodes,
+		shards:       make(map[string]*Shard),
+		owners:       make(map[uint32]string),
+	}
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// GroupKey returns the part of the key placed on the ring: the group before the first
+// delimiter, or the whole key if the delimiter is empty, missing from the key or the group
+// before it is empty
+func GroupKey(key, delimiter string) string {
+	if delimiter == "" {
+		return key
+	}
+	group, _, found := strings.Cut(key, delimiter)
+	if !found || group == "" {
+		return key
+	}
+	return group
+}
+
+// SetGroupDelimiter makes keys containing the delimiter hash by their group only, so all
+// keys of a group are owned by the same shards. Keys without the delimiter are placed as
+// before. Every node of a cluster must use the same delimiter.
+func (ch *ConsistentHash) SetGroupDelimiter(delimiter string) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.groupDelim = delimiter
+}
+
+// GroupDelimiter returns the delimiter set by SetGroupDelimiter
+func (ch *ConsistentHash) GroupDelimiter() string {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	return ch.groupDelim
+}
+
+// Add places the shard on the ring and reports whether it is new. A shard already on
+// the ring keeps its virtual nodes, only its address and status are updated.
+func (ch *ConsistentHash) Add(shard *Shard) bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.add(shard)
+}
+
+func (ch *ConsistentHash) add(shard *Shard) bool {
+	shardCopy := *shard
+	if _, ok := ch.shards[shard.Name]; ok {
+		ch.shards[shard.Name] = &shardCopy
+		return false
+	}
+	ch.shards[shard.Name] = &shardCopy
+	ch.place(shard.Name)
+	slices.Sort(ch.points)
+	return true
+}
+
+// place puts the virtual nodes of the shard on the ring. On a hash collision the shard with
+// the lower name keeps the point, so the ring depends on its members only, not on the order
+// they joined in.
+func (ch *ConsistentHash) place(name string) {
+	for i := 0; i < ch.virtualNodes; i++ {
+		point := hashKey(name + "#" + strconv.Itoa(i))
+		owner, taken := ch.owners[point]
+		if !taken {
+			ch.points = append(ch.points, point)
+		}
+		if !taken || name < owner {
+			ch.owners[point] = name
+		}
+	}
+}
+
+func (ch *ConsistentHash) Remove(name string) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.remove(name)
+}
+
+func (ch *ConsistentHash) remove(name string) {
+	if _, ok := ch.shards[name]; !ok {
+		return
+	}
+	delete(ch.shards, name)
+	// the points the shard won on a collision go back to the other shard, placing every shard
+	// again is simpler than tracking them and membership changes are rare
+	ch.points = ch.points[:0]
+	clear(ch.owners)
+	for other := range ch.shards {
+		ch.place(other)
+	}
+	slices.Sort(ch.points)
+}
+
+// Sync makes the ring membership equal to shards, shards missing from the list are
+// removed, new ones are added and known ones are updated in place
+func (ch *ConsistentHash) Sync(shards []*Shard) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	keep := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		keep[shard.Name] = true
+	}
+	for name := range ch.shards {
+		if !keep[name] {
+			ch.remove(name)
+		}
+	}
+	for _, shard := range shards {
+		ch.add(shard)
+	}
+}
+
+// Serving reports whether the shard accepts requests for the keys it owns
+func (s *Shard) Serving() bool {
+	return s.Status == ShardActive || s.Status == "" // shards persisted before statuses existed
+}
+
+// GetShard returns the shard owning the key. Walking clockwise from the key hash the
+// first active shard owns it, if no shard is active the first draining shard is used,
+// so a cluster being drained keeps serving. Dead shards are never returned, nil means
+// the ring is empty or every shard is dead.
+func (ch *ConsistentHash) GetShard(key string) *Shard {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	var draining *Shard
+	for _, shard := range ch.walk(key) {
+		if shard.Serving() {
+			shardCopy := *shard
+			return &shardCopy
+		}
+		if draining == nil && shard.Status == ShardDraining {
+			draining = shard
+		}
+	}
+	if draining == nil {
+		return nil
+	}
+	shardCopy := *draining
+	return &shardCopy
+}
+
+// GetShards returns up to n distinct active shards walking clockwise from the key hash,
+// the first one is the owner returned by GetShard and the rest are its replicas
+func (ch *ConsistentHash) GetShards(key string, n int) []*Shard {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	shards := make([]*Shard, 0, n)
+	for _, shard := range ch.walk(key) {
+		if len(shards) == n {
+			break
+		}
+		if shard.Serving() {
+			shardCopy := *shard
+			shards = append(shards, &shardCopy)
+		}
+	}
+	return shards
+}
+
+// walk returns every shard once in ring order starting at the key hash, the caller holds the lock
+func (ch *ConsistentHash) walk(key string) []*Shard {
+	if len(ch.points) == 0 {
+		return nil
+	}
+	hash := hashKey(GroupKey(key, ch.groupDelim))
+	start := sort.Search(len(ch.points), func(i int) bool { return ch.points[i] >= hash })
+	shards := make([]*Shard, 0, len(ch.shards))
+	seen := make(map[string]bool, len(ch.shards))
+	for i := 0; i < len(ch.points) && len(shards) < len(ch.shards); i++ {
+		name := ch.owners[ch.points[(start+i)%len(ch.points)]]
+		if !seen[name] {
+			seen[name] = true
+			shards = append(shards, ch.shards[name])
+		}
+	}
+	return shards
+}
+
+// Shards returns copies of all shards ordered by name
+func (ch *ConsistentHash) Shards() []*Shard {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	shards := make([]*Shard, 0, len(ch.shards))
+	for _, shard := range ch.shards {
+		shardCopy := *shard
+		shards = append(shards, &shardCopy)
+	}
+	slices.SortFunc(shards, func(a, b *Shard) int {
+		if a.Name < b.Name {
+			return -1
+		}
+		if a.Name > b.Name {
+			return 1
+		}
+		return 0
+	})
+	return shards
+}
+
+// Points returns the number of virtual nodes on the ring
+func (ch *ConsistentHash) Points() int {
+	ch.lock.RLock()
+	defer ch.lock.RUnlock()
+	return len(ch.points)
+}
@@ -0,0 +1,226 @@
+package sharding
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testShard(name string) *Shard {
+	return &Shard{Name: name, Host: "127.0.0.1", Port: 4321, Status: ShardActive}
+}
+
+func TestConsistentHashAddIsIdempotent(t *testing.T) {
+	ring := NewConsistentHash(16)
+	require.Nil(t, ring.GetShard("foo"))
+
+	require.True(t, ring.Add(testShard("a")))
+	require.True(t, ring.Add(testShard("b")))
+	points := ring.Points()
+
+	moved := testShard("a")
+	moved.Port = 5000
+	require.False(t, ring.Add(moved))
+	require.Equal(t, points, ring.Points())
+	require.Equal(t, 5000, ring.Shards()[0].Port)
+}
+
+func TestConsistentHashSync(t *testing.T) {
+	ring := NewConsistentHash(16)
+	ring.Sync([]*Shard{testShard("a"), testShard("b"), testShard("c")})
+	owners := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owners[key] = ring.GetShard(key).Name
+	}
+
+	// another ring built in a different order maps keys the same way
+	other := NewConsistentHash(16)
+	other.Add(testShard("c"))
+	other.Add(testShard("a"))
+	other.Add(testShard("b"))
+	for key, owner := range owners {
+		require.Equal(t, owner, other.GetShard(key).Name)
+	}
+
+	// dropping a shard only moves its own keys
+	ring.Sync([]*Shard{testShard("a"), testShard("c")})
+	require.Len(t, ring.Shards(), 2)
+	for key, owner := range owners {
+		if owner != "b" {
+			require.Equal(t, owner, ring.GetShard(key).Name)
+		}
+	}
+}
+
+func TestConsistentHashSkipsNonServingShards(t *testing.T) {
+	const key = "user:42"
+	// order is the clockwise shard order for the key on a healthy ring, test cases
+	// refer to shards by their position in it
+	healthy := NewConsistentHash(16)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		healthy.Add(testShard(name))
+	}
+	order := healthy.GetShards(key, 4)
+	require.Len(t, order, 4)
+
+	tests := []struct {
+		name     string
+		statuses []ShardStatus // by position in order
+		owner    int           // position of GetShard result, -1 for nil
+		replicas []int         // positions of GetShards(key, 3)
+	}{
+		{
+			name:     "all active",
+			statuses: []ShardStatus{ShardActive, ShardActive, ShardActive, ShardActive},
+			owner:    0,
+			replicas: []int{0, 1, 2},
+		},
+		{
+			name:     "owner dead",
+			statuses: []ShardStatus{ShardDead, ShardActive, ShardActive, ShardActive},
+			owner:    1,
+			replicas: []int{1, 2, 3},
+		},
+		{
+			name:     "owner draining",
+			statuses: []ShardStatus{ShardDraining, ShardActive, ShardActive, ShardActive},
+			owner:    1,
+			replicas: []int{1, 2, 3},
+		},
+		{
+			name:     "mixed",
+			statuses: []ShardStatus{ShardDraining, ShardDead, ShardActive, ShardDead},
+			owner:    2,
+			replicas: []int{2},
+		},
+		{
+			name:     "only draining left",
+			statuses: []ShardStatus{ShardDead, ShardDraining, ShardDead, ShardDraining},
+			owner:    1,
+			replicas: []int{},
+		},
+		{
+			name:     "all dead",
+			statuses: []ShardStatus{ShardDead, ShardDead, ShardDead, ShardDead},
+			owner:    -1,
+			replicas: []int{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewConsistentHash(16)
+			for idx, shard := range order {
+				shardCopy := *shard
+				shardCopy.Status = tt.statuses[idx]
+				ring.Add(&shardCopy)
+			}
+
+			owner := ring.GetShard(key)
+			if tt.owner < 0 {
+				require.Nil(t, owner)
+			} else {
+				require.Equal(t, order[tt.owner].Name, owner.Name)
+			}
+
+			names := make([]string, 0)
+			for _, shard := range ring.GetShards(key, 3) {
+				names = append(names, shard.Name)
+			}
+			expected := make([]string, 0)
+			for _, idx := range tt.replicas {
+				expected = append(expected, order[idx].Name)
+			}
+			require.Equal(t, expected, names)
+		})
+	}
+}
+
+func TestConsistentHashGetShards(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+		n      int
+		want   int
+	}{
+		{name: "empty ring", shards: 0, n: 3, want: 0},
+		{name: "fewer shards than replicas", shards: 2, n: 3, want: 2},
+		{name: "exact", shards: 3, n: 3, want: 3},
+		{name: "more shards than replicas", shards: 5, n: 3, want: 3},
+		{name: "zero", shards: 3, n: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := NewConsistentHash(8)
+			for i := 0; i < tt.shards; i++ {
+				ring.Add(testShard(fmt.Sprintf("shard-%d", i)))
+			}
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				shards := ring.GetShards(key, tt.n)
+				require.Len(t, shards, tt.want)
+				seen := make(map[string]bool)
+				for _, shard := range shards {
+					require.False(t, seen[shard.Name], "duplicate shard %s", shard.Name)
+					seen[shard.Name] = true
+				}
+				if tt.want > 0 {
+					require.Equal(t, ring.GetShard(key).Name, shards[0].Name)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupKey(t *testing.T) {
+	for _, tc := range []struct{ key, delimiter, group string }{
+		{"config:app/checksum", "/", "config:app"},
+		{"a/b/c", "/", "a"},
+		{"plain", "/", "plain"},
+		{"/leading", "/", "/leading"},
+		{"a/b", "", "a/b"},
+		{"tenant::key", "::", "tenant"},
+	} {
+		require.Equal(t, tc.group, GroupKey(tc.key, tc.delimiter), tc.key)
+	}
+}
+
+func TestConsistentHashGroups(t *testing.T) {
+	plain := NewConsistentHash(16)
+	ring := NewConsistentHash(16)
+	ring.SetGroupDelimiter("/")
+	shards := []*Shard{testShard("a"), testShard("b"), testShard("c"), testShard("d")}
+	plain.Sync(shards)
+	ring.Sync(shards)
+
+	// keys without the delimiter are placed as on a ring without groups
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		require.Equal(t, plain.GetShard(key).Name, ring.GetShard(key).Name)
+		require.Equal(t, plain.GetShards(key, 2), ring.GetShards(key, 2))
+	}
+
+	requireGrouped := func(ring *ConsistentHash) {
+		t.Helper()
+		for g := 0; g < 20; g++ {
+			group := fmt.Sprintf("group-%d", g)
+			owners := ring.GetShards(group+"/", 2)
+			require.Len(t, owners, 2)
+			for _, suffix := range []string{"config", "checksum", "version", "a/b"} {
+				require.Equal(t, owners, ring.GetShards(group+"/"+suffix, 2), group+"/"+suffix)
+			}
+		}
+	}
+	requireGrouped(ring)
+
+	// groups stay together while shards join, leave and drain
+	ring.Add(testShard("e"))
+	requireGrouped(ring)
+	ring.Remove("b")
+	requireGrouped(ring)
+	draining := testShard("c")
+	draining.Status = ShardDraining
+	ring.Sync([]*Shard{testShard("a"), draining, testShard("d"), testShard("e"), testShard("f")})
+	requireGrouped(ring)
+}
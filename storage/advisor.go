@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"time"
+)
+
+// defaults of the tiny transaction advisor, see Options.AdvisorEnabled
+const (
+	defaultTinyTxPages   = 4
+	defaultAdvisorRate   = 100 // tiny commits per second
+	defaultAdvisorWindow = 10 * time.Second
+	advisorWarnInterval  = 10 * time.Minute
+)
+
+// txAdvisor watches the rate of tiny commits, a loop calling Update once per key pays a
+// tx log write and fsyncs for every key. It only logs, commits are not changed.
+type txAdvisor struct {
+	rate         float64
+	window       time.Duration
+	warnInterval time.Duration
+	started      time.Time   // start of the current window
+	start        CommitStats // counters at the start of the window
+	warned       time.Time   // last warning, warnings are rate limited
+}
+
+func newTxAdvisor(db *DB, opts *Options) *txAdvisor {
+	return &txAdvisor{
+		rate:         opts.AdvisorRate,
+		window:       opts.AdvisorWindow,
+		warnInterval: advisorWarnInterval,
+		started:      time.Now(),
+		start:        db.CommitStats(),
+	}
+}
+
+// observe runs after every commit under the write lock, at the end of a window it warns
+// once if tiny commits came faster than the configured rate
+func (a *txAdvisor) observe(db *DB) {
+	now := time.Now()
+	elapsed := now.Sub(a.started)
+	if elapsed < a.window {
+		return
+	}
+	current := db.CommitStats()
+	delta := current.Sub(a.start)
+	a.started, a.start = now, current
+
+	tinyRate := float64(delta.TinyCommits) / elapsed.Seconds()
+	if tinyRate <= a.rate || delta.Commits == 0 || now.Sub(a.warned) < a.warnInterval {
+		return
+	}
+	a.warned = now
+	logger.Warn("many tiny write transactions, group writes into fewer Update calls",
+		"tiny_tx_per_sec", int(tinyRate),
+		"tiny_tx_pages", db.dal.opts.AdvisorTinyPages,
+		"avg_dirty_pages", float64(delta.DirtyPages)/float64(delta.Commits),
+		"fsyncs_per_sec", int(float64(delta.Fsyncs)/elapsed.Seconds()),
+		"fsyncs_per_tx", float64(delta.Fsyncs)/float64(delta.Commits),
+		"avg_commit_time", delta.CommitTime/time.Duration(delta.Commits),
+		"window", elapsed.Round(time.Millisecond))
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTinyCommitStats(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.Nil(t, db.advisor)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	}))
+
+	before := db.CommitStats()
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	stats := db.CommitStats().Sub(before)
+	require.Equal(t, uint64(1), stats.TinyCommits)
+	require.Positive(t, stats.DirtyPages)
+	require.Less(t, stats.DirtyPages, uint64(defaultTinyTxPages))
+
+	before = db.CommitStats()
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := range 2000 {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%05d", i)), bytes.Repeat([]byte("v"), 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	stats = db.CommitStats().Sub(before)
+	require.Zero(t, stats.TinyCommits)
+	require.GreaterOrEqual(t, stats.DirtyPages, uint64(defaultTinyTxPages))
+}
+
+func TestTxAdvisor(t *testing.T) {
+	var logs bytes.Buffer
+	prev := logger
+	SetLogger(slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn})))
+	t.Cleanup(func() { SetLogger(prev) })
+
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithAdvisor(true, 0, 10, 20*time.Millisecond)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	db := openTestDB(t, filename, opts)
+
+	// one Update per key, well above 10 tiny commits per second
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for i := 0; time.Now().Before(deadline); i++ {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(fmt.Sprintf("key_%05d", i)), []byte("value"))
+		}))
+	}
+	require.Equal(t, 1, strings.Count(logs.String(), "many tiny write transactions"), "the warning is rate limited")
+	for _, attr := range []string{"tiny_tx_per_sec=", "avg_dirty_pages=", "fsyncs_per_sec=", "avg_commit_time="} {
+		require.Contains(t, logs.String(), attr)
+	}
+
+	// a slow writer stays below the rate
+	logs.Reset()
+	db.advisor.warned = time.Time{}
+	db.advisor.started, db.advisor.start = time.Now(), db.CommitStats()
+	for i := 0; i < 2; i++ {
+		time.Sleep(150 * time.Millisecond)
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("slow"), []byte("value"))
+		}))
+	}
+	require.Empty(t, logs.String())
+
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithAdvisor(true, -1, 0, 0))
+	require.ErrorIs(t, err, ErrBadAdvisorOptions)
+}
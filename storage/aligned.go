@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// directIOAlignment is the buffer, offset and length alignment required by O_DIRECT,
+// 4096 covers the logical block size of common disks and filesystems
+const directIOAlignment = 4096
+
+// alignedBlock returns a zeroed slice of the given size starting at a directIOAlignment boundary
+func alignedBlock(size int) []byte {
+	block := make([]byte, size+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&block[0])) & (directIOAlignment - 1)); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return block[offset : offset+size : offset+size]
+}
+
+func isAligned(b []byte) bool {
+	return len(b) > 0 && uintptr(unsafe.Pointer(&b[0]))&(directIOAlignment-1) == 0
+}
+
+// pagePool recycles aligned page buffers. Only buffers that do not escape the dal,
+// like pages read to be deserialized, are returned to the pool.
+type pagePool struct {
+	pool sync.Pool
+}
+
+// get returns an aligned buffer of size bytes, a recycled buffer is not zeroed
+func (p *pagePool) get(size uint64) []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok && uint64(len(*buf)) == size {
+		return *buf
+	}
+	return alignedBlock(int(size))
+}
+
+func (p *pagePool) put(buf []byte) {
+	p.pool.Put(&buf)
+}
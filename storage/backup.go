@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"bufio"
+	"io"
+)
+
+// WriteTo writes a copy of the database file as of the transaction to w, page by page. Commits
+// wait until the copy is written, the transaction holds the lock. The copy opens as a cleanly
+// closed database with Open or OpenReader, there is no tx log to replay. A database keeping
+// blobs in a blob file returns ErrBlobFileNotCopied, the copy would miss them.
+func (tx *Tx) WriteTo(w io.Writer) (int64, error) {
+	if err := tx.enter(); err != nil {
+		return 0, err
+	}
+	defer tx.leave()
+	dal := tx.db.dal
+	if dal.meta.flags&metaFlagBlobFile != 0 {
+		return 0, ErrBlobFileNotCopied
+	}
+	buffered := bufio.NewWriterSize(w, 64*int(dal.meta.pageSize))
+	var written int64
+	for pageNum := uint64(0); pageNum < dal.maxPages.Load(); pageNum++ {
+		page, err := dal.readPage(pageNum)
+		if err != nil {
+			return written, err
+		}
+		if pageNum == metaPageNumber {
+			page.Data[metaFlagsOffset] &^= metaFlagOpen
+		}
+		n, err := buffered.Write(page.Data)
+		dal.releasePage(page)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return written - int64(buffered.Buffered()), err
+	}
+	return written, nil
+}
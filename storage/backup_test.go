@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTxWriteTo(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%04d", i))); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("blob"), bytes.Repeat([]byte("b"), 3*BTreePageSize))
+	}))
+
+	var image bytes.Buffer
+	require.NoError(t, db.View(func(tx *Tx) error {
+		n, err := tx.WriteTo(&image)
+		require.NoError(t, err)
+		require.EqualValues(t, image.Len(), n)
+		return nil
+	}))
+	require.NoError(t, putKey(db, "after"))
+
+	backup, err := OpenReader(bytes.NewReader(image.Bytes()), int64(image.Len()), nil)
+	require.NoError(t, err)
+	require.True(t, backup.DurabilityInfo().CleanShutdown, "the copy is not marked open")
+	require.NoError(t, backup.Check())
+	require.NoError(t, backup.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		value, found := bucket.Get([]byte("key_0500"))
+		require.True(t, found)
+		require.Equal(t, []byte("value_0500"), value)
+		value, found = bucket.Get([]byte("blob"))
+		require.True(t, found)
+		require.Len(t, value, 3*BTreePageSize)
+		_, found = bucket.Get([]byte("after"))
+		require.False(t, found, "later commits are not in the copy")
+		return nil
+	}))
+	require.NoError(t, backup.Close())
+
+	// the copy opens as a database file too
+	filename := filepath.Join(t.TempDir(), "restored.db")
+	require.NoError(t, os.WriteFile(filename, image.Bytes(), 0o600))
+	restored := openTestDB(t, filename, DefaultOptions())
+	require.True(t, restored.DurabilityInfo().CleanShutdown)
+	require.NoError(t, putKey(restored, "restored"))
+	closeTestDB(t, restored)
+}
+
+func TestTxWriteToBlobFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "hot.db")
+	db := openTestDB(t, filename, DefaultOptions())
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketWithOptions([]byte("cold"), BucketOptions{File: "blobs.db"})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob"), bytes.Repeat([]byte("c"), 2*BTreePageSize))
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		_, err := tx.WriteTo(&bytes.Buffer{})
+		require.ErrorIs(t, err, ErrBlobFileNotCopied)
+		return nil
+	}))
+	closeTestDB(t, db)
+}
@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
 )
 
 // Blob - first page
@@ -45,6 +48,7 @@ type Blob struct {
 	pageCount    int
 	size         int
 	data         []byte
+	inBlobFile   bool // Save writes the chain to the blob file
 }
 
 func NewBlob(data []byte) (*Blob, error) {
@@ -62,10 +66,22 @@ func GetBlob(tx *Tx, startPageNum uint64) (*Blob, error) {
 	}
 
 	if startPage.Data[blobExtraPageTypeOffset] != BlobPage {
-		logger.Warn("page type is not a blob page", "type", startPage.Data[blobExtraPageTypeOffset])
+		return nil, fmt.Errorf("%w: page %d is not a blob page", ErrCorrupted, startPageNum)
 	}
 	pageCount := int(binary.LittleEndian.Uint32(startPage.Data[blobFirstPageTotalPagesOffset:]))
 	dataLen := int(binary.LittleEndian.Uint32(startPage.Data[blobFirstPageDataSizeOffset:]))
+	// the size allocates the value, it must fit the chain it claims, the chain must fit the file
+	capacity := len(startPage.Data) - firstPageHeaderSize + (pageCount-1)*(len(startPage.Data)-pageHeaderSize)
+	filePages := tx.db.dal.maxPages.Load()
+	if blobs := tx.db.dal.blobs; blobs != nil && isBlobFilePage(startPageNum) {
+		filePages = blobs.maxPages.Load()
+	}
+	if pageCount == 0 || uint64(pageCount) > filePages || dataLen > capacity || dataLen > maxBlobSize {
+		return nil, fmt.Errorf("%w: blob at page %d has %d bytes in %d pages", ErrCorrupted, startPageNum, dataLen, pageCount)
+	}
+	// a chain linking back to one of its pages is corrupted, Brent's cycle detection keeps a
+	// single page number to compare the next ones with
+	loopCheck, loopPower, loopSteps := startPageNum, 1, 0
 
 	blob := Blob{
 		startPageNum: startPageNum,
@@ -80,18 +96,25 @@ func GetBlob(tx *Tx, startPageNum uint64) (*Blob, error) {
 	dataOffset := 0
 	bytesRemaining := dataLen
 
-	for pageIdx := 0; pageIdx < pageCount; pageIdx++ {
+	// a chain longer than its data is not followed past the data, it may loop
+	for pageIdx := 0; pageIdx < pageCount && (pageIdx == 0 || bytesRemaining > 0); pageIdx++ {
 		var page *Page
 		if pageIdx == 0 {
 			page = startPage
 		} else {
+			if nextPageNum == loopCheck {
+				return nil, fmt.Errorf("%w: blob at page %d links back to page %d", ErrCorrupted, startPageNum, nextPageNum)
+			}
+			if loopSteps++; loopSteps == loopPower {
+				loopCheck, loopPower, loopSteps = nextPageNum, 2*loopPower, 0
+			}
 			page, err = tx.getPage(nextPageNum)
 			if err != nil {
 				return nil, err
 			}
 			pos = 0
 			if page.Data[pos] != BlobPage {
-				logger.Warn("page type is not a blob page", "type", page.Data[pos])
+				return nil, fmt.Errorf("%w: page %d of blob at page %d is not a blob page", ErrCorrupted, page.PageNumber, startPageNum)
 			}
 			pos++
 			nextPageNum = binary.LittleEndian.Uint64(page.Data[pos:])
@@ -110,13 +133,37 @@ func GetBlob(tx *Tx, startPageNum uint64) (*Blob, error) {
 	return &blob, nil
 }
 
+// getBlobPageCount reads the length of the blob page chain from its first page.
+func getBlobPageCount(tx *Tx, startPageNum uint64) (int, error) {
+	startPage, err := tx.getPage(startPageNum)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.LittleEndian.Uint32(startPage.Data[blobFirstPageTotalPagesOffset:])), nil
+}
+
+// getBlobSize reads the data size of the blob from its first page.
+func getBlobSize(tx *Tx, startPageNum uint64) (int, error) {
+	startPage, err := tx.getPage(startPageNum)
+	if err != nil {
+		return 0, err
+	}
+	if startPage.Data[blobFirstPageTypeOffset] != BlobPage {
+		return 0, fmt.Errorf("%w: page %d is not a blob page", ErrCorrupted, startPageNum)
+	}
+	return int(binary.LittleEndian.Uint32(startPage.Data[blobFirstPageDataSizeOffset:])), nil
+}
+
 func DeleteBlob(tx *Tx, startPageNum uint64) (int, error) {
 	page, err := tx.getPage(startPageNum)
 	if err != nil {
 		return 0, err
 	}
-	pageCount := binary.LittleEndian.Uint32(page.Data[1:])
-	dataLen := int(binary.LittleEndian.Uint32(page.Data[blobDataSizeBytes:]))
+	if page.Data[blobExtraPageTypeOffset] != BlobPage {
+		return 0, fmt.Errorf("%w: page %d is not a blob page", ErrCorrupted, startPageNum)
+	}
+	pageCount := binary.LittleEndian.Uint32(page.Data[blobFirstPageTotalPagesOffset:])
+	dataLen := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageDataSizeOffset:]))
 	pages := make([]uint64, pageCount)
 	for pageIndex := 0; pageIndex < int(pageCount); pageIndex++ {
 		var nextPageNum uint64
@@ -140,30 +187,68 @@ func DeleteBlob(tx *Tx, startPageNum uint64) (int, error) {
 }
 
 func (blob *Blob) Save(tx *Tx) (uint64, error) {
-	dataLen := len(blob.data)
+	return saveBlobStream(tx, bytes.NewReader(blob.data), len(blob.data), blob.inBlobFile)
+}
 
-	pages := make([]*Page, blob.pageCount)
-	for pageIndex := 0; pageIndex < blob.pageCount; pageIndex++ {
-		page, err := tx.db.dal.AllocatePage()
-		if err != nil {
-			return 0, err
+// allocateBlobPages allocates the pages of a new blob chain. Chains in the blob file are
+// always adjacent pages, in the database file only with contiguous. The chain is allocated
+// as a whole or not at all, its pages are released if the transaction rolls back.
+func allocateBlobPages(tx *Tx, n int, inBlobFile, contiguous bool) ([]*Page, error) {
+	var pages []*Page
+	var err error
+	switch {
+	case inBlobFile:
+		pages, err = tx.db.dal.allocateBlobFilePages(n)
+	case contiguous:
+		pages, err = tx.db.dal.AllocateContiguousPages(n)
+	default:
+		mark := len(tx.allocatedPageNums)
+		pages = make([]*Page, n)
+		for i := range pages {
+			if pages[i], err = tx.allocatePage(); err != nil {
+				tx.releaseAllocated(mark)
+				return nil, err
+			}
 		}
-		pages[pageIndex] = page
+		return pages, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		tx.allocatedPageNums = append(tx.allocatedPageNums, page.PageNumber)
+	}
+	return pages, nil
+}
+
+// saveBlobStream writes dataLen bytes from the reader into a new blob page chain,
+// the data is copied page by page without buffering the whole value
+func saveBlobStream(tx *Tx, r io.Reader, dataLen int, inBlobFile bool) (uint64, error) {
+	if dataLen > maxBlobSize {
+		return 0, ErrBlobTooLarge
+	}
+	if err := tx.db.dal.failpoint(FailpointBlobSave); err != nil {
+		return 0, err
+	}
+	pageCount := calcPageCount(dataLen)
+
+	pages, err := allocateBlobPages(tx, pageCount, inBlobFile, false)
+	if err != nil {
+		return 0, err
 	}
 
-	dataOffset := 0
 	bytesRemaining := dataLen
 
 	for pageIndex, page := range pages {
 		var nextPageNum uint64
-		if pageIndex < blob.pageCount-1 {
+		if pageIndex < pageCount-1 {
 			nextPageNum = pages[pageIndex+1].PageNumber
 		}
 		page.Data[blobExtraPageTypeOffset] = BlobPage
 
 		pos := blobExtraPageNextPageOffset
 		if pageIndex == 0 {
-			binary.LittleEndian.PutUint32(page.Data[blobFirstPageTotalPagesOffset:], uint32(blob.pageCount))
+			binary.LittleEndian.PutUint32(page.Data[blobFirstPageTotalPagesOffset:], uint32(pageCount))
 			binary.LittleEndian.PutUint32(page.Data[blobFirstPageDataSizeOffset:], uint32(dataLen))
 			pos = blobFirstPageNextPageOffset
 		}
@@ -174,9 +259,10 @@ func (blob *Blob) Save(tx *Tx) (uint64, error) {
 		capacity := len(page.Data[pos:])
 		toCopy := min(bytesRemaining, capacity)
 
-		copy(page.Data[pos:], blob.data[dataOffset:dataOffset+toCopy])
+		if _, err := io.ReadFull(r, page.Data[pos:pos+toCopy]); err != nil {
+			return 0, err
+		}
 
-		dataOffset += toCopy
 		bytesRemaining -= toCopy
 
 		tx.setPage(page)
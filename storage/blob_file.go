@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/gofrs/flock"
+)
+
+// A database may keep the blob chains of some buckets in one secondary file, the blob file,
+// for example to put cold values on another device. Buckets choose it with BucketOptions.File.
+// Pages of the blob file are addressed with blobFileBit set in the page number everywhere a
+// page is referenced: item values, blob chain links, the tx log and the freelist of the
+// transaction. Page 0 of the blob file is a header, its freelist lives in the main file and
+// is found with Meta.blobFreelistPage, so one commit and one tx log record cover both files.
+
+// blobFileBit marks the page numbers of the blob file
+const blobFileBit = uint64(1) << 63
+
+// maxBlobFileName is the longest blob file name stored in the meta page
+const maxBlobFileName = 255
+
+func isBlobFilePage(pageNum uint64) bool {
+	return pageNum&blobFileBit != 0
+}
+
+// localPageNum returns the page number within its file
+func localPageNum(pageNum uint64) uint64 {
+	return pageNum &^ blobFileBit
+}
+
+// blobFile is the open blob file of the dal
+type blobFile struct {
+	name     string // as given in BucketOptions.File and stored in the meta
+	path     string
+	file     dataFile
+	fileLock *flock.Flock
+	size     uint64
+	maxPages atomic.Uint64 // grows under Dal.allocLock, page reads check it without
+	freelist *Freelist     // local page numbers
+}
+
+// blobFilePath resolves a blob file name, relative names are next to the main file
+func blobFilePath(dbPath, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(dbPath), name)
+}
+
+// lockBlobFile opens the blob file at path and takes its file lock, create refuses an
+// existing file with content: its pages would be handed out again
+func lockBlobFile(path string, opts *Options, create bool) (*os.File, *flock.Flock, error) {
+	info, statErr := os.Stat(path)
+	switch {
+	case create && statErr == nil && info.Size() > 0:
+		return nil, nil, fmt.Errorf("%w: blob file %s already exists, remove it or choose another name", ErrBadBucketOptions, path)
+	case !create && os.IsNotExist(statErr):
+		return nil, nil, fmt.Errorf("%w: %s", ErrBlobFileMissing, path)
+	}
+	fileLock := flock.New(path)
+	locked, err := fileLock.TryLock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not lock blob file %s: %w", path, err)
+	}
+	if !locked {
+		return nil, nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, path)
+	}
+	if !create {
+		if _, err = checkDatabaseFile(path); err != nil {
+			_ = fileLock.Unlock()
+			return nil, nil, err
+		}
+	}
+	file, _, err := openDataFile(path, opts)
+	if err != nil {
+		_ = fileLock.Unlock()
+		return nil, nil, fmt.Errorf("could not open blob file: %w", err)
+	}
+	return file, fileLock, nil
+}
+
+// attachBlobFile creates the blob file name for the buckets placed in it. Its header is
+// written right away, the meta and its empty freelist are persisted with the next commit.
+func (dal *Dal) attachBlobFile(name string) error {
+	path := blobFilePath(dal.path, name)
+	file, fileLock, err := lockBlobFile(path, dal.opts, true)
+	if err != nil {
+		return err
+	}
+	blobs := &blobFile{
+		name:     name,
+		path:     path,
+		file:     osDataFile{file},
+		fileLock: fileLock,
+		freelist: NewFreelist(dal.meta.pageSize, 0),
+	}
+	blobs.freelist.currentPage = 0 // page 0 is the header
+	blobs.freelist.dirty = true
+	if err = dal.writeBlobFileHeader(blobs); err != nil {
+		blobs.close()
+		return err
+	}
+	if err = blobs.allocate(minFileSize, dal.meta.pageSize); err != nil {
+		blobs.close()
+		return err
+	}
+	// the first freelist page stays allocated even if the transaction rolls back, the
+	// blob file stays attached in memory and the next commit persists both
+	page, err := dal.AllocatePage()
+	if err != nil {
+		blobs.close()
+		return err
+	}
+	blobs.freelist.freelistPages = []uint64{page.PageNumber}
+	dal.blobs = blobs
+	dal.meta.blobFile = name
+	dal.meta.blobFreelistPage = page.PageNumber
+	dal.meta.flags |= metaFlagBlobFile
+	logger.Info("attached blob file", "path", path)
+	return nil
+}
+
+// writeBlobFileHeader writes a meta page naming the database and its format, so the file
+// is recognized and refused by Open as a main file of its own
+func (dal *Dal) writeBlobFileHeader(blobs *blobFile) error {
+	header := &Meta{
+		dbName:    dbName,
+		dbVersion: currentFormatVersion,
+		pageSize:  dal.meta.pageSize,
+	}
+	data := alignedBlock(int(dal.meta.pageSize))
+	header.Serialize(data)
+	if _, err := blobs.file.WriteAt(data, 0); err != nil {
+		return fmt.Errorf("could not write blob file header: %w", err)
+	}
+	return nil
+}
+
+// openBlobFile opens the blob file named in the meta and reads its freelist
+func (dal *Dal) openBlobFile(meta *Meta) error {
+	path := blobFilePath(dal.path, meta.blobFile)
+	file, fileLock, err := lockBlobFile(path, dal.opts, false)
+	if err != nil {
+		return err
+	}
+	blobs := &blobFile{name: meta.blobFile, path: path, file: osDataFile{file}, fileLock: fileLock}
+	size, err := blobs.file.Size()
+	if err != nil {
+		blobs.close()
+		return fmt.Errorf("could not stat blob file: %w", err)
+	}
+	blobs.size = uint64(size)
+	blobs.maxPages.Store(blobs.size / meta.pageSize)
+	dal.blobs = blobs
+	logger.Info("open blob file", "path", path, "size", size)
+	return nil
+}
+
+// readBlobFreelist reads the freelist of the blob file once the meta of the main file is read
+func (dal *Dal) readBlobFreelist() error {
+	freelist, err := readFreelistAt(dal, dal.meta.blobFreelistPage)
+	if err != nil && dal.canRebuildFreelist(err) {
+		freelist, err = dal.damagedFreelist(dal.meta.blobFreelistPage, dal.blobs.maxPages.Load()), nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read blob file freelist: %w", err)
+	}
+	dal.blobs.freelist = freelist
+	declared := freelist.maxPages * dal.meta.pageSize
+	if dal.blobs.size >= declared {
+		freelist.maxPages = dal.blobs.maxPages.Load()
+		return nil
+	}
+	if dal.recovery.Pages == 0 {
+		return fmt.Errorf("%w: %s has %d bytes, its freelist declares %d", ErrTruncatedDatabase,
+			dal.blobs.path, dal.blobs.size, declared)
+	}
+	return dal.blobs.allocate(declared, dal.meta.pageSize)
+}
+
+func (blobs *blobFile) allocate(size uint64, pageSize uint64) error {
+	if err := blobs.file.Truncate(int64(size)); err != nil {
+		return fmt.Errorf("could not grow blob file to %d bytes: %w", size, err)
+	}
+	blobs.size = size
+	blobs.maxPages.Store(size / pageSize)
+	if blobs.freelist != nil {
+		blobs.freelist.maxPages = blobs.maxPages.Load()
+	}
+	logger.Info("allocate blob file", "size", size, "max_pages", blobs.maxPages.Load())
+	return nil
+}
+
+// expand grows the blob file like the main file, Options.MaxSize does not apply to it
+func (blobs *blobFile) expand(pageSize uint64) error {
+	if blobs.size < OneGigabyte {
+		return blobs.allocate(blobs.size*2, pageSize)
+	}
+	return blobs.allocate(blobs.size+OneGigabyte, pageSize)
+}
+
+func (blobs *blobFile) close() {
+	_ = blobs.file.Close()
+	_ = blobs.fileLock.Unlock()
+}
+
+// allocateBlobFilePages allocates n adjacent pages in the blob file, a chain there is always
+// written as one run
+func (dal *Dal) allocateBlobFilePages(n int) ([]*Page, error) {
+	if err := dal.failpoint(FailpointAllocatePage); err != nil {
+		return nil, err
+	}
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
+	start, err := dal.blobs.freelist.GetContiguousPages(uint64(n))
+	for errors.Is(err, ErrNoPagesLeft) {
+		if err = dal.blobs.expand(dal.meta.pageSize); err != nil {
+			return nil, err
+		}
+		start, err = dal.blobs.freelist.GetContiguousPages(uint64(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]*Page, n)
+	for i := range pages {
+		page, err := dal.GetPage(blobFileBit | (start + uint64(i)))
+		if err != nil {
+			// the run is allocated as a whole or not at all
+			dal.blobs.freelist.ReleasePages(pageRun(start, n))
+			return nil, err
+		}
+		page.Clear()
+		pages[i] = page
+	}
+	return pages, nil
+}
+
+// releasePages returns pages of either file to their freelist
+func (dal *Dal) releasePages(pageNums []uint64) {
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
+	main, blobs := splitBlobFilePages(pageNums)
+	dal.freelist.ReleasePages(main)
+	if len(blobs) > 0 {
+		dal.blobs.freelist.ReleasePages(blobs)
+	}
+}
+
+// holdPages keeps pages of either file from reuse while snapshots are open
+func (dal *Dal) holdPages(pageNums []uint64) {
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
+	main, blobs := splitBlobFilePages(pageNums)
+	dal.freelist.hold(main)
+	if len(blobs) > 0 {
+		dal.blobs.freelist.hold(blobs)
+	}
+}
+
+// splitBlobFilePages separates page numbers of the main file from local page numbers of
+// the blob file
+func splitBlobFilePages(pageNums []uint64) ([]uint64, []uint64) {
+	var main, blobs []uint64
+	for _, pageNum := range pageNums {
+		if isBlobFilePage(pageNum) {
+			blobs = append(blobs, localPageNum(pageNum))
+		} else {
+			main = append(main, pageNum)
+		}
+	}
+	return main, blobs
+}
+
+// recoverPage writes a page replayed from the tx log. The blob file is opened on its first
+// page: the meta naming it precedes it in the record and was just written back.
+func (dal *Dal) recoverPage(page *Page) error {
+	if isBlobFilePage(page.PageNumber) && dal.blobs == nil {
+		meta := NewMeta(dal.meta.pageSize)
+		data, err := dal.GetPage(metaPageNumber)
+		if err != nil {
+			return err
+		}
+		err = meta.Deserialize(data.Data)
+		dal.releasePage(data)
+		if err != nil {
+			return err
+		}
+		if meta.flags&metaFlagBlobFile == 0 {
+			return fmt.Errorf("%w: page %d of a blob file, the meta names none", ErrTxLogCorrupted, localPageNum(page.PageNumber))
+		}
+		if err = dal.openBlobFile(meta); err != nil {
+			return err
+		}
+	}
+	return dal.SetPage(page)
+}
+
+// BlobFileInfo describes the blob file of the database
+type BlobFileInfo struct {
+	Path     string
+	Size     uint64       // bytes allocated for the file
+	Freelist FreelistInfo // pages of the blob file
+}
+
+// BlobFileInfo returns the blob file state as seen by a read transaction, false if no
+// bucket keeps its blobs in a blob file
+func (db *DB) BlobFileInfo() (BlobFileInfo, bool, error) {
+	var info BlobFileInfo
+	var found bool
+	err := db.View(func(tx *Tx) error {
+		blobs := tx.db.dal.blobs
+		if blobs == nil {
+			return nil
+		}
+		found = true
+		tx.db.dal.allocLock.Lock()
+		defer tx.db.dal.allocLock.Unlock()
+		info = BlobFileInfo{Path: blobs.path, Size: blobs.size, Freelist: blobs.freelist.info()}
+		return nil
+	})
+	return info, found, err
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blobRef returns the start page of the blob chain of the key
+func blobRef(t *testing.T, bucket *Bucket, key string) uint64 {
+	t.Helper()
+	item, err := bucket.findItem([]byte(key))
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	payload, err := item.payload()
+	require.NoError(t, err)
+	return binary.LittleEndian.Uint64(payload)
+}
+
+func TestBlobFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "hot.db")
+	opts := DefaultOptions()
+	db := openTestDB(t, filename, opts)
+	cold := bytes.Repeat([]byte("c"), 5*BTreePageSize)
+	hot := bytes.Repeat([]byte("h"), 2*BTreePageSize)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketWithOptions([]byte("cold"), BucketOptions{File: "blobs.db"})
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 3; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("blob-%d", i)), cold); err != nil {
+				return err
+			}
+		}
+		if err = bucket.Put([]byte("inline"), []byte("value")); err != nil {
+			return err
+		}
+		bucket, err = tx.CreateBucket([]byte("hot"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob"), hot)
+	}))
+	mainPages := db.dal.freelist.currentPage
+
+	// a second blob file is refused, more buckets may share the first one
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("other"), BucketOptions{File: "other.db"})
+		return err
+	})
+	require.ErrorIs(t, err, ErrBadBucketOptions)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketWithOptions([]byte("archive"), BucketOptions{File: "blobs.db"})
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob"), cold)
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("cold"))
+		require.NoError(t, err)
+		require.True(t, isBlobFilePage(blobRef(t, bucket, "blob-0")))
+		pages := blobPages(t, tx, bucket, "blob-1")
+		require.Len(t, pages, calcPageCount(len(cold)))
+		require.False(t, chainFragmented(pages), "blob file chains are written as one run")
+		bucket, err = tx.GetBucket([]byte("hot"))
+		require.NoError(t, err)
+		require.False(t, isBlobFilePage(blobRef(t, bucket, "blob")))
+		return nil
+	}))
+	// the cold blobs did not grow the database file
+	require.Less(t, db.dal.freelist.currentPage, mainPages+uint64(calcPageCount(len(cold))))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("cold"))
+		if err != nil {
+			return err
+		}
+		return bucket.Remove([]byte("blob-2"))
+	}))
+	info, found, err := db.BlobFileInfo()
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, filepath.Join(dir, "blobs.db"), info.Path)
+	require.EqualValues(t, calcPageCount(len(cold)), info.Freelist.FreePages)
+	require.NoError(t, db.Check())
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, opts)
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("cold"))
+		require.NoError(t, err)
+		require.Equal(t, BucketOptions{File: "blobs.db"}, bucket.Options())
+		for _, key := range []string{"blob-0", "blob-1"} {
+			value, found, err := bucket.Lookup([]byte(key))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, cold, value)
+		}
+		_, found, err := bucket.Lookup([]byte("blob-2"))
+		require.NoError(t, err)
+		require.False(t, found)
+		value, _ := bucket.Get([]byte("inline"))
+		require.Equal(t, []byte("value"), value)
+		bucket, err = tx.GetBucket([]byte("hot"))
+		require.NoError(t, err)
+		value, _ = bucket.Get([]byte("blob"))
+		require.Equal(t, hot, value)
+		return nil
+	}))
+	// freed blob file pages are reused
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("cold"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob-3"), cold)
+	}))
+	info, _, err = db.BlobFileInfo()
+	require.NoError(t, err)
+	require.Zero(t, info.Freelist.FreePages)
+	require.NoError(t, db.Check())
+	closeTestDB(t, db)
+
+	// the database does not open without its blob file
+	require.NoError(t, os.Rename(filepath.Join(dir, "blobs.db"), filepath.Join(dir, "moved.db")))
+	_, err = Open(filename, opts)
+	require.ErrorIs(t, err, ErrBlobFileMissing)
+}
+
+func TestBlobFileRollback(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, filepath.Join(dir, "hot.db"), DefaultOptions())
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("cold"), BucketOptions{File: "blobs.db"})
+		return err
+	}))
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("cold"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("blob"), bytes.Repeat([]byte("c"), 3*BTreePageSize)); err != nil {
+			return err
+		}
+		return errInjected
+	})
+	require.ErrorIs(t, err, errInjected)
+	info, _, err := db.BlobFileInfo()
+	require.NoError(t, err)
+	require.EqualValues(t, info.Freelist.HighWaterMark, info.Freelist.FreePages, "the pages of the rolled back blob are free")
+	require.NoError(t, db.Check())
+}
+
+// TestBlobFileRecovery fails writes to the files after the tx log is written, recovery
+// replays the pages of both files
+func TestBlobFileRecovery(t *testing.T) {
+	cold := bytes.Repeat([]byte("c"), 3*BTreePageSize)
+	for n := 1; ; n++ {
+		dir := t.TempDir()
+		filename := filepath.Join(dir, "hot.db")
+		failpoints := NewFailpoints()
+		opts := DefaultOptions().WithFailpoints(failpoints)
+		db := openTestDB(t, filename, opts)
+		require.NoError(t, db.Update(crashBaseline))
+
+		failpoints.Enable(FailpointPageWrite, FailNth(n, errInjected))
+		err := db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketWithOptions([]byte("cold"), BucketOptions{File: "blobs.db"})
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("blob"), cold)
+		})
+		reached := failpoints.Hits(FailpointPageWrite) >= n
+		closeTestDB(t, db)
+		if !reached {
+			require.NoError(t, err)
+			require.Greater(t, n, 1)
+			return
+		}
+		require.ErrorIs(t, err, errInjected)
+
+		db = openTestDB(t, filename, DefaultOptions())
+		require.NoError(t, db.Check(), "failed write %d", n)
+		require.NoError(t, db.View(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("cold"))
+			require.NoError(t, err)
+			value, found, err := bucket.Lookup([]byte("blob"))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, cold, value)
+			return nil
+		}))
+		closeTestDB(t, db)
+	}
+}
+
+func TestBucketOptionsFileRoundTrip(t *testing.T) {
+	bucket := newBucket([]byte("cold"))
+	bucket.options = BucketOptions{ForceBlobsAbove: 64, File: "/mnt/cold/blobs.db"}
+	bucket.quota = BucketQuota{MaxKeys: 10}
+	decoded := newBucket([]byte("cold"))
+	require.NoError(t, decoded.deserialize(bucket.serialize().Value))
+	require.Equal(t, bucket.options, decoded.options)
+	require.Equal(t, bucket.quota, decoded.quota)
+
+	err := BucketOptions{File: string(bytes.Repeat([]byte("f"), maxBlobFileName+1))}.validate()
+	require.ErrorIs(t, err, ErrBadBucketOptions)
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/require"
 	"reflect"
 	"testing"
@@ -14,7 +15,8 @@ func TestNewBlob(t *testing.T) {
 		data[idx] = byte(idx % 256)
 	}
 
-	tx := db.Begin(true)
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
 	blob, err := NewBlob(data)
 	require.NoError(t, err)
 
@@ -28,7 +30,8 @@ func TestNewBlob(t *testing.T) {
 
 	// Now open created database
 	db = openTestDB(t, filename, nil)
-	tx = db.Begin(true)
+	tx, err = db.Begin(true)
+	require.NoError(t, err)
 
 	existingBlob, errRead := GetBlob(tx, pageNum)
 	require.NoError(t, errRead)
@@ -42,5 +45,119 @@ func TestNewBlob(t *testing.T) {
 	err = tx.Commit()
 	require.NoError(t, err)
 
-	require.Equal(t, len(db.dal.freelist.releasedPages), existingBlob.pageCount)
+	require.EqualValues(t, existingBlob.pageCount, db.dal.freelist.releasedN)
+}
+
+func TestOverwriteBlobReleasesPages(t *testing.T) {
+	db, _ := createTestDB(t)
+	const size = 20 * 1024
+	put := func(value []byte) {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("blobs"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("key"), value)
+		}))
+	}
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("blobs"))
+		return err
+	}))
+	put(bytes.Repeat([]byte{1}, size))
+	before := db.Stat()
+
+	const overwrites = 100
+	for i := range overwrites {
+		put(bytes.Repeat([]byte{byte(i)}, size))
+	}
+	after := db.Stat()
+	// every overwrite frees the chain it replaces, the next one reuses those pages instead of
+	// growing the file
+	require.GreaterOrEqual(t, after.ReleasedPageN-before.ReleasedPageN, calcPageCount(size))
+	require.Less(t, after.TotalPageNum-before.TotalPageNum, 4*calcPageCount(size))
+	stat := after.Buckets["blobs"]
+	require.EqualValues(t, 1, stat.ItemsN)
+	require.EqualValues(t, 1, stat.BlobsN)
+	require.EqualValues(t, len("key")+size, stat.BytesInUse)
+
+	// a blob replaced by an inline value and back keeps the stats right
+	put([]byte("small"))
+	stat = db.Stat().Buckets["blobs"]
+	require.EqualValues(t, 0, stat.BlobsN)
+	require.EqualValues(t, len("key")+len("small"), stat.BytesInUse)
+	put(make([]byte, size))
+	stat = db.Stat().Buckets["blobs"]
+	require.EqualValues(t, 1, stat.BlobsN)
+	require.EqualValues(t, len("key")+size, stat.BytesInUse)
+	require.NoError(t, db.Check())
+}
+
+// TestBlobAllocationFailureReleasesPages fails the allocation of a page in the middle of a
+// blob chain, the pages taken before it are free again after the rollback
+func TestBlobAllocationFailureReleasesPages(t *testing.T) {
+	failpoints := NewFailpoints()
+	db := openTestDB(t, TempFileName(".db"), DefaultOptions().WithFailpoints(failpoints))
+	require.NoError(t, db.Put([]byte("foo"), []byte("small"), []byte("v")))
+	usedPages := func() uint64 {
+		info, err := db.FreelistInfo()
+		require.NoError(t, err)
+		return info.HighWaterMark - info.FreePages
+	}
+	used := usedPages()
+
+	size := BTreePageSize - firstPageHeaderSize + 99*(BTreePageSize-pageHeaderSize)
+	require.Equal(t, 100, calcPageCount(size))
+	value := bytes.Repeat([]byte("b"), size)
+	failpoints.Enable(FailpointAllocatePage, FailNth(50, errInjected))
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob"), value)
+	})
+	require.ErrorIs(t, err, errInjected)
+	require.Equal(t, 50, failpoints.Hits(FailpointAllocatePage))
+	require.Equal(t, used, usedPages(), "no page of the partial chain leaked")
+
+	// the root page of a bucket created by a rolled back transaction is released too
+	failpoints.Disable(FailpointAllocatePage)
+	require.ErrorIs(t, db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("bar")); err != nil {
+			return err
+		}
+		return errInjected
+	}), errInjected)
+	require.Equal(t, used, usedPages())
+
+	require.NoError(t, db.Put([]byte("foo"), []byte("blob"), value))
+	got, err := db.Get([]byte("foo"), []byte("blob"))
+	require.NoError(t, err)
+	require.Equal(t, value, got)
+	require.NoError(t, db.Check())
+}
+
+// TestAllocatePageReadFailureReleasesPage fails reading a page just taken from the freelist,
+// the page goes back to it
+func TestAllocatePageReadFailureReleasesPage(t *testing.T) {
+	failpoints := NewFailpoints()
+	db := openTestDB(t, TempFileName(".db"), DefaultOptions().WithFailpoints(failpoints))
+	require.NoError(t, db.Put([]byte("foo"), []byte("small"), []byte("v")))
+	info, err := db.FreelistInfo()
+	require.NoError(t, err)
+	used := info.HighWaterMark - info.FreePages
+
+	err = db.Update(func(tx *Tx) error {
+		failpoints.Enable(FailpointPageRead, FailNth(1, errInjected))
+		_, err := tx.allocatePage()
+		failpoints.Disable(FailpointPageRead)
+		require.Empty(t, tx.allocatedPageNums)
+		return err
+	})
+	require.ErrorIs(t, err, errInjected)
+	info, err = db.FreelistInfo()
+	require.NoError(t, err)
+	require.Equal(t, used, info.HighWaterMark-info.FreePages, "the page taken from the freelist is free again")
+	require.NoError(t, db.Check())
 }
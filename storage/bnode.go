@@ -4,11 +4,23 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"slices"
 )
 
 const (
 	ValueSimple = 0
 	ValueBlob   = 1
+	// ValueBucket is a nested bucket, the payload is a bucket value like the ones of the
+	// root tree, see Bucket.CreateBucket
+	ValueBucket = 2
+
+	// blobRefSize is the payload of a blob reference, the start page and the blob size
+	blobRefSize = UInt64Size + UInt32Size
+
+	// valueFlagChecksum in the type byte marks a value carrying the XXH64 of its content
+	valueFlagChecksum = 0x80
+	valueTypeMask     = 0x7f
 
 	NodePageTypeSize = UInt8Size
 	NodeTypeSize     = UInt8Size
@@ -18,14 +30,35 @@ const (
 	NodePageTypeOffset = 0
 	NodeTypeOffset     = NodePageTypeOffset + NodePageTypeSize
 	NodeNumItemsOffset = NodeTypeOffset + NodeTypeSize
+
+	// nodeTypeLeaf in the node type byte marks a leaf, nodeFlagCounts an internal node
+	// storing the item count of every child subtree after the child page numbers
+	nodeTypeLeaf   = 1 << 0
+	nodeFlagCounts = 1 << 1
+	// nodeFlagWide marks a node with uint32 counts and lengths, written only when one of them
+	// does not fit an uint16, in pages above 64KB
+	nodeFlagWide = 1 << 2
 )
 
 // BNode map
-// 0           1            2            4                   ...                    ...                ...
-// +-----------+------------+------------+--------------------+----------------------+--------------------+
-// | Page Type | Node Type  | Num Items  |   Child Nodes      |     KV Offsets       |      KV Data       |
-// | uint8     |   uint8    |  uint16    | uint64[itemsN]   | uint16[itemsN]     |   (bytes[])        |
-// +-----------+------------+------------+--------------------+----------------------+--------------------+
+// 0           1            2            4                   ...                  ...                    ...                ...
+// +-----------+------------+------------+--------------------+--------------------+----------------------+--------------------+
+// | Page Type | Node Type  | Num Items  |   Child Nodes      | Child Counts       |     KV Offsets       |      KV Data       |
+// | uint8     |   uint8    |  uint16    | uint64[itemsN]   | uint64[childrenN]  | uint16[itemsN]     |   (bytes[])        |
+// +-----------+------------+------------+--------------------+--------------------+----------------------+--------------------+
+// Child counts are present with nodeFlagCounts, internal nodes written before 0.7 have none.
+// With nodeFlagWide (0.8) Num Items, the number of children and the key and value lengths
+// of every item are uint32 instead of uint16.
+
+// Item value map, the checksum is present when valueFlagChecksum is set in the type byte
+// 0        1                       1 or 9
+// +--------+-----------------------+--------------------------------------+
+// |  Type  | Checksum (optional)   | Inline value or blob start page     |
+// | uint8  | uint64                | bytes[] or uint64                    |
+// +--------+-----------------------+--------------------------------------+
+// Since 0.12 the blob start page is followed by the blob size, an uint32, so listings get
+// the size of a value without reading the blob.
+// A nested bucket (ValueBucket, 0.11) has no checksum, its payload is the bucket value.
 
 // Item represents a Key-value pair stored in a B-Tree node.
 type Item struct {
@@ -33,55 +66,148 @@ type Item struct {
 	Value []byte
 }
 
-func (item *Item) setValue(tx *Tx) error {
-	if len(item.Value) > MaxValueSize {
+// setValue encodes the item value, values above inlineLimit are saved as blobs, in the blob
+// file with inBlobFile
+func (item *Item) setValue(tx *Tx, inlineLimit int, inBlobFile bool) error {
+	withChecksum := tx.db.dal.opts.ValueChecksums
+	var checksum uint64
+	if withChecksum {
+		checksum = ValueChecksum(item.Value)
+	}
+	if len(item.Value) > inlineLimit {
 		blob, err := NewBlob(item.Value)
 		if err != nil {
 			return err
 		}
+		blob.inBlobFile = inBlobFile
 		pageNum, err := blob.Save(tx)
 		if err != nil {
 			return err
 		}
-		item.Value = make([]byte, 9)
-		item.Value[0] = ValueBlob
-		binary.LittleEndian.PutUint64(item.Value[1:], pageNum)
+		item.Value = blobValueRef(pageNum, len(item.Value), withChecksum, checksum)
 	} else {
-		item.Value = append(item.Value, 0)
-		copy(item.Value[1:], item.Value)
-		item.Value[0] = ValueSimple
+		value := valueHeader(ValueSimple, withChecksum, checksum, len(item.Value))
+		item.Value = append(value, item.Value...)
 	}
 
 	return nil
 }
 
+// valueHeader returns the type byte and the optional checksum, with room for size more bytes
+func valueHeader(valueType byte, withChecksum bool, checksum uint64, size int) []byte {
+	if !withChecksum {
+		return append(make([]byte, 0, 1+size), valueType)
+	}
+	value := make([]byte, 1+UInt64Size, 1+UInt64Size+size)
+	value[0] = valueType | valueFlagChecksum
+	binary.LittleEndian.PutUint64(value[1:], checksum)
+	return value
+}
+
+// blobValueRef encodes the item value pointing to the blob of size bytes stored at pageNum
+func blobValueRef(pageNum uint64, size int, withChecksum bool, checksum uint64) []byte {
+	value := valueHeader(ValueBlob, withChecksum, checksum, blobRefSize)
+	value = binary.LittleEndian.AppendUint64(value, pageNum)
+	return binary.LittleEndian.AppendUint32(value, uint32(size))
+}
+
+// blobRefDataSize returns the blob size stored in a blob reference payload, false for
+// references written before 0.12 which hold the start page only
+func blobRefDataSize(payload []byte) (int, bool) {
+	if len(payload) < blobRefSize {
+		return 0, false
+	}
+	return int(binary.LittleEndian.Uint32(payload[UInt64Size:])), true
+}
+
+// valueType returns the encoded value type without flags
+func (item *Item) valueType() (byte, error) {
+	if len(item.Value) == 0 {
+		return 0, fmt.Errorf("%w: empty value", ErrUnknownItemType)
+	}
+	return item.Value[0] & valueTypeMask, nil
+}
+
+// checksum returns the stored value checksum, false for values written without one
+func (item *Item) checksum() (uint64, bool) {
+	if len(item.Value) < 1+UInt64Size || item.Value[0]&valueFlagChecksum == 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(item.Value[1:]), true
+}
+
+// payload returns the encoded value after the header: the inline value or the blob reference
+func (item *Item) payload() ([]byte, error) {
+	valueType, err := item.valueType()
+	if err != nil {
+		return nil, err
+	}
+	header := 1
+	if item.Value[0]&valueFlagChecksum != 0 {
+		header += UInt64Size
+	}
+	if len(item.Value) < header {
+		return nil, fmt.Errorf("%w: value header of %d bytes", ErrCorrupted, len(item.Value))
+	}
+	payload := item.Value[header:]
+	if valueType == ValueBlob && len(payload) < UInt64Size {
+		return nil, fmt.Errorf("%w: blob reference of %d bytes", ErrCorrupted, len(payload))
+	}
+	return payload, nil
+}
+
 func (item *Item) getValue(tx *Tx) ([]byte, error) {
-	if item.Value[0] == ValueSimple {
-		return item.Value[1:], nil
-	} else if item.Value[0] == ValueBlob {
-		pageNum := binary.LittleEndian.Uint64(item.Value[1:])
-		blob, err := GetBlob(tx, pageNum)
+	valueType, err := item.valueType()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := item.payload()
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	switch valueType {
+	case ValueSimple:
+		value = payload
+	case ValueBlob:
+		blob, err := GetBlob(tx, binary.LittleEndian.Uint64(payload))
 		if err != nil {
 			return nil, err
 		}
-		return blob.data, nil
+		value = blob.data
+	case ValueBucket:
+		return nil, nil // cursors return nested buckets with a nil value
+	default:
+		return nil, ErrUnknownItemType
+	}
+	if checksum, ok := item.checksum(); ok && tx.db.dal.opts.VerifyValueChecksums {
+		if actual := ValueChecksum(value); actual != checksum {
+			return nil, fmt.Errorf("%w: stored %016x, value %016x", ErrChecksumMismatch, checksum, actual)
+		}
 	}
-	return nil, ErrUnknownItemType
+	return value, nil
 }
 
 func (item *Item) deleteValue(tx *Tx) (int, bool, error) {
-	var err error
-	dataLen := len(item.Value)
-	blob := false
-	if item.Value[0] == ValueBlob {
-		blob = true
-		pageNum := binary.LittleEndian.Uint64(item.Value[1:])
-		dataLen, err = DeleteBlob(tx, pageNum)
-		if err != nil {
-			return 0, false, err
-		}
+	valueType, err := item.valueType()
+	if err != nil {
+		return 0, false, err
+	}
+	payload, err := item.payload()
+	if err != nil {
+		return 0, false, err
+	}
+	if valueType == ValueBucket {
+		return 0, false, nil // the entry of a nested bucket counts as its key only
+	}
+	if valueType != ValueBlob {
+		return len(payload), false, nil
+	}
+	dataLen, err := DeleteBlob(tx, binary.LittleEndian.Uint64(payload))
+	if err != nil {
+		return 0, false, err
 	}
-	return dataLen, blob, nil
+	return dataLen, true, nil
 }
 
 // BNode represents a node in a B-Tree.
@@ -97,42 +223,68 @@ type BNode struct {
 
 	// childNodes is a slice of pageNum numbers of the child nodes.
 	childNodes []uint64
+
+	// childCounts is the number of items below each child node, empty while the node
+	// is not counted, see counted
+	childCounts []uint64
 }
 
 func NewBNode() *BNode {
 	return &BNode{}
 }
 
+// Serialize encodes the node into a page, counts and lengths that fit no encoding return an
+// error wrapping ErrNodeFieldOverflow instead of wrapping around
 func (node *BNode) Serialize(data []byte) error {
-	var bitSetVar uint8
+	var nodeType uint8
 	if node.isLeaf() {
-		bitSetVar = 1
+		nodeType = nodeTypeLeaf
+	} else if node.counted() {
+		nodeType = nodeFlagCounts
+	}
+	wide, err := node.wide()
+	if err != nil {
+		return err
+	}
+	if wide {
+		nodeType |= nodeFlagWide
 	}
 
 	// clear node.Data
 	copy(data, make([]byte, len(data)))
+	if len(data) < nodeHeaderSize(wide) {
+		return ErrNotEnoughSpace
+	}
 
 	data[NodePageTypeOffset] = NodePage
-	data[NodeTypeOffset] = bitSetVar
-	binary.LittleEndian.PutUint16(data[NodeNumItemsOffset:], uint16(node.numItems()))
-	pos := NodeHeaderSize
-
-	binary.LittleEndian.PutUint16(data[pos:], uint16(len(node.childNodes)))
-	pos += UInt16Size
+	data[NodeTypeOffset] = nodeType
+	pos := NodeNumItemsOffset
+	pos += putNodeLength(data[pos:], node.numItems(), wide)
+	pos += putNodeLength(data[pos:], len(node.childNodes), wide)
+	if pos+len(node.childNodes)*UInt64Size > len(data) {
+		return ErrNotEnoughSpace
+	}
 	for _, childNode := range node.childNodes {
 		binary.LittleEndian.PutUint64(data[pos:], childNode)
 		pos += UInt64Size
 	}
+	if nodeType&nodeFlagCounts != 0 {
+		if pos+len(node.childCounts)*UInt64Size > len(data) {
+			return ErrNotEnoughSpace
+		}
+		for _, count := range node.childCounts {
+			binary.LittleEndian.PutUint64(data[pos:], count)
+			pos += UInt64Size
+		}
+	}
 
 	kvPos := pos
 	for _, item := range node.items {
-		if kvPos+len(item.Key)+len(item.Value) >= len(data) {
+		if kvPos+2*node.lengthSize(wide)+len(item.Key)+len(item.Value) > len(data) {
 			return ErrNotEnoughSpace
 		}
-		binary.LittleEndian.PutUint16(data[kvPos:], uint16(len(item.Key)))
-		kvPos += UInt16Size
-		binary.LittleEndian.PutUint16(data[kvPos:], uint16(len(item.Value)))
-		kvPos += UInt16Size
+		kvPos += putNodeLength(data[kvPos:], len(item.Key), wide)
+		kvPos += putNodeLength(data[kvPos:], len(item.Value), wide)
 		copy(data[kvPos:], item.Key)
 		kvPos += len(item.Key)
 		copy(data[kvPos:], item.Value)
@@ -142,36 +294,132 @@ func (node *BNode) Serialize(data []byte) error {
 	return nil
 }
 
-func (node *BNode) Deserialize(data []byte) {
-	isLeaf := data[NodeTypeOffset]
-	numItems := int(binary.LittleEndian.Uint16(data[NodeNumItemsOffset:]))
-	pos := NodeHeaderSize
-	numbChildren := int(binary.LittleEndian.Uint16(data[pos:]))
-	pos += UInt16Size
+// wide reports whether the node needs the wide encoding, a count or length above uint32 fits
+// neither
+func (node *BNode) wide() (bool, error) {
+	if uint64(node.numItems()) > math.MaxUint32 || uint64(len(node.childNodes)) > math.MaxUint32 {
+		return false, fmt.Errorf("%w: %d items and %d children",
+			ErrNodeFieldOverflow, node.numItems(), len(node.childNodes))
+	}
+	wide := node.numItems() > math.MaxUint16 || len(node.childNodes) > math.MaxUint16
+	for idx, item := range node.items {
+		if !item.wide() {
+			continue
+		}
+		if uint64(len(item.Key)) > math.MaxUint32 || uint64(len(item.Value)) > math.MaxUint32 {
+			return false, fmt.Errorf("%w: item %d with a key of %d and a value of %d bytes",
+				ErrNodeFieldOverflow, idx, len(item.Key), len(item.Value))
+		}
+		wide = true
+	}
+	return wide, nil
+}
+
+// wide reports whether the key or value length of the item does not fit an uint16
+func (item *Item) wide() bool {
+	return len(item.Key) > math.MaxUint16 || len(item.Value) > math.MaxUint16
+}
+
+// lengthSize returns the size of a count or length field in the encoding
+func (node *BNode) lengthSize(wide bool) int {
+	if wide {
+		return UInt32Size
+	}
+	return UInt16Size
+}
 
-	if isLeaf == 0 {
+// nodeHeaderSize returns the size of the node header up to the child page numbers
+func nodeHeaderSize(wide bool) int {
+	if wide {
+		return NodePageTypeSize + NodeTypeSize + 2*UInt32Size
+	}
+	return NodeHeaderSize + UInt16Size
+}
+
+// putNodeLength writes a count or length in the encoding and returns its size
+func putNodeLength(data []byte, n int, wide bool) int {
+	if wide {
+		binary.LittleEndian.PutUint32(data, uint32(n))
+		return UInt32Size
+	}
+	binary.LittleEndian.PutUint16(data, uint16(n))
+	return UInt16Size
+}
+
+// readNodeLength reads a count or length in the encoding and returns it with its size
+func readNodeLength(data []byte, wide bool) (int, int) {
+	if wide {
+		return int(binary.LittleEndian.Uint32(data)), UInt32Size
+	}
+	return int(binary.LittleEndian.Uint16(data)), UInt16Size
+}
+
+// Deserialize decodes a node page, a corrupted page returns an error wrapping ErrCorrupted
+// instead of reading past the page. Nodes of both encodings are read.
+func (node *BNode) Deserialize(data []byte) error {
+	if len(data) < nodeHeaderSize(false) {
+		return fmt.Errorf("%w: node page of %d bytes", ErrCorrupted, len(data))
+	}
+	nodeType := data[NodeTypeOffset]
+	wide := nodeType&nodeFlagWide != 0
+	if len(data) < nodeHeaderSize(wide) {
+		return fmt.Errorf("%w: node page of %d bytes", ErrCorrupted, len(data))
+	}
+	lengthSize := node.lengthSize(wide)
+	pos := NodeNumItemsOffset
+	numItems, size := readNodeLength(data[pos:], wide)
+	pos += size
+	numbChildren, size := readNodeLength(data[pos:], wide)
+	pos += size
+
+	if nodeType&nodeTypeLeaf == 0 {
+		childSize := UInt64Size
+		if nodeType&nodeFlagCounts != 0 {
+			childSize += UInt64Size
+		}
+		if numbChildren > (len(data)-pos)/childSize {
+			return fmt.Errorf("%w: %d children do not fit the node page", ErrCorrupted, numbChildren)
+		}
+		// every item separates two children, a lookup indexes the children by the items
+		if numbChildren > 0 && numbChildren != numItems+1 {
+			return fmt.Errorf("%w: internal node with %d items and %d children", ErrCorrupted, numItems, numbChildren)
+		}
 		for idx := 0; idx < numbChildren; idx++ {
 			childNode := binary.LittleEndian.Uint64(data[pos:])
 			pos += UInt64Size
 			node.childNodes = append(node.childNodes, childNode)
 		}
+		if nodeType&nodeFlagCounts != 0 {
+			node.childCounts = make([]uint64, numbChildren)
+			for idx := range node.childCounts {
+				node.childCounts[idx] = binary.LittleEndian.Uint64(data[pos:])
+				pos += UInt64Size
+			}
+		}
 	}
 	for idx := 0; idx < numItems; idx++ {
-		keyLen := binary.LittleEndian.Uint16(data[pos:])
-		pos += UInt16Size
-		valueLen := binary.LittleEndian.Uint16(data[pos:])
-		pos += UInt16Size
+		if pos+2*lengthSize > len(data) {
+			return fmt.Errorf("%w: item %d of %d is past the node page", ErrCorrupted, idx, numItems)
+		}
+		keyLen, size := readNodeLength(data[pos:], wide)
+		pos += size
+		valueLen, size := readNodeLength(data[pos:], wide)
+		pos += size
+		if keyLen > len(data)-pos || valueLen > len(data)-pos-keyLen {
+			return fmt.Errorf("%w: item %d of %d is past the node page", ErrCorrupted, idx, numItems)
+		}
 
 		// Allocate new slices for Key and value to ensure they are copies
 		key := make([]byte, keyLen)
-		copy(key, data[pos:pos+int(keyLen)])
-		pos += int(keyLen)
+		copy(key, data[pos:pos+keyLen])
+		pos += keyLen
 
 		value := make([]byte, valueLen)
-		copy(value, data[pos:pos+int(valueLen)])
-		pos += int(valueLen)
+		copy(value, data[pos:pos+valueLen])
+		pos += valueLen
 		node.items = append(node.items, &Item{Key: key, Value: value})
 	}
+	return nil
 }
 
 // Return number of children
@@ -189,14 +437,89 @@ func (node *BNode) numItems() int {
 }
 
 func (node *BNode) elemSize(item *Item) int {
-	// Len of key + key, len of value + value + child node
-	return UInt16Size + len(item.Key) + UInt16Size + len(item.Value) + UInt64Size
+	// Len of key + key, len of value + value + child node, lengths of a node with a long
+	// item are wide, size adds the difference for the other items
+	lengthSize := node.lengthSize(item.wide())
+	size := lengthSize + len(item.Key) + lengthSize + len(item.Value) + UInt64Size
+	if !node.isLeaf() {
+		size += UInt64Size // child count
+	}
+	return size
+}
+
+// counted reports whether the node knows the item count of its children, a leaf always does.
+// Internal nodes of older files are counted by ensureCounts when a write changes them.
+func (node *BNode) counted() bool {
+	return len(node.childCounts) == len(node.childNodes)
+}
+
+// subtreeCount returns the number of items in the subtree of a counted node
+func (node *BNode) subtreeCount() uint64 {
+	count := uint64(len(node.items))
+	for _, childCount := range node.childCounts {
+		count += childCount
+	}
+	return count
+}
+
+// ensureCounts counts the children of a node written without counts, each walks its subtree
+func (node *BNode) ensureCounts(tx *Tx) error {
+	if node.counted() {
+		return nil
+	}
+	counts := make([]uint64, len(node.childNodes))
+	for i, pageNum := range node.childNodes {
+		count, err := countSubtree(tx, pageNum)
+		if err != nil {
+			return err
+		}
+		counts[i] = count
+	}
+	node.childCounts = counts
+	return nil
+}
+
+// countSubtree returns the number of items below pageNum, stored counts are used where present
+func countSubtree(tx *Tx, pageNum uint64) (uint64, error) {
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	if node.counted() {
+		return node.subtreeCount(), nil
+	}
+	count := uint64(len(node.items))
+	for _, childPageNum := range node.childNodes {
+		childCount, err := countSubtree(tx, childPageNum)
+		if err != nil {
+			return 0, err
+		}
+		count += childCount
+	}
+	return count, nil
+}
+
+// setChildCount stores the count of the child at index, a node that is not counted or a
+// child that is not counted leaves the node without counts
+func (node *BNode) setChildCount(index int, child *BNode) {
+	if !node.counted() || !child.counted() {
+		node.childCounts = nil
+		return
+	}
+	node.childCounts[index] = child.subtreeCount()
 }
 
 func (node *BNode) size() int {
 	size := NodeHeaderSize
+	narrow := 0
 	for _, item := range node.items {
 		size += node.elemSize(item)
+		if !item.wide() {
+			narrow++
+		}
+	}
+	if wide, _ := node.wide(); wide {
+		size += nodeHeaderSize(true) - nodeHeaderSize(false) + narrow*2*(UInt32Size-UInt16Size)
 	}
 	return size
 }
@@ -225,27 +548,29 @@ func (node *BNode) findKeyPosition(key []byte) (int, bool) {
 	return left, false
 }
 
-func (node *BNode) Find(tx *Tx, key []byte, exact bool) (int, *BNode, []int, bool) {
+// Find looks up the key below the node, a failure to read a node on the way is returned as error
+// and never reported as a missing key
+func (node *BNode) Find(tx *Tx, key []byte, exact bool) (int, *BNode, []int, bool, error) {
 	ancestorsIndexes := []int{0}
-	pos, foundNode, isFound := traverseBTree(tx, node, key, exact, &ancestorsIndexes)
-	return pos, foundNode, ancestorsIndexes, isFound
+	pos, foundNode, isFound, err := traverseBTree(tx, node, key, exact, &ancestorsIndexes)
+	return pos, foundNode, ancestorsIndexes, isFound, err
 }
 
-func traverseBTree(tx *Tx, node *BNode, key []byte, exact bool, ancestorsIndexes *[]int) (int, *BNode, bool) {
+func traverseBTree(tx *Tx, node *BNode, key []byte, exact bool, ancestorsIndexes *[]int) (int, *BNode, bool, error) {
 	pos, isFound := node.findKeyPosition(key)
 	if isFound {
-		return pos, node, isFound
+		return pos, node, isFound, nil
 	}
 	if node.isLeaf() {
 		if exact {
-			return -1, nil, false
+			return -1, nil, false, nil
 		}
-		return pos, node, true
+		return pos, node, true, nil
 	}
 	*ancestorsIndexes = append(*ancestorsIndexes, pos)
 	child, err := tx.getNode(node.childNodes[pos])
 	if err != nil {
-		return -1, nil, false
+		return -1, nil, false, err
 	}
 	return traverseBTree(tx, child, key, exact, ancestorsIndexes)
 }
@@ -272,20 +597,31 @@ func (node *BNode) isUnderPopulated(minThreshold float32) bool {
 	return float32(node.size()) < minThreshold
 }
 
-func (node *BNode) splitChild(tx *Tx, fullNode *BNode, fullNodeIndex int) {
-	// determine splitChild index
-	splitIndex := getSplitIndex(fullNode, tx.db.dal.minThreshold())
-
+// splitChild moves the items of fullNode after splitIndex to a new node, the item at
+// splitIndex goes to the parent node
+func (node *BNode) splitChild(tx *Tx, fullNode *BNode, fullNodeIndex int, splitIndex int) error {
 	// this element will go to parent node
 	middleItem := fullNode.items[splitIndex]
 	var newNode *BNode
+	var err error
 
 	if fullNode.isLeaf() {
-		newNode = tx.newNode(fullNode.items[splitIndex+1:], []uint64{})
+		newNode, err = tx.newNode(fullNode.items[splitIndex+1:], []uint64{}, nil)
+		if err != nil {
+			return err
+		}
 		tx.setNode(newNode)
 		fullNode.items = fullNode.items[:splitIndex]
 	} else {
-		newNode = tx.newNode(fullNode.items[splitIndex+1:], fullNode.childNodes[splitIndex+1:])
+		var childCounts []uint64
+		if fullNode.counted() {
+			childCounts = fullNode.childCounts[splitIndex+1:]
+			fullNode.childCounts = fullNode.childCounts[:splitIndex+1]
+		}
+		newNode, err = tx.newNode(fullNode.items[splitIndex+1:], fullNode.childNodes[splitIndex+1:], childCounts)
+		if err != nil {
+			return err
+		}
 		tx.setNode(newNode)
 		fullNode.items = fullNode.items[:splitIndex]
 		fullNode.childNodes = fullNode.childNodes[:splitIndex+1]
@@ -293,6 +629,9 @@ func (node *BNode) splitChild(tx *Tx, fullNode *BNode, fullNodeIndex int) {
 
 	// insert middle item to parent node
 	node.insertItemAt(middleItem, fullNodeIndex)
+	if node.counted() {
+		node.childCounts = slices.Insert(node.childCounts, fullNodeIndex+1, 0)
+	}
 
 	if len(node.childNodes) == fullNodeIndex+1 { // If middle of list, then move items forward
 		node.childNodes = append(node.childNodes, newNode.PageNum)
@@ -300,8 +639,11 @@ func (node *BNode) splitChild(tx *Tx, fullNode *BNode, fullNodeIndex int) {
 		node.childNodes = append(node.childNodes[:fullNodeIndex+1], node.childNodes[fullNodeIndex:]...)
 		node.childNodes[fullNodeIndex+1] = newNode.PageNum
 	}
+	node.setChildCount(fullNodeIndex, fullNode)
+	node.setChildCount(fullNodeIndex+1, newNode)
 
 	tx.writeNodes(node, fullNode)
+	return nil
 }
 
 // removeItemAtLeaf removes an item at the given index from a leaf node.
@@ -318,14 +660,14 @@ func (node *BNode) removeItemFromInternal(tx *Tx, index int) ([]int, error) {
 	affectedNodes := make([]int, 0)
 	affectedNodes = append(affectedNodes, index)
 
-	predecessorNode, err := tx.getNode(node.childNodes[index])
+	predecessorNode, err := tx.getCountedNode(node.childNodes[index])
 	if err != nil {
 		return nil, err
 	}
 
 	for !predecessorNode.isLeaf() {
 		traversingIndex := len(predecessorNode.childNodes) - 1
-		predecessorNode, err = tx.getNode(predecessorNode.childNodes[traversingIndex])
+		predecessorNode, err = tx.getCountedNode(predecessorNode.childNodes[traversingIndex])
 		if err != nil {
 			return nil, err
 		}
@@ -381,7 +723,22 @@ func rotateRight(leftNode, parentNode, rightNode *BNode, rightNodeIndex int) {
 		rightNode.childNodes = append(rightNode.childNodes, 0)
 		copy(rightNode.childNodes[1:], rightNode.childNodes[:])
 		rightNode.childNodes[0] = childToMove
+		moveChildCount(leftNode, len(leftNode.childCounts)-1, rightNode, 0)
 	}
+	parentNode.setChildCount(rightNodeIndex-1, leftNode)
+	parentNode.setChildCount(rightNodeIndex, rightNode)
+}
+
+// moveChildCount moves the count of the child that moved from index of one node to index of
+// another along with it, the nodes lose their counts unless both are counted
+func moveChildCount(from *BNode, fromIndex int, to *BNode, toIndex int) {
+	if len(from.childCounts) != len(from.childNodes)+1 || len(to.childCounts) != len(to.childNodes)-1 {
+		from.childCounts, to.childCounts = nil, nil
+		return
+	}
+	count := from.childCounts[fromIndex]
+	from.childCounts = slices.Delete(from.childCounts, fromIndex, fromIndex+1)
+	to.childCounts = slices.Insert(to.childCounts, toIndex, count)
 }
 
 func rotateLeft(leftNode, parentNode, rightNode *BNode, rightNodeIndex int) {
@@ -405,12 +762,15 @@ func rotateLeft(leftNode, parentNode, rightNode *BNode, rightNodeIndex int) {
 		childToMove := rightNode.childNodes[0]
 		rightNode.childNodes = rightNode.childNodes[1:]
 		leftNode.childNodes = append(leftNode.childNodes, childToMove)
+		moveChildCount(rightNode, 0, leftNode, len(leftNode.childCounts))
 	}
+	parentNode.setChildCount(rightNodeIndex, leftNode)
+	parentNode.setChildCount(rightNodeIndex+1, rightNode)
 }
 
 func (node *BNode) merge(tx *Tx, rightNode *BNode, rightNodeIndex int) error {
 	// Get the left sibling of rightNode
-	leftNode, err := tx.getNode(node.childNodes[rightNodeIndex-1])
+	leftNode, err := tx.getCountedNode(node.childNodes[rightNodeIndex-1])
 	if err != nil {
 		return err
 	}
@@ -421,7 +781,7 @@ func (node *BNode) merge(tx *Tx, rightNode *BNode, rightNodeIndex int) error {
 
 	// Check for overflow
 	if combinedSize+NodeHeaderSize > BTreePageSize {
-		return fmt.Errorf("merge overflow error: combined size %d exceeds max page size %d", combinedSize, BTreePageSize)
+		return fmt.Errorf("%w: merged node of %d bytes exceeds the page size %d", ErrNotEnoughSpace, combinedSize, BTreePageSize)
 	}
 
 	// Take the item from the parent, remove it and add it to the unbalanced node
@@ -436,12 +796,21 @@ func (node *BNode) merge(tx *Tx, rightNode *BNode, rightNodeIndex int) error {
 	leftNode.items = append(leftNode.items, rightNode.items...)
 
 	// Remove rightNode reference from parent
+	if node.counted() {
+		node.childCounts = slices.Delete(node.childCounts, rightNodeIndex, rightNodeIndex+1)
+	}
 	copy(node.childNodes[rightNodeIndex:], node.childNodes[rightNodeIndex+1:])
 	node.childNodes = node.childNodes[:len(node.childNodes)-1]
 
 	if !leftNode.isLeaf() {
+		if leftNode.counted() && rightNode.counted() {
+			leftNode.childCounts = append(leftNode.childCounts, rightNode.childCounts...)
+		} else {
+			leftNode.childCounts = nil
+		}
 		leftNode.childNodes = append(leftNode.childNodes, rightNode.childNodes...)
 	}
+	node.setChildCount(rightNodeIndex-1, leftNode)
 
 	tx.writeNodes(leftNode, node)
 	tx.deletePage(rightNode.PageNum)
@@ -468,7 +837,7 @@ func (node *BNode) rebalanceRemove(tx *Tx, unbalancedNode *BNode, nodeIndexInPar
 
 	// Right rotate
 	if nodeIndexInParent != 0 {
-		leftNode, err := tx.getNode(parentNode.childNodes[nodeIndexInParent-1])
+		leftNode, err := tx.getCountedNode(parentNode.childNodes[nodeIndexInParent-1])
 		if err != nil {
 			return err
 		}
@@ -481,7 +850,7 @@ func (node *BNode) rebalanceRemove(tx *Tx, unbalancedNode *BNode, nodeIndexInPar
 
 	// Left Balance
 	if nodeIndexInParent != len(parentNode.childNodes)-1 {
-		rightNode, err := tx.getNode(parentNode.childNodes[nodeIndexInParent+1])
+		rightNode, err := tx.getCountedNode(parentNode.childNodes[nodeIndexInParent+1])
 		if err != nil {
 			return err
 		}
@@ -495,7 +864,7 @@ func (node *BNode) rebalanceRemove(tx *Tx, unbalancedNode *BNode, nodeIndexInPar
 	// with its right sibling. In the case where the unbalanced node is the leftmost, we have to replace the merge
 	// parameters, so the unbalanced node right sibling, will be merged into the unbalanced node.
 	if nodeIndexInParent == 0 {
-		rightNode, err := tx.getNode(node.childNodes[nodeIndexInParent+1])
+		rightNode, err := tx.getCountedNode(node.childNodes[nodeIndexInParent+1])
 		if err != nil {
 			return err
 		}
@@ -505,23 +874,6 @@ func (node *BNode) rebalanceRemove(tx *Tx, unbalancedNode *BNode, nodeIndexInPar
 	return parentNode.merge(tx, unbalancedNode, nodeIndexInParent)
 }
 
-func traverse(tx *Tx, node *BNode, pages *[]uint64) {
-	if node == nil {
-		return
-	}
-	if !node.isLeaf() {
-		for _, nodePageNumber := range node.childNodes {
-			childNode, err := tx.getNode(nodePageNumber)
-			if err != nil {
-				return
-			}
-			*pages = append(*pages, childNode.PageNum)
-			traverse(tx, childNode, pages)
-		}
-	}
-	return
-}
-
 func getSplitIndex(node *BNode, minThreshold float32) int {
 	size := 0
 	size += NodeHeaderSize
@@ -3,6 +3,11 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
 )
 
 const (
@@ -30,7 +35,17 @@ type Bucket struct {
 	itemsN     uint64
 	blobsN     uint64
 	bytesInUse uint64
-	tx         *Tx
+	bucketsN   uint64 // nested buckets, counted in itemsN too
+	// expiration rules checked on every read, at most MaxPrefixRules
+	prefixRules []PrefixRule
+	options     BucketOptions
+	quota       BucketQuota
+	tx          *Tx
+	emptied     bool // the last key was removed in the transaction
+	// parent is the bucket holding a nested bucket, nil for a top level one. buckets are
+	// the nested buckets opened in a write transaction, written into this bucket on commit.
+	parent  *Bucket
+	buckets map[string]*Bucket
 }
 
 func newBucket(name []byte) *Bucket {
@@ -40,54 +55,187 @@ func newBucket(name []byte) *Bucket {
 	}
 }
 
+// Get returns the value of the key, use Lookup to tell a missing key from a read failure
 func (bucket *Bucket) Get(key []byte) ([]byte, bool) {
+	v, found, _ := bucket.Lookup(key)
+	return v, found
+}
+
+// Lookup returns the value of the key, a closed transaction or a corrupted page is returned as error
+func (bucket *Bucket) Lookup(key []byte) ([]byte, bool, error) {
 	if bucket.tx == nil {
-		return nil, false
+		return nil, false, ErrTxClosed
 	}
-	node, err := bucket.tx.getNode(bucket.root)
-	if err != nil {
-		return nil, false
+	if err := bucket.tx.enter(); err != nil {
+		return nil, false, err
 	}
-	pos, foundNode, _, found := node.Find(bucket.tx, key, true)
-	if !found {
-		return nil, false
+	defer bucket.tx.leave()
+	return bucket.get(key)
+}
+
+// Checksum returns the checksum stored with the value of the key, see Options.ValueChecksums.
+// It is false for a missing key and for a value written without a checksum.
+func (bucket *Bucket) Checksum(key []byte) (uint64, bool, error) {
+	if bucket.tx == nil {
+		return 0, false, ErrTxClosed
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return 0, false, err
 	}
+	defer bucket.tx.leave()
+	item, err := bucket.findItem(key)
+	if err != nil || item == nil {
+		return 0, false, err
+	}
+	checksum, ok := item.checksum()
+	return checksum, ok, nil
+}
 
-	value := foundNode.items[pos]
-	v, _ := value.getValue(bucket.tx)
+func (bucket *Bucket) get(key []byte) ([]byte, bool, error) {
+	item, err := bucket.findItem(key)
+	if err != nil || item == nil {
+		return nil, false, err
+	}
+	if item.isBucket() {
+		return nil, false, bucket.tx.keyError(key, ErrIncompatibleValue)
+	}
+	v, err := item.getValue(bucket.tx)
+	if err != nil {
+		return nil, false, bucket.tx.keyError(key, err)
+	}
+	return v, true, nil
+}
 
-	return v, true
+// findItem returns the item of the key with its encoded value, nil for a missing or expired key
+func (bucket *Bucket) findItem(key []byte) (*Item, error) {
+	node, err := bucket.tx.getNode(bucket.root)
+	if err != nil {
+		return nil, err
+	}
+	pos, foundNode, _, found, err := node.Find(bucket.tx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	if !found || bucket.expired(key, time.Now()) {
+		return nil, nil
+	}
+	return foundNode.items[pos], nil
 }
 
 // Bucket value map
-// 0            8            16         24         32            40
-// +------------+------------+-----------+-----------+------------+
-// |   Root     |  Counter   |   ItemN   |   BlobN   | BytesInUse |
-// |  uint64    |  uint64    |  uint64   |  uint64   |  uint64    |
-// +------------+------------+-----------+-----------+------------+
+// 0        4         5            13           21          29          37            45
+// +--------+---------+------------+------------+-----------+-----------+------------+
+// | Magic  | Version |   Root     |  Counter   |   ItemN   |   BlobN   | BytesInUse |
+// | uint32 |  uint8  |  uint64    |  uint64    |  uint64   |  uint64   |  uint64    |
+// +--------+---------+------------+------------+-----------+-----------+------------+
+// followed by optional prefix rules (see serializePrefixRules) and bucket options
+// (see serializeBucketOptions), rules are written whenever options are. A bucket quota
+// (see serializeBucketQuota) follows the options when their flags have bucketOptionQuota,
+// the blob file name (see serializeBucketFile) follows with bucketOptionFile, the retention
+// (see serializeBucketRetention) with bucketOptionRetention, the split strategy byte with
+// bucketOptionSplit and the uint64 count of nested buckets comes last with bucketOptionNested.
+// Values written before format 0.4 have no magic and version and start with the root.
+
+const (
+	// bucketValueMagic read as the root page of a legacy value would point past 11 TiB
+	bucketValueMagic   = 0xB5C4E7F1
+	bucketValueVersion = 1
+	bucketHeaderSize   = UInt32Size + UInt8Size
+)
 
 func (bucket *Bucket) serialize() *Item {
-	b := make([]byte, BucketTotalSize)
-	binary.LittleEndian.PutUint64(b[BucketRootOffset:], bucket.root)
-	binary.LittleEndian.PutUint64(b[BucketCounterOffset:], bucket.counter)
-	binary.LittleEndian.PutUint64(b[BucketItemNOffset:], bucket.itemsN)
-	binary.LittleEndian.PutUint64(b[BucketBlobNOffset:], bucket.blobsN)
-	binary.LittleEndian.PutUint64(b[BucketBytesInUseOffset:], bucket.bytesInUse)
+	b := make([]byte, bucketHeaderSize+BucketTotalSize)
+	binary.LittleEndian.PutUint32(b, bucketValueMagic)
+	b[UInt32Size] = bucketValueVersion
+	fields := b[bucketHeaderSize:]
+	binary.LittleEndian.PutUint64(fields[BucketRootOffset:], bucket.root)
+	binary.LittleEndian.PutUint64(fields[BucketCounterOffset:], bucket.counter)
+	binary.LittleEndian.PutUint64(fields[BucketItemNOffset:], bucket.itemsN)
+	binary.LittleEndian.PutUint64(fields[BucketBlobNOffset:], bucket.blobsN)
+	binary.LittleEndian.PutUint64(fields[BucketBytesInUseOffset:], bucket.bytesInUse)
+	hasOptions := bucket.options != (BucketOptions{}) || bucket.quota != (BucketQuota{}) || bucket.bucketsN != 0
+	if len(bucket.prefixRules) > 0 || hasOptions {
+		b = append(b, serializePrefixRules(bucket.prefixRules)...)
+	}
+	if hasOptions {
+		options := serializeBucketOptions(bucket.options)
+		if bucket.quota != (BucketQuota{}) {
+			options[0] |= bucketOptionQuota
+			options = append(options, serializeBucketQuota(bucket.quota)...)
+		}
+		if bucket.options.File != "" {
+			options = append(options, serializeBucketFile(bucket.options.File)...)
+		}
+		if bucket.options.RetainFor != 0 {
+			options = append(options, serializeBucketRetention(bucket.options)...)
+		}
+		if bucket.options.Split != SplitAuto {
+			options = append(options, byte(bucket.options.Split))
+		}
+		if bucket.bucketsN != 0 {
+			options[0] |= bucketOptionNested
+			options = binary.LittleEndian.AppendUint64(options, bucket.bucketsN)
+		}
+		b = append(b, options...)
+	}
 	return &Item{bucket.name, b}
 }
 
-func (bucket *Bucket) deserialize(data []byte) {
-	if len(data) != 0 {
-		bucket.root = binary.LittleEndian.Uint64(data[BucketRootOffset:])
-		bucket.counter = binary.LittleEndian.Uint64(data[BucketCounterOffset:])
-		bucket.itemsN = binary.LittleEndian.Uint64(data[BucketItemNOffset:])
-		bucket.blobsN = binary.LittleEndian.Uint64(data[BucketBlobNOffset:])
-		bucket.bytesInUse = binary.LittleEndian.Uint64(data[BucketBytesInUseOffset:])
+// deserialize returns ErrBadBucketValue if the data is not a bucket value, the bucket is
+// left unchanged then
+func (bucket *Bucket) deserialize(data []byte) error {
+	if len(data) >= bucketHeaderSize && binary.LittleEndian.Uint32(data) == bucketValueMagic {
+		if version := data[UInt32Size]; version != bucketValueVersion {
+			return fmt.Errorf("%w: unknown version %d", ErrBadBucketValue, version)
+		}
+		data = data[bucketHeaderSize:]
+	}
+	if len(data) < BucketTotalSize {
+		return fmt.Errorf("%w: %d bytes, at least %d expected", ErrBadBucketValue, len(data), BucketTotalSize)
+	}
+	rules, n, err := deserializePrefixRules(data[BucketTotalSize:])
+	if err != nil {
+		return err
+	}
+	bucket.root = binary.LittleEndian.Uint64(data[BucketRootOffset:])
+	bucket.counter = binary.LittleEndian.Uint64(data[BucketCounterOffset:])
+	bucket.itemsN = binary.LittleEndian.Uint64(data[BucketItemNOffset:])
+	bucket.blobsN = binary.LittleEndian.Uint64(data[BucketBlobNOffset:])
+	bucket.bytesInUse = binary.LittleEndian.Uint64(data[BucketBytesInUseOffset:])
+	bucket.prefixRules = rules
+	options := data[BucketTotalSize+n:]
+	bucket.options = deserializeBucketOptions(options)
+	if len(options) < bucketOptionsSize {
+		return nil
+	}
+	flags, rest := options[0], options[bucketOptionsSize:]
+	if flags&bucketOptionQuota != 0 {
+		bucket.quota = deserializeBucketQuota(rest)
+		rest = rest[min(len(rest), bucketQuotaSize):]
+	}
+	if flags&bucketOptionFile != 0 {
+		bucket.options.File = deserializeBucketFile(rest)
+		if len(rest) > 0 {
+			rest = rest[min(len(rest), 1+int(rest[0])):]
+		}
+	}
+	if flags&bucketOptionRetention != 0 {
+		deserializeBucketRetention(rest, &bucket.options)
+		rest = rest[min(len(rest), bucketRetentionSize):]
+	}
+	if flags&bucketOptionSplit != 0 && len(rest) > 0 {
+		bucket.options.Split = SplitStrategy(rest[0])
+		rest = rest[1:]
+	}
+	if flags&bucketOptionNested != 0 && len(rest) >= UInt64Size {
+		bucket.bucketsN = binary.LittleEndian.Uint64(rest)
 	}
+	return nil
 }
 
+// getNodes returns the nodes along the path of child indexes from the root, counted for a write
 func (bucket *Bucket) getNodes(indexes []int) ([]*BNode, error) {
-	root, err := bucket.tx.getNode(bucket.root)
+	root, err := bucket.tx.getCountedNode(bucket.root)
 	if err != nil {
 		return nil, err
 	}
@@ -95,26 +243,51 @@ func (bucket *Bucket) getNodes(indexes []int) ([]*BNode, error) {
 	nodes := []*BNode{root}
 	child := root
 	for i := 1; i < len(indexes); i++ {
-		child, _ = bucket.tx.getNode(child.childNodes[indexes[i]])
+		child, err = bucket.tx.getCountedNode(child.childNodes[indexes[i]])
+		if err != nil {
+			return nil, err
+		}
 		nodes = append(nodes, child)
 	}
 	return nodes, nil
 }
 
-func (bucket *Bucket) Put(key, value []byte) error {
-	var root *BNode
-	var err error
-	var keyExists bool
+// checkPut validates the key and the value size against the limits and the bucket policy
+func (bucket *Bucket) checkPut(key []byte, size int) error {
+	if len(key) >= MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if size >= OneGigabyte {
+		return ErrValueTooLarge
+	}
+	if size > bucket.inlineLimit() && bucket.options.DisableBlobs {
+		return ErrValueTooLarge
+	}
+	if bucket.expired(key, time.Now()) {
+		return ErrPrefixExpired
+	}
+	return nil
+}
 
+func (bucket *Bucket) Put(key, value []byte) error {
 	if bucket.tx == nil {
 		return ErrTxClosed
 	}
-	if len(key) >= MaxKeySize {
-		return ErrKeyTooLarge
+	if err := bucket.checkPut(key, len(value)); err != nil {
+		return err
 	}
-	if len(value) >= OneGigabyte {
-		return ErrValueTooLarge
+	if err := bucket.validate(key, value); err != nil {
+		return err
+	}
+	return bucket.put(key, value)
+}
+
+// put stores a value that passed checkPut and the bucket validator
+func (bucket *Bucket) put(key, value []byte) error {
+	if err := bucket.checkPutQuota(key, len(value)); err != nil {
+		return err
 	}
+	inlineLimit := bucket.inlineLimit()
 
 	item := Item{
 		Key:   key,
@@ -122,14 +295,118 @@ func (bucket *Bucket) Put(key, value []byte) error {
 	}
 
 	// Persist the value if needed to a blob store, before modifying the tree
-	err = item.setValue(bucket.tx)
+	err := item.setValue(bucket.tx, inlineLimit, bucket.inBlobFile())
+	if err != nil {
+		return err
+	}
+	return bucket.putItem(&item, len(value))
+}
+
+// PutReader stores a value of the given size read from r. Large values are streamed
+// straight into a blob page chain instead of being buffered as a whole, unless the bucket
+// has a validator which needs the whole value.
+func (bucket *Bucket) PutReader(key []byte, r io.Reader, size int) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if len(key) >= MaxKeySize {
+		return ErrKeyTooLarge
+	}
+	if size >= OneGigabyte {
+		return ErrValueTooLarge
+	}
+	if bucket.expired(key, time.Now()) {
+		return ErrPrefixExpired
+	}
+	if size <= bucket.inlineLimit() || bucket.validator() != nil {
+		value := make([]byte, size)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return err
+		}
+		return bucket.Put(key, value)
+	}
+	if bucket.options.DisableBlobs {
+		return ErrValueTooLarge
+	}
+	if err := bucket.checkPutQuota(key, size); err != nil {
+		return err
+	}
+
+	withChecksum := bucket.tx.db.dal.opts.ValueChecksums
+	var digest hash.Hash64
+	if withChecksum {
+		digest = NewValueHash()
+		r = io.TeeReader(r, digest)
+	}
+	pageNum, err := saveBlobStream(bucket.tx, r, size, bucket.inBlobFile())
 	if err != nil {
 		return err
 	}
+	var checksum uint64
+	if withChecksum {
+		checksum = digest.Sum64()
+	}
+	return bucket.putItem(&Item{Key: key, Value: blobValueRef(pageNum, size, withChecksum, checksum)}, size)
+}
+
+// Merge replaces the value of the key with fn(old), a missing key is created with fn(nil).
+// The old value is released before the new one is stored, so a value may move between
+// inline and blob storage in either direction. An error from fn, a value over the limits
+// or the quota or refused by the bucket validator leaves the key unchanged.
+func (bucket *Bucket) Merge(key []byte, fn func(old []byte) ([]byte, error)) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	old, found, err := bucket.get(key)
+	if err != nil {
+		return err
+	}
+	if len(old) <= bucket.inlineLimit() {
+		old = bytes.Clone(old) // an inline value points into the node, which Remove changes
+	}
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if err = bucket.checkPut(key, len(value)); err != nil {
+		return err
+	}
+	if found {
+		err = bucket.checkQuota(0, int64(len(value)-len(old)))
+	} else {
+		err = bucket.checkQuota(1, int64(len(key)+len(value)))
+	}
+	if err != nil {
+		return err
+	}
+	if err = bucket.validate(key, value); err != nil {
+		return err
+	}
+	if err = bucket.Remove(key); err != nil && !errors.Is(err, ErrNodeNotFound) {
+		return err
+	}
+	return bucket.put(key, value)
+}
+
+// putItem inserts the item with already encoded value into the tree, the blob of a value it
+// replaces is released. valueLen is the length of the original value used for bucket stats.
+func (bucket *Bucket) putItem(item *Item, valueLen int) error {
+	var root *BNode
+	var err error
+	var keyExists, oldBlob bool
+	var oldLen int
+	key := item.Key
+	bucket.recordKey(key, false)
 
 	// First insert: no root exists yet. Create a root node and set it
 	if bucket.root == 0 {
-		root = bucket.tx.newNode([]*Item{&item}, []uint64{})
+		root, err = bucket.tx.newNode([]*Item{item}, []uint64{}, nil)
+		if err != nil {
+			return err
+		}
 		root.PageNum = 2
 		bucket.tx.setNode(root)
 		bucket.root = root.PageNum
@@ -143,25 +420,52 @@ func (bucket *Bucket) Put(key, value []byte) error {
 	}
 
 	// Traverse the tree to find the target node and index for insertion
-	insertionIndex, nodeToInsertIn, breadcrumbs, found := root.Find(bucket.tx, item.Key, false)
+	insertionIndex, _, breadcrumbs, found, err := root.Find(bucket.tx, item.Key, false)
+	if err != nil {
+		return err
+	}
 	if !found {
 		return ErrNodeNotFound
 	}
 
+	// Fetch all nodes along the path (breadcrumbs) before the change, the ancestors keep the
+	// item count of the path and are rebalanced if needed
+	nodesAlongPath, err := bucket.getNodes(breadcrumbs)
+	if err != nil {
+		return err
+	}
+	nodeToInsertIn := nodesAlongPath[len(nodesAlongPath)-1]
+
 	// If the key already exists, update the value
 	if nodeToInsertIn.items != nil && insertionIndex < len(nodeToInsertIn.items) && bytes.Compare(nodeToInsertIn.items[insertionIndex].Key, key) == 0 {
-		nodeToInsertIn.items[insertionIndex] = &item
+		if nodeToInsertIn.items[insertionIndex].isBucket() != item.isBucket() {
+			// a value never replaces a nested bucket nor the other way round, a blob saved
+			// for the value is released
+			if _, _, err = item.deleteValue(bucket.tx); err != nil {
+				return err
+			}
+			return bucket.tx.keyError(key, ErrIncompatibleValue)
+		}
+		// the blob of the old value is released, the stats lose the old value
+		oldLen, oldBlob, err = nodeToInsertIn.items[insertionIndex].deleteValue(bucket.tx)
+		if err != nil {
+			return err
+		}
+		nodeToInsertIn.items[insertionIndex] = item
 		keyExists = true
 	} else {
 		// Otherwise, insert the new item at the appropriate position
-		nodeToInsertIn.insertItemAt(&item, insertionIndex)
+		nodeToInsertIn.insertItemAt(item, insertionIndex)
+		bucket.adjustPathCounts(nodesAlongPath, breadcrumbs, 1)
 	}
 	bucket.tx.setNode(nodeToInsertIn)
 
-	// Fetch all ancestor nodes along the path (breadcrumbs) to rebalance if needed
-	nodesAlongPath, err := bucket.getNodes(breadcrumbs)
-	if err != nil {
-		return err
+	// A node appends when the new key is the last of its subtree, found before the
+	// splits add children
+	appending := make([]bool, len(nodesAlongPath))
+	appending[len(appending)-1] = !keyExists && insertionIndex == len(nodeToInsertIn.items)-1
+	for i := len(nodesAlongPath) - 2; i >= 0; i-- {
+		appending[i] = appending[i+1] && breadcrumbs[i+1] == len(nodesAlongPath[i].childNodes)-1
 	}
 
 	// Rebalance from bottom-up, excluding root
@@ -170,45 +474,61 @@ func (bucket *Bucket) Put(key, value []byte) error {
 		node := nodesAlongPath[i+1]
 		nodeIndex := breadcrumbs[i+1]
 		if node.isOverPopulated(bucket.tx.db.dal.maxThreshold()) {
-			parentNode.splitChild(bucket.tx, node, nodeIndex)
+			if err = parentNode.splitChild(bucket.tx, node, nodeIndex, bucket.splitIndex(node, appending[i+1])); err != nil {
+				return err
+			}
 		}
 	}
 
 	// Re-check root in case it was affected and needs splitting
 	rootNode := nodesAlongPath[0]
 	if rootNode.isOverPopulated(bucket.tx.db.dal.maxThreshold()) {
-		newRoot := bucket.tx.newNode([]*Item{}, []uint64{rootNode.PageNum})
+		newRoot, newRootErr := bucket.tx.newNode([]*Item{}, []uint64{rootNode.PageNum}, []uint64{rootNode.subtreeCount()})
+		if newRootErr != nil {
+			return newRootErr
+		}
 		logger.Debug("splitChild root node", "oldPageNum", rootNode.PageNum, "newPageNum", newRoot.PageNum)
-		newRoot.splitChild(bucket.tx, rootNode, 0)
+		if err = newRoot.splitChild(bucket.tx, rootNode, 0, bucket.splitIndex(rootNode, appending[0])); err != nil {
+			return err
+		}
 
 		// commit newly created root
 		bucket.tx.setNode(newRoot)
 		bucket.root = newRoot.PageNum
 
-		// If this is the main bucket, update DB metadata
+		// If this is the main bucket, update DB metadata. A sub-bucket is in
+		// tx.dirtyBuckets and its new root is persisted on commit.
 		if bucket.tx.db.dal.meta.root == rootNode.PageNum {
 			bucket.tx.db.dal.meta.root = newRoot.PageNum
-		} else {
-			// If it's a sub-bucket, persist the bucket with the new root
-			_, updateBucketErr := bucket.tx.createOrUpdateBucket(bucket)
-			if updateBucketErr != nil {
-				return updateBucketErr
-			}
 		}
 	}
 
-	if !keyExists {
-		bucket.itemsN++
-		bucket.bytesInUse += uint64(len(key) + len(value))
-		if len(value) > MaxValueSize {
-			bucket.blobsN++
+	if keyExists {
+		bucket.bytesInUse = bucket.bytesInUse - uint64(oldLen) + uint64(valueLen)
+		if oldBlob {
+			bucket.blobsN--
 		}
+	} else {
+		bucket.itemsN++
+		bucket.bytesInUse += uint64(len(key) + valueLen)
+	}
+	if valueType, _ := item.valueType(); valueType == ValueBlob {
+		bucket.blobsN++
+	}
+	if valueLen > bucket.inlineLimit() {
+		logger.Debug("value stored as blob", bucket.tx.db.dal.logKey(key), "size", valueLen)
 	}
 
 	return nil
 }
 
+// Remove deletes the key, ErrIncompatibleValue if it holds a nested bucket, see DeleteBucket
 func (bucket *Bucket) Remove(key []byte) error {
+	return bucket.remove(key, false)
+}
+
+// remove deletes the key, nested tells whether it is expected to hold a nested bucket
+func (bucket *Bucket) remove(key []byte, nested bool) error {
 	if bucket.tx == nil {
 		return ErrTxClosed
 	}
@@ -219,7 +539,13 @@ func (bucket *Bucket) Remove(key []byte) error {
 	}
 
 	// Search for the key and collect the path (nodesAlongPath) to the node
-	removeItemIndex, nodeToRemoveFrom, breadcrumbs, found := rootNode.Find(bucket.tx, key, true)
+	removeItemIndex, _, breadcrumbs, found, err := rootNode.Find(bucket.tx, key, true)
+	if err != nil {
+		return err
+	}
+	// a removal of a missing key is reported too, the key may live elsewhere, like on the
+	// previous owner of a cluster node
+	bucket.recordKey(key, true)
 	if !found {
 		return ErrNodeNotFound
 	}
@@ -228,9 +554,17 @@ func (bucket *Bucket) Remove(key []byte) error {
 	if removeItemIndex == -1 {
 		return nil
 	}
+	nodesAlongPath, err := bucket.getNodes(breadcrumbs)
+	if err != nil {
+		return err
+	}
+	nodeToRemoveFrom := nodesAlongPath[len(nodesAlongPath)-1]
 
 	// Attempt to delete the blob before removing the item
 	item := nodeToRemoveFrom.items[removeItemIndex]
+	if item.isBucket() != nested {
+		return bucket.tx.keyError(key, ErrIncompatibleValue)
+	}
 	valueLen, wasBlob, blobDeleteErr := item.deleteValue(bucket.tx)
 	if blobDeleteErr != nil {
 		return blobDeleteErr
@@ -252,10 +586,11 @@ func (bucket *Bucket) Remove(key []byte) error {
 	// Persist the updated node in the transaction state
 	bucket.tx.setNode(nodeToRemoveFrom)
 
-	nodesAlongPath, err := bucket.getNodes(breadcrumbs)
+	nodesAlongPath, err = bucket.getNodes(breadcrumbs)
 	if err != nil {
 		return err
 	}
+	bucket.adjustPathCounts(nodesAlongPath, breadcrumbs, -1)
 
 	// Rebalance from the bottom-up (excluding the root node)
 	for i := len(nodesAlongPath) - 2; i >= 0; i-- {
@@ -269,14 +604,23 @@ func (bucket *Bucket) Remove(key []byte) error {
 		}
 	}
 
-	// If the root node is now empty but has children, promote the first child as the new root
+	// If the root gave its last item to a merge of its two children, the merged child is the
+	// new root. It is the remaining child, not the one on the path, which the merge may have
+	// released. An emptied tree keeps its empty root leaf, as a created bucket has one.
 	rootNode = nodesAlongPath[0]
 	if len(rootNode.items) == 0 && len(rootNode.childNodes) > 0 {
-		bucket.root = nodesAlongPath[1].PageNum
+		bucket.root = rootNode.childNodes[0]
+		// If this is the main bucket, update DB metadata as a root split does
+		if bucket.tx.db.dal.meta.root == rootNode.PageNum {
+			bucket.tx.db.dal.meta.root = bucket.root
+		}
+		delete(bucket.tx.dirtyNodes, rootNode.PageNum)
+		bucket.tx.deletePage(rootNode.PageNum)
 	}
 
 	// adjust bucket stat
 	bucket.itemsN--
+	bucket.emptied = bucket.emptied || bucket.itemsN == 0
 	bucket.bytesInUse -= uint64(len(key) + valueLen)
 	if wasBlob {
 		bucket.blobsN--
@@ -285,10 +629,133 @@ func (bucket *Bucket) Remove(key []byte) error {
 	return nil
 }
 
+// adjustPathCounts adds delta to the count of every child on the path to the node an item
+// was inserted into or removed from
+func (bucket *Bucket) adjustPathCounts(nodesAlongPath []*BNode, breadcrumbs []int, delta int) {
+	for i := 0; i < len(nodesAlongPath)-1; i++ {
+		node := nodesAlongPath[i]
+		if node.counted() {
+			node.childCounts[breadcrumbs[i+1]] += uint64(delta)
+			bucket.tx.setNode(node)
+		}
+	}
+}
+
+// deleteRangeBatch is how many keys DeleteRange collects before removing them, the cursor
+// is not valid across Remove so it seeks again after every batch
+const deleteRangeBatch = 1000
+
+// DeleteRange removes every key in [start, end) and returns the number of removed keys,
+// a nil end removes up to the end of the bucket. Keys hidden by expired prefix rules are
+// removed too, nested buckets are kept.
+func (bucket *Bucket) DeleteRange(start, end []byte) (int, error) {
+	return bucket.deleteRange(start, end, 0)
+}
+
+// deleteRange removes up to limit keys of [start, end) from the start, zero is unlimited
+func (bucket *Bucket) deleteRange(start, end []byte, limit int) (int, error) {
+	if bucket.tx == nil {
+		return 0, ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return 0, ErrWriteInRxTransaction
+	}
+	deleted := 0
+	for {
+		batch := deleteRangeBatch
+		if limit > 0 {
+			batch = min(batch, limit-deleted)
+		}
+		keys := make([][]byte, 0, batch)
+		cursor := bucket.Cursor()
+		for k, v := cursor.seek(start); k != nil && len(keys) < batch; k, v = cursor.next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				break
+			}
+			if v == nil {
+				continue // nested buckets are removed by DeleteBucket only
+			}
+			keys = append(keys, bytes.Clone(k))
+		}
+		if err := cursor.Err(); err != nil {
+			return deleted, err
+		}
+		for _, key := range keys {
+			if err := bucket.Remove(key); err != nil {
+				return deleted, err
+			}
+			deleted++
+		}
+		if len(keys) < batch || deleted == limit {
+			return deleted, nil
+		}
+		start = keys[len(keys)-1]
+	}
+}
+
+// DeletePrefix removes every key starting with the prefix and returns the number of removed keys
+func (bucket *Bucket) DeletePrefix(prefix []byte) (int, error) {
+	return bucket.DeleteRange(prefix, prefixEnd(prefix))
+}
+
+// release frees the pages of the bucket tree, of the blob chains of its values and of its
+// nested buckets, the bucket must not be used after it
+func (bucket *Bucket) release() error {
+	if bucket.root == 0 {
+		return nil
+	}
+	// the entries of nested buckets opened in the transaction have their current roots
+	if err := bucket.spill(); err != nil {
+		return err
+	}
+	return releaseTree(bucket.tx, bucket.root)
+}
+
+// releaseTree frees the subtree at pageNum with the blob chains and nested buckets of its items
+func releaseTree(tx *Tx, pageNum uint64) error {
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		return err
+	}
+	for _, item := range node.items {
+		valueType, err := item.valueType()
+		if err != nil {
+			return err
+		}
+		payload, err := item.payload()
+		if err != nil {
+			return err
+		}
+		switch valueType {
+		case ValueBlob:
+			if _, err = DeleteBlob(tx, binary.LittleEndian.Uint64(payload)); err != nil {
+				return tx.keyError(item.Key, err)
+			}
+		case ValueBucket:
+			nested := newBucket(item.Key)
+			if err = nested.deserialize(payload); err != nil {
+				return fmt.Errorf("bucket %q: %w", item.Key, err)
+			}
+			if err = releaseTree(tx, nested.root); err != nil {
+				return err
+			}
+		}
+	}
+	for _, childPageNum := range node.childNodes {
+		if err = releaseTree(tx, childPageNum); err != nil {
+			return err
+		}
+	}
+	delete(tx.dirtyNodes, pageNum)
+	tx.deletePage(pageNum)
+	return nil
+}
+
 func (bucket *Bucket) Cursor() *Cursor {
 	return &Cursor{bucket: bucket, tx: bucket.tx}
 }
 
+// ForEach calls fn for every key of the bucket in order, nested buckets with a nil value
 func (bucket *Bucket) ForEach(fn func(k, v []byte) error) error {
 	cursor := bucket.Cursor()
 	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
@@ -296,6 +763,12 @@ func (bucket *Bucket) ForEach(fn func(k, v []byte) error) error {
 			return err
 		}
 	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if bucket.tx.isInvalidated() {
+		return ErrTxClosed
+	}
 	return nil
 }
 
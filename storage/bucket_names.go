@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"slices"
+	"sync"
+)
+
+// maxCachedBuckets bounds the buckets the database remembers, lookups of many names that do
+// not exist must not grow it without limit
+const maxCachedBuckets = 1024
+
+// bucketCache remembers the committed values of buckets looked up in the root bucket, nil
+// for a name without a bucket. Commits forget the buckets they wrote and everything if they
+// created or deleted a bucket. They hold the write lock, so a reader never fills the cache
+// from a state older than the one it holds.
+type bucketCache struct {
+	lock   sync.RWMutex
+	values map[string][]byte
+}
+
+func (cache *bucketCache) get(name string) (value []byte, known bool) {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+	value, known = cache.values[name]
+	return value, known
+}
+
+func (cache *bucketCache) put(name string, value []byte) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cache.values == nil || len(cache.values) >= maxCachedBuckets {
+		cache.values = make(map[string][]byte)
+	}
+	cache.values[name] = slices.Clone(value)
+}
+
+func (cache *bucketCache) forget(buckets map[string]*Bucket) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	for name := range buckets {
+		delete(cache.values, name)
+	}
+}
+
+func (cache *bucketCache) clear() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	cache.values = nil
+}
+
+// BucketExists reports whether the bucket exists, including buckets created or deleted in
+// the transaction. Buckets already looked up are answered without a lookup in the root
+// bucket, across transactions until a commit creates or deletes a bucket.
+func (tx *Tx) BucketExists(name []byte) bool {
+	if _, ok := tx.dirtyBuckets[string(name)]; ok {
+		return true
+	}
+	if exists, ok := tx.knownBuckets[string(name)]; ok {
+		return exists
+	}
+	_, err := tx.GetBucket(name)
+	return err == nil
+}
+
+// bucketValue returns the value of the bucket in the root bucket, nil if there is none.
+// Transactions of a snapshot and transactions that created or deleted a bucket see a root
+// bucket that differs from the committed one, they do not share the database cache.
+func (tx *Tx) bucketValue(name []byte) ([]byte, error) {
+	if exists, ok := tx.knownBuckets[string(name)]; ok && !exists {
+		return nil, nil
+	}
+	shared := tx.snapshot == nil && !tx.bucketsChanged
+	if shared {
+		if value, ok := tx.db.buckets.get(string(name)); ok {
+			return slices.Clone(value), nil
+		}
+	}
+	value, found, err := tx.getRootBucket().get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		value = nil
+	}
+	if shared {
+		tx.db.buckets.put(string(name), value)
+	} else if tx.snapshot != nil {
+		tx.bucketChanged(name, value != nil)
+	}
+	return value, nil
+}
+
+// bucketChanged records whether the bucket exists for the transaction, after it created or
+// deleted the bucket or a snapshot looked it up
+func (tx *Tx) bucketChanged(name []byte, exists bool) {
+	if tx.knownBuckets == nil {
+		tx.knownBuckets = make(map[string]bool)
+	}
+	tx.knownBuckets[string(name)] = exists
+	tx.bucketsChanged = tx.bucketsChanged || tx.snapshot == nil
+}
+
+// cacheBuckets updates the database cache after a commit: the buckets written get their
+// committed values, a failed commit drops them
+func (tx *Tx) cacheBuckets(committed bool) {
+	if tx.bucketsChanged {
+		tx.db.buckets.clear()
+	} else {
+		tx.db.buckets.forget(tx.dirtyBuckets)
+	}
+	if !committed {
+		return
+	}
+	for name, bucket := range tx.dirtyBuckets {
+		tx.db.buckets.put(name, bucket.serialize().Value)
+	}
+}
+
+// deleteEmptyBuckets removes the buckets whose last key was removed in the transaction, for
+// Options.AutoDeleteEmptyBuckets. A bucket is only removed if its tree is down to an empty
+// root leaf, whose page is released with it.
+func (tx *Tx) deleteEmptyBuckets() error {
+	for name, bucket := range tx.dirtyBuckets {
+		if !bucket.emptied || bucket.itemsN != 0 {
+			continue
+		}
+		root, err := tx.getNode(bucket.root)
+		if err != nil {
+			return err
+		}
+		if !root.isLeaf() || len(root.items) > 0 {
+			continue
+		}
+		if err = tx.DeleteBucket([]byte(name)); err != nil {
+			return err
+		}
+		logger.Debug("deleted empty bucket", "bucket", name)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketExists(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "a")
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.True(t, tx.BucketExists([]byte("a")))
+		require.False(t, tx.BucketExists([]byte("b")))
+		return nil
+	}))
+	value, known := db.buckets.get("b")
+	require.True(t, known, "lookups are remembered across transactions")
+	require.Nil(t, value)
+
+	// a rolled back transaction leaves the remembered names alone
+	errRollback := errors.New("rollback")
+	require.ErrorIs(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("b"))
+		require.NoError(t, err)
+		require.True(t, tx.BucketExists([]byte("b")))
+		require.NoError(t, tx.DeleteBucket([]byte("a")))
+		require.False(t, tx.BucketExists([]byte("a")))
+		_, err = tx.GetBucket([]byte("a"))
+		require.ErrorIs(t, err, ErrBucketNotFound)
+		return errRollback
+	}), errRollback)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.True(t, tx.BucketExists([]byte("a")))
+		require.False(t, tx.BucketExists([]byte("b")))
+		return nil
+	}))
+
+	// a commit creating a bucket forgets them, except the buckets it wrote
+	createBuckets(t, db, "b")
+	_, known = db.buckets.get("a")
+	require.False(t, known)
+	value, known = db.buckets.get("b")
+	require.True(t, known)
+	require.NotNil(t, value)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.True(t, tx.BucketExists([]byte("b")))
+		_, err := tx.GetBucket([]byte("b"))
+		return err
+	}))
+}
+
+func TestRenameBucket(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "taken")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("old"))
+		require.NoError(t, err)
+		require.NoError(t, bucket.Put([]byte("k"), []byte("v")))
+		_, err = bucket.NextSequence()
+		require.NoError(t, err)
+		require.NoError(t, bucket.SetQuota(BucketQuota{MaxKeys: 10}))
+
+		// the changes of the transaction move with the bucket
+		require.NoError(t, tx.RenameBucket([]byte("old"), []byte("new")))
+		require.False(t, tx.BucketExists([]byte("old")))
+		require.ErrorIs(t, tx.RenameBucket([]byte("old"), []byte("other")), ErrBucketNotFound)
+		require.ErrorIs(t, tx.RenameBucket([]byte("new"), []byte("taken")), ErrBucketExists)
+		require.ErrorIs(t, tx.RenameBucket([]byte("new"), eventsBucketName), ErrReservedBucketName)
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("new"))
+		require.NoError(t, err)
+		value, found := bucket.Get([]byte("k"))
+		require.True(t, found)
+		require.Equal(t, []byte("v"), value)
+		require.Equal(t, uint64(1), bucket.Sequence())
+		require.Equal(t, uint64(10), bucket.Quota().MaxKeys)
+		_, err = tx.GetBucket([]byte("old"))
+		require.ErrorIs(t, err, ErrBucketNotFound)
+
+		events, err := tx.BucketEvents([]byte("new"), 10)
+		require.NoError(t, err)
+		require.Equal(t, "renamed from old", events[0].Detail)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
+
+func TestAutoDeleteEmptyBuckets(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithAutoDeleteEmptyBuckets(true)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(filename + ".tlog")
+	})
+	db := openTestDB(t, filename, opts)
+	createBuckets(t, db, "empty", "kept", "drained")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for _, name := range []string{"kept", "drained"} {
+			bucket, err := tx.GetBucket([]byte(name))
+			require.NoError(t, err)
+			for _, key := range []string{"key1", "key2"} {
+				require.NoError(t, bucket.Put([]byte(key), []byte("value")))
+			}
+		}
+		return nil
+	}))
+
+	var drainedRoot uint64
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		kept, err := tx.GetBucket([]byte("kept"))
+		require.NoError(t, err)
+		require.NoError(t, kept.Remove([]byte("key1")))
+		drained, err := tx.GetBucket([]byte("drained"))
+		require.NoError(t, err)
+		require.NoError(t, drained.Remove([]byte("key1")))
+		require.NoError(t, drained.Remove([]byte("key2")))
+		drainedRoot = drained.root
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.True(t, tx.BucketExists([]byte("empty")), "buckets created empty are kept")
+		require.True(t, tx.BucketExists([]byte("kept")))
+		require.False(t, tx.BucketExists([]byte("drained")))
+		return nil
+	}))
+	require.True(t, db.dal.freelist.isFree(drainedRoot), "the root page is released with the bucket")
+
+	// a key put back in the same transaction keeps the bucket
+	require.NoError(t, db.UpdateBucket([]byte("kept"), func(bucket *Bucket) error {
+		require.NoError(t, bucket.Remove([]byte("key2")))
+		return bucket.Put([]byte("key3"), []byte("value"))
+	}))
+	require.NoError(t, db.UpdateBucket([]byte("kept"), func(bucket *Bucket) error {
+		return bucket.Remove([]byte("key3"))
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.False(t, tx.BucketExists([]byte("kept")))
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BucketOptions is a write path policy stored with the bucket, reads are not affected
+type BucketOptions struct {
+	// DisableBlobs makes Put return ErrValueTooLarge for values above the inline
+	// threshold instead of spilling them into a blob page chain
+	DisableBlobs bool
+	// ForceBlobsAbove lowers the inline threshold from MaxValueSize, values longer than
+	// it are stored as blobs. Zero keeps MaxValueSize.
+	ForceBlobsAbove int
+	// File places the blobs of the bucket in a blob file, relative names are next to the
+	// database file. A database has at most one blob file, keys and inline values stay in
+	// the database file.
+	File string
+	// RetainFor makes DB.SweepRetention delete keys older than it, the time a key was
+	// written is read from the key as RetainKeys tells. Zero keeps keys forever.
+	RetainFor  time.Duration
+	RetainKeys RetentionKeys
+	// Split tells where full nodes of the bucket are split, see SplitStrategy
+	Split SplitStrategy
+}
+
+const (
+	bucketOptionDisableBlobs = 1 << iota
+	bucketOptionQuota        // a BucketQuota follows the options
+	bucketOptionFile         // the blob file name follows the options and the quota
+	bucketOptionRetention    // the retention follows the blob file name
+	bucketOptionSplit        // the split strategy byte follows the retention
+	bucketOptionNested       // the count of nested buckets comes last, see Bucket.CreateBucket
+)
+
+const bucketOptionsSize = 1 + UInt32Size // flags + ForceBlobsAbove
+
+// Bucket options follow the prefix rules in the bucket value
+// 0         1                 5
+// +---------+-----------------+
+// |  Flags  | ForceBlobsAbove |
+// |  uint8  |     uint32      |
+// +---------+-----------------+
+// With bucketOptionFile the name follows, after the quota if there is one
+// 0             1
+// +-------------+------------------+
+// | Name Length |  Blob File Name  |
+// |   uint8     |  bytes[]         |
+// +-------------+------------------+
+
+func serializeBucketOptions(opts BucketOptions) []byte {
+	b := make([]byte, bucketOptionsSize)
+	if opts.DisableBlobs {
+		b[0] |= bucketOptionDisableBlobs
+	}
+	if opts.File != "" {
+		b[0] |= bucketOptionFile
+	}
+	if opts.RetainFor != 0 {
+		b[0] |= bucketOptionRetention
+	}
+	if opts.Split != SplitAuto {
+		b[0] |= bucketOptionSplit
+	}
+	binary.LittleEndian.PutUint32(b[1:], uint32(opts.ForceBlobsAbove))
+	return b
+}
+
+func deserializeBucketOptions(data []byte) BucketOptions {
+	if len(data) < bucketOptionsSize {
+		return BucketOptions{}
+	}
+	return BucketOptions{
+		DisableBlobs:    data[0]&bucketOptionDisableBlobs != 0,
+		ForceBlobsAbove: int(binary.LittleEndian.Uint32(data[1:])),
+	}
+}
+
+// serializeBucketFile encodes the blob file name written after the options and the quota
+func serializeBucketFile(name string) []byte {
+	return append([]byte{byte(len(name))}, name...)
+}
+
+func deserializeBucketFile(data []byte) string {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return ""
+	}
+	return string(data[1 : 1+int(data[0])])
+}
+
+const bucketRetentionSize = UInt64Size + UInt8Size
+
+func serializeBucketRetention(opts BucketOptions) []byte {
+	b := make([]byte, bucketRetentionSize)
+	binary.LittleEndian.PutUint64(b, uint64(opts.RetainFor))
+	b[UInt64Size] = byte(opts.RetainKeys)
+	return b
+}
+
+// deserializeBucketRetention sets the retention fields of opts from data
+func deserializeBucketRetention(data []byte, opts *BucketOptions) {
+	if len(data) < bucketRetentionSize {
+		return
+	}
+	opts.RetainFor = time.Duration(binary.LittleEndian.Uint64(data))
+	opts.RetainKeys = RetentionKeys(data[UInt64Size])
+}
+
+func (opts BucketOptions) validate() error {
+	if opts.ForceBlobsAbove < 0 || opts.ForceBlobsAbove > MaxValueSize {
+		return ErrBadBucketOptions
+	}
+	if len(opts.File) > maxBlobFileName || strings.ContainsRune(opts.File, 0) {
+		return fmt.Errorf("%w: blob file name %q", ErrBadBucketOptions, opts.File)
+	}
+	if opts.RetainFor < 0 || opts.RetainKeys > RetainTimeKeys {
+		return fmt.Errorf("%w: retention %s of %d keys", ErrBadBucketOptions, opts.RetainFor, opts.RetainKeys)
+	}
+	if opts.Split > SplitThreshold {
+		return fmt.Errorf("%w: split strategy %s", ErrBadBucketOptions, opts.Split)
+	}
+	return nil
+}
+
+// CreateBucketWithOptions creates a bucket with a write policy, options can not be changed
+// later except the retention and the split strategy, see SetRetention and SetSplitStrategy
+func (tx *Tx) CreateBucketWithOptions(name []byte, opts BucketOptions) (*Bucket, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	blobs := tx.db.dal.blobs
+	if opts.File != "" && blobs != nil && blobs.name != opts.File {
+		return nil, fmt.Errorf("%w: the database keeps blobs in %s, it has one blob file", ErrBadBucketOptions, blobs.name)
+	}
+	bucket, err := tx.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	if opts.File != "" && blobs == nil {
+		if err = tx.db.dal.attachBlobFile(opts.File); err != nil {
+			return nil, err
+		}
+	}
+	bucket.options = opts
+	return bucket, nil
+}
+
+// Options returns the write policy of the bucket
+func (bucket *Bucket) Options() BucketOptions {
+	return bucket.options
+}
+
+// inBlobFile reports whether the blobs of the bucket are written to the blob file
+func (bucket *Bucket) inBlobFile() bool {
+	return bucket.options.File != ""
+}
+
+// inlineLimit is the longest value stored in the node, longer values go to blobs
+func (bucket *Bucket) inlineLimit() int {
+	if bucket.options.ForceBlobsAbove > 0 {
+		return bucket.options.ForceBlobsAbove
+	}
+	return MaxValueSize
+}
@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketOptions(t *testing.T) {
+	db, filename := createTestDB(t)
+	small := bytes.Repeat([]byte("s"), 200)
+	large := bytes.Repeat([]byte("l"), 3*MaxValueSize)
+
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucketWithOptions([]byte("bad"), BucketOptions{ForceBlobsAbove: MaxValueSize + 1})
+		require.ErrorIs(t, err, ErrBadBucketOptions)
+
+		strict, err := tx.CreateBucketWithOptions([]byte("strict"), BucketOptions{DisableBlobs: true})
+		if err != nil {
+			return err
+		}
+		require.NoError(t, strict.Put([]byte("inline"), bytes.Repeat([]byte("i"), MaxValueSize)))
+		require.ErrorIs(t, strict.Put([]byte("large"), large), ErrValueTooLarge)
+		require.ErrorIs(t, strict.PutReader([]byte("large"), bytes.NewReader(large), len(large)), ErrValueTooLarge)
+
+		cold, err := tx.CreateBucketWithOptions([]byte("cold"), BucketOptions{ForceBlobsAbove: 100})
+		if err != nil {
+			return err
+		}
+		if err = cold.Put([]byte("small"), small); err != nil {
+			return err
+		}
+		if err = cold.Put([]byte("tiny"), []byte("tiny")); err != nil {
+			return err
+		}
+		return cold.SetPrefixTTL([]byte("tmp:"), time.Now().Add(time.Hour))
+	})
+	require.NoError(t, err)
+	closeTestDB(t, db)
+
+	// options are stored in the bucket value together with prefix rules
+	db = openTestDB(t, filename, nil)
+	require.NoError(t, db.Check())
+	err = db.Update(func(tx *Tx) error {
+		strict, err := tx.GetBucket([]byte("strict"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, BucketOptions{DisableBlobs: true}, strict.Options())
+		require.ErrorIs(t, strict.Put([]byte("large"), large), ErrValueTooLarge)
+		require.Zero(t, strict.blobsN)
+
+		cold, err := tx.GetBucket([]byte("cold"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, BucketOptions{ForceBlobsAbove: 100}, cold.Options())
+		require.Len(t, cold.PrefixRules(), 1)
+		require.Equal(t, uint64(1), cold.blobsN)
+		value, found := cold.Get([]byte("small"))
+		require.True(t, found)
+		require.Equal(t, small, value)
+		return nil
+	})
+	require.NoError(t, err)
+}
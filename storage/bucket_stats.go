@@ -0,0 +1,143 @@
+package storage
+
+import "bytes"
+
+// StatOption tunes what DB.Stat collects
+type StatOption func(*statConfig)
+
+type statConfig struct {
+	buckets bool
+}
+
+// WithBuckets controls whether Stat loads every bucket to fill DBStat.Buckets, disabled it
+// keeps Stat cheap for databases with many buckets
+func WithBuckets(enable bool) StatOption {
+	return func(c *statConfig) {
+		c.buckets = enable
+	}
+}
+
+// NamedBucketStat is a bucket stat returned by BucketStatsPage
+type NamedBucketStat struct {
+	Name string
+	BucketStat
+}
+
+func (bucket *Bucket) stat() *BucketStat {
+	stat := &BucketStat{
+		ItemsN:      bucket.itemsN,
+		BlobsN:      bucket.blobsN,
+		BytesInUse:  bucket.bytesInUse,
+		BucketsN:    bucket.bucketsN,
+		PrefixRules: bucket.PrefixRules(),
+		Quota:       bucket.quota,
+		RetainFor:   bucket.options.RetainFor,
+	}
+	if bucket.options.RetainFor > 0 && bucket.tx != nil && bucket.parent == nil {
+		if sweep, ok := bucket.tx.db.retention.get(string(bucket.name)); ok {
+			stat.LastSweep = &sweep
+		}
+	}
+	if bucket.tx != nil && bucket.parent == nil && !IsInternalBucket(bucket.name) {
+		events, err := bucket.tx.bucketEvents(bucket.name, statEvents)
+		if err != nil {
+			logger.Warn("skipping bucket events", "bucket", string(bucket.name), "error", err)
+		}
+		stat.Events = events
+	}
+	return stat
+}
+
+// BucketStatsPage returns stats of up to limit buckets ordered by name and starting after
+// startAfter, next is the name to pass as startAfter for the following page and nil
+// once the last bucket was returned
+func (tx *Tx) BucketStatsPage(startAfter []byte, limit int) (stats []NamedBucketStat, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, ErrInvalidLimit
+	}
+	if err := tx.enter(); err != nil {
+		return nil, nil, err
+	}
+	defer tx.leave()
+	stats, _, next, err = tx.bucketStatsPage(startAfter, limit)
+	return stats, next, err
+}
+
+// bucketStatsPage is BucketStatsPage also returning the names of root entries that are not
+// bucket values, they are skipped as in Stat
+func (tx *Tx) bucketStatsPage(startAfter []byte, limit int) (stats []NamedBucketStat, invalid []string, next []byte, err error) {
+	cursor := tx.getRootBucket().Cursor()
+	var k, v []byte
+	if startAfter == nil {
+		k, v = cursor.first()
+	} else {
+		k, v = cursor.seek(startAfter)
+		if bytes.Equal(k, startAfter) {
+			k, v = cursor.next()
+		}
+	}
+	stats = make([]NamedBucketStat, 0, limit)
+	for ; k != nil; k, v = cursor.next() {
+		if len(stats) == limit {
+			return stats, invalid, []byte(stats[len(stats)-1].Name), nil
+		}
+		if IsInternalBucket(k) {
+			continue
+		}
+		bucket := newBucket([]byte{})
+		if bucket.deserialize(v) != nil {
+			logger.Warn("skipping invalid bucket value", "bucket", string(k))
+			invalid = append(invalid, string(k))
+			continue
+		}
+		bucket.tx = tx
+		bucket.name = k
+		if dirty, ok := tx.dirtyBuckets[string(k)]; ok {
+			bucket = dirty
+		}
+		stats = append(stats, NamedBucketStat{Name: string(k), BucketStat: *bucket.stat()})
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	return stats, invalid, nil, nil
+}
+
+// StatBuckets calls fn with the stats of every bucket ordered by name, batchSize buckets at a
+// time. Each batch is read in its own read transaction, released before fn runs, so fn can
+// write to a slow client without holding back writers and memory does not grow with the
+// number of buckets. The batches are not a point in time snapshot. Like Stat it does not wait
+// for a writer: while one holds the lock the remaining buckets are skipped and complete is
+// false. invalid lists the root entries that are not bucket values, as DBStat.InvalidBuckets.
+func (db *DB) StatBuckets(batchSize int, fn func(stats []NamedBucketStat) error) (invalid []string, complete bool, err error) {
+	if batchSize <= 0 {
+		return nil, false, ErrInvalidLimit
+	}
+	var start []byte
+	for {
+		var stats []NamedBucketStat
+		var skipped []string
+		var next []byte
+		ok, err := db.tryView(func(tx *Tx) error {
+			if err := tx.enter(); err != nil {
+				return err
+			}
+			defer tx.leave()
+			stats, skipped, next, err = tx.bucketStatsPage(start, batchSize)
+			return err
+		})
+		if err != nil || !ok {
+			return invalid, false, err
+		}
+		invalid = append(invalid, skipped...)
+		if len(stats) > 0 {
+			if err = fn(stats); err != nil {
+				return invalid, false, err
+			}
+		}
+		if next == nil {
+			return invalid, true, nil
+		}
+		start = next
+	}
+}
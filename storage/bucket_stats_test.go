@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketStatsPage(t *testing.T) {
+	db, _ := createTestDB(t)
+	const bucketsN = 25
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < bucketsN; i++ {
+			bucket, err := tx.CreateBucket([]byte(fmt.Sprintf("tenant-%03d", i)))
+			if err != nil {
+				return err
+			}
+			for j := 0; j <= i; j++ {
+				if err := bucket.Put([]byte(fmt.Sprintf("key-%d", j)), []byte("value")); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}))
+
+	require.Nil(t, db.Stat(WithBuckets(false)).Buckets)
+	all := db.Stat().Buckets
+	require.Len(t, all, bucketsN)
+
+	var names []string
+	require.NoError(t, db.View(func(tx *Tx) error {
+		var startAfter []byte
+		for {
+			stats, next, err := tx.BucketStatsPage(startAfter, 10)
+			if err != nil {
+				return err
+			}
+			require.LessOrEqual(t, len(stats), 10)
+			for _, stat := range stats {
+				names = append(names, stat.Name)
+				require.Equal(t, all[stat.Name].ItemsN, stat.ItemsN)
+			}
+			if next == nil {
+				return nil
+			}
+			startAfter = next
+		}
+	}))
+	require.Len(t, names, bucketsN)
+	require.IsIncreasing(t, names)
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		// a page ending exactly at the last bucket has no next cursor
+		stats, next, err := tx.BucketStatsPage([]byte("tenant-019"), 5)
+		require.NoError(t, err)
+		require.Len(t, stats, 5)
+		require.Equal(t, "tenant-020", stats[0].Name)
+		require.Nil(t, next)
+
+		// the start name does not have to exist
+		stats, _, err = tx.BucketStatsPage([]byte("tenant-0105"), 1)
+		require.NoError(t, err)
+		require.Equal(t, "tenant-011", stats[0].Name)
+
+		_, _, err = tx.BucketStatsPage(nil, 0)
+		require.ErrorIs(t, err, ErrInvalidLimit)
+		return nil
+	}))
+
+	// StatBuckets hands out the same stats in batches, each read in its own transaction
+	names = names[:0]
+	var batches int
+	_, complete, err := db.StatBuckets(10, func(stats []NamedBucketStat) error {
+		require.NotEmpty(t, stats)
+		require.LessOrEqual(t, len(stats), 10)
+		batches++
+		for _, stat := range stats {
+			names = append(names, stat.Name)
+			require.Equal(t, all[stat.Name].ItemsN, stat.ItemsN)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.Equal(t, 3, batches)
+	require.Len(t, names, bucketsN)
+	require.IsIncreasing(t, names)
+	stop := errors.New("stop")
+	_, complete, err = db.StatBuckets(10, func([]NamedBucketStat) error { return stop })
+	require.ErrorIs(t, err, stop)
+	require.False(t, complete)
+	_, _, err = db.StatBuckets(0, nil)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+
+	// uncommitted changes of a write transaction are visible in its own pages
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("tenant-000"))
+		require.NoError(t, err)
+		require.NoError(t, bucket.Put([]byte("extra"), []byte("value")))
+		stats, _, err := tx.BucketStatsPage(nil, 1)
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), stats[0].ItemsN)
+		return nil
+	}))
+}
+
+func TestStatDuringWrite(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "data")
+	before := db.Stat(WithBuckets(false))
+	require.False(t, before.LastCommit.IsZero())
+
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("data"))
+			if err != nil {
+				return err
+			}
+			value := make([]byte, 512)
+			for i := 0; i < 5000; i++ {
+				if err := bucket.Put([]byte(fmt.Sprintf("key-%05d", i)), value); err != nil {
+					return err
+				}
+			}
+			close(holding)
+			<-release
+			return nil
+		})
+	}()
+	<-holding
+
+	// the writer holds the lock until released, Stat reports the last commit meanwhile
+	for i := 0; i < 3; i++ {
+		started := time.Now()
+		stat := db.Stat(WithBuckets(false))
+		require.Less(t, time.Since(started), time.Second)
+		require.Equal(t, before.TotalPageNum, stat.TotalPageNum)
+		require.Equal(t, before.UsedPageN, stat.UsedPageN)
+		require.Equal(t, before.FreePageN, stat.FreePageN)
+		require.Equal(t, before.LastCommit, stat.LastCommit)
+		require.Positive(t, stat.WriterHeldFor)
+		time.Sleep(500 * time.Millisecond)
+	}
+	stat := db.Stat()
+	require.Empty(t, stat.Buckets)
+	require.False(t, stat.BucketsComplete)
+	_, complete, err := db.StatBuckets(10, func([]NamedBucketStat) error {
+		return errors.New("no batch is read while the writer holds the lock")
+	})
+	require.NoError(t, err)
+	require.False(t, complete)
+	close(release)
+	require.NoError(t, <-done)
+
+	after := db.Stat(WithBuckets(false))
+	require.Greater(t, after.UsedPageN, before.UsedPageN)
+	require.True(t, after.LastCommit.After(before.LastCommit))
+	require.Equal(t, before.Commit.Commits+1, after.Commit.Commits)
+}
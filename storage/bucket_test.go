@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"math/rand"
@@ -194,6 +195,66 @@ func BenchmarkBucketOperations(b *testing.B) {
 	})
 }
 
+// BenchmarkIOMode compares buffered and direct io, every Put is a separate commit and
+// every Get reads pages from the file, so the page cache bypass is visible in both.
+func BenchmarkIOMode(b *testing.B) {
+	for _, directIO := range []bool{false, true} {
+		name := "buffered"
+		if directIO {
+			name = "direct"
+		}
+		b.Run(name, func(b *testing.B) {
+			path := TempFileName(".db")
+			opts := DefaultOptions().WithDirectIO(directIO)
+			db, err := Open(path, opts)
+			require.NoError(b, err)
+			b.Cleanup(func() {
+				_ = db.Close()
+				_ = os.Remove(path)
+				_ = os.Remove(opts.TxLogPath)
+			})
+			if directIO && !db.Stat().DirectIO {
+				b.Skip("direct io is not supported by the filesystem")
+			}
+			require.NoError(b, db.Update(func(tx *Tx) error {
+				_, err := tx.CreateBucket([]byte("foo"))
+				return err
+			}))
+
+			b.Run("Put", func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					err = db.Update(func(tx *Tx) error {
+						bucket, err := tx.GetBucket([]byte("foo"))
+						if err != nil {
+							return err
+						}
+						return bucket.Put([]byte(fmt.Sprintf("%016d", i)), []byte(fmt.Sprintf("%016d", i)))
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("Get", func(b *testing.B) {
+				err = db.View(func(tx *Tx) error {
+					bucket, err := tx.GetBucket([]byte("foo"))
+					if err != nil {
+						return err
+					}
+					for i := 0; i < b.N; i++ {
+						bucket.Get([]byte(fmt.Sprintf("%016d", i%1000)))
+					}
+					return nil
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			})
+		})
+	}
+}
+
 func TestBucketInsertRandom(t *testing.T) {
 	db, filename := createTestDB(t)
 	iterations := 1_000_000
@@ -337,3 +398,460 @@ func TestBucketNextSequence(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestBucketPutReader(t *testing.T) {
+	db, _ := createTestDB(t)
+	testValue := make([]byte, 100_000)
+	for idx := 0; idx < len(testValue); idx++ {
+		testValue[idx] = byte(rand.Intn(255))
+	}
+
+	err := db.Update(func(tx *Tx) error {
+		bucket, _ := tx.CreateBucket([]byte("foo"))
+		err := bucket.PutReader([]byte("blob"), bytes.NewReader(testValue), len(testValue))
+		require.NoError(t, err)
+		err = bucket.PutReader([]byte("small"), strings.NewReader("bar"), 3)
+		require.NoError(t, err)
+		err = bucket.PutReader([]byte("short"), bytes.NewReader(testValue[:10]), len(testValue))
+		require.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *Tx) error {
+		bucket, _ := tx.GetBucket([]byte("foo"))
+		v, found := bucket.Get([]byte("blob"))
+		require.True(t, found)
+		require.Equal(t, testValue, v)
+		v, found = bucket.Get([]byte("small"))
+		require.True(t, found)
+		require.Equal(t, []byte("bar"), v)
+		require.Equal(t, uint64(2), bucket.itemsN)
+		require.Equal(t, uint64(1), bucket.blobsN)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBucketDeleteRange(t *testing.T) {
+	db, _ := createTestDB(t)
+	blob := bytes.Repeat([]byte("b"), 3*BTreePageSize)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		// more than one batch of sess: keys
+		for i := 0; i < 2500; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("sess:%05d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		for _, key := range []string{"sess", "sesr:1", "set:1", "user:1"} {
+			if err = bucket.Put([]byte(key), []byte("value")); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("sess:blob"), blob)
+	})
+	require.NoError(t, err)
+
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		deleted, err := bucket.DeletePrefix([]byte("sess:"))
+		require.NoError(t, err)
+		require.Equal(t, 2501, deleted)
+		deleted, err = bucket.DeletePrefix([]byte("sess:"))
+		require.NoError(t, err)
+		require.Zero(t, deleted)
+		deleted, err = bucket.DeleteRange([]byte("set"), nil)
+		require.NoError(t, err)
+		require.Equal(t, 2, deleted)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		var keys []string
+		require.NoError(t, bucket.ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		}))
+		require.Equal(t, []string{"sesr:1", "sess"}, keys)
+		require.Equal(t, uint64(2), bucket.itemsN)
+		require.Zero(t, bucket.blobsN)
+
+		_, err = bucket.DeletePrefix([]byte("sess"))
+		require.ErrorIs(t, err, ErrWriteInRxTransaction)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Check())
+}
+
+func TestBucketMerge(t *testing.T) {
+	db, _ := createTestDB(t)
+	appendValue := func(entry []byte) func(old []byte) ([]byte, error) {
+		return func(old []byte) ([]byte, error) {
+			return append(bytes.Clone(old), entry...), nil
+		}
+	}
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		require.NoError(t, err)
+
+		// a missing key is created with fn(nil)
+		require.NoError(t, bucket.Merge([]byte("list"), func(old []byte) ([]byte, error) {
+			require.Nil(t, old)
+			return []byte("a"), nil
+		}))
+		// grow the value from inline into a blob chain
+		entry := bytes.Repeat([]byte("x"), 1000)
+		for i := 0; i < 20; i++ {
+			require.NoError(t, bucket.Merge([]byte("list"), appendValue(entry)))
+		}
+		value, found := bucket.Get([]byte("list"))
+		require.True(t, found)
+		require.Len(t, value, 1+20*1000)
+		require.Equal(t, uint64(1), bucket.itemsN)
+		require.Equal(t, uint64(1), bucket.blobsN)
+
+		// an error from fn keeps the value
+		fnErr := errors.New("stop")
+		require.ErrorIs(t, bucket.Merge([]byte("list"), func(old []byte) ([]byte, error) {
+			return nil, fnErr
+		}), fnErr)
+		value, _ = bucket.Get([]byte("list"))
+		require.Len(t, value, 1+20*1000)
+		return nil
+	})
+	require.NoError(t, err)
+
+	// shrink the blob back to an inline value in another transaction
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		require.NoError(t, bucket.Merge([]byte("list"), func(old []byte) ([]byte, error) {
+			return old[:1], nil
+		}))
+		require.Equal(t, uint64(1), bucket.itemsN)
+		require.Zero(t, bucket.blobsN)
+		require.Equal(t, uint64(len("list")+1), bucket.bytesInUse)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		value, _ := bucket.Get([]byte("list"))
+		require.Equal(t, []byte("a"), value)
+		require.ErrorIs(t, bucket.Merge([]byte("list"), appendValue([]byte("b"))), ErrWriteInRxTransaction)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Check())
+	info, err := db.FreelistInfo()
+	require.NoError(t, err)
+	require.Positive(t, info.FreePages, "released blob pages go back to the freelist")
+}
+
+func TestBucketsSkipInvalidValues(t *testing.T) {
+	db, _ := createTestDB(t)
+	badVersion := (&Bucket{root: 5}).serialize().Value
+	badVersion[UInt32Size] = 9
+	truncatedRules := append((&Bucket{root: 5}).serialize().Value, 1, 0, 200, 0)
+	invalid := map[string][]byte{
+		"short":           []byte("x"),
+		"bad version":     badVersion,
+		"truncated rules": truncatedRules,
+	}
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		if _, err := tx.CreateBucket([]byte("good")); err != nil {
+			return err
+		}
+		for name, value := range invalid {
+			if err := tx.getRootBucket().Put([]byte(name), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	stat := db.Stat()
+	require.ElementsMatch(t, []string{"bad version", "short", "truncated rules"}, stat.InvalidBuckets)
+	require.Len(t, stat.Buckets, 1)
+	require.Contains(t, stat.Buckets, "good")
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Equal(t, [][]byte{[]byte("good")}, tx.Buckets())
+		stats, _, err := tx.BucketStatsPage(nil, 10)
+		require.NoError(t, err)
+		require.Len(t, stats, 1)
+		for name := range invalid {
+			_, err = tx.GetBucket([]byte(name))
+			require.ErrorIs(t, err, ErrBadBucketValue, name)
+		}
+		return nil
+	}))
+	invalidNames, complete, err := db.StatBuckets(1, func(stats []NamedBucketStat) error {
+		require.Equal(t, "good", stats[0].Name)
+		return nil
+	})
+	require.NoError(t, err)
+	require.True(t, complete)
+	require.ElementsMatch(t, stat.InvalidBuckets, invalidNames)
+	require.ErrorIs(t, db.Check(), ErrCorrupted)
+}
+
+func TestValueChecksums(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithValueChecksums(true, true)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	db := openTestDB(t, filename, opts)
+	blob := bytes.Repeat([]byte("b"), 3*BTreePageSize)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("inline"), []byte("value")); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("blob"), blob); err != nil {
+			return err
+		}
+		if err = bucket.PutReader([]byte("stream"), bytes.NewReader(blob), len(blob)); err != nil {
+			return err
+		}
+		// a value stored with a wrong checksum, as a bad write would leave it
+		value := append(valueHeader(ValueSimple, true, 1, 3), "bad"...)
+		return bucket.putItem(&Item{Key: []byte("bad"), Value: value}, 3)
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		for key, value := range map[string][]byte{"inline": []byte("value"), "blob": blob, "stream": blob} {
+			checksum, ok, err := bucket.Checksum([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok, key)
+			require.Equal(t, ValueChecksum(value), checksum, key)
+			got, found, err := bucket.Lookup([]byte(key))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, value, got)
+		}
+		_, found, err := bucket.Lookup([]byte("bad"))
+		require.ErrorIs(t, err, ErrChecksumMismatch)
+		require.False(t, found)
+		_, ok, err := bucket.Checksum([]byte("missing"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		return nil
+	}))
+	err := db.Check()
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.Contains(t, err.Error(), `key "bad": value checksum mismatch`)
+
+	// without verification the value is returned as stored
+	db.dal.opts.VerifyValueChecksums = false
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		value, found, err := bucket.Lookup([]byte("bad"))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, []byte("bad"), value)
+		return nil
+	}))
+
+	// values written without checksums have none, and replacing or removing them works
+	db.dal.opts.ValueChecksums = false
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("inline"), []byte("plain")); err != nil {
+			return err
+		}
+		_, ok, err := bucket.Checksum([]byte("inline"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		if err = bucket.Remove([]byte("blob")); err != nil {
+			return err
+		}
+		return bucket.Remove([]byte("bad"))
+	}))
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		require.EqualValues(t, 2, bucket.stat().ItemsN)
+		require.EqualValues(t, 1, bucket.stat().BlobsN)
+		return nil
+	}))
+}
+
+// treePages returns the depth of the root tree and the pages in use for nodes and values, the
+// freelist and released pages excluded
+func treePages(t *testing.T, db *DB) (int, int) {
+	t.Helper()
+	require.NoError(t, db.Check())
+	stats := TreeStats{LeafItems: make(map[int]int), BlobChainPages: make(map[int]int)}
+	require.NoError(t, db.View(func(tx *Tx) error {
+		root, err := tx.getNode(tx.db.dal.meta.root)
+		if err != nil {
+			return err
+		}
+		return collectTreeStats(tx, root, 0, &stats)
+	}))
+	stat := db.Stat(WithBuckets(false))
+	return len(stats.Levels), stat.UsedPageN - stat.FreeListPageN - stat.ReleasedPageN
+}
+
+func TestBucketDrainRefill(t *testing.T) {
+	db, _ := createTestDB(t)
+	const keys = 5000
+	update := func(fn func(bucket *Bucket, key []byte) error) {
+		t.Helper()
+		// batches commit demoted roots between transactions as well as within one
+		for start := 0; start < keys; start += 1000 {
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				bucket, err := tx.CreateBucketIfNotExists([]byte("drain"))
+				if err != nil {
+					return err
+				}
+				for i := start; i < start+1000; i++ {
+					// long keys keep the fan-out low, the tree grows three levels deep
+					if err = fn(bucket, []byte(fmt.Sprintf("key-%05d-%s", i, strings.Repeat("k", 100)))); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		}
+	}
+	put := func(bucket *Bucket, key []byte) error { return bucket.Put(key, key) }
+	remove := func(bucket *Bucket, key []byte) error { return bucket.Remove(key) }
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("drain"))
+		return err
+	}))
+	rootDepth, baseline := treePages(t, db)
+	update(put)
+	stats, err := db.TreeStats([]byte("drain"))
+	require.NoError(t, err)
+	depth := stats.Depth
+	require.Greater(t, depth, 2)
+	_, filled := treePages(t, db)
+
+	for range 2 {
+		update(remove)
+		stats, err = db.TreeStats([]byte("drain"))
+		require.NoError(t, err)
+		require.Equal(t, 1, stats.Depth, "the drained bucket is a single empty leaf")
+		require.Equal(t, map[int]int{0: 1}, stats.LeafItems)
+		drainedDepth, drained := treePages(t, db)
+		require.Equal(t, rootDepth, drainedDepth)
+		require.Equal(t, baseline, drained, "every demoted root is released")
+
+		update(put)
+		stats, err = db.TreeStats([]byte("drain"))
+		require.NoError(t, err)
+		require.Equal(t, depth, stats.Depth)
+		_, refilled := treePages(t, db)
+		require.Equal(t, filled, refilled)
+	}
+
+	// the root tree holds the buckets, its root in the meta is demoted the same way
+	names := make([][]byte, 1000)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for i := range names {
+			names[i] = []byte(fmt.Sprintf("bucket-%04d-%s", i, strings.Repeat("x", 64)))
+			if _, err := tx.CreateBucket(names[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	grownDepth, _ := treePages(t, db)
+	require.Greater(t, grownDepth, rootDepth)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for _, name := range names {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	shrunkDepth, _ := treePages(t, db)
+	require.Equal(t, rootDepth, shrunkDepth)
+	_, err = db.TreeStats([]byte("drain"))
+	require.NoError(t, err)
+}
+
+func TestDeleteBucketReleasesPages(t *testing.T) {
+	db, _ := createTestDB(t)
+	fill := func() {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucket([]byte("doomed"))
+			if err != nil {
+				return err
+			}
+			for i := range 3000 {
+				if err = bucket.Put([]byte(fmt.Sprintf("key-%05d", i)), []byte(strings.Repeat("v", 32))); err != nil {
+					return err
+				}
+			}
+			for i := range 5 {
+				if err = bucket.Put([]byte(fmt.Sprintf("blob-%d", i)), make([]byte, 3*BTreePageSize)); err != nil {
+					return err
+				}
+			}
+			nested, err := bucket.CreateBucket([]byte("nested"))
+			if err != nil {
+				return err
+			}
+			return nested.Put([]byte("blob"), make([]byte, 2*BTreePageSize))
+		}))
+	}
+	fill()
+	stats, err := db.TreeStats([]byte("doomed"))
+	require.NoError(t, err)
+	pages := 1 + calcPageCount(2*BTreePageSize) // the nested leaf and its blob
+	for _, level := range stats.Levels {
+		pages += level.NodesN
+	}
+	for chainPages, blobsN := range stats.BlobChainPages {
+		pages += chainPages * blobsN
+	}
+	require.Equal(t, 5, stats.BlobChainPages[calcPageCount(3*BTreePageSize)])
+
+	before := db.Stat()
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("doomed"))
+	}))
+	after := db.Stat()
+	require.GreaterOrEqual(t, after.ReleasedPageN-before.ReleasedPageN, pages)
+	require.NoError(t, db.Check())
+
+	// the released pages are reused, creating and deleting the bucket again does not grow the file
+	fill()
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket([]byte("doomed"))
+	}))
+	require.Equal(t, after.TotalPageNum, db.Stat().TotalPageNum)
+	require.NoError(t, db.Check())
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		require.ErrorIs(t, tx.DeleteBucket([]byte("doomed")), ErrBucketNotFound)
+		return nil
+	}))
+}
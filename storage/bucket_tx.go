@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"sync"
+)
+
+// bucketScope limits a write transaction started by UpdateBucket to one bucket
+type bucketScope struct {
+	name      string
+	lock      *bucketLock
+	exclusive bool // the database lock was taken exclusively for the commit
+}
+
+// bucketLock serializes the writers of one bucket, it is dropped when no writer uses it
+type bucketLock struct {
+	sync.Mutex
+	refs int
+}
+
+// bucketLocks holds the locks of buckets with a writer running or waiting
+type bucketLocks struct {
+	lock  sync.Mutex
+	locks map[string]*bucketLock
+}
+
+func (locks *bucketLocks) acquire(name string) *bucketLock {
+	locks.lock.Lock()
+	if locks.locks == nil {
+		locks.locks = make(map[string]*bucketLock)
+	}
+	bl, ok := locks.locks[name]
+	if !ok {
+		bl = &bucketLock{}
+		locks.locks[name] = bl
+	}
+	bl.refs++
+	locks.lock.Unlock()
+	bl.Lock()
+	return bl
+}
+
+func (locks *bucketLocks) release(name string, bl *bucketLock) {
+	bl.Unlock()
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+	bl.refs--
+	if bl.refs == 0 {
+		delete(locks.locks, name)
+	}
+}
+
+// UpdateBucket runs fn in a write transaction limited to the named bucket. Writers of
+// different buckets run fn at the same time, next to readers, and only their commits take the
+// database lock exclusively, one after the other. Writers of the same bucket are serialized.
+// Update excludes all bucket writers while it runs. fn must not keep the bucket after it
+// returned, an error of fn rolls the transaction back. ErrBucketNotFound is returned if the
+// bucket does not exist, UpdateBucket does not create it.
+func (db *DB) UpdateBucket(name []byte, fn func(bucket *Bucket) error) (err error) {
+	tx, err := db.beginBucket(string(name))
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	defer db.recoverPanic(&err)
+	bucket, err := tx.GetBucket(name)
+	if err != nil {
+		return err
+	}
+	if err = fn(bucket); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// beginBucket starts a write transaction scoped to the bucket. The locks are taken in the
+// order bucket writers, bucket, database; a global writer takes bucket writers exclusively
+// before the database lock, so the two never wait on each other in a circle.
+func (db *DB) beginBucket(name string) (*Tx, error) {
+	if db.dal.readOnly {
+		return nil, db.dal.errReadOnly()
+	}
+	ownerID := goroutineID()
+	if !db.acquireOwner(ownerID) {
+		return nil, ErrNestedTransaction
+	}
+	if db.stall != nil {
+		if err := db.stall.check(int(db.writeQueue.Load())); err != nil {
+			db.releaseOwner(ownerID)
+			return nil, err
+		}
+	}
+	db.writeQueue.Add(1)
+	db.bucketWriters.RLock()
+	bl := db.bucketLocks.acquire(name)
+	db.lock.RLock()
+	db.writeQueue.Add(-1)
+	tx := newTx(db, true, ownerID)
+	tx.scope = &bucketScope{name: name, lock: bl}
+	tx.changes = newChangeSet(db.getCommitHooks())
+	tx.validators = db.getValidators()
+	return tx, nil
+}
+
+// promote takes the database lock exclusively for the commit of a bucket transaction
+func (tx *Tx) promote() {
+	if tx.scope == nil || tx.scope.exclusive {
+		return
+	}
+	tx.db.lock.RUnlock()
+	tx.db.lock.Lock()
+	tx.scope.exclusive = true
+}
+
+// unlockBucket releases the locks of a bucket transaction
+func (tx *Tx) unlockBucket() {
+	if tx.scope.exclusive {
+		tx.db.lock.Unlock()
+	} else {
+		tx.db.lock.RUnlock()
+	}
+	tx.db.bucketLocks.release(tx.scope.name, tx.scope.lock)
+	tx.db.bucketWriters.RUnlock()
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func createBuckets(t testing.TB, db *DB, names ...string) {
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestUpdateBucket(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "a", "b")
+	var events []*CommitEvent
+	db.OnCommit(func(event *CommitEvent) {
+		events = append(events, event)
+	})
+
+	require.NoError(t, db.UpdateBucket([]byte("a"), func(bucket *Bucket) error {
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	require.Len(t, events, 1)
+	require.True(t, events[0].Changed("a", []byte("key")))
+
+	errFn := errors.New("fn failed")
+	require.ErrorIs(t, db.UpdateBucket([]byte("a"), func(bucket *Bucket) error {
+		require.NoError(t, bucket.Put([]byte("rolled back"), []byte("value")))
+		return errFn
+	}), errFn)
+	require.ErrorIs(t, db.UpdateBucket([]byte("missing"), func(bucket *Bucket) error {
+		return nil
+	}), ErrBucketNotFound)
+	require.ErrorIs(t, db.UpdateBucket([]byte("a"), func(bucket *Bucket) error {
+		return db.View(func(tx *Tx) error { return nil })
+	}), ErrNestedTransaction)
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("a"))
+		require.NoError(t, err)
+		_, found := bucket.Get([]byte("key"))
+		require.True(t, found)
+		_, found = bucket.Get([]byte("rolled back"))
+		require.False(t, found)
+		return nil
+	}))
+	require.Len(t, events, 1)
+	require.NoError(t, db.Check())
+}
+
+func TestUpdateBucketOverlaps(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "a", "b")
+
+	// both writers are inside fn at the same time and a reader runs next to them
+	entered := make(chan struct{}, 2)
+	proceed := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, db.UpdateBucket([]byte(name), func(bucket *Bucket) error {
+				entered <- struct{}{}
+				<-proceed
+				return bucket.Put([]byte("key"), []byte(name))
+			}))
+		}()
+	}
+	for range 2 {
+		select {
+		case <-entered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("bucket writers of different buckets were serialized")
+		}
+	}
+	require.NoError(t, db.View(func(tx *Tx) error { return nil }))
+	close(proceed)
+	wg.Wait()
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		for _, name := range []string{"a", "b"} {
+			bucket, err := tx.GetBucket([]byte(name))
+			require.NoError(t, err)
+			value, _ := bucket.Get([]byte("key"))
+			require.Equal(t, name, string(value))
+		}
+		return nil
+	}))
+}
+
+func TestUpdateBucketConcurrent(t *testing.T) {
+	db, _ := createTestDB(t)
+	names := []string{"a", "b", "c"}
+	createBuckets(t, db, names...)
+	const writers, commits = 4, 50
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		for w := 0; w < writers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < commits; i++ {
+					err := db.UpdateBucket([]byte(name), func(bucket *Bucket) error {
+						// a read-modify-write loses counts unless writers of a bucket are serialized
+						value, _ := bucket.Get([]byte("counter"))
+						n, _ := strconv.Atoi(string(value))
+						if err := bucket.Put([]byte("counter"), []byte(strconv.Itoa(n+1))); err != nil {
+							return err
+						}
+						return bucket.Put([]byte(fmt.Sprintf("key-%d-%03d", w, i)), make([]byte, 200))
+					})
+					require.NoError(t, err)
+				}
+			}()
+		}
+	}
+	// global writers and readers run in between
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < commits; i++ {
+			require.NoError(t, putKey(db, fmt.Sprintf("global-%d", i)))
+			require.NoError(t, db.View(func(tx *Tx) error {
+				_, err := tx.GetBucket([]byte("a"))
+				return err
+			}))
+		}
+	}()
+	wg.Wait()
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		for _, name := range names {
+			bucket, err := tx.GetBucket([]byte(name))
+			require.NoError(t, err)
+			value, _ := bucket.Get([]byte("counter"))
+			require.Equal(t, strconv.Itoa(writers*commits), string(value))
+			keys, err := bucket.CountPrefix([]byte("key-"))
+			require.NoError(t, err)
+			require.EqualValues(t, writers*commits, keys)
+		}
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
+
+// BenchmarkUpdateBucket compares two writers on two buckets through Update and UpdateBucket,
+// with UpdateBucket only the commits of the writers are serialized
+func BenchmarkUpdateBucket(b *testing.B) {
+	for _, scoped := range []bool{false, true} {
+		b.Run(fmt.Sprintf("scoped=%t", scoped), func(b *testing.B) {
+			db, _ := createTestDB(b)
+			createBuckets(b, db, "a", "b")
+			write := func(name string, round int) func(bucket *Bucket) error {
+				return func(bucket *Bucket) error {
+					for i := 0; i < 100; i++ {
+						key := []byte(fmt.Sprintf("%s-%05d", name, (round*100+i)%20000))
+						if _, found := bucket.Get(key); found {
+							continue
+						}
+						if err := bucket.Put(key, commitBenchInline); err != nil {
+							return err
+						}
+					}
+					return nil
+				}
+			}
+			b.ResetTimer()
+			var wg sync.WaitGroup
+			for _, name := range []string{"a", "b"} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < b.N; i++ {
+						var err error
+						if scoped {
+							err = db.UpdateBucket([]byte(name), write(name, i))
+						} else {
+							err = db.Update(func(tx *Tx) error {
+								bucket, err := tx.GetBucket([]byte(name))
+								if err != nil {
+									return err
+								}
+								return write(name, i)(bucket)
+							})
+						}
+						if err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// checker accumulates the pages reachable from the meta page during Check
+type checker struct {
+	tx        *Tx
+	free      *Freelist
+	seen      map[uint64]string // page number -> owner description
+	errs      []error
+	limit     uint64 // first page number never handed out by the freelist
+	blobLimit uint64 // the same for the blob file, 0 without one
+}
+
+// Check walks the root tree, every bucket tree and blob chain in a read transaction.
+// It verifies that keys are ordered and that every reachable page lies within the
+// allocated range, is referenced once and is not on the freelist. Leaked pages are
+// not reported. The returned error wraps ErrCorrupted.
+func (db *DB) Check() error {
+	return db.View(func(tx *Tx) error {
+		// the walk is a single read operation, MaxReaderDuration waits for it to finish
+		if err := tx.enter(); err != nil {
+			return err
+		}
+		defer tx.leave()
+		// bucket transactions do not allocate during the walk, the freelist stays as it is
+		tx.db.dal.allocLock.Lock()
+		defer tx.db.dal.allocLock.Unlock()
+		c := newChecker(tx)
+		c.run()
+		if len(c.errs) > 0 {
+			return fmt.Errorf("%w: %w", ErrCorrupted, errors.Join(c.errs...))
+		}
+		return nil
+	})
+}
+
+func newChecker(tx *Tx) *checker {
+	freelist := tx.db.dal.freelist
+	c := &checker{
+		tx:    tx,
+		free:  freelist,
+		seen:  make(map[uint64]string),
+		limit: min(max(freelist.currentPage, rootPageNumber)+1, tx.db.dal.maxPages.Load()),
+	}
+	if freelist.doubleFreed > 0 {
+		c.errorf("%d pages were released to the freelist twice", freelist.doubleFreed)
+	}
+	if blobs := tx.db.dal.blobs; blobs != nil {
+		c.blobLimit = min(blobs.freelist.currentPage+1, blobs.maxPages.Load())
+		if blobs.freelist.doubleFreed > 0 {
+			c.errorf("%d pages were released to the blob file freelist twice", blobs.freelist.doubleFreed)
+		}
+	}
+	return c
+}
+
+func (c *checker) errorf(format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf(format, args...))
+}
+
+// visit marks the page as used by owner, it returns false if the page must not be read
+func (c *checker) visit(pageNum uint64, owner string) bool {
+	if isBlobFilePage(pageNum) {
+		return c.visitBlobFile(pageNum, owner)
+	}
+	if pageNum == metaPageNumber || pageNum >= c.limit {
+		c.errorf("%s references page %d out of range", owner, pageNum)
+		return false
+	}
+	if prev, ok := c.seen[pageNum]; ok {
+		c.errorf("page %d is referenced by %s and %s", pageNum, prev, owner)
+		return false
+	}
+	c.seen[pageNum] = owner
+	if c.free.isFree(pageNum) {
+		c.errorf("page %d of %s is on the freelist", pageNum, owner)
+	}
+	return true
+}
+
+// visitBlobFile is visit for a page of the blob file, page 0 is its header
+func (c *checker) visitBlobFile(pageNum uint64, owner string) bool {
+	local := localPageNum(pageNum)
+	if local == 0 || local >= c.blobLimit {
+		c.errorf("%s references blob file page %d out of range", owner, local)
+		return false
+	}
+	if prev, ok := c.seen[pageNum]; ok {
+		c.errorf("blob file page %d is referenced by %s and %s", local, prev, owner)
+		return false
+	}
+	c.seen[pageNum] = owner
+	if c.tx.db.dal.blobs.freelist.isFree(local) {
+		c.errorf("blob file page %d of %s is on the freelist", local, owner)
+	}
+	return true
+}
+
+func (c *checker) run() {
+	meta := c.tx.db.dal.meta
+	c.visit(meta.freelistPageNumber, "freelist")
+	for _, pageNum := range c.tx.db.dal.freelist.freelistPages {
+		if pageNum != meta.freelistPageNumber {
+			c.visit(pageNum, "freelist")
+		}
+	}
+	if blobs := c.tx.db.dal.blobs; blobs != nil {
+		for _, pageNum := range blobs.freelist.freelistPages {
+			c.visit(pageNum, "blob file freelist")
+		}
+	}
+	c.checkTree(meta.root, "root tree", true)
+}
+
+// checkTree verifies the subtree at pageNum and returns its number of items, buckets found
+// in the root tree are checked recursively
+func (c *checker) checkTree(pageNum uint64, owner string, isRoot bool) uint64 {
+	if !c.visit(pageNum, owner) {
+		return 0
+	}
+	node, err := c.tx.getNode(pageNum)
+	if err != nil {
+		c.errorf("%s: %v", owner, err)
+		return 0
+	}
+	if !node.isLeaf() && len(node.childNodes) != len(node.items)+1 {
+		c.errorf("%s: node %d has %d items and %d children", owner, pageNum, len(node.items), len(node.childNodes))
+	}
+	for idx, item := range node.items {
+		if idx > 0 && bytes.Compare(node.items[idx-1].Key, item.Key) >= 0 {
+			c.errorf("%s: node %d keys are not ordered at %d", owner, pageNum, idx)
+		}
+		if len(item.Value) == 0 {
+			c.errorf("%s: node %d key %q has no value", owner, pageNum, item.Key)
+			continue
+		}
+		valueType, _ := item.valueType()
+		payload, err := item.payload()
+		if err != nil {
+			c.errorf("%s: node %d key %q: %v", owner, pageNum, item.Key, err)
+			continue
+		}
+		switch valueType {
+		case ValueSimple:
+			if isRoot {
+				bucket := newBucket(item.Key)
+				if err := bucket.deserialize(payload); err != nil {
+					c.errorf("%s: key %q: %v", owner, item.Key, err)
+					continue
+				}
+				c.checkTree(bucket.root, fmt.Sprintf("bucket %q", item.Key), false)
+			}
+		case ValueBlob:
+			c.checkBlob(binary.LittleEndian.Uint64(payload), fmt.Sprintf("%s blob %q", owner, item.Key))
+			c.checkBlobRefSize(payload, fmt.Sprintf("%s blob %q", owner, item.Key))
+		case ValueBucket:
+			bucket := newBucket(item.Key)
+			if err := bucket.deserialize(payload); err != nil {
+				c.errorf("%s: nested bucket %q: %v", owner, item.Key, err)
+				continue
+			}
+			c.checkTree(bucket.root, fmt.Sprintf("%s bucket %q", owner, item.Key), false)
+		default:
+			c.errorf("%s: node %d key %q has unknown value type %d", owner, pageNum, item.Key, valueType)
+			continue
+		}
+		c.checkValueChecksum(item, owner)
+	}
+	count := uint64(len(node.items))
+	for idx, childPageNum := range node.childNodes {
+		childCount := c.checkTree(childPageNum, owner, isRoot)
+		if node.counted() && node.childCounts[idx] != childCount {
+			c.errorf("%s: node %d counts %d items below child %d, it has %d", owner, pageNum,
+				node.childCounts[idx], idx, childCount)
+		}
+		count += childCount
+	}
+	return count
+}
+
+// checkValueChecksum compares a stored value checksum with the value, a blob is read whole
+func (c *checker) checkValueChecksum(item *Item, owner string) {
+	checksum, ok := item.checksum()
+	if !ok {
+		return
+	}
+	valueType, _ := item.valueType()
+	payload, _ := item.payload()
+	value := payload
+	if valueType == ValueBlob {
+		blob, err := GetBlob(c.tx, binary.LittleEndian.Uint64(payload))
+		if err != nil {
+			return // the chain is reported by checkBlob
+		}
+		value = blob.data
+	}
+	if actual := ValueChecksum(value); actual != checksum {
+		c.errorf("%s: key %q: %v: stored %016x, value %016x", owner, item.Key, ErrChecksumMismatch, checksum, actual)
+	}
+}
+
+// checkBlobRefSize compares the size stored in a blob reference with the size of the blob
+func (c *checker) checkBlobRefSize(payload []byte, owner string) {
+	size, ok := blobRefDataSize(payload)
+	if !ok {
+		return
+	}
+	actual, err := getBlobSize(c.tx, binary.LittleEndian.Uint64(payload))
+	if err != nil {
+		return // the chain is reported by checkBlob
+	}
+	if size != actual {
+		c.errorf("%s: reference holds %d bytes, the blob %d", owner, size, actual)
+	}
+}
+
+func (c *checker) checkBlob(startPageNum uint64, owner string) {
+	pageNum := startPageNum
+	if !c.visit(pageNum, owner) {
+		return
+	}
+	page, err := c.tx.getPage(pageNum)
+	if err != nil {
+		c.errorf("%s: %v", owner, err)
+		return
+	}
+	pageCount := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageTotalPagesOffset:]))
+	dataLen := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageDataSizeOffset:]))
+	if pageCount != calcPageCount(dataLen) {
+		c.errorf("%s: %d pages for %d bytes", owner, pageCount, dataLen)
+	}
+	nextPageNum := binary.LittleEndian.Uint64(page.Data[blobFirstPageNextPageOffset:])
+	for pageIdx := 0; ; pageIdx++ {
+		if page.Data[blobExtraPageTypeOffset] != BlobPage {
+			c.errorf("%s: page %d is not a blob page", owner, pageNum)
+		}
+		if pageIdx == pageCount-1 {
+			if nextPageNum != 0 {
+				c.errorf("%s: last page %d links to page %d", owner, pageNum, nextPageNum)
+			}
+			return
+		}
+		if nextPageNum == 0 {
+			c.errorf("%s: chain ends after %d of %d pages", owner, pageIdx+1, pageCount)
+			return
+		}
+		pageNum = nextPageNum
+		if !c.visit(pageNum, owner) {
+			return
+		}
+		if page, err = c.tx.getPage(pageNum); err != nil {
+			c.errorf("%s: %v", owner, err)
+			return
+		}
+		nextPageNum = binary.LittleEndian.Uint64(page.Data[blobExtraPageNextPageOffset:])
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Check())
+
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 200; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("id_%03d", i)), []byte(randSeq(100))); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("blob"), bytes.Repeat([]byte("x"), 3*BTreePageSize))
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Check())
+
+	// a page in use handed back to the freelist would be allocated twice
+	var root uint64
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		root = bucket.root
+		return nil
+	})
+	require.NoError(t, err)
+	db.dal.freelist.ReleasePage(root)
+	err = db.Check()
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.Contains(t, err.Error(), fmt.Sprintf("page %d of bucket \"users\" is on the freelist", root))
+}
+
+// TestCheckUndecodableNode overwrites a bucket root with bytes that do not decode, Check
+// reports the page instead of panicking
+func TestCheckUndecodableNode(t *testing.T) {
+	db, filename := createTestDB(t)
+	require.NoError(t, db.Put([]byte("users"), []byte("id_1"), []byte("v")))
+	var root uint64
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		root = bucket.root
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt(bytes.Repeat([]byte{0xff}, BTreePageSize), int64(root*BTreePageSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+	// without recovery the tx log does not put the page back
+	db = openTestDB(t, filename, DefaultOptions().WithRecovery(false))
+	err = db.Check()
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.Contains(t, err.Error(), "bucket \"users\"")
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// go test ./storage -run=None -bench=Commit -count=5 -commit-bench-out=commit.json
+var commitBenchOut = flag.String("commit-bench-out", "", "write BenchmarkCommit results as JSON to the file")
+
+// commitBenchResult is one BenchmarkCommit run, results of all runs are written as a JSON array
+type commitBenchResult struct {
+	Name            string  `json:"name"`
+	DirtyPages      int     `json:"dirty_pages"`
+	Values          string  `json:"values"`
+	Recovery        bool    `json:"recovery"`
+	Commits         int     `json:"commits"`
+	NsPerCommit     float64 `json:"ns_per_commit"`
+	PagesPerSec     float64 `json:"pages_per_sec"`
+	PagesPerCommit  float64 `json:"pages_per_commit"`
+	TxLogPagesPer   float64 `json:"txlog_pages_per_commit"`
+	FsyncsPerCommit float64 `json:"fsyncs_per_commit"`
+	WritesPerCommit float64 `json:"write_calls_per_commit"`
+}
+
+// commitBenchResults collects runs of all -count iterations
+var commitBenchResults []commitBenchResult
+
+// writeCommitBenchResults appends the runs of one BenchmarkCommit call and rewrites the file
+func writeCommitBenchResults(b *testing.B, runs []commitBenchResult) {
+	commitBenchResults = append(commitBenchResults, runs...)
+	if *commitBenchOut == "" {
+		return
+	}
+	data, err := json.MarshalIndent(commitBenchResults, "", "  ")
+	require.NoError(b, err)
+	require.NoError(b, os.WriteFile(*commitBenchOut, data, 0644))
+}
+
+const (
+	commitBenchKeys    = 64_000
+	commitBenchSpacing = 64 // more than items per leaf, so every updated key is in another leaf
+)
+
+var commitBenchInline = bytes.Repeat([]byte("v"), 100)
+
+// commitBenchDB prepares a bucket with enough leaves to dirty 1000 of them in one commit
+func commitBenchDB(b *testing.B, recovery bool) *DB {
+	filename := TempFileName(".db")
+	db, err := Open(filename, DefaultOptions().WithRecovery(recovery))
+	require.NoError(b, err)
+	b.Cleanup(func() {
+		_ = db.Close()
+		_ = os.Remove(filename)
+		_ = os.Remove(db.dal.opts.TxLogPath)
+	})
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < commitBenchKeys; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("%016d", i)), commitBenchInline); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(b, err)
+	return db
+}
+
+// commitWorkload dirties about dirtyPages pages: inline values update keys in distinct
+// leaves, blob values rewrite blobs of four pages each
+func commitWorkload(dirtyPages int, blobs bool, round int) func(tx *Tx) error {
+	blob := bytes.Repeat([]byte{byte(round)}, 3*BTreePageSize)
+	return func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("bench"))
+		if err != nil {
+			return err
+		}
+		if blobs {
+			for i := 0; i < max(1, dirtyPages/calcPageCount(len(blob))); i++ {
+				if err = bucket.Put([]byte(fmt.Sprintf("blob-%04d", i)), blob); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		value := append(commitBenchInline[:99:99], byte(round))
+		for i := 0; i < dirtyPages; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("%016d", i*commitBenchSpacing)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// BenchmarkCommit measures commit cost by dirty page count, value kind and recovery.
+// Pass -commit-bench-out to get the results as JSON for diffing runs.
+func BenchmarkCommit(b *testing.B) {
+	// every sub-benchmark runs with growing b.N, only the last run of each is kept
+	var runs []commitBenchResult
+	runIdx := make(map[string]int)
+	b.Cleanup(func() { writeCommitBenchResults(b, runs) })
+	for _, recovery := range []bool{true, false} {
+		for _, values := range []string{"inline", "blob"} {
+			for _, dirtyPages := range []int{1, 10, 100, 1000} {
+				name := fmt.Sprintf("pages=%d/values=%s/recovery=%t", dirtyPages, values, recovery)
+				b.Run(name, func(b *testing.B) {
+					db := commitBenchDB(b, recovery)
+					b.ResetTimer()
+					before := db.CommitStats()
+					started := time.Now()
+					for i := 0; i < b.N; i++ {
+						if err := db.Update(commitWorkload(dirtyPages, values == "blob", i)); err != nil {
+							b.Fatal(err)
+						}
+					}
+					elapsed := time.Since(started)
+					b.StopTimer()
+
+					stats := db.CommitStats().Sub(before)
+					commits := float64(stats.Commits)
+					result := commitBenchResult{
+						Name:            b.Name(),
+						DirtyPages:      dirtyPages,
+						Values:          values,
+						Recovery:        recovery,
+						Commits:         int(stats.Commits),
+						NsPerCommit:     float64(elapsed.Nanoseconds()) / commits,
+						PagesPerSec:     float64(stats.PagesWritten) / elapsed.Seconds(),
+						PagesPerCommit:  float64(stats.PagesWritten) / commits,
+						TxLogPagesPer:   float64(stats.TxLogPages) / commits,
+						FsyncsPerCommit: float64(stats.Fsyncs) / commits,
+						WritesPerCommit: float64(stats.WriteCalls) / commits,
+					}
+					b.ReportMetric(result.PagesPerSec, "pages/sec")
+					b.ReportMetric(result.PagesPerCommit, "pages/commit")
+					b.ReportMetric(result.FsyncsPerCommit, "fsyncs/commit")
+					b.ReportMetric(result.WritesPerCommit, "writes/commit")
+
+					if idx, ok := runIdx[result.Name]; ok {
+						runs[idx] = result
+					} else {
+						runIdx[result.Name] = len(runs)
+						runs = append(runs, result)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestCommitStats(t *testing.T) {
+	db, _ := createTestDB(t)
+	before := db.CommitStats()
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	})
+	require.NoError(t, err)
+
+	stats := db.CommitStats().Sub(before)
+	require.Equal(t, uint64(1), stats.Commits)
+	// every page goes to the tx log first and then to the database file
+	require.Equal(t, stats.TxLogPages, stats.PagesWritten)
+	require.GreaterOrEqual(t, stats.PagesWritten, uint64(3)) // node, freelist and meta
+	require.Equal(t, uint64(2), stats.Fsyncs)                // tx log and database file
+	require.Positive(t, stats.CommitTime)
+	require.Equal(t, stats.Commits, db.Stat().Commit.Sub(before).Commits)
+
+	// failed reads and rollbacks are not commits
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	tx.Rollback()
+	require.Equal(t, uint64(1), db.CommitStats().Sub(before).Commits)
+}
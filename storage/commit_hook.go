@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"bytes"
+	"slices"
+	"sync"
+)
+
+// maxTrackedKeys bounds the keys a commit event lists per bucket, a transaction changing
+// more keys reports the bucket as changed as a whole
+const maxTrackedKeys = 10000
+
+// CommitEvent tells commit hooks what a write transaction changed. A key is listed once,
+// whether it was put or removed, and may not differ from its value before the transaction.
+// Removed lists the keys of Keys removed last, a removal of a missing key included.
+type CommitEvent struct {
+	Keys    map[string][][]byte // changed keys by bucket name
+	Removed map[string][][]byte // keys of Keys removed by the transaction by bucket name
+	Buckets []string            // buckets whose keys may all have changed, their keys are not listed
+}
+
+// Changed reports whether the commit may have changed the key of the bucket
+func (event *CommitEvent) Changed(bucket string, key []byte) bool {
+	if slices.Contains(event.Buckets, bucket) {
+		return true
+	}
+	return slices.ContainsFunc(event.Keys[bucket], func(changed []byte) bool {
+		return string(changed) == string(key)
+	})
+}
+
+// CommitHook is called after a write transaction committed, before its write lock is
+// released, so no transaction sees the commit before its hooks returned. A hook must be
+// quick and must not begin a transaction.
+type CommitHook func(event *CommitEvent)
+
+// commitHooks holds the hooks of a database, they are not persisted
+type commitHooks struct {
+	lock  sync.RWMutex
+	hooks []CommitHook
+}
+
+// OnCommit registers hook for the write transactions started after the call, transactions
+// without changes to a bucket do not call it. Changes to the root bucket of bucket values
+// and the bucket events are not reported, deleting a bucket reports the bucket.
+func (db *DB) OnCommit(hook CommitHook) {
+	db.hooks.lock.Lock()
+	defer db.hooks.lock.Unlock()
+	db.hooks.hooks = append(db.hooks.hooks, hook)
+}
+
+func (db *DB) getCommitHooks() []CommitHook {
+	db.hooks.lock.RLock()
+	defer db.hooks.lock.RUnlock()
+	return db.hooks.hooks
+}
+
+// changeSet collects the changes of a write transaction for its commit hooks
+type changeSet struct {
+	hooks   []CommitHook
+	keys    map[string]map[string]bool // changed keys by bucket, true for a removed key
+	buckets map[string]struct{}
+}
+
+func newChangeSet(hooks []CommitHook) *changeSet {
+	if len(hooks) == 0 {
+		return nil
+	}
+	return &changeSet{
+		hooks:   hooks,
+		keys:    make(map[string]map[string]bool),
+		buckets: make(map[string]struct{}),
+	}
+}
+
+// recordKey notes a key put or removed, the root bucket and the events bucket are skipped
+func (tx *Tx) recordKey(bucket []byte, key []byte, removed bool) {
+	changes := tx.changes
+	if changes == nil || len(bucket) == 0 || bytes.Equal(bucket, eventsBucketName) {
+		return
+	}
+	name := string(bucket)
+	if _, whole := changes.buckets[name]; whole {
+		return
+	}
+	keys := changes.keys[name]
+	if keys == nil {
+		keys = make(map[string]bool)
+		changes.keys[name] = keys
+	}
+	if _, found := keys[string(key)]; !found && len(keys) >= maxTrackedKeys {
+		tx.recordBucket(bucket)
+		return
+	}
+	keys[string(key)] = removed
+}
+
+// recordBucket notes a change to any key of the bucket
+func (tx *Tx) recordBucket(bucket []byte) {
+	changes := tx.changes
+	if changes == nil || len(bucket) == 0 || bytes.Equal(bucket, eventsBucketName) {
+		return
+	}
+	delete(changes.keys, string(bucket))
+	changes.buckets[string(bucket)] = struct{}{}
+}
+
+// runCommitHooks calls the hooks with the changes of the committed transaction
+func (tx *Tx) runCommitHooks() {
+	changes := tx.changes
+	tx.changes = nil
+	if changes == nil || len(changes.keys)+len(changes.buckets) == 0 {
+		return
+	}
+	event := &CommitEvent{
+		Keys:    make(map[string][][]byte, len(changes.keys)),
+		Removed: make(map[string][][]byte),
+	}
+	for name, keys := range changes.keys {
+		list := make([][]byte, 0, len(keys))
+		for key, removed := range keys {
+			list = append(list, []byte(key))
+			if removed {
+				event.Removed[name] = append(event.Removed[name], []byte(key))
+			}
+		}
+		event.Keys[name] = list
+	}
+	for name := range changes.buckets {
+		event.Buckets = append(event.Buckets, name)
+	}
+	slices.Sort(event.Buckets)
+	for _, hook := range changes.hooks {
+		hook(event)
+	}
+}
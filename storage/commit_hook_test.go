@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommitHook(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, putKey(db, "before"))
+	var events []*CommitEvent
+	db.OnCommit(func(event *CommitEvent) {
+		events = append(events, event)
+	})
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("a"), []byte("1")); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("a"), []byte("2")); err != nil {
+			return err
+		}
+		// a removed key put again is not reported as removed
+		if err = bucket.Remove([]byte("a")); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("a"), []byte("3")); err != nil {
+			return err
+		}
+		require.ErrorIs(t, bucket.Remove([]byte("missing")), ErrNodeNotFound)
+		return bucket.Remove([]byte("before"))
+	}))
+	require.Len(t, events, 1)
+	require.ElementsMatch(t, [][]byte{[]byte("a"), []byte("before"), []byte("missing")}, events[0].Keys["foo"])
+	require.ElementsMatch(t, [][]byte{[]byte("before"), []byte("missing")}, events[0].Removed["foo"])
+	require.Empty(t, events[0].Buckets)
+	require.True(t, events[0].Changed("foo", []byte("a")))
+	require.False(t, events[0].Changed("foo", []byte("b")))
+	require.False(t, events[0].Changed("bar", []byte("a")))
+
+	// rolled back and unchanged transactions do not call the hooks
+	require.Error(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("b"), []byte("1")); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("empty"))
+		return err
+	}))
+	require.Len(t, events, 1)
+
+	// expiry rules, deleted buckets and large transactions report whole buckets
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.SetPrefixTTL([]byte("a"), time.Now().Add(time.Hour)); err != nil {
+			return err
+		}
+		if err = bucket.Put([]byte("c"), []byte("1")); err != nil {
+			return err
+		}
+		if err = tx.DeleteBucket([]byte("empty")); err != nil {
+			return err
+		}
+		large, err := tx.CreateBucket([]byte("large"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i <= maxTrackedKeys; i++ {
+			if err = large.Put([]byte(fmt.Sprintf("key_%06d", i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Len(t, events, 2)
+	require.Equal(t, []string{"empty", "foo", "large"}, events[1].Buckets)
+	require.Empty(t, events[1].Keys)
+	require.True(t, events[1].Changed("large", []byte("any")))
+}
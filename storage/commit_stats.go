@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// CommitStats are cumulative counters of the commit pipeline since the database was opened
+type CommitStats struct {
+	Commits      uint64        // committed write transactions
+	PagesWritten uint64        // pages written to the database file, meta and freelist included
+	TxLogPages   uint64        // pages written to the tx log
+	Fsyncs       uint64        // fsyncs of the database file and the tx log
+	WriteCalls   uint64        // write syscalls to the database file and the tx log, adjacent pages share one
+	DirtyPages   uint64        // nodes and pages changed by committed transactions, meta and freelist excluded
+	TinyCommits  uint64        // commits that changed fewer than Options.AdvisorTinyPages pages
+	CommitTime   time.Duration // total time spent in Commit
+}
+
+// Sub returns the counters accumulated since prev was taken
+func (s CommitStats) Sub(prev CommitStats) CommitStats {
+	return CommitStats{
+		Commits:      s.Commits - prev.Commits,
+		PagesWritten: s.PagesWritten - prev.PagesWritten,
+		TxLogPages:   s.TxLogPages - prev.TxLogPages,
+		Fsyncs:       s.Fsyncs - prev.Fsyncs,
+		WriteCalls:   s.WriteCalls - prev.WriteCalls,
+		DirtyPages:   s.DirtyPages - prev.DirtyPages,
+		TinyCommits:  s.TinyCommits - prev.TinyCommits,
+		CommitTime:   s.CommitTime - prev.CommitTime,
+	}
+}
+
+type commitCounters struct {
+	commits      atomic.Uint64
+	pagesWritten atomic.Uint64
+	txLogPages   atomic.Uint64
+	fsyncs       atomic.Uint64
+	writes       atomic.Uint64 // write calls to the database file
+	dirtyPages   atomic.Uint64
+	tinyCommits  atomic.Uint64
+	commitNanos  atomic.Int64
+}
+
+// CommitStats returns the commit pipeline counters
+func (db *DB) CommitStats() CommitStats {
+	counters := &db.dal.stats
+	return CommitStats{
+		Commits:      counters.commits.Load(),
+		PagesWritten: counters.pagesWritten.Load(),
+		TxLogPages:   counters.txLogPages.Load(),
+		Fsyncs:       counters.fsyncs.Load() + db.dal.txLog.syncs.Load(),
+		WriteCalls:   counters.writes.Load() + db.dal.txLog.writes.Load(),
+		DirtyPages:   counters.dirtyPages.Load(),
+		TinyCommits:  counters.tinyCommits.Load(),
+		CommitTime:   time.Duration(counters.commitNanos.Load()),
+	}
+}
+
+// pageCounters hold the page usage as of the last commit. Stat reads them without the lock,
+// the freelist itself changes under a running write transaction.
+type pageCounters struct {
+	totalPages    atomic.Uint64
+	freePages     atomic.Uint64
+	usedPages     atomic.Uint64
+	releasedPages atomic.Uint64
+	freelistPages atomic.Uint64
+	freelistRuns  atomic.Uint64
+	lastCommit    atomic.Int64 // unix nanoseconds
+	lastCommitDur atomic.Int64
+}
+
+// publishPages stores the page usage of the freelist, called at open and after every commit
+// while the freelist can't change
+func (dal *Dal) publishPages() {
+	freelist := dal.freelist
+	freelistPages := uint64(len(freelist.freelistPages))
+	dal.usage.totalPages.Store(freelist.maxPages)
+	dal.usage.freePages.Store(freelist.maxPages - freelist.currentPage + freelist.releasedN)
+	dal.usage.usedPages.Store(freelist.currentPage + freelistPages)
+	dal.usage.releasedPages.Store(freelist.releasedN)
+	dal.usage.freelistPages.Store(freelistPages)
+	dal.usage.freelistRuns.Store(uint64(len(freelist.released)))
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// compactMinBreakRatio is the share of non-adjacent links in a blob chain above which
+// CompactBlobs rewrites it, a large blob split in a few long runs reads fast enough
+const compactMinBreakRatio = 0.125
+
+// CompactReport describes the work done by one CompactBlobs call
+type CompactReport struct {
+	ChainsScanned   int
+	ChainsRewritten int
+	PagesFreed      int
+	BytesMoved      int64
+	// Complete is false when maxBytes stopped the call before the end of the bucket,
+	// calling it again continues with the chains still fragmented
+	Complete bool
+}
+
+// fragmentedBlob is a blob chain found by CompactBlobs
+type fragmentedBlob struct {
+	item  *Item
+	pages []uint64
+	size  int
+}
+
+// CompactBlobs rewrites blob chains scattered across the file into runs of adjacent pages,
+// the old chains are freed on commit. A call stops once maxBytes of values were moved,
+// zero or less means no limit. The bucket must belong to tx, a write transaction.
+func (bucket *Bucket) CompactBlobs(tx *Tx, maxBytes int64) (CompactReport, error) {
+	var report CompactReport
+	if tx == nil || bucket.tx != tx {
+		return report, ErrTxClosed
+	}
+	if !tx.write {
+		return report, ErrWriteInRxTransaction
+	}
+	if bucket.root == 0 {
+		report.Complete = true
+		return report, nil
+	}
+	root, err := tx.getNode(bucket.root)
+	if err != nil {
+		return report, err
+	}
+	// the chains are collected first, rewriting an item changes the node being walked
+	var blobs []fragmentedBlob
+	if err = collectFragmentedBlobs(tx, root, &blobs, &report); err != nil {
+		return report, err
+	}
+
+	report.Complete = true
+	for _, blob := range blobs {
+		if maxBytes > 0 && report.BytesMoved >= maxBytes {
+			report.Complete = false
+			break
+		}
+		if err = bucket.rewriteBlob(blob); err != nil {
+			return report, err
+		}
+		report.ChainsRewritten++
+		report.PagesFreed += len(blob.pages)
+		report.BytesMoved += int64(blob.size)
+	}
+	if report.ChainsRewritten > 0 {
+		logger.Info("compacted blobs", "bucket", string(bucket.name),
+			"chains", report.ChainsRewritten, "pages", report.PagesFreed, "bytes", report.BytesMoved)
+	}
+	return report, nil
+}
+
+// collectFragmentedBlobs appends the blob chains of the subtree rooted at node that are
+// worth rewriting, in key order
+func collectFragmentedBlobs(tx *Tx, node *BNode, blobs *[]fragmentedBlob, report *CompactReport) error {
+	for i, item := range node.items {
+		if !node.isLeaf() {
+			if err := collectFragmentedChild(tx, node.childNodes[i], blobs, report); err != nil {
+				return err
+			}
+		}
+		if valueType, err := item.valueType(); err != nil || valueType != ValueBlob {
+			continue
+		}
+		payload, err := item.payload()
+		if err != nil {
+			return err
+		}
+		pages, size, err := blobChainPages(tx, binary.LittleEndian.Uint64(payload))
+		if err != nil {
+			return tx.keyError(item.Key, err)
+		}
+		report.ChainsScanned++
+		if chainFragmented(pages) {
+			*blobs = append(*blobs, fragmentedBlob{item: item, pages: pages, size: size})
+		}
+	}
+	if !node.isLeaf() {
+		return collectFragmentedChild(tx, node.childNodes[len(node.items)], blobs, report)
+	}
+	return nil
+}
+
+func collectFragmentedChild(tx *Tx, pageNum uint64, blobs *[]fragmentedBlob, report *CompactReport) error {
+	child, err := tx.getNode(pageNum)
+	if err != nil {
+		return err
+	}
+	return collectFragmentedBlobs(tx, child, blobs, report)
+}
+
+// blobChainPages returns the pages of the blob chain starting at startPageNum in chain
+// order and the size of the value
+func blobChainPages(tx *Tx, startPageNum uint64) ([]uint64, int, error) {
+	page, err := tx.getPage(startPageNum)
+	if err != nil {
+		return nil, 0, err
+	}
+	if page.Data[blobFirstPageTypeOffset] != BlobPage {
+		return nil, 0, fmt.Errorf("%w: page %d is not a blob page", ErrCorrupted, startPageNum)
+	}
+	pageCount := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageTotalPagesOffset:]))
+	size := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageDataSizeOffset:]))
+	pages := make([]uint64, 0, pageCount)
+	nextPageNum := binary.LittleEndian.Uint64(page.Data[blobFirstPageNextPageOffset:])
+	pages = append(pages, startPageNum)
+	for len(pages) < pageCount {
+		if page, err = tx.getPage(nextPageNum); err != nil {
+			return nil, 0, err
+		}
+		if page.Data[blobExtraPageTypeOffset] != BlobPage {
+			return nil, 0, fmt.Errorf("%w: page %d of blob at page %d is not a blob page", ErrCorrupted, nextPageNum, startPageNum)
+		}
+		pages = append(pages, nextPageNum)
+		nextPageNum = binary.LittleEndian.Uint64(page.Data[blobExtraPageNextPageOffset:])
+	}
+	return pages, size, nil
+}
+
+// chainFragmented reports whether more than compactMinBreakRatio of the links of a chain
+// point elsewhere than the next page
+func chainFragmented(pages []uint64) bool {
+	if len(pages) < 2 {
+		return false
+	}
+	breaks := 0
+	for i := 1; i < len(pages); i++ {
+		if pages[i] != pages[i-1]+1 {
+			breaks++
+		}
+	}
+	return float64(breaks)/float64(len(pages)-1) > compactMinBreakRatio
+}
+
+// rewriteBlob copies the chain into adjacent pages, points the item at the copy and frees
+// the old pages, the value header with its checksum is kept
+func (bucket *Bucket) rewriteBlob(blob fragmentedBlob) error {
+	tx := bucket.tx
+	pages, err := allocateBlobPages(tx, len(blob.pages), bucket.inBlobFile(), true)
+	if err != nil {
+		return err
+	}
+	for i, page := range pages {
+		old, err := tx.getPage(blob.pages[i])
+		if err != nil {
+			return err
+		}
+		copy(page.Data, old.Data)
+		var nextPageNum uint64
+		if i < len(pages)-1 {
+			nextPageNum = pages[i+1].PageNumber
+		}
+		offset := blobExtraPageNextPageOffset
+		if i == 0 {
+			offset = blobFirstPageNextPageOffset
+		}
+		binary.LittleEndian.PutUint64(page.Data[offset:], nextPageNum)
+		tx.setPage(page)
+	}
+	// putItem releases the old chain with the reference it replaces
+	checksum, withChecksum := blob.item.checksum()
+	item := &Item{Key: blob.item.Key, Value: blobValueRef(pages[0].PageNumber, blob.size, withChecksum, checksum)}
+	return bucket.putItem(item, blob.size)
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// blobPages returns the pages of the blob chain of the key
+func blobPages(t *testing.T, tx *Tx, bucket *Bucket, key string) []uint64 {
+	t.Helper()
+	item, err := bucket.findItem([]byte(key))
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	payload, err := item.payload()
+	require.NoError(t, err)
+	pages, _, err := blobChainPages(tx, binary.LittleEndian.Uint64(payload))
+	require.NoError(t, err)
+	return pages
+}
+
+func TestCompactBlobs(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithValueChecksums(true, true)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	db := openTestDB(t, filename, opts)
+	name := []byte("blobs")
+	small := bytes.Repeat([]byte("s"), 2*MaxValueSize)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 40; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("small-%02d", i)), small); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	// every other page is freed, the next blobs are written into the holes
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 40; i += 2 {
+			if err = bucket.Remove([]byte(fmt.Sprintf("small-%02d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	values := map[string][]byte{}
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"big-1", "big-2"} {
+			values[key] = bytes.Repeat([]byte(key), 2*BTreePageSize)
+			if err = bucket.Put([]byte(key), values[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		require.NoError(t, err)
+		require.True(t, chainFragmented(blobPages(t, tx, bucket, "big-1")))
+		require.True(t, chainFragmented(blobPages(t, tx, bucket, "big-2")))
+		return nil
+	}))
+
+	pageCount := calcPageCount(len(values["big-1"]))
+	freeBefore := db.dal.freelist.releasedN
+	var reports []CompactReport
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return err
+		}
+		_, err = bucket.CompactBlobs(nil, 0)
+		require.ErrorIs(t, err, ErrTxClosed)
+		// one byte stops the call after the first chain
+		for _, maxBytes := range []int64{1, 0, 0} {
+			report, err := bucket.CompactBlobs(tx, maxBytes)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, report)
+		}
+		return nil
+	}))
+	require.Equal(t, []CompactReport{
+		{ChainsScanned: 22, ChainsRewritten: 1, PagesFreed: pageCount, BytesMoved: int64(len(values["big-1"]))},
+		{ChainsScanned: 22, ChainsRewritten: 1, PagesFreed: pageCount, BytesMoved: int64(len(values["big-2"])), Complete: true},
+		{ChainsScanned: 22, Complete: true},
+	}, reports)
+	require.EqualValues(t, freeBefore+2*uint64(pageCount), db.dal.freelist.releasedN)
+
+	closeTestDB(t, db)
+	db = openTestDB(t, filename, opts)
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		require.NoError(t, err)
+		for key, value := range values {
+			pages := blobPages(t, tx, bucket, key)
+			require.Len(t, pages, pageCount)
+			require.EqualValues(t, pages[0]+uint64(pageCount-1), pages[pageCount-1], "the chain is contiguous")
+			require.False(t, chainFragmented(pages))
+			got, found, err := bucket.Lookup([]byte(key))
+			require.NoError(t, err)
+			require.True(t, found)
+			require.Equal(t, value, got)
+			checksum, ok, err := bucket.Checksum([]byte(key))
+			require.NoError(t, err)
+			require.True(t, ok)
+			require.Equal(t, ValueChecksum(value), checksum)
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		require.NoError(t, err)
+		_, err = bucket.CompactBlobs(tx, 0)
+		require.ErrorIs(t, err, ErrWriteInRxTransaction)
+		return nil
+	}))
+}
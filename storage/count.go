@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Internal nodes store the item count of every child subtree, so counting a key range reads
+// the two paths to its ends and sums the counts of the subtrees in between. Keys hidden by
+// expired prefix rules are counted until they are removed, like in the bucket stats.
+
+// CountRange returns the number of keys in [start, end) without reading any value, a nil
+// start counts from the first key and a nil end up to the last one
+func (bucket *Bucket) CountRange(start, end []byte) (uint64, error) {
+	if bucket.tx == nil {
+		return 0, ErrTxClosed
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return 0, err
+	}
+	defer bucket.tx.leave()
+	if bucket.root == 0 || end != nil && bytes.Compare(start, end) >= 0 {
+		return 0, nil
+	}
+	return countRange(bucket.tx, bucket.root, start, end)
+}
+
+// Rank returns the number of keys before the key, its position if it exists
+func (bucket *Bucket) Rank(key []byte) (uint64, error) {
+	if key == nil {
+		return 0, nil
+	}
+	return bucket.CountRange(nil, key)
+}
+
+// CountPrefix returns the number of keys starting with the prefix
+func (bucket *Bucket) CountPrefix(prefix []byte) (uint64, error) {
+	if len(prefix) == 0 {
+		return bucket.CountRange(nil, nil)
+	}
+	return bucket.CountRange(prefix, prefixEnd(prefix))
+}
+
+// KeyAt returns the key at position index in key order, false if the bucket has no more keys.
+// It is the inverse of Rank, see Cursor.SeekToIndex to iterate from the position.
+func (bucket *Bucket) KeyAt(index uint64) ([]byte, bool, error) {
+	if bucket.tx == nil {
+		return nil, false, ErrTxClosed
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return nil, false, err
+	}
+	defer bucket.tx.leave()
+	if bucket.root == 0 {
+		return nil, false, nil
+	}
+	root, err := bucket.tx.getNode(bucket.root)
+	if err != nil {
+		return nil, false, err
+	}
+	var stack []cursorFrame
+	pos, node, err := traverseToIndex(bucket.tx, root, index, &stack)
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return bytes.Clone(node.items[pos].Key), true, nil
+}
+
+// countRange counts the keys of the subtree at pageNum in [start, end), children entirely
+// inside the range are taken from the counts, only the children holding a bound are read
+func countRange(tx *Tx, pageNum uint64, start, end []byte) (uint64, error) {
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	// items lo..hi-1 are in the range, so are children lo+1..hi-1
+	lo, hi := 0, len(node.items)
+	if start != nil {
+		lo, _ = node.findKeyPosition(start)
+	}
+	if end != nil {
+		hi, _ = node.findKeyPosition(end)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	count := uint64(hi - lo)
+	if node.isLeaf() {
+		return count, nil
+	}
+	for i := lo + 1; i < hi; i++ {
+		childCount, err := childCount(tx, node, i)
+		if err != nil {
+			return 0, err
+		}
+		count += childCount
+	}
+	edges := []int{lo}
+	if hi != lo {
+		edges = append(edges, hi)
+	}
+	for _, i := range edges {
+		childCount, err := countRange(tx, node.childNodes[i], start, end)
+		if err != nil {
+			return 0, err
+		}
+		count += childCount
+	}
+	return count, nil
+}
+
+// childCount returns the number of items below child i, a node written without counts has
+// the subtree walked
+func childCount(tx *Tx, node *BNode, i int) (uint64, error) {
+	if node.counted() {
+		return node.childCounts[i], nil
+	}
+	return countSubtree(tx, node.childNodes[i])
+}
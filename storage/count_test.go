@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countKeys returns the number of model keys in [start, end)
+func countKeys(keys []string, start, end string) uint64 {
+	lo := sort.SearchStrings(keys, start)
+	hi := len(keys)
+	if end != "" {
+		hi = sort.SearchStrings(keys, end)
+	}
+	if hi < lo {
+		return 0
+	}
+	return uint64(hi - lo)
+}
+
+func TestCountRange(t *testing.T) {
+	db, _ := createTestDB(t)
+	rnd := rand.New(rand.NewSource(1))
+	model := make(map[string]bool)
+	value := make([]byte, 40)
+
+	for round := 0; round < 6; round++ {
+		// inserts split nodes, the removals of the later rounds rotate and merge them
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("counted"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1500; i++ {
+				key := fmt.Sprintf("key_%05d", rnd.Intn(6000))
+				if round >= 3 && rnd.Intn(3) > 0 {
+					err = bucket.Remove([]byte(key))
+					if err == nil {
+						delete(model, key)
+					} else if !errors.Is(err, ErrNodeNotFound) {
+						return err
+					}
+					continue
+				}
+				if err = bucket.Put([]byte(key), value); err != nil {
+					return err
+				}
+				model[key] = true
+			}
+			return nil
+		}))
+		require.NoError(t, db.Check(), "round %d", round)
+
+		keys := make([]string, 0, len(model))
+		for key := range model {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		require.NoError(t, db.View(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("counted"))
+			require.NoError(t, err)
+			total, err := bucket.CountRange(nil, nil)
+			require.NoError(t, err)
+			require.EqualValues(t, len(keys), total)
+			for i := 0; i < 50; i++ {
+				start := fmt.Sprintf("key_%05d", rnd.Intn(6000))
+				end := fmt.Sprintf("key_%05d", rnd.Intn(6000))
+				count, err := bucket.CountRange([]byte(start), []byte(end))
+				require.NoError(t, err)
+				require.Equal(t, countKeys(keys, start, end), count, "[%s, %s)", start, end)
+
+				rank, err := bucket.Rank([]byte(start))
+				require.NoError(t, err)
+				require.Equal(t, countKeys(keys, "", start), rank, start)
+				if len(keys) == 0 {
+					continue
+				}
+				index := rnd.Intn(len(keys))
+				key, found, err := bucket.KeyAt(uint64(index))
+				require.NoError(t, err)
+				require.True(t, found)
+				require.Equal(t, keys[index], string(key), "index %d", index)
+			}
+			_, found, err := bucket.KeyAt(uint64(len(keys)))
+			require.NoError(t, err)
+			require.False(t, found)
+			return nil
+		}))
+	}
+}
+
+func TestCountRangeEmpty(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("empty"))
+		require.NoError(t, err)
+		count, err := bucket.CountRange(nil, nil)
+		require.NoError(t, err)
+		require.Zero(t, count)
+		_, found, err := bucket.KeyAt(0)
+		require.NoError(t, err)
+		require.False(t, found)
+
+		require.NoError(t, bucket.Put([]byte("b"), []byte("1")))
+		count, err = bucket.CountRange([]byte("c"), []byte("a"))
+		require.NoError(t, err)
+		require.Zero(t, count, "an empty range")
+		rank, err := bucket.Rank([]byte("c"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, rank)
+		return nil
+	}))
+}
+
+func TestCheckChildCounts(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("counted"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 500; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%04d", i)), make([]byte, 40)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Check())
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("counted"))
+		if err != nil {
+			return err
+		}
+		root, err := tx.getNode(bucket.root)
+		if err != nil {
+			return err
+		}
+		require.True(t, root.counted())
+		root.childCounts[0]++
+		tx.setNode(root)
+		return nil
+	}))
+	require.ErrorIs(t, db.Check(), ErrCorrupted)
+}
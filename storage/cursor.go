@@ -1,19 +1,29 @@
 package storage
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// cursorFrame is an ancestor of the cursor node, childIndex is the child the cursor descended into
 type cursorFrame struct {
 	childIndex int
 	pageNum    uint64
 	children   []uint64
-	itemIndex  int
 }
 
 type Cursor struct {
-	tx         *Tx
-	bucket     *Bucket
-	node       *BNode
-	itemIndex  int
-	childIndex int
-	stack      []cursorFrame
+	tx            *Tx
+	bucket        *Bucket
+	node          *BNode
+	itemIndex     int // current item of node, an internal node is left through the children around it
+	stack         []cursorFrame
+	leafCrossings int                 // leaves finished by Next in a row, other moves reset it
+	prefetched    map[uint64]struct{} // pages scheduled for read ahead and not visited yet
+	err           error               // first error that ended the iteration, see Err
+	rawValues     bool                // moves return encoded item values, blobs are not read
+	current       *Item               // item of the last key returned by a move, see ItemInfo
 }
 
 // stackPop removes and returns the last item from the stack.
@@ -48,8 +58,7 @@ func traverseToLastItem(tx *Tx, node *BNode, stack *[]cursorFrame) (*Item, *BNod
 		if err != nil {
 			return nil, nil, err
 		}
-		stackPush(stack, cursorFrame{pageNum: node.PageNum, children: node.childNodes, childIndex: len(node.childNodes) - 1,
-			itemIndex: len(node.items)})
+		stackPush(stack, cursorFrame{pageNum: node.PageNum, children: node.childNodes, childIndex: len(node.childNodes) - 1})
 		return traverseToLastItem(tx, childNode, stack)
 	}
 	if len(node.items) == 0 {
@@ -80,74 +89,268 @@ func traverseToFirstItem(tx *Tx, node *BNode, stack *[]cursorFrame) (*Item, *BNo
 	return node.items[0], node, nil
 }
 
-// traverseToItem recursively finds the given item in the B-tree
+// traverseToItem recursively finds the position of the key, or of its successor, in the B-tree.
 // It also tracks the traversal path using a stack.
-func traverseToItem(tx *Tx, node *BNode, key []byte, exact bool, stack *[]cursorFrame) (int, *BNode, bool) {
+func traverseToItem(tx *Tx, node *BNode, key []byte, stack *[]cursorFrame) (int, *BNode, error) {
 	pos, isFound := node.findKeyPosition(key)
-	if isFound {
-		return pos, node, isFound
+	if isFound || node.isLeaf() {
+		return pos, node, nil
 	}
+	*stack = append(*stack, cursorFrame{pageNum: node.PageNum, children: node.childNodes, childIndex: pos})
+	child, err := tx.getNode(node.childNodes[pos])
+	if err != nil {
+		return -1, nil, err
+	}
+	return traverseToItem(tx, child, key, stack)
+}
+
+// traverseToIndex finds the item at position index of the subtree in key order, children
+// before it are skipped by their counts. It tracks the traversal path using a stack and
+// returns ErrNodeNotFound if the subtree has no more items.
+func traverseToIndex(tx *Tx, node *BNode, index uint64, stack *[]cursorFrame) (int, *BNode, error) {
 	if node.isLeaf() {
-		if exact {
-			return -1, nil, false
+		if index >= uint64(len(node.items)) {
+			return -1, nil, ErrNodeNotFound
 		}
-		return pos, node, true
+		return int(index), node, nil
 	}
-	*stack = append(*stack, cursorFrame{pageNum: node.PageNum, children: node.childNodes, childIndex: pos, itemIndex: pos})
-	child, err := tx.getNode(node.childNodes[pos])
+	// child i is followed by item i
+	for i, childPageNum := range node.childNodes {
+		count, err := childCount(tx, node, i)
+		if err != nil {
+			return -1, nil, err
+		}
+		if index < count {
+			*stack = append(*stack, cursorFrame{pageNum: node.PageNum, children: node.childNodes, childIndex: i})
+			child, err := tx.getNode(childPageNum)
+			if err != nil {
+				return -1, nil, err
+			}
+			return traverseToIndex(tx, child, index, stack)
+		}
+		index -= count
+		if i == len(node.items) {
+			break
+		}
+		if index == 0 {
+			return i, node, nil
+		}
+		index--
+	}
+	return -1, nil, ErrNodeNotFound
+}
+
+func (cursor *Cursor) First() ([]byte, []byte) {
+	cursor.err = nil // positioning starts a new iteration
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.first()
+	return cursor.skipExpired(k, v, cursor.next)
+}
+
+func (cursor *Cursor) Last() ([]byte, []byte) {
+	cursor.err = nil // positioning starts a new iteration
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.last()
+	return cursor.skipExpired(k, v, cursor.prev)
+}
+
+func (cursor *Cursor) Seek(key []byte) ([]byte, []byte) {
+	cursor.err = nil // positioning starts a new iteration
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.seek(key)
+	return cursor.skipExpired(k, v, cursor.next)
+}
+
+// SeekToIndex moves the cursor to the key at position index in key order, as counted by
+// Bucket.Rank, and returns nil past the last key. Stored subtree counts make it O(log n),
+// subtrees of nodes written before format 0.7 are walked to count them.
+func (cursor *Cursor) SeekToIndex(index uint64) ([]byte, []byte) {
+	cursor.err = nil // positioning starts a new iteration
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.seekToIndex(index)
+	return cursor.skipExpired(k, v, cursor.next)
+}
+
+func (cursor *Cursor) Next() ([]byte, []byte) {
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.next()
+	return cursor.skipExpired(k, v, cursor.next)
+}
+
+func (cursor *Cursor) Prev() ([]byte, []byte) {
+	if err := cursor.tx.enter(); err != nil {
+		return cursor.fail(err)
+	}
+	defer cursor.tx.leave()
+	k, v := cursor.prev()
+	return cursor.skipExpired(k, v, cursor.prev)
+}
+
+// Err returns the error that ended the iteration, nil if the cursor simply ran past the
+// last key. A nil key from a move is the end of the iteration only when Err is nil.
+func (cursor *Cursor) Err() error {
+	return cursor.err
+}
+
+// ItemInfo describes the value at the cursor position without reading it, ErrKeyNotFound
+// when the last move returned no key
+func (cursor *Cursor) ItemInfo() (ItemInfo, error) {
+	if cursor.current == nil {
+		return ItemInfo{}, ErrKeyNotFound
+	}
+	if err := cursor.tx.enter(); err != nil {
+		return ItemInfo{}, err
+	}
+	defer cursor.tx.leave()
+	info, err := itemInfo(cursor.tx, cursor.current)
 	if err != nil {
-		return -1, nil, false
+		return ItemInfo{}, cursor.tx.keyError(cursor.current.Key, err)
+	}
+	return info, nil
+}
+
+// fail records the first error of the iteration and returns the end of iteration
+func (cursor *Cursor) fail(err error) ([]byte, []byte) {
+	cursor.current = nil
+	if cursor.err == nil {
+		cursor.err = err
+	}
+	return nil, nil
+}
+
+// value decodes the value of item, a failure is recorded and ends the iteration
+func (cursor *Cursor) value(item *Item) ([]byte, []byte) {
+	cursor.current = item
+	if cursor.rawValues {
+		return item.Key, item.Value
+	}
+	v, err := item.getValue(cursor.tx)
+	if err != nil {
+		return cursor.fail(err)
+	}
+	return item.Key, v
+}
+
+// skipExpired moves the cursor with move past keys hidden by the bucket prefix rules
+func (cursor *Cursor) skipExpired(k, v []byte, move func() ([]byte, []byte)) ([]byte, []byte) {
+	if len(cursor.bucket.prefixRules) > 0 {
+		now := time.Now()
+		for k != nil && cursor.bucket.expired(k, now) {
+			k, v = move()
+		}
+	}
+	if k == nil {
+		cursor.current = nil // past the last key, ItemInfo has nothing to describe
 	}
-	return traverseToItem(tx, child, key, exact, stack)
+	return k, v
 }
 
-func (cursor *Cursor) First() (key []byte, value []byte) {
-	root, _ := cursor.tx.getNode(cursor.bucket.root)
-	var pages []uint64
-	traverse(cursor.tx, root, &pages)
+func (cursor *Cursor) first() (key []byte, value []byte) {
+	cursor.leafCrossings = 0
+	cursor.stack = cursor.stack[:0] // the cursor may be positioned again
+	root, err := cursor.tx.getNode(cursor.bucket.root)
+	if err != nil {
+		return cursor.fail(err)
+	}
 	item, node, err := traverseToFirstItem(cursor.tx, root, &cursor.stack)
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil, nil // empty tree
+	}
 	if err != nil {
-		return nil, nil
+		return cursor.fail(err)
 	}
 	cursor.node = node
-	v, _ := item.getValue(cursor.tx)
-	return item.Key, v
+	cursor.itemIndex = 0
+	return cursor.value(item)
 }
 
-func (cursor *Cursor) Last() (key []byte, value []byte) {
-	root, _ := cursor.tx.getNode(cursor.bucket.root)
+func (cursor *Cursor) last() (key []byte, value []byte) {
+	cursor.leafCrossings = 0
+	cursor.stack = cursor.stack[:0] // the cursor may be positioned again
+	root, err := cursor.tx.getNode(cursor.bucket.root)
+	if err != nil {
+		return cursor.fail(err)
+	}
 	item, node, err := traverseToLastItem(cursor.tx, root, &cursor.stack)
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil, nil // empty tree
+	}
 	if err != nil {
-		return nil, nil
+		return cursor.fail(err)
 	}
 	cursor.node = node
 	cursor.itemIndex = len(cursor.node.items) - 1
-	v, _ := item.getValue(cursor.tx)
-	return item.Key, v
+	return cursor.value(item)
 }
 
-func (cursor *Cursor) Seek(key []byte) ([]byte, []byte) {
-	root, _ := cursor.tx.getNode(cursor.bucket.root)
-	pos, foundNode, isFound := traverseToItem(cursor.tx, root, key, false, &cursor.stack)
-	if !isFound {
-		return nil, nil
+func (cursor *Cursor) seek(key []byte) ([]byte, []byte) {
+	cursor.leafCrossings = 0
+	cursor.stack = cursor.stack[:0] // the cursor may be positioned again
+	root, err := cursor.tx.getNode(cursor.bucket.root)
+	if err != nil {
+		return cursor.fail(err)
+	}
+	pos, foundNode, err := traverseToItem(cursor.tx, root, key, &cursor.stack)
+	if err != nil {
+		return cursor.fail(err)
 	}
 	cursor.node = foundNode
 	cursor.itemIndex = pos
+	if pos == len(foundNode.items) {
+		// the key sorts after the whole leaf, the successor is a separator in an ancestor
+		cursor.itemIndex = pos - 1
+		return cursor.next()
+	}
 
-	value, _ := foundNode.items[pos].getValue(cursor.tx)
-	return foundNode.items[pos].Key, value
+	return cursor.value(foundNode.items[pos])
 }
 
-func (cursor *Cursor) Next() ([]byte, []byte) {
+func (cursor *Cursor) seekToIndex(index uint64) ([]byte, []byte) {
+	cursor.leafCrossings = 0
+	cursor.stack = cursor.stack[:0] // the cursor may be positioned again
+	if cursor.bucket.root == 0 {
+		return nil, nil
+	}
+	root, err := cursor.tx.getNode(cursor.bucket.root)
+	if err != nil {
+		return cursor.fail(err)
+	}
+	pos, node, err := traverseToIndex(cursor.tx, root, index, &cursor.stack)
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil, nil // past the last key
+	}
+	if err != nil {
+		return cursor.fail(err)
+	}
+	cursor.node = node
+	cursor.itemIndex = pos
+	return cursor.value(node.items[pos])
+}
+
+func (cursor *Cursor) next() ([]byte, []byte) {
 	// If we are in a leaf node, iterate over items
 	var err error
 	if cursor.node.isLeaf() {
 		if cursor.itemIndex < len(cursor.node.items)-1 {
 			cursor.itemIndex++
-			value, _ := cursor.node.items[cursor.itemIndex].getValue(cursor.tx)
-			return cursor.node.items[cursor.itemIndex].Key, value
+			return cursor.value(cursor.node.items[cursor.itemIndex])
 		}
+		cursor.leafCrossings++
 		for {
 			parent, ok := stackPop(&cursor.stack)
 			if !ok {
@@ -156,50 +359,83 @@ func (cursor *Cursor) Next() ([]byte, []byte) {
 			if parent.childIndex < len(parent.children)-1 {
 				cursor.node, err = cursor.tx.getNode(parent.pageNum)
 				if err != nil {
-					return nil, nil
+					return cursor.fail(err)
 				}
-				item := cursor.node.items[parent.itemIndex]
-				cursor.childIndex = parent.childIndex
-				cursor.itemIndex = parent.itemIndex + 1
-				value, _ := item.getValue(cursor.tx)
-				return item.Key, value
+				// the separator after the finished child
+				cursor.itemIndex = parent.childIndex
+				return cursor.value(cursor.node.items[cursor.itemIndex])
 			}
 		}
 	}
 
-	// If we are in an internal node, move down to the next child
-	cursor.childIndex++
-	if cursor.childIndex >= len(cursor.node.childNodes) {
-		return nil, nil // Defensive check: prevent out-of-bounds access
+	// If we are in an internal node, move down to the child after the current item
+	childIndex := cursor.itemIndex + 1
+	if childIndex >= len(cursor.node.childNodes) {
+		return cursor.fail(fmt.Errorf("%w: node %d has no child %d", ErrCorrupted, cursor.node.PageNum, childIndex))
+	}
+	childPage := cursor.node.childNodes[childIndex]
+	cursor.visitPrefetched(childPage)
+	if cursor.leafCrossings >= readAheadTrigger {
+		cursor.readAhead(cursor.node.childNodes[childIndex+1:])
 	}
-	childPage := cursor.node.childNodes[cursor.childIndex]
 	childNode, errGetNode := cursor.tx.getNode(childPage)
 	if errGetNode != nil {
-		return nil, nil
+		return cursor.fail(errGetNode)
 	}
 	// Push the current cursor onto the stack before descending
 	stackPush(&cursor.stack, cursorFrame{
 		pageNum:    cursor.node.PageNum,
 		children:   cursor.node.childNodes,
-		childIndex: cursor.childIndex,
-		itemIndex:  cursor.itemIndex,
+		childIndex: childIndex,
 	})
 	// Traverse down to the first item of the new subtree
-	item, node, _ := traverseToFirstItem(cursor.tx, childNode, &cursor.stack)
+	item, node, err := traverseToFirstItem(cursor.tx, childNode, &cursor.stack)
+	if err != nil {
+		return cursor.fail(err)
+	}
 	cursor.node = node
 	cursor.itemIndex = 0
-	value, _ := item.getValue(cursor.tx)
-	return item.Key, value
+	return cursor.value(item)
 }
 
-func (cursor *Cursor) Prev() ([]byte, []byte) {
+// readAhead schedules the next sibling pages of a sequential scan, up to Options.ReadAheadPages
+func (cursor *Cursor) readAhead(siblings []uint64) {
+	ra := cursor.tx.db.dal.readAhead
+	if ra == nil {
+		return
+	}
+	if cursor.prefetched == nil {
+		cursor.prefetched = make(map[uint64]struct{})
+	}
+	siblings = siblings[:min(len(siblings), cursor.tx.db.dal.opts.ReadAheadPages)]
+	for _, pageNum := range siblings {
+		if _, ok := cursor.prefetched[pageNum]; ok {
+			continue
+		}
+		if !ra.schedule(pageNum) {
+			return
+		}
+		cursor.prefetched[pageNum] = struct{}{}
+	}
+}
+
+// visitPrefetched accounts a page the cursor moves to if it was read ahead
+func (cursor *Cursor) visitPrefetched(pageNum uint64) {
+	if _, ok := cursor.prefetched[pageNum]; ok {
+		delete(cursor.prefetched, pageNum)
+		cursor.tx.db.dal.readAhead.used.Add(1)
+	}
+}
+
+func (cursor *Cursor) prev() ([]byte, []byte) {
 	var err error
+	cursor.leafCrossings = 0
 
 	// If we are in a leaf node, iterate backward over items
 	if cursor.node.isLeaf() {
 		if cursor.itemIndex > 0 {
 			cursor.itemIndex--
-			return cursor.node.items[cursor.itemIndex].Key, cursor.node.items[cursor.itemIndex].Value
+			return cursor.value(cursor.node.items[cursor.itemIndex])
 		}
 
 		// Leaf node is finished, move up the stack
@@ -213,35 +449,36 @@ func (cursor *Cursor) Prev() ([]byte, []byte) {
 			if parent.childIndex > 0 {
 				cursor.node, err = cursor.tx.getNode(parent.pageNum)
 				if err != nil {
-					return nil, nil
+					return cursor.fail(err)
 				}
-				cursor.childIndex = parent.childIndex
-				cursor.itemIndex = parent.itemIndex - 1
-				return cursor.node.items[cursor.itemIndex].Key, cursor.node.items[cursor.itemIndex].Value
+				// the separator before the finished child
+				cursor.itemIndex = parent.childIndex - 1
+				return cursor.value(cursor.node.items[cursor.itemIndex])
 			}
 		}
 	}
 
-	// If we are in an internal node, move down to the last child of the left subtree
-	cursor.childIndex--
-
-	childPage := cursor.node.childNodes[cursor.childIndex]
+	// If we are in an internal node, move down to the last item of the child before the current item
+	childIndex := cursor.itemIndex
+	childPage := cursor.node.childNodes[childIndex]
 	childNode, errGetNode := cursor.tx.getNode(childPage)
 	if errGetNode != nil {
-		return nil, nil
+		return cursor.fail(errGetNode)
 	}
 
 	// Push the current cursor onto the stack before descending
 	stackPush(&cursor.stack, cursorFrame{
 		pageNum:    cursor.node.PageNum,
 		children:   cursor.node.childNodes,
-		childIndex: cursor.childIndex,
-		itemIndex:  cursor.itemIndex,
+		childIndex: childIndex,
 	})
 
 	// Traverse down to the last item of the new subtree
-	item, node, _ := traverseToLastItem(cursor.tx, childNode, &cursor.stack)
+	item, node, err := traverseToLastItem(cursor.tx, childNode, &cursor.stack)
+	if err != nil {
+		return cursor.fail(err)
+	}
 	cursor.node = node
 	cursor.itemIndex = len(cursor.node.items) - 1
-	return item.Key, item.Value
+	return cursor.value(item)
 }
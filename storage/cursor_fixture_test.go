@@ -0,0 +1,52 @@
+package storage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/storagetest"
+)
+
+func TestCursorFirstNext(t *testing.T) {
+	fixture := storagetest.New(t).
+		WithBucket(storagetest.BucketSpec{Name: "foo", Count: 5000, KeySize: 5, MinValueSize: 1, MaxValueSize: 64, Shuffle: true}).
+		Build()
+	entries := fixture.Entries["foo"]
+
+	err := fixture.DB.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		cursor := bucket.Cursor()
+		cnt := 0
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			require.Equal(t, entries[cnt].Key, k)
+			require.Equal(t, entries[cnt].Value, v)
+			cnt++
+		}
+		require.Equal(t, len(entries), cnt)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestCursorPrefixScan(t *testing.T) {
+	fixture := storagetest.New(t).
+		WithBucket(storagetest.BucketSpec{Name: "foo", Count: 5000, KeySize: 5, MinValueSize: 8, MaxValueSize: 8}).
+		Build()
+
+	err := fixture.DB.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		cursor := bucket.Cursor()
+		prefix := []byte("03")
+		cnt := 0
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			cnt++
+		}
+		require.Equal(t, 1000, cnt)
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -4,17 +4,16 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"os"
 	"reflect"
 	"slices"
 	"testing"
 )
 
-func TestCursorFirstNext(t *testing.T) {
+func TestCursorSeekBetweenKeys(t *testing.T) {
 	db, _ := createTestDB(t)
 
 	iterations := 5000
-	sourceKeys := make(map[string][]byte)
-	readKeys := make(map[string][]byte)
 	err := db.Update(func(tx *Tx) error {
 		bucket, _ := tx.CreateBucket([]byte("foo"))
 		for idx := range iterations {
@@ -23,7 +22,6 @@ func TestCursorFirstNext(t *testing.T) {
 			if err != nil {
 				return err
 			}
-			sourceKeys[k] = []byte(k)
 		}
 		return nil
 	})
@@ -31,47 +29,46 @@ func TestCursorFirstNext(t *testing.T) {
 
 	err = db.View(func(tx *Tx) error {
 		bucket, _ := tx.GetBucket([]byte("foo"))
-		cursor := bucket.Cursor()
-		cnt := 0
-		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			readKeys[string(k)] = v
-			cnt++
+		// a missing key sorting after the last key of a leaf must land on the next leaf
+		for idx := range iterations {
+			k, _ := bucket.Cursor().Seek([]byte(fmt.Sprintf("%05d\x00", idx)))
+			if idx == iterations-1 {
+				require.Nil(t, k)
+			} else {
+				require.Equal(t, fmt.Sprintf("%05d", idx+1), string(k))
+			}
 		}
-		require.Equal(t, iterations, cnt)
-		require.True(t, reflect.DeepEqual(sourceKeys, readKeys))
-		return nil
-	})
-	require.NoError(t, err)
-}
-
-func TestCursorPrefixScan(t *testing.T) {
-	db, _ := createTestDB(t)
+		cursor := bucket.Cursor()
+		k, _ := cursor.Seek([]byte("04999\x00"))
+		require.Nil(t, k)
+		k, _ = cursor.Seek([]byte("02500\x00"))
+		require.Equal(t, "02501", string(k))
+		k, _ = cursor.Next()
+		require.Equal(t, "02502", string(k))
 
-	iterations := 5000
-	err := db.Update(func(tx *Tx) error {
-		bucket, _ := tx.CreateBucket([]byte("foo"))
+		// an exact hit may be a separator in an internal node, both directions continue from it
 		for idx := range iterations {
-			k := fmt.Sprintf("%05d", idx)
-			err := bucket.Put([]byte(k), []byte(k))
-			if err != nil {
-				return err
+			key := []byte(fmt.Sprintf("%05d", idx))
+			k, v := cursor.Seek(key)
+			require.Equal(t, key, k)
+			require.Equal(t, key, v)
+			k, _ = cursor.Next()
+			if idx == iterations-1 {
+				require.Nil(t, k)
+			} else {
+				require.Equal(t, fmt.Sprintf("%05d", idx+1), string(k))
+			}
+			cursor.Seek(key)
+			k, _ = cursor.Prev()
+			if idx == 0 {
+				require.Nil(t, k)
+			} else {
+				require.Equal(t, fmt.Sprintf("%05d", idx-1), string(k))
 			}
 		}
 		return nil
 	})
 	require.NoError(t, err)
-
-	err = db.View(func(tx *Tx) error {
-		bucket, _ := tx.GetBucket([]byte("foo"))
-		cursor := bucket.Cursor()
-		prefix := []byte("03")
-		cnt := 0
-		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
-			cnt++
-		}
-		require.Equal(t, 1000, cnt)
-		return nil
-	})
 }
 
 func TestCursorLastPrev(t *testing.T) {
@@ -121,3 +118,255 @@ func TestCursorLastPrev(t *testing.T) {
 		return nil
 	})
 }
+
+func fillScanBucket(tb testing.TB, db *DB, keysN int) {
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for idx := range keysN {
+			k := fmt.Sprintf("%07d", idx)
+			if err = bucket.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(tb, err)
+}
+
+func scanBucket(tb testing.TB, db *DB) int {
+	cnt := 0
+	err := db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, []byte(fmt.Sprintf("%07d", cnt))) {
+				return fmt.Errorf("unexpected key %s at %d", k, cnt)
+			}
+			cnt++
+			return nil
+		})
+	})
+	require.NoError(tb, err)
+	return cnt
+}
+
+func TestCursorReadAhead(t *testing.T) {
+	db, _ := createTestDB(t)
+	fillScanBucket(t, db, 10_000)
+
+	require.Equal(t, 10_000, scanBucket(t, db))
+	stat := db.Stat()
+	require.Greater(t, stat.ReadAheadPages, uint64(0))
+	require.Greater(t, stat.ReadAheadUsedPages, uint64(0))
+	require.LessOrEqual(t, stat.ReadAheadUsedPages, stat.ReadAheadPages)
+
+	// point lookups and backward scans never read ahead
+	err := db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, _ := cursor.Last(); k != nil; k, _ = cursor.Prev() {
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, stat.ReadAheadPages, db.Stat().ReadAheadPages)
+}
+
+func TestCursorReadAheadDisabled(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithReadAhead(0)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	fillScanBucket(t, db, 10_000)
+
+	require.Equal(t, 10_000, scanBucket(t, db))
+	require.Zero(t, db.Stat().ReadAheadPages)
+}
+
+// BenchmarkCursorScanColdCache scans a million keys after dropping the database file
+// from the OS page cache, compare read ahead on and off
+func BenchmarkCursorScanColdCache(b *testing.B) {
+	const keysN = 1_000_000
+	for _, readAhead := range []int{0, 8, 32} {
+		b.Run(fmt.Sprintf("readahead_%d", readAhead), func(b *testing.B) {
+			filename := TempFileName(".db")
+			opts := DefaultOptions().WithReadAhead(readAhead)
+			db, err := Open(filename, opts)
+			require.NoError(b, err)
+			b.Cleanup(func() {
+				_ = db.Close()
+				_ = os.Remove(filename)
+				_ = os.Remove(opts.TxLogPath)
+			})
+			fillScanBucket(b, db, keysN)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				dropPageCache(b, db)
+				b.StartTimer()
+				require.Equal(b, keysN, scanBucket(b, db))
+			}
+			stat := db.Stat()
+			b.ReportMetric(float64(stat.ReadAheadPages)/float64(b.N), "readahead/op")
+			b.ReportMetric(float64(stat.ReadAheadUsedPages)/float64(b.N), "readahead_used/op")
+		})
+	}
+}
+
+func TestCursorSeekToIndex(t *testing.T) {
+	db, _ := createTestDB(t)
+	iterations := 5000
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, _ := tx.CreateBucket([]byte("foo"))
+		for idx := range iterations {
+			k := fmt.Sprintf("%05d", idx*2)
+			if err := bucket.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	verify := func(step int) {
+		require.NoError(t, db.View(func(tx *Tx) error {
+			bucket, _ := tx.GetBucket([]byte("foo"))
+			root, err := tx.getNode(bucket.root)
+			require.NoError(t, err)
+			require.False(t, root.isLeaf(), "the tree spans several levels")
+
+			var keys []string
+			cursor := bucket.Cursor()
+			for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+				keys = append(keys, string(k))
+			}
+			require.Len(t, keys, iterations)
+			for idx := 0; idx < iterations; idx += step {
+				k, v := cursor.SeekToIndex(uint64(idx))
+				require.Equal(t, keys[idx], string(k), "index %d", idx)
+				require.Equal(t, k, v)
+				// both directions continue from the position, which may be a separator
+				k, _ = cursor.Next()
+				if idx == iterations-1 {
+					require.Nil(t, k)
+				} else {
+					require.Equal(t, keys[idx+1], string(k))
+				}
+				cursor.SeekToIndex(uint64(idx))
+				k, _ = cursor.Prev()
+				if idx == 0 {
+					require.Nil(t, k)
+				} else {
+					require.Equal(t, keys[idx-1], string(k))
+				}
+			}
+			k, _ := cursor.SeekToIndex(uint64(iterations))
+			require.Nil(t, k)
+			require.NoError(t, cursor.Err())
+			return nil
+		}))
+	}
+	verify(1)
+
+	// nodes written before format 0.7 have no counts, their subtrees are walked instead
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, _ := tx.GetBucket([]byte("foo"))
+		root, err := tx.getNode(bucket.root)
+		if err != nil {
+			return err
+		}
+		root.childCounts = nil
+		tx.setNode(root)
+		return nil
+	}))
+	verify(97)
+}
+
+func TestCursorItemInfo(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		require.NoError(t, err)
+		require.NoError(t, bucket.Put([]byte("a"), []byte("value")))
+		require.NoError(t, bucket.Put([]byte("b"), make([]byte, 3*BTreePageSize)))
+		require.NoError(t, bucket.PutReader([]byte("c"), bytes.NewReader(make([]byte, 5000)), 5000))
+		_, err = bucket.CreateBucket([]byte("d"))
+		return err
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		cursor := bucket.Cursor()
+		_, err = cursor.ItemInfo()
+		require.ErrorIs(t, err, ErrKeyNotFound)
+		var infos []ItemInfo
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			info, err := cursor.ItemInfo()
+			require.NoError(t, err)
+			infos = append(infos, info)
+		}
+		require.Equal(t, []ItemInfo{
+			{Key: []byte("a"), Size: 5},
+			{Key: []byte("b"), Size: 3 * BTreePageSize, Blob: true},
+			{Key: []byte("c"), Size: 5000, Blob: true},
+			{Key: []byte("d"), Bucket: true},
+		}, infos)
+		_, err = cursor.ItemInfo()
+		require.ErrorIs(t, err, ErrKeyNotFound)
+
+		// a blob reference written before 0.12 holds no size, the first blob page has it
+		item, err := bucket.findItem([]byte("b"))
+		require.NoError(t, err)
+		legacy := &Item{Value: item.Value[:len(item.Value)-UInt32Size]}
+		size, err := valueSize(tx, legacy)
+		require.NoError(t, err)
+		require.Equal(t, 3*BTreePageSize, size)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
+
+// TestCursorMissingChild moves past the last separator of a root node missing its last
+// child, the cursor stops with ErrCorrupted instead of ending as if the bucket was read
+// to the end
+func TestCursorMissingChild(t *testing.T) {
+	db, _ := createTestDB(t)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		require.NoError(t, err)
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, bucket.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte("value")))
+		}
+		root, err := tx.getNode(bucket.root)
+		require.NoError(t, err)
+		require.False(t, root.isLeaf())
+		corrupted := NewBNode()
+		corrupted.PageNum = root.PageNum
+		corrupted.items = root.items
+		corrupted.childNodes = root.childNodes[:len(root.childNodes)-1]
+		corrupted.childCounts = root.childCounts[:len(root.childCounts)-1]
+		tx.setNode(corrupted)
+
+		// the last separator has no child after it to descend into
+		separator := root.items[len(root.items)-1].Key
+		cursor := bucket.Cursor()
+		k, _ := cursor.Seek(separator)
+		require.Equal(t, separator, k)
+		k, _ = cursor.Next()
+		require.Nil(t, k)
+		require.ErrorIs(t, cursor.Err(), ErrCorrupted)
+		return errInjected
+	})
+	require.ErrorIs(t, err, errInjected)
+}
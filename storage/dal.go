@@ -4,10 +4,17 @@ import (
 	"errors"
 	"fmt"
 	"github.com/gofrs/flock"
+	"github.com/google/uuid"
+	"io"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 const (
@@ -15,19 +22,66 @@ const (
 	OneGigabyte = 1024 * 1024 * 1024
 )
 
+// dataReader is the read side of the database file, all a read only database needs
+type dataReader interface {
+	io.ReaderAt
+	Size() (int64, error)
+	Close() error
+}
+
+// dataFile is the database file of a writable database
+type dataFile interface {
+	dataReader
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+}
+
+// osDataFile is the database file on local disk
+type osDataFile struct {
+	*os.File
+}
+
+func (file osDataFile) Size() (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
 type Dal struct {
-	file              *os.File
-	osPageSize        uint64
-	maxPages          uint64
-	size              uint64
-	MinFillPercent    float32
-	MaxFillPercent    float32
-	freelist          *Freelist
-	meta              *Meta
-	fileLock          *flock.Flock
-	txLog             *TxLog
-	opts              *Options
-	beforeSetPageHook func(p *Page) error
+	path           string
+	file           dataFile
+	blobs          *blobFile // nil until a bucket places its blobs in a blob file
+	osPageSize     uint64
+	maxPages       atomic.Uint64 // grows under allocLock, page reads check it without
+	size           uint64
+	MinFillPercent float32
+	MaxFillPercent float32
+	freelist       *Freelist
+	allocLock      sync.Mutex // freelists and file growth, bucket transactions allocate concurrently
+	snapshots      snapshotSet
+	meta           *Meta
+	fileLock       *flock.Flock
+	txLog          *TxLog
+	opts           *Options
+	directIO       bool // file is opened with O_DIRECT, page io must be aligned
+	pages          pagePool
+	readAhead      *readAheader // nil if read ahead is disabled
+	stats          commitCounters
+	usage          pageCounters
+	lastSync       atomic.Int64 // unix nanoseconds of the last database file fsync
+	recovery       RecoveryInfo
+	cleanShutdown  bool // the meta open flag was clear when the file was opened
+	committedMeta  Meta // meta of the last successful commit, in memory meta may hold rolled back changes
+	commitFailed   atomic.Bool
+	batch          *pageBatch // set while a commit phase buffers its page writes
+	readOnly       bool       // opened with OpenReader or with a mismatched tx log, the file refuses writes
+	readOnlyErr    error      // why Open opened the file read only, nil for OpenReader
+	formatVersion  uint16     // written to the meta by every commit, below current while migrations run
+	// a freelist failed its checks and was replaced by one without free pages, Open rebuilds it
+	freelistDamaged bool
 }
 
 func NewDal(path string, opts *Options) (*Dal, error) {
@@ -45,24 +99,50 @@ func NewDal(path string, opts *Options) (*Dal, error) {
 		fileExists = false
 		logger.Debug("database file not exists", "path", path)
 	} else {
-		return nil, fmt.Errorf("could not stat dal: %v", statErr)
+		return nil, fmt.Errorf("could not stat dal: %w", statErr)
+	}
+	if !fileExists && opts.MustExist {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseNotFound, path)
+	}
+	if fileExists && opts.MustCreate {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseExists, path)
 	}
 
 	fileLock := flock.New(path)
 	locked, err := fileLock.TryLock()
-	if err != nil || !locked {
-		return nil, fmt.Errorf("could not lock database file: %s", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock database file %s: %w", path, err)
+	}
+	if !locked {
+		return nil, fmt.Errorf("%w: %s", ErrDatabaseLocked, path)
+	}
+	// the page size and id of an existing file, the tx log is checked against them before
+	// it is replayed
+	fileMeta := NewMeta(opts.PageSize)
+	if fileExists {
+		meta, checkErr := checkDatabaseFile(path)
+		if checkErr == nil && meta.dbVersion < currentFormatVersion && !opts.AutoMigrate {
+			checkErr = fmt.Errorf("%w: %s has format %s, this build writes %d.%d, run pirindb migrate %s",
+				ErrMigrationRequired, path, meta.GetDbVersionString(), dbVersionMajor, dbVersionMinor, path)
+		}
+		if checkErr != nil {
+			_ = fileLock.Unlock()
+			return nil, checkErr
+		}
+		fileMeta = meta
+	} else {
+		fileMeta.setID(uuid.New())
 	}
 
-	file, openErr := os.OpenFile(path, os.O_RDWR|os.O_CREATE, opts.FileMode)
+	file, directIO, openErr := openDataFile(path, opts)
 	if openErr != nil {
-		return nil, fmt.Errorf("could not open dal: %v", openErr)
+		return nil, fmt.Errorf("could not open dal: %w", openErr)
 	}
 
 	fileInfo, fileStatErr := file.Stat()
 	if fileStatErr != nil {
 		_ = file.Close()
-		return nil, fmt.Errorf("could not stat dal: %v", fileStatErr)
+		return nil, fmt.Errorf("could not stat dal: %w", fileStatErr)
 	}
 
 	fileSize := fileInfo.Size()
@@ -70,91 +150,224 @@ func NewDal(path string, opts *Options) (*Dal, error) {
 		fileSize = minFileSize
 	}
 
-	tlog := NewTxLog(opts.TxLogPath, 0600)
+	tlog, err := NewTxLog(opts.TxLogPath, 0600)
+	if err != nil {
+		_ = file.Close()
+		_ = fileLock.Unlock()
+		return nil, err
+	}
+	tlog.keepRecords = opts.SyncMode == SyncInterval
+	tlog.syncOnCommit = opts.SyncMode != SyncNever && opts.SyncMode != SyncInterval
+	tlog.failpoints = opts.Failpoints
+	tlog.pageSize = int(fileMeta.pageSize)
+	tlog.dbID = fileMeta.id
 	logger.Info("open database file", "path", path, "size", fileSize,
 		"tx_log", opts.TxLogPath)
 
 	dal := &Dal{
+		path:           path,
 		fileLock:       fileLock,
-		file:           file,
-		meta:           NewMeta(opts.PageSize),
+		file:           osDataFile{file},
+		meta:           fileMeta,
 		osPageSize:     uint64(os.Getpagesize()),
 		freelist:       NewFreelist(BTreePageSize, 0),
 		MinFillPercent: 0.45,
 		MaxFillPercent: 0.95,
 		txLog:          tlog,
 		opts:           opts,
+		directIO:       directIO,
+		formatVersion:  currentFormatVersion,
+	}
+	if err = dal.allocateFile(uint64(fileSize)); err != nil {
+		_ = dal.file.Close()
+		_ = tlog.file.Close()
+		_ = fileLock.Unlock()
+		return nil, err
 	}
-	dal.allocateFile(uint64(fileSize))
 
 	if fileExists {
+		// replayed meta pages carry the flag of their commit, read it from the file first
+		dal.cleanShutdown = readMetaFlags(dal)&metaFlagOpen == 0
 		if opts.EnableRecovery {
-			recoveredPages := 0
-			err = tlog.Recover(func(offset uint64, page *Page) error {
-				err = dal.SetPage(page)
-				if err != nil {
-					return err
-				}
-				recoveredPages++
-				return nil
+			tlog.identity = &txLogIdentity{pageSize: int(fileMeta.pageSize), dbID: fileMeta.id}
+			summary, recoverErr := tlog.Recover(func(offset uint64, page *Page) error {
+				return dal.recoverPage(page)
 			})
-			if err != nil {
-				logger.Error("unable to apply tx log", "error", err)
+			dal.recovery = RecoveryInfo{RecoverySummary: summary, At: time.Now()}
+			if errors.Is(recoverErr, ErrTxLogMismatch) {
+				recoverErr = fmt.Errorf("%s: %w", opts.TxLogPath, recoverErr)
+				if opts.FailOnTxLogMismatch {
+					_ = dal.Close()
+					_ = tlog.file.Close()
+					return nil, recoverErr
+				}
+				// nothing was replayed, the log is kept for the file it was written for
+				dal.readOnly = true
+				dal.readOnlyErr = recoverErr
+			}
+			if recoverErr != nil {
+				dal.recovery.Error = recoverErr.Error()
+				logger.Error("unable to apply tx log", "error", recoverErr)
 			} else {
-				logger.Info("tx log applied", "recovered_pages", recoveredPages)
+				logger.Info("tx log applied", "recovered_pages", summary.Pages)
+			}
+			if summary.Pages > 0 && opts.SyncMode != SyncNever {
+				// recovered pages must be durable before the next commit truncates the log
+				if err = dal.Sync(); err != nil {
+					_ = dal.file.Close()
+					return nil, fmt.Errorf("could not sync recovered pages: %w", err)
+				}
 			}
 		}
 		meta, readMetaErr := ReadMeta(dal)
 		if readMetaErr != nil {
-			_ = dal.file.Close()
-			return nil, fmt.Errorf("could not read meta: %v", readMetaErr)
+			_ = dal.Close()
+			return nil, fmt.Errorf("could not read meta: %w", readMetaErr)
 		}
 		dal.meta = meta
+		// a recovered commit may have upgraded the file since the check above
+		dal.formatVersion = meta.dbVersion
+		tlog.dbID = meta.id
+		if meta.flags&metaFlagBlobFile != 0 && dal.blobs == nil {
+			if err = dal.openBlobFile(meta); err != nil {
+				_ = dal.Close()
+				return nil, err
+			}
+		}
 		freelist, readFreelistErr := ReadFreelist(dal)
+		if readFreelistErr != nil && dal.canRebuildFreelist(readFreelistErr) {
+			freelist, readFreelistErr = dal.damagedFreelist(dal.meta.freelistPageNumber, dal.maxPages.Load()), nil
+		}
 		if readFreelistErr != nil {
-			_ = dal.file.Close()
-			return nil, fmt.Errorf("could not read freelist: %v", readFreelistErr)
+			_ = dal.Close()
+			return nil, fmt.Errorf("could not read freelist: %w", readFreelistErr)
 		}
 		dal.freelist = freelist
+		if err = dal.checkDeclaredSize(path); err != nil {
+			_ = dal.Close()
+			return nil, err
+		}
+		if dal.blobs != nil {
+			if err = dal.readBlobFreelist(); err != nil {
+				_ = dal.Close()
+				return nil, err
+			}
+		}
 	} else {
+		dal.cleanShutdown = true
 		writeMetaErr := WriteMeta(dal, dal.meta)
 		if writeMetaErr != nil {
 			_ = dal.file.Close()
-			return nil, fmt.Errorf("could not write meta: %v", writeMetaErr)
+			return nil, fmt.Errorf("could not write meta: %w", writeMetaErr)
 		}
+		// an empty freelist is written too, files of the current format always have one
+		dal.freelist.dirty = true
 		writeFreelistErr := WriteFreelist(dal, dal.freelist)
 		if writeFreelistErr != nil {
 			_ = dal.file.Close()
-			return nil, fmt.Errorf("could not write freelist: %v", writeFreelistErr)
+			return nil, fmt.Errorf("could not write freelist: %w", writeFreelistErr)
 		}
 	}
 
+	dal.committedMeta = *dal.meta
+	if dal.readOnly {
+		logger.Warn("database opened read only, the tx log does not belong to it", "path", path,
+			"tx_log", opts.TxLogPath)
+	} else if err = dal.markOpen(true); err != nil {
+		_ = dal.file.Close()
+		return nil, fmt.Errorf("could not mark database open: %w", err)
+	}
+
+	// with O_DIRECT reads bypass the page cache, reading ahead would only waste io
+	if opts.ReadAheadPages > 0 && !dal.directIO {
+		dal.readAhead = newReadAheader(dal)
+	}
 	return dal, nil
 }
 
-func (dal *Dal) allocateFile(size uint64) {
+// errReadOnly is the error of a write to a read only file, with the reason Open opened it so
+func (dal *Dal) errReadOnly() error {
+	if dal.readOnlyErr != nil {
+		return fmt.Errorf("%w: %w", ErrReadOnly, dal.readOnlyErr)
+	}
+	return ErrReadOnly
+}
+
+// openDataFile opens the database file, with O_DIRECT if requested and supported.
+// Filesystems rejecting O_DIRECT, like tmpfs, fall back to buffered io.
+func openDataFile(path string, opts *Options) (*os.File, bool, error) {
+	flags := os.O_RDWR | os.O_CREATE
+	if opts.DirectIO {
+		if !directIOSupported {
+			logger.Warn("direct io is not supported on this platform, using buffered io")
+		} else {
+			file, err := os.OpenFile(path, flags|directIOFlag, opts.FileMode)
+			if err == nil {
+				return file, true, nil
+			}
+			if !errors.Is(err, syscall.EINVAL) {
+				return nil, false, err
+			}
+			logger.Warn("filesystem does not support direct io, using buffered io", "path", path)
+		}
+	}
+	file, err := os.OpenFile(path, flags, opts.FileMode)
+	return file, false, err
+}
+
+func (dal *Dal) allocateFile(size uint64) error {
 	err := dal.file.Truncate(int64(size))
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not grow database file to %d bytes: %w", size, err)
 	}
 	dal.size = size
-	dal.maxPages = size / dal.meta.pageSize
-	dal.freelist.maxPages = dal.maxPages
-	logger.Info("allocateFile", "size", dal.size, "max_pages", dal.maxPages)
+	dal.maxPages.Store(size / dal.meta.pageSize)
+	dal.freelist.maxPages = dal.maxPages.Load()
+	logger.Info("allocateFile", "size", dal.size, "max_pages", dal.maxPages.Load())
+	return nil
+}
+
+// checkDeclaredSize refuses a file shorter than the pages its freelist declares, unless the
+// tx log just replayed commits whose growth of the file was lost
+func (dal *Dal) checkDeclaredSize(path string) error {
+	size, err := dal.file.Size()
+	if err != nil {
+		return fmt.Errorf("could not stat dal: %w", err)
+	}
+	declared := dal.freelist.maxPages * dal.meta.pageSize
+	if uint64(size) >= declared {
+		return nil
+	}
+	if dal.recovery.Pages == 0 {
+		return fmt.Errorf("%w: %s has %d bytes, its freelist declares %d", ErrTruncatedDatabase,
+			path, size, declared)
+	}
+	return dal.allocateFile(declared)
 }
 
-func (dal *Dal) expandAllocation() {
+func (dal *Dal) expandAllocation() error {
 	var newSize uint64
 	if dal.size < OneGigabyte {
 		newSize = dal.size * 2
 	} else {
 		newSize = dal.size + OneGigabyte
 	}
+	if maxSize := dal.opts.MaxSize; maxSize > 0 {
+		newSize = min(newSize, maxSize/dal.meta.pageSize*dal.meta.pageSize)
+		if newSize <= dal.size {
+			return fmt.Errorf("%w: database file has %d bytes, the limit is %d", ErrQuotaExceeded, dal.size, maxSize)
+		}
+	}
 	logger.Info("expand allocateFile", "size", newSize)
-	dal.allocateFile(newSize)
+	return dal.allocateFile(newSize)
 }
 
 func (dal *Dal) AllocatePage() (*Page, error) {
+	if err := dal.failpoint(FailpointAllocatePage); err != nil {
+		return nil, err
+	}
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
 	var page *Page
 	newPageNum, err := dal.freelist.GetNextPageNumber()
 	if err != nil {
@@ -162,7 +375,9 @@ func (dal *Dal) AllocatePage() (*Page, error) {
 			logger.Debug("trying allocate new pageNum, but no pages left")
 			// if no free pages left, we should allocate new pages
 			// by expand database file and expand mapping
-			dal.expandAllocation()
+			if err = dal.expandAllocation(); err != nil {
+				return nil, err
+			}
 			newPageNum, err = dal.freelist.GetNextPageNumber()
 			if err != nil {
 				return nil, err
@@ -176,16 +391,59 @@ func (dal *Dal) AllocatePage() (*Page, error) {
 	}
 	page, err = dal.GetPage(newPageNum)
 	if err != nil {
+		dal.freelist.ReleasePage(newPageNum)
 		return nil, err
 	}
 	page.Clear()
 	return page, nil
 }
 
+// AllocateContiguousPages allocates n adjacent pages, the file is expanded until the run fits
+func (dal *Dal) AllocateContiguousPages(n int) ([]*Page, error) {
+	if err := dal.failpoint(FailpointAllocatePage); err != nil {
+		return nil, err
+	}
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
+	start, err := dal.freelist.GetContiguousPages(uint64(n))
+	for errors.Is(err, ErrNoPagesLeft) {
+		if err = dal.expandAllocation(); err != nil {
+			return nil, err
+		}
+		start, err = dal.freelist.GetContiguousPages(uint64(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]*Page, n)
+	for i := range pages {
+		page, err := dal.GetPage(start + uint64(i))
+		if err != nil {
+			// the run is allocated as a whole or not at all
+			dal.freelist.ReleasePages(pageRun(start, n))
+			return nil, err
+		}
+		page.Clear()
+		pages[i] = page
+	}
+	return pages, nil
+}
+
+// pageRun returns the numbers of n adjacent pages from start
+func pageRun(start uint64, n int) []uint64 {
+	pageNums := make([]uint64, n)
+	for i := range pageNums {
+		pageNums[i] = start + uint64(i)
+	}
+	return pageNums
+}
+
 func (dal *Dal) ReleasePage(pageNumber uint64) error {
 	if pageNumber == 0 {
-		return fmt.Errorf("cannot release pageNum 0")
+		return fmt.Errorf("%w: cannot release the meta page", ErrPageOutOfRange)
 	}
+	dal.allocLock.Lock()
+	defer dal.allocLock.Unlock()
 	dal.freelist.ReleasePage(pageNumber)
 	return nil
 }
@@ -194,28 +452,51 @@ func (dal *Dal) Close() error {
 	if dal.file == nil {
 		return nil
 	}
+	if dal.readAhead != nil {
+		dal.readAhead.close()
+	}
 
+	if dal.blobs != nil {
+		dal.blobs.close()
+		dal.blobs = nil
+	}
 	if err := dal.file.Close(); err != nil && !errors.Is(err, fs.ErrClosed) {
 		return fmt.Errorf("failed to close file: %w", err)
 	}
-	err := dal.fileLock.Unlock()
-	if err != nil {
-		return fmt.Errorf("failed to unlock db file: %w", err)
+	if dal.fileLock != nil {
+		if err := dal.fileLock.Unlock(); err != nil {
+			return fmt.Errorf("failed to unlock db file: %w", err)
+		}
 	}
 	dal.file = nil
 	return nil
 }
 
 func (dal *Dal) GetPage(pageNumber uint64) (*Page, error) {
-	if pageNumber >= dal.maxPages {
-		return nil, fmt.Errorf("page number %d is greater than max page number %d", pageNumber, dal.maxPages)
+	if isBlobFilePage(pageNumber) {
+		if dal.blobs == nil || localPageNum(pageNumber) >= dal.blobs.maxPages.Load() {
+			return nil, fmt.Errorf("%w: blob file page %d", ErrPageOutOfRange, localPageNum(pageNumber))
+		}
+		return dal.readPage(pageNumber)
+	}
+	if maxPages := dal.maxPages.Load(); pageNumber >= maxPages {
+		return nil, fmt.Errorf("%w: page %d, the file has %d pages", ErrPageOutOfRange, pageNumber, maxPages)
 	}
+	return dal.readPage(pageNumber)
+}
 
+// readPage reads the page from the file without the bounds check, snapshots call it
+// outside of the database lock and check against their own page count
+func (dal *Dal) readPage(pageNumber uint64) (*Page, error) {
+	if err := dal.failpoint(FailpointPageRead); err != nil {
+		return nil, err
+	}
 	pageSize := dal.meta.pageSize
-	offset := int64(pageNumber * pageSize)
+	file, local := dal.pageFile(pageNumber)
+	offset := int64(local * pageSize)
 
-	data := make([]byte, pageSize)
-	_, err := dal.file.ReadAt(data, offset)
+	data := dal.pages.get(pageSize)
+	_, err := file.ReadAt(data, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read page %d: %w", pageNumber, err)
 	}
@@ -228,32 +509,116 @@ func (dal *Dal) GetPage(pageNumber uint64) (*Page, error) {
 	return page, nil
 }
 
+// pageFile returns the file holding the page and the page number within it
+func (dal *Dal) pageFile(pageNumber uint64) (dataFile, uint64) {
+	if isBlobFilePage(pageNumber) && dal.blobs != nil {
+		return dal.blobs.file, localPageNum(pageNumber)
+	}
+	return dal.file, pageNumber
+}
+
+// releasePage hands the page buffer back to the pool, the page must not be used afterwards
+func (dal *Dal) releasePage(page *Page) {
+	dal.pages.put(page.Data)
+}
+
 func (dal *Dal) SetPage(page *Page) error {
-	if dal.beforeSetPageHook != nil {
-		if err := dal.beforeSetPageHook(page); err != nil {
-			return err
-		}
+	if dal.batch != nil {
+		return dal.addToBatch(page)
 	}
+	return dal.writeRun(page.PageNumber, page.Data)
+}
 
-	offset := page.PageNumber * dal.meta.pageSize
+// writeRun writes adjacent pages starting at firstPage with a single call, to the tx log
+// while a record is open and to the database file otherwise
+func (dal *Dal) writeRun(firstPage uint64, data []byte) error {
+	file, local := dal.pageFile(firstPage)
+	offset := local * dal.meta.pageSize
+	numPages := max(1, uint64(len(data))/dal.meta.pageSize)
 
 	if dal.txLog.active {
-		if err := dal.txLog.writePage(offset, page); err != nil {
-			return fmt.Errorf("failed to write pageNum %d to recovery log: %w", page.PageNumber, err)
+		if err := dal.failpoint(FailpointTxLogPageWrite); err != nil {
+			return err
+		}
+		if err := dal.txLog.writeRun(offset, firstPage, int(dal.meta.pageSize), data); err != nil {
+			return fmt.Errorf("failed to write pageNum %d to recovery log: %w", firstPage, err)
 		}
+		dal.stats.txLogPages.Add(numPages)
 		return nil
 	}
 
-	_, err := dal.file.WriteAt(page.Data, int64(offset))
+	if err := dal.failpoint(FailpointPageWrite); err != nil {
+		return err
+	}
+	if err := dal.snapshots.preserve(dal, firstPage, numPages); err != nil {
+		return err
+	}
+	if dal.directIO {
+		if uint64(len(data))%dal.meta.pageSize != 0 {
+			return fmt.Errorf("%w: pageNum %d has %d bytes", ErrPartialPage, firstPage, len(data))
+		}
+		// pages built outside the dal, like recovered ones, are copied to an aligned buffer
+		if !isAligned(data) {
+			aligned := alignedBlock(len(data))
+			copy(aligned, data)
+			data = aligned
+		}
+	}
+	_, err := file.WriteAt(data, int64(offset))
 	if err != nil {
-		return fmt.Errorf("failed to write pageNum %d to file: %w", page.PageNumber, err)
+		return fmt.Errorf("failed to write pageNum %d to file: %w", firstPage, err)
 	}
+	dal.stats.pagesWritten.Add(numPages)
+	dal.stats.writes.Add(1)
 
 	return nil
 }
 
 func (dal *Dal) Sync() error {
-	return dal.file.Sync()
+	if err := dal.failpoint(FailpointSync); err != nil {
+		return err
+	}
+	if err := dal.file.Sync(); err != nil {
+		return err
+	}
+	if dal.blobs != nil {
+		if err := dal.blobs.file.Sync(); err != nil {
+			return err
+		}
+	}
+	dal.stats.fsyncs.Add(1)
+	dal.lastSync.Store(time.Now().UnixNano())
+	return nil
+}
+
+// markOpen sets or clears the open flag in the meta of the last commit. The meta page is
+// written directly: the tx log is left untouched for recovery, and all meta fields fit in
+// the first disk sector, so the write does not tear.
+func (dal *Dal) markOpen(open bool) error {
+	if open {
+		dal.meta.flags |= metaFlagOpen
+	} else {
+		dal.meta.flags &^= metaFlagOpen
+	}
+	meta := dal.committedMeta
+	meta.flags = meta.flags&^metaFlagOpen | dal.meta.flags&metaFlagOpen
+	if err := WriteMeta(dal, &meta); err != nil {
+		return err
+	}
+	if dal.opts.SyncMode == SyncNever {
+		return nil
+	}
+	return dal.Sync()
+}
+
+// logKey returns the key log attribute redacted according to Options.LogKeyMode
+func (dal *Dal) logKey(key []byte) slog.Attr {
+	return LogKey(dal.opts.LogKeyMode, key)
+}
+
+// failpoint runs the test hook installed at the site, if any
+func (dal *Dal) failpoint(name Failpoint) error {
+	return dal.opts.Failpoints.trigger(name)
 }
 
 func (dal *Dal) getNode(pageNumber uint64) (*BNode, error) {
@@ -262,7 +627,11 @@ func (dal *Dal) getNode(pageNumber uint64) (*BNode, error) {
 		return nil, err
 	}
 	node := NewBNode()
-	node.Deserialize(page.Data)
+	err = node.Deserialize(page.Data)
+	dal.releasePage(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode node page %d: %w", pageNumber, err)
+	}
 	node.PageNum = pageNumber
 	return node, nil
 }
@@ -288,13 +657,6 @@ func (dal *Dal) setNode(node *BNode) (*Page, error) {
 	return page, dal.SetPage(page)
 }
 
-func (dal *Dal) deletePage(pageNumber uint64) {
-	err := dal.ReleasePage(pageNumber)
-	if err != nil {
-		return
-	}
-}
-
 func (dal *Dal) maxThreshold() float32 {
 	return dal.MaxFillPercent * float32(dal.meta.pageSize)
 }
@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"os"
+	"slices"
 	"testing"
 )
 
@@ -44,6 +46,25 @@ func TestDAL(t *testing.T) {
 	_ = newDal.Close()
 }
 
+func TestDALErrors(t *testing.T) {
+	testFileName := TempFileName(".db")
+	opts := DefaultOptions()
+	dal, err := NewDal(testFileName, opts)
+	require.NoError(t, err)
+	defer func() {
+		_ = dal.Close()
+		_ = os.Remove(testFileName)
+		_ = os.Remove(dal.opts.TxLogPath)
+	}()
+
+	_, err = dal.GetPage(dal.maxPages.Load() + 10)
+	require.ErrorIs(t, err, ErrPageOutOfRange)
+	require.ErrorIs(t, dal.ReleasePage(0), ErrPageOutOfRange)
+
+	_, err = NewDal(testFileName, opts)
+	require.ErrorIs(t, err, ErrDatabaseLocked)
+}
+
 func TestDALMetadata(t *testing.T) {
 	testFileName := "test_data.db"
 	opts := DefaultOptions()
@@ -85,7 +106,7 @@ func TestDALFreelist(t *testing.T) {
 	err = dal.ReleasePage(pageNum.PageNumber)
 	require.NoError(t, err)
 
-	releasedPages := dal.freelist.releasedPages
+	released := slices.Clone(dal.freelist.released)
 	err = WriteFreelist(dal, dal.freelist)
 	require.NoError(t, err)
 	err = dal.Close()
@@ -93,7 +114,57 @@ func TestDALFreelist(t *testing.T) {
 
 	dal, err = NewDal(testFileName, opts)
 	require.NoError(t, err)
-	require.Equal(t, releasedPages, dal.freelist.releasedPages)
+	require.Equal(t, released, dal.freelist.released)
 	err = dal.Close()
 	require.NoError(t, err)
 }
+
+func TestDALAlignedPages(t *testing.T) {
+	for _, size := range []int{1, 100, BTreePageSize, 3 * BTreePageSize} {
+		block := alignedBlock(size)
+		require.Len(t, block, size)
+		require.True(t, isAligned(block))
+	}
+
+	db, _ := createTestDB(t)
+	page, err := db.dal.AllocatePage()
+	require.NoError(t, err)
+	require.True(t, isAligned(page.Data))
+	require.Len(t, page.Data, int(db.dal.meta.pageSize))
+}
+
+func TestDALDirectIO(t *testing.T) {
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithDirectIO(true).WithPageSize(1000))
+	require.ErrorIs(t, err, ErrBadDirectIOPageSize)
+
+	filename := TempFileName(".db")
+	failpoints := NewFailpoints()
+	opts := DefaultOptions().WithDirectIO(true).WithFailpoints(failpoints)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	// filesystems without O_DIRECT fall back to buffered io, the test must pass either way
+	t.Logf("direct io active: %v", db.Stat().DirectIO)
+
+	require.NoError(t, db.Update(crashBaseline))
+	// recovered pages are not aligned and must be copied before the direct write
+	failpoints.Enable(FailpointAfterTxLog, FailNth(1, errInjected))
+	require.ErrorIs(t, db.Update(crashWorkload), errInjected)
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, DefaultOptions().WithDirectIO(true))
+	require.True(t, requireCrashState(t, db))
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		value, found := bucket.Get([]byte("key-10"))
+		require.True(t, found)
+		require.Equal(t, []byte(fmt.Sprintf("value-%d", 10)), value)
+		return nil
+	})
+	require.NoError(t, err)
+}
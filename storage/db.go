@@ -1,20 +1,58 @@
 package storage
 
 import (
+	"fmt"
+	"runtime/debug"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/timson/pirindb/storage/keys"
 )
 
 type DB struct {
-	lock sync.RWMutex
-	dal  *Dal
-	TxN  atomic.Int32
+	lock       sync.RWMutex
+	dal        *Dal
+	TxN        atomic.Int32
+	ownersLock sync.Mutex
+	owners     map[int64]struct{} // goroutines currently holding a transaction
+	stopSync   chan struct{}
+	syncDone   chan struct{}
+	writeQueue atomic.Int32 // goroutines waiting for the write lock
+	writerLock sync.Mutex
+	writer     writerInfo
+	readers    *readerSet
+	advisor    *txAdvisor     // nil unless Options.AdvisorEnabled
+	stall      *stallDetector // nil without write stall limits
+	softLimits *softLimits    // nil without soft limits
+	validators validatorSet
+	hooks      commitHooks
+	// bucketWriters is held shared by UpdateBucket transactions and exclusively by other writers
+	bucketWriters sync.RWMutex
+	bucketLocks   bucketLocks
+	buckets       bucketCache
+	retention     retentionSweeps
+	lastTxID      atomic.Uint64 // id of the last write transaction begun, see Tx.ID
+	clock         *keys.Clock   // timestamps the bucket events
+}
+
+// writerInfo describes the write transaction currently holding the lock
+type writerInfo struct {
+	started time.Time
+	label   string
 }
 
 type BucketStat struct {
-	ItemsN     uint64
-	BlobsN     uint64
-	BytesInUse uint64
+	ItemsN      uint64
+	BlobsN      uint64
+	BytesInUse  uint64
+	BucketsN    uint64          // nested buckets, counted in ItemsN too
+	PrefixRules []PrefixRule    // keys are counted until PurgeExpired deletes them
+	Quota       BucketQuota     // zero when the bucket has no quota
+	RetainFor   time.Duration   // zero when the bucket keeps keys forever
+	LastSweep   *RetentionSweep // nil until SweepRetention ran with the retention set
+	Events      []BucketEvent   // the newest events of a top level bucket, see Tx.BucketEvents
 }
 
 type DBStat struct {
@@ -26,81 +64,296 @@ type DBStat struct {
 	TotalDBSize   uint64                 // amount of pages * page size
 	AvailDBSize   uint64                 // amount of free pages * page size
 	UsedDBSize    uint64                 // amount of used pages * page size
-	Buckets       map[string]*BucketStat //
+	MaxDBSize     uint64                 // Options.MaxSize, 0 is unlimited
+	Buckets       map[string]*BucketStat // empty while a writer holds the lock, nil when not requested
 	TxN           int                    // total number of started read transactions
+	SyncMode      SyncMode               // active sync mode
+	DirectIO      bool                   // database file is opened with O_DIRECT
+
+	BucketsComplete bool     // Buckets lists every bucket, false when a writer held the lock or not requested
+	InvalidBuckets  []string // root bucket entries that are not bucket values, skipped in Buckets
+
+	ReadAheadPages     uint64 // pages read ahead by sequential cursor scans
+	ReadAheadUsedPages uint64 // read ahead pages later visited by the cursor
+
+	WriterHeldFor   time.Duration // how long the current write transaction holds the lock
+	WriterLabel     string        // label of the current write transaction
+	WriteQueueDepth int           // number of goroutines waiting for the write lock
+
+	Snapshots     int // open bucket snapshots
+	SnapshotPages int // page images copied into open snapshots before commits overwrote them
+
+	LastCommit     time.Time     // when the last write transaction committed, zero before the first
+	LastCommitTime time.Duration // how long the last commit took
+
+	Commit     CommitStats    // commit pipeline counters
+	Durability DurabilityInfo // tx log and recovery state
+	WriteStall WriteStallInfo // write stall detector state
+
+	Warnings   []SoftLimitWarning // soft limits the database is above, see Options.SizeWarnRatio
+	SoftLimits SoftLimitInfo      // per limit gauges and crossing counters, Warnings included
 }
 
 func Open(path string, opts *Options) (*DB, error) {
 	if opts == nil {
 		opts = DefaultOptions()
 	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
 	dal, err := NewDal(path, opts)
 	if err != nil {
 		return nil, err
 	}
-	db := &DB{
-		lock: sync.RWMutex{},
-		dal:  dal,
+	db := newDB(dal, opts)
+	if err = db.rebuildFreelist(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	// a read only file of an older format is read as it is
+	if dal.formatVersion < currentFormatVersion && !dal.readOnly {
+		if _, err = db.migrate(); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
 	}
 	return db, nil
 }
 
+func newDB(dal *Dal, opts *Options) *DB {
+	db := &DB{
+		lock:    sync.RWMutex{},
+		dal:     dal,
+		owners:  make(map[int64]struct{}),
+		readers: newReaderSet(),
+		stall:   newStallDetector(opts),
+		clock:   keys.NewClock(),
+	}
+	dal.publishPages()
+	if db.softLimits = newSoftLimits(opts); db.softLimits != nil {
+		db.softLimits.observe(dal)
+	}
+	if opts.AdvisorEnabled {
+		db.advisor = newTxAdvisor(db, opts)
+	}
+	if opts.SyncMode == SyncInterval && !dal.readOnly {
+		db.stopSync = make(chan struct{})
+		db.syncDone = make(chan struct{})
+		go db.syncLoop(opts.SyncInterval)
+	}
+	if opts.MaxReaderDuration > 0 {
+		db.readers.stop = make(chan struct{})
+		db.readers.done = make(chan struct{})
+		go db.reaperLoop(opts.MaxReaderDuration)
+	}
+	return db
+}
+
 func (db *DB) Close() error {
+	db.stopReaper()
+	db.dal.snapshots.closeAll()
+	if db.stopSync != nil {
+		close(db.stopSync)
+		<-db.syncDone
+		db.stopSync = nil
+		if err := db.syncAndRoll(); err != nil {
+			logger.Error("final sync failed", "error", err)
+		}
+	}
+	// after a failed commit the database is left for recovery on the next open
+	if db.dal.file != nil && !db.dal.commitFailed.Load() && !db.dal.readOnly {
+		if err := db.dal.markOpen(false); err != nil {
+			logger.Error("could not mark clean shutdown", "error", err)
+		}
+	}
 	return db.dal.Close()
 }
 
-func (db *DB) Begin(write bool) *Tx {
+// syncLoop periodically flushes the database file in SyncInterval mode
+func (db *DB) syncLoop(interval time.Duration) {
+	defer close(db.syncDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.stopSync:
+			return
+		case <-ticker.C:
+			if err := db.syncAndRoll(); err != nil {
+				logger.Error("background sync failed", "error", err)
+			}
+		}
+	}
+}
+
+// syncAndRoll fsyncs the database file and drops tx log records that are durable now.
+// The write lock keeps commits from landing between the sync and the roll.
+func (db *DB) syncAndRoll() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if err := db.dal.Sync(); err != nil {
+		return err
+	}
+	return db.dal.txLog.roll()
+}
+
+// Begin starts a new transaction. A goroutine can hold only one transaction at a time:
+// sync.RWMutex is not re-entrant, so nesting Update or View inside an open transaction
+// on the same goroutine would deadlock. Any such nesting, including View inside View,
+// returns ErrNestedTransaction instead.
+func (db *DB) Begin(write bool) (*Tx, error) {
+	return db.BeginLabeled(write, "")
+}
+
+// BeginLabeled starts a new transaction, the label of a write transaction is reported
+// in DBStat while it holds the write lock. Read transactions are limited by
+// Options.MaxOpenReaders and Options.MaxReaderDuration.
+func (db *DB) BeginLabeled(write bool, label string) (*Tx, error) {
+	if write && db.dal.readOnly {
+		return nil, db.dal.errReadOnly()
+	}
+	ownerID := goroutineID()
+	if !db.acquireOwner(ownerID) {
+		return nil, ErrNestedTransaction
+	}
 	if write {
+		if db.stall != nil {
+			if err := db.stall.check(int(db.writeQueue.Load())); err != nil {
+				db.releaseOwner(ownerID)
+				return nil, err
+			}
+		}
+		db.writeQueue.Add(1)
+		db.bucketWriters.Lock()
 		db.lock.Lock()
-	} else {
-		db.lock.RLock()
-		db.TxN.Add(1)
+		db.writeQueue.Add(-1)
+		db.setWriter(writerInfo{started: time.Now(), label: label})
+		tx := newTx(db, write, ownerID)
+		tx.changes = newChangeSet(db.getCommitHooks())
+		tx.validators = db.getValidators()
+		return tx, nil
+	}
+	tx := newTx(db, false, ownerID)
+	if err := db.acquireReader(tx); err != nil {
+		db.releaseOwner(ownerID)
+		return nil, err
+	}
+	db.lock.RLock()
+	db.TxN.Add(1)
+	db.startReader(tx)
+	return tx, nil
+}
+
+func (db *DB) setWriter(info writerInfo) {
+	db.writerLock.Lock()
+	defer db.writerLock.Unlock()
+	db.writer = info
+}
+
+func (db *DB) getWriter() writerInfo {
+	db.writerLock.Lock()
+	defer db.writerLock.Unlock()
+	return db.writer
+}
+
+func (db *DB) acquireOwner(ownerID int64) bool {
+	db.ownersLock.Lock()
+	defer db.ownersLock.Unlock()
+	if _, ok := db.owners[ownerID]; ok {
+		return false
 	}
-	return newTx(db, write)
+	db.owners[ownerID] = struct{}{}
+	return true
+}
+
+func (db *DB) releaseOwner(ownerID int64) {
+	db.ownersLock.Lock()
+	defer db.ownersLock.Unlock()
+	delete(db.owners, ownerID)
 }
 
-func (db *DB) View(fn func(tx *Tx) error) error {
-	tx := db.Begin(false)
+func (db *DB) View(fn func(tx *Tx) error) (err error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
-	if err := fn(tx); err != nil {
+	defer db.recoverPanic(&err)
+	if err = fn(tx); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
 func (db *DB) Update(fn func(tx *Tx) error) error {
-	tx := db.Begin(true)
+	return db.UpdateLabeled("", fn)
+}
+
+// UpdateLabeled works as Update, the label is reported in DBStat while the transaction runs
+func (db *DB) UpdateLabeled(label string, fn func(tx *Tx) error) (err error) {
+	tx, err := db.BeginLabeled(true, label)
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
-	if err := fn(tx); err != nil {
+	defer db.recoverPanic(&err)
+	if err = fn(tx); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
-func (db *DB) Stat() *DBStat {
-	freePages := int(db.dal.freelist.maxPages-db.dal.freelist.currentPage) + len(db.dal.freelist.releasedPages)
-	freelistPages := len(db.dal.freelist.freelistPages)
-	usedPages := int(db.dal.freelist.currentPage) + freelistPages
-	releasedPages := len(db.dal.freelist.releasedPages)
-	totalPages := int(db.dal.freelist.maxPages)
+// recoverPanic is deferred by the functions running a transaction function, after the
+// rollback so it runs first. The rollback happens whether the panic is recovered or not.
+func (db *DB) recoverPanic(err *error) {
+	if !db.dal.opts.RecoverPanics {
+		return
+	}
+	if r := recover(); r != nil {
+		logger.Error("transaction function panicked", "panic", r, "stack", string(debug.Stack()))
+		*err = fmt.Errorf("%w: %v", ErrTxPanic, r)
+	}
+}
 
-	bucketStats := make(map[string]*BucketStat)
+// Stat reports page usage and counters, bucket stats are collected unless disabled with WithBuckets.
+// Nested buckets are listed by the path of names joined with a slash, like users/42/sessions.
+func (db *DB) Stat(opts ...StatOption) *DBStat {
+	cfg := statConfig{buckets: true}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	// page counts are published at commit, a running writer is not waited for
+	usage := &db.dal.usage
+	freePages := int(usage.freePages.Load())
+	freelistPages := int(usage.freelistPages.Load())
+	usedPages := int(usage.usedPages.Load())
+	releasedPages := int(usage.releasedPages.Load())
+	totalPages := int(usage.totalPages.Load())
 
-	_ = db.View(func(tx *Tx) error {
-		buckets := tx.Buckets()
-		for _, bucketName := range buckets {
-			bucket, err := tx.GetBucket(bucketName)
-			if err != nil {
-				continue
+	var bucketStats map[string]*BucketStat
+	var invalidBuckets []string
+	bucketsComplete := false
+	if cfg.buckets {
+		bucketStats = make(map[string]*BucketStat)
+		// Stat must not wait for a stuck writer, bucket stats are skipped while the lock is taken
+		bucketsComplete, _ = db.tryView(func(tx *Tx) error {
+			buckets, invalid := tx.bucketNames()
+			for _, name := range invalid {
+				invalidBuckets = append(invalidBuckets, string(name))
 			}
-			bucketStats[string(bucketName)] = &BucketStat{
-				ItemsN:     bucket.itemsN,
-				BlobsN:     bucket.blobsN,
-				BytesInUse: bucket.bytesInUse,
+			for _, bucketName := range slices.DeleteFunc(buckets, IsInternalBucket) {
+				bucket, err := tx.GetBucket(bucketName)
+				if err != nil {
+					continue
+				}
+				bucketStats[string(bucketName)] = bucket.stat()
+				if err = bucket.nestedStats(string(bucketName), bucketStats); err != nil {
+					logger.Warn("skipping nested buckets", "bucket", string(bucketName), "error", err)
+				}
 			}
-		}
-		return nil
-	})
+			return nil
+		})
+	}
 
 	stat := &DBStat{
 		TotalPageNum:  totalPages,
@@ -111,12 +364,56 @@ func (db *DB) Stat() *DBStat {
 		TotalDBSize:   uint64(totalPages) * db.dal.meta.pageSize,
 		AvailDBSize:   uint64(freePages) * db.dal.meta.pageSize,
 		UsedDBSize:    uint64(usedPages) * db.dal.meta.pageSize,
+		MaxDBSize:     db.dal.opts.MaxSize,
 		Buckets:       bucketStats,
 		TxN:           int(db.TxN.Load()),
+		SyncMode:      db.dal.opts.SyncMode,
+		DirectIO:      db.dal.directIO,
+
+		BucketsComplete: bucketsComplete,
+		InvalidBuckets:  invalidBuckets,
+		WriteQueueDepth: int(db.writeQueue.Load()),
+		Commit:          db.CommitStats(),
+		Durability:      db.DurabilityInfo(),
+		WriteStall:      db.WriteStall(),
+		SoftLimits:      db.SoftLimits(),
+	}
+	stat.Warnings = stat.SoftLimits.Warnings
+	stat.LastCommit = unixNanoTime(usage.lastCommit.Load())
+	stat.LastCommitTime = time.Duration(usage.lastCommitDur.Load())
+	if ra := db.dal.readAhead; ra != nil {
+		stat.ReadAheadPages = ra.prefetched.Load()
+		stat.ReadAheadUsedPages = ra.used.Load()
+	}
+	stat.Snapshots, stat.SnapshotPages = db.dal.snapshots.stats()
+	if writer := db.getWriter(); !writer.started.IsZero() {
+		stat.WriterHeldFor = time.Since(writer.started)
+		stat.WriterLabel = writer.label
 	}
 	return stat
 }
 
+// tryView runs fn in a read transaction only if the lock can be taken without waiting
+func (db *DB) tryView(fn func(tx *Tx) error) (bool, error) {
+	ownerID := goroutineID()
+	if !db.acquireOwner(ownerID) {
+		return false, ErrNestedTransaction
+	}
+	if !db.lock.TryRLock() {
+		db.releaseOwner(ownerID)
+		return false, nil
+	}
+	db.TxN.Add(1)
+	tx := newTx(db, false, ownerID)
+	defer tx.Rollback()
+	return true, fn(tx)
+}
+
+// FormatVersion returns the on-disk format version stored in the meta page
+func (db *DB) FormatVersion() (major byte, minor byte) {
+	return db.dal.meta.GetDbVersion()
+}
+
 func (db *DB) GetOptions() *Options {
 	return db.dal.opts
 }
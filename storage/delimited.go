@@ -0,0 +1,122 @@
+package storage
+
+import "bytes"
+
+// DelimitedList is one page of a directory-style listing
+type DelimitedList struct {
+	Keys           [][]byte // keys under the prefix without a delimiter after it
+	CommonPrefixes [][]byte // the prefix up to and including the first delimiter after it, once per group
+	Next           []byte   // last returned key or common prefix when more entries follow, nil on the last page
+	Sizes          []int    // value size of every key in Keys, filled by ListDelimitedSizes only
+}
+
+// ListDelimited lists keys under the prefix the way S3 lists objects: keys with the delimiter
+// after the prefix are grouped into one common prefix per next level. A group costs a single
+// seek, the keys inside it are not visited. limit counts keys and common prefixes together.
+func (bucket *Bucket) ListDelimited(prefix, delimiter []byte, limit int) (DelimitedList, error) {
+	return bucket.ListDelimitedAfter(prefix, delimiter, nil, limit)
+}
+
+// ListDelimitedAfter continues ListDelimited after startAfter, usually DelimitedList.Next
+// of the previous page. A startAfter inside a group skips the rest of the group, a common
+// prefix is never returned twice.
+func (bucket *Bucket) ListDelimitedAfter(prefix, delimiter, startAfter []byte, limit int) (DelimitedList, error) {
+	return bucket.listDelimited(prefix, delimiter, startAfter, limit, false)
+}
+
+// ListDelimitedSizes is ListDelimitedAfter with the value sizes of the keys, see ItemInfo.
+// The values are not read.
+func (bucket *Bucket) ListDelimitedSizes(prefix, delimiter, startAfter []byte, limit int) (DelimitedList, error) {
+	return bucket.listDelimited(prefix, delimiter, startAfter, limit, true)
+}
+
+func (bucket *Bucket) listDelimited(prefix, delimiter, startAfter []byte, limit int, withSizes bool) (DelimitedList, error) {
+	var list DelimitedList
+	if limit <= 0 {
+		return list, ErrInvalidLimit
+	}
+	if bucket.tx == nil {
+		return list, ErrTxClosed
+	}
+	cursor := bucket.Cursor()
+	cursor.rawValues = true // only keys and sizes are listed, blobs are not read
+	var k []byte
+	group := bucket.commonPrefix(startAfter, prefix, delimiter)
+	switch {
+	case startAfter == nil || bytes.Compare(startAfter, prefix) < 0:
+		k, _ = cursor.Seek(prefix)
+	case group != nil:
+		k = bucket.seekPast(cursor, group)
+	default:
+		k, _ = cursor.Seek(startAfter)
+		if bytes.Equal(k, startAfter) {
+			k, _ = cursor.Next()
+		}
+	}
+
+	n := 0
+	var last []byte
+	for k != nil && bytes.HasPrefix(k, prefix) {
+		if n == limit {
+			list.Next = last
+			break
+		}
+		n++
+		if group = bucket.commonPrefix(k, prefix, delimiter); group != nil {
+			last = bytes.Clone(group)
+			list.CommonPrefixes = append(list.CommonPrefixes, last)
+			k = bucket.seekPast(cursor, last)
+			continue
+		}
+		last = bytes.Clone(k)
+		list.Keys = append(list.Keys, last)
+		if withSizes {
+			info, err := cursor.ItemInfo()
+			if err != nil {
+				return DelimitedList{}, err
+			}
+			list.Sizes = append(list.Sizes, info.Size)
+		}
+		k, _ = cursor.Next()
+	}
+	if err := cursor.Err(); err != nil {
+		return DelimitedList{}, err
+	}
+	return list, nil
+}
+
+// commonPrefix returns the key up to and including the first delimiter after the prefix,
+// nil if the key has none
+func (bucket *Bucket) commonPrefix(key, prefix, delimiter []byte) []byte {
+	if len(delimiter) == 0 || !bytes.HasPrefix(key, prefix) {
+		return nil
+	}
+	i := bytes.Index(key[len(prefix):], delimiter)
+	if i < 0 {
+		return nil
+	}
+	return key[:len(prefix)+i+len(delimiter)]
+}
+
+// seekPast moves the cursor to the first key that does not start with the group
+func (bucket *Bucket) seekPast(cursor *Cursor, group []byte) []byte {
+	end := prefixEnd(group)
+	if end == nil {
+		return nil // only 0xff bytes, every following key starts with the group
+	}
+	k, _ := cursor.Seek(end)
+	return k
+}
+
+// prefixEnd returns the smallest key greater than every key starting with the prefix,
+// nil if there is none
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
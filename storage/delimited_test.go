@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// listDelimitedReference lists by visiting every key, ListDelimited must agree with it
+func listDelimitedReference(keys [][]byte, prefix, delimiter []byte) (entries [][]byte, groups map[string]bool) {
+	groups = make(map[string]bool)
+	for _, key := range keys {
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := bytes.Index(key[len(prefix):], delimiter); len(delimiter) > 0 && i >= 0 {
+			group := key[:len(prefix)+i+len(delimiter)]
+			if !groups[string(group)] {
+				groups[string(group)] = true
+				entries = append(entries, group)
+			}
+			continue
+		}
+		entries = append(entries, key)
+	}
+	return entries, groups
+}
+
+func TestListDelimited(t *testing.T) {
+	db, _ := createTestDB(t)
+
+	keys := [][]byte{
+		[]byte("a"), []byte("a/"), []byte("a//"), []byte("a/b"), []byte("a/b/"), []byte("a/b/c"),
+		[]byte("a/bc"), []byte("a/b/c/d/e"), []byte("ab"), []byte("a\xff"), []byte("a/\xff/x"),
+		[]byte("a/\xff\xff"), []byte("b::c::d"), []byte("b::c"), []byte("b:"), []byte("\xff/\xff"),
+	}
+	// a deep and wide hierarchy, so groups span several leaves
+	for i := range 30 {
+		for j := range 20 {
+			keys = append(keys, []byte(fmt.Sprintf("a/dir%02d/sub%02d/file", i, j)))
+			keys = append(keys, []byte(fmt.Sprintf("a/dir%02d/file%02d", i, j)))
+		}
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = bucket.Put(key, []byte("value")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		prefix    string
+		delimiter string
+	}{
+		{"", "/"},
+		{"a", "/"},
+		{"a/", "/"},
+		{"a/b", "/"},
+		{"a/b/", "/"},
+		{"a/dir07/", "/"},
+		{"a/\xff", "/"},
+		{"b", "::"},
+		{"", ""},
+		{"a/", "sub"},
+		{"zzz", "/"},
+	}
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		for _, tt := range tests {
+			prefix, delimiter := []byte(tt.prefix), []byte(tt.delimiter)
+			want, groups := listDelimitedReference(keys, prefix, delimiter)
+			for _, limit := range []int{1, 2, 7, 1000} {
+				t.Run(fmt.Sprintf("%q %q %d", tt.prefix, tt.delimiter, limit), func(t *testing.T) {
+					var got [][]byte
+					list, err := bucket.ListDelimited(prefix, delimiter, limit)
+					for {
+						require.NoError(t, err)
+						require.LessOrEqual(t, len(list.Keys)+len(list.CommonPrefixes), limit)
+						for _, group := range list.CommonPrefixes {
+							require.True(t, groups[string(group)], "unexpected group %q", group)
+						}
+						page := append(slices.Clone(list.Keys), list.CommonPrefixes...)
+						slices.SortFunc(page, bytes.Compare)
+						got = append(got, page...)
+						if list.Next == nil {
+							break
+						}
+						require.Equal(t, got[len(got)-1], list.Next)
+						list, err = bucket.ListDelimitedAfter(prefix, delimiter, list.Next, limit)
+					}
+					require.Equal(t, want, got)
+				})
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestListDelimitedStartAfterInsideGroup(t *testing.T) {
+	db, _ := createTestDB(t)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"a/b/1", "a/b/2", "a/c", "a/d/1"} {
+			if err = bucket.Put([]byte(key), []byte("value")); err != nil {
+				return err
+			}
+		}
+		list, err := bucket.ListDelimitedAfter([]byte("a/"), []byte("/"), []byte("a/b/1"), 10)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("a/c")}, list.Keys)
+		require.Equal(t, [][]byte{[]byte("a/d/")}, list.CommonPrefixes)
+		require.Nil(t, list.Next)
+		require.Nil(t, list.Sizes)
+
+		require.NoError(t, bucket.Put([]byte("a/e"), make([]byte, 3*BTreePageSize)))
+		list, err = bucket.ListDelimitedSizes([]byte("a/"), []byte("/"), []byte("a/b/1"), 10)
+		require.NoError(t, err)
+		require.Equal(t, [][]byte{[]byte("a/c"), []byte("a/e")}, list.Keys)
+		require.Equal(t, []int{5, 3 * BTreePageSize}, list.Sizes)
+
+		_, err = bucket.ListDelimited(nil, []byte("/"), 0)
+		require.ErrorIs(t, err, ErrInvalidLimit)
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	require.Equal(t, []byte("a0"), prefixEnd([]byte("a/")))
+	require.Equal(t, []byte("b"), prefixEnd([]byte("a\xff\xff")))
+	require.Nil(t, prefixEnd([]byte("\xff\xff")))
+	require.Nil(t, prefixEnd(nil))
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// DiffKind tells how a key differs between the buckets of a diff
+type DiffKind string
+
+const (
+	DiffOnlyInA DiffKind = "only_in_a"
+	DiffOnlyInB DiffKind = "only_in_b"
+	DiffChanged DiffKind = "changed" // the key is in both buckets with different values
+)
+
+// DiffEntry is a key that differs between the buckets
+type DiffEntry struct {
+	Key  []byte
+	Kind DiffKind
+}
+
+// DiffOptions limits a bucket diff
+type DiffOptions struct {
+	Start        []byte                      // first key compared, nil starts at the first key
+	End          []byte                      // keys from End on are not compared, nil runs to the last key
+	MaxEntries   int                         // differences kept in DiffReport.Entries, 0 keeps all, counting goes on
+	BlobSizeOnly bool                        // blobs of the same size are taken as equal without reading them
+	OnDiff       func(entry DiffEntry) error // called for every difference instead of keeping it, an error stops the diff
+}
+
+// DiffReport counts the differences between two buckets
+type DiffReport struct {
+	Compared  int // keys present in both buckets
+	OnlyInA   int
+	OnlyInB   int
+	Changed   int
+	Entries   []DiffEntry // empty with DiffOptions.OnDiff
+	Truncated bool        // there were more differences than DiffOptions.MaxEntries
+}
+
+// Equal reports whether no difference was found
+func (report *DiffReport) Equal() bool {
+	return report.OnlyInA == 0 && report.OnlyInB == 0 && report.Changed == 0
+}
+
+func (report *DiffReport) add(entry DiffEntry, opts *DiffOptions) error {
+	switch entry.Kind {
+	case DiffOnlyInA:
+		report.OnlyInA++
+	case DiffOnlyInB:
+		report.OnlyInB++
+	case DiffChanged:
+		report.Changed++
+	}
+	// cursor keys point into nodes of the transaction
+	entry.Key = bytes.Clone(entry.Key)
+	if opts.OnDiff != nil {
+		return opts.OnDiff(entry)
+	}
+	if opts.MaxEntries > 0 && len(report.Entries) == opts.MaxEntries {
+		report.Truncated = true
+		return nil
+	}
+	report.Entries = append(report.Entries, entry)
+	return nil
+}
+
+// DiffBuckets compares the bucket called name in two transactions, usually of two databases,
+// by walking both trees with cursors side by side. Inline values are compared as stored,
+// blobs are compared by size first and read only when the sizes match. Values that both
+// carry checksums (see Options.ValueChecksums) are compared by checksum.
+func DiffBuckets(txA, txB *Tx, name []byte, opts DiffOptions) (DiffReport, error) {
+	var report DiffReport
+	bucketA, err := txA.GetBucket(name)
+	if err != nil {
+		return report, fmt.Errorf("bucket a: %w", err)
+	}
+	bucketB, err := txB.GetBucket(name)
+	if err != nil {
+		return report, fmt.Errorf("bucket b: %w", err)
+	}
+	cursorA, cursorB := bucketA.Cursor(), bucketB.Cursor()
+	cursorA.rawValues, cursorB.rawValues = true, true
+	kA, vA := diffFirst(cursorA, opts.Start)
+	kB, vB := diffFirst(cursorB, opts.Start)
+	inRange := func(k []byte) bool {
+		return k != nil && (opts.End == nil || bytes.Compare(k, opts.End) < 0)
+	}
+	for err == nil {
+		var order int
+		switch a, b := inRange(kA), inRange(kB); {
+		case !a && !b:
+			return report, diffCursorsErr(cursorA, cursorB)
+		case !b:
+			order = -1
+		case !a:
+			order = 1
+		default:
+			order = bytes.Compare(kA, kB)
+		}
+		switch {
+		case order < 0:
+			err = report.add(DiffEntry{Key: kA, Kind: DiffOnlyInA}, &opts)
+			kA, vA = cursorA.Next()
+		case order > 0:
+			err = report.add(DiffEntry{Key: kB, Kind: DiffOnlyInB}, &opts)
+			kB, vB = cursorB.Next()
+		default:
+			report.Compared++
+			var equal bool
+			if equal, err = equalValues(txA, vA, txB, vB, opts.BlobSizeOnly); err == nil && !equal {
+				err = report.add(DiffEntry{Key: kA, Kind: DiffChanged}, &opts)
+			}
+			kA, vA = cursorA.Next()
+			kB, vB = cursorB.Next()
+		}
+	}
+	return report, err
+}
+
+func diffFirst(cursor *Cursor, start []byte) ([]byte, []byte) {
+	if start == nil {
+		return cursor.First()
+	}
+	return cursor.Seek(start)
+}
+
+func diffCursorsErr(cursorA, cursorB *Cursor) error {
+	if err := cursorA.Err(); err != nil {
+		return fmt.Errorf("bucket a: %w", err)
+	}
+	if err := cursorB.Err(); err != nil {
+		return fmt.Errorf("bucket b: %w", err)
+	}
+	return nil
+}
+
+// equalValues compares two encoded item values, a blob is read only when the size of the
+// other value matches and the values do not both carry checksums
+func equalValues(txA *Tx, a []byte, txB *Tx, b []byte, blobSizeOnly bool) (bool, error) {
+	itemA, itemB := &Item{Value: a}, &Item{Value: b}
+	typeA, err := itemA.valueType()
+	if err != nil {
+		return false, fmt.Errorf("bucket a: %w", err)
+	}
+	typeB, err := itemB.valueType()
+	if err != nil {
+		return false, fmt.Errorf("bucket b: %w", err)
+	}
+	if typeA == ValueSimple && typeB == ValueSimple {
+		payloadA, err := itemA.payload()
+		if err != nil {
+			return false, fmt.Errorf("bucket a: %w", err)
+		}
+		payloadB, err := itemB.payload()
+		if err != nil {
+			return false, fmt.Errorf("bucket b: %w", err)
+		}
+		return bytes.Equal(payloadA, payloadB), nil
+	}
+	sizeA, err := valueSize(txA, itemA)
+	if err != nil {
+		return false, fmt.Errorf("bucket a: %w", err)
+	}
+	sizeB, err := valueSize(txB, itemB)
+	if err != nil {
+		return false, fmt.Errorf("bucket b: %w", err)
+	}
+	if sizeA != sizeB {
+		return false, nil
+	}
+	if blobSizeOnly && typeA == ValueBlob && typeB == ValueBlob {
+		return true, nil
+	}
+	sumA, okA := itemA.checksum()
+	sumB, okB := itemB.checksum()
+	if okA && okB {
+		return sumA == sumB, nil
+	}
+	valueA, err := itemA.getValue(txA)
+	if err != nil {
+		return false, fmt.Errorf("bucket a: %w", err)
+	}
+	valueB, err := itemB.getValue(txB)
+	if err != nil {
+		return false, fmt.Errorf("bucket b: %w", err)
+	}
+	return bytes.Equal(valueA, valueB), nil
+}
+
+// valueSize returns the size of an encoded item value, the first page of a blob is read only
+// for references written before 0.12
+func valueSize(tx *Tx, item *Item) (int, error) {
+	valueType, err := item.valueType()
+	if err != nil {
+		return 0, err
+	}
+	payload, err := item.payload()
+	if err != nil {
+		return 0, err
+	}
+	switch valueType {
+	case ValueSimple:
+		return len(payload), nil
+	case ValueBlob:
+		if size, ok := blobRefDataSize(payload); ok {
+			return size, nil
+		}
+		return getBlobSize(tx, binary.LittleEndian.Uint64(payload))
+	case ValueBucket:
+		return 0, nil
+	}
+	return 0, ErrUnknownItemType
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBuckets(t *testing.T) {
+	dbA, _ := createTestDB(t)
+	dbB, _ := createTestDB(t)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key_%04d", i)) }
+	blob := func(fill byte) []byte { return bytes.Repeat([]byte{fill}, 3*BTreePageSize) }
+	fill := func(db *DB, fn func(bucket *Bucket) error) {
+		require.NoError(t, db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 1000; i++ {
+				if err = bucket.Put(key(i), key(i)); err != nil {
+					return err
+				}
+			}
+			if err = bucket.Put([]byte("blob_same"), blob('a')); err != nil {
+				return err
+			}
+			return fn(bucket)
+		}))
+	}
+	fill(dbA, func(bucket *Bucket) error {
+		if err := bucket.Put([]byte("blob_content"), blob('a')); err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("blob_size"), blob('a')); err != nil {
+			return err
+		}
+		if err := bucket.Put(key(10), []byte("changed")); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("only_a"), []byte("a"))
+	})
+	fill(dbB, func(bucket *Bucket) error {
+		if err := bucket.Put([]byte("blob_content"), blob('b')); err != nil {
+			return err
+		}
+		if err := bucket.Put([]byte("blob_size"), []byte("small")); err != nil {
+			return err
+		}
+		if err := bucket.Remove(key(500)); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("zz_only_b"), []byte("b"))
+	})
+
+	diff := func(opts DiffOptions) DiffReport {
+		var report DiffReport
+		require.NoError(t, dbA.View(func(txA *Tx) error {
+			return dbB.View(func(txB *Tx) error {
+				var err error
+				report, err = DiffBuckets(txA, txB, []byte("foo"), opts)
+				return err
+			})
+		}))
+		return report
+	}
+
+	report := diff(DiffOptions{})
+	require.Equal(t, DiffReport{
+		Compared: 1002,
+		OnlyInA:  2,
+		OnlyInB:  1,
+		Changed:  3,
+		Entries: []DiffEntry{
+			{Key: []byte("blob_content"), Kind: DiffChanged},
+			{Key: []byte("blob_size"), Kind: DiffChanged},
+			{Key: key(10), Kind: DiffChanged},
+			{Key: key(500), Kind: DiffOnlyInA},
+			{Key: []byte("only_a"), Kind: DiffOnlyInA},
+			{Key: []byte("zz_only_b"), Kind: DiffOnlyInB},
+		},
+	}, report)
+	require.False(t, report.Equal())
+
+	// same size blobs are not read
+	report = diff(DiffOptions{BlobSizeOnly: true, MaxEntries: 2})
+	require.Equal(t, 2, report.Changed)
+	require.Equal(t, []DiffEntry{{Key: []byte("blob_size"), Kind: DiffChanged}, {Key: key(10), Kind: DiffChanged}}, report.Entries)
+	require.True(t, report.Truncated)
+
+	report = diff(DiffOptions{Start: key(0), End: key(500)})
+	require.Equal(t, DiffReport{Compared: 500, Changed: 1, Entries: []DiffEntry{{Key: key(10), Kind: DiffChanged}}}, report)
+	report = diff(DiffOptions{Start: key(11), End: key(500)})
+	require.True(t, report.Equal())
+
+	var streamed []DiffEntry
+	report = diff(DiffOptions{OnDiff: func(entry DiffEntry) error {
+		streamed = append(streamed, entry)
+		return nil
+	}})
+	require.Len(t, streamed, 6)
+	require.Empty(t, report.Entries)
+	stop := errors.New("stop")
+	require.NoError(t, dbA.View(func(txA *Tx) error {
+		return dbB.View(func(txB *Tx) error {
+			_, err := DiffBuckets(txA, txB, []byte("foo"), DiffOptions{OnDiff: func(DiffEntry) error { return stop }})
+			require.ErrorIs(t, err, stop)
+			_, err = DiffBuckets(txA, txB, []byte("missing"), DiffOptions{})
+			require.ErrorIs(t, err, ErrBucketNotFound)
+			return nil
+		})
+	}))
+}
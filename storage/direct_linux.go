@@ -0,0 +1,10 @@
+//go:build linux
+
+package storage
+
+import "syscall"
+
+const (
+	directIOSupported = true
+	directIOFlag      = syscall.O_DIRECT
+)
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package storage
+
+const (
+	directIOSupported = false
+	directIOFlag      = 0
+)
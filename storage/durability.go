@@ -0,0 +1,59 @@
+package storage
+
+import "time"
+
+// RecoveryInfo is the outcome of the tx log replay done when the database was opened
+type RecoveryInfo struct {
+	RecoverySummary
+	At    time.Time // zero if recovery is disabled or the database file was created
+	Error string    // replay error, records before the failed one were applied
+}
+
+// DurabilityInfo describes the tx log and the recovery state of the database
+type DurabilityInfo struct {
+	SyncMode        SyncMode
+	RecoveryEnabled bool
+	TxLogPath       string
+	TxLogSize       int64
+	LastSync        time.Time // last fsync of the database file, zero if none since open
+	LastTxLogSync   time.Time // last fsync of the tx log, zero if none since open
+	CleanShutdown   bool      // the database was closed before it was opened this time
+	Recovery        RecoveryInfo
+}
+
+// DurabilityInfo returns the tx log and recovery state
+func (db *DB) DurabilityInfo() DurabilityInfo {
+	dal := db.dal
+	return DurabilityInfo{
+		SyncMode:        dal.opts.SyncMode,
+		RecoveryEnabled: dal.opts.EnableRecovery,
+		TxLogPath:       dal.opts.TxLogPath,
+		TxLogSize:       dal.txLog.size(),
+		LastSync:        unixNanoTime(dal.lastSync.Load()),
+		LastTxLogSync:   unixNanoTime(dal.txLog.lastSync.Load()),
+		CleanShutdown:   dal.cleanShutdown,
+		Recovery:        dal.recovery,
+	}
+}
+
+// Sync fsyncs the database file and drops the tx log records it made durable. In SyncInterval
+// and SyncNever modes commits reach stable storage only with it.
+func (db *DB) Sync() error {
+	if db.dal.readOnly {
+		return db.dal.errReadOnly()
+	}
+	// the write lock is taken, a goroutine holding a transaction would deadlock
+	ownerID := goroutineID()
+	if !db.acquireOwner(ownerID) {
+		return ErrNestedTransaction
+	}
+	defer db.releaseOwner(ownerID)
+	return db.syncAndRoll()
+}
+
+func unixNanoTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurabilityInfo(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions()
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	info := db.DurabilityInfo()
+	require.True(t, info.CleanShutdown)
+	require.True(t, info.RecoveryEnabled)
+	require.Equal(t, SyncAlways, info.SyncMode)
+	require.Equal(t, opts.TxLogPath, info.TxLogPath)
+	require.True(t, info.Recovery.At.IsZero(), "a new file is not recovered")
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	info = db.Stat().Durability
+	require.Positive(t, info.TxLogSize)
+	require.False(t, info.LastSync.IsZero())
+	require.False(t, info.LastTxLogSync.IsZero())
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, opts)
+	info = db.DurabilityInfo()
+	require.True(t, info.CleanShutdown)
+	require.False(t, info.Recovery.At.IsZero())
+	require.Equal(t, 1, info.Recovery.Records, "the log keeps the last commit")
+	require.Positive(t, info.Recovery.Pages)
+	require.Zero(t, info.Recovery.SkippedRecords)
+	require.Empty(t, info.Recovery.Error)
+	closeTestDB(t, db)
+}
+
+func TestDurabilityInfoAfterCrash(t *testing.T) {
+	filename := TempFileName(".db")
+	failpoints := NewFailpoints()
+	opts := DefaultOptions().WithFailpoints(failpoints)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	// the commit stops between the tx log and the database file, like a crash
+	failpoints.Enable(FailpointAfterTxLog, FailNth(1, errInjected))
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	})
+	require.ErrorIs(t, err, errInjected)
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, DefaultOptions())
+	info := db.DurabilityInfo()
+	require.False(t, info.CleanShutdown)
+	require.Equal(t, 1, info.Recovery.Records)
+	require.Greater(t, info.Recovery.Pages, 2)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		_, err := tx.GetBucket([]byte("foo"))
+		return err
+	}))
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, DefaultOptions())
+	require.True(t, db.DurabilityInfo().CleanShutdown)
+	closeTestDB(t, db)
+}
+
+func TestDurabilityInfoTruncatedLog(t *testing.T) {
+	db, filename := createTestDB(t)
+	txLogPath := db.dal.opts.TxLogPath
+	closeTestDB(t, db)
+
+	// a record header promising runs that were never written
+	header := make([]byte, txLogHeaderSize)
+	binary.LittleEndian.PutUint32(header[txLogMagicOffset:], txLogMagic)
+	binary.LittleEndian.PutUint16(header[txLogVersionOffset:], txLogVersion)
+	binary.LittleEndian.PutUint32(header[txLogNumRuns:], 3)
+	binary.LittleEndian.PutUint32(header[txLogPageSize:], BTreePageSize)
+	file, err := os.OpenFile(txLogPath, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = file.Write(header)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	db = openTestDB(t, filename, DefaultOptions())
+	recovery := db.DurabilityInfo().Recovery
+	require.Zero(t, recovery.Records, "the new database has no commits")
+	require.Equal(t, 1, recovery.SkippedRecords)
+	require.EqualValues(t, txLogHeaderSize, recovery.SkippedBytes)
+	require.Contains(t, recovery.Error, "truncated")
+}
+
+func TestSync(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithSyncMode(SyncInterval).WithSyncInterval(time.Hour)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	info := db.DurabilityInfo()
+	require.Positive(t, info.TxLogSize)
+	require.NoError(t, db.Sync())
+	require.True(t, db.DurabilityInfo().LastSync.After(info.LastSync))
+	require.Zero(t, db.DurabilityInfo().TxLogSize, "synced records are dropped")
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.ErrorIs(t, db.Sync(), ErrNestedTransaction)
+		return nil
+	}))
+	closeTestDB(t, db)
+}
@@ -8,14 +8,59 @@ var (
 	ErrKeyTooLarge          = errors.New("key too large")
 	ErrValueTooLarge        = errors.New("value too large")
 	ErrNotEnoughSpace       = errors.New("not enough space to serialize node")
+	ErrNodeFieldOverflow    = errors.New("node count or length does not fit its encoding")
 	ErrNoPagesLeft          = errors.New("no pages left")
 	ErrBucketNotFound       = errors.New("bucket not found")
 	ErrBucketExists         = errors.New("bucket already exists")
+	ErrIncompatibleValue    = errors.New("key holds a nested bucket where a value is expected or the other way round")
+	ErrReservedBucketName   = errors.New("bucket name is reserved")
 	ErrTxClosed             = errors.New("transaction closed")
 	ErrWriteInRxTransaction = errors.New("write in read transaction")
 	ErrNodeNotFound         = errors.New("node not found")
+	ErrKeyNotFound          = errors.New("key not found")
 	ErrBlobTooLarge         = errors.New("blob too large")
 	ErrUnknownItemType      = errors.New("unknown item type")
-	ErrBadDbVersion         = errors.New("invalid db version")
+	ErrNewerFormat          = errors.New("database file has a newer format")
+	ErrOlderFormat          = errors.New("database file has an unsupported older format")
+	ErrNotADatabase         = errors.New("file is not a pirindb database")
+	ErrTruncatedDatabase    = errors.New("database file is truncated")
+	ErrBadBucketValue       = errors.New("invalid bucket value")
 	ErrBadDbName            = errors.New("invalid db name")
+	ErrNestedTransaction    = errors.New("nested transaction in the same goroutine")
+	ErrBadSyncMode          = errors.New("invalid sync mode")
+	ErrBadSyncInterval      = errors.New("sync interval must be positive")
+	ErrUnsafeSyncMode       = errors.New("sync mode never requires AllowUnsafeSync option")
+	ErrCorrupted            = errors.New("database is corrupted")
+	ErrFreelistCorrupted    = errors.New("freelist is corrupted")
+	ErrBadDirectIOPageSize  = errors.New("direct io requires page size multiple of 4096")
+	ErrPartialPage          = errors.New("direct io requires full page writes")
+	ErrBadLogKeyMode        = errors.New("invalid log key mode")
+	ErrPrefixTooLarge       = errors.New("prefix too large")
+	ErrTooManyPrefixRules   = errors.New("too many prefix rules")
+	ErrPrefixExpired        = errors.New("key is under an expired prefix rule")
+	ErrBadBucketOptions     = errors.New("invalid bucket options")
+	ErrTooManyReaders       = errors.New("too many open read transactions")
+	ErrBadReaderLimits      = errors.New("reader limits must not be negative")
+	ErrBadAdvisorOptions    = errors.New("advisor options must not be negative")
+	ErrBadWriteStall        = errors.New("write stall limits must not be negative")
+	ErrWriteStalled         = errors.New("writes stalled")
+	ErrInvalidLimit         = errors.New("limit must be positive")
+	ErrBadScanToken         = errors.New("invalid scan token")
+	ErrPageOutOfRange       = errors.New("page number out of range")
+	ErrDatabaseLocked       = errors.New("database file is locked")
+	ErrTxLogCorrupted       = errors.New("tx log record is corrupted")
+	ErrTxLogMismatch        = errors.New("tx log does not belong to the database file")
+	ErrQuotaExceeded        = errors.New("quota exceeded")
+	ErrReadOnly             = errors.New("database is opened read only")
+	ErrChecksumMismatch     = errors.New("value checksum mismatch")
+	ErrBlobFileMissing      = errors.New("blob file of the database is missing")
+	ErrValueRejected        = errors.New("value rejected by the bucket validator")
+	ErrDatabaseNotFound     = errors.New("database file does not exist")
+	ErrDatabaseExists       = errors.New("database file already exists")
+	ErrBadOpenMode          = errors.New("must exist and must create are mutually exclusive")
+	ErrBlobFileNotCopied    = errors.New("blobs kept in a blob file are not copied")
+	ErrTxPanic              = errors.New("transaction function panicked")
+	ErrBadDelimiter         = errors.New("delimiter must not be empty")
+	ErrMigrationRequired    = errors.New("database file has an older format that needs a migration")
+	ErrBadSoftLimits        = errors.New("soft limits must not be negative, the size ratio at most 1")
 )
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/timson/pirindb/storage/keys"
+)
+
+// eventsBucketName is the internal bucket of the bucket events, an event is stored as JSON
+// under the bucket name and its clock timestamp, see eventKey
+var eventsBucketName = []byte(InternalBucketPrefix + "events")
+
+// statEvents is the number of the newest events in BucketStat.Events
+const statEvents = 3
+
+// BucketEventType tells what happened to a bucket
+type BucketEventType string
+
+const (
+	EventCreated          BucketEventType = "created"
+	EventDropped          BucketEventType = "dropped" // deleted, or purged from the trash
+	EventTrashed          BucketEventType = "trashed"
+	EventRestored         BucketEventType = "restored"
+	EventQuotaChanged     BucketEventType = "quota_changed"
+	EventRetentionChanged BucketEventType = "retention_changed"
+)
+
+// EmbeddedActor is the actor of the events of a transaction without one, see Tx.SetActor
+const EmbeddedActor = "embedded"
+
+// BucketEvent is a change of a bucket recorded in the events bucket by the transaction that
+// made it. Timestamp is taken from the hybrid logical clock of the database, the events of a
+// bucket are ordered by it.
+type BucketEvent struct {
+	Time      time.Time       `json:"time"`
+	Timestamp uint64          `json:"hlc"`
+	Bucket    string          `json:"bucket"`
+	Type      BucketEventType `json:"type"`
+	Actor     string          `json:"actor"`
+	Detail    string          `json:"detail,omitempty"`
+}
+
+// SetActor names who makes the changes of the transaction in its bucket events, like the
+// user or the client address of a request. The events of a transaction without an actor
+// carry EmbeddedActor.
+func (tx *Tx) SetActor(actor string) {
+	tx.actor = actor
+}
+
+// recordEvent queues an event of the bucket for writeEvents, internal buckets record none
+func (tx *Tx) recordEvent(name []byte, eventType BucketEventType, detail string) {
+	if IsInternalBucket(name) {
+		return
+	}
+	actor := tx.actor
+	if actor == "" {
+		actor = EmbeddedActor
+	}
+	timestamp := tx.db.clock.Now()
+	tx.events = append(tx.events, BucketEvent{
+		Time:      keys.ClockTime(timestamp),
+		Timestamp: timestamp,
+		Bucket:    string(name),
+		Type:      eventType,
+		Actor:     actor,
+		Detail:    detail,
+	})
+}
+
+// writeEvents puts the queued events into the events bucket, created with the first event.
+// Commit calls it holding the database lock exclusively, so the bucket transactions of
+// different buckets write the events bucket one after the other.
+func (tx *Tx) writeEvents() error {
+	if len(tx.events) == 0 {
+		return nil
+	}
+	bucket, err := tx.getBucket(eventsBucketName)
+	if errors.Is(err, ErrBucketNotFound) {
+		bucket, err = tx.createBucket(eventsBucketName)
+	}
+	if err != nil {
+		return err
+	}
+	for _, event := range tx.events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(eventKey([]byte(event.Bucket), event.Timestamp), value); err != nil {
+			return err
+		}
+	}
+	tx.events = nil
+	return nil
+}
+
+// eventKey is the composite key of the bucket name and the event timestamp
+func eventKey(name []byte, timestamp uint64) []byte {
+	return keys.Encode(name, keys.Uint64(timestamp))
+}
+
+// BucketEvents returns up to limit events of the bucket, the newest first. The events of a
+// deleted bucket are kept, the events of the transaction are written on commit.
+func (tx *Tx) BucketEvents(name []byte, limit int) ([]BucketEvent, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	if err := tx.enter(); err != nil {
+		return nil, err
+	}
+	defer tx.leave()
+	return tx.bucketEvents(name, limit)
+}
+
+func (tx *Tx) bucketEvents(name []byte, limit int) ([]BucketEvent, error) {
+	// not kept by a write transaction, only writeEvents writes the events bucket in its commit
+	bucket, err := tx.loadBucket(eventsBucketName)
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := keys.Encode(name)
+	cursor := bucket.Cursor()
+	// the newest event of the bucket is the last key before the keys of the next name
+	k, v := cursor.seek(prefixEnd(prefix))
+	if k == nil {
+		k, v = cursor.last()
+	} else {
+		k, v = cursor.prev()
+	}
+	var events []BucketEvent
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(events) < limit; k, v = cursor.prev() {
+		var event BucketEvent
+		if err = json.Unmarshal(v, &event); err != nil {
+			return nil, fmt.Errorf("%w: bucket event %q: %v", ErrCorrupted, k, err)
+		}
+		events = append(events, event)
+	}
+	return events, cursor.Err()
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func eventTypes(events []BucketEvent) []BucketEventType {
+	types := make([]BucketEventType, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestBucketEvents(t *testing.T) {
+	db, _ := createTestDB(t)
+	orders := []byte("orders")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		tx.SetActor("10.0.0.1")
+		bucket, err := tx.CreateBucket(orders)
+		require.NoError(t, err)
+		require.NoError(t, bucket.SetQuota(BucketQuota{MaxKeys: 10}))
+		// written on commit
+		events, err := tx.BucketEvents(orders, 10)
+		require.NoError(t, err)
+		require.Empty(t, events)
+		return nil
+	}))
+	// a bucket transaction records the events of its bucket too
+	require.NoError(t, db.UpdateBucket(orders, func(bucket *Bucket) error {
+		return bucket.SetRetention(time.Hour, RetainGeneratedKeys)
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucketSoft(orders)
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.RestoreBucket(orders)
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucketSoft(orders)
+	}))
+	_, err := db.PurgeTrash(time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, db.Put(orders, []byte("k"), []byte("v")))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucket(orders)
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		events, err := tx.BucketEvents(orders, 100)
+		require.NoError(t, err)
+		require.Equal(t, []BucketEventType{
+			EventDropped, EventCreated, EventDropped, EventTrashed, EventRestored,
+			EventTrashed, EventRetentionChanged, EventQuotaChanged, EventCreated,
+		}, eventTypes(events))
+		for i, event := range events {
+			require.Equal(t, "orders", event.Bucket)
+			require.WithinDuration(t, time.Now(), event.Time, time.Minute)
+			if i > 0 {
+				require.Less(t, event.Timestamp, events[i-1].Timestamp)
+			}
+		}
+		require.Equal(t, "10.0.0.1", events[8].Actor)
+		require.Equal(t, "max_keys=10 max_bytes=0", events[7].Detail)
+		require.Equal(t, EmbeddedActor, events[6].Actor)
+		require.Equal(t, "purged from the trash", events[2].Detail)
+
+		events, err = tx.BucketEvents(orders, 2)
+		require.NoError(t, err)
+		require.Equal(t, []BucketEventType{EventDropped, EventCreated}, eventTypes(events))
+		_, err = tx.BucketEvents(orders, 0)
+		require.ErrorIs(t, err, ErrInvalidLimit)
+		events, err = tx.BucketEvents([]byte("order"), 10)
+		require.NoError(t, err)
+		require.Empty(t, events)
+
+		// the events bucket is internal
+		require.Empty(t, tx.Buckets())
+		stats, _, err := tx.BucketStatsPage(nil, 10)
+		require.NoError(t, err)
+		require.Empty(t, stats)
+		return nil
+	}))
+	require.Empty(t, db.Stat().Buckets)
+	require.NoError(t, db.Check())
+}
+
+func TestBucketStatEvents(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Put([]byte("orders"), []byte("k"), []byte("v")))
+	require.NoError(t, db.UpdateBucket([]byte("orders"), func(bucket *Bucket) error {
+		for i := 1; i <= 5; i++ {
+			if err := bucket.SetQuota(BucketQuota{MaxKeys: uint64(i)}); err != nil {
+				return err
+			}
+		}
+		// reading the events in a write transaction does not keep the events bucket
+		events, err := bucket.tx.BucketEvents(bucket.name, 10)
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		require.NotContains(t, bucket.tx.dirtyBuckets, string(eventsBucketName))
+		return nil
+	}))
+	stat := db.Stat().Buckets["orders"]
+	require.Len(t, stat.Events, statEvents)
+	require.Equal(t, "max_keys=5 max_bytes=0", stat.Events[0].Detail)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		stats, _, err := tx.BucketStatsPage(nil, 10)
+		require.NoError(t, err)
+		require.Len(t, stats, 1)
+		require.Equal(t, stat.Events, stats[0].Events)
+		return nil
+	}))
+}
+
+func TestInternalBuckets(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket(eventsBucketName)
+		require.ErrorIs(t, err, ErrReservedBucketName)
+		// applications may keep their own internal buckets
+		bucket, err := tx.CreateBucket([]byte("__app"))
+		require.NoError(t, err)
+		require.ErrorIs(t, bucket.SetQuota(BucketQuota{MaxKeys: 1}), ErrReservedBucketName)
+		_, err = tx.CreateBucket([]byte("users"))
+		return err
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Equal(t, [][]byte{[]byte("users")}, tx.Buckets())
+		for name := range tx.AllBuckets() {
+			require.Equal(t, "users", string(name))
+		}
+		_, err := tx.GetBucket([]byte("__app"))
+		require.NoError(t, err)
+		events, err := tx.BucketEvents([]byte("__app"), 10)
+		require.NoError(t, err)
+		require.Empty(t, events)
+		return nil
+	}))
+	require.True(t, IsInternalBucket([]byte("__app")))
+	require.False(t, IsInternalBucket([]byte("_app")))
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"sync"
+	"time"
+)
+
+// Failpoint names a hook site in the storage engine. Failpoints are meant for tests,
+// they are checked only when Options.Failpoints is set.
+type Failpoint string
+
+const (
+	// FailpointAllocatePage fires before a page is taken from the freelist
+	FailpointAllocatePage Failpoint = "allocate-page"
+	// FailpointBlobSave fires before a blob page chain is written
+	FailpointBlobSave Failpoint = "blob-save"
+	// FailpointBeforeTxLog fires on commit before the tx log record is started
+	FailpointBeforeTxLog Failpoint = "before-txlog"
+	// FailpointTxLogPageWrite fires before every run of adjacent pages is appended to the tx log
+	FailpointTxLogPageWrite Failpoint = "txlog-page-write"
+	// FailpointTxLogSync fires before the tx log is fsynced
+	FailpointTxLogSync Failpoint = "txlog-sync"
+	// FailpointAfterTxLog fires after the tx log record is complete, before the database file writes
+	FailpointAfterTxLog Failpoint = "after-txlog"
+	// FailpointPageWrite fires before every run of adjacent pages is written to the database file
+	FailpointPageWrite Failpoint = "page-write"
+	// FailpointFreelistWrite fires before the freelist is written, to the tx log or the database file
+	FailpointFreelistWrite Failpoint = "freelist-write"
+	// FailpointMetaWrite fires before the meta page is written, to the tx log or the database file
+	FailpointMetaWrite Failpoint = "meta-write"
+	// FailpointSync fires before the database file is fsynced
+	FailpointSync Failpoint = "sync"
+	// FailpointPageRead fires before a page is read from the file, by readers and writers.
+	// It is not reached in a fixed place of a commit and is not part of AllFailpoints.
+	FailpointPageRead Failpoint = "page-read"
+)
+
+// AllFailpoints lists every hook site in the order they are reached by a commit
+var AllFailpoints = []Failpoint{
+	FailpointAllocatePage,
+	FailpointBlobSave,
+	FailpointBeforeTxLog,
+	FailpointTxLogPageWrite,
+	FailpointTxLogSync,
+	FailpointAfterTxLog,
+	FailpointFreelistWrite,
+	FailpointMetaWrite,
+	FailpointPageWrite,
+	FailpointSync,
+}
+
+// FailpointHook is called every time its site is reached, hit counts from 1.
+// A non nil error fails the operation at the site.
+type FailpointHook func(hit int) error
+
+// Failpoints is a registry of hooks, safe for concurrent use
+type Failpoints struct {
+	lock  sync.Mutex
+	hooks map[Failpoint]FailpointHook
+	hits  map[Failpoint]int
+}
+
+func NewFailpoints() *Failpoints {
+	return &Failpoints{
+		hooks: make(map[Failpoint]FailpointHook),
+		hits:  make(map[Failpoint]int),
+	}
+}
+
+// Enable installs the hook at the site and resets its hit counter
+func (fp *Failpoints) Enable(name Failpoint, hook FailpointHook) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.hooks[name] = hook
+	fp.hits[name] = 0
+}
+
+func (fp *Failpoints) Disable(name Failpoint) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	delete(fp.hooks, name)
+}
+
+// Hits returns how many times the site was reached since it was enabled
+func (fp *Failpoints) Hits(name Failpoint) int {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	return fp.hits[name]
+}
+
+// trigger runs the hook installed at the site, a nil registry is a no-op
+func (fp *Failpoints) trigger(name Failpoint) error {
+	if fp == nil {
+		return nil
+	}
+	fp.lock.Lock()
+	hook, ok := fp.hooks[name]
+	if ok {
+		fp.hits[name]++
+	}
+	hit := fp.hits[name]
+	fp.lock.Unlock()
+	if !ok {
+		return nil
+	}
+	// the hook runs unlocked, so a delay does not block other sites
+	return hook(hit)
+}
+
+// FailNth returns a hook failing only the nth hit with err
+func FailNth(n int, err error) FailpointHook {
+	return func(hit int) error {
+		if hit == n {
+			return err
+		}
+		return nil
+	}
+}
+
+// Delay returns a hook sleeping for d on every hit
+func Delay(d time.Duration) FailpointHook {
+	return func(hit int) error {
+		time.Sleep(d)
+		return nil
+	}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errInjected = errors.New("injected failure")
+
+var crashBlob = bytes.Repeat([]byte("blob"), 1500)
+
+// crashBaseline commits the data every crash case starts from
+func crashBaseline(tx *Tx) error {
+	bucket, err := tx.CreateBucket([]byte("users"))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 50; i++ {
+		if err = bucket.Put([]byte(fmt.Sprintf("key-%02d", i)), []byte(fmt.Sprintf("value-%d", i))); err != nil {
+			return err
+		}
+	}
+	return bucket.Put([]byte("blob-old"), crashBlob)
+}
+
+// crashWorkload is the transaction interrupted by failpoints, it touches every commit phase:
+// updates and deletes, node splits, blob chains and a new bucket
+func crashWorkload(tx *Tx) error {
+	bucket, err := tx.GetBucket([]byte("users"))
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put([]byte("key-00"), []byte("updated")); err != nil {
+		return err
+	}
+	if err = bucket.Remove([]byte("key-01")); err != nil {
+		return err
+	}
+	for i := 0; i < 50; i++ {
+		if err = bucket.Put([]byte(fmt.Sprintf("new-%02d", i)), bytes.Repeat([]byte("n"), 64)); err != nil {
+			return err
+		}
+	}
+	if err = bucket.Put([]byte("blob-new"), crashBlob); err != nil {
+		return err
+	}
+	orders, err := tx.CreateBucket([]byte("orders"))
+	if err != nil {
+		return err
+	}
+	return orders.Put([]byte("id"), []byte("1"))
+}
+
+// requireCrashState asserts the database holds either the baseline or the baseline with
+// the whole workload applied, and reports which one
+func requireCrashState(t *testing.T, db *DB) (applied bool) {
+	require.NoError(t, db.Check())
+	err := db.View(func(tx *Tx) error {
+		_, err := tx.GetBucket([]byte("orders"))
+		applied = err == nil
+
+		bucket, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		for i := 2; i < 50; i++ {
+			value, found := bucket.Get([]byte(fmt.Sprintf("key-%02d", i)))
+			require.True(t, found)
+			require.Equal(t, []byte(fmt.Sprintf("value-%d", i)), value)
+		}
+		value, found := bucket.Get([]byte("blob-old"))
+		require.True(t, found)
+		require.Equal(t, crashBlob, value)
+
+		value, _ = bucket.Get([]byte("key-00"))
+		_, key01Found := bucket.Get([]byte("key-01"))
+		_, blobFound := bucket.Get([]byte("blob-new"))
+		newFound := 0
+		for i := 0; i < 50; i++ {
+			if _, found = bucket.Get([]byte(fmt.Sprintf("new-%02d", i))); found {
+				newFound++
+			}
+		}
+		if applied {
+			require.Equal(t, []byte("updated"), value)
+			require.False(t, key01Found)
+			require.True(t, blobFound)
+			require.Equal(t, 50, newFound)
+		} else {
+			require.Equal(t, []byte("value-0"), value)
+			require.True(t, key01Found)
+			require.False(t, blobFound)
+			require.Zero(t, newFound)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return applied
+}
+
+// runCrashCase fails the nth hit of the failpoint during the workload, reopens the
+// database with recovery and checks it. It returns false if the failpoint was not reached.
+func runCrashCase(t *testing.T, name Failpoint, n int) bool {
+	filename := TempFileName(".db")
+	failpoints := NewFailpoints()
+	opts := DefaultOptions().WithFailpoints(failpoints)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	require.NoError(t, db.Update(crashBaseline))
+
+	failpoints.Enable(name, FailNth(n, errInjected))
+	err := db.Update(crashWorkload)
+	reached := failpoints.Hits(name) >= n
+	if reached {
+		require.ErrorIs(t, err, errInjected)
+	} else {
+		require.NoError(t, err)
+	}
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, DefaultOptions())
+	applied := requireCrashState(t, db)
+	if !reached {
+		require.True(t, applied)
+	}
+	return reached
+}
+
+func TestCrashMatrix(t *testing.T) {
+	for _, name := range AllFailpoints {
+		for n := 1; ; n++ {
+			reached := false
+			t.Run(fmt.Sprintf("%s/%d", name, n), func(t *testing.T) {
+				reached = runCrashCase(t, name, n)
+			})
+			if t.Failed() {
+				return
+			}
+			if !reached {
+				require.Greater(t, n, 1, "failpoint %s is never reached", name)
+				break
+			}
+		}
+	}
+}
+
+func TestFailpointDelaySync(t *testing.T) {
+	filename := TempFileName(".db")
+	failpoints := NewFailpoints()
+	opts := DefaultOptions().WithFailpoints(failpoints)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+
+	failpoints.Enable(FailpointSync, Delay(50*time.Millisecond))
+	started := time.Now()
+	require.NoError(t, db.Update(crashBaseline))
+	require.GreaterOrEqual(t, time.Since(started), 50*time.Millisecond)
+	require.Equal(t, 1, failpoints.Hits(FailpointSync))
+
+	failpoints.Disable(FailpointSync)
+	require.NoError(t, db.Update(crashWorkload))
+	require.Equal(t, 1, failpoints.Hits(FailpointSync))
+	require.True(t, requireCrashState(t, db))
+}
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// go test ./storage -run=TestFormatGolden -update-golden
+var updateGolden = flag.Bool("update-golden", false, "regenerate the golden database files in testdata")
+
+// goldenVersions are the format minor versions with a golden file, a version is only added
+// here, never removed, while the code still reads it. -update-golden rewrites the file of the
+// current version only, older files stay as the code of their version wrote them. The 0.2
+// file was derived from a 0.3 file with writeFlatFreelist, the only difference of 0.2.
+var goldenVersions = []byte{2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+func goldenFileName(minor byte) string {
+	return filepath.Join("testdata", fmt.Sprintf("format_%d.%d.db", dbVersionMajor, minor))
+}
+
+// goldenFixture is the content of every golden file, bucket name to keys and values
+func goldenFixture() map[string]map[string][]byte {
+	inline := make(map[string][]byte)
+	for i := range 300 {
+		inline[fmt.Sprintf("key_%04d", i)] = []byte(fmt.Sprintf("value_%04d", i))
+	}
+	return map[string]map[string][]byte{
+		"inline": inline,
+		"blobs": {
+			"blob_1": bytes.Repeat([]byte("1"), 3*BTreePageSize),
+			"small":  []byte("small"),
+		},
+		"options": {
+			"forced": bytes.Repeat([]byte("f"), 100),
+		},
+	}
+}
+
+// writeGoldenDB writes the fixture with the current code, removing a blob leaves free pages
+// in the freelist. Values carry checksums since 0.5.
+func writeGoldenDB(t *testing.T, filename string) {
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithValueChecksums(true, false)
+	t.Cleanup(func() { _ = os.Remove(opts.TxLogPath) })
+	db, err := Open(filename, opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		for name, items := range goldenFixture() {
+			var bucket *Bucket
+			if name == "options" {
+				bucket, err = tx.CreateBucketWithOptions([]byte(name), BucketOptions{ForceBlobsAbove: 64})
+				if err == nil {
+					err = bucket.SetQuota(BucketQuota{MaxKeys: 10})
+				}
+			} else {
+				bucket, err = tx.CreateBucket([]byte(name))
+			}
+			if err != nil {
+				return err
+			}
+			for key, value := range items {
+				if err = bucket.Put([]byte(key), value); err != nil {
+					return err
+				}
+			}
+		}
+		bucket, err := tx.GetBucket([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob_2"), bytes.Repeat([]byte("2"), 3*BTreePageSize))
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		return bucket.Remove([]byte("blob_2"))
+	}))
+	require.NotZero(t, db.dal.freelist.releasedN)
+	require.NoError(t, db.Close())
+}
+
+// setFormatVersion overwrites the format version in the meta page of a closed database
+func setFormatVersion(t *testing.T, filename string, major, minor byte) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, file.Close()) }()
+	version := make([]byte, metaDbVersionSize)
+	binary.LittleEndian.PutUint16(version, uint16(major)<<8|uint16(minor))
+	_, err = file.WriteAt(version, int64(metaDbVersionOffset))
+	require.NoError(t, err)
+}
+
+// copyGolden copies a golden file to a temp file, opening a database changes its file
+func copyGolden(t *testing.T, minor byte) string {
+	data, err := os.ReadFile(goldenFileName(minor))
+	require.NoError(t, err, "golden file of format %d.%d is missing, run with -update-golden", dbVersionMajor, minor)
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	require.NoError(t, os.WriteFile(filename, data, 0600))
+	return filename
+}
+
+func verifyGoldenDB(t *testing.T, db *DB) {
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		for name, items := range goldenFixture() {
+			bucket, err := tx.GetBucket([]byte(name))
+			require.NoError(t, err, "bucket %s", name)
+			require.EqualValues(t, len(items), bucket.stat().ItemsN, "bucket %s", name)
+			count := 0
+			require.NoError(t, bucket.ForEach(func(k, v []byte) error {
+				require.Equal(t, items[string(k)], v, "bucket %s key %s", name, k)
+				count++
+				return nil
+			}))
+			require.Equal(t, len(items), count, "bucket %s", name)
+			// files before 0.7 have no counts in their nodes, the subtrees are walked
+			total, err := bucket.CountRange(nil, nil)
+			require.NoError(t, err)
+			require.EqualValues(t, len(items), total, "bucket %s", name)
+		}
+		bucket, err := tx.GetBucket([]byte("options"))
+		require.NoError(t, err)
+		require.Equal(t, BucketOptions{ForceBlobsAbove: 64}, bucket.Options())
+		require.Equal(t, BucketQuota{MaxKeys: 10}, bucket.Quota())
+		return nil
+	}))
+}
+
+func TestFormatGolden(t *testing.T) {
+	if *updateGolden {
+		filename := goldenFileName(dbVersionMinor)
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+		_ = os.Remove(filename)
+		writeGoldenDB(t, filename)
+	}
+	require.Equal(t, byte(dbVersionMinor), goldenVersions[len(goldenVersions)-1],
+		"add a golden file for the current format version")
+	require.Equal(t, byte(dbVersionMinorOldest), goldenVersions[0])
+
+	for _, golden := range goldenVersions {
+		t.Run(fmt.Sprintf("%d.%d", dbVersionMajor, golden), func(t *testing.T) {
+			filename := copyGolden(t, golden)
+			var steps []MigrationStep
+			opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithValueChecksums(false, true).
+				WithAutoMigrate(true, func(step MigrationStep) { steps = append(steps, step) })
+			t.Cleanup(func() {
+				_ = os.Remove(opts.TxLogPath)
+				_ = os.Remove(fmt.Sprintf("%s.meta-%d.%d.bak", filename, dbVersionMajor, golden))
+			})
+			db := openTestDB(t, filename, opts)
+			major, minor := db.FormatVersion()
+			require.Equal(t, []byte{dbVersionMajor, dbVersionMinor}, []byte{major, minor})
+			require.Len(t, steps, dbVersionMinor-int(golden))
+			for i, step := range steps {
+				require.Equal(t, fmt.Sprintf("%d.%d", dbVersionMajor, int(golden)+i+1), step.Version)
+				require.Equal(t, len(steps), step.Steps)
+			}
+			verifyGoldenDB(t, db)
+			id := db.dal.meta.id
+			require.NotZero(t, id, "the migration assigns a database id")
+			require.NoError(t, db.View(func(tx *Tx) error {
+				bucket, err := tx.GetBucket([]byte("inline"))
+				require.NoError(t, err)
+				root, err := tx.getNode(bucket.root)
+				require.NoError(t, err)
+				require.False(t, root.isLeaf())
+				require.True(t, root.counted(), "internal nodes are counted by the migration")
+				return nil
+			}))
+			if golden < dbVersionMinor {
+				backup, err := os.ReadFile(fmt.Sprintf("%s.meta-%d.%d.bak", filename, dbVersionMajor, golden))
+				require.NoError(t, err)
+				meta := &Meta{}
+				meta.Deserialize(backup)
+				require.Equal(t, fmt.Sprintf("%d.%d", dbVersionMajor, golden), meta.GetDbVersionString())
+			}
+
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				bucket, err := tx.GetBucket([]byte("inline"))
+				if err != nil {
+					return err
+				}
+				for i := range 100 {
+					if err = bucket.Put([]byte(fmt.Sprintf("new_%04d", i)), []byte("new")); err != nil {
+						return err
+					}
+				}
+				_, err = bucket.DeletePrefix([]byte("new_"))
+				return err
+			}))
+			closeTestDB(t, db)
+			// a migrated file opens without running the migrations again
+			steps = nil
+			db = openTestDB(t, filename, opts)
+			require.Empty(t, steps)
+			major, minor = db.FormatVersion()
+			require.Equal(t, []byte{dbVersionMajor, dbVersionMinor}, []byte{major, minor})
+			require.Equal(t, id, db.dal.meta.id)
+			verifyGoldenDB(t, db)
+			closeTestDB(t, db)
+		})
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	require.Len(t, migrations, dbVersionMinor-dbVersionMinorOldest)
+	for i, step := range migrations {
+		require.EqualValues(t, dbVersionMinorOldest+i+1, step.minor, "migration %s", step.name)
+	}
+}
+
+func TestOpenMigrationRequired(t *testing.T) {
+	filename := copyGolden(t, dbVersionMinorOldest)
+	before, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	txLogPath := TempFileName(".tlog")
+	t.Cleanup(func() { _ = os.Remove(txLogPath) })
+
+	_, err = Open(filename, DefaultOptions().WithTxLogPath(txLogPath))
+	require.ErrorIs(t, err, ErrMigrationRequired)
+	require.ErrorContains(t, err, fmt.Sprintf("%s has format %d.%d, this build writes %d.%d, run pirindb migrate %s",
+		filename, dbVersionMajor, dbVersionMinorOldest, dbVersionMajor, dbVersionMinor, filename))
+	after, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(before, after), "a refused file must not change")
+	require.NoFileExists(t, txLogPath)
+
+	var versions []string
+	steps, err := Migrate(filename, DefaultOptions().WithTxLogPath(txLogPath), func(step MigrationStep) {
+		versions = append(versions, step.Version)
+	})
+	require.NoError(t, err)
+	require.Equal(t, dbVersionMinor-dbVersionMinorOldest, steps)
+	require.Len(t, versions, steps)
+	require.Equal(t, fmt.Sprintf("%d.%d", dbVersionMajor, dbVersionMinor), versions[len(versions)-1])
+	backup := fmt.Sprintf("%s.meta-%d.%d.bak", filename, dbVersionMajor, dbVersionMinorOldest)
+	t.Cleanup(func() { _ = os.Remove(backup) })
+	require.FileExists(t, backup)
+
+	steps, err = Migrate(filename, DefaultOptions().WithTxLogPath(txLogPath), nil)
+	require.NoError(t, err)
+	require.Zero(t, steps)
+	db := openTestDB(t, filename, DefaultOptions().WithTxLogPath(txLogPath))
+	verifyGoldenDB(t, db)
+	closeTestDB(t, db)
+}
+
+// a step that fails leaves the file at the version of the last committed step, the next
+// open runs the rest
+func TestMigrationInterrupted(t *testing.T) {
+	filename := copyGolden(t, 6)
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog")).WithAutoMigrate(true, nil)
+	t.Cleanup(func() {
+		_ = os.Remove(opts.TxLogPath)
+		_ = os.Remove(filename + ".meta-0.6.bak")
+	})
+	injected := errors.New("injected migration failure")
+	failing := migrations[len(migrations)-1]
+	migrations[len(migrations)-1].run = func(tx *Tx) error { return injected }
+	t.Cleanup(func() { migrations[len(migrations)-1] = failing })
+
+	_, err := Open(filename, opts)
+	require.ErrorIs(t, err, injected)
+	require.ErrorContains(t, err, fmt.Sprintf("migration to %d.%d (%s)", dbVersionMajor, failing.minor, failing.name))
+	_, err = Open(filename, DefaultOptions().WithTxLogPath(opts.TxLogPath))
+	require.ErrorIs(t, err, ErrMigrationRequired)
+	require.ErrorContains(t, err, fmt.Sprintf("has format %d.%d,", dbVersionMajor, failing.minor-1))
+
+	migrations[len(migrations)-1] = failing
+	db := openTestDB(t, filename, opts)
+	major, minor := db.FormatVersion()
+	require.Equal(t, []byte{dbVersionMajor, dbVersionMinor}, []byte{major, minor})
+	verifyGoldenDB(t, db)
+	closeTestDB(t, db)
+}
+
+func TestOpenRefusedFormat(t *testing.T) {
+	tests := []struct {
+		name         string
+		major, minor byte
+		err          error
+		message      string
+	}{
+		{"newer minor", dbVersionMajor, dbVersionMinor + 1, ErrNewerFormat,
+			fmt.Sprintf("file format %d.%d, this build reads %d.%d to %d.%d", dbVersionMajor, dbVersionMinor+1,
+				dbVersionMajor, dbVersionMinorOldest, dbVersionMajor, dbVersionMinor)},
+		{"newer major", dbVersionMajor + 1, 0, ErrNewerFormat, fmt.Sprintf("file format %d.0", dbVersionMajor+1)},
+		{"older minor", dbVersionMajor, dbVersionMinorOldest - 1, ErrOlderFormat,
+			fmt.Sprintf("file format %d.%d", dbVersionMajor, dbVersionMinorOldest-1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := copyGolden(t, dbVersionMinor)
+			setFormatVersion(t, filename, tt.major, tt.minor)
+			before, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			txLogPath := TempFileName(".tlog")
+
+			_, err = Open(filename, DefaultOptions().WithTxLogPath(txLogPath))
+			require.ErrorIs(t, err, tt.err)
+			require.ErrorContains(t, err, tt.message)
+
+			after, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(before, after), "a refused file must not change")
+			require.NoFileExists(t, txLogPath)
+		})
+	}
+
+	// a short file is not grown to the minimal database size
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	require.NoError(t, os.WriteFile(filename, []byte("not a database"), 0600))
+	_, err := Open(filename, nil)
+	require.ErrorIs(t, err, ErrNotADatabase)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, []byte("not a database"), data)
+}
+
+func TestOpenNotADatabase(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		message string
+	}{
+		{"empty", nil, " is empty or zero filled"},
+		{"zero filled", make([]byte, 64*1024), " is empty or zero filled"},
+		{"foreign", bytes.Repeat([]byte("SQLite format 3\x00"), 4096), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := TempFileName(".db")
+			t.Cleanup(func() { _ = os.Remove(filename) })
+			require.NoError(t, os.WriteFile(filename, tt.data, 0600))
+
+			_, err := Open(filename, nil)
+			require.ErrorIs(t, err, ErrNotADatabase)
+			require.ErrorContains(t, err, filename+tt.message)
+			data, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(tt.data, data), "a refused file must not change")
+		})
+	}
+}
+
+func TestOpenMode(t *testing.T) {
+	filename := TempFileName(".db")
+	txLogPath := TempFileName(".tlog")
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(txLogPath)
+	})
+
+	_, err := Open(filename, DefaultOptions().WithTxLogPath(txLogPath).WithMustExist(true))
+	require.ErrorIs(t, err, ErrDatabaseNotFound)
+	require.ErrorContains(t, err, filename)
+	require.NoFileExists(t, filename, "a refused open creates nothing")
+	require.NoFileExists(t, txLogPath)
+	_, err = Open(filename, DefaultOptions().WithMustExist(true).WithMustCreate(true))
+	require.ErrorIs(t, err, ErrBadOpenMode)
+
+	db, err := Open(filename, DefaultOptions().WithTxLogPath(txLogPath).WithMustCreate(true))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = Open(filename, DefaultOptions().WithTxLogPath(txLogPath).WithMustCreate(true))
+	require.ErrorIs(t, err, ErrDatabaseExists)
+	db, err = Open(filename, DefaultOptions().WithTxLogPath(txLogPath).WithMustExist(true))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestOpenTruncatedDatabase(t *testing.T) {
+	golden, err := os.ReadFile(goldenFileName(dbVersionMinor))
+	require.NoError(t, err)
+	// below the minimal file size and below the size declared by the freelist
+	for _, size := range []int{4 * BTreePageSize, len(golden) - BTreePageSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			filename := TempFileName(".db")
+			t.Cleanup(func() { _ = os.Remove(filename) })
+			require.NoError(t, os.WriteFile(filename, golden[:size], 0600))
+			opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog"))
+			t.Cleanup(func() { _ = os.Remove(opts.TxLogPath) })
+
+			_, err := Open(filename, opts)
+			require.ErrorIs(t, err, ErrTruncatedDatabase)
+			require.ErrorContains(t, err, fmt.Sprintf("%s has %d bytes", filename, size))
+			data, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(golden[:size], data), "a refused file must not change")
+		})
+	}
+}
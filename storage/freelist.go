@@ -1,23 +1,33 @@
 package storage
 
 import (
+	"cmp"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"slices"
 )
 
 // Freelist first page map
-// 0            1                        9                        17                       25                       33                   ...
-// +------------+------------------------+------------------------+------------------------+------------------------+----------------------+
-// | Page Type  |      Next Page         |    Current Page        |      Max Pages         |  Num Freelist Entries  |   Freelist Entries   |
-// |  uint8     |       uint64           |        uint64          |        uint64          |        uint64          |   uint64[]           |
-// +------------+------------------------+------------------------+------------------------+------------------------+----------------------+
+// 0            1              9              17             25             33               37             41               ...
+// +------------+--------------+--------------+--------------+--------------+----------------+--------------+------------------+
+// | Page Type  |  Next Page   | Current Page |  Max Pages   | Num Entries  |  Page Entries  |   Checksum   | Freelist Entries |
+// |  uint8     |   uint64     |   uint64     |   uint64     |   uint64     |    uint32      |    uint32    |     uint64[]     |
+// +------------+--------------+--------------+--------------+--------------+----------------+--------------+------------------+
 
 // Freelist extra page map
-// 0            1                        9                   ...
-// +------------+------------------------+---------------------+
-// | Page Type  |      Next Page         |  Freelist Entries   |
-// |  uint8     |       uint64           |     uint64[]        |
-// +------------+------------------------+---------------------+
+// 0            1              9                13             17                 ...
+// +------------+--------------+----------------+--------------+------------------+
+// | Page Type  |  Next Page   |  Page Entries  |   Checksum   | Freelist Entries |
+// |  uint8     |   uint64     |    uint32      |    uint32    |     uint64[]     |
+// +------------+--------------+----------------+--------------+------------------+
+
+// Num Entries counts the entries of the whole chain, Page Entries those of the page. The
+// checksum is the CRC-32 of the page up to its last entry, the checksum field left out.
+// FreeListChecksummedPage pages hold pairs of entries, the first page of a run of free pages
+// and the run length. Files before 0.10 have no Page Entries and Checksum fields: their
+// FreeListRangesPage pages hold the same pairs and FreeListPage pages one entry per free
+// page, they are read but never written.
 
 const (
 	freelistPageTypeSize    = UInt8Size
@@ -25,20 +35,44 @@ const (
 	freelistCurrentPageSize = UInt64Size
 	freelistMaxPagesSize    = UInt64Size
 	freelistNumPagesSize    = UInt64Size
-
-	freelistPageTypeOffset         = 0
-	freelistNextPageOffset         = freelistPageTypeOffset + freelistPageTypeSize
-	freelistCurrentPageOffset      = freelistNextPageOffset + freelistNextPageSize
-	freelistMaxPagesOffset         = freelistCurrentPageOffset + freelistCurrentPageSize
-	freelistNumPagesOffset         = freelistMaxPagesOffset + freelistMaxPagesSize
-	freelistFirstPageEntriesOffset = freelistNumPagesOffset + freelistNumPagesSize
-	freelistExtraPageEntriesOffset = freelistNextPageOffset + freelistNextPageSize
+	freelistPageEntriesSize = UInt32Size
+	freelistChecksumSize    = UInt32Size
+
+	freelistPageTypeOffset              = 0
+	freelistNextPageOffset              = freelistPageTypeOffset + freelistPageTypeSize
+	freelistCurrentPageOffset           = freelistNextPageOffset + freelistNextPageSize
+	freelistMaxPagesOffset              = freelistCurrentPageOffset + freelistCurrentPageSize
+	freelistNumPagesOffset              = freelistMaxPagesOffset + freelistMaxPagesSize
+	freelistFirstPageEntriesCountOffset = freelistNumPagesOffset + freelistNumPagesSize
+	freelistFirstPageChecksumOffset     = freelistFirstPageEntriesCountOffset + freelistPageEntriesSize
+	freelistFirstPageEntriesOffset      = freelistFirstPageChecksumOffset + freelistChecksumSize
+	freelistExtraPageEntriesCountOffset = freelistNextPageOffset + freelistNextPageSize
+	freelistExtraPageChecksumOffset     = freelistExtraPageEntriesCountOffset + freelistPageEntriesSize
+	freelistExtraPageEntriesOffset      = freelistExtraPageChecksumOffset + freelistChecksumSize
+
+	freelistLegacyFirstPageEntriesOffset = freelistNumPagesOffset + freelistNumPagesSize
+	freelistLegacyExtraPageEntriesOffset = freelistNextPageOffset + freelistNextPageSize
+
+	freelistRangeEntries = 2 // start and length of a run
 )
 
+// pageRange is a run of free pages starting at start
+type pageRange struct {
+	start uint64
+	count uint64
+}
+
+func (r pageRange) end() uint64 {
+	return r.start + r.count
+}
+
 type Freelist struct {
 	currentPage         uint64
 	maxPages            uint64
-	releasedPages       []uint64
+	released            []pageRange // sorted, neither overlapping nor adjacent
+	releasedN           uint64      // pages in released
+	doubleFreed         uint64      // pages released while already free, reported by Check
+	held                []uint64    // freed while bucket snapshots are open, persisted as free but not reused
 	freelistPages       []uint64
 	entriesPerFirstPage int
 	entriesPerExtraPage int
@@ -50,7 +84,7 @@ func NewFreelist(pageSize uint64, maxPages uint64) *Freelist {
 	return &Freelist{
 		currentPage:         rootPageNumber,
 		maxPages:            maxPages,
-		releasedPages:       make([]uint64, 0),
+		released:            make([]pageRange, 0),
 		freelistPages:       make([]uint64, 0),
 		entriesPerFirstPage: entriesPerFirstPage,
 		entriesPerExtraPage: entriesPerExtraPage,
@@ -58,11 +92,18 @@ func NewFreelist(pageSize uint64, maxPages uint64) *Freelist {
 	}
 }
 
+// GetNextPageNumber reuses the lowest free page, so pages allocated together tend to be
+// adjacent and are written with a single call at commit
 func (f *Freelist) GetNextPageNumber() (uint64, error) {
 	f.dirty = true
-	if len(f.releasedPages) > 0 {
-		pageNum := f.releasedPages[len(f.releasedPages)-1]
-		f.releasedPages = f.releasedPages[:len(f.releasedPages)-1]
+	if len(f.released) > 0 {
+		pageNum := f.released[0].start
+		f.released[0].start++
+		f.released[0].count--
+		if f.released[0].count == 0 {
+			f.released = f.released[1:]
+		}
+		f.releasedN--
 		return pageNum, nil
 	}
 	if f.currentPage >= (f.maxPages - 1) {
@@ -73,10 +114,141 @@ func (f *Freelist) GetNextPageNumber() (uint64, error) {
 	return f.currentPage, nil
 }
 
-func (f *Freelist) ReleasePage(pageNum uint64) {
+// GetContiguousPages returns the first page of n adjacent pages, taken from the first free
+// run long enough or else from the end of the file
+func (f *Freelist) GetContiguousPages(n uint64) (uint64, error) {
+	if n == 0 {
+		return 0, fmt.Errorf("%w: empty page run", ErrPageOutOfRange)
+	}
+	for i := range f.released {
+		r := &f.released[i]
+		if r.count < n {
+			continue
+		}
+		f.dirty = true
+		start := r.start
+		r.start += n
+		r.count -= n
+		if r.count == 0 {
+			f.released = slices.Delete(f.released, i, i+1)
+		}
+		f.releasedN -= n
+		return start, nil
+	}
+	if f.currentPage+n > f.maxPages-1 {
+		return 0, ErrNoPagesLeft
+	}
 	f.dirty = true
+	start := f.currentPage + 1
+	f.currentPage += n
+	logger.Debug("freelist GetContiguousPages", "pageNum", start, "count", n)
+	return start, nil
+}
+
+func (f *Freelist) ReleasePage(pageNum uint64) {
 	logger.Debug("releasing pageNum", "pageNumber", pageNum)
-	f.releasedPages = append(f.releasedPages, pageNum)
+	f.ReleasePages([]uint64{pageNum})
+}
+
+// ReleasePages returns pages to the freelist, the pages are sorted and merged with the free
+// runs in one pass
+func (f *Freelist) ReleasePages(pageNums []uint64) {
+	if len(pageNums) == 0 {
+		return
+	}
+	f.dirty = true
+	sorted := slices.Clone(pageNums)
+	slices.Sort(sorted)
+	added := make([]pageRange, 0, 1)
+	for _, pageNum := range sorted {
+		if n := len(added); n > 0 && added[n-1].end() > pageNum {
+			f.doubleFreed++
+			continue
+		} else if n > 0 && added[n-1].end() == pageNum {
+			added[n-1].count++
+			continue
+		}
+		added = append(added, pageRange{start: pageNum, count: 1})
+	}
+	f.addRanges(added)
+}
+
+// addRanges merges sorted ranges into the free runs, pages already free are counted as double frees
+func (f *Freelist) addRanges(added []pageRange) {
+	merged := make([]pageRange, 0, len(f.released)+len(added))
+	push := func(r pageRange) {
+		n := len(merged)
+		if n == 0 || merged[n-1].end() < r.start {
+			merged = append(merged, r)
+			return
+		}
+		last := &merged[n-1]
+		if last.end() > r.start {
+			f.doubleFreed += min(last.end(), r.end()) - r.start
+		}
+		if r.end() > last.end() {
+			last.count = r.end() - last.start
+		}
+	}
+	i, j := 0, 0
+	for i < len(f.released) || j < len(added) {
+		if j == len(added) || (i < len(f.released) && f.released[i].start <= added[j].start) {
+			push(f.released[i])
+			i++
+		} else {
+			push(added[j])
+			j++
+		}
+	}
+	f.released = merged
+	f.releasedN = 0
+	for _, r := range merged {
+		f.releasedN += r.count
+	}
+}
+
+// hold keeps freed pages from reuse, open bucket snapshots may still read them
+func (f *Freelist) hold(pageNums []uint64) {
+	if len(pageNums) == 0 {
+		return
+	}
+	f.dirty = true
+	f.held = append(f.held, pageNums...)
+}
+
+// releaseHeld makes the held pages reusable once no snapshot reads them
+func (f *Freelist) releaseHeld() {
+	f.ReleasePages(f.held)
+	f.held = nil
+}
+
+// isFree reports whether the page is on the freelist
+func (f *Freelist) isFree(pageNum uint64) bool {
+	if slices.Contains(f.held, pageNum) {
+		return true
+	}
+	i, found := slices.BinarySearchFunc(f.released, pageNum, func(r pageRange, pageNum uint64) int {
+		return cmp.Compare(r.start, pageNum)
+	})
+	if found {
+		return true
+	}
+	return i > 0 && f.released[i-1].end() > pageNum
+}
+
+// entries returns the free runs as flat start and length pairs, held pages are written as
+// free too, snapshots do not survive a reopen
+func (f *Freelist) entries() []uint64 {
+	if len(f.held) > 0 {
+		merged := &Freelist{released: f.released}
+		merged.ReleasePages(f.held)
+		return merged.entries()
+	}
+	entries := make([]uint64, 0, len(f.released)*freelistRangeEntries)
+	for _, r := range f.released {
+		entries = append(entries, r.start, r.count)
+	}
+	return entries
 }
 
 func calculatePagesNeeded(numEntries, entriesPerFirstPage, entriesPerExtraPage int) int {
@@ -86,7 +258,7 @@ func calculatePagesNeeded(numEntries, entriesPerFirstPage, entriesPerExtraPage i
 	return 1 + (numEntries-entriesPerFirstPage+entriesPerExtraPage-1)/entriesPerExtraPage
 }
 
-// Reads entries from a freelist pageNum
+// Reads entries from a freelist page of a file before 0.10
 func readEntriesFromPage(page *Page, startPos int, maxEntries int, entries *[]uint64, remaining *uint64) uint64 {
 	pos := startPos
 	for i := 0; i < maxEntries && uint64(len(*entries)) < *remaining; i++ {
@@ -98,6 +270,38 @@ func readEntriesFromPage(page *Page, startPos int, maxEntries int, entries *[]ui
 	return binary.LittleEndian.Uint64(page.Data[1:]) // Return next pageNum number
 }
 
+// freelistPageChecksum is the CRC-32 of the page up to end without the checksum field
+func freelistPageChecksum(data []byte, checksumOffset int, end int) uint32 {
+	sum := crc32.ChecksumIEEE(data[:checksumOffset])
+	return crc32.Update(sum, crc32.IEEETable, data[checksumOffset+freelistChecksumSize:end])
+}
+
+// checksummedPageEntries returns the entries of a FreeListChecksummedPage page after checking
+// its entry count and checksum
+func checksummedPageEntries(page *Page, first bool, capacity int) ([]uint64, error) {
+	countOffset, checksumOffset, entriesOffset := freelistExtraPageEntriesCountOffset, freelistExtraPageChecksumOffset, freelistExtraPageEntriesOffset
+	if first {
+		countOffset, checksumOffset, entriesOffset = freelistFirstPageEntriesCountOffset, freelistFirstPageChecksumOffset, freelistFirstPageEntriesOffset
+	}
+	if page.Data[freelistPageTypeOffset] != FreeListChecksummedPage {
+		return nil, fmt.Errorf("%w: page %d is not a freelist page", ErrFreelistCorrupted, page.PageNumber)
+	}
+	n := int(binary.LittleEndian.Uint32(page.Data[countOffset:]))
+	if n > capacity {
+		return nil, fmt.Errorf("%w: page %d counts %d entries, it holds %d", ErrFreelistCorrupted, page.PageNumber, n, capacity)
+	}
+	end := entriesOffset + n*UInt64Size
+	stored := binary.LittleEndian.Uint32(page.Data[checksumOffset:])
+	if actual := freelistPageChecksum(page.Data, checksumOffset, end); actual != stored {
+		return nil, fmt.Errorf("%w: page %d checksum is %08x, the page has %08x", ErrFreelistCorrupted, page.PageNumber, stored, actual)
+	}
+	entries := make([]uint64, n)
+	for i := range entries {
+		entries[i] = binary.LittleEndian.Uint64(page.Data[entriesOffset+i*UInt64Size:])
+	}
+	return entries, nil
+}
+
 func writeEntriesToPage(page *Page, startPos int, entries []uint64, startIdx int, maxEntries int) int {
 	pos := startPos
 	entriesWritten := 0
@@ -110,33 +314,131 @@ func writeEntriesToPage(page *Page, startPos int, entries []uint64, startIdx int
 }
 
 func ReadFreelist(dal *Dal) (*Freelist, error) {
+	return readFreelistAt(dal, dal.meta.freelistPageNumber)
+}
+
+// readFreelistAt reads the freelist starting at firstPageNum, the blob file freelist is
+// stored in the main file like the freelist of the main file. A freelist that fails its
+// checks returns an error wrapping ErrFreelistCorrupted, its entries are not trusted.
+func readFreelistAt(dal *Dal, firstPageNum uint64) (*Freelist, error) {
 	freelist := NewFreelist(dal.meta.pageSize, 0)
-	freelist.freelistPages = []uint64{dal.meta.freelistPageNumber}
+	freelist.freelistPages = []uint64{firstPageNum}
 
 	// Read the primary freelist pageNum
-	firstPage, err := dal.GetPage(dal.meta.freelistPageNumber)
+	firstPage, err := dal.GetPage(firstPageNum)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get freelist pageNum: %w", err)
 	}
 
 	// Read metadata, skip next pageNum pointer for now
+	pageType := firstPage.Data[freelistPageTypeOffset]
 	freelist.currentPage = binary.LittleEndian.Uint64(firstPage.Data[freelistCurrentPageOffset:])
 	freelist.maxPages = binary.LittleEndian.Uint64(firstPage.Data[freelistMaxPagesOffset:])
-	numPages := binary.LittleEndian.Uint64(firstPage.Data[freelistNumPagesOffset:])
+	numEntries := binary.LittleEndian.Uint64(firstPage.Data[freelistNumPagesOffset:])
+
+	var entries []uint64
+	switch pageType {
+	case FreeListChecksummedPage:
+		entries, err = readChecksummedFreelist(dal, freelist, firstPage, numEntries)
+	case FreeListPage, FreeListRangesPage:
+		entries, err = readLegacyFreelist(dal, freelist, firstPage, numEntries)
+	case MetaPage:
+		// files before 0.10 closed before their first commit have an empty page
+		if dal.meta.dbVersion >= currentFormatVersion {
+			err = fmt.Errorf("%w: page %d is not a freelist page", ErrFreelistCorrupted, firstPageNum)
+			break
+		}
+		entries, err = readLegacyFreelist(dal, freelist, firstPage, numEntries)
+	default:
+		err = fmt.Errorf("%w: page %d is not a freelist page", ErrFreelistCorrupted, firstPageNum)
+	}
+	dal.releasePage(firstPage)
+	if err != nil {
+		return nil, err
+	}
+
+	if pageType == FreeListPage {
+		// flat format of older files, one entry per page
+		freelist.ReleasePages(entries)
+	} else {
+		ranges := make([]pageRange, 0, len(entries)/freelistRangeEntries)
+		for i := 0; i+1 < len(entries); i += freelistRangeEntries {
+			ranges = append(ranges, pageRange{start: entries[i], count: entries[i+1]})
+		}
+		freelist.addRanges(ranges)
+	}
+	freelist.dirty = false
+
+	logger.Debug("read freelist",
+		"currentPage", freelist.currentPage,
+		"releasedPages", freelist.releasedN,
+		"ranges", len(freelist.released),
+		"pagesRead", len(freelist.freelistPages))
+
+	return freelist, nil
+}
 
-	freelist.releasedPages = make([]uint64, 0)
+// readChecksummedFreelist reads the entries of a chain of FreeListChecksummedPage pages.
+// Every page is checked against its checksum, the chain must not loop or leave the file, the
+// page counts must add up to the count of the first page and the runs must be ordered, apart
+// and within the pages the freelist hands out.
+func readChecksummedFreelist(dal *Dal, freelist *Freelist, firstPage *Page, numEntries uint64) ([]uint64, error) {
+	entries, err := checksummedPageEntries(firstPage, true, freelist.entriesPerFirstPage)
+	if err != nil {
+		return nil, err
+	}
+	pageNum := firstPage.PageNumber
+	nextPageNum := binary.LittleEndian.Uint64(firstPage.Data[freelistNextPageOffset:])
+	for nextPageNum != 0 {
+		if nextPageNum == metaPageNumber || nextPageNum >= dal.maxPages.Load() || slices.Contains(freelist.freelistPages, nextPageNum) {
+			return nil, fmt.Errorf("%w: page %d links to page %d", ErrFreelistCorrupted, pageNum, nextPageNum)
+		}
+		freelist.freelistPages = append(freelist.freelistPages, nextPageNum)
+		page, err := dal.GetPage(nextPageNum)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read freelist pageNum %d: %w", nextPageNum, err)
+		}
+		pageEntries, err := checksummedPageEntries(page, false, freelist.entriesPerExtraPage)
+		pageNum, nextPageNum = nextPageNum, binary.LittleEndian.Uint64(page.Data[freelistNextPageOffset:])
+		dal.releasePage(page)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, pageEntries...)
+	}
+	if uint64(len(entries)) != numEntries || numEntries%freelistRangeEntries != 0 {
+		return nil, fmt.Errorf("%w: %d pages hold %d entries, the first page counts %d", ErrFreelistCorrupted,
+			len(freelist.freelistPages), len(entries), numEntries)
+	}
+	end := uint64(1) // page 0 is the meta page, or the header of the blob file
+	for i := 0; i < len(entries); i += freelistRangeEntries {
+		r := pageRange{start: entries[i], count: entries[i+1]}
+		if r.count == 0 || r.start < end || r.end() > freelist.maxPages || r.end() < r.start {
+			return nil, fmt.Errorf("%w: run of %d pages at page %d is out of order or out of range", ErrFreelistCorrupted,
+				r.count, r.start)
+		}
+		end = r.end()
+	}
+	return entries, nil
+}
+
+// readLegacyFreelist reads the entries of a freelist of a file before 0.10, its pages have no
+// entry counts, the entries are taken in order until numEntries
+func readLegacyFreelist(dal *Dal, freelist *Freelist, firstPage *Page, numEntries uint64) ([]uint64, error) {
+	entriesPerFirstPage, entriesPerExtraPage := calculateLegacyFreelistCapacity(int(dal.meta.pageSize))
+	entries := make([]uint64, 0)
 
 	// Read entries from first pageNum and get next pageNum number
 	nextPageNum := readEntriesFromPage(
 		firstPage,
-		freelistFirstPageEntriesOffset,
-		freelist.entriesPerFirstPage,
-		&freelist.releasedPages,
-		&numPages,
+		freelistLegacyFirstPageEntriesOffset,
+		entriesPerFirstPage,
+		&entries,
+		&numEntries,
 	)
 
-	// Read additional pages if needed
-	for nextPageNum != 0 && uint64(len(freelist.releasedPages)) < numPages {
+	// Read additional pages, the chain may be longer than the entries need
+	for nextPageNum != 0 {
 		freelist.freelistPages = append(freelist.freelistPages, nextPageNum)
 
 		page, getPageErr := dal.GetPage(nextPageNum)
@@ -146,76 +448,94 @@ func ReadFreelist(dal *Dal) (*Freelist, error) {
 
 		nextPageNum = readEntriesFromPage(
 			page,
-			freelistExtraPageEntriesOffset,
-			freelist.entriesPerExtraPage,
-			&freelist.releasedPages,
-			&numPages,
+			freelistLegacyExtraPageEntriesOffset,
+			entriesPerExtraPage,
+			&entries,
+			&numEntries,
 		)
+		dal.releasePage(page)
 	}
-
-	logger.Debug("read freelist",
-		"currentPage", freelist.currentPage,
-		"releasedPages", len(freelist.releasedPages),
-		"pagesRead", len(freelist.freelistPages))
-
-	return freelist, nil
+	return entries, nil
 }
 
 func WriteFreelist(dal *Dal, freelist *Freelist) error {
+	return writeFreelistAt(dal, freelist, dal.meta.freelistPageNumber)
+}
+
+// writeFreelistAt writes the freelist starting at firstPageNum, extra pages are allocated
+// from and released to the freelist of the main file
+func writeFreelistAt(dal *Dal, freelist *Freelist, firstPageNum uint64) error {
 	if !freelist.dirty {
 		return nil
 	}
-	pagesNeeded := calculatePagesNeeded(
-		len(freelist.releasedPages),
-		freelist.entriesPerFirstPage,
-		freelist.entriesPerExtraPage,
-	)
+	if err := dal.failpoint(FailpointFreelistWrite); err != nil {
+		return err
+	}
 
-	// Initialize and ensure first pageNum is the meta.freelistPageNumber
+	// Initialize and ensure first pageNum is firstPageNum
 	if len(freelist.freelistPages) == 0 {
-		freelist.freelistPages = []uint64{dal.meta.freelistPageNumber}
-	} else if freelist.freelistPages[0] != dal.meta.freelistPageNumber {
-		freelist.freelistPages[0] = dal.meta.freelistPageNumber
+		freelist.freelistPages = []uint64{firstPageNum}
+	} else if freelist.freelistPages[0] != firstPageNum {
+		freelist.freelistPages[0] = firstPageNum
 	}
 
-	managePageErr := manageFreelistPageAllocation(dal, freelist, pagesNeeded)
-	if managePageErr != nil {
-		return managePageErr
+	// Allocating freelist pages may shrink the runs and releasing them may add one, so the
+	// entries are taken again after every change. Growing never adds entries and ends the loop.
+	entries := freelist.entries()
+	pagesNeeded := calculatePagesNeeded(len(entries), freelist.entriesPerFirstPage, freelist.entriesPerExtraPage)
+	if pagesNeeded < len(freelist.freelistPages) {
+		if err := manageFreelistPageAllocation(dal, freelist, pagesNeeded); err != nil {
+			return err
+		}
+		entries = freelist.entries()
+		pagesNeeded = calculatePagesNeeded(len(entries), freelist.entriesPerFirstPage, freelist.entriesPerExtraPage)
 	}
+	for pagesNeeded > len(freelist.freelistPages) {
+		if err := manageFreelistPageAllocation(dal, freelist, len(freelist.freelistPages)+1); err != nil {
+			return err
+		}
+		entries = freelist.entries()
+		pagesNeeded = calculatePagesNeeded(len(entries), freelist.entriesPerFirstPage, freelist.entriesPerExtraPage)
+	}
+	pagesUsed := len(freelist.freelistPages)
 
 	// Write the first pageNum with header
-	firstPage, getFirstPageErr := dal.GetPage(dal.meta.freelistPageNumber)
+	firstPage, getFirstPageErr := dal.GetPage(firstPageNum)
 	if getFirstPageErr != nil {
 		return fmt.Errorf("failed to get first freelist pageNum: %w", getFirstPageErr)
 	}
 
 	// Set next pageNum pointer
 	nextPageNum := uint64(0)
-	if pagesNeeded > 1 {
+	if pagesUsed > 1 {
 		nextPageNum = freelist.freelistPages[1]
 	}
 
-	firstPage.Data[freelistPageTypeOffset] = FreeListPage
+	firstPage.Data[freelistPageTypeOffset] = FreeListChecksummedPage
 	binary.LittleEndian.PutUint64(firstPage.Data[freelistNextPageOffset:], nextPageNum)
 	binary.LittleEndian.PutUint64(firstPage.Data[freelistCurrentPageOffset:], freelist.currentPage)
 	binary.LittleEndian.PutUint64(firstPage.Data[freelistMaxPagesOffset:], freelist.maxPages)
-	binary.LittleEndian.PutUint64(firstPage.Data[freelistNumPagesOffset:], uint64(len(freelist.releasedPages)))
+	binary.LittleEndian.PutUint64(firstPage.Data[freelistNumPagesOffset:], uint64(len(entries)))
 
 	// Write entries to first pageNum
 	entriesWritten := writeEntriesToPage(
 		firstPage,
 		freelistFirstPageEntriesOffset,
-		freelist.releasedPages,
+		entries,
 		0,
 		freelist.entriesPerFirstPage,
 	)
-	if err := dal.SetPage(firstPage); err != nil {
+	sealFreelistPage(firstPage, freelistFirstPageEntriesCountOffset, freelistFirstPageChecksumOffset,
+		freelistFirstPageEntriesOffset, entriesWritten)
+	err := dal.SetPage(firstPage)
+	dal.releasePage(firstPage)
+	if err != nil {
 		return err
 	}
 
 	// Write additional pages if needed
 	entriesIdx := entriesWritten
-	for i := 1; i < pagesNeeded; i++ {
+	for i := 1; i < pagesUsed; i++ {
 		page, getPageErr := dal.GetPage(freelist.freelistPages[i])
 		if getPageErr != nil {
 			return fmt.Errorf("failed to get freelist pageNum %d: %w", i, getPageErr)
@@ -223,41 +543,67 @@ func WriteFreelist(dal *Dal, freelist *Freelist) error {
 
 		// Set next pageNum pointer
 		nextPageNum = uint64(0)
-		if i < pagesNeeded-1 {
+		if i < pagesUsed-1 {
 			nextPageNum = freelist.freelistPages[i+1]
 		}
-		page.Data[freelistPageTypeOffset] = FreeListPage
+		page.Data[freelistPageTypeOffset] = FreeListChecksummedPage
 		binary.LittleEndian.PutUint64(page.Data[freelistNextPageOffset:], nextPageNum)
 
 		// Write entries
 		written := writeEntriesToPage(
 			page,
 			freelistExtraPageEntriesOffset,
-			freelist.releasedPages,
+			entries,
 			entriesIdx,
 			freelist.entriesPerExtraPage,
 		)
+		sealFreelistPage(page, freelistExtraPageEntriesCountOffset, freelistExtraPageChecksumOffset,
+			freelistExtraPageEntriesOffset, written)
 		entriesIdx += written
 
-		if err := dal.SetPage(page); err != nil {
+		err = dal.SetPage(page)
+		dal.releasePage(page)
+		if err != nil {
 			return err
 		}
 	}
 
 	logger.Debug("write freelist",
-		"releasedPages", len(freelist.releasedPages),
-		"pagesUsed", pagesNeeded)
+		"releasedPages", freelist.releasedN,
+		"ranges", len(freelist.released),
+		"pagesUsed", pagesUsed)
 
-	freelist.dirty = false
+	// the meta is written after the freelist, a migration step commits the version it upgraded
+	// the file to, every other commit the current one, see migrate.go
+	dal.meta.dbVersion = dal.formatVersion
+
+	// the freelist stays dirty until it reaches the database file, not only the tx log
+	if !dal.txLog.active {
+		freelist.dirty = false
+	}
 	return nil
 }
 
+// sealFreelistPage writes the entry count and the checksum of a page, after its entries
+func sealFreelistPage(page *Page, countOffset, checksumOffset, entriesOffset, written int) {
+	binary.LittleEndian.PutUint32(page.Data[countOffset:], uint32(written))
+	end := entriesOffset + written*UInt64Size
+	binary.LittleEndian.PutUint32(page.Data[checksumOffset:], freelistPageChecksum(page.Data, checksumOffset, end))
+}
+
 func calculateFreelistCapacity(pageSize int) (int, int) {
 	entriesPerFirstPage := ((pageSize - freelistFirstPageEntriesOffset) / UInt64Size) - 1
 	entriesPerExtraPage := ((pageSize - freelistExtraPageEntriesOffset) / UInt64Size) - 1
 	return entriesPerFirstPage, entriesPerExtraPage
 }
 
+// calculateLegacyFreelistCapacity is calculateFreelistCapacity for the pages of files before 0.10
+func calculateLegacyFreelistCapacity(pageSize int) (int, int) {
+	entriesPerFirstPage := ((pageSize - freelistLegacyFirstPageEntriesOffset) / UInt64Size) - 1
+	entriesPerExtraPage := ((pageSize - freelistLegacyExtraPageEntriesOffset) / UInt64Size) - 1
+	return entriesPerFirstPage, entriesPerExtraPage
+}
+
 func manageFreelistPageAllocation(dal *Dal, freelist *Freelist, pagesNeeded int) error {
 	// Manage pageNum allocations
 	oldPageCount := len(freelist.freelistPages)
@@ -0,0 +1,72 @@
+package storage
+
+import "unsafe"
+
+// freelistInfoRuns is the number of largest free runs reported by FreelistInfo
+const freelistInfoRuns = 10
+
+// FreeRun is a run of adjacent free pages
+type FreeRun struct {
+	Start uint64
+	Pages uint64
+}
+
+// FreelistInfo describes the pages released for reuse
+type FreelistInfo struct {
+	FreePages      uint64    // released pages waiting for reuse
+	Runs           int       // runs of adjacent free pages, the in-memory and on-disk entries
+	MinPage        uint64    // lowest free page, zero if none
+	MaxPage        uint64    // highest free page, zero if none
+	LargestRuns    []FreeRun // largest runs first
+	HighWaterMark  uint64    // highest page ever allocated, pages above it are not on the list
+	PersistedPages int       // pages holding the freelist in the database file
+	MemoryBytes    uint64    // approximate memory held by the in-memory freelist
+	DoubleFreed    uint64    // pages released while already free, Check reports them
+	HeldPages      int       // pages freed while bucket snapshots are open, reused after their release
+}
+
+// FreelistInfo returns the freelist state as seen by a read transaction
+func (db *DB) FreelistInfo() (FreelistInfo, error) {
+	var info FreelistInfo
+	err := db.View(func(tx *Tx) error {
+		tx.db.dal.allocLock.Lock()
+		defer tx.db.dal.allocLock.Unlock()
+		info = tx.db.dal.freelist.info()
+		return nil
+	})
+	return info, err
+}
+
+func (f *Freelist) info() FreelistInfo {
+	info := FreelistInfo{
+		FreePages:      f.releasedN,
+		Runs:           len(f.released),
+		HeldPages:      len(f.held),
+		LargestRuns:    make([]FreeRun, 0, freelistInfoRuns),
+		HighWaterMark:  f.currentPage,
+		PersistedPages: len(f.freelistPages),
+		MemoryBytes: uint64(cap(f.released))*uint64(unsafe.Sizeof(pageRange{})) +
+			uint64(cap(f.freelistPages)+cap(f.held))*UInt64Size,
+		DoubleFreed: f.doubleFreed,
+	}
+	if len(f.released) > 0 {
+		info.MinPage = f.released[0].start
+		info.MaxPage = f.released[len(f.released)-1].end() - 1
+	}
+	for _, r := range f.released {
+		// keep the largest runs sorted, ties keep the lower page first
+		i := len(info.LargestRuns)
+		for i > 0 && info.LargestRuns[i-1].Pages < r.count {
+			i--
+		}
+		if i == freelistInfoRuns {
+			continue
+		}
+		if len(info.LargestRuns) < freelistInfoRuns {
+			info.LargestRuns = append(info.LargestRuns, FreeRun{})
+		}
+		copy(info.LargestRuns[i+1:], info.LargestRuns[i:])
+		info.LargestRuns[i] = FreeRun{Start: r.start, Pages: r.count}
+	}
+	return info
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// canRebuildFreelist reports whether a freelist that failed to read is replaced and rebuilt
+// by Open instead of failing it
+func (dal *Dal) canRebuildFreelist(err error) bool {
+	if !errors.Is(err, ErrFreelistCorrupted) || !dal.opts.RebuildFreelist || dal.readOnly {
+		return false
+	}
+	logger.Warn("freelist is damaged, it is rebuilt from the reachable pages", "path", dal.path, "error", err)
+	return true
+}
+
+// damagedFreelist stands in for a freelist that failed its checks until Open rebuilds it, it
+// has no free pages and every page of the file counts as handed out
+func (dal *Dal) damagedFreelist(firstPageNum uint64, maxPages uint64) *Freelist {
+	dal.freelistDamaged = true
+	freelist := NewFreelist(dal.meta.pageSize, maxPages)
+	freelist.currentPage = max(maxPages, 1) - 1
+	freelist.freelistPages = []uint64{firstPageNum}
+	return freelist
+}
+
+// rebuildFreelist replaces the freelists NewDal found damaged, see Options.RebuildFreelist.
+// The pages reachable from the meta page are in use, every other page up to the last
+// reachable one is free. Pages the damaged freelist handed out past it are beyond the file
+// end the new freelist knows, they are reused as the file grows.
+func (db *DB) rebuildFreelist() error {
+	dal := db.dal
+	if !dal.freelistDamaged {
+		return nil
+	}
+	err := db.UpdateLabeled("rebuild freelist", func(tx *Tx) error {
+		dal.allocLock.Lock()
+		defer dal.allocLock.Unlock()
+		c := newChecker(tx)
+		c.run()
+		if len(c.errs) > 0 {
+			return fmt.Errorf("%w: the freelist can't be rebuilt: %w", ErrCorrupted, errors.Join(c.errs...))
+		}
+		var used, blobUsed []bool
+		used = make([]bool, dal.maxPages.Load())
+		if dal.blobs != nil {
+			blobUsed = make([]bool, dal.blobs.maxPages.Load())
+		}
+		for pageNum := range c.seen {
+			if isBlobFilePage(pageNum) {
+				blobUsed[localPageNum(pageNum)] = true
+			} else {
+				used[pageNum] = true
+			}
+		}
+		dal.freelist = rebuiltFreelist(dal.freelist, used, rootPageNumber)
+		if dal.blobs != nil {
+			dal.blobs.freelist = rebuiltFreelist(dal.blobs.freelist, blobUsed, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	dal.freelistDamaged = false
+	logger.Warn("freelist rebuilt from the reachable pages", "path", dal.path,
+		"free_pages", dal.freelist.releasedN, "current_page", dal.freelist.currentPage)
+	return nil
+}
+
+// rebuiltFreelist returns the freelist of the pages not marked used up to the last used
+// one, minPage is the lowest current page of the file. Page 0 is never free.
+func rebuiltFreelist(damaged *Freelist, used []bool, minPage uint64) *Freelist {
+	freelist := &Freelist{
+		currentPage:         minPage,
+		maxPages:            damaged.maxPages,
+		released:            make([]pageRange, 0),
+		freelistPages:       damaged.freelistPages,
+		entriesPerFirstPage: damaged.entriesPerFirstPage,
+		entriesPerExtraPage: damaged.entriesPerExtraPage,
+		dirty:               true,
+	}
+	for pageNum := len(used) - 1; pageNum > int(minPage); pageNum-- {
+		if used[pageNum] {
+			freelist.currentPage = uint64(pageNum)
+			break
+		}
+	}
+	var free []pageRange
+	for pageNum := uint64(1); pageNum <= freelist.currentPage; pageNum++ {
+		if used[pageNum] {
+			continue
+		}
+		if n := len(free); n > 0 && free[n-1].end() == pageNum {
+			free[n-1].count++
+		} else {
+			free = append(free, pageRange{start: pageNum, count: 1})
+		}
+	}
+	freelist.addRanges(free)
+	return freelist
+}
@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
 	"reflect"
 	"testing"
 
@@ -11,20 +15,26 @@ func TestFreelistWriteRead(t *testing.T) {
 	db, filename := createTestDB(t)
 
 	releasedPageSize := 10000
-	// Allocate new freelist, add releasedPages
-	freelist := NewFreelist(BTreePageSize, uint64(releasedPageSize))
-	freelist.releasedPages = make([]uint64, releasedPageSize)
+	// Allocate new freelist, release every other page so runs don't merge
+	freelist := NewFreelist(BTreePageSize, uint64(2*releasedPageSize+100))
+	pages := make([]uint64, releasedPageSize)
 	for i := 0; i < releasedPageSize; i++ {
-		freelist.releasedPages[i] = uint64(i)
+		pages[i] = uint64(2*i + 100)
 	}
+	freelist.ReleasePages(pages)
+	// Open refuses a file shorter than the freelist declares
+	require.NoError(t, db.dal.allocateFile(freelist.maxPages*BTreePageSize))
 	// Flush it to the disk
-	freelist.dirty = true
 	err := WriteFreelist(db.dal, freelist)
+	require.NoError(t, err)
+	require.Greater(t, len(freelist.freelistPages), 1)
 	closeTestDB(t, db)
 
 	db = openTestDB(t, filename, nil)
-	// Truncated releasedPages
-	freelist.releasedPages = db.dal.freelist.releasedPages[:3000]
+	require.Equal(t, freelist.released, db.dal.freelist.released)
+	// Truncated released runs
+	freelist.released = db.dal.freelist.released[:3000]
+	freelist.releasedN = 3000
 	// Flush to the disk once again
 	freelist.dirty = true
 	err = WriteFreelist(db.dal, freelist)
@@ -32,7 +42,267 @@ func TestFreelistWriteRead(t *testing.T) {
 	closeTestDB(t, db)
 
 	db = openTestDB(t, filename, nil)
-	require.NoError(t, err)
 	require.True(t, reflect.DeepEqual(freelist.freelistPages, db.dal.freelist.freelistPages))
-	require.True(t, reflect.DeepEqual(freelist.releasedPages, db.dal.freelist.releasedPages))
+	require.True(t, reflect.DeepEqual(freelist.released, db.dal.freelist.released))
+}
+
+func TestFreelistRanges(t *testing.T) {
+	freelist := NewFreelist(BTreePageSize, 1000)
+	freelist.ReleasePages([]uint64{12, 10, 11, 20, 14})
+	require.Equal(t, []pageRange{{10, 3}, {14, 1}, {20, 1}}, freelist.released)
+	freelist.ReleasePages([]uint64{13, 21, 22})
+	require.Equal(t, []pageRange{{10, 5}, {20, 3}}, freelist.released)
+	require.EqualValues(t, 8, freelist.releasedN)
+	require.True(t, freelist.isFree(14))
+	require.False(t, freelist.isFree(15))
+	require.Zero(t, freelist.doubleFreed)
+
+	// the lowest page is reused first
+	pageNum, err := freelist.GetNextPageNumber()
+	require.NoError(t, err)
+	require.EqualValues(t, 10, pageNum)
+	require.Equal(t, []pageRange{{11, 4}, {20, 3}}, freelist.released)
+
+	freelist.ReleasePages([]uint64{12, 30, 30})
+	require.EqualValues(t, 2, freelist.doubleFreed)
+	require.Equal(t, []pageRange{{11, 4}, {20, 3}, {30, 1}}, freelist.released)
+	require.EqualValues(t, 8, freelist.releasedN)
+}
+
+func TestFreelistContiguousPages(t *testing.T) {
+	freelist := NewFreelist(BTreePageSize, 100)
+	freelist.currentPage = 40
+	freelist.ReleasePages([]uint64{10, 12, 13, 20, 21, 22, 23})
+
+	// the first run long enough is used
+	pageNum, err := freelist.GetContiguousPages(2)
+	require.NoError(t, err)
+	require.EqualValues(t, 12, pageNum)
+	pageNum, err = freelist.GetContiguousPages(3)
+	require.NoError(t, err)
+	require.EqualValues(t, 20, pageNum)
+	require.Equal(t, []pageRange{{10, 1}, {23, 1}}, freelist.released)
+	require.EqualValues(t, 2, freelist.releasedN)
+
+	// no run fits, the pages are taken from the end of the file
+	pageNum, err = freelist.GetContiguousPages(5)
+	require.NoError(t, err)
+	require.EqualValues(t, 41, pageNum)
+	require.EqualValues(t, 45, freelist.currentPage)
+	_, err = freelist.GetContiguousPages(60)
+	require.ErrorIs(t, err, ErrNoPagesLeft)
+	require.EqualValues(t, 45, freelist.currentPage)
+}
+
+// writeFlatFreelist rewrites the freelist of a closed database in the format of older files
+func writeFlatFreelist(t *testing.T, filename string, pages []uint64) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, file.Close()) }()
+	page := make([]byte, BTreePageSize)
+	offset := int64(freelistPageNumber * BTreePageSize)
+	_, err = file.ReadAt(page, offset)
+	require.NoError(t, err)
+	require.EqualValues(t, FreeListChecksummedPage, page[freelistPageTypeOffset])
+	require.Zero(t, binary.LittleEndian.Uint64(page[freelistNextPageOffset:]), "one page fits the test")
+
+	page[freelistPageTypeOffset] = FreeListPage
+	binary.LittleEndian.PutUint64(page[freelistNumPagesOffset:], uint64(len(pages)))
+	for i, pageNum := range pages {
+		binary.LittleEndian.PutUint64(page[freelistLegacyFirstPageEntriesOffset+i*UInt64Size:], pageNum)
+	}
+	_, err = file.WriteAt(page, offset)
+	require.NoError(t, err)
+}
+
+func TestFreelistInfo(t *testing.T) {
+	db, filename := createTestDB(t)
+	blob := make([]byte, 40*BTreePageSize)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20; i++ {
+			if err := bucket.Put([]byte(fmt.Sprintf("key-%05d", i)), blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	info, err := db.FreelistInfo()
+	require.NoError(t, err)
+	require.Zero(t, info.FreePages)
+	require.Empty(t, info.LargestRuns)
+
+	// blob chains are adjacent pages, freeing them adds few runs
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20; i += 2 {
+			if err := bucket.Remove([]byte(fmt.Sprintf("key-%05d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	info, err = db.FreelistInfo()
+	require.NoError(t, err)
+	require.Greater(t, info.FreePages, uint64(100))
+	require.Less(t, info.Runs*10, int(info.FreePages))
+	require.Equal(t, 1, info.PersistedPages)
+	require.NotEmpty(t, info.LargestRuns)
+	require.GreaterOrEqual(t, info.LargestRuns[0].Pages, info.LargestRuns[len(info.LargestRuns)-1].Pages)
+	require.LessOrEqual(t, info.MinPage, info.LargestRuns[0].Start)
+	require.GreaterOrEqual(t, info.MaxPage, info.LargestRuns[0].Start+info.LargestRuns[0].Pages-1)
+	require.Greater(t, info.HighWaterMark, info.MaxPage)
+	require.Positive(t, info.MemoryBytes)
+	require.Equal(t, info.FreePages, uint64(db.Stat(WithBuckets(false)).ReleasedPageN))
+	require.NoError(t, db.Check())
+
+	// files written before ranges keep one entry per page, they are still read
+	released := db.dal.freelist.released
+	var pages []uint64
+	for _, r := range released {
+		for pageNum := r.start; pageNum < r.end(); pageNum++ {
+			pages = append(pages, pageNum)
+		}
+	}
+	closeTestDB(t, db)
+	writeFlatFreelist(t, filename, pages)
+	db = openTestDB(t, filename, nil)
+	require.Equal(t, released, db.dal.freelist.released)
+	require.NoError(t, db.Check())
+
+	// the next commit writes checksummed ranges again
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key-00000"), []byte("value"))
+	}))
+	page, err := db.dal.GetPage(freelistPageNumber)
+	require.NoError(t, err)
+	require.EqualValues(t, FreeListChecksummedPage, page.Data[freelistPageTypeOffset])
+	require.NoError(t, db.Check())
+}
+
+func TestFreelistCorrupted(t *testing.T) {
+	db, filename := createTestDB(t)
+	// every other blob chain is freed, the runs of free pages need two freelist pages
+	blob := make([]byte, 2*BTreePageSize)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key-%05d", i)) }
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 800; i++ {
+			if err := bucket.Put(key(i), blob); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 800; i += 2 {
+			if err := bucket.Remove(key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.Len(t, db.dal.freelist.freelistPages, 2)
+	secondPage := db.dal.freelist.freelistPages[1]
+	closeTestDB(t, db)
+
+	// a run of the second page points at a used page
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	entry := make([]byte, UInt64Size)
+	binary.LittleEndian.PutUint64(entry, rootPageNumber)
+	_, err = file.WriteAt(entry, int64(secondPage*BTreePageSize)+freelistExtraPageEntriesOffset)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	// without recovery the tx log does not put the page back
+	_, err = Open(filename, DefaultOptions().WithRecovery(false))
+	require.ErrorIs(t, err, ErrFreelistCorrupted)
+	require.ErrorContains(t, err, fmt.Sprintf("page %d checksum", secondPage))
+
+	// the rebuilt freelist frees the removed chains and none of the kept ones
+	db = openTestDB(t, filename, DefaultOptions().WithRecovery(false).WithFreelistRebuild(true))
+	require.NoError(t, db.Check())
+	require.Greater(t, db.dal.freelist.releasedN, uint64(800))
+	value := []byte("new value")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 800; i += 2 {
+			if err := bucket.Put(key(i), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Check())
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, nil)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("keep"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 800; i++ {
+			got, found := bucket.Get(key(i))
+			require.True(t, found)
+			if i%2 == 0 {
+				require.Equal(t, value, got)
+			} else {
+				require.Equal(t, blob, got)
+			}
+		}
+		return nil
+	}))
+}
+
+// TestFreelistRebuildUndecodableNode damages the freelist and a bucket root, Open reports the
+// node the rebuild could not read instead of panicking
+func TestFreelistRebuildUndecodableNode(t *testing.T) {
+	db, filename := createTestDB(t)
+	require.NoError(t, db.Put([]byte("users"), []byte("id_1"), []byte("v")))
+	var root uint64
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		root = bucket.root
+		return nil
+	}))
+	freelistPage := db.dal.meta.freelistPageNumber
+	require.NoError(t, db.Close())
+
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, int64(freelistPage*BTreePageSize+freelistFirstPageChecksumOffset))
+	require.NoError(t, err)
+	_, err = file.WriteAt(bytes.Repeat([]byte{0xff}, BTreePageSize), int64(root*BTreePageSize))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = Open(filename, DefaultOptions().WithRecovery(false).WithFreelistRebuild(true))
+	require.ErrorIs(t, err, ErrCorrupted)
+	require.ErrorContains(t, err, "the freelist can't be rebuilt")
+	require.ErrorContains(t, err, "bucket \"users\"")
 }
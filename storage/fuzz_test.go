@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// The fuzz targets decode damaged input the way Open, recovery and the inspection tools do:
+// every input either decodes or fails with a corruption error, none panics. Inputs that
+// panicked before the decoders checked their bounds are kept in testdata/fuzz and run by
+// go test as regression cases.
+
+func FuzzNodeDeserialize(f *testing.F) {
+	leaf := &BNode{items: []*Item{{Key: []byte("key"), Value: []byte("value")}, {Key: []byte("other"), Value: nil}}}
+	internal := &BNode{
+		items:       []*Item{{Key: []byte("middle"), Value: []byte{ValueSimple}}},
+		childNodes:  []uint64{3, 4},
+		childCounts: []uint64{10, 12},
+	}
+	for _, node := range []*BNode{leaf, internal, {}} {
+		page := make([]byte, 256)
+		require.NoError(f, node.Serialize(page))
+		f.Add(page)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := NewBNode()
+		if err := node.Deserialize(data); err != nil {
+			require.ErrorIs(t, err, ErrCorrupted)
+			return
+		}
+		// a decoded node encodes into the same space and decodes to the same node
+		page := make([]byte, max(len(data), nodeHeaderSize(true)))
+		require.NoError(t, node.Serialize(page))
+		again := NewBNode()
+		require.NoError(t, again.Deserialize(page))
+		require.Equal(t, node.items, again.items)
+		require.Equal(t, node.childNodes, again.childNodes)
+		if !node.isLeaf() {
+			require.Equal(t, node.counted(), again.counted())
+		}
+	})
+}
+
+func FuzzTxLogRecover(f *testing.F) {
+	// a version 2 record with a run of two pages, as the commit writes it
+	path := filepath.Join(f.TempDir(), "seed.tlog")
+	txlog, err := NewTxLog(path, 0600)
+	require.NoError(f, err)
+	require.NoError(f, txlog.With(func() error {
+		return txlog.writeRun(4*64, 4, 64, bytes.Repeat([]byte{7}, 128))
+	}))
+	require.NoError(f, txlog.file.Close())
+	record, err := os.ReadFile(path)
+	require.NoError(f, err)
+	f.Add(record)
+	f.Add(append(bytes.Clone(record), record...))
+	f.Add(record[:len(record)-1])
+
+	// a version 1 record of one page
+	body := binary.LittleEndian.AppendUint64(nil, 3*64)
+	body = binary.LittleEndian.AppendUint64(body, 3)
+	body = append(body, bytes.Repeat([]byte{3}, 64)...)
+	header := make([]byte, txLogV1HeaderSize)
+	binary.LittleEndian.PutUint64(header[txLogV1NumPages:], 1)
+	binary.LittleEndian.PutUint16(header[txLogV1PageSize:], 64)
+	binary.LittleEndian.PutUint32(header[txLogV1CRC:], crc32.ChecksumIEEE(body))
+	f.Add(append(header, body...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz.tlog")
+		require.NoError(t, os.WriteFile(path, data, 0600))
+		txlog, err := NewTxLog(path, 0600)
+		require.NoError(t, err)
+		defer func() { _ = txlog.file.Close() }()
+		pages := 0
+		summary, err := txlog.Recover(func(offset uint64, page *Page) error {
+			require.NotEmpty(t, page.Data)
+			pages++
+			return nil
+		})
+		if err != nil {
+			require.ErrorIs(t, err, ErrTxLogCorrupted)
+			require.Equal(t, 1, summary.SkippedRecords)
+		}
+		require.Equal(t, pages, summary.Pages)
+		require.LessOrEqual(t, summary.SkippedBytes, int64(len(data)))
+	})
+}
+
+func FuzzMetaDeserialize(f *testing.F) {
+	page := make([]byte, BTreePageSize)
+	NewMeta(BTreePageSize).Serialize(page)
+	f.Add(page)
+	f.Add(page[:metaFlagsOffset+1])
+	withBlobs := NewMeta(BTreePageSize)
+	withBlobs.flags, withBlobs.blobFreelistPage, withBlobs.blobFile = metaFlagBlobFile, 5, "pirin.db.blobs"
+	page = make([]byte, BTreePageSize)
+	withBlobs.Serialize(page)
+	f.Add(page[:metaBlobFileNameOffset+4])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, err := checkDatabaseImage(bytes.NewReader(data), int64(len(data)), "fuzz")
+		if err != nil && !errors.Is(err, ErrNotADatabase) && !errors.Is(err, ErrCorrupted) &&
+			!errors.Is(err, ErrNewerFormat) && !errors.Is(err, ErrOlderFormat) {
+			require.ErrorIs(t, err, ErrTruncatedDatabase)
+		}
+		meta := &Meta{}
+		if err = meta.Deserialize(data); err != nil {
+			require.ErrorIs(t, err, ErrCorrupted)
+			return
+		}
+		_ = meta.checkFormat()
+		// the decoded fields encode and decode to the same meta
+		page := make([]byte, BTreePageSize)
+		meta.Serialize(page)
+		again := &Meta{}
+		require.NoError(t, again.Deserialize(page))
+		require.Equal(t, meta, again)
+	})
+}
+
+// blobChain builds the pages of a blob chain starting at page 3, each page links to the next
+func blobChain(data []byte) []byte {
+	first := make([]byte, BTreePageSize)
+	first[blobFirstPageTypeOffset] = BlobPage
+	binary.LittleEndian.PutUint32(first[blobFirstPageDataSizeOffset:], uint32(len(data)))
+	rest := data[copy(first[blobFirstPageDataOffset:], data):]
+	pages := [][]byte{first}
+	for len(rest) > 0 {
+		next := blobExtraPageNextPageOffset
+		if len(pages) == 1 {
+			next = blobFirstPageNextPageOffset
+		}
+		binary.LittleEndian.PutUint64(pages[len(pages)-1][next:], uint64(3+len(pages)))
+		page := make([]byte, BTreePageSize)
+		page[blobExtraPageTypeOffset] = BlobPage
+		rest = rest[copy(page[blobExtraPageDataOffset:], rest):]
+		pages = append(pages, page)
+	}
+	binary.LittleEndian.PutUint32(first[blobFirstPageTotalPagesOffset:], uint32(len(pages)))
+	return bytes.Join(pages, nil)
+}
+
+func FuzzBlobGet(f *testing.F) {
+	f.Add(blobChain([]byte("small blob")))
+	f.Add(blobChain(bytes.Repeat([]byte("blob"), BTreePageSize/2)))
+	// the second page links back to the first
+	looped := blobChain(bytes.Repeat([]byte("loop"), BTreePageSize/2))
+	binary.LittleEndian.PutUint64(looped[BTreePageSize+blobExtraPageNextPageOffset:], 3)
+	f.Add(looped)
+
+	db, _ := createTestDB(f)
+	errRollback := errors.New("rollback")
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// require must not stop the test while the update holds the write lock
+		var blob *Blob
+		err := db.Update(func(tx *Tx) error {
+			// the input replaces pages 3 to 6, a chain leaving them reads pages of the file
+			for i := 0; i < 4 && i*BTreePageSize < len(data); i++ {
+				page := &Page{PageNumber: uint64(3 + i), Data: make([]byte, BTreePageSize)}
+				copy(page.Data, data[i*BTreePageSize:])
+				tx.setPage(page)
+			}
+			var err error
+			if blob, err = GetBlob(tx, 3); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		if errors.Is(err, errRollback) {
+			require.Len(t, blob.data, blob.size)
+		} else if !errors.Is(err, ErrPageOutOfRange) {
+			require.ErrorIs(t, err, ErrCorrupted)
+		}
+	})
+}
@@ -0,0 +1,19 @@
+package storage
+
+import "bytes"
+
+// InternalBucketPrefix starts the names of internal buckets, they hold state of the storage,
+// like the trash and the bucket events, or of an application built on it. Internal buckets
+// are left out of Buckets, AllBuckets, BucketStatsPage and the buckets of Stat, take no quota
+// and record no bucket events. GetBucket opens them by name like any bucket.
+const InternalBucketPrefix = "__"
+
+// IsInternalBucket reports whether the bucket name starts with InternalBucketPrefix
+func IsInternalBucket(name []byte) bool {
+	return bytes.HasPrefix(name, []byte(InternalBucketPrefix))
+}
+
+// isReservedBucketName reports whether the storage owns the name, CreateBucket refuses it
+func isReservedBucketName(name []byte) bool {
+	return isTrashName(name) || bytes.Equal(name, eventsBucketName)
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+)
+
+// All returns an iterator over the keys and values of the bucket in key order:
+//
+//	for k, v := range bucket.All() {
+//	}
+//
+// Breaking out of the loop ends the iteration, there is nothing to release. Keys and values
+// are valid until the transaction ends and the bucket must not be changed inside the loop,
+// collect the keys and change them after it. An error ends the loop like the last key does,
+// use AllErr where it matters.
+func (bucket *Bucket) All() iter.Seq2[[]byte, []byte] {
+	seq, _ := bucket.AllErr()
+	return seq
+}
+
+// AllErr returns All and the error that ended its last iteration, to read after the loop:
+//
+//	seq, errp := bucket.AllErr()
+//	for k, v := range seq {
+//	}
+//	if *errp != nil {
+//	}
+func (bucket *Bucket) AllErr() (iter.Seq2[[]byte, []byte], *error) {
+	return bucket.RangeErr(nil, nil)
+}
+
+// Range returns an iterator over the keys in [start, end) in key order, a nil end runs to
+// the last key. It behaves like All.
+func (bucket *Bucket) Range(start, end []byte) iter.Seq2[[]byte, []byte] {
+	seq, _ := bucket.RangeErr(start, end)
+	return seq
+}
+
+// RangeErr returns Range and the error that ended its last iteration, like AllErr
+func (bucket *Bucket) RangeErr(start, end []byte) (iter.Seq2[[]byte, []byte], *error) {
+	errp := new(error)
+	seq := func(yield func(k, v []byte) bool) {
+		*errp = nil
+		if bucket.tx == nil {
+			*errp = ErrTxClosed
+			return
+		}
+		cursor := bucket.Cursor()
+		var k, v []byte
+		if start == nil {
+			k, v = cursor.First()
+		} else {
+			k, v = cursor.Seek(start)
+		}
+		for ; k != nil; k, v = cursor.Next() {
+			if end != nil && bytes.Compare(k, end) >= 0 {
+				return
+			}
+			if !yield(k, v) {
+				return
+			}
+		}
+		*errp = cursor.Err()
+	}
+	return seq, errp
+}
+
+// AllBuckets returns an iterator over the buckets of the transaction by name, buckets
+// created in the transaction included. Buckets must not be created or deleted inside the
+// loop. Root bucket entries that are not bucket values and trashed buckets are skipped like
+// in Buckets.
+func (tx *Tx) AllBuckets() iter.Seq2[[]byte, *Bucket] {
+	seq, _ := tx.AllBucketsErr()
+	return seq
+}
+
+// AllBucketsErr returns AllBuckets and the error that ended its last iteration, like AllErr
+func (tx *Tx) AllBucketsErr() (iter.Seq2[[]byte, *Bucket], *error) {
+	errp := new(error)
+	seq := func(yield func(name []byte, bucket *Bucket) bool) {
+		*errp = nil
+		cursor := tx.getRootBucket().Cursor()
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			if IsInternalBucket(k) {
+				continue
+			}
+			name := bytes.Clone(k)
+			bucket, err := tx.GetBucket(name)
+			if errors.Is(err, ErrBadBucketValue) {
+				logger.Warn("skipping invalid bucket value", "bucket", string(name))
+				continue
+			}
+			if err != nil {
+				*errp = err
+				return
+			}
+			if !yield(name, bucket) {
+				return
+			}
+		}
+		*errp = cursor.Err()
+	}
+	return seq, errp
+}
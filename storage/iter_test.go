@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketIterators(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("items"))
+		require.NoError(t, err)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, bucket.Put([]byte(fmt.Sprintf("key-%03d", i)), []byte(fmt.Sprintf("value-%d", i))))
+		}
+		require.NoError(t, bucket.Put([]byte("tmp:1"), []byte("hidden")))
+		require.NoError(t, bucket.SetPrefixTTL([]byte("tmp:"), time.Now().Add(-time.Second)))
+		_, err = tx.CreateBucket([]byte("other"))
+		return err
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("items"))
+		require.NoError(t, err)
+
+		// expired keys are skipped like by cursors
+		var keys []string
+		for k, v := range bucket.All() {
+			require.Equal(t, fmt.Sprintf("value-%d", len(keys)), string(v))
+			keys = append(keys, string(k))
+		}
+		require.Len(t, keys, 100)
+
+		keys = keys[:0]
+		for k := range bucket.Range([]byte("key-010"), []byte("key-015")) {
+			keys = append(keys, string(k))
+		}
+		require.Equal(t, []string{"key-010", "key-011", "key-012", "key-013", "key-014"}, keys)
+		n := 0
+		for range bucket.Range([]byte("key-095"), nil) {
+			n++
+		}
+		require.Equal(t, 5, n)
+
+		// an early break leaves nothing behind, the iterator can run again
+		seq, errp := bucket.AllErr()
+		for range 2 {
+			keys = keys[:0]
+			for k := range seq {
+				if len(keys) == 3 {
+					break
+				}
+				keys = append(keys, string(k))
+			}
+			require.Equal(t, []string{"key-000", "key-001", "key-002"}, keys)
+			require.NoError(t, *errp)
+		}
+
+		var names []string
+		for name, b := range tx.AllBuckets() {
+			require.Equal(t, string(name), string(b.name))
+			names = append(names, string(name))
+		}
+		require.Equal(t, []string{"items", "other"}, names)
+		for name := range tx.AllBuckets() {
+			require.Equal(t, "items", string(name))
+			break
+		}
+		return nil
+	}))
+
+	// a write transaction sees its new buckets and can commit after breaking out
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("created"))
+		require.NoError(t, err)
+		var names []string
+		for name := range tx.AllBuckets() {
+			names = append(names, string(name))
+		}
+		require.Equal(t, []string{"created", "items", "other"}, names)
+		bucket, err := tx.GetBucket([]byte("items"))
+		require.NoError(t, err)
+		for range bucket.All() {
+			break
+		}
+		return bucket.Put([]byte("key-100"), []byte("value-100"))
+	}))
+}
+
+func TestBucketIteratorReadFailure(t *testing.T) {
+	filename := TempFileName(".db")
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(filename + ".tlog")
+	})
+	failpoints := NewFailpoints()
+	db := openTestDB(t, filename, DefaultOptions().WithFailpoints(failpoints).WithReadAhead(0))
+	const total = 2000
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("items"))
+		require.NoError(t, err)
+		for i := 0; i < total; i++ {
+			require.NoError(t, bucket.Put([]byte(fmt.Sprintf("key-%05d", i)), make([]byte, 100)))
+		}
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("items"))
+		require.NoError(t, err)
+		// a full pass counts the page reads, the second pass fails half way through
+		failpoints.Enable(FailpointPageRead, func(hit int) error { return nil })
+		for range bucket.All() {
+		}
+		reads := failpoints.Hits(FailpointPageRead)
+		failpoints.Enable(FailpointPageRead, func(hit int) error {
+			if hit > reads/2 {
+				return errInjected
+			}
+			return nil
+		})
+		defer failpoints.Disable(FailpointPageRead)
+
+		seq, errp := bucket.AllErr()
+		n := 0
+		for range seq {
+			n++
+		}
+		require.ErrorIs(t, *errp, errInjected)
+		require.Positive(t, n)
+		require.Less(t, n, total)
+
+		// All ends the same way without telling
+		failpoints.Enable(FailpointPageRead, FailNth(reads/2, errInjected))
+		m := 0
+		for range bucket.All() {
+			m++
+		}
+		require.Less(t, m, total)
+		return nil
+	}))
+}
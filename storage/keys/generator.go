@@ -0,0 +1,105 @@
+package keys
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GeneratedKeySize is the length of a key made by Generator
+const GeneratedKeySize = 16
+
+// hlcLogicalBits of a clock timestamp count events within a wall clock millisecond
+const hlcLogicalBits = 16
+
+// Clock is a hybrid logical clock. A timestamp holds the wall clock in Unix milliseconds in
+// its upper 48 bits and a logical counter in the lower 16, every timestamp of a clock is
+// greater than the ones before, also when the wall clock goes back or more than 65536
+// timestamps are taken within a millisecond: the counter then carries into the milliseconds.
+type Clock struct {
+	lock sync.Mutex
+	last uint64
+	wall func() time.Time
+}
+
+func NewClock() *Clock {
+	return &Clock{wall: time.Now}
+}
+
+// Now returns a timestamp greater than every one returned or observed before
+func (clock *Clock) Now() uint64 {
+	wall := uint64(clock.wall().UnixMilli()) << hlcLogicalBits
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	if wall > clock.last {
+		clock.last = wall
+	} else {
+		clock.last++
+	}
+	return clock.last
+}
+
+// Observe moves the clock past a timestamp received from another node, so the next one
+// taken here is ordered after it
+func (clock *Clock) Observe(remote uint64) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	clock.last = max(clock.last, remote)
+}
+
+// ClockTime returns the wall clock time of a timestamp, in millisecond precision
+func ClockTime(timestamp uint64) time.Time {
+	return time.UnixMilli(int64(timestamp >> hlcLogicalBits)).UTC()
+}
+
+// ClockTimestamp returns the first timestamp of the millisecond of t, timestamps taken at t
+// or later are not below it. Times before 1970 return 0.
+func ClockTimestamp(t time.Time) uint64 {
+	millis := t.UnixMilli()
+	if millis < 0 {
+		return 0
+	}
+	return uint64(millis) << hlcLogicalBits
+}
+
+// Generator makes 16 byte keys that sort by the time they were made: the clock timestamp,
+// the shard id and a counter of the generator, all big endian. The timestamps of a clock
+// never repeat, so keys of one generator can not collide and generators of shards with
+// distinct ids neither. The counter tells apart generators of one shard sharing a clock.
+type Generator struct {
+	clock   *Clock
+	shard   uint32
+	counter atomic.Uint32
+}
+
+func NewGenerator(clock *Clock, shard uint32) *Generator {
+	return &Generator{clock: clock, shard: shard}
+}
+
+// Next returns a new key
+func (gen *Generator) Next() []byte {
+	key := make([]byte, 0, GeneratedKeySize)
+	key = binary.BigEndian.AppendUint64(key, gen.clock.Now())
+	key = binary.BigEndian.AppendUint32(key, gen.shard)
+	return binary.BigEndian.AppendUint32(key, gen.counter.Add(1))
+}
+
+// GeneratedKey is a key made by Generator taken apart
+type GeneratedKey struct {
+	Timestamp uint64 // clock timestamp, see ClockTime
+	Shard     uint32
+	Counter   uint32
+}
+
+// ParseGeneratedKey takes apart a key made by Generator
+func ParseGeneratedKey(key []byte) (GeneratedKey, error) {
+	if len(key) != GeneratedKeySize {
+		return GeneratedKey{}, ErrInvalidKey
+	}
+	return GeneratedKey{
+		Timestamp: binary.BigEndian.Uint64(key),
+		Shard:     binary.BigEndian.Uint32(key[8:]),
+		Counter:   binary.BigEndian.Uint32(key[12:]),
+	}, nil
+}
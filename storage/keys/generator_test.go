@@ -0,0 +1,68 @@
+package keys
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClock(t *testing.T) {
+	wall := time.UnixMilli(1_700_000_000_000)
+	clock := &Clock{wall: func() time.Time { return wall }}
+	first := clock.Now()
+	require.Equal(t, wall.UTC(), ClockTime(first))
+	require.Equal(t, first, ClockTimestamp(wall.Add(time.Microsecond)))
+	require.Zero(t, ClockTimestamp(time.Unix(-1, 0)))
+
+	// within a millisecond and with the wall clock going back the logical counter grows
+	require.Equal(t, first+1, clock.Now())
+	wall = wall.Add(-time.Second)
+	require.Equal(t, first+2, clock.Now())
+	for i := 0; i < 1<<hlcLogicalBits; i++ {
+		clock.Now()
+	}
+	require.Equal(t, ClockTime(first).Add(time.Millisecond), ClockTime(clock.Now()), "the counter carries")
+
+	remote := first + 10<<hlcLogicalBits
+	clock.Observe(remote)
+	require.Equal(t, remote+1, clock.Now())
+	clock.Observe(first)
+	require.Equal(t, remote+2, clock.Now())
+}
+
+func TestGenerator(t *testing.T) {
+	gen := NewGenerator(NewClock(), 7)
+	const goroutines, perGoroutine = 8, 2000
+	generated := make(chan []byte, goroutines*perGoroutine)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var last []byte
+			for j := 0; j < perGoroutine; j++ {
+				key := gen.Next()
+				require.Positive(t, bytes.Compare(key, last), "keys of a goroutine grow")
+				last = key
+				generated <- key
+			}
+		}()
+	}
+	wg.Wait()
+	close(generated)
+	seen := make(map[string]bool)
+	for key := range generated {
+		require.Len(t, key, GeneratedKeySize)
+		require.False(t, seen[string(key)])
+		seen[string(key)] = true
+		parsed, err := ParseGeneratedKey(key)
+		require.NoError(t, err)
+		require.EqualValues(t, 7, parsed.Shard)
+		require.WithinDuration(t, time.Now(), ClockTime(parsed.Timestamp), time.Minute)
+	}
+	_, err := ParseGeneratedKey([]byte("short"))
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
@@ -0,0 +1,118 @@
+// Package keys builds composite keys whose byte order follows the order of their parts, so a
+// bucket sorts them part by part and the encoding of the leading parts is a prefix of the key.
+//
+// Every part ends with Separator and a 0x00 byte inside a part is escaped as 0x00 0xFF. A
+// length prefix would sort a short part before any longer one, the escaping keeps the byte
+// order of the parts: a part sorts before every part it is a prefix of. Parts without a
+// 0x00 byte are stored as they are, text parts stay readable.
+package keys
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrInvalidKey = errors.New("keys: invalid encoded key")
+
+const (
+	escapeByte  = 0x00
+	endByte     = 0x01 // follows escapeByte at the end of a part
+	escapedZero = 0xFF // follows escapeByte for a 0x00 inside a part
+)
+
+// Separator ends every encoded part, a delimiter listing keys grouped by their first parts
+var Separator = []byte{escapeByte, endByte}
+
+// Encode returns the composite key of the parts. Encode of the first parts of a key is a
+// prefix of the key that no key with other first parts starts with.
+func Encode(parts ...[]byte) []byte {
+	size := 0
+	for _, part := range parts {
+		size += len(part) + len(Separator)
+	}
+	key := make([]byte, 0, size)
+	for _, part := range parts {
+		for {
+			i := bytes.IndexByte(part, escapeByte)
+			if i < 0 {
+				break
+			}
+			key = append(key, part[:i]...)
+			key = append(key, escapeByte, escapedZero)
+			part = part[i+1:]
+		}
+		key = append(key, part...)
+		key = append(key, Separator...)
+	}
+	return key
+}
+
+// Decode returns the parts of a key built by Encode
+func Decode(key []byte) ([][]byte, error) {
+	var parts [][]byte
+	part := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != escapeByte {
+			part = append(part, key[i])
+			continue
+		}
+		if i+1 == len(key) {
+			return nil, ErrInvalidKey
+		}
+		i++
+		switch key[i] {
+		case endByte:
+			parts = append(parts, part)
+			part = []byte{}
+		case escapedZero:
+			part = append(part, escapeByte)
+		default:
+			return nil, ErrInvalidKey
+		}
+	}
+	if len(part) > 0 {
+		return nil, ErrInvalidKey
+	}
+	return parts, nil
+}
+
+// Uint64 encodes v big endian, the encodings sort as the numbers
+func Uint64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// DecodeUint64 returns the number encoded by Uint64
+func DecodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, ErrInvalidKey
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// Int64 encodes v big endian with the sign bit flipped, negative numbers sort first
+func Int64(v int64) []byte {
+	return Uint64(uint64(v) ^ 1<<63)
+}
+
+// DecodeInt64 returns the number encoded by Int64
+func DecodeInt64(b []byte) (int64, error) {
+	v, err := DecodeUint64(b)
+	return int64(v ^ 1<<63), err
+}
+
+// Time encodes t as Int64 of its Unix nanoseconds, which covers the years 1678 to 2262.
+// The location is not kept.
+func Time(t time.Time) []byte {
+	return Int64(t.UnixNano())
+}
+
+// DecodeTime returns the time encoded by Time in UTC
+func DecodeTime(b []byte) (time.Time, error) {
+	nanos, err := DecodeInt64(b)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos).UTC(), nil
+}
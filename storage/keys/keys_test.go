@@ -0,0 +1,113 @@
+package keys
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"reflect"
+	"slices"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// parts are composite key parts made mostly of the bytes the encoding treats specially
+type parts [][]byte
+
+func (parts) Generate(rnd *rand.Rand, size int) reflect.Value {
+	alphabet := []byte{escapeByte, endByte, escapedZero, 0x02, 'a'}
+	list := make(parts, rnd.Intn(4))
+	for i := range list {
+		list[i] = make([]byte, rnd.Intn(size%6+1))
+		for j := range list[i] {
+			list[i][j] = alphabet[rnd.Intn(len(alphabet))]
+		}
+	}
+	return reflect.ValueOf(list)
+}
+
+// compareParts orders part lists part by part, a list sorts before the lists it is a prefix of
+func compareParts(a, b parts) int {
+	return slices.CompareFunc(a, b, bytes.Compare)
+}
+
+var quickConfig = &quick.Config{MaxCount: 10000, Rand: rand.New(rand.NewSource(1))}
+
+func TestEncodeOrder(t *testing.T) {
+	order := func(a, b parts) bool {
+		return compareParts(a, b) == bytes.Compare(Encode(a...), Encode(b...))
+	}
+	require.NoError(t, quick.Check(order, quickConfig))
+}
+
+func TestEncodePrefix(t *testing.T) {
+	// an encoding is a prefix of another exactly when its parts are the first parts
+	prefix := func(a, c parts) bool {
+		isFirst := len(c) <= len(a) && compareParts(c, a[:len(c)]) == 0
+		return isFirst == bytes.HasPrefix(Encode(a...), Encode(c...))
+	}
+	require.NoError(t, quick.Check(prefix, quickConfig))
+}
+
+func TestDecode(t *testing.T) {
+	roundTrip := func(a parts) bool {
+		decoded, err := Decode(Encode(a...))
+		return err == nil && compareParts(a, decoded) == 0
+	}
+	require.NoError(t, quick.Check(roundTrip, quickConfig))
+
+	decoded, err := Decode(Encode([]byte("tenant"), []byte("a\x00b"), nil))
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("tenant"), []byte("a\x00b"), {}}, decoded)
+	require.Equal(t, []byte("tenant\x00\x01"), Encode([]byte("tenant")), "text parts stay readable")
+	for _, invalid := range []string{"abc", "abc\x00", "a\x00\x02\x00\x01", "a\x00\x01b"} {
+		_, err = Decode([]byte(invalid))
+		require.ErrorIs(t, err, ErrInvalidKey, "%q", invalid)
+	}
+}
+
+func TestNumberOrder(t *testing.T) {
+	unsigned := func(a, b uint64) bool {
+		decoded, err := DecodeUint64(Uint64(a))
+		return err == nil && decoded == a && cmpInt(a, b) == bytes.Compare(Uint64(a), Uint64(b))
+	}
+	require.NoError(t, quick.Check(unsigned, quickConfig))
+	signed := func(a, b int64) bool {
+		decoded, err := DecodeInt64(Int64(a))
+		return err == nil && decoded == a && cmpInt(a, b) == bytes.Compare(Int64(a), Int64(b))
+	}
+	require.NoError(t, quick.Check(signed, quickConfig))
+	edges := []int64{math.MinInt64, -1, 0, 1, math.MaxInt64}
+	for i := 1; i < len(edges); i++ {
+		require.Negative(t, bytes.Compare(Int64(edges[i-1]), Int64(edges[i])))
+	}
+	_, err := DecodeInt64([]byte{1, 2})
+	require.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestTimeOrder(t *testing.T) {
+	times := func(a, b int64) bool {
+		ta, tb := time.Unix(0, a), time.Unix(0, b)
+		decoded, err := DecodeTime(Time(ta))
+		return err == nil && decoded.Equal(ta) && ta.Compare(tb) == bytes.Compare(Time(ta), Time(tb))
+	}
+	require.NoError(t, quick.Check(times, quickConfig))
+
+	// numbers inside composite keys keep their order
+	before := Encode([]byte("tenant"), []byte("order"), Time(time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC)))
+	after := Encode([]byte("tenant"), []byte("order"), Time(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+	require.Negative(t, bytes.Compare(before, after))
+	require.True(t, bytes.HasPrefix(after, Encode([]byte("tenant"), []byte("order"))))
+}
+
+func cmpInt[T uint64 | int64](a, b T) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
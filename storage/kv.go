@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+)
+
+// Put stores the value of the key in its own transaction, the bucket is created on its first
+// write. The write runs as UpdateBucket does, next to the writers of other buckets.
+func (db *DB) Put(bucket, key, value []byte) error {
+	return db.updateOrCreateBucket(bucket, func(b *Bucket) error {
+		return b.Put(key, value)
+	})
+}
+
+// Get returns a copy of the value of the key, ErrKeyNotFound for a missing key or bucket
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	var value []byte
+	err := db.View(func(tx *Tx) error {
+		b, err := tx.GetBucket(bucket)
+		if err != nil {
+			return err
+		}
+		v, found, err := b.Lookup(key)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrKeyNotFound
+		}
+		value = bytes.Clone(v)
+		return nil
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, ErrKeyNotFound
+	}
+	return value, err
+}
+
+// Delete removes the key in its own transaction, ErrKeyNotFound for a missing key or bucket
+func (db *DB) Delete(bucket, key []byte) error {
+	err := db.UpdateBucket(bucket, func(b *Bucket) error {
+		return b.Remove(key)
+	})
+	if errors.Is(err, ErrBucketNotFound) || errors.Is(err, ErrNodeNotFound) {
+		return ErrKeyNotFound
+	}
+	return err
+}
+
+// ForEach calls fn for every key of the bucket in order in a read transaction, a missing
+// bucket has no keys. Keys and values are valid only until fn returns, an error of fn stops
+// the iteration and is returned.
+func (db *DB) ForEach(bucket []byte, fn func(k, v []byte) error) error {
+	err := db.View(func(tx *Tx) error {
+		b, err := tx.GetBucket(bucket)
+		if err != nil {
+			return err
+		}
+		return b.ForEach(fn)
+	})
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil
+	}
+	return err
+}
+
+// updateOrCreateBucket runs fn as UpdateBucket does, a missing bucket is created in a
+// transaction of the whole database
+func (db *DB) updateOrCreateBucket(name []byte, fn func(bucket *Bucket) error) error {
+	err := db.UpdateBucket(name, fn)
+	if !errors.Is(err, ErrBucketNotFound) {
+		return err
+	}
+	return db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		return fn(bucket)
+	})
+}
@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDBKeyValue(t *testing.T) {
+	db, _ := createTestDB(t)
+	bucket := []byte("kv")
+
+	_, err := db.Get(bucket, []byte("a"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	require.ErrorIs(t, db.Delete(bucket, []byte("a")), ErrKeyNotFound)
+	require.NoError(t, db.ForEach(bucket, func(k, v []byte) error {
+		t.Fatalf("unexpected key %q", k)
+		return nil
+	}))
+
+	// the first write creates the bucket
+	require.NoError(t, db.Put(bucket, []byte("b"), []byte("2")))
+	require.NoError(t, db.Put(bucket, []byte("a"), []byte("1")))
+	require.NoError(t, db.Put(bucket, []byte("c"), []byte("3")))
+	value, err := db.Get(bucket, []byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), value)
+	_, err = db.Get(bucket, []byte("missing"))
+	require.ErrorIs(t, err, ErrKeyNotFound)
+
+	require.NoError(t, db.Delete(bucket, []byte("c")))
+	require.ErrorIs(t, db.Delete(bucket, []byte("c")), ErrKeyNotFound)
+	var keys []string
+	require.NoError(t, db.ForEach(bucket, func(k, v []byte) error {
+		keys = append(keys, string(k)+"="+string(v))
+		return nil
+	}))
+	require.Equal(t, []string{"a=1", "b=2"}, keys)
+
+	errStop := errors.New("stop")
+	calls := 0
+	require.ErrorIs(t, db.ForEach(bucket, func(k, v []byte) error {
+		calls++
+		return errStop
+	}), errStop)
+	require.Equal(t, 1, calls)
+
+	// the value returned by Get outlives its transaction
+	require.NoError(t, db.Put(bucket, []byte("a"), []byte("changed")))
+	require.Equal(t, []byte("1"), value)
+	require.ErrorIs(t, db.Put(bucket, make([]byte, MaxKeySize), []byte("1")), ErrKeyTooLarge)
+}
@@ -1,30 +1,60 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/uuid"
 )
 
 // Meta page map
-// 0            1            8            10                       18                       26                       34
-// +------------+------------+------------+------------------------+------------------------+------------------------+
-// | Page Type  | DB Name    | DB Version |       Root Page        |     Freelist Page      |      Page Size         |
-// |  uint8     |  7 bytes   |  uint16    |        uint64          |        uint64          |        uint64          |
-// +------------+------------+------------+------------------------+------------------------+------------------------+
+// 0            1            8            10                       18                       26                       34         35
+// +------------+------------+------------+------------------------+------------------------+------------------------+----------+
+// | Page Type  | DB Name    | DB Version |       Root Page        |     Freelist Page      |      Page Size         |  Flags   |
+// |  uint8     |  7 bytes   |  uint16    |        uint64          |        uint64          |        uint64          |  uint8   |
+// +------------+------------+------------+------------------------+------------------------+------------------------+----------+
+// Files written before flags were added have zero there, which reads as a clean shutdown.
+
+// With metaFlagBlobFile the blob file fields follow the flags, see blob_file.go
+// 35                       43              44
+// +------------------------+---------------+------------------+
+// | Blob Freelist Page     | Name Length   |  Blob File Name  |
+// |        uint64          |    uint8      |  bytes[]         |
+// +------------------------+---------------+------------------+
+
+// With metaFlagDatabaseID the id follows the longest blob file name, the tx log records it
+// 299                      315
+// +------------------------+
+// |      Database ID       |
+// |       16 bytes         |
+// +------------------------+
 
 const (
 	metaPageNumber     = 0
 	freelistPageNumber = 1
 	rootPageNumber     = 2
 	dbName             = "pirindb"
-	dbVersionMinor     = 2
+	dbVersionMinor     = 12
 	dbVersionMajor     = 0
+	// dbVersionMinorOldest is the oldest minor version with a golden file in testdata,
+	// older files are refused instead of being misread
+	dbVersionMinorOldest = 2
+	// maxPageSize bounds the page size read from a meta page or a tx log record, a larger one
+	// is corruption and would size buffers by it
+	maxPageSize = 1 << 20
+	// currentFormatVersion is the version written to the meta page, major in the high byte
+	currentFormatVersion = uint16(dbVersionMajor)<<8 | uint16(dbVersionMinor)
 
 	metaPageSize               = UInt8Size
 	metaDbNameSize             = len(dbName)
 	metaDbVersionSize          = UInt16Size
 	metaRootPageNumberSize     = UInt64Size
 	metaFreelistPageNumberSize = UInt64Size
+	metaPageSizeSize           = UInt64Size
 
 	metaPageTypeOffset           = 0
 	metaDbNameOffset             = metaPageTypeOffset + metaPageSize
@@ -32,6 +62,20 @@ const (
 	metaRootPageNumberOffset     = metaDbVersionOffset + metaDbVersionSize
 	metaFreelistPageNumberOffset = metaRootPageNumberOffset + metaRootPageNumberSize
 	metaPageSizeOffset           = metaFreelistPageNumberOffset + metaFreelistPageNumberSize
+	metaFlagsOffset              = metaPageSizeOffset + metaPageSizeSize
+	metaBlobFreelistPageOffset   = metaFlagsOffset + UInt8Size
+	metaBlobFileNameLenOffset    = metaBlobFreelistPageOffset + UInt64Size
+	metaBlobFileNameOffset       = metaBlobFileNameLenOffset + UInt8Size
+	metaDbIDOffset               = metaBlobFileNameOffset + maxBlobFileName
+	metaDbIDSize                 = 16 // uuid.UUID
+
+	// metaFlagOpen is set while the database is open, it stays set after a crash
+	metaFlagOpen = 1 << 0
+	// metaFlagBlobFile is set once a bucket keeps its blobs in a blob file
+	metaFlagBlobFile = 1 << 1
+	// metaFlagDatabaseID is set once the file has a database id, files before 0.9 get one
+	// from their migration
+	metaFlagDatabaseID = 1 << 2
 )
 
 type Meta struct {
@@ -40,12 +84,16 @@ type Meta struct {
 	root               uint64
 	freelistPageNumber uint64
 	pageSize           uint64
+	flags              uint8
+	blobFreelistPage   uint64 // first freelist page of the blob file, with metaFlagBlobFile
+	blobFile           string
+	id                 uuid.UUID // zero without metaFlagDatabaseID
 }
 
 func NewMeta(pageSize uint64) *Meta {
 	return &Meta{
 		dbName:             dbName,
-		dbVersion:          uint16(dbVersionMajor)<<8 | uint16(dbVersionMinor),
+		dbVersion:          currentFormatVersion,
 		root:               rootPageNumber,
 		freelistPageNumber: freelistPageNumber,
 		pageSize:           pageSize,
@@ -56,6 +104,12 @@ func (m *Meta) GetDbName() string {
 	return m.dbName
 }
 
+// setID gives the meta a new database id
+func (m *Meta) setID(id uuid.UUID) {
+	m.id = id
+	m.flags |= metaFlagDatabaseID
+}
+
 func (m *Meta) GetDbVersion() (major byte, minor byte) {
 	return byte(m.dbVersion >> 8), byte(m.dbVersion & 0xff)
 }
@@ -65,6 +119,26 @@ func (m *Meta) GetDbVersionString() string {
 	return fmt.Sprintf("%d.%d", major, minor)
 }
 
+// checkFormat returns ErrNewerFormat or ErrOlderFormat with both versions if this build
+// can not serve a file with the meta
+func (m *Meta) checkFormat() error {
+	if m.dbName != dbName {
+		return ErrBadDbName
+	}
+	if m.pageSize == 0 || m.pageSize > maxPageSize {
+		return fmt.Errorf("%w: meta page size %d", ErrCorrupted, m.pageSize)
+	}
+	major, minor := m.GetDbVersion()
+	supported := fmt.Sprintf("%d.%d to %d.%d", dbVersionMajor, dbVersionMinorOldest, dbVersionMajor, dbVersionMinor)
+	switch {
+	case major > dbVersionMajor || major == dbVersionMajor && minor > dbVersionMinor:
+		return fmt.Errorf("%w: file format %s, this build reads %s", ErrNewerFormat, m.GetDbVersionString(), supported)
+	case major < dbVersionMajor || minor < dbVersionMinorOldest:
+		return fmt.Errorf("%w: file format %s, this build reads %s", ErrOlderFormat, m.GetDbVersionString(), supported)
+	}
+	return nil
+}
+
 func (m *Meta) Serialize(data []byte) {
 	data[metaPageTypeOffset] = MetaPage
 	copy(data[metaDbNameOffset:], m.dbName)
@@ -72,9 +146,23 @@ func (m *Meta) Serialize(data []byte) {
 	binary.LittleEndian.PutUint64(data[metaRootPageNumberOffset:], m.root)
 	binary.LittleEndian.PutUint64(data[metaFreelistPageNumberOffset:], m.freelistPageNumber)
 	binary.LittleEndian.PutUint64(data[metaPageSizeOffset:], m.pageSize)
+	data[metaFlagsOffset] = m.flags
+	if m.flags&metaFlagBlobFile != 0 {
+		binary.LittleEndian.PutUint64(data[metaBlobFreelistPageOffset:], m.blobFreelistPage)
+		data[metaBlobFileNameLenOffset] = byte(len(m.blobFile))
+		copy(data[metaBlobFileNameOffset:], m.blobFile)
+	}
+	if m.flags&metaFlagDatabaseID != 0 {
+		copy(data[metaDbIDOffset:], m.id[:])
+	}
 }
 
-func (m *Meta) Deserialize(data []byte) {
+// Deserialize decodes a meta page, data shorter than the fields up to the flags returns an
+// error wrapping ErrCorrupted. The fields are not validated, see checkFormat.
+func (m *Meta) Deserialize(data []byte) error {
+	if len(data) <= metaFlagsOffset {
+		return fmt.Errorf("%w: meta page of %d bytes", ErrCorrupted, len(data))
+	}
 	pos := 0
 	if data[pos] != MetaPage {
 		logger.Warn("page type is not a meta page", "type", data[pos])
@@ -84,9 +172,22 @@ func (m *Meta) Deserialize(data []byte) {
 	m.root = binary.LittleEndian.Uint64(data[metaRootPageNumberOffset:])
 	m.freelistPageNumber = binary.LittleEndian.Uint64(data[metaFreelistPageNumberOffset:])
 	m.pageSize = binary.LittleEndian.Uint64(data[metaPageSizeOffset:])
+	m.flags = data[metaFlagsOffset]
+	if m.flags&metaFlagBlobFile != 0 && len(data) > metaBlobFileNameLenOffset {
+		m.blobFreelistPage = binary.LittleEndian.Uint64(data[metaBlobFreelistPageOffset:])
+		nameLen := int(data[metaBlobFileNameLenOffset])
+		m.blobFile = string(data[metaBlobFileNameOffset:min(len(data), metaBlobFileNameOffset+nameLen)])
+	}
+	if m.flags&metaFlagDatabaseID != 0 && len(data) >= metaDbIDOffset+metaDbIDSize {
+		copy(m.id[:], data[metaDbIDOffset:])
+	}
+	return nil
 }
 
 func WriteMeta(dal *Dal, m *Meta) error {
+	if err := dal.failpoint(FailpointMetaWrite); err != nil {
+		return err
+	}
 	page, err := dal.GetPage(0)
 	if err != nil {
 		return fmt.Errorf("failed to get pageNum 0: %w", err)
@@ -94,22 +195,79 @@ func WriteMeta(dal *Dal, m *Meta) error {
 	page.PageNumber = metaPageNumber
 	m.Serialize(page.Data)
 	logger.Debug("write meta pageNum", "rootPage", m.root)
+	defer dal.releasePage(page)
 	return dal.SetPage(page)
 }
 
+// readMetaFlags returns the meta flags without validating the meta page
+func readMetaFlags(dal *Dal) uint8 {
+	page, err := dal.GetPage(0)
+	if err != nil {
+		return 0
+	}
+	defer dal.releasePage(page)
+	return page.Data[metaFlagsOffset]
+}
+
 func ReadMeta(dal *Dal) (*Meta, error) {
 	page, err := dal.GetPage(0)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get pageNum 0: %w", err)
 	}
 	m := NewMeta(0)
-	m.Deserialize(page.Data)
-	if m.dbName != dbName {
-		return nil, ErrBadDbName
+	err = m.Deserialize(page.Data)
+	dal.releasePage(page)
+	if err != nil {
+		return nil, err
 	}
-	if m.dbVersion>>8 != uint16(dbVersionMajor) {
-		return nil, ErrBadDbVersion
+	if err = m.checkFormat(); err != nil {
+		return nil, err
 	}
 	logger.Debug("read meta pageNum", "dbName", m.dbName, "version", m.GetDbVersionString(), "rootPage", m.root)
 	return m, nil
 }
+
+// checkDatabaseFile reads the meta page of an existing file with plain reads, so a file this
+// build can not serve is refused before Open grows it, replays the tx log or marks it open.
+// The meta is returned for the format version, the page size and the database id.
+func checkDatabaseFile(path string) (*Meta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return checkDatabaseImage(file, info.Size(), path)
+}
+
+// checkDatabaseImage checks the meta page and the size of a database image, name is
+// only used in errors
+func checkDatabaseImage(r io.ReaderAt, size int64, name string) (*Meta, error) {
+	data := make([]byte, metaDbIDOffset+metaDbIDSize)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	m := &Meta{}
+	_ = m.Deserialize(data[:n]) // a short file has no name and is not a database
+	if m.dbName != dbName {
+		if bytes.Count(data[:n], []byte{0}) == n {
+			// pre-created or never initialized, not a damaged database
+			return nil, fmt.Errorf("%w: %s is empty or zero filled", ErrNotADatabase, name)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotADatabase, name)
+	}
+	if err = m.checkFormat(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if size < minFileSize {
+		return nil, fmt.Errorf("%w: %s has %d bytes, a database has at least %d", ErrTruncatedDatabase,
+			name, size, minFileSize)
+	}
+	return m, nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// migration upgrades a file to the minor version, run is nil when the commit of the step is
+// the whole migration: the freelist, nodes and values are written in the current encoding by
+// every commit, files of older versions are read as they are. A migration must be idempotent,
+// a step interrupted by a crash runs again on the next open.
+type migration struct {
+	minor byte
+	name  string
+	run   func(tx *Tx) error
+}
+
+// migrations has a step for every minor version after dbVersionMinorOldest, a format change
+// adds its step here
+var migrations = []migration{
+	{minor: 3, name: "freelist ranges"},
+	{minor: 4, name: "bucket value headers", run: rewriteBuckets},
+	{minor: 5, name: "value checksums"}, // values written before keep none
+	{minor: 6, name: "blob file"},
+	{minor: 7, name: "subtree counts", run: countSubtrees},
+	{minor: 8, name: "wide nodes"}, // only nodes that overflow uint16 are wide
+	{minor: 9, name: "database id", run: assignDatabaseID},
+	{minor: 10, name: "freelist checksums"},
+	{minor: 11, name: "nested buckets"},
+	{minor: 12, name: "blob sizes in references"}, // blobs written before keep the page only
+}
+
+// MigrationStep is reported to Options.MigrationProgress after a migration step committed
+type MigrationStep struct {
+	Step     int    // 1 based
+	Steps    int    // steps the file needs
+	Version  string // format version the file has now
+	Name     string
+	Duration time.Duration
+}
+
+// Migrate opens the database file, runs the migrations it needs and closes it. progress is
+// called after every step, it may be nil. It returns the number of steps run, zero for a file
+// of the current format.
+func Migrate(path string, opts *Options, progress func(MigrationStep)) (int, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	migrateOpts := *opts
+	migrateOpts.AutoMigrate = true
+	migrateOpts.MigrationProgress = progress
+	migrateOpts.MustExist = true
+	migrateOpts.MustCreate = false
+	if err := migrateOpts.validate(); err != nil {
+		return 0, err
+	}
+	dal, err := NewDal(path, &migrateOpts)
+	if err != nil {
+		return 0, err
+	}
+	db := newDB(dal, &migrateOpts)
+	if err = db.rebuildFreelist(); err != nil {
+		_ = db.Close()
+		return 0, err
+	}
+	steps, err := db.migrate()
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return steps, err
+}
+
+// migrate runs the migrations after the format version of the file, each in its own write
+// transaction. The meta page of the file is saved next to it before the first step. A step
+// commits the version it upgraded the file to, the meta is written last in every commit.
+func (db *DB) migrate() (int, error) {
+	dal := db.dal
+	var pending []migration
+	for _, step := range migrations {
+		if uint16(dbVersionMajor)<<8|uint16(step.minor) > dal.formatVersion {
+			pending = append(pending, step)
+		}
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+	backup, err := dal.backupMeta()
+	if err != nil {
+		return 0, err
+	}
+	logger.Info("migrating database file", "path", dal.path, "from", dal.meta.GetDbVersionString(),
+		"to", fmt.Sprintf("%d.%d", dbVersionMajor, dbVersionMinor), "steps", len(pending), "meta_backup", backup)
+	for i, step := range pending {
+		started := time.Now()
+		previous := dal.formatVersion
+		err = db.UpdateLabeled("migrate", func(tx *Tx) error {
+			if step.run != nil {
+				if err := step.run(tx); err != nil {
+					return err
+				}
+			}
+			// the version is written with the freelist, which is rewritten in the current encoding
+			dal.formatVersion = uint16(dbVersionMajor)<<8 | uint16(step.minor)
+			dal.freelist.dirty = true
+			return nil
+		})
+		if err != nil {
+			dal.formatVersion = previous
+			return i, fmt.Errorf("migration to %d.%d (%s): %w", dbVersionMajor, step.minor, step.name, err)
+		}
+		logger.Info("migration step done", "version", dal.meta.GetDbVersionString(), "name", step.name,
+			"duration", time.Since(started))
+		if progress := dal.opts.MigrationProgress; progress != nil {
+			progress(MigrationStep{
+				Step:     i + 1,
+				Steps:    len(pending),
+				Version:  dal.meta.GetDbVersionString(),
+				Name:     step.name,
+				Duration: time.Since(started),
+			})
+		}
+	}
+	return len(pending), nil
+}
+
+// backupMeta copies the meta page to <path>.meta-<version>.bak, an existing backup of the same
+// version is kept, it was taken before an earlier attempt changed anything
+func (dal *Dal) backupMeta() (string, error) {
+	path := fmt.Sprintf("%s.meta-%s.bak", dal.path, dal.meta.GetDbVersionString())
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	page, err := dal.GetPage(metaPageNumber)
+	if err != nil {
+		return "", err
+	}
+	defer dal.releasePage(page)
+	// the backup reads as a cleanly closed file, as a copy taken by WriteTo
+	page.Data[metaFlagsOffset] &^= metaFlagOpen
+	if err = os.WriteFile(path, page.Data, dal.opts.FileMode); err != nil {
+		return "", fmt.Errorf("could not back up the meta page: %w", err)
+	}
+	return path, nil
+}
+
+// assignDatabaseID gives the file a database id, the tx log records written from this
+// commit on carry it
+func assignDatabaseID(tx *Tx) error {
+	dal := tx.db.dal
+	if dal.meta.flags&metaFlagDatabaseID == 0 {
+		dal.meta.setID(uuid.New())
+		dal.txLog.dbID = dal.meta.id
+	}
+	return nil
+}
+
+// rewriteBuckets marks every bucket dirty, the commit writes their values with the header
+func rewriteBuckets(tx *Tx) error {
+	buckets, _ := tx.bucketNames()
+	for _, name := range buckets {
+		if _, err := tx.GetBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countSubtrees writes the counts of the children into every internal node written without
+// them, in the buckets and in the root bucket
+func countSubtrees(tx *Tx) error {
+	if _, err := countTree(tx, tx.getRootBucket().root); err != nil {
+		return err
+	}
+	buckets, _ := tx.bucketNames()
+	for _, name := range buckets {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return err
+		}
+		if _, err = countTree(tx, bucket.root); err != nil {
+			return fmt.Errorf("bucket %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// countTree counts the subtree of pageNum bottom up and keeps every node it counted dirty
+func countTree(tx *Tx, pageNum uint64) (uint64, error) {
+	node, err := tx.getNode(pageNum)
+	if err != nil {
+		return 0, err
+	}
+	if node.isLeaf() {
+		return uint64(len(node.items)), nil
+	}
+	counts := make([]uint64, len(node.childNodes))
+	for i, child := range node.childNodes {
+		if counts[i], err = countTree(tx, child); err != nil {
+			return 0, err
+		}
+	}
+	if !node.counted() {
+		node.childCounts = counts
+		tx.setNode(node)
+	}
+	return node.subtreeCount(), nil
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// nestedBucketSeparator joins the names of nested buckets in DBStat.Buckets
+const nestedBucketSeparator = "/"
+
+// isBucket reports whether the item is the entry of a nested bucket
+func (item *Item) isBucket() bool {
+	valueType, err := item.valueType()
+	return err == nil && valueType == ValueBucket
+}
+
+// nestedValue encodes the entry of a nested bucket in its parent
+func (bucket *Bucket) nestedValue() []byte {
+	return append([]byte{ValueBucket}, bucket.serialize().Value...)
+}
+
+// recordKey records a change of the key for commit hooks, a change in a nested bucket is
+// reported as a change of its whole top level bucket
+func (bucket *Bucket) recordKey(key []byte, removed bool) {
+	if bucket.parent == nil {
+		bucket.tx.recordKey(bucket.name, key, removed)
+		return
+	}
+	bucket.tx.recordBucket(bucket.topLevel().name)
+}
+
+// recordBucket records a change of the whole bucket for commit hooks, see recordKey
+func (bucket *Bucket) recordBucket() {
+	bucket.tx.recordBucket(bucket.topLevel().name)
+}
+
+// topLevel returns the bucket of the root tree holding the bucket
+func (bucket *Bucket) topLevel() *Bucket {
+	for bucket.parent != nil {
+		bucket = bucket.parent
+	}
+	return bucket
+}
+
+// Bucket returns the bucket nested under name, ErrBucketNotFound if there is none and
+// ErrIncompatibleValue if the key holds a value. Like Tx.GetBucket a write transaction
+// returns the same bucket on every call.
+func (bucket *Bucket) Bucket(name []byte) (*Bucket, error) {
+	if bucket.tx == nil {
+		return nil, ErrTxClosed
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return nil, err
+	}
+	defer bucket.tx.leave()
+	return bucket.nested(name)
+}
+
+func (bucket *Bucket) nested(name []byte) (*Bucket, error) {
+	if child, ok := bucket.buckets[string(name)]; ok {
+		return child, nil
+	}
+	item, err := bucket.findItem(name)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return nil, ErrBucketNotFound
+	}
+	if !item.isBucket() {
+		return nil, bucket.tx.keyError(name, ErrIncompatibleValue)
+	}
+	payload, err := item.payload()
+	if err != nil {
+		return nil, err
+	}
+	child := newBucket(bytes.Clone(name))
+	if err = child.deserialize(payload); err != nil {
+		return nil, fmt.Errorf("bucket %q: %w", name, err)
+	}
+	child.tx = bucket.tx
+	child.parent = bucket
+	if bucket.tx.write {
+		bucket.openNested(child)
+	}
+	return child, nil
+}
+
+// openNested keeps the nested bucket to write it into the bucket on commit
+func (bucket *Bucket) openNested(child *Bucket) {
+	if bucket.buckets == nil {
+		bucket.buckets = make(map[string]*Bucket)
+	}
+	bucket.buckets[string(child.name)] = child
+}
+
+// CreateBucket creates a bucket nested under name. Its entry counts as a key of the bucket
+// for the stats and the quota, cursors return it with a nil value. ErrBucketExists if the
+// nested bucket exists and ErrIncompatibleValue if the key holds a value.
+func (bucket *Bucket) CreateBucket(name []byte) (*Bucket, error) {
+	if bucket.tx == nil {
+		return nil, ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return nil, ErrWriteInRxTransaction
+	}
+	_, err := bucket.nested(name)
+	if err == nil {
+		return nil, ErrBucketExists
+	}
+	if !errors.Is(err, ErrBucketNotFound) {
+		return nil, err
+	}
+	if err = bucket.checkPut(name, 0); err != nil {
+		return nil, err
+	}
+	if err = bucket.checkQuota(1, int64(len(name))); err != nil {
+		return nil, err
+	}
+	root, err := bucket.tx.newNode(nil, []uint64{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	bucket.tx.setNode(root)
+	child := newBucket(bytes.Clone(name))
+	child.root = root.PageNum
+	child.tx = bucket.tx
+	child.parent = bucket
+	if err = bucket.putItem(&Item{Key: child.name, Value: child.nestedValue()}, 0); err != nil {
+		return nil, err
+	}
+	bucket.bucketsN++
+	bucket.openNested(child)
+	return child, nil
+}
+
+// CreateBucketIfNotExists returns the bucket nested under name, created if missing
+func (bucket *Bucket) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	child, err := bucket.Bucket(name)
+	if errors.Is(err, ErrBucketNotFound) {
+		return bucket.CreateBucket(name)
+	}
+	return child, err
+}
+
+// DeleteBucket removes the bucket nested under name with the buckets nested in it and
+// releases their pages like Tx.DeleteBucket, ErrBucketNotFound if there is none and
+// ErrIncompatibleValue if the key holds a value
+func (bucket *Bucket) DeleteBucket(name []byte) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	child, err := bucket.nested(name)
+	if err != nil {
+		return err
+	}
+	if err = child.release(); err != nil {
+		return err
+	}
+	delete(bucket.buckets, string(name))
+	if err := bucket.remove(name, true); err != nil {
+		return err
+	}
+	bucket.bucketsN--
+	return nil
+}
+
+// ForEachBucket calls fn with the name of every nested bucket in order
+func (bucket *Bucket) ForEachBucket(fn func(name []byte) error) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	cursor := bucket.Cursor()
+	cursor.rawValues = true
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if !(&Item{Value: v}).isBucket() {
+			continue
+		}
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// spill writes the nested buckets opened in the transaction into the bucket, the buckets
+// nested in them first. An entry is rewritten only when the bucket value changed.
+func (bucket *Bucket) spill() error {
+	for _, name := range slices.Sorted(maps.Keys(bucket.buckets)) {
+		child := bucket.buckets[name]
+		if err := child.spill(); err != nil {
+			return err
+		}
+		value := child.nestedValue()
+		item, err := bucket.findItem(child.name)
+		if err != nil {
+			return err
+		}
+		if item != nil && bytes.Equal(item.Value, value) {
+			continue
+		}
+		if err = bucket.putItem(&Item{Key: child.name, Value: value}, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nestedStats adds the stats of the buckets nested in the bucket to stats, keyed by the
+// path of names from the top level bucket
+func (bucket *Bucket) nestedStats(path string, stats map[string]*BucketStat) error {
+	if bucket.bucketsN == 0 {
+		return nil // the keys of the bucket are not walked
+	}
+	return bucket.ForEachBucket(func(name []byte) error {
+		child, err := bucket.Bucket(name)
+		if err != nil {
+			return err
+		}
+		childPath := path + nestedBucketSeparator + string(name)
+		stats[childPath] = child.stat()
+		return child.nestedStats(childPath, stats)
+	})
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNestedBuckets(t *testing.T) {
+	db, filename := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		users, err := tx.CreateBucket([]byte("users"))
+		require.NoError(t, err)
+		require.NoError(t, users.Put([]byte("count"), []byte("2")))
+		for _, id := range []string{"1", "2"} {
+			user, err := users.CreateBucket([]byte(id))
+			require.NoError(t, err)
+			require.NoError(t, user.Put([]byte("name"), []byte("user"+id)))
+			sessions, err := user.CreateBucket([]byte("sessions"))
+			require.NoError(t, err)
+			// enough keys to split the nested tree
+			for idx := range 500 {
+				require.NoError(t, sessions.Put([]byte(fmt.Sprintf("%04d", idx)), []byte(id)))
+			}
+		}
+		_, err = users.CreateBucket([]byte("1"))
+		require.ErrorIs(t, err, ErrBucketExists)
+		_, err = users.CreateBucket([]byte("count"))
+		require.ErrorIs(t, err, ErrIncompatibleValue)
+		require.ErrorIs(t, users.Put([]byte("1"), []byte("v")), ErrIncompatibleValue)
+		require.ErrorIs(t, users.Put([]byte("2"), make([]byte, 4000)), ErrIncompatibleValue)
+		require.ErrorIs(t, users.Remove([]byte("1")), ErrIncompatibleValue)
+		require.ErrorIs(t, users.DeleteBucket([]byte("count")), ErrIncompatibleValue)
+		_, found, err := users.Lookup([]byte("1"))
+		require.False(t, found)
+		require.ErrorIs(t, err, ErrIncompatibleValue)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+
+	// the cursor returns nested buckets with a nil value
+	checkUsers := func(db *DB) {
+		require.NoError(t, db.View(func(tx *Tx) error {
+			users, err := tx.GetBucket([]byte("users"))
+			require.NoError(t, err)
+			values := make(map[string][]byte)
+			require.NoError(t, users.ForEach(func(k, v []byte) error {
+				values[string(k)] = v
+				return nil
+			}))
+			require.Equal(t, map[string][]byte{"1": nil, "2": nil, "count": []byte("2")}, values)
+			var names []string
+			require.NoError(t, users.ForEachBucket(func(name []byte) error {
+				names = append(names, string(name))
+				return nil
+			}))
+			require.Equal(t, []string{"1", "2"}, names)
+
+			user, err := users.Bucket([]byte("2"))
+			require.NoError(t, err)
+			value, _ := user.Get([]byte("name"))
+			require.Equal(t, "user2", string(value))
+			sessions, err := user.Bucket([]byte("sessions"))
+			require.NoError(t, err)
+			require.EqualValues(t, 500, sessions.stat().ItemsN)
+			value, _ = sessions.Get([]byte("0499"))
+			require.Equal(t, "2", string(value))
+			_, err = users.Bucket([]byte("3"))
+			require.ErrorIs(t, err, ErrBucketNotFound)
+			_, err = users.Bucket([]byte("count"))
+			require.ErrorIs(t, err, ErrIncompatibleValue)
+			return nil
+		}))
+	}
+	checkUsers(db)
+
+	stat := db.Stat()
+	require.EqualValues(t, 3, stat.Buckets["users"].ItemsN)
+	require.EqualValues(t, 2, stat.Buckets["users"].BucketsN)
+	require.EqualValues(t, 2, stat.Buckets["users/1"].ItemsN)
+	require.EqualValues(t, 500, stat.Buckets["users/1/sessions"].ItemsN)
+	require.Contains(t, stat.Buckets, "users/2/sessions")
+
+	require.NoError(t, db.Close())
+	db = openTestDB(t, filename, nil)
+	checkUsers(db)
+
+	// changes deep down are written up to the root on commit, DeleteRange keeps the buckets
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		users, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		user, err := users.Bucket([]byte("1"))
+		require.NoError(t, err)
+		sessions, err := user.CreateBucketIfNotExists([]byte("sessions"))
+		require.NoError(t, err)
+		deleted, err := sessions.DeleteRange(nil, []byte("0400"))
+		require.NoError(t, err)
+		require.Equal(t, 400, deleted)
+		deleted, err = users.DeleteRange(nil, nil)
+		require.NoError(t, err)
+		require.Equal(t, 1, deleted)
+		return users.DeleteBucket([]byte("2"))
+	}))
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		users, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		require.EqualValues(t, 1, users.stat().ItemsN)
+		require.EqualValues(t, 1, users.stat().BucketsN)
+		_, err = users.Bucket([]byte("2"))
+		require.ErrorIs(t, err, ErrBucketNotFound)
+		user, err := users.Bucket([]byte("1"))
+		require.NoError(t, err)
+		sessions, err := user.Bucket([]byte("sessions"))
+		require.NoError(t, err)
+		require.EqualValues(t, 100, sessions.stat().ItemsN)
+		k, _ := sessions.Cursor().First()
+		require.Equal(t, "0400", string(k))
+		return nil
+	}))
+	require.NotContains(t, db.Stat().Buckets, "users/2")
+
+	// a rolled back creation leaves nothing behind
+	require.Error(t, db.Update(func(tx *Tx) error {
+		users, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		_, err = users.CreateBucket([]byte("3"))
+		require.NoError(t, err)
+		return ErrKeyNotFound
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		users, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		_, err = users.Bucket([]byte("3"))
+		require.ErrorIs(t, err, ErrBucketNotFound)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
@@ -1,12 +1,95 @@
 package storage
 
-import "os"
+import (
+	"os"
+	"time"
+)
+
+// SyncMode controls when committed data is flushed to stable storage
+type SyncMode string
+
+const (
+	// SyncAlways fsyncs the tx log and the database file on every commit
+	SyncAlways SyncMode = "always"
+	// SyncInterval fsyncs the database file every SyncInterval in background, commits in between
+	// append to the tx log and write the database file without fsync. A process crash loses
+	// nothing, but on an OS crash or power loss the pages written since the last sync may reach
+	// the disk torn or without their log record, so the file can be corrupted, not only miss
+	// up to SyncInterval of writes. Check the file after such a crash, see DB.Check.
+	SyncInterval SyncMode = "interval"
+	// SyncNever never fsyncs, requires AllowUnsafeSync
+	SyncNever SyncMode = "never"
+)
 
 type Options struct {
-	FileMode       os.FileMode
-	PageSize       uint64
-	EnableRecovery bool
-	TxLogPath      string
+	FileMode        os.FileMode
+	PageSize        uint64
+	EnableRecovery  bool
+	TxLogPath       string
+	SyncMode        SyncMode
+	SyncInterval    time.Duration
+	AllowUnsafeSync bool        // must be set to use SyncNever
+	Failpoints      *Failpoints // test hooks, nil disables them
+	DirectIO        bool        // open the database file with O_DIRECT on Linux, buffered io elsewhere
+	ReadAheadPages  int         // pages a sequential cursor scan reads ahead, 0 disables read ahead
+	LogKeyMode      LogKeyMode  // how keys are written to logs
+	MaxSize         uint64      // the database file does not grow beyond it, 0 is unlimited
+
+	// Open creates a missing database file unless MustExist is set, it fails with
+	// ErrDatabaseNotFound then. MustCreate fails with ErrDatabaseExists for an existing file.
+	MustExist  bool
+	MustCreate bool
+
+	MaxOpenReaders    int           // read transactions open at once, 0 is unlimited
+	WaitForReader     bool          // Begin(false) waits for a free reader slot instead of failing with ErrTooManyReaders
+	MaxReaderDuration time.Duration // read transactions open longer are invalidated, 0 disables
+
+	// AdvisorEnabled logs a rate limited warning when more than AdvisorRate commits per second
+	// dirty fewer than AdvisorTinyPages pages over AdvisorWindow, commits are not changed.
+	// CommitStats counts tiny commits with AdvisorTinyPages whether it is enabled or not.
+	AdvisorEnabled   bool
+	AdvisorTinyPages int
+	AdvisorRate      float64
+	AdvisorWindow    time.Duration
+
+	// new write transactions fail with ErrWriteStalled while the p95 commit time of the last
+	// 10s is above CommitStallThreshold or MaxWriteQueue writers wait for the lock, 0 disables
+	CommitStallThreshold time.Duration
+	MaxWriteQueue        int
+
+	// ValueChecksums stores the XXH64 of every written value next to it, values written
+	// before keep none. VerifyValueChecksums checks stored checksums on every read and
+	// fails the read with ErrChecksumMismatch.
+	ValueChecksums       bool
+	VerifyValueChecksums bool
+
+	// AutoDeleteEmptyBuckets deletes a bucket at commit when the transaction removed its last
+	// key, with its prefix rules, options and quota. Buckets created empty are kept.
+	AutoDeleteEmptyBuckets bool
+
+	// View, Update and UpdateBucket roll back a transaction whose function panics and panic
+	// again, with RecoverPanics they return ErrTxPanic instead
+	RecoverPanics bool
+
+	// Open fails with ErrMigrationRequired for a file of an older format, with AutoMigrate
+	// it runs the migrations first. MigrationProgress is called after every migration step.
+	AutoMigrate       bool
+	MigrationProgress func(MigrationStep)
+
+	// a tx log written for another database file or page size is never replayed: Open opens
+	// the database read only and reports the mismatch in DBStat.Durability.Recovery, with
+	// FailOnTxLogMismatch it fails with ErrTxLogMismatch instead. The log is left as it is.
+	FailOnTxLogMismatch bool
+
+	// Open fails with ErrFreelistCorrupted when a freelist page fails its checks, with
+	// RebuildFreelist it rebuilds the freelist from the pages reachable from the meta page
+	RebuildFreelist bool
+
+	// soft limits only warn, in DBStat.Warnings and the log, 0 disables each. SizeWarnRatio is
+	// a fraction of MaxSize, FreelistWarnRuns counts runs of free pages, see FreelistInfo.
+	SizeWarnRatio    float64
+	FreelistWarnRuns int
+	TxLogWarnBytes   int64
 }
 
 func DefaultOptions() *Options {
@@ -15,6 +98,14 @@ func DefaultOptions() *Options {
 		PageSize:       BTreePageSize,
 		EnableRecovery: true,
 		TxLogPath:      "", // default to db basename + ".tlog"
+		SyncMode:       SyncAlways,
+		SyncInterval:   time.Second,
+		ReadAheadPages: 8,
+		LogKeyMode:     LogKeyFull,
+
+		AdvisorTinyPages: defaultTinyTxPages,
+		AdvisorRate:      defaultAdvisorRate,
+		AdvisorWindow:    defaultAdvisorWindow,
 	}
 }
 
@@ -37,3 +128,184 @@ func (o *Options) WithFileMode(mode os.FileMode) *Options {
 	o.FileMode = mode
 	return o
 }
+
+func (o *Options) WithSyncMode(mode SyncMode) *Options {
+	o.SyncMode = mode
+	return o
+}
+
+func (o *Options) WithSyncInterval(interval time.Duration) *Options {
+	o.SyncInterval = interval
+	return o
+}
+
+func (o *Options) WithUnsafeSync(allow bool) *Options {
+	o.AllowUnsafeSync = allow
+	return o
+}
+
+func (o *Options) WithDirectIO(enable bool) *Options {
+	o.DirectIO = enable
+	return o
+}
+
+func (o *Options) WithReadAhead(pages int) *Options {
+	o.ReadAheadPages = pages
+	return o
+}
+
+func (o *Options) WithLogKeyMode(mode LogKeyMode) *Options {
+	o.LogKeyMode = mode
+	return o
+}
+
+func (o *Options) WithMaxSize(size uint64) *Options {
+	o.MaxSize = size
+	return o
+}
+
+// WithMustExist makes Open fail with ErrDatabaseNotFound instead of creating a missing file
+func (o *Options) WithMustExist(mustExist bool) *Options {
+	o.MustExist = mustExist
+	return o
+}
+
+// WithMustCreate makes Open fail with ErrDatabaseExists instead of opening an existing file
+func (o *Options) WithMustCreate(mustCreate bool) *Options {
+	o.MustCreate = mustCreate
+	return o
+}
+
+func (o *Options) WithMaxOpenReaders(readers int, wait bool) *Options {
+	o.MaxOpenReaders = readers
+	o.WaitForReader = wait
+	return o
+}
+
+func (o *Options) WithMaxReaderDuration(duration time.Duration) *Options {
+	o.MaxReaderDuration = duration
+	return o
+}
+
+func (o *Options) WithWriteStall(threshold time.Duration, maxQueue int) *Options {
+	o.CommitStallThreshold = threshold
+	o.MaxWriteQueue = maxQueue
+	return o
+}
+
+func (o *Options) WithValueChecksums(write bool, verify bool) *Options {
+	o.ValueChecksums = write
+	o.VerifyValueChecksums = verify
+	return o
+}
+
+func (o *Options) WithAutoDeleteEmptyBuckets(enable bool) *Options {
+	o.AutoDeleteEmptyBuckets = enable
+	return o
+}
+
+func (o *Options) WithRecoverPanics(enable bool) *Options {
+	o.RecoverPanics = enable
+	return o
+}
+
+// WithAutoMigrate makes Open migrate a file of an older format, progress may be nil
+func (o *Options) WithAutoMigrate(enable bool, progress func(MigrationStep)) *Options {
+	o.AutoMigrate = enable
+	o.MigrationProgress = progress
+	return o
+}
+
+// WithFailOnTxLogMismatch makes Open fail instead of opening read only when the tx log does
+// not belong to the database file
+func (o *Options) WithFailOnTxLogMismatch(fail bool) *Options {
+	o.FailOnTxLogMismatch = fail
+	return o
+}
+
+// WithFreelistRebuild makes Open rebuild a damaged freelist instead of failing
+func (o *Options) WithFreelistRebuild(enable bool) *Options {
+	o.RebuildFreelist = enable
+	return o
+}
+
+// WithSoftLimits sets the warning thresholds, zero disables a threshold
+func (o *Options) WithSoftLimits(sizeRatio float64, freelistRuns int, txLogBytes int64) *Options {
+	o.SizeWarnRatio = sizeRatio
+	o.FreelistWarnRuns = freelistRuns
+	o.TxLogWarnBytes = txLogBytes
+	return o
+}
+
+// WithAdvisor enables the tiny transaction warning, zero values keep the defaults
+func (o *Options) WithAdvisor(enable bool, tinyPages int, rate float64, window time.Duration) *Options {
+	o.AdvisorEnabled = enable
+	if tinyPages != 0 {
+		o.AdvisorTinyPages = tinyPages
+	}
+	if rate != 0 {
+		o.AdvisorRate = rate
+	}
+	if window != 0 {
+		o.AdvisorWindow = window
+	}
+	return o
+}
+
+func (o *Options) WithFailpoints(fp *Failpoints) *Options {
+	o.Failpoints = fp
+	return o
+}
+
+func (o *Options) validate() error {
+	switch o.LogKeyMode {
+	case "":
+		o.LogKeyMode = LogKeyFull
+	case LogKeyFull, LogKeyHash, LogKeyNone:
+	default:
+		return ErrBadLogKeyMode
+	}
+	if o.MustExist && o.MustCreate {
+		return ErrBadOpenMode
+	}
+	if o.MaxOpenReaders < 0 || o.MaxReaderDuration < 0 {
+		return ErrBadReaderLimits
+	}
+	if o.CommitStallThreshold < 0 || o.MaxWriteQueue < 0 {
+		return ErrBadWriteStall
+	}
+	if o.AdvisorTinyPages < 0 || o.AdvisorRate < 0 || o.AdvisorWindow < 0 {
+		return ErrBadAdvisorOptions
+	}
+	if o.SizeWarnRatio < 0 || o.SizeWarnRatio > 1 || o.FreelistWarnRuns < 0 || o.TxLogWarnBytes < 0 {
+		return ErrBadSoftLimits
+	}
+	if o.AdvisorTinyPages == 0 {
+		o.AdvisorTinyPages = defaultTinyTxPages
+	}
+	if o.AdvisorRate == 0 {
+		o.AdvisorRate = defaultAdvisorRate
+	}
+	if o.AdvisorWindow == 0 {
+		o.AdvisorWindow = defaultAdvisorWindow
+	}
+	if o.DirectIO && o.PageSize%directIOAlignment != 0 {
+		return ErrBadDirectIOPageSize
+	}
+	switch o.SyncMode {
+	case "":
+		o.SyncMode = SyncAlways
+	case SyncAlways:
+	case SyncInterval:
+		if o.SyncInterval <= 0 {
+			return ErrBadSyncInterval
+		}
+	case SyncNever:
+		if !o.AllowUnsafeSync {
+			return ErrUnsafeSyncMode
+		}
+	default:
+		return ErrBadSyncMode
+	}
+	return nil
+}
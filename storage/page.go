@@ -5,6 +5,9 @@ const (
 	FreeListPage = 1
 	NodePage     = 2
 	BlobPage     = 3
+
+	FreeListRangesPage      = 4 // freelist pages of run length encoded entries
+	FreeListChecksummedPage = 5 // run length encoded freelist pages with entry counts and a checksum
 )
 
 type Page struct {
@@ -26,7 +29,7 @@ func (p *Page) GetPageType() string {
 	switch p.Data[0] {
 	case MetaPage:
 		return "Meta"
-	case FreeListPage:
+	case FreeListPage, FreeListRangesPage, FreeListChecksummedPage:
 		return "Freelist"
 	case NodePage:
 		return "Node"
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+)
+
+// maxRunBytes caps a coalesced write, so a bulk load does not build one huge buffer
+const maxRunBytes = 1 << 20
+
+// pageBatch buffers the page writes of one commit phase. Pages are copied, callers like
+// WriteMeta hand their buffers back to the pool right after SetPage.
+type pageBatch struct {
+	pages map[uint64][]byte // a page written twice keeps the last data
+}
+
+// batched runs fn with page writes buffered and then writes them sorted by page number,
+// adjacent pages with a single call. Nothing is written if fn fails.
+func (dal *Dal) batched(fn func() error) error {
+	dal.batch = &pageBatch{pages: make(map[uint64][]byte)}
+	defer func() {
+		for _, data := range dal.batch.pages {
+			dal.pages.put(data)
+		}
+		dal.batch = nil
+	}()
+	if err := fn(); err != nil {
+		return err
+	}
+	return dal.flushBatch()
+}
+
+func (dal *Dal) addToBatch(page *Page) error {
+	if uint64(len(page.Data)) != dal.meta.pageSize {
+		return fmt.Errorf("%w: pageNum %d has %d bytes", ErrPartialPage, page.PageNumber, len(page.Data))
+	}
+	data, ok := dal.batch.pages[page.PageNumber]
+	if !ok {
+		data = dal.pages.get(dal.meta.pageSize)
+		dal.batch.pages[page.PageNumber] = data
+	}
+	copy(data, page.Data)
+	return nil
+}
+
+func (dal *Dal) flushBatch() error {
+	pageNums := make([]uint64, 0, len(dal.batch.pages))
+	for pageNum := range dal.batch.pages {
+		pageNums = append(pageNums, pageNum)
+	}
+	slices.Sort(pageNums)
+
+	pageSize := int(dal.meta.pageSize)
+	maxRunPages := max(1, maxRunBytes/pageSize)
+	for start := 0; start < len(pageNums); {
+		end := start + 1
+		for end < len(pageNums) && end-start < maxRunPages && pageNums[end] == pageNums[end-1]+1 {
+			end++
+		}
+		var data []byte
+		if end-start == 1 {
+			data = dal.batch.pages[pageNums[start]]
+		} else {
+			data = alignedBlock((end - start) * pageSize)
+			for i, pageNum := range pageNums[start:end] {
+				copy(data[i*pageSize:], dal.batch.pages[pageNum])
+			}
+		}
+		if err := dal.writeRun(pageNums[start], data); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package storage
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// dropPageCache evicts the database file from the OS page cache, the file is synced first
+// because dirty pages can not be dropped
+func dropPageCache(tb testing.TB, db *DB) {
+	if err := db.dal.Sync(); err != nil {
+		tb.Fatal(err)
+	}
+	if err := unix.Fadvise(int(db.dal.file.(osDataFile).Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+		tb.Fatal(err)
+	}
+}
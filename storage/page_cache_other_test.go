@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "testing"
+
+// dropPageCache is not supported here, scans run on a warm cache
+func dropPageCache(tb testing.TB, db *DB) {
+	tb.Log("page cache can not be dropped on this platform")
+}
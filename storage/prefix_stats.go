@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"time"
+)
+
+// prefixStatsSlack is how many groups beyond the two rankings are kept before the groups
+// that can no longer rank are dropped
+const prefixStatsSlack = 1024
+
+// PrefixStatsOptions bounds Bucket.PrefixStats
+type PrefixStatsOptions struct {
+	Delimiter  []byte    // keys are grouped up to and including the first delimiter
+	Top        int       // prefixes returned in each ranking
+	MaxKeys    int       // keys visited before the scan stops, zero is unlimited
+	Deadline   time.Time // the scan stops at the deadline, zero has none
+	CountsOnly bool      // groups are counted and skipped with one seek, no bytes are summed
+}
+
+// PrefixStat is a first-level key prefix of a bucket
+type PrefixStat struct {
+	Prefix []byte
+	Count  uint64 // keys under the prefix
+	Bytes  uint64 // keys and values under the prefix, blobs by their size, zero with CountsOnly
+}
+
+// PrefixStats ranks the first-level prefixes of a bucket
+type PrefixStats struct {
+	ByCount  []PrefixStat
+	ByBytes  []PrefixStat // empty with CountsOnly
+	Prefixes int          // prefixes seen
+	Keys     uint64       // keys under the prefixes seen
+	Visited  int          // keys read, a group skipped by its count is read once
+	// Exact is false when the budget stopped the scan, later prefixes are missing and the
+	// bytes of the last one are short
+	Exact bool
+}
+
+// PrefixStats groups the keys of the bucket by their part up to the first delimiter, a key
+// without the delimiter is its own group, and returns the Top groups by count and by bytes.
+// A group is counted from the subtree counts without visiting it, its keys are visited to sum
+// the bytes, values are sized without reading blobs. Keys hidden by expired prefix rules are
+// counted until they are removed but add no bytes. The scan stops at opts.MaxKeys visited keys
+// or at opts.Deadline and reports what it saw with Exact false.
+func (bucket *Bucket) PrefixStats(opts PrefixStatsOptions) (PrefixStats, error) {
+	stats := PrefixStats{Exact: true}
+	if opts.Top <= 0 || opts.MaxKeys < 0 {
+		return stats, ErrInvalidLimit
+	}
+	if len(opts.Delimiter) == 0 {
+		return stats, ErrBadDelimiter
+	}
+	if bucket.tx == nil {
+		return stats, ErrTxClosed
+	}
+	exhausted := func() bool {
+		return opts.MaxKeys > 0 && stats.Visited >= opts.MaxKeys ||
+			!opts.Deadline.IsZero() && !time.Now().Before(opts.Deadline)
+	}
+	var groups []PrefixStat
+	cursor := bucket.Cursor()
+	cursor.rawValues = true
+	k, v := cursor.First()
+	for k != nil && stats.Exact {
+		if exhausted() {
+			stats.Exact = false
+			break
+		}
+		group := bucket.commonPrefix(k, nil, opts.Delimiter)
+		stat := PrefixStat{Count: 1}
+		switch {
+		case group == nil:
+			// the key is its own group, keys it is a prefix of are not in it
+			stat.Prefix = bytes.Clone(k)
+			if !opts.CountsOnly {
+				size, err := valueSize(bucket.tx, &Item{Value: v})
+				if err != nil {
+					return PrefixStats{}, err
+				}
+				stat.Bytes = uint64(len(k) + size)
+			}
+			stats.Visited++
+			k, v = cursor.Next()
+		case opts.CountsOnly:
+			stat.Prefix = bytes.Clone(group)
+			count, err := bucket.CountPrefix(stat.Prefix)
+			if err != nil {
+				return PrefixStats{}, err
+			}
+			stat.Count = count
+			stats.Visited++
+			k, v = nil, nil
+			if end := prefixEnd(stat.Prefix); end != nil {
+				k, v = cursor.Seek(end)
+			}
+		default:
+			stat.Prefix = bytes.Clone(group)
+			count, err := bucket.CountPrefix(stat.Prefix)
+			if err != nil {
+				return PrefixStats{}, err
+			}
+			stat.Count = count
+			for k != nil && bytes.HasPrefix(k, stat.Prefix) {
+				if exhausted() {
+					stats.Exact = false
+					break
+				}
+				size, err := valueSize(bucket.tx, &Item{Value: v})
+				if err != nil {
+					return PrefixStats{}, err
+				}
+				stat.Bytes += uint64(len(k) + size)
+				stats.Visited++
+				k, v = cursor.Next()
+			}
+		}
+		stats.Prefixes++
+		stats.Keys += stat.Count
+		if groups = append(groups, stat); len(groups) > 2*opts.Top+prefixStatsSlack {
+			groups = keepRanked(groups, opts.Top)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return PrefixStats{}, err
+	}
+	stats.ByCount = rankPrefixes(groups, opts.Top, func(stat PrefixStat) uint64 { return stat.Count })
+	if !opts.CountsOnly {
+		stats.ByBytes = rankPrefixes(groups, opts.Top, func(stat PrefixStat) uint64 { return stat.Bytes })
+	}
+	return stats, nil
+}
+
+// rankPrefixes returns the top groups by the value, ties in prefix order
+func rankPrefixes(groups []PrefixStat, top int, by func(PrefixStat) uint64) []PrefixStat {
+	ranked := slices.Clone(groups)
+	slices.SortFunc(ranked, func(a, b PrefixStat) int {
+		if c := cmp.Compare(by(b), by(a)); c != 0 {
+			return c
+		}
+		return bytes.Compare(a.Prefix, b.Prefix)
+	})
+	return ranked[:min(top, len(ranked))]
+}
+
+// keepRanked drops the groups that are in neither ranking, a group is seen once so a
+// dropped group can't rank later
+func keepRanked(groups []PrefixStat, top int) []PrefixStat {
+	kept := rankPrefixes(groups, top, func(stat PrefixStat) uint64 { return stat.Count })
+	for _, stat := range rankPrefixes(groups, top, func(stat PrefixStat) uint64 { return stat.Bytes }) {
+		if !slices.ContainsFunc(kept, func(k PrefixStat) bool { return bytes.Equal(k.Prefix, stat.Prefix) }) {
+			kept = append(kept, stat)
+		}
+	}
+	return kept
+}
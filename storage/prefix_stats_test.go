@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixStats(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "data")
+	// tenant-a has the most keys, tenant-c the most bytes with a blob
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("data"))
+		require.NoError(t, err)
+		for tenant, n := range map[string]int{"tenant-a": 300, "tenant-b": 50, "tenant-c": 2, "tenant-d": 10} {
+			for i := range n {
+				require.NoError(t, bucket.Put([]byte(fmt.Sprintf("%s:%04d", tenant, i)), []byte("value")))
+			}
+		}
+		require.NoError(t, bucket.Put([]byte("tenant-c:blob"), bytes.Repeat([]byte("b"), 3*BTreePageSize)))
+		require.NoError(t, bucket.Put([]byte("plain"), []byte("v")))
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("data"))
+		require.NoError(t, err)
+		_, err = bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte(":")})
+		require.ErrorIs(t, err, ErrInvalidLimit)
+		_, err = bucket.PrefixStats(PrefixStatsOptions{Top: 2})
+		require.ErrorIs(t, err, ErrBadDelimiter)
+
+		stats, err := bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte(":"), Top: 2})
+		require.NoError(t, err)
+		require.True(t, stats.Exact)
+		require.Equal(t, 5, stats.Prefixes)
+		require.EqualValues(t, 364, stats.Keys)
+		require.Equal(t, 364, stats.Visited)
+		require.Equal(t, []PrefixStat{
+			{Prefix: []byte("tenant-a:"), Count: 300, Bytes: 300 * (13 + 5)},
+			{Prefix: []byte("tenant-b:"), Count: 50, Bytes: 50 * (13 + 5)},
+		}, stats.ByCount)
+		require.Len(t, stats.ByBytes, 2)
+		require.Equal(t, []byte("tenant-c:"), stats.ByBytes[0].Prefix)
+		require.EqualValues(t, 2*(13+5)+13+3*BTreePageSize, stats.ByBytes[0].Bytes)
+
+		// groups are skipped by their counts, one key is read per group
+		stats, err = bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte(":"), Top: 10, CountsOnly: true})
+		require.NoError(t, err)
+		require.True(t, stats.Exact)
+		require.Equal(t, 5, stats.Visited)
+		require.Len(t, stats.ByCount, 5)
+		require.Equal(t, PrefixStat{Prefix: []byte("plain"), Count: 1}, stats.ByCount[4])
+		require.Empty(t, stats.ByBytes)
+
+		// the key budget stops the scan inside tenant-a, its count is still exact
+		stats, err = bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte(":"), Top: 10, MaxKeys: 100})
+		require.NoError(t, err)
+		require.False(t, stats.Exact)
+		require.Equal(t, 100, stats.Visited)
+		require.Equal(t, 2, stats.Prefixes)
+		require.Equal(t, PrefixStat{Prefix: []byte("tenant-a:"), Count: 300, Bytes: 99 * 18}, stats.ByCount[0])
+
+		stats, err = bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte(":"), Top: 10, Deadline: time.Now()})
+		require.NoError(t, err)
+		require.False(t, stats.Exact)
+		require.Zero(t, stats.Prefixes)
+		return nil
+	}))
+}
+
+func TestPrefixStatsManyGroups(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "data")
+	// more groups than are kept, the rankings stay exact when the rest is dropped
+	const groupsN = 3000
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("data"))
+		require.NoError(t, err)
+		for i := range groupsN {
+			for j := range 1 + i%7 {
+				require.NoError(t, bucket.Put([]byte(fmt.Sprintf("g%05d/%d", i, j)), bytes.Repeat([]byte("v"), 1+i%11)))
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("data"))
+		require.NoError(t, err)
+		stats, err := bucket.PrefixStats(PrefixStatsOptions{Delimiter: []byte("/"), Top: 3})
+		require.NoError(t, err)
+		require.Equal(t, groupsN, stats.Prefixes)
+		// groups 6, 13, 20... have 7 keys, 76 (76%7 == 6, 76%11 == 10) is the largest in bytes
+		require.Equal(t, []string{"g00006/", "g00013/", "g00020/"}, prefixNames(stats.ByCount))
+		require.EqualValues(t, 7, stats.ByCount[0].Count)
+		require.Equal(t, "g00076/", string(stats.ByBytes[0].Prefix))
+		return nil
+	}))
+}
+
+func prefixNames(stats []PrefixStat) []string {
+	names := make([]string, len(stats))
+	for i, stat := range stats {
+		names[i] = string(stat.Prefix)
+	}
+	return names
+}
@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// MaxPrefixRules bounds the rules of a bucket, they are stored in the bucket value
+	// which has to fit into a node item
+	MaxPrefixRules = 8
+	MaxPrefixSize  = 64
+
+	prefixRulesCountSize = 2
+	prefixRuleHeaderSize = 2 + UInt64Size // prefix length + expiration
+)
+
+// PrefixRule expires every key starting with Prefix at ExpireAt
+type PrefixRule struct {
+	Prefix   []byte
+	ExpireAt time.Time
+}
+
+// MarshalJSON reports the prefix as text, prefixes are usually readable key namespaces
+func (rule PrefixRule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Prefix   string
+		ExpireAt time.Time
+	}{string(rule.Prefix), rule.ExpireAt})
+}
+
+// Prefix rules are appended to the bucket value
+// 0        2           4            4+N          12+N
+// +--------+-----------+------------+------------+-----
+// | RulesN | PrefixLen |   Prefix   |  ExpireAt  | ...
+// | uint16 |  uint16   |  N bytes   | int64 nsec |
+// +--------+-----------+------------+------------+-----
+
+func serializePrefixRules(rules []PrefixRule) []byte {
+	size := prefixRulesCountSize
+	for _, rule := range rules {
+		size += prefixRuleHeaderSize + len(rule.Prefix)
+	}
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint16(b, uint16(len(rules)))
+	pos := prefixRulesCountSize
+	for _, rule := range rules {
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(rule.Prefix)))
+		pos += 2
+		pos += copy(b[pos:], rule.Prefix)
+		binary.LittleEndian.PutUint64(b[pos:], uint64(rule.ExpireAt.UnixNano()))
+		pos += UInt64Size
+	}
+	return b
+}
+
+// deserializePrefixRules returns the rules and the number of bytes they take, a rule running
+// past the data is ErrBadBucketValue
+func deserializePrefixRules(data []byte) ([]PrefixRule, int, error) {
+	if len(data) < prefixRulesCountSize {
+		return nil, 0, nil
+	}
+	rulesN := int(binary.LittleEndian.Uint16(data))
+	rules := make([]PrefixRule, 0, rulesN)
+	pos := prefixRulesCountSize
+	for i := 0; i < rulesN; i++ {
+		if pos+prefixRuleHeaderSize > len(data) {
+			return nil, 0, fmt.Errorf("%w: prefix rule %d is truncated", ErrBadBucketValue, i)
+		}
+		prefixLen := int(binary.LittleEndian.Uint16(data[pos:]))
+		pos += 2
+		if pos+prefixLen+UInt64Size > len(data) {
+			return nil, 0, fmt.Errorf("%w: prefix rule %d is truncated", ErrBadBucketValue, i)
+		}
+		prefix := make([]byte, prefixLen)
+		pos += copy(prefix, data[pos:pos+prefixLen])
+		expireAt := time.Unix(0, int64(binary.LittleEndian.Uint64(data[pos:])))
+		pos += UInt64Size
+		rules = append(rules, PrefixRule{Prefix: prefix, ExpireAt: expireAt})
+	}
+	return rules, pos, nil
+}
+
+// SetPrefixTTL expires all keys starting with prefix at expireAt. Expired keys are hidden
+// from Get and cursors right away and deleted later by DB.PurgeExpired, which drops the
+// rule once no key matches it. Until then writing a key under the expired prefix fails
+// with ErrPrefixExpired, the key would be hidden and purged with the others. Setting a rule for a known prefix replaces it, a zero expireAt removes it.
+func (bucket *Bucket) SetPrefixTTL(prefix []byte, expireAt time.Time) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	if len(prefix) > MaxPrefixSize {
+		return ErrPrefixTooLarge
+	}
+	rules := make([]PrefixRule, 0, len(bucket.prefixRules)+1)
+	for _, rule := range bucket.prefixRules {
+		if !bytes.Equal(rule.Prefix, prefix) {
+			rules = append(rules, rule)
+		}
+	}
+	if !expireAt.IsZero() {
+		rules = append(rules, PrefixRule{Prefix: bytes.Clone(prefix), ExpireAt: expireAt})
+	}
+	if len(rules) > MaxPrefixRules {
+		return ErrTooManyPrefixRules
+	}
+	bucket.prefixRules = rules
+	bucket.recordBucket()
+	return nil
+}
+
+// PrefixRules returns the expiration rules of the bucket
+func (bucket *Bucket) PrefixRules() []PrefixRule {
+	return append([]PrefixRule(nil), bucket.prefixRules...)
+}
+
+// expired reports whether a rule hides the key, it is linear in the number of rules
+func (bucket *Bucket) expired(key []byte, now time.Time) bool {
+	for _, rule := range bucket.prefixRules {
+		if !now.Before(rule.ExpireAt) && bytes.HasPrefix(key, rule.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// purgeExpired deletes up to limit keys hidden by expired rules and drops rules without
+// matching keys left
+func (bucket *Bucket) purgeExpired(now time.Time, limit int) (int, error) {
+	purged := 0
+	rules := bucket.prefixRules[:0:0]
+	for _, rule := range bucket.prefixRules {
+		if now.Before(rule.ExpireAt) || purged >= limit {
+			rules = append(rules, rule)
+			continue
+		}
+		var keys [][]byte
+		cursor := bucket.Cursor()
+		for k, _ := cursor.seek(rule.Prefix); k != nil && bytes.HasPrefix(k, rule.Prefix); k, _ = cursor.next() {
+			if len(keys) == limit-purged {
+				// more keys left than the limit allows, keep the rule for the next run
+				rules = append(rules, rule)
+				break
+			}
+			keys = append(keys, bytes.Clone(k))
+		}
+		if err := cursor.Err(); err != nil {
+			return purged, err
+		}
+		for _, key := range keys {
+			if err := bucket.Remove(key); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	bucket.prefixRules = rules
+	return purged, nil
+}
+
+// PurgeExpired deletes up to limit keys hidden by expired prefix rules in all buckets
+// in one write transaction and returns the number of deleted keys
+func (db *DB) PurgeExpired(now time.Time, limit int) (int, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	purged := 0
+	rules := 0
+	for _, name := range tx.Buckets() {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return 0, err
+		}
+		rules += len(bucket.prefixRules)
+		n, err := bucket.purgeExpired(now, limit-purged)
+		if err != nil {
+			return 0, err
+		}
+		purged += n
+		rules -= len(bucket.prefixRules)
+	}
+	if purged == 0 && rules == 0 {
+		return 0, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func putSessions(t *testing.T, db *DB) {
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 300; i++ {
+			for _, prefix := range []string{"session:2023-", "session:2024-", "user:"} {
+				if err = bucket.Put([]byte(fmt.Sprintf("%s%03d", prefix, i)), []byte("value")); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func collectKeys(t *testing.T, db *DB, reverse bool) []string {
+	var keys []string
+	err := db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		first, next := cursor.First, cursor.Next
+		if reverse {
+			first, next = cursor.Last, cursor.Prev
+		}
+		for k, _ := first(); k != nil; k, _ = next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return keys
+}
+
+func TestPrefixTTL(t *testing.T) {
+	db, filename := createTestDB(t)
+	putSessions(t, db)
+
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		if err = bucket.SetPrefixTTL([]byte("session:2023-"), time.Now().Add(-time.Second)); err != nil {
+			return err
+		}
+		return bucket.SetPrefixTTL([]byte("session:2024-"), time.Now().Add(time.Hour))
+	})
+	require.NoError(t, err)
+	closeTestDB(t, db)
+
+	// rules are stored in the bucket value
+	db = openTestDB(t, filename, nil)
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		require.Len(t, bucket.PrefixRules(), 2)
+		_, found := bucket.Get([]byte("session:2023-007"))
+		require.False(t, found)
+		_, found = bucket.Get([]byte("session:2024-007"))
+		require.True(t, found)
+
+		k, _ := bucket.Cursor().Seek([]byte("session:2023-100"))
+		require.Equal(t, []byte("session:2024-000"), k)
+		return nil
+	})
+	require.NoError(t, err)
+
+	for _, reverse := range []bool{false, true} {
+		keys := collectKeys(t, db, reverse)
+		require.Len(t, keys, 600)
+		require.NotContains(t, keys, "session:2023-000")
+		require.Contains(t, keys, "session:2024-299")
+	}
+	stat := db.Stat()
+	require.Equal(t, uint64(900), stat.Buckets["sessions"].ItemsN)
+	require.Len(t, stat.Buckets["sessions"].PrefixRules, 2)
+
+	// the sweeper deletes hidden keys in batches and drops the rule once they are gone
+	purged, err := db.PurgeExpired(time.Now(), 200)
+	require.NoError(t, err)
+	require.Equal(t, 200, purged)
+	require.Len(t, db.Stat().Buckets["sessions"].PrefixRules, 2)
+	purged, err = db.PurgeExpired(time.Now(), 200)
+	require.NoError(t, err)
+	require.Equal(t, 100, purged)
+	stat = db.Stat()
+	require.Equal(t, uint64(600), stat.Buckets["sessions"].ItemsN)
+	require.Len(t, stat.Buckets["sessions"].PrefixRules, 1)
+	purged, err = db.PurgeExpired(time.Now(), 200)
+	require.NoError(t, err)
+	require.Zero(t, purged)
+	require.NoError(t, db.Check())
+
+	// keys written after the rule was dropped are visible again
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("session:2023-new"), []byte("value"))
+	})
+	require.NoError(t, err)
+	require.Contains(t, collectKeys(t, db, false), "session:2023-new")
+}
+
+func TestPrefixTTLWriteAfterExpiry(t *testing.T) {
+	db, _ := createTestDB(t)
+	putSessions(t, db)
+	key := []byte("session:2023-new")
+	err := db.UpdateBucket([]byte("sessions"), func(bucket *Bucket) error {
+		return bucket.SetPrefixTTL([]byte("session:2023-"), time.Now().Add(-time.Second))
+	})
+	require.NoError(t, err)
+
+	// the write would be hidden and purged with the expired keys, it is refused instead
+	require.ErrorIs(t, db.Put([]byte("sessions"), key, []byte("value")), ErrPrefixExpired)
+	err = db.UpdateBucket([]byte("sessions"), func(bucket *Bucket) error {
+		require.ErrorIs(t, bucket.PutReader(key, bytes.NewReader(make([]byte, 8192)), 8192), ErrPrefixExpired)
+		return bucket.Merge(key, func([]byte) ([]byte, error) { return []byte("value"), nil })
+	})
+	require.ErrorIs(t, err, ErrPrefixExpired)
+	_, err = db.Get([]byte("sessions"), key)
+	require.ErrorIs(t, err, ErrKeyNotFound)
+	purged, err := db.PurgeExpired(time.Now(), 1000)
+	require.NoError(t, err)
+	require.Equal(t, 300, purged)
+
+	// the purge dropped the rule, the key is written and read back
+	require.NoError(t, db.Put([]byte("sessions"), key, []byte("value")))
+	value, err := db.Get([]byte("sessions"), key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("value"), value)
+	purged, err = db.PurgeExpired(time.Now(), 1000)
+	require.NoError(t, err)
+	require.Zero(t, purged)
+}
+
+func TestPrefixTTLLimits(t *testing.T) {
+	db, _ := createTestDB(t)
+	putSessions(t, db)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		expireAt := time.Now().Add(time.Hour)
+		require.ErrorIs(t, bucket.SetPrefixTTL(make([]byte, MaxPrefixSize+1), expireAt), ErrPrefixTooLarge)
+		for i := 0; i < MaxPrefixRules; i++ {
+			require.NoError(t, bucket.SetPrefixTTL([]byte(fmt.Sprintf("p%d", i)), expireAt))
+		}
+		require.ErrorIs(t, bucket.SetPrefixTTL([]byte("extra"), expireAt), ErrTooManyPrefixRules)
+
+		// replacing and removing rules does not count against the limit
+		require.NoError(t, bucket.SetPrefixTTL([]byte("p0"), expireAt.Add(time.Hour)))
+		require.NoError(t, bucket.SetPrefixTTL([]byte("p1"), time.Time{}))
+		require.Len(t, bucket.PrefixRules(), MaxPrefixRules-1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sessions"))
+		if err != nil {
+			return err
+		}
+		require.ErrorIs(t, bucket.SetPrefixTTL([]byte("p"), time.Now()), ErrWriteInRxTransaction)
+		return nil
+	})
+	require.NoError(t, err)
+}
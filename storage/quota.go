@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// BucketQuota limits how much a bucket may hold, a zero field is unlimited. Keys already
+// in the bucket may always be overwritten, only growth is refused with ErrQuotaExceeded.
+type BucketQuota struct {
+	MaxKeys  uint64 // compared with BucketStat.ItemsN
+	MaxBytes uint64 // compared with BucketStat.BytesInUse, keys and values
+}
+
+const bucketQuotaSize = 2 * UInt64Size
+
+// Bucket quota follows the bucket options when bucketOptionQuota is set in their flags
+// 0            8            16
+// +------------+------------+
+// |  MaxKeys   |  MaxBytes  |
+// |  uint64    |  uint64    |
+// +------------+------------+
+
+func serializeBucketQuota(quota BucketQuota) []byte {
+	b := make([]byte, bucketQuotaSize)
+	binary.LittleEndian.PutUint64(b, quota.MaxKeys)
+	binary.LittleEndian.PutUint64(b[UInt64Size:], quota.MaxBytes)
+	return b
+}
+
+func deserializeBucketQuota(data []byte) BucketQuota {
+	if len(data) < bucketQuotaSize {
+		return BucketQuota{}
+	}
+	return BucketQuota{
+		MaxKeys:  binary.LittleEndian.Uint64(data),
+		MaxBytes: binary.LittleEndian.Uint64(data[UInt64Size:]),
+	}
+}
+
+// SetQuota replaces the quota of the bucket, a zero quota removes it. A quota below the
+// current usage is accepted and blocks further growth until keys are deleted. Internal
+// buckets take no quota, see IsInternalBucket.
+func (bucket *Bucket) SetQuota(quota BucketQuota) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	if bucket.parent == nil && IsInternalBucket(bucket.name) {
+		return ErrReservedBucketName
+	}
+	bucket.quota = quota
+	if bucket.parent == nil {
+		bucket.tx.recordEvent(bucket.name, EventQuotaChanged, fmt.Sprintf("max_keys=%d max_bytes=%d", quota.MaxKeys, quota.MaxBytes))
+	}
+	return nil
+}
+
+// Quota returns the quota of the bucket
+func (bucket *Bucket) Quota() BucketQuota {
+	return bucket.quota
+}
+
+// checkPutQuota refuses a new key that would take the bucket over its quota, overwrites pass
+func (bucket *Bucket) checkPutQuota(key []byte, size int) error {
+	if bucket.quota == (BucketQuota{}) || bucket.root == 0 {
+		return nil
+	}
+	root, err := bucket.tx.getNode(bucket.root)
+	if err != nil {
+		return err
+	}
+	_, _, _, exists, err := root.Find(bucket.tx, key, true)
+	if err != nil || exists {
+		return err
+	}
+	return bucket.checkQuota(1, int64(len(key)+size))
+}
+
+// checkQuota returns ErrQuotaExceeded if adding keys and bytes to the bucket counters would
+// cross the quota
+func (bucket *Bucket) checkQuota(keys int, bytes int64) error {
+	quota := bucket.quota
+	if quota.MaxKeys > 0 && keys > 0 && bucket.itemsN+uint64(keys) > quota.MaxKeys {
+		return fmt.Errorf("%w: bucket %q holds %d of %d keys", ErrQuotaExceeded,
+			bucket.name, bucket.itemsN, quota.MaxKeys)
+	}
+	if quota.MaxBytes > 0 && bytes > 0 && bucket.bytesInUse+uint64(bytes) > quota.MaxBytes {
+		return fmt.Errorf("%w: bucket %q uses %d of %d bytes, %d more requested", ErrQuotaExceeded,
+			bucket.name, bucket.bytesInUse, quota.MaxBytes, bytes)
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketQuota(t *testing.T) {
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	db := openTestDB(t, filename, nil)
+
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, bucket.SetQuota(BucketQuota{MaxKeys: 3, MaxBytes: 64}))
+		for i := range 3 {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("value")); err != nil {
+				return err
+			}
+		}
+		err = bucket.Put([]byte("key_3"), []byte("value"))
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		// overwrites do not grow the key count
+		return bucket.Put([]byte("key_0"), []byte("new"))
+	})
+	require.NoError(t, err)
+
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		require.ErrorIs(t, bucket.SetQuota(BucketQuota{}), ErrWriteInRxTransaction)
+		return nil
+	})
+	require.NoError(t, err)
+	closeTestDB(t, db)
+
+	// the quota is stored with the bucket
+	db = openTestDB(t, filename, nil)
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		require.Equal(t, BucketQuota{MaxKeys: 3, MaxBytes: 64}, bucket.Quota())
+		require.NoError(t, bucket.Remove([]byte("key_2")))
+
+		err = bucket.Put([]byte("key_2"), bytes.Repeat([]byte("v"), 64))
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		err = bucket.PutReader([]byte("key_2"), bytes.NewReader(make([]byte, 4096)), 4096)
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		err = bucket.Merge([]byte("key_1"), func(old []byte) ([]byte, error) {
+			return append(old, bytes.Repeat([]byte("v"), 64)...), nil
+		})
+		require.ErrorIs(t, err, ErrQuotaExceeded)
+		value, _ := bucket.Get([]byte("key_1"))
+		require.Equal(t, []byte("value"), value)
+		require.NoError(t, bucket.Merge([]byte("key_1"), func(old []byte) ([]byte, error) {
+			return append(old, "+1"...), nil
+		}))
+
+		require.NoError(t, bucket.SetQuota(BucketQuota{}))
+		return bucket.Put([]byte("key_2"), bytes.Repeat([]byte("v"), 4096))
+	})
+	require.NoError(t, err)
+	require.Equal(t, BucketQuota{}, db.Stat().Buckets["foo"].Quota)
+	require.NoError(t, db.Check())
+}
+
+func TestBucketQuotaWithOptions(t *testing.T) {
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	db := openTestDB(t, filename, nil)
+	opts := BucketOptions{ForceBlobsAbove: 16}
+	quota := BucketQuota{MaxBytes: 1 << 20}
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketWithOptions([]byte("foo"), opts)
+		if err != nil {
+			return err
+		}
+		return bucket.SetQuota(quota)
+	}))
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, nil)
+	stat := db.Stat().Buckets["foo"]
+	require.Equal(t, quota, stat.Quota)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		require.Equal(t, opts, bucket.Options())
+		return nil
+	}))
+}
+
+func TestDatabaseMaxSize(t *testing.T) {
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	const maxSize = 256 * 1024
+	db := openTestDB(t, filename, DefaultOptions().WithMaxSize(maxSize))
+	require.EqualValues(t, maxSize, db.Stat().MaxDBSize)
+
+	value := bytes.Repeat([]byte("v"), 8*BTreePageSize)
+	var err error
+	stored := 0
+	for i := range 100 {
+		err = db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(fmt.Sprintf("key_%03d", i)), value)
+		})
+		if err != nil {
+			break
+		}
+		stored++
+	}
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.Positive(t, stored)
+	require.LessOrEqual(t, db.Stat().TotalDBSize, uint64(maxSize))
+	require.NoError(t, db.Check())
+
+	// deleting makes room again
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Remove([]byte("key_000"))
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key_000"), value)
+	}))
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, nil)
+	require.NoError(t, db.Check())
+	count := 0
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		return bucket.ForEach(func(k, v []byte) error {
+			require.Equal(t, value, v)
+			count++
+			return nil
+		})
+	}))
+	require.Equal(t, stored, count)
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	readAheadTrigger = 2  // leaves finished by Next in a row before a cursor starts reading ahead
+	readAheadWorkers = 4  // concurrent page reads
+	readAheadQueue   = 64 // pending pages, read ahead requests are dropped when the queue is full
+)
+
+// readAheader reads pages in background workers, so the OS page cache is filled
+// ahead of a cursor scan. Pages are read and dropped, nothing is cached by the dal.
+type readAheader struct {
+	dal        *Dal
+	lock       sync.RWMutex
+	closed     bool
+	queue      chan uint64
+	wg         sync.WaitGroup
+	prefetched atomic.Uint64 // pages scheduled for read ahead
+	used       atomic.Uint64 // read ahead pages later visited by a cursor
+}
+
+func newReadAheader(dal *Dal) *readAheader {
+	ra := &readAheader{
+		dal:   dal,
+		queue: make(chan uint64, readAheadQueue),
+	}
+	ra.wg.Add(readAheadWorkers)
+	for i := 0; i < readAheadWorkers; i++ {
+		go ra.worker()
+	}
+	return ra
+}
+
+// schedule queues the page for reading, it returns false if the page was dropped
+func (ra *readAheader) schedule(pageNum uint64) bool {
+	ra.lock.RLock()
+	defer ra.lock.RUnlock()
+	if ra.closed {
+		return false
+	}
+	select {
+	case ra.queue <- pageNum:
+		ra.prefetched.Add(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (ra *readAheader) worker() {
+	defer ra.wg.Done()
+	pageSize := ra.dal.meta.pageSize
+	for pageNum := range ra.queue {
+		buf := ra.dal.pages.get(pageSize)
+		// errors are ignored, the cursor reads the page again anyway
+		_, _ = ra.dal.file.ReadAt(buf, int64(pageNum*pageSize))
+		ra.dal.pages.put(buf)
+	}
+}
+
+// close stops the workers, it must be called before the database file is closed
+func (ra *readAheader) close() {
+	ra.lock.Lock()
+	if !ra.closed {
+		ra.closed = true
+		close(ra.queue)
+	}
+	ra.lock.Unlock()
+	ra.wg.Wait()
+}
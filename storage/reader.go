@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// readerFile serves a read only database from any io.ReaderAt, writes are refused
+type readerFile struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (file readerFile) ReadAt(p []byte, off int64) (int, error) {
+	return file.r.ReadAt(p, off)
+}
+
+func (file readerFile) Size() (int64, error) {
+	return file.size, nil
+}
+
+// Close leaves the reader open, it belongs to the caller of OpenReader
+func (file readerFile) Close() error {
+	return nil
+}
+
+func (file readerFile) WriteAt([]byte, int64) (int, error) {
+	return 0, ErrReadOnly
+}
+
+func (file readerFile) Truncate(int64) error {
+	return ErrReadOnly
+}
+
+func (file readerFile) Sync() error {
+	return nil
+}
+
+// OpenReader opens the database image in r, size bytes long, read only and without copying it:
+// a copy of a database file taken while it was closed or between commits, served by an S3
+// range reader or found inside a tar. Pages are read from r on demand, so r must stay usable
+// until the database is closed, Close leaves it open. Write transactions fail with ErrReadOnly,
+// there is no tx log, file lock or recovery. The reader limits of opts apply.
+func OpenReader(r io.ReaderAt, size int64, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := checkDatabaseImage(r, size, "database image"); err != nil {
+		return nil, err
+	}
+	readerOpts := *opts
+	readerOpts.EnableRecovery = false
+	readerOpts.TxLogPath = ""
+	// read ahead only warms the OS page cache, a remote reader would fetch every page twice
+	readerOpts.ReadAheadPages = 0
+
+	dal := &Dal{
+		file:           readerFile{r: r, size: size},
+		meta:           NewMeta(opts.PageSize),
+		osPageSize:     uint64(os.Getpagesize()),
+		MinFillPercent: 0.45,
+		MaxFillPercent: 0.95,
+		txLog:          &TxLog{},
+		opts:           &readerOpts,
+		size:           uint64(size),
+		readOnly:       true,
+	}
+	dal.maxPages.Store(dal.size / dal.meta.pageSize)
+	meta, err := ReadMeta(dal)
+	if err != nil {
+		return nil, fmt.Errorf("could not read meta: %w", err)
+	}
+	dal.meta = meta
+	dal.maxPages.Store(dal.size / meta.pageSize)
+	dal.cleanShutdown = meta.flags&metaFlagOpen == 0
+	if meta.flags&metaFlagBlobFile != 0 {
+		logger.Warn("database image keeps blobs in a blob file, reading them fails", "blob_file", meta.blobFile)
+	}
+	if dal.freelist, err = ReadFreelist(dal); err != nil {
+		return nil, fmt.Errorf("could not read freelist: %w", err)
+	}
+	if err = dal.checkDeclaredSize("database image"); err != nil {
+		return nil, err
+	}
+	dal.committedMeta = *meta
+	logger.Info("open read only database", "size", size, "pages", dal.maxPages.Load())
+	return newDB(dal, &readerOpts), nil
+}
+
+// ReadOnly reports whether the database was opened with OpenReader, or by Open with a tx log
+// of another database file, see Options.FailOnTxLogMismatch
+func (db *DB) ReadOnly() bool {
+	return db.dal.readOnly
+}
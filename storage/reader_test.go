@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingReader counts ReadAt calls, a range reader fetching pages on demand
+type countingReader struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (cr *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	cr.reads++
+	return cr.r.ReadAt(p, off)
+}
+
+func TestOpenReader(t *testing.T) {
+	db, filename := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%04d", i)), []byte(fmt.Sprintf("value_%04d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Close())
+	image, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// the image sits inside a larger stream, like a file inside a tar
+	stream := append(bytes.Repeat([]byte{'x'}, 512), image...)
+	reader := &countingReader{r: io.NewSectionReader(bytes.NewReader(stream), 512, int64(len(image)))}
+	backup, err := OpenReader(reader, int64(len(image)), nil)
+	require.NoError(t, err)
+	require.True(t, backup.ReadOnly())
+	require.True(t, backup.DurabilityInfo().CleanShutdown)
+
+	reads := reader.reads
+	require.NoError(t, backup.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		value, found := bucket.Get([]byte("key_0500"))
+		require.True(t, found)
+		require.Equal(t, []byte("value_0500"), value)
+		return nil
+	}))
+	require.Less(t, reader.reads-reads, 10, "a lookup reads a few pages, not the image")
+	require.EqualValues(t, 1000, backup.Stat().Buckets["foo"].ItemsN)
+
+	_, err = backup.Begin(true)
+	require.ErrorIs(t, err, ErrReadOnly)
+	require.ErrorIs(t, backup.Update(func(tx *Tx) error { return nil }), ErrReadOnly)
+	require.NoError(t, backup.Close())
+}
+
+func TestOpenReaderBadImage(t *testing.T) {
+	_, err := OpenReader(bytes.NewReader(make([]byte, minFileSize)), minFileSize, nil)
+	require.ErrorIs(t, err, ErrNotADatabase)
+
+	db, filename := createTestDB(t)
+	require.NoError(t, db.Close())
+	image, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	_, err = OpenReader(bytes.NewReader(image[:minFileSize/2]), minFileSize/2, nil)
+	require.ErrorIs(t, err, ErrTruncatedDatabase)
+}
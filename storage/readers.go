@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReaderInfo describes an open read transaction
+type ReaderInfo struct {
+	ID      uint64
+	Started time.Time
+	Age     time.Duration
+}
+
+// readerSet tracks read transactions started with Begin, it enforces Options.MaxOpenReaders
+type readerSet struct {
+	lock    sync.Mutex
+	freed   *sync.Cond // signalled when a reader slot is released
+	nextID  uint64
+	readers map[uint64]*Tx
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// readerState is the part of a read transaction used for limits and invalidation
+type readerState struct {
+	id      uint64
+	started time.Time
+	// opLock is held by every read operation, invalidation waits for the current one to finish
+	opLock      sync.Mutex
+	invalidated bool
+	reaping     bool // guarded by readerSet.lock
+}
+
+func newReaderSet() *readerSet {
+	rs := &readerSet{readers: make(map[uint64]*Tx)}
+	rs.freed = sync.NewCond(&rs.lock)
+	return rs
+}
+
+// acquireReader takes a reader slot, it waits for a free slot or fails with ErrTooManyReaders
+func (db *DB) acquireReader(tx *Tx) error {
+	rs := db.readers
+	opts := db.dal.opts
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	for opts.MaxOpenReaders > 0 && len(rs.readers) >= opts.MaxOpenReaders {
+		if !opts.WaitForReader {
+			return ErrTooManyReaders
+		}
+		rs.freed.Wait()
+	}
+	rs.nextID++
+	tx.reader.id = rs.nextID
+	rs.readers[tx.reader.id] = tx
+	return nil
+}
+
+// startReader starts the reader clock once the transaction holds the database lock
+func (db *DB) startReader(tx *Tx) {
+	db.readers.lock.Lock()
+	defer db.readers.lock.Unlock()
+	tx.reader.started = time.Now()
+}
+
+func (db *DB) releaseReader(tx *Tx) {
+	rs := db.readers
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if _, ok := rs.readers[tx.reader.id]; ok {
+		delete(rs.readers, tx.reader.id)
+		rs.freed.Signal()
+	}
+}
+
+// OpenReaders returns the read transactions started with Begin and not closed yet, oldest first
+func (db *DB) OpenReaders() []ReaderInfo {
+	rs := db.readers
+	now := time.Now()
+	rs.lock.Lock()
+	readers := make([]ReaderInfo, 0, len(rs.readers))
+	for id, tx := range rs.readers {
+		if tx.reader.started.IsZero() {
+			continue // still waiting for the database lock
+		}
+		readers = append(readers, ReaderInfo{ID: id, Started: tx.reader.started, Age: now.Sub(tx.reader.started)})
+	}
+	rs.lock.Unlock()
+	sort.Slice(readers, func(i, j int) bool { return readers[i].ID < readers[j].ID })
+	return readers
+}
+
+// reaperLoop invalidates readers open longer than Options.MaxReaderDuration
+func (db *DB) reaperLoop(maxDuration time.Duration) {
+	rs := db.readers
+	defer close(rs.done)
+	ticker := time.NewTicker(max(maxDuration/4, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case now := <-ticker.C:
+			rs.lock.Lock()
+			for _, tx := range rs.readers {
+				if !tx.reader.reaping && !tx.reader.started.IsZero() && now.Sub(tx.reader.started) > maxDuration {
+					tx.reader.reaping = true
+					// the reader may be inside an operation, do not block other readers on it
+					go tx.invalidate(now.Sub(tx.reader.started))
+				}
+			}
+			rs.lock.Unlock()
+		}
+	}
+}
+
+func (db *DB) stopReaper() {
+	rs := db.readers
+	if rs.stop == nil {
+		return
+	}
+	close(rs.stop)
+	<-rs.done
+	rs.stop = nil
+}
+
+// invalidate closes a read transaction from outside of its goroutine, later operations fail
+// with ErrTxClosed and the database lock is released for writers
+func (tx *Tx) invalidate(age time.Duration) {
+	tx.reader.opLock.Lock()
+	tx.reader.invalidated = true
+	tx.reader.opLock.Unlock()
+	logger.Warn("read transaction invalidated", "id", tx.reader.id, "age", age)
+	tx.once.Do(tx.unlock)
+}
+
+// enter guards a read operation against invalidation, it must be paired with leave
+func (tx *Tx) enter() error {
+	if tx.write {
+		return nil
+	}
+	tx.reader.opLock.Lock()
+	if tx.reader.invalidated {
+		tx.reader.opLock.Unlock()
+		return ErrTxClosed
+	}
+	return nil
+}
+
+func (tx *Tx) leave() {
+	if !tx.write {
+		tx.reader.opLock.Unlock()
+	}
+}
+
+// isInvalidated reports whether the reader was closed by Options.MaxReaderDuration
+func (tx *Tx) isInvalidated() bool {
+	if tx.write {
+		return false
+	}
+	tx.reader.opLock.Lock()
+	defer tx.reader.opLock.Unlock()
+	return tx.reader.invalidated
+}
@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func openReadersTestDB(t *testing.T, opts *Options) *DB {
+	filename := TempFileName(".db")
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(db.dal.opts.TxLogPath)
+	})
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	return db
+}
+
+// beginReader starts a read transaction on its own goroutine, a goroutine holds one transaction only
+func beginReader(db *DB) (*Tx, error) {
+	type result struct {
+		tx  *Tx
+		err error
+	}
+	ch := make(chan result)
+	go func() {
+		tx, err := db.Begin(false)
+		ch <- result{tx, err}
+	}()
+	res := <-ch
+	return res.tx, res.err
+}
+
+func TestMaxOpenReaders(t *testing.T) {
+	db := openReadersTestDB(t, DefaultOptions().WithMaxOpenReaders(2, false))
+
+	first, err := beginReader(db)
+	require.NoError(t, err)
+	second, err := beginReader(db)
+	require.NoError(t, err)
+	_, err = beginReader(db)
+	require.ErrorIs(t, err, ErrTooManyReaders)
+
+	readers := db.OpenReaders()
+	require.Len(t, readers, 2)
+	require.Less(t, readers[0].ID, readers[1].ID)
+	require.GreaterOrEqual(t, readers[0].Age, readers[1].Age)
+
+	first.Rollback()
+	third, err := beginReader(db)
+	require.NoError(t, err)
+	require.NoError(t, second.Commit())
+	require.NoError(t, third.Commit())
+	require.Empty(t, db.OpenReaders())
+
+	// writers are not limited
+	require.NoError(t, db.Update(func(tx *Tx) error { return nil }))
+}
+
+func TestMaxOpenReadersWait(t *testing.T) {
+	db := openReadersTestDB(t, DefaultOptions().WithMaxOpenReaders(1, true))
+
+	first, err := beginReader(db)
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	go func() {
+		_ = db.View(func(tx *Tx) error { return nil })
+		close(started)
+	}()
+	select {
+	case <-started:
+		t.Fatal("reader started over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Rollback()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("waiting reader was not started")
+	}
+}
+
+func TestMaxReaderDuration(t *testing.T) {
+	db := openReadersTestDB(t, DefaultOptions().WithMaxReaderDuration(50*time.Millisecond))
+
+	stuck, err := beginReader(db)
+	require.NoError(t, err)
+	bucket, err := stuck.GetBucket([]byte("foo"))
+	require.NoError(t, err)
+	cursor := bucket.Cursor()
+	k, _ := cursor.First()
+	require.Equal(t, []byte("key"), k)
+
+	// the writer gets the lock once the stuck reader is invalidated
+	done := make(chan error)
+	go func() {
+		done <- db.Update(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("other"), []byte("value"))
+		})
+	}()
+	select {
+	case err = <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer is blocked by the stuck reader")
+	}
+
+	require.Empty(t, db.OpenReaders())
+	_, found := bucket.Get([]byte("key"))
+	require.False(t, found)
+	k, _ = cursor.Next()
+	require.Nil(t, k)
+	require.ErrorIs(t, bucket.ForEach(func(k, v []byte) error { return nil }), ErrTxClosed)
+	_, err = stuck.GetBucket([]byte("foo"))
+	require.ErrorIs(t, err, ErrTxClosed)
+	require.ErrorIs(t, stuck.Commit(), ErrTxClosed)
+	stuck.Rollback()
+
+	// short readers are not affected
+	require.NoError(t, db.View(func(tx *Tx) error {
+		_, err := tx.GetBucket([]byte("foo"))
+		return err
+	}))
+}
+
+func TestBadReaderLimits(t *testing.T) {
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithMaxOpenReaders(-1, false))
+	require.ErrorIs(t, err, ErrBadReaderLimits)
+}
@@ -0,0 +1,79 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+)
+
+// LogKeyMode controls how key material is written to logs
+type LogKeyMode string
+
+const (
+	// LogKeyFull logs keys as is
+	LogKeyFull LogKeyMode = "full"
+	// LogKeyHash logs a salted hash of the key, equal keys give equal hashes within a process
+	LogKeyHash LogKeyMode = "hash"
+	// LogKeyNone replaces keys with a placeholder
+	LogKeyNone LogKeyMode = "none"
+
+	redactedKey = "[redacted]"
+)
+
+// logKeySalt is generated per process, so hashes can not be matched across restarts
+// or against a precomputed table of likely keys
+var logKeySalt = newLogKeySalt()
+
+func newLogKeySalt() []byte {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		panic(err)
+	}
+	return salt
+}
+
+// RedactKey returns the key as it may appear in logs and error messages for the mode,
+// an unknown mode redacts the key completely
+func RedactKey(mode LogKeyMode, key []byte) string {
+	switch mode {
+	case LogKeyFull, "":
+		return string(key)
+	case LogKeyHash:
+		mac := hmac.New(sha256.New, logKeySalt)
+		_, _ = mac.Write(key)
+		return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	default:
+		return redactedKey
+	}
+}
+
+// LogKey returns the "key" log attribute redacted for the mode, every log site
+// including key material must use it
+func LogKey(mode LogKeyMode, key []byte) slog.Attr {
+	return slog.String("key", RedactKey(mode, key))
+}
+
+// KeyError is a failure on a key, the key is redacted by the LogKeyMode of the database
+// when the error is formatted, so it can be passed on to logs and responses
+type KeyError struct {
+	Key  []byte
+	Err  error
+	mode LogKeyMode
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %q: %v", RedactKey(e.mode, e.Key), e.Err)
+}
+
+func (e *KeyError) Unwrap() error {
+	return e.Err
+}
+
+// keyError wraps err with the key, the key is copied as it may point into a page
+func (tx *Tx) keyError(key []byte, err error) error {
+	return &KeyError{Key: bytes.Clone(key), Err: err, mode: tx.db.dal.opts.LogKeyMode}
+}
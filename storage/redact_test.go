@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactKey(t *testing.T) {
+	key := []byte("alice@example.com")
+	require.Equal(t, string(key), RedactKey(LogKeyFull, key))
+	require.Equal(t, redactedKey, RedactKey(LogKeyNone, key))
+	require.Equal(t, redactedKey, RedactKey("unknown", key))
+
+	hashed := RedactKey(LogKeyHash, key)
+	require.NotContains(t, hashed, string(key))
+	require.Equal(t, hashed, RedactKey(LogKeyHash, key))
+	require.NotEqual(t, hashed, RedactKey(LogKeyHash, []byte("bob@example.com")))
+
+	require.Equal(t, "key", LogKey(LogKeyNone, key).Key)
+	require.Equal(t, redactedKey, LogKey(LogKeyNone, key).Value.String())
+
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithLogKeyMode("plain"))
+	require.ErrorIs(t, err, ErrBadLogKeyMode)
+}
+
+func TestKeyErrorRedacted(t *testing.T) {
+	filename := TempFileName(".db")
+	db := openTestDB(t, filename, DefaultOptions().WithLogKeyMode(LogKeyNone))
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(db.dal.opts.TxLogPath)
+	})
+	createBuckets(t, db, "users")
+	key := []byte("alice@example.com")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		require.NoError(t, err)
+		_, err = bucket.CreateBucket(key)
+		require.NoError(t, err)
+
+		_, _, err = bucket.Lookup(key)
+		require.ErrorIs(t, err, ErrIncompatibleValue)
+		require.NotContains(t, err.Error(), string(key))
+		require.Contains(t, err.Error(), redactedKey)
+		var keyErr *KeyError
+		require.True(t, errors.As(err, &keyErr))
+		require.Equal(t, key, keyErr.Key)
+
+		err = bucket.Put(key, []byte("value"))
+		require.ErrorIs(t, err, ErrIncompatibleValue)
+		require.NotContains(t, err.Error(), string(key))
+		return nil
+	}))
+}
@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/timson/pirindb/storage/keys"
+)
+
+// RetentionKeys tells how the retention of a bucket reads the time a key was written
+type RetentionKeys uint8
+
+const (
+	// RetainGeneratedKeys is for keys made by keys.Generator, like bucket appends
+	RetainGeneratedKeys RetentionKeys = iota
+	// RetainTimeKeys is for keys whose first keys.Encode part is keys.Time
+	RetainTimeKeys
+)
+
+// RetentionSweep reports the last retention sweep of a bucket
+type RetentionSweep struct {
+	At       time.Time
+	Removed  int // keys older than the retention deleted by the sweep
+	Duration time.Duration
+	Complete bool // false when the limit left expired keys for the next sweep
+}
+
+// retentionSweeps holds the last sweep of every bucket with a retention
+type retentionSweeps struct {
+	lock   sync.Mutex
+	sweeps map[string]RetentionSweep
+}
+
+func (rs *retentionSweeps) get(name string) (RetentionSweep, bool) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	sweep, ok := rs.sweeps[name]
+	return sweep, ok
+}
+
+func (rs *retentionSweeps) set(sweeps map[string]RetentionSweep) {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.sweeps = sweeps
+}
+
+// SetRetention makes SweepRetention delete the keys of the bucket older than retainFor, a
+// zero retainFor keeps keys forever. Every key of the bucket has to start with a time as
+// format tells, keys sorting before the cutoff are deleted whatever they hold.
+func (bucket *Bucket) SetRetention(retainFor time.Duration, format RetentionKeys) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	opts := bucket.options
+	opts.RetainFor, opts.RetainKeys = retainFor, format
+	if retainFor == 0 {
+		opts.RetainKeys = RetainGeneratedKeys
+	}
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	bucket.options = opts
+	if bucket.parent == nil {
+		bucket.tx.recordEvent(bucket.name, EventRetentionChanged, fmt.Sprintf("retain_for=%s time_keys=%t", retainFor, opts.RetainKeys == RetainTimeKeys))
+	}
+	return nil
+}
+
+// retentionEnd returns the first key kept by the retention at now, the keys before it are
+// expired. nil means no key can be expired yet.
+func (bucket *Bucket) retentionEnd(now time.Time) []byte {
+	cutoff := now.Add(-bucket.options.RetainFor)
+	if bucket.options.RetainKeys == RetainTimeKeys {
+		return keys.Encode(keys.Time(cutoff))
+	}
+	timestamp := keys.ClockTimestamp(cutoff)
+	if timestamp == 0 {
+		return nil
+	}
+	return keys.Uint64(timestamp)
+}
+
+// SweepRetention deletes the keys older than the retention of every bucket that has one.
+// Keys are deleted with DeleteRange in bucket transactions of at most chunk keys, so
+// writers of the bucket wait for one chunk only and writers of other buckets run next to
+// the sweep. At most limit keys of a bucket are deleted, zero is unlimited, the rest is left
+// for the next sweep. The sweeps are returned by bucket name and reported in BucketStat.
+func (db *DB) SweepRetention(now time.Time, chunk, limit int) (map[string]RetentionSweep, error) {
+	if chunk <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	var names []string
+	err := db.View(func(tx *Tx) error {
+		for _, name := range tx.Buckets() {
+			bucket, err := tx.GetBucket(name)
+			if err != nil {
+				return err
+			}
+			if bucket.options.RetainFor > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sweeps := make(map[string]RetentionSweep, len(names))
+	for _, name := range names {
+		sweep, err := db.sweepBucket(name, now, chunk, limit)
+		if errors.Is(err, ErrBucketNotFound) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return nil, err
+		}
+		sweeps[name] = sweep
+	}
+	db.retention.set(sweeps)
+	return sweeps, nil
+}
+
+func (db *DB) sweepBucket(name string, now time.Time, chunk, limit int) (RetentionSweep, error) {
+	sweep := RetentionSweep{At: now}
+	started := time.Now()
+	for !sweep.Complete {
+		n := chunk
+		if limit > 0 {
+			n = min(n, limit-sweep.Removed)
+		}
+		if n == 0 {
+			break
+		}
+		removed := 0
+		err := db.UpdateBucket([]byte(name), func(bucket *Bucket) error {
+			end := bucket.retentionEnd(now)
+			if bucket.options.RetainFor <= 0 || end == nil {
+				return nil
+			}
+			var err error
+			removed, err = bucket.deleteRange(nil, end, n)
+			return err
+		})
+		if err != nil {
+			return sweep, err
+		}
+		sweep.Removed += removed
+		sweep.Complete = removed < n
+	}
+	sweep.Duration = time.Since(started)
+	if sweep.Removed > 0 {
+		logger.Debug("swept expired keys", "bucket", name, "removed", sweep.Removed)
+	}
+	return sweep, nil
+}
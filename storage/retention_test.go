@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage/keys"
+)
+
+func TestSweepRetention(t *testing.T) {
+	db, filename := createTestDB(t)
+	now := time.Now()
+	day := 24 * time.Hour
+	createBuckets(t, db, "events", "logs", "forever")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		events, err := tx.GetBucket([]byte("events"))
+		require.NoError(t, err)
+		require.ErrorIs(t, events.SetRetention(-time.Hour, RetainGeneratedKeys), ErrBadBucketOptions)
+		require.NoError(t, events.SetRetention(30*day, RetainGeneratedKeys))
+		logs, err := tx.GetBucket([]byte("logs"))
+		require.NoError(t, err)
+		require.NoError(t, logs.SetRetention(7*day, RetainTimeKeys))
+		forever, err := tx.GetBucket([]byte("forever"))
+		require.NoError(t, err)
+
+		// one key per day over the last 60 days in every bucket
+		for age := 0; age < 60; age++ {
+			written := now.Add(-time.Duration(age)*day - time.Minute)
+			// a generator stamps the current time, the key is laid out the same way
+			generated := append(keys.Uint64(keys.ClockTimestamp(written)), keys.Uint64(uint64(age))...)
+			require.NoError(t, events.Put(generated, []byte("event")))
+			require.NoError(t, forever.Put(generated, []byte("event")))
+			require.NoError(t, logs.Put(keys.Encode(keys.Time(written), []byte("host")), []byte("line")))
+		}
+		return nil
+	}))
+	closeTestDB(t, db)
+
+	// the retention is stored with the bucket options
+	db = openTestDB(t, filename, nil)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		logs, err := tx.GetBucket([]byte("logs"))
+		require.NoError(t, err)
+		require.Equal(t, BucketOptions{RetainFor: 7 * day, RetainKeys: RetainTimeKeys}, logs.Options())
+		return nil
+	}))
+
+	_, err := db.SweepRetention(now, 0, 0)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+
+	// a limit leaves keys for the next sweep, chunks are smaller than the limit
+	sweeps, err := db.SweepRetention(now, 7, 20)
+	require.NoError(t, err)
+	require.Len(t, sweeps, 2)
+	require.Equal(t, 20, sweeps["events"].Removed)
+	require.False(t, sweeps["events"].Complete)
+	require.Equal(t, 20, sweeps["logs"].Removed)
+
+	sweeps, err = db.SweepRetention(now, 7, 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, sweeps["events"].Removed)
+	require.True(t, sweeps["events"].Complete)
+	require.Equal(t, 33, sweeps["logs"].Removed)
+	require.True(t, sweeps["logs"].Complete)
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		for name, kept := range map[string]int{"events": 30, "logs": 7, "forever": 60} {
+			bucket, err := tx.GetBucket([]byte(name))
+			require.NoError(t, err)
+			require.EqualValues(t, kept, bucket.stat().ItemsN, name)
+		}
+		stats, _, err := tx.BucketStatsPage(nil, 10)
+		require.NoError(t, err)
+		for _, stat := range stats {
+			if stat.Name == "forever" {
+				require.Nil(t, stat.LastSweep)
+				continue
+			}
+			require.NotNil(t, stat.LastSweep, stat.Name)
+			require.True(t, stat.LastSweep.Complete)
+			require.Equal(t, now, stat.LastSweep.At)
+		}
+		return nil
+	}))
+
+	// the oldest key left is within the retention
+	require.NoError(t, db.View(func(tx *Tx) error {
+		events, err := tx.GetBucket([]byte("events"))
+		require.NoError(t, err)
+		k, _ := events.Cursor().First()
+		generated, err := keys.ParseGeneratedKey(k)
+		require.NoError(t, err)
+		require.WithinDuration(t, now.Add(-29*day), keys.ClockTime(generated.Timestamp), day)
+		return nil
+	}))
+
+	// removing the retention stops the sweeps of the bucket
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		events, err := tx.GetBucket([]byte("events"))
+		require.NoError(t, err)
+		return events.SetRetention(0, RetainTimeKeys)
+	}))
+	sweeps, err = db.SweepRetention(now.Add(365*day), 100, 0)
+	require.NoError(t, err)
+	require.Len(t, sweeps, 1)
+	require.NoError(t, db.Check())
+}
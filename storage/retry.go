@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy tells UpdateWithRetry how often to run a transaction again and how long to wait
+// in between, the wait starts at Backoff and doubles up to MaxBackoff
+type RetryPolicy struct {
+	MaxAttempts int           // attempts in total, the first one included, below 2 never retries
+	Backoff     time.Duration // wait before the second attempt
+	MaxBackoff  time.Duration // longest wait, 0 does not cap it
+	// Retryable decides which errors are retried, IsTransient when nil
+	Retryable func(err error) bool
+}
+
+// DefaultRetryPolicy makes up to 3 attempts 50ms and 100ms apart
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, Backoff: 50 * time.Millisecond, MaxBackoff: time.Second}
+}
+
+// IsTransient reports errors that go away on their own, the same transaction may succeed
+// when it runs again a bit later: a write stall and a full reader table
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrWriteStalled) || errors.Is(err, ErrTooManyReaders)
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsTransient(err)
+}
+
+// wait returns the pause after the failed attempt, attempts count from 1
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt; i++ {
+		if p.MaxBackoff > 0 && wait >= p.MaxBackoff {
+			break
+		}
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && wait > p.MaxBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// UpdateWithRetry works as Update and runs the transaction again while it fails with an error
+// the policy retries, until the attempts run out or ctx is done. The error of the last attempt
+// is returned.
+//
+// fn MUST be idempotent: it runs once per attempt and only the last run is committed, so it
+// must not consume input it can't read again or have effects outside the transaction.
+func (db *DB) UpdateWithRetry(ctx context.Context, policy RetryPolicy, fn func(tx *Tx) error) error {
+	return db.UpdateLabeledWithRetry(ctx, policy, "", fn)
+}
+
+// UpdateLabeledWithRetry works as UpdateWithRetry, the label is reported as with UpdateLabeled
+func (db *DB) UpdateLabeledWithRetry(ctx context.Context, policy RetryPolicy, label string, fn func(tx *Tx) error) error {
+	for attempt := 1; ; attempt++ {
+		err := db.UpdateLabeled(label, fn)
+		if err == nil || attempt >= policy.MaxAttempts || !policy.retryable(err) {
+			return err
+		}
+		timer := time.NewTimer(policy.wait(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		logger.Debug("retrying write transaction", "label", label, "attempt", attempt+1, "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpdateWithRetry(t *testing.T) {
+	db := openStallTestDB(t, DefaultOptions().WithWriteStall(0, 2))
+	policy := RetryPolicy{MaxAttempts: 50, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, putKey(db, key))
+		}()
+	}
+	require.Eventually(t, func() bool { return db.writeQueue.Load() == 2 }, time.Second, time.Millisecond)
+
+	// a single attempt fails, retries outlast the stall
+	done := make(chan error, 1)
+	go func() {
+		done <- db.UpdateWithRetry(context.Background(), RetryPolicy{MaxAttempts: 1}, func(tx *Tx) error { return nil })
+	}()
+	require.ErrorIs(t, <-done, ErrWriteStalled)
+	attempts := 0
+	go func() {
+		done <- db.UpdateWithRetry(context.Background(), policy, func(tx *Tx) error {
+			attempts++
+			bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte("c"), []byte("value"))
+		})
+	}()
+	require.Eventually(t, func() bool { return db.WriteStall().Rejected >= 3 }, time.Second, time.Millisecond)
+	tx.Rollback()
+	wg.Wait()
+	require.NoError(t, <-done)
+	require.Equal(t, 1, attempts, "fn only runs once the transaction began")
+}
+
+func TestUpdateWithRetryGivesUp(t *testing.T) {
+	db := openStallTestDB(t, DefaultOptions())
+	errBusy := errors.New("busy")
+	policy := RetryPolicy{MaxAttempts: 3, Retryable: func(err error) bool { return errors.Is(err, errBusy) }}
+
+	attempts := 0
+	err := db.UpdateWithRetry(context.Background(), policy, func(tx *Tx) error {
+		attempts++
+		return errBusy
+	})
+	require.ErrorIs(t, err, errBusy)
+	require.Equal(t, 3, attempts)
+
+	// other errors are returned at once
+	attempts = 0
+	err = db.UpdateWithRetry(context.Background(), policy, func(tx *Tx) error {
+		attempts++
+		return ErrBucketNotFound
+	})
+	require.ErrorIs(t, err, ErrBucketNotFound)
+	require.Equal(t, 1, attempts)
+
+	// a done context ends the waits
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts = 0
+	policy.Backoff = time.Hour
+	err = db.UpdateWithRetry(ctx, policy, func(tx *Tx) error {
+		attempts++
+		return errBusy
+	})
+	require.ErrorIs(t, err, errBusy)
+	require.Equal(t, 1, attempts)
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	policy := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	var waits []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		waits = append(waits, policy.wait(attempt))
+	}
+	require.Equal(t, []time.Duration{10, 20, 40, 50, 50}, scaleDurations(waits, time.Millisecond))
+	require.True(t, IsTransient(ErrTooManyReaders))
+	require.False(t, IsTransient(ErrQuotaExceeded))
+}
+
+func scaleDurations(durations []time.Duration, unit time.Duration) []time.Duration {
+	scaled := make([]time.Duration, len(durations))
+	for i, d := range durations {
+		scaled[i] = d / unit
+	}
+	return scaled
+}
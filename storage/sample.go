@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// ItemInfo describes a key and the size of its value, the value itself is not read
+type ItemInfo struct {
+	Key    []byte
+	Size   int  // value bytes, 0 for a nested bucket
+	Blob   bool // the value is stored in a blob page chain
+	Bucket bool // the key is a nested bucket, see Bucket.CreateBucket
+}
+
+// itemInfo describes the item, only a blob written before format 0.12 has its first page
+// read for the size
+func itemInfo(tx *Tx, item *Item) (ItemInfo, error) {
+	valueType, err := item.valueType()
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	size, err := valueSize(tx, item)
+	if err != nil {
+		return ItemInfo{}, err
+	}
+	return ItemInfo{
+		Key:    bytes.Clone(item.Key),
+		Size:   size,
+		Blob:   valueType == ValueBlob,
+		Bucket: valueType == ValueBucket,
+	}, nil
+}
+
+// Sample returns up to n keys under the prefix picked uniformly at random, in key order.
+// The keys below a prefix form a range of positions, random positions are looked up by
+// descending the child subtree counts, so a sample reads n paths instead of the range.
+// All keys are returned when the prefix has n or fewer, keys hidden by expired prefix rules
+// are left out and make the sample smaller.
+func (bucket *Bucket) Sample(prefix []byte, n int) ([]ItemInfo, error) {
+	if bucket.tx == nil {
+		return nil, ErrTxClosed
+	}
+	if n <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return nil, err
+	}
+	defer bucket.tx.leave()
+	if bucket.root == 0 {
+		return nil, nil
+	}
+	var first uint64 // position of the first key under the prefix
+	var err error
+	if len(prefix) > 0 {
+		if first, err = countRange(bucket.tx, bucket.root, nil, prefix); err != nil {
+			return nil, err
+		}
+	}
+	total, err := countRange(bucket.tx, bucket.root, prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, err
+	}
+	root, err := bucket.tx.getNode(bucket.root)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	infos := make([]ItemInfo, 0, min(uint64(n), total))
+	for _, index := range samplePositions(total, n) {
+		var stack []cursorFrame
+		pos, node, err := traverseToIndex(bucket.tx, root, first+index, &stack)
+		if errors.Is(err, ErrNodeNotFound) {
+			break // the counts are checked by db.Check, a short tree ends the sample
+		}
+		if err != nil {
+			return nil, err
+		}
+		item := node.items[pos]
+		if len(bucket.prefixRules) > 0 && bucket.expired(item.Key, now) {
+			continue
+		}
+		info, err := itemInfo(bucket.tx, item)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// samplePositions picks min(n, total) distinct positions below total in ascending order
+func samplePositions(total uint64, n int) []uint64 {
+	if total <= uint64(n) {
+		positions := make([]uint64, total)
+		for i := range positions {
+			positions[i] = uint64(i)
+		}
+		return positions
+	}
+	// Floyd's algorithm, n draws for n distinct positions whatever the total
+	picked := make(map[uint64]struct{}, n)
+	for j := total - uint64(n); j < total; j++ {
+		position := rand.Uint64N(j + 1)
+		if _, ok := picked[position]; ok {
+			position = j
+		}
+		picked[position] = struct{}{}
+	}
+	positions := make([]uint64, 0, n)
+	for position := range picked {
+		positions = append(positions, position)
+	}
+	slices.Sort(positions)
+	return positions
+}
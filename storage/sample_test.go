@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSample(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("sampled"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("a:%04d", i)), make([]byte, i%50)); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 300; i++ {
+			if err = bucket.Put([]byte(fmt.Sprintf("b:%04d", i)), make([]byte, 10)); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("blob"), make([]byte, 3*BTreePageSize))
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sampled"))
+		require.NoError(t, err)
+
+		sample, err := bucket.Sample([]byte("a:"), 50)
+		require.NoError(t, err)
+		require.Len(t, sample, 50)
+		require.True(t, slices.IsSortedFunc(sample, func(a, b ItemInfo) int { return bytes.Compare(a.Key, b.Key) }))
+		for i, info := range sample {
+			require.True(t, bytes.HasPrefix(info.Key, []byte("a:")))
+			var index int
+			_, _ = fmt.Sscanf(string(info.Key), "a:%d", &index)
+			require.Equal(t, index%50, info.Size)
+			if i > 0 {
+				require.NotEqual(t, sample[i-1].Key, info.Key, "positions are distinct")
+			}
+		}
+
+		// a small prefix is returned whole
+		sample, err = bucket.Sample([]byte("b:"), 1000)
+		require.NoError(t, err)
+		require.Len(t, sample, 300)
+		require.Equal(t, "b:0000", string(sample[0].Key))
+		require.Equal(t, "b:0299", string(sample[299].Key))
+
+		sample, err = bucket.Sample([]byte("blob"), 10)
+		require.NoError(t, err)
+		require.Equal(t, []ItemInfo{{Key: []byte("blob"), Size: 3 * BTreePageSize, Blob: true}}, sample)
+		sample, err = bucket.Sample([]byte("c:"), 10)
+		require.NoError(t, err)
+		require.Empty(t, sample)
+		sample, err = bucket.Sample(nil, 2000)
+		require.NoError(t, err)
+		require.Len(t, sample, 1301)
+		_, err = bucket.Sample(nil, 0)
+		require.ErrorIs(t, err, ErrInvalidLimit)
+
+		count, err := bucket.CountPrefix([]byte("b:"))
+		require.NoError(t, err)
+		require.EqualValues(t, 300, count)
+
+		// every part of the range gets picked
+		hits := make([]int, 10)
+		for i := 0; i < 200; i++ {
+			sample, err = bucket.Sample([]byte("a:"), 5)
+			require.NoError(t, err)
+			for _, info := range sample {
+				var index int
+				_, _ = fmt.Sscanf(string(info.Key), "a:%d", &index)
+				hits[index/100]++
+			}
+		}
+		for decile, n := range hits {
+			require.Greater(t, n, 50, "decile %d", decile)
+		}
+		return nil
+	}))
+
+	// keys hidden by an expired rule are not sampled
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("sampled"))
+		if err != nil {
+			return err
+		}
+		require.NoError(t, bucket.SetPrefixTTL([]byte("b:"), time.Now().Add(-time.Second)))
+		sample, err := bucket.Sample([]byte("b:"), 10)
+		require.NoError(t, err)
+		require.Empty(t, sample)
+		return nil
+	}))
+}
+
+func TestSamplePositions(t *testing.T) {
+	require.Equal(t, []uint64{0, 1, 2}, samplePositions(3, 5))
+	for i := 0; i < 100; i++ {
+		positions := samplePositions(20, 19)
+		require.Len(t, positions, 19)
+		require.True(t, slices.IsSorted(positions))
+		require.Len(t, slices.Compact(positions), 19)
+		require.Less(t, positions[18], uint64(20))
+	}
+}
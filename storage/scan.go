@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+)
+
+// scanTokenPrefix versions the scan token format, the rest is the last visited key in
+// unpadded url safe base64, so a token is usable as is in urls and JSON
+const scanTokenPrefix = "1."
+
+// EncodeScanToken returns the token resuming a scan after the key
+func EncodeScanToken(lastKey []byte) []byte {
+	token := make([]byte, len(scanTokenPrefix)+base64.RawURLEncoding.EncodedLen(len(lastKey)))
+	copy(token, scanTokenPrefix)
+	base64.RawURLEncoding.Encode(token[len(scanTokenPrefix):], lastKey)
+	return token
+}
+
+// DecodeScanToken returns the last key of a scan token, a nil or empty token starts at the
+// first key and decodes to nil
+func DecodeScanToken(token []byte) ([]byte, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+	encoded, ok := bytes.CutPrefix(token, []byte(scanTokenPrefix))
+	if !ok {
+		return nil, ErrBadScanToken
+	}
+	key := make([]byte, base64.RawURLEncoding.DecodedLen(len(encoded)))
+	n, err := base64.RawURLEncoding.Decode(key, encoded)
+	if err != nil {
+		return nil, ErrBadScanToken
+	}
+	return key[:n], nil
+}
+
+// ScanFrom calls fn for up to limit keys after the key encoded in the token, a nil token
+// starts at the first key. It returns the token of the next chunk, nil once the bucket is
+// done. Chunks are meant to run in separate short transactions: a key inserted or deleted
+// between two chunks may or may not be seen, keys present during the whole scan are seen
+// once and in order.
+func (bucket *Bucket) ScanFrom(token []byte, limit int, fn func(k, v []byte) error) ([]byte, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+	if bucket.tx == nil {
+		return nil, ErrTxClosed
+	}
+	after, err := DecodeScanToken(token)
+	if err != nil {
+		return nil, err
+	}
+	cursor := bucket.Cursor()
+	var k, v []byte
+	if after == nil {
+		k, v = cursor.First()
+	} else if k, v = cursor.Seek(after); bytes.Equal(k, after) {
+		k, v = cursor.Next()
+	}
+	var next []byte
+	for n := 1; k != nil; n++ {
+		if err = fn(k, v); err != nil {
+			return nil, err
+		}
+		if n == limit {
+			// encoded before the cursor moves on, k points into the page
+			next = EncodeScanToken(k)
+			if k, _ = cursor.Next(); k == nil {
+				next = nil
+			}
+			break
+		}
+		k, v = cursor.Next()
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, err
+	}
+	if bucket.tx.isInvalidated() {
+		return nil, ErrTxClosed
+	}
+	return next, nil
+}
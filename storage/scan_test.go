@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanToken(t *testing.T) {
+	for _, key := range [][]byte{[]byte("key"), {0x00, 0xff, '/', '+'}, []byte("")} {
+		token := EncodeScanToken(key)
+		require.NotContains(t, string(token), "/")
+		decoded, err := DecodeScanToken(token)
+		require.NoError(t, err)
+		require.Equal(t, key, decoded)
+	}
+	decoded, err := DecodeScanToken(nil)
+	require.NoError(t, err)
+	require.Nil(t, decoded)
+	for _, token := range []string{"key", "2.a2V5", "1.!!"} {
+		_, err = DecodeScanToken([]byte(token))
+		require.ErrorIs(t, err, ErrBadScanToken, token)
+	}
+}
+
+func TestScanFrom(t *testing.T) {
+	db, _ := createTestDB(t)
+	key := func(i int) []byte { return []byte(fmt.Sprintf("key_%05d", i)) }
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i += 2 {
+			if err = bucket.Put(key(i), key(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	scan := func(token []byte, limit int, modify func(bucket *Bucket) error) ([][]byte, []byte) {
+		var keys [][]byte
+		require.NoError(t, db.View(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			token, err = bucket.ScanFrom(token, limit, func(k, v []byte) error {
+				require.Equal(t, k, v)
+				keys = append(keys, append([]byte(nil), k...))
+				return nil
+			})
+			return err
+		}))
+		if modify != nil {
+			require.NoError(t, db.Update(func(tx *Tx) error {
+				bucket, err := tx.GetBucket([]byte("foo"))
+				if err != nil {
+					return err
+				}
+				return modify(bucket)
+			}))
+		}
+		return keys, token
+	}
+
+	// every chunk in its own transaction, keys change between chunks
+	var seen [][]byte
+	var token []byte
+	for chunk := 0; ; chunk++ {
+		var keys [][]byte
+		keys, token = scan(token, 64, func(bucket *Bucket) error {
+			if err := bucket.Put(key(chunk*2+1), key(chunk*2+1)); err != nil { // behind the scan
+				return err
+			}
+			return bucket.Put(key(999-chunk*2), key(999-chunk*2)) // ahead of the scan
+		})
+		require.LessOrEqual(t, len(keys), 64)
+		seen = append(seen, keys...)
+		if token == nil {
+			break
+		}
+	}
+	for i := 1; i < len(seen); i++ {
+		require.Less(t, string(seen[i-1]), string(seen[i]), "keys are seen once and in order")
+	}
+	evenSeen := 0
+	for _, k := range seen {
+		var i int
+		_, err := fmt.Sscanf(string(k), "key_%05d", &i)
+		require.NoError(t, err)
+		if i%2 == 0 {
+			evenSeen++
+		}
+	}
+	require.Equal(t, 500, evenSeen, "keys present during the whole scan are all seen")
+
+	// the last chunk ending exactly at the last key returns no token
+	keys, token := scan(nil, 10000, nil)
+	require.Nil(t, token)
+	last := keys[len(keys)-1]
+	keys, token = scan(EncodeScanToken(keys[len(keys)-2]), 1, nil)
+	require.Equal(t, [][]byte{last}, keys)
+	require.Nil(t, token)
+
+	// a deleted last key still resumes after it
+	token = EncodeScanToken(key(100))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Remove(key(100))
+	}))
+	keys, _ = scan(token, 1, nil)
+	require.Equal(t, [][]byte{key(102)}, keys)
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		_, err = bucket.ScanFrom(nil, 0, nil)
+		require.ErrorIs(t, err, ErrInvalidLimit)
+		_, err = bucket.ScanFrom([]byte("bad"), 1, nil)
+		require.ErrorIs(t, err, ErrBadScanToken)
+		return nil
+	}))
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BucketSnapshot is a read-only view of one bucket as of SnapshotBucket. It does not hold
+// the database lock, writers keep committing while it is open. Pages are updated in place,
+// so before a commit overwrites a page the snapshot may read, its old image is copied into
+// the snapshot, and pages freed by commits are not reused until every snapshot is released.
+type BucketSnapshot struct {
+	state  *snapshotState
+	bucket *Bucket
+}
+
+// snapshotState is the part of a snapshot the dal sees, it never points back to the handle
+// so the finalizer of a leaked handle can run
+type snapshotState struct {
+	id        uint64
+	name      string
+	created   time.Time
+	highWater uint64 // pages at and above it did not exist when the snapshot was taken
+	dal       *Dal
+	tx        *Tx // read-only transaction of the snapshot, it is never registered as a reader
+	once      sync.Once
+	// lock keeps a commit from overwriting a page between the image lookup and the file read
+	lock  sync.RWMutex
+	pages map[uint64][]byte // old images of pages overwritten since the snapshot was taken
+}
+
+// snapshotSet tracks open bucket snapshots of the dal
+type snapshotSet struct {
+	lock   sync.RWMutex
+	nextID uint64
+	open   map[uint64]*snapshotState
+	n      atomic.Int32
+}
+
+// SnapshotBucket pins the bucket as it is now. Get, Cursor and ForEach of the snapshot see
+// that state until Release, without holding a transaction open. A snapshot left for the
+// garbage collector is released by a finalizer that logs a warning.
+func (db *DB) SnapshotBucket(name []byte) (*BucketSnapshot, error) {
+	var snapshot *BucketSnapshot
+	err := db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(name)
+		if err != nil {
+			return err
+		}
+		// commits wait for the read lock, so the bucket and the file pages are consistent
+		state := db.dal.snapshots.add(db.dal, string(name))
+		state.tx = newTx(db, false, 0)
+		state.tx.snapshot = state
+		bucket.tx = state.tx
+		snapshot = &BucketSnapshot{state: state, bucket: bucket}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	runtime.SetFinalizer(snapshot, func(snapshot *BucketSnapshot) {
+		if snapshot.state.release() {
+			logger.Warn("bucket snapshot was not released", "bucket", snapshot.state.name,
+				"age", time.Since(snapshot.state.created))
+		}
+	})
+	return snapshot, nil
+}
+
+// Get returns the value of the key as of the snapshot
+func (snapshot *BucketSnapshot) Get(key []byte) ([]byte, bool) {
+	return snapshot.bucket.Get(key)
+}
+
+// Lookup returns the value of the key as of the snapshot, ErrTxClosed after Release
+func (snapshot *BucketSnapshot) Lookup(key []byte) ([]byte, bool, error) {
+	return snapshot.bucket.Lookup(key)
+}
+
+// Cursor iterates the snapshot, moves after Release end with ErrTxClosed in Cursor.Err
+func (snapshot *BucketSnapshot) Cursor() *Cursor {
+	return snapshot.bucket.Cursor()
+}
+
+// ForEach calls fn for every key of the snapshot in order
+func (snapshot *BucketSnapshot) ForEach(fn func(k, v []byte) error) error {
+	return snapshot.bucket.ForEach(fn)
+}
+
+// Stat returns the bucket counters as of the snapshot
+func (snapshot *BucketSnapshot) Stat() BucketStat {
+	return *snapshot.bucket.stat()
+}
+
+// Release drops the snapshot and its page images, it waits for a running read to finish.
+// Releasing twice is a no-op.
+func (snapshot *BucketSnapshot) Release() {
+	snapshot.state.release()
+	runtime.SetFinalizer(snapshot, nil)
+}
+
+func (ss *snapshotSet) add(dal *Dal, name string) *snapshotState {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.open == nil {
+		ss.open = make(map[uint64]*snapshotState)
+	}
+	ss.nextID++
+	state := &snapshotState{
+		id:        ss.nextID,
+		name:      name,
+		created:   time.Now(),
+		highWater: dal.maxPages.Load(),
+		dal:       dal,
+		pages:     make(map[uint64][]byte),
+	}
+	ss.open[state.id] = state
+	ss.n.Add(1)
+	return state
+}
+
+func (ss *snapshotSet) remove(id uint64) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if _, ok := ss.open[id]; ok {
+		delete(ss.open, id)
+		ss.n.Add(-1)
+	}
+}
+
+// active reports whether any snapshot is open
+func (ss *snapshotSet) active() bool {
+	return ss.n.Load() > 0
+}
+
+// stats returns the number of open snapshots and the page images they hold
+func (ss *snapshotSet) stats() (int, int) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	pages := 0
+	for _, state := range ss.open {
+		state.lock.RLock()
+		pages += len(state.pages)
+		state.lock.RUnlock()
+	}
+	return len(ss.open), pages
+}
+
+// preserve copies the current file images of the pages into every open snapshot that may
+// read them, it runs before the pages are overwritten in the database file
+func (ss *snapshotSet) preserve(dal *Dal, firstPage uint64, numPages uint64) error {
+	if !ss.active() {
+		return nil
+	}
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	images := make(map[uint64][]byte) // read once for all snapshots
+	for _, state := range ss.open {
+		state.lock.Lock()
+		for pageNum := firstPage; pageNum < firstPage+numPages && pageNum < state.highWater; pageNum++ {
+			if _, ok := state.pages[pageNum]; ok {
+				continue
+			}
+			image, ok := images[pageNum]
+			if !ok {
+				page, err := dal.readPage(pageNum)
+				if err != nil {
+					state.lock.Unlock()
+					return fmt.Errorf("could not preserve page %d for snapshots: %w", pageNum, err)
+				}
+				image = append([]byte(nil), page.Data...)
+				dal.releasePage(page)
+				images[pageNum] = image
+			}
+			state.pages[pageNum] = image
+		}
+		state.lock.Unlock()
+	}
+	return nil
+}
+
+// closeAll releases the snapshots still open when the database is closed
+func (ss *snapshotSet) closeAll() {
+	ss.lock.RLock()
+	open := make([]*snapshotState, 0, len(ss.open))
+	for _, state := range ss.open {
+		open = append(open, state)
+	}
+	ss.lock.RUnlock()
+	for _, state := range open {
+		state.release()
+	}
+}
+
+// release invalidates the snapshot transaction and drops the page images, it reports
+// whether this call released the snapshot
+func (state *snapshotState) release() bool {
+	released := false
+	state.once.Do(func() {
+		released = true
+		state.tx.reader.opLock.Lock()
+		state.tx.reader.invalidated = true
+		state.tx.reader.opLock.Unlock()
+		state.dal.snapshots.remove(state.id)
+		state.lock.Lock()
+		state.pages = nil
+		state.lock.Unlock()
+	})
+	return released
+}
+
+// getPage returns the page as it was when the snapshot was taken
+func (state *snapshotState) getPage(pageNum uint64) (*Page, error) {
+	if isBlobFilePage(pageNum) {
+		// blob file pages are never overwritten, freed ones are held until the release
+		return state.dal.readPage(pageNum)
+	}
+	if pageNum >= state.highWater {
+		return nil, fmt.Errorf("%w: page %d, the snapshot has %d pages", ErrPageOutOfRange, pageNum, state.highWater)
+	}
+	state.lock.RLock()
+	defer state.lock.RUnlock()
+	if image, ok := state.pages[pageNum]; ok {
+		data := state.dal.pages.get(state.dal.meta.pageSize)
+		copy(data, image)
+		return &Page{PageNumber: pageNum, Data: data}, nil
+	}
+	return state.dal.readPage(pageNum)
+}
+
+func (state *snapshotState) getNode(pageNum uint64) (*BNode, error) {
+	page, err := state.getPage(pageNum)
+	if err != nil {
+		return nil, err
+	}
+	node := NewBNode()
+	err = node.Deserialize(page.Data)
+	state.dal.releasePage(page)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode node page %d: %w", pageNum, err)
+	}
+	node.PageNum = pageNum
+	return node, nil
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotBucket(t *testing.T) {
+	db, _ := createTestDB(t)
+
+	blob := bytes.Repeat([]byte("b"), 3*BTreePageSize)
+	err := db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := range 2000 {
+			if err = bucket.Put([]byte(fmt.Sprintf("key_%05d", i)), []byte("old")); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("blob"), blob)
+	})
+	require.NoError(t, err)
+
+	snapshot, err := db.SnapshotBucket([]byte("foo"))
+	require.NoError(t, err)
+
+	// writers are not blocked by the snapshot
+	err = db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		for i := range 2000 {
+			key := []byte(fmt.Sprintf("key_%05d", i))
+			if i%2 == 0 {
+				err = bucket.Remove(key)
+			} else {
+				err = bucket.Put(key, []byte("new"))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Remove([]byte("blob"))
+	})
+	require.NoError(t, err)
+
+	value, found := snapshot.Get([]byte("key_00000"))
+	require.True(t, found)
+	require.Equal(t, []byte("old"), value)
+	value, found = snapshot.Get([]byte("blob"))
+	require.True(t, found)
+	require.Equal(t, blob, value)
+	count := 0
+	require.NoError(t, snapshot.ForEach(func(k, v []byte) error {
+		count++
+		return nil
+	}))
+	require.Equal(t, 2001, count)
+	require.EqualValues(t, 2001, snapshot.Stat().ItemsN)
+	cursor := snapshot.Cursor()
+	k, v := cursor.Last()
+	require.Equal(t, []byte("key_01999"), k)
+	require.Equal(t, []byte("old"), v)
+
+	// the database itself moved on
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		_, found := bucket.Get([]byte("key_00000"))
+		require.False(t, found)
+		value, _ := bucket.Get([]byte("key_00001"))
+		require.Equal(t, []byte("new"), value)
+		return nil
+	})
+	require.NoError(t, err)
+
+	stat := db.Stat(WithBuckets(false))
+	require.Equal(t, 1, stat.Snapshots)
+	require.Positive(t, stat.SnapshotPages)
+	info, err := db.FreelistInfo()
+	require.NoError(t, err)
+	require.Positive(t, info.HeldPages, "pages freed under the snapshot are not reused")
+	require.NoError(t, db.Check())
+
+	snapshot.Release()
+	snapshot.Release()
+	_, found, err = snapshot.Lookup([]byte("key_00001"))
+	require.False(t, found)
+	require.ErrorIs(t, err, ErrTxClosed)
+	k, _ = cursor.First()
+	require.Nil(t, k)
+	require.ErrorIs(t, cursor.Err(), ErrTxClosed)
+
+	// the next commit hands the held pages back to the freelist
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key_00001"), []byte("newer"))
+	}))
+	info, err = db.FreelistInfo()
+	require.NoError(t, err)
+	require.Zero(t, info.HeldPages)
+	require.Positive(t, info.FreePages)
+	require.Zero(t, db.Stat(WithBuckets(false)).Snapshots)
+	require.NoError(t, db.Check())
+}
+
+func TestSnapshotBucketNotFound(t *testing.T) {
+	db, _ := createTestDB(t)
+	_, err := db.SnapshotBucket([]byte("missing"))
+	require.ErrorIs(t, err, ErrBucketNotFound)
+}
+
+func TestSnapshotBucketFinalizer(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("foo"))
+		return err
+	}))
+
+	func() {
+		snapshot, err := db.SnapshotBucket([]byte("foo"))
+		require.NoError(t, err)
+		_ = snapshot
+	}()
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return db.Stat(WithBuckets(false)).Snapshots == 0
+	}, 5*time.Second, 10*time.Millisecond, "a leaked snapshot is released by the finalizer")
+}
+
+func TestSnapshotBucketClose(t *testing.T) {
+	filename := TempFileName(".db")
+	t.Cleanup(func() { _ = os.Remove(filename) })
+	db := openTestDB(t, filename, nil)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("key"), []byte("value"))
+	}))
+	snapshot, err := db.SnapshotBucket([]byte("foo"))
+	require.NoError(t, err)
+	closeTestDB(t, db)
+
+	_, _, err = snapshot.Lookup([]byte("key"))
+	require.ErrorIs(t, err, ErrTxClosed)
+}
+
+func TestSnapshotBucketConcurrentWrites(t *testing.T) {
+	db, _ := createTestDB(t)
+	put := func(value string) error {
+		return db.Update(func(tx *Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+			if err != nil {
+				return err
+			}
+			for i := range 500 {
+				if err = bucket.Put([]byte(fmt.Sprintf("key_%05d", i)), []byte(value)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	require.NoError(t, put("v0"))
+	snapshot, err := db.SnapshotBucket([]byte("foo"))
+	require.NoError(t, err)
+	defer snapshot.Release()
+
+	done := make(chan error)
+	go func() {
+		for round := 1; round <= 20; round++ {
+			if err := put(fmt.Sprintf("v%d", round)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for reading := true; reading; {
+		select {
+		case err = <-done:
+			require.NoError(t, err)
+			reading = false
+		default:
+		}
+		count := 0
+		require.NoError(t, snapshot.ForEach(func(k, v []byte) error {
+			require.Equal(t, []byte("v0"), v)
+			count++
+			return nil
+		}))
+		require.Equal(t, 500, count)
+	}
+}
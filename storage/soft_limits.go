@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a soft limit that stays crossed is logged again after softLimitWarnInterval
+const softLimitWarnInterval = 10 * time.Minute
+
+// SoftLimitKind names a soft limit, see Options.SizeWarnRatio
+type SoftLimitKind string
+
+const (
+	SoftLimitFileSize SoftLimitKind = "file_size" // the file is above SizeWarnRatio of MaxSize
+	SoftLimitFreelist SoftLimitKind = "freelist"  // the freelist has more than FreelistWarnRuns runs
+	SoftLimitTxLog    SoftLimitKind = "tx_log"    // the tx log is above TxLogWarnBytes
+)
+
+// SoftLimitWarning is a soft limit the database is above, writes are not refused
+type SoftLimitWarning struct {
+	Kind    SoftLimitKind
+	Message string
+	Value   uint64
+	Limit   uint64
+	Since   time.Time // when the limit was crossed
+}
+
+// SoftLimitInfo reports the soft limits, a warning is dropped once its value is back under
+// the limit
+type SoftLimitInfo struct {
+	Warnings []SoftLimitWarning       // by kind
+	Active   map[SoftLimitKind]int    // 1 while the limit is crossed, 0 after, for every enabled limit
+	Crossed  map[SoftLimitKind]uint64 // times each limit was crossed since open
+}
+
+// softLimits checks the file size, freelist runs and tx log size after every commit and
+// when they are read, so a warning shows up without a poll and clears without a commit
+type softLimits struct {
+	lock     sync.Mutex
+	warnings map[SoftLimitKind]*SoftLimitWarning
+	crossed  map[SoftLimitKind]uint64
+	logged   map[SoftLimitKind]time.Time
+}
+
+func newSoftLimits(opts *Options) *softLimits {
+	if opts.SizeWarnRatio <= 0 && opts.FreelistWarnRuns <= 0 && opts.TxLogWarnBytes <= 0 {
+		return nil
+	}
+	return &softLimits{
+		warnings: make(map[SoftLimitKind]*SoftLimitWarning),
+		crossed:  make(map[SoftLimitKind]uint64),
+		logged:   make(map[SoftLimitKind]time.Time),
+	}
+}
+
+// observe compares the published page counters and the tx log size with the limits
+func (s *softLimits) observe(dal *Dal) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	opts := dal.opts
+	if opts.SizeWarnRatio > 0 && opts.MaxSize > 0 {
+		size := dal.usage.totalPages.Load() * dal.meta.pageSize
+		limit := uint64(float64(opts.MaxSize) * opts.SizeWarnRatio)
+		s.check(now, SoftLimitFileSize, size, limit, func() string {
+			return fmt.Sprintf("database file has %d bytes, above %.0f%% of its limit of %d", size,
+				opts.SizeWarnRatio*100, opts.MaxSize)
+		})
+	}
+	if opts.FreelistWarnRuns > 0 {
+		runs := dal.usage.freelistRuns.Load()
+		s.check(now, SoftLimitFreelist, runs, uint64(opts.FreelistWarnRuns), func() string {
+			return fmt.Sprintf("freelist has %d runs of free pages, above %d", runs, opts.FreelistWarnRuns)
+		})
+	}
+	if opts.TxLogWarnBytes > 0 && dal.txLog.file != nil {
+		size := uint64(dal.txLog.size())
+		s.check(now, SoftLimitTxLog, size, uint64(opts.TxLogWarnBytes), func() string {
+			return fmt.Sprintf("tx log has %d bytes, above %d", size, opts.TxLogWarnBytes)
+		})
+	}
+}
+
+// check sets or clears the warning of a limit, message is only built above the limit
+func (s *softLimits) check(now time.Time, kind SoftLimitKind, value, limit uint64, message func() string) {
+	warning, active := s.warnings[kind]
+	if value <= limit {
+		if active {
+			delete(s.warnings, kind)
+			logger.Info("soft limit cleared", "limit", string(kind), "value", value, "threshold", limit,
+				"duration", now.Sub(warning.Since).Round(time.Second))
+		}
+		return
+	}
+	if !active {
+		warning = &SoftLimitWarning{Kind: kind, Since: now}
+		s.warnings[kind] = warning
+		s.crossed[kind]++
+	}
+	warning.Message, warning.Value, warning.Limit = message(), value, limit
+	if now.Sub(s.logged[kind]) >= softLimitWarnInterval {
+		s.logged[kind] = now
+		logger.Warn("soft limit crossed", "limit", string(kind), "message", warning.Message)
+	}
+}
+
+func (s *softLimits) info(opts *Options) SoftLimitInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info := SoftLimitInfo{
+		Active:  make(map[SoftLimitKind]int),
+		Crossed: make(map[SoftLimitKind]uint64),
+	}
+	enabled := map[SoftLimitKind]bool{
+		SoftLimitFileSize: opts.SizeWarnRatio > 0 && opts.MaxSize > 0,
+		SoftLimitFreelist: opts.FreelistWarnRuns > 0,
+		SoftLimitTxLog:    opts.TxLogWarnBytes > 0,
+	}
+	for kind, on := range enabled {
+		if !on {
+			continue
+		}
+		info.Crossed[kind] = s.crossed[kind]
+		info.Active[kind] = 0
+		if warning, ok := s.warnings[kind]; ok {
+			info.Active[kind] = 1
+			info.Warnings = append(info.Warnings, *warning)
+		}
+	}
+	slices.SortFunc(info.Warnings, func(a, b SoftLimitWarning) int {
+		return strings.Compare(string(a.Kind), string(b.Kind))
+	})
+	return info
+}
+
+// SoftLimits checks the soft limits and reports them, the zero value when none is set
+func (db *DB) SoftLimits() SoftLimitInfo {
+	if db.softLimits == nil {
+		return SoftLimitInfo{}
+	}
+	db.softLimits.observe(db.dal)
+	return db.softLimits.info(db.dal.opts)
+}
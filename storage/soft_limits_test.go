@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func putBlobs(t *testing.T, db *DB, keys ...int) {
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = bucket.Put([]byte(fmt.Sprint(key)), bytes.Repeat([]byte("x"), 2*BTreePageSize)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func removeBlobs(t *testing.T, db *DB, keys ...int) {
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("blobs"))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err = bucket.Remove([]byte(fmt.Sprint(key))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestSoftLimitFileSize(t *testing.T) {
+	db := openStallTestDB(t, DefaultOptions().WithMaxSize(4*minFileSize).WithSoftLimits(0.5, 0, 0))
+	stat := db.Stat(WithBuckets(false))
+	require.Empty(t, stat.Warnings)
+	require.Equal(t, map[SoftLimitKind]int{SoftLimitFileSize: 0}, stat.SoftLimits.Active)
+
+	// the file grows past half of its limit
+	putBlobs(t, db, 0, 1, 2, 3, 4, 5)
+	stat = db.Stat(WithBuckets(false))
+	require.Len(t, stat.Warnings, 1)
+	warning := stat.Warnings[0]
+	require.Equal(t, SoftLimitFileSize, warning.Kind)
+	require.EqualValues(t, 2*minFileSize, warning.Limit)
+	require.Greater(t, warning.Value, warning.Limit)
+	require.Contains(t, warning.Message, fmt.Sprintf("above 50%% of its limit of %d", 4*minFileSize))
+	require.False(t, warning.Since.IsZero())
+	require.Equal(t, 1, stat.SoftLimits.Active[SoftLimitFileSize])
+	require.EqualValues(t, 1, stat.SoftLimits.Crossed[SoftLimitFileSize])
+
+	// staying above is one crossing, the warning keeps its start
+	putBlobs(t, db, 6)
+	limits := db.SoftLimits()
+	require.EqualValues(t, 1, limits.Crossed[SoftLimitFileSize])
+	require.Equal(t, warning.Since, limits.Warnings[0].Since)
+}
+
+func TestSoftLimitFreelist(t *testing.T) {
+	db := openStallTestDB(t, DefaultOptions().WithSoftLimits(0, 2, 0))
+	putBlobs(t, db, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+	require.Empty(t, db.SoftLimits().Warnings)
+
+	// every other blob leaves a run of its own
+	removeBlobs(t, db, 1, 3, 5, 7)
+	info, err := db.FreelistInfo()
+	require.NoError(t, err)
+	require.Greater(t, info.Runs, 2)
+	limits := db.SoftLimits()
+	require.Len(t, limits.Warnings, 1)
+	require.Equal(t, SoftLimitFreelist, limits.Warnings[0].Kind)
+	require.EqualValues(t, info.Runs, limits.Warnings[0].Value)
+
+	// new blobs reuse the runs, the warning clears and the crossing is still counted
+	putBlobs(t, db, 11, 13, 15, 17)
+	info, err = db.FreelistInfo()
+	require.NoError(t, err)
+	require.LessOrEqual(t, info.Runs, 2)
+	limits = db.SoftLimits()
+	require.Empty(t, limits.Warnings)
+	require.Equal(t, 0, limits.Active[SoftLimitFreelist])
+	require.EqualValues(t, 1, limits.Crossed[SoftLimitFreelist])
+}
+
+func TestSoftLimitTxLog(t *testing.T) {
+	// the interval mode keeps tx log records until the database file is synced
+	opts := DefaultOptions().WithSyncMode(SyncInterval).WithSyncInterval(time.Hour).
+		WithSoftLimits(0, 0, 8*BTreePageSize)
+	db := openStallTestDB(t, opts)
+	for key := range 10 {
+		putBlobs(t, db, key)
+	}
+	limits := db.SoftLimits()
+	require.Len(t, limits.Warnings, 1)
+	require.Equal(t, SoftLimitTxLog, limits.Warnings[0].Kind)
+	require.Contains(t, limits.Warnings[0].Message, fmt.Sprintf("above %d", 8*BTreePageSize))
+
+	// a sync drops the records, the limit clears without a commit
+	require.NoError(t, db.Sync())
+	limits = db.SoftLimits()
+	require.Empty(t, limits.Warnings)
+	require.EqualValues(t, 1, limits.Crossed[SoftLimitTxLog])
+
+	require.Empty(t, (&DB{}).SoftLimits().Warnings, "no soft limits without thresholds")
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithSoftLimits(1.5, 0, 0))
+	require.ErrorIs(t, err, ErrBadSoftLimits)
+}
@@ -0,0 +1,76 @@
+package storage
+
+import "fmt"
+
+// SplitStrategy tells where a bucket splits a node that grew over the page
+type SplitStrategy uint8
+
+const (
+	// SplitAuto keeps the left node nearly full when the key was appended after the last
+	// key of the leaf, like sequences and timestamps, and splits near the size midpoint
+	// otherwise
+	SplitAuto SplitStrategy = iota
+	// SplitMidpoint always splits near the size midpoint
+	SplitMidpoint
+	// SplitThreshold splits at the first item past the minimum fill, the left node keeps
+	// a bit less than half the page whatever the keys are
+	SplitThreshold
+)
+
+// appendFillPercent is the fill the left node keeps when SplitAuto splits for an append,
+// the room left absorbs values that grow on update
+const appendFillPercent = 0.9
+
+func (strategy SplitStrategy) String() string {
+	switch strategy {
+	case SplitAuto:
+		return "auto"
+	case SplitMidpoint:
+		return "midpoint"
+	case SplitThreshold:
+		return "threshold"
+	}
+	return fmt.Sprintf("SplitStrategy(%d)", uint8(strategy))
+}
+
+// SetSplitStrategy changes where the nodes of the bucket split from now on, nodes split
+// before keep their fill
+func (bucket *Bucket) SetSplitStrategy(strategy SplitStrategy) error {
+	if bucket.tx == nil {
+		return ErrTxClosed
+	}
+	if !bucket.tx.write {
+		return ErrWriteInRxTransaction
+	}
+	opts := bucket.options
+	opts.Split = strategy
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	bucket.options = opts
+	return nil
+}
+
+// splitIndex returns the index of the item of the full node moved to the parent by
+// splitChild, appending is true when the put added the last key of the node subtree
+func (bucket *Bucket) splitIndex(node *BNode, appending bool) int {
+	dal := bucket.tx.db.dal
+	strategy := bucket.options.Split
+	if strategy == SplitThreshold || len(node.items) < 3 {
+		return getSplitIndex(node, dal.minThreshold())
+	}
+	limit := node.size() / 2
+	// item sizes miss the wide length overhead, a wide node splits near the midpoint
+	if wide, _ := node.wide(); strategy == SplitAuto && appending && !wide {
+		limit = int(appendFillPercent * float32(dal.meta.pageSize))
+	}
+	// the left node keeps the items before the index, the right node at least one item
+	size := NodeHeaderSize
+	for idx, item := range node.items {
+		size += node.elemSize(item)
+		if size > limit {
+			return min(max(idx, 1), len(node.items)-2)
+		}
+	}
+	return len(node.items) - 2
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// putSequential writes n increasing keys to a new bucket with the split strategy
+func putSequential(t testing.TB, db *DB, name string, strategy SplitStrategy, n int) {
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketWithOptions([]byte(name), BucketOptions{Split: strategy})
+		if err != nil {
+			return err
+		}
+		for idx := range n {
+			key := fmt.Sprintf("%016d", idx)
+			if err = bucket.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+func TestSplitStrategy(t *testing.T) {
+	db, filename := createTestDB(t)
+	const n = 20_000
+	stats := make(map[SplitStrategy]TreeStats)
+	for _, strategy := range []SplitStrategy{SplitAuto, SplitMidpoint, SplitThreshold} {
+		putSequential(t, db, strategy.String(), strategy, n)
+		var err error
+		stats[strategy], err = db.TreeStats([]byte(strategy.String()))
+		require.NoError(t, err)
+	}
+	leaves := func(strategy SplitStrategy) int {
+		return stats[strategy].Levels[stats[strategy].Depth-1].NodesN
+	}
+	leafFill := func(strategy SplitStrategy) float64 {
+		return stats[strategy].Levels[stats[strategy].Depth-1].AvgFill
+	}
+	// appends keep the left leaves nearly full, the threshold leaves them about half full
+	require.Greater(t, leafFill(SplitAuto), 0.85)
+	require.Less(t, leafFill(SplitThreshold), 0.6)
+	require.Less(t, leaves(SplitAuto)*3, leaves(SplitThreshold)*2)
+	require.LessOrEqual(t, stats[SplitAuto].Depth, stats[SplitThreshold].Depth)
+	require.LessOrEqual(t, leaves(SplitAuto), leaves(SplitMidpoint))
+
+	// random keys split near the midpoint
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("auto"))
+		require.NoError(t, err)
+		for _, idx := range rand.Perm(n) {
+			key := fmt.Sprintf("%016d-", idx)
+			if err = bucket.Put([]byte(key), []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	require.NoError(t, db.Check())
+
+	// the strategy is stored with the bucket and can be changed
+	require.NoError(t, db.Close())
+	db = openTestDB(t, filename, nil)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("threshold"))
+		require.NoError(t, err)
+		require.Equal(t, SplitThreshold, bucket.Options().Split)
+		require.ErrorIs(t, bucket.SetSplitStrategy(SplitThreshold+1), ErrBadBucketOptions)
+		return bucket.SetSplitStrategy(SplitMidpoint)
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("threshold"))
+		require.NoError(t, err)
+		require.Equal(t, SplitMidpoint, bucket.Options().Split)
+		_, err = tx.CreateBucketWithOptions([]byte("bad"), BucketOptions{Split: SplitThreshold + 1})
+		require.ErrorIs(t, err, ErrBadBucketOptions)
+		return nil
+	}))
+}
+
+// BenchmarkSequentialInsert compares the split strategies on increasing keys, the file size
+// and tree depth after the inserts are reported with the time
+func BenchmarkSequentialInsert(b *testing.B) {
+	const n = 100_000
+	for _, strategy := range []SplitStrategy{SplitAuto, SplitMidpoint, SplitThreshold} {
+		b.Run(strategy.String(), func(b *testing.B) {
+			for range b.N {
+				b.StopTimer()
+				path := TempFileName(".db")
+				db, err := Open(path, nil)
+				require.NoError(b, err)
+				b.StartTimer()
+				putSequential(b, db, "seq", strategy, n)
+				b.StopTimer()
+				stats, err := db.TreeStats([]byte("seq"))
+				require.NoError(b, err)
+				require.NoError(b, db.Close())
+				info, err := os.Stat(path)
+				require.NoError(b, err)
+				b.ReportMetric(float64(info.Size())/(1<<20), "MiB")
+				b.ReportMetric(float64(stats.Depth), "depth")
+				b.ReportMetric(stats.Levels[stats.Depth-1].AvgFill, "leaf-fill")
+				_ = os.Remove(path)
+				_ = os.Remove(db.dal.opts.TxLogPath)
+				b.StartTimer()
+			}
+		})
+	}
+}
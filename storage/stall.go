@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the stall detector looks at commits of the last stallWindow, a p95 needs stallMinSamples
+// commits. A stall ends once the p95 and the queue are back under stallRecoverRatio of their
+// limits, so the state does not flap around the threshold.
+const (
+	stallWindow       = 10 * time.Second
+	stallMinSamples   = 5
+	stallMaxSamples   = 256
+	stallRecoverRatio = 0.5
+)
+
+// WriteStallInfo reports the write stall detector, see Options.CommitStallThreshold
+type WriteStallInfo struct {
+	Enabled   bool
+	Stalled   bool
+	Reason    string        // why writes are refused, empty while they are not
+	Since     time.Time     // start of the current stall
+	CommitP95 time.Duration // p95 commit time over the last 10s
+	Rejected  uint64        // write transactions refused with ErrWriteStalled
+}
+
+type commitSample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// stallDetector refuses new write transactions while commits are slow or too many writers
+// wait for the lock, queued writers would only pile up behind a slow disk
+type stallDetector struct {
+	lock      sync.Mutex
+	threshold time.Duration
+	maxQueue  int
+	window    time.Duration
+	samples   []commitSample // oldest first
+	stalled   bool
+	reason    string
+	since     time.Time
+	rejected  uint64
+}
+
+func newStallDetector(opts *Options) *stallDetector {
+	if opts.CommitStallThreshold <= 0 && opts.MaxWriteQueue <= 0 {
+		return nil
+	}
+	return &stallDetector{threshold: opts.CommitStallThreshold, maxQueue: opts.MaxWriteQueue, window: stallWindow}
+}
+
+// record adds the duration of a finished commit
+func (s *stallDetector) record(duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.samples) == stallMaxSamples {
+		s.samples = s.samples[1:]
+	}
+	s.samples = append(s.samples, commitSample{at: time.Now(), duration: duration})
+}
+
+// check runs before a write transaction waits for the lock, queue is the number of
+// writers already waiting
+func (s *stallDetector) check(queue int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.update(queue)
+	if s.stalled {
+		s.rejected++
+		return fmt.Errorf("%w: %s", ErrWriteStalled, s.reason)
+	}
+	return nil
+}
+
+// update enters or leaves the stall and returns the current p95
+func (s *stallDetector) update(queue int) time.Duration {
+	p95, samples := s.p95(time.Now())
+	slow := s.threshold > 0 && samples >= stallMinSamples && p95 > s.threshold
+	crowded := s.maxQueue > 0 && queue >= s.maxQueue
+	switch {
+	case !s.stalled && (slow || crowded):
+		s.stalled, s.since = true, time.Now()
+		if slow {
+			s.reason = fmt.Sprintf("p95 commit time %s above %s", p95.Round(time.Millisecond), s.threshold)
+		} else {
+			s.reason = fmt.Sprintf("%d writers waiting, limit %d", queue, s.maxQueue)
+		}
+		logger.Warn("write stall, refusing new write transactions", "reason", s.reason)
+	case s.stalled && s.recovered(p95, queue):
+		logger.Warn("write stall over", "duration", time.Since(s.since).Round(time.Millisecond))
+		s.stalled, s.reason, s.since = false, "", time.Time{}
+	}
+	return p95
+}
+
+func (s *stallDetector) recovered(p95 time.Duration, queue int) bool {
+	if s.threshold > 0 && float64(p95) > float64(s.threshold)*stallRecoverRatio {
+		return false
+	}
+	return s.maxQueue <= 0 || float64(queue) <= float64(s.maxQueue)*stallRecoverRatio
+}
+
+// p95 drops samples older than the window and returns the p95 of the rest, the
+// window has no samples once writes stopped for a while
+func (s *stallDetector) p95(now time.Time) (time.Duration, int) {
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].at) > s.window {
+		i++
+	}
+	s.samples = s.samples[i:]
+	if len(s.samples) == 0 {
+		return 0, 0
+	}
+	durations := make([]time.Duration, len(s.samples))
+	for i, sample := range s.samples {
+		durations[i] = sample.duration
+	}
+	slices.Sort(durations)
+	return durations[(len(durations)-1)*95/100], len(durations)
+}
+
+func (s *stallDetector) info(queue int) WriteStallInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	p95 := s.update(queue)
+	return WriteStallInfo{
+		Enabled:   true,
+		Stalled:   s.stalled,
+		Reason:    s.reason,
+		Since:     s.since,
+		CommitP95: p95,
+		Rejected:  s.rejected,
+	}
+}
+
+// WriteStall reports the write stall detector, the zero value when it is disabled
+func (db *DB) WriteStall() WriteStallInfo {
+	if db.stall == nil {
+		return WriteStallInfo{}
+	}
+	return db.stall.info(int(db.writeQueue.Load()))
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func openStallTestDB(t *testing.T, opts *Options) *DB {
+	filename := TempFileName(".db")
+	opts.WithTxLogPath(TempFileName(".tlog"))
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	return openTestDB(t, filename, opts)
+}
+
+func putKey(db *DB, key string) error {
+	return db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("foo"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), []byte("value"))
+	})
+}
+
+func TestWriteStallQueue(t *testing.T) {
+	db := openStallTestDB(t, DefaultOptions().WithWriteStall(0, 2))
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, putKey(db, key))
+		}()
+	}
+	require.Eventually(t, func() bool { return db.writeQueue.Load() == 2 }, time.Second, time.Millisecond)
+
+	// the queue is full, a new writer fails instead of waiting
+	errs := make(chan error, 1)
+	go func() { errs <- putKey(db, "c") }()
+	err = <-errs
+	require.ErrorIs(t, err, ErrWriteStalled)
+	require.ErrorContains(t, err, "2 writers waiting, limit 2")
+	stall := db.WriteStall()
+	require.True(t, stall.Stalled)
+	require.EqualValues(t, 1, stall.Rejected)
+
+	tx.Rollback()
+	wg.Wait()
+	require.NoError(t, putKey(db, "c"))
+	stall = db.Stat().WriteStall
+	require.True(t, stall.Enabled)
+	require.False(t, stall.Stalled)
+	require.Empty(t, stall.Reason)
+}
+
+func TestWriteStallSlowCommits(t *testing.T) {
+	fp := NewFailpoints()
+	db := openStallTestDB(t, DefaultOptions().WithFailpoints(fp).WithWriteStall(5*time.Millisecond, 0))
+
+	fp.Enable(FailpointSync, Delay(20*time.Millisecond))
+	for i := 0; i < stallMinSamples; i++ {
+		require.NoError(t, putKey(db, "key"))
+	}
+	err := putKey(db, "key")
+	require.ErrorIs(t, err, ErrWriteStalled)
+	require.ErrorContains(t, err, "p95 commit time")
+	stall := db.WriteStall()
+	require.True(t, stall.Stalled)
+	require.GreaterOrEqual(t, stall.CommitP95, 20*time.Millisecond)
+
+	// reads go on
+	require.NoError(t, db.View(func(tx *Tx) error {
+		_, err := tx.GetBucket([]byte("foo"))
+		return err
+	}))
+
+	// the slow commits leave the window, the disk is fast again
+	fp.Disable(FailpointSync)
+	db.stall.lock.Lock()
+	db.stall.window = 50 * time.Millisecond
+	db.stall.lock.Unlock()
+	require.ErrorIs(t, putKey(db, "key"), ErrWriteStalled)
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, putKey(db, "key"))
+	require.False(t, db.WriteStall().Stalled)
+	require.EqualValues(t, 2, db.WriteStall().Rejected)
+}
+
+func TestWriteStallDisabled(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.Nil(t, db.stall)
+	require.Equal(t, WriteStallInfo{}, db.WriteStall())
+
+	_, err := Open(TempFileName(".db"), DefaultOptions().WithWriteStall(-time.Second, 0))
+	require.ErrorIs(t, err, ErrBadWriteStall)
+}
@@ -0,0 +1,221 @@
+// Package storagetest builds deterministic storage fixtures for tests: databases filled
+// with seeded keys and values, trees of a requested depth and corrupted pages.
+package storagetest
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timson/pirindb/storage"
+)
+
+const (
+	DefaultSeed     = 1
+	DefaultKeySize  = 8
+	DefaultBlobSize = 3 * storage.BTreePageSize
+
+	depthBatchSize = 500 // entries inserted between depth checks
+)
+
+// BucketSpec describes the content of one bucket. Entries are generated from the seed
+// and the entry index only, so the same spec always produces the same data.
+type BucketSpec struct {
+	Name   string
+	Prefix string // key prefix, keys are Prefix + zero padded index
+	Count  int    // number of entries, more are added if MinDepth needs them
+	// KeySize is the width of the zero padded index, DefaultKeySize if zero
+	KeySize int
+	// values are random letters of a length in [MinValueSize, MaxValueSize]
+	MinValueSize int
+	MaxValueSize int
+	// BlobFraction of values are BlobSize long and stored as blobs
+	BlobFraction float64
+	BlobSize     int // DefaultBlobSize if zero
+	// MinDepth keeps inserting entries until the bucket tree has at least this depth
+	MinDepth int
+	// Shuffle inserts entries in a seeded random order instead of key order
+	Shuffle bool
+}
+
+// Entry is a generated key value pair
+type Entry struct {
+	Key   []byte
+	Value []byte
+}
+
+// Builder creates a database file filled according to bucket specs
+type Builder struct {
+	tb      testing.TB
+	seed    int64
+	opts    *storage.Options
+	buckets []BucketSpec
+}
+
+// Fixture is a built database with the entries stored in every bucket
+type Fixture struct {
+	DB      *storage.DB
+	Path    string
+	Opts    *storage.Options
+	Entries map[string][]Entry // bucket name -> entries in key order
+	tb      testing.TB
+}
+
+func New(tb testing.TB) *Builder {
+	return &Builder{tb: tb, seed: DefaultSeed}
+}
+
+func (b *Builder) WithSeed(seed int64) *Builder {
+	b.seed = seed
+	return b
+}
+
+func (b *Builder) WithOptions(opts *storage.Options) *Builder {
+	b.opts = opts
+	return b
+}
+
+func (b *Builder) WithBucket(spec BucketSpec) *Builder {
+	b.buckets = append(b.buckets, spec)
+	return b
+}
+
+// Build creates the database in a temporary directory, it is closed and removed when the test ends
+func (b *Builder) Build() *Fixture {
+	b.tb.Helper()
+	opts := b.opts
+	if opts == nil {
+		opts = storage.DefaultOptions()
+	}
+	path := filepath.Join(b.tb.TempDir(), "fixture.db")
+	opts.TxLogPath = filepath.Join(filepath.Dir(path), "fixture.tlog")
+	db, err := storage.Open(path, opts)
+	if err != nil {
+		b.tb.Fatalf("storagetest: open %s: %v", path, err)
+	}
+	fixture := &Fixture{DB: db, Path: path, Opts: opts, Entries: make(map[string][]Entry), tb: b.tb}
+	b.tb.Cleanup(fixture.Close)
+
+	for idx, spec := range b.buckets {
+		entries, err := fill(db, spec, b.seed+int64(idx))
+		if err != nil {
+			b.tb.Fatalf("storagetest: fill bucket %s: %v", spec.Name, err)
+		}
+		fixture.Entries[spec.Name] = entries
+	}
+	return fixture
+}
+
+// Close closes the database, it can be called more than once
+func (f *Fixture) Close() {
+	if f.DB == nil {
+		return
+	}
+	if err := f.DB.Close(); err != nil {
+		f.tb.Errorf("storagetest: close %s: %v", f.Path, err)
+	}
+	f.DB = nil
+}
+
+// Reopen closes the database and opens it again with the fixture options
+func (f *Fixture) Reopen() *storage.DB {
+	f.tb.Helper()
+	f.Close()
+	db, err := storage.Open(f.Path, f.Opts)
+	if err != nil {
+		f.tb.Fatalf("storagetest: reopen %s: %v", f.Path, err)
+	}
+	f.DB = db
+	return db
+}
+
+// Remove deletes the database files, for fixtures built outside of a temporary directory
+func (f *Fixture) Remove() {
+	f.Close()
+	_ = os.Remove(f.Path)
+	_ = os.Remove(f.Opts.TxLogPath)
+}
+
+// GenerateEntry returns the entry with index idx of the spec
+func GenerateEntry(spec BucketSpec, seed int64, idx int) Entry {
+	rnd := rand.New(rand.NewSource(seed*1_000_003 + int64(idx)))
+	keySize := spec.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	key := []byte(fmt.Sprintf("%s%0*d", spec.Prefix, keySize, idx))
+
+	size := spec.MinValueSize
+	if spec.MaxValueSize > spec.MinValueSize {
+		size += rnd.Intn(spec.MaxValueSize - spec.MinValueSize + 1)
+	}
+	if spec.BlobFraction > 0 && rnd.Float64() < spec.BlobFraction {
+		size = spec.BlobSize
+		if size == 0 {
+			size = DefaultBlobSize
+		}
+	}
+	value := make([]byte, size)
+	for i := range value {
+		value[i] = byte('a' + rnd.Intn(26))
+	}
+	return Entry{Key: key, Value: value}
+}
+
+func fill(db *storage.DB, spec BucketSpec, seed int64) ([]Entry, error) {
+	entries := make([]Entry, 0, spec.Count)
+	for idx := 0; idx < spec.Count; idx++ {
+		entries = append(entries, GenerateEntry(spec, seed, idx))
+	}
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	if spec.Shuffle {
+		rand.New(rand.NewSource(seed)).Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	err := db.Update(func(tx *storage.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(spec.Name))
+		if err != nil {
+			return err
+		}
+		for _, idx := range order {
+			if err = bucket.Put(entries[idx].Key, entries[idx].Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		stats, err := db.TreeStats([]byte(spec.Name))
+		if err != nil {
+			return nil, err
+		}
+		if stats.Depth >= spec.MinDepth {
+			return entries, nil
+		}
+		err = db.Update(func(tx *storage.Tx) error {
+			bucket, err := tx.GetBucket([]byte(spec.Name))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < depthBatchSize; i++ {
+				entry := GenerateEntry(spec, seed, len(entries))
+				if err = bucket.Put(entry.Key, entry.Value); err != nil {
+					return err
+				}
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+}
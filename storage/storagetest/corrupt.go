@@ -0,0 +1,122 @@
+package storagetest
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/timson/pirindb/storage"
+)
+
+// Corruption flips bits in pages of one type of a closed database file. Pages are
+// recognised by their type byte, released pages still carrying the type are candidates too.
+// Recovery replays the tx log on open, pages restored from it lose the corruption.
+type Corruption struct {
+	PageType byte
+	Offset   int  // byte offset inside the page, 0 is the type byte itself
+	Mask     byte // bits to flip, 0xff if zero
+	Limit    int  // corrupt at most Limit pages chosen by Seed, all if zero
+	Seed     int64
+	PageSize int // storage.BTreePageSize if zero
+}
+
+var (
+	// CorruptNodeItems turns the item count of node pages into a value far beyond the page
+	CorruptNodeItems = Corruption{PageType: storage.NodePage, Offset: storage.NodeNumItemsOffset + 1}
+	// CorruptBlobType clears the type byte of blob pages
+	CorruptBlobType = Corruption{PageType: storage.BlobPage, Offset: 0}
+)
+
+// Apply flips the bits and returns the corrupted page numbers. Page 0 is the only meta page,
+// zeroed unused pages also carry type 0 and are never touched.
+func (c Corruption) Apply(path string) ([]uint64, error) {
+	pageSize := c.PageSize
+	if pageSize == 0 {
+		pageSize = storage.BTreePageSize
+	}
+	if c.Offset < 0 || c.Offset >= pageSize {
+		return nil, fmt.Errorf("storagetest: offset %d outside of page", c.Offset)
+	}
+	mask := c.Mask
+	if mask == 0 {
+		mask = 0xff
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pages, err := findPages(file, pageSize, c.PageType)
+	if err != nil {
+		return nil, err
+	}
+	if c.Limit > 0 && c.Limit < len(pages) {
+		rnd := rand.New(rand.NewSource(c.Seed))
+		rnd.Shuffle(len(pages), func(i, j int) { pages[i], pages[j] = pages[j], pages[i] })
+		pages = pages[:c.Limit]
+	}
+
+	buf := make([]byte, 1)
+	for _, pageNum := range pages {
+		offset := int64(pageNum)*int64(pageSize) + int64(c.Offset)
+		if _, err = file.ReadAt(buf, offset); err != nil {
+			return nil, err
+		}
+		buf[0] ^= mask
+		if _, err = file.WriteAt(buf, offset); err != nil {
+			return nil, err
+		}
+	}
+	return pages, file.Sync()
+}
+
+// MustApply is Apply failing the test on error or when no page of the type exists
+func (c Corruption) MustApply(tb testing.TB, path string) []uint64 {
+	tb.Helper()
+	pages, err := c.Apply(path)
+	if err != nil {
+		tb.Fatalf("storagetest: corrupt %s: %v", path, err)
+	}
+	if len(pages) == 0 {
+		tb.Fatalf("storagetest: no pages of type %d in %s", c.PageType, path)
+	}
+	return pages
+}
+
+func findPages(file *os.File, pageSize int, pageType byte) ([]uint64, error) {
+	if pageType == storage.MetaPage {
+		return []uint64{0}, nil
+	}
+	var pages []uint64
+	buf := make([]byte, 1)
+	for pageNum := uint64(1); ; pageNum++ {
+		_, err := file.ReadAt(buf, int64(pageNum)*int64(pageSize))
+		if err == io.EOF {
+			return pages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] == pageType {
+			pages = append(pages, pageNum)
+		}
+	}
+}
+
+// Corrupt closes the database and applies the corruption to its file, use Reopen to open it again.
+// The tx log is removed first, recovery would otherwise restore the logged pages on reopen.
+func (f *Fixture) Corrupt(c Corruption) []uint64 {
+	f.tb.Helper()
+	f.Close()
+	if err := os.Remove(f.Opts.TxLogPath); err != nil && !os.IsNotExist(err) {
+		f.tb.Fatalf("storagetest: remove tx log: %v", err)
+	}
+	if c.PageSize == 0 {
+		c.PageSize = int(f.Opts.PageSize)
+	}
+	return c.MustApply(f.tb, f.Path)
+}
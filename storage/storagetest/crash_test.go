@@ -0,0 +1,167 @@
+//go:build crash
+
+package storagetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+// The crash test runs a workload in a child process and SIGKILLs it, unlike the recovery tests
+// of the storage package the page cache and fsync ordering of the OS are involved.
+//
+//	go test -tags crash ./storage/storagetest -run TestCrash
+//
+// PIRINDB_CRASH_SEED repeats a run, its seed is logged, PIRINDB_CRASH_ITERATIONS sets the kills
+// per sync mode.
+
+const (
+	crashChildEnv = "PIRINDB_CRASH_CHILD"
+	crashFileEnv  = "PIRINDB_CRASH_FILE"
+	crashSeedEnv  = "PIRINDB_CRASH_SEED"
+	crashModeEnv  = "PIRINDB_CRASH_SYNC_MODE"
+	crashIterEnv  = "PIRINDB_CRASH_ITERATIONS"
+)
+
+func crashOptions(filename string, mode storage.SyncMode) *storage.Options {
+	return storage.DefaultOptions().
+		WithTxLogPath(filename + ".tlog").
+		WithSyncMode(mode).
+		WithSyncInterval(10 * time.Millisecond).
+		WithUnsafeSync(true)
+}
+
+func crashWorkload(seed int64) Workload {
+	return Workload{Seed: seed, Keys: 500, Ops: 20, BlobFraction: 0.05}
+}
+
+func envInt(tb testing.TB, name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	require.NoError(tb, err, name)
+	return n
+}
+
+// TestCrashChild is the process TestCrash kills. It commits workload steps until it is killed
+// and writes "<step> <tx id>" to the pipe on fd 3 after each Commit returned.
+func TestCrashChild(t *testing.T) {
+	if os.Getenv(crashChildEnv) == "" {
+		t.Skip("run by TestCrash")
+	}
+	filename := os.Getenv(crashFileEnv)
+	mode := storage.SyncMode(os.Getenv(crashModeEnv))
+	workload := crashWorkload(envInt(t, crashSeedEnv, 0))
+	pipe := os.NewFile(3, "committed")
+
+	db, err := storage.Open(filename, crashOptions(filename, mode))
+	require.NoError(t, err)
+	for n := 1; ; n++ {
+		tx, err := db.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, workload.Apply(tx, n))
+		id := tx.ID()
+		require.NoError(t, tx.Commit())
+		_, err = fmt.Fprintf(pipe, "%d %d\n", n, id)
+		require.NoError(t, err)
+	}
+}
+
+func TestCrash(t *testing.T) {
+	seed := envInt(t, crashSeedEnv, time.Now().UnixNano())
+	iterations := int(envInt(t, crashIterEnv, 5))
+	t.Logf("%s=%d", crashSeedEnv, seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	for _, mode := range []storage.SyncMode{storage.SyncAlways, storage.SyncInterval, storage.SyncNever} {
+		for i := 0; i < iterations; i++ {
+			runSeed := rnd.Int63()
+			delay := time.Duration(20+rnd.Intn(300)) * time.Millisecond
+			t.Run(fmt.Sprintf("%s/%d", mode, i), func(t *testing.T) {
+				crashOnce(t, mode, runSeed, delay)
+			})
+		}
+	}
+}
+
+// crashOnce kills a child after delay and checks the file it leaves
+func crashOnce(t *testing.T, mode storage.SyncMode, seed int64, delay time.Duration) {
+	filename := filepath.Join(t.TempDir(), "crash.db")
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer func() { _ = r.Close() }()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashChild$", "-test.count=1")
+	cmd.Env = append(os.Environ(),
+		crashChildEnv+"=1",
+		crashFileEnv+"="+filename,
+		fmt.Sprintf("%s=%d", crashSeedEnv, seed),
+		crashModeEnv+"="+string(mode),
+	)
+	cmd.ExtraFiles = []*os.File{w}
+	output := &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = output, output
+	require.NoError(t, cmd.Start())
+	_ = w.Close()
+
+	committed := make(chan [2]uint64, 1024)
+	go func() {
+		defer close(committed)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var step, id uint64
+			if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &step, &id); err == nil {
+				committed <- [2]uint64{step, id}
+			}
+		}
+	}()
+
+	time.Sleep(delay)
+	require.NoError(t, cmd.Process.Kill())
+	_ = cmd.Wait()
+
+	last, lastID := 0, uint64(0)
+	for c := range committed {
+		require.Equal(t, uint64(last+1), c[0], "steps are reported in order")
+		require.Greater(t, c[1], lastID, "tx ids grow")
+		last, lastID = int(c[0]), c[1]
+	}
+	if last == 0 {
+		t.Skipf("killed before the first commit, child output:\n%s", output.String())
+	}
+	t.Logf("seed %d killed after %s, %d steps committed, last tx id %d", seed, delay, last, lastID)
+
+	db, err := storage.Open(filename, crashOptions(filename, mode))
+	require.NoError(t, err)
+	defer func() { _ = db.Close() }()
+	require.NoError(t, db.Check())
+
+	got := make(map[string][]byte)
+	require.NoError(t, db.ForEach([]byte(WorkloadBucket), func(k, v []byte) error {
+		got[string(k)] = append([]byte(nil), v...)
+		return nil
+	}))
+	workload := crashWorkload(seed)
+	for n := 1; n <= last; n++ {
+		require.Contains(t, got, string(StepKey(n)), "committed step %d is lost", n)
+	}
+	// the step after the last reported one may have committed before the kill
+	want := workload.State(last)
+	if _, ok := got[string(StepKey(last+1))]; ok {
+		want = workload.State(last + 1)
+	}
+	require.Equal(t, want, got)
+}
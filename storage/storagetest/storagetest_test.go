@@ -0,0 +1,160 @@
+package storagetest
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+)
+
+func TestBuilderDeterministic(t *testing.T) {
+	spec := BucketSpec{Name: "foo", Count: 300, MinValueSize: 10, MaxValueSize: 100, BlobFraction: 0.1, Shuffle: true}
+	first := New(t).WithSeed(42).WithBucket(spec).Build()
+	second := New(t).WithSeed(42).WithBucket(spec).Build()
+	other := New(t).WithSeed(43).WithBucket(spec).Build()
+
+	require.Equal(t, first.Entries, second.Entries)
+	require.NotEqual(t, first.Entries, other.Entries)
+
+	stats, err := first.DB.TreeStats([]byte("foo"))
+	require.NoError(t, err)
+	blobs := 0
+	for _, n := range stats.BlobChainPages {
+		blobs += n
+	}
+	require.Positive(t, blobs)
+	require.Less(t, blobs, 300/4)
+
+	err = first.DB.View(func(tx *storage.Tx) error {
+		bucket, err := tx.GetBucket([]byte("foo"))
+		require.NoError(t, err)
+		for _, entry := range first.Entries["foo"] {
+			value, ok := bucket.Get(entry.Key)
+			require.True(t, ok)
+			require.Equal(t, entry.Value, value)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestBuilderMinDepth(t *testing.T) {
+	fixture := New(t).
+		WithBucket(BucketSpec{Name: "deep", Count: 10, MinValueSize: 200, MaxValueSize: 200, MinDepth: 3}).
+		Build()
+
+	stats, err := fixture.DB.TreeStats([]byte("deep"))
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, stats.Depth, 3)
+	require.Greater(t, len(fixture.Entries["deep"]), 10)
+	require.NoError(t, fixture.DB.Check())
+}
+
+func TestCorruption(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       BucketSpec
+		corruption Corruption
+	}{
+		{"node items", BucketSpec{Name: "foo", Count: 2000, MinValueSize: 50, MaxValueSize: 50}, CorruptNodeItems},
+		{"blob type", BucketSpec{Name: "foo", Count: 20, BlobFraction: 1}, CorruptBlobType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := New(t).WithBucket(tt.spec).Build()
+			require.NoError(t, fixture.DB.Check())
+
+			pages := fixture.Corrupt(tt.corruption)
+			require.NotEmpty(t, pages)
+			db := fixture.Reopen()
+			require.ErrorIs(t, db.Check(), storage.ErrCorrupted)
+		})
+	}
+}
+
+func TestCorruptionLimit(t *testing.T) {
+	fixture := New(t).WithBucket(BucketSpec{Name: "foo", Count: 20, BlobFraction: 1}).Build()
+	fixture.Close()
+
+	file, err := os.Open(fixture.Path)
+	require.NoError(t, err)
+	all, err := findPages(file, storage.BTreePageSize, storage.BlobPage)
+	require.NoError(t, file.Close())
+	require.NoError(t, err)
+	require.Greater(t, len(all), 2)
+
+	corruption := Corruption{PageType: storage.BlobPage, Offset: 100, Limit: 2, Seed: 7}
+	first, err := corruption.Apply(fixture.Path)
+	require.NoError(t, err)
+	require.Len(t, first, 2)
+	// the same seed picks the same pages, flipping them back restores the file
+	second, err := corruption.Apply(fixture.Path)
+	require.NoError(t, err)
+	require.Equal(t, first, second)
+	require.NoError(t, fixture.Reopen().Check())
+}
+
+func TestCorruptionCursorErr(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       BucketSpec
+		corruption Corruption
+	}{
+		{"node items", BucketSpec{Name: "foo", Count: 2000, MinValueSize: 50, MaxValueSize: 50}, CorruptNodeItems},
+		{"blob type", BucketSpec{Name: "foo", Count: 20, BlobFraction: 1}, CorruptBlobType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := New(t).WithBucket(tt.spec).Build()
+			fixture.Corrupt(tt.corruption)
+			db := fixture.Reopen()
+			err := db.View(func(tx *storage.Tx) error {
+				bucket, err := tx.GetBucket([]byte(tt.spec.Name))
+				if err != nil {
+					return err
+				}
+				// the walk ends early instead of panicking, Err tells it from the end of the bucket
+				cursor := bucket.Cursor()
+				for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+				}
+				require.ErrorIs(t, cursor.Err(), storage.ErrCorrupted)
+				if tt.spec.BlobFraction == 1 {
+					// every value is a blob, none of them is reported as missing
+					_, found, err := bucket.Lookup(fixture.Entries[tt.spec.Name][0].Key)
+					require.False(t, found)
+					require.ErrorIs(t, err, storage.ErrCorrupted)
+				}
+				return bucket.ForEach(func(k, v []byte) error { return nil })
+			})
+			require.ErrorIs(t, err, storage.ErrCorrupted)
+		})
+	}
+}
+
+func TestWorkload(t *testing.T) {
+	workload := Workload{Seed: 7, Keys: 50, BlobFraction: 0.1}
+	require.Equal(t, workload.Step(3), Workload{Seed: 7, Keys: 50, BlobFraction: 0.1}.Step(3))
+	require.NotEqual(t, workload.Step(3), Workload{Seed: 8, Keys: 50, BlobFraction: 0.1}.Step(3))
+
+	fixture := New(t).Build()
+	for n := 1; n <= 20; n++ {
+		tx, err := fixture.DB.Begin(true)
+		require.NoError(t, err)
+		require.NoError(t, workload.Apply(tx, n))
+		require.Equal(t, uint64(n), tx.ID())
+		require.NoError(t, tx.Commit())
+	}
+	got := make(map[string][]byte)
+	require.NoError(t, fixture.DB.ForEach([]byte(WorkloadBucket), func(k, v []byte) error {
+		got[string(k)] = append([]byte(nil), v...)
+		return nil
+	}))
+	require.Equal(t, workload.State(20), got)
+
+	err := fixture.DB.View(func(tx *storage.Tx) error {
+		require.Zero(t, tx.ID())
+		return nil
+	})
+	require.NoError(t, err)
+}
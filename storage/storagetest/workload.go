@@ -0,0 +1,102 @@
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/timson/pirindb/storage"
+)
+
+// WorkloadBucket holds the keys a Workload writes
+const WorkloadBucket = "workload"
+
+// Workload is a scripted sequence of write transactions generated from a seed, step n of two
+// workloads with the same seed writes the same keys and values. A step puts and deletes keys
+// among Keys and records its number under StepKey, so the state after any step can be
+// computed without a database.
+type Workload struct {
+	Seed int64
+	Keys int // keys the steps pick from, 100 if zero
+	// Ops is the largest number of puts and deletes in a step, 10 if zero
+	Ops int
+	// BlobFraction of the values are DefaultBlobSize long and stored as blobs
+	BlobFraction float64
+}
+
+// WorkloadOp is a put, or a delete when Value is nil
+type WorkloadOp struct {
+	Key   []byte
+	Value []byte
+}
+
+// StepKey is the key step n writes its number under
+func StepKey(n int) []byte {
+	return []byte(fmt.Sprintf("step-%08d", n))
+}
+
+// Step returns the operations of step n, steps count from 1
+func (w Workload) Step(n int) []WorkloadOp {
+	keys, ops := w.Keys, w.Ops
+	if keys == 0 {
+		keys = 100
+	}
+	if ops == 0 {
+		ops = 10
+	}
+	rnd := rand.New(rand.NewSource(w.Seed*1_000_003 + int64(n)))
+	steps := make([]WorkloadOp, 0, ops+1)
+	for i := rnd.Intn(ops) + 1; i > 0; i-- {
+		key := []byte(fmt.Sprintf("key-%06d", rnd.Intn(keys)))
+		if rnd.Intn(4) == 0 {
+			steps = append(steps, WorkloadOp{Key: key})
+			continue
+		}
+		size := 1 + rnd.Intn(200)
+		if w.BlobFraction > 0 && rnd.Float64() < w.BlobFraction {
+			size = DefaultBlobSize
+		}
+		value := bytes.Repeat([]byte{byte('a' + rnd.Intn(26))}, size)
+		copy(value, fmt.Sprintf("%d:", n))
+		steps = append(steps, WorkloadOp{Key: key, Value: value})
+	}
+	return append(steps, WorkloadOp{Key: StepKey(n), Value: []byte(fmt.Sprint(n))})
+}
+
+// Apply runs step n in the transaction, the bucket is created by the first step
+func (w Workload) Apply(tx *storage.Tx, n int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(WorkloadBucket))
+	if err != nil {
+		return err
+	}
+	for _, op := range w.Step(n) {
+		if op.Value == nil {
+			err = bucket.Remove(op.Key)
+			if errors.Is(err, storage.ErrNodeNotFound) {
+				err = nil
+			}
+		} else {
+			err = bucket.Put(op.Key, op.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("step %d: %w", n, err)
+		}
+	}
+	return nil
+}
+
+// State returns the content of the bucket after steps 1 to n
+func (w Workload) State(n int) map[string][]byte {
+	state := make(map[string][]byte)
+	for step := 1; step <= n; step++ {
+		for _, op := range w.Step(step) {
+			if op.Value == nil {
+				delete(state, string(op.Key))
+			} else {
+				state[string(op.Key)] = op.Value
+			}
+		}
+	}
+	return state
+}
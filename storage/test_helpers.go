@@ -24,7 +24,7 @@ func TempFileName(suffix string) string {
 	return filepath.Join(os.TempDir(), uuid.New().String()+suffix)
 }
 
-func createTestDB(t *testing.T) (*DB, string) {
+func createTestDB(t testing.TB) (*DB, string) {
 	tempFilename := TempFileName(".db")
 
 	db, err := Open(tempFilename, nil)
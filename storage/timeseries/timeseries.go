@@ -0,0 +1,296 @@
+// Package timeseries partitions a logical bucket by time window. Every window is a bucket of
+// its own named after the window start, events_2024_06_01 for the daily window of June 1 2024,
+// so data past a retention horizon is dropped a whole bucket at a time instead of rewriting
+// tree pages key by key.
+package timeseries
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/timson/pirindb/storage"
+)
+
+// Partition is the length of a window, windows start on UTC boundaries
+type Partition string
+
+const (
+	Hourly  Partition = "hourly"
+	Daily   Partition = "daily"
+	Monthly Partition = "monthly"
+)
+
+var ErrInvalidPartition = errors.New("invalid partition")
+
+// layout formats the start of a window in a bucket name, names sort by window start
+func (p Partition) layout() string {
+	switch p {
+	case Hourly:
+		return "2006_01_02_15"
+	case Daily:
+		return "2006_01_02"
+	case Monthly:
+		return "2006_01"
+	}
+	return ""
+}
+
+// Validate returns ErrInvalidPartition for a partition other than hourly, daily or monthly
+func (p Partition) Validate() error {
+	if p.layout() == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidPartition, string(p))
+	}
+	return nil
+}
+
+// Start returns the start of the window holding t
+func (p Partition) Start(t time.Time) time.Time {
+	t = t.UTC()
+	switch p {
+	case Hourly:
+		return t.Truncate(time.Hour)
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// Next returns the start of the window after the one holding t
+func (p Partition) Next(t time.Time) time.Time {
+	start := p.Start(t)
+	switch p {
+	case Hourly:
+		return start.Add(time.Hour)
+	case Daily:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// BucketName returns the bucket of the window holding t
+func BucketName(name string, p Partition, t time.Time) string {
+	return name + "_" + p.Start(t).Format(p.layout())
+}
+
+// ParseBucketName returns the window start of a bucket of the logical bucket, false for a
+// bucket that is not one of its windows
+func ParseBucketName(name string, p Partition, bucket string) (time.Time, bool) {
+	suffix, found := strings.CutPrefix(bucket, name+"_")
+	if !found || p.layout() == "" || len(suffix) != len(p.layout()) {
+		return time.Time{}, false
+	}
+	start, err := time.ParseInLocation(p.layout(), suffix, time.UTC)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return start, true
+}
+
+// Window is a bucket of a logical bucket and the time span it holds
+type Window struct {
+	Bucket string
+	Start  time.Time
+	End    time.Time
+}
+
+// Windows returns the windows of the logical bucket present in the transaction, oldest first
+func Windows(tx *storage.Tx, name string, p Partition) []Window {
+	var windows []Window
+	for _, bucket := range tx.Buckets() {
+		if start, ok := ParseBucketName(name, p, string(bucket)); ok {
+			windows = append(windows, Window{Bucket: string(bucket), Start: start, End: p.Next(start)})
+		}
+	}
+	slices.SortFunc(windows, func(a, b Window) int { return a.Start.Compare(b.Start) })
+	return windows
+}
+
+// TSWriter stores the keys of a logical bucket in the window of their write time
+type TSWriter struct {
+	db        *storage.DB
+	name      string
+	partition Partition
+	now       func() time.Time
+}
+
+func NewWriter(db *storage.DB, name string, p Partition) *TSWriter {
+	return &TSWriter{db: db, name: name, partition: p, now: time.Now}
+}
+
+// Bucket returns the bucket a write at t goes to
+func (w *TSWriter) Bucket(t time.Time) string {
+	return BucketName(w.name, w.partition, t)
+}
+
+// Put stores the value in the window of now, the window bucket is created on its first write
+func (w *TSWriter) Put(key, value []byte) error {
+	return w.PutAt(w.now(), key, value)
+}
+
+// PutAt stores the value in the window holding t
+func (w *TSWriter) PutAt(t time.Time, key, value []byte) error {
+	return w.db.Put([]byte(w.Bucket(t)), key, value)
+}
+
+// TSReader reads a logical bucket across its windows
+type TSReader struct {
+	db        *storage.DB
+	name      string
+	partition Partition
+}
+
+func NewReader(db *storage.DB, name string, p Partition) *TSReader {
+	return &TSReader{db: db, name: name, partition: p}
+}
+
+// Get returns a copy of the value of the key in the newest window holding it, ErrKeyNotFound
+// when no window has the key
+func (r *TSReader) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := r.db.View(func(tx *storage.Tx) error {
+		windows := Windows(tx, r.name, r.partition)
+		for i := len(windows) - 1; i >= 0; i-- {
+			bucket, err := tx.GetBucket([]byte(windows[i].Bucket))
+			if err != nil {
+				return err
+			}
+			v, found, err := bucket.Lookup(key)
+			if err != nil {
+				return err
+			}
+			if found {
+				value = bytes.Clone(v)
+				return nil
+			}
+		}
+		return storage.ErrKeyNotFound
+	})
+	return value, err
+}
+
+// ForEach calls fn for every key of every window, see Range
+func (r *TSReader) ForEach(fn func(k, v []byte) error) error {
+	return r.Range(time.Time{}, time.Time{}, nil, fn)
+}
+
+// Range calls fn in key order for the keys from start of the windows overlapping [from, to),
+// a zero from or to leaves that side open and a nil start begins at the first key. A key
+// written in several windows is passed once with the value of the newest. Keys and values are
+// valid only until fn returns, an error of fn stops the iteration and is returned.
+func (r *TSReader) Range(from, to time.Time, start []byte, fn func(k, v []byte) error) error {
+	return r.db.View(func(tx *storage.Tx) error {
+		merged := &cursorHeap{}
+		for age, window := range Windows(tx, r.name, r.partition) {
+			if (!from.IsZero() && !window.End.After(from)) || (!to.IsZero() && !window.Start.Before(to)) {
+				continue
+			}
+			bucket, err := tx.GetBucket([]byte(window.Bucket))
+			if err != nil {
+				return err
+			}
+			head := &windowCursor{cursor: bucket.Cursor(), age: age}
+			if start == nil {
+				head.key, head.value = head.cursor.First()
+			} else {
+				head.key, head.value = head.cursor.Seek(start)
+			}
+			if err := head.advanced(merged); err != nil {
+				return err
+			}
+		}
+		for merged.Len() > 0 {
+			head := heap.Pop(merged).(*windowCursor)
+			if err := fn(head.key, head.value); err != nil {
+				return err
+			}
+			// older windows holding the same key are behind the newest one in the heap
+			for merged.Len() > 0 && bytes.Equal((*merged)[0].key, head.key) {
+				older := heap.Pop(merged).(*windowCursor)
+				older.key, older.value = older.cursor.Next()
+				if err := older.advanced(merged); err != nil {
+					return err
+				}
+			}
+			head.key, head.value = head.cursor.Next()
+			if err := head.advanced(merged); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// windowCursor is the position of a window in a merged read, age orders the windows oldest
+// first
+type windowCursor struct {
+	cursor *storage.Cursor
+	age    int
+	key    []byte
+	value  []byte
+}
+
+// advanced puts the cursor back into the merge after a move, an exhausted cursor is dropped
+func (c *windowCursor) advanced(merged *cursorHeap) error {
+	if c.key == nil {
+		return c.cursor.Err()
+	}
+	heap.Push(merged, c)
+	return nil
+}
+
+// cursorHeap orders window cursors by key, the newest window first on equal keys
+type cursorHeap []*windowCursor
+
+func (h cursorHeap) Len() int { return len(h) }
+func (h cursorHeap) Less(i, j int) bool {
+	if c := bytes.Compare(h[i].key, h[j].key); c != 0 {
+		return c < 0
+	}
+	return h[i].age > h[j].age
+}
+func (h cursorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *cursorHeap) Push(x any)   { *h = append(*h, x.(*windowCursor)) }
+func (h *cursorHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// Expire drops the windows of the logical bucket that ended before now minus retain and
+// returns their bucket names
+func Expire(db *storage.DB, name string, p Partition, retain time.Duration, now time.Time) ([]string, error) {
+	horizon := now.Add(-retain)
+	var expired []string
+	err := db.View(func(tx *storage.Tx) error {
+		for _, window := range Windows(tx, name, p) {
+			if window.End.After(horizon) {
+				break
+			}
+			expired = append(expired, window.Bucket)
+		}
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+	err = db.Update(func(tx *storage.Tx) error {
+		for _, bucket := range expired {
+			if err := tx.DeleteBucket([]byte(bucket)); err != nil && !errors.Is(err, storage.ErrBucketNotFound) {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
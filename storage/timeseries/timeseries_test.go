@@ -0,0 +1,72 @@
+package timeseries
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/timson/pirindb/storage"
+	"github.com/timson/pirindb/storage/storagetest"
+)
+
+func TestBucketName(t *testing.T) {
+	at := time.Date(2024, 6, 1, 13, 45, 0, 0, time.FixedZone("CEST", 2*3600))
+	require.Equal(t, "events_2024_06_01_11", BucketName("events", Hourly, at))
+	require.Equal(t, "events_2024_06_01", BucketName("events", Daily, at))
+	require.Equal(t, "events_2024_06", BucketName("events", Monthly, at))
+	require.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), Monthly.Next(at))
+
+	start, ok := ParseBucketName("events", Daily, "events_2024_06_01")
+	require.True(t, ok)
+	require.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), start)
+	for _, bucket := range []string{"events", "events_2024_06", "events_extra_2024_06_01", "events_2024_13_01", "other_2024_06_01"} {
+		_, ok := ParseBucketName("events", Daily, bucket)
+		require.False(t, ok, bucket)
+	}
+	require.ErrorIs(t, Partition("weekly").Validate(), ErrInvalidPartition)
+}
+
+func TestWriterReader(t *testing.T) {
+	db := storagetest.New(t).Build().DB
+	day := func(d int) time.Time { return time.Date(2024, 6, d, 12, 0, 0, 0, time.UTC) }
+	writer := NewWriter(db, "events", Daily)
+	require.NoError(t, writer.PutAt(day(1), []byte("a"), []byte("a1")))
+	require.NoError(t, writer.PutAt(day(1), []byte("c"), []byte("c1")))
+	require.NoError(t, writer.PutAt(day(2), []byte("b"), []byte("b2")))
+	require.NoError(t, writer.PutAt(day(3), []byte("a"), []byte("a3")))
+	require.NoError(t, writer.PutAt(day(3), []byte("d"), []byte("d3")))
+	writer.now = func() time.Time { return day(3) }
+	require.NoError(t, writer.Put([]byte("e"), []byte("e3")))
+	require.NoError(t, db.Put([]byte("events_other"), []byte("x"), []byte("x")))
+
+	collect := func(from, to time.Time, start []byte) []string {
+		var got []string
+		require.NoError(t, NewReader(db, "events", Daily).Range(from, to, start, func(k, v []byte) error {
+			got = append(got, string(k)+"="+string(v))
+			return nil
+		}))
+		return got
+	}
+	require.Equal(t, []string{"a=a3", "b=b2", "c=c1", "d=d3", "e=e3"}, collect(time.Time{}, time.Time{}, nil))
+	require.Equal(t, []string{"a=a1", "b=b2", "c=c1"}, collect(time.Time{}, day(2), nil))
+	require.Equal(t, []string{"b=b2", "d=d3", "e=e3"}, collect(day(2), time.Time{}, []byte("b")))
+
+	reader := NewReader(db, "events", Daily)
+	value, err := reader.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, "a3", string(value))
+	_, err = reader.Get([]byte("x"))
+	require.ErrorIs(t, err, storage.ErrKeyNotFound)
+
+	// the window of June 1 ended on June 2, 48 hours before June 4
+	dropped, err := Expire(db, "events", Daily, 48*time.Hour, time.Date(2024, 6, 4, 1, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Equal(t, []string{"events_2024_06_01"}, dropped)
+	require.Equal(t, []string{"a=a3", "b=b2", "d=d3", "e=e3"}, collect(time.Time{}, time.Time{}, nil))
+	dropped, err = Expire(db, "events", Daily, 48*time.Hour, time.Date(2024, 6, 4, 1, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Empty(t, dropped)
+	value, err = db.Get([]byte("events_other"), []byte("x"))
+	require.NoError(t, err)
+	require.Equal(t, "x", string(value))
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+// trashPrefix starts the root bucket entries of soft deleted buckets. A trashed bucket is
+// stored as trashPrefix, its name, a zero byte and the big endian unix nanoseconds it was
+// deleted at, so the copies of a name sort oldest first.
+var trashPrefix = []byte("__trash/")
+
+const trashSuffixSize = 1 + UInt64Size
+
+// TrashedBucket is a soft deleted bucket, see Tx.DeleteBucketSoft
+type TrashedBucket struct {
+	Name      string
+	DeletedAt time.Time
+	BucketStat
+}
+
+func isTrashName(name []byte) bool {
+	return bytes.HasPrefix(name, trashPrefix)
+}
+
+func trashName(name []byte, deletedAt time.Time) []byte {
+	key := make([]byte, 0, len(trashPrefix)+len(name)+trashSuffixSize)
+	key = append(key, trashPrefix...)
+	key = append(key, name...)
+	key = append(key, 0)
+	return binary.BigEndian.AppendUint64(key, uint64(deletedAt.UnixNano()))
+}
+
+// parseTrashName returns the bucket name and deletion time of a trash entry
+func parseTrashName(key []byte) ([]byte, time.Time, bool) {
+	if !isTrashName(key) || len(key) < len(trashPrefix)+trashSuffixSize || key[len(key)-trashSuffixSize] != 0 {
+		return nil, time.Time{}, false
+	}
+	name := key[len(trashPrefix) : len(key)-trashSuffixSize]
+	nanos := binary.BigEndian.Uint64(key[len(key)-UInt64Size:])
+	return name, time.Unix(0, int64(nanos)), true
+}
+
+// DeleteBucketSoft moves the bucket to the trash instead of deleting it: its keys, options
+// and quota are kept under a hidden name until PurgeTrash deletes them, RestoreBucket brings
+// the bucket back. Trashed buckets are not listed by Buckets, AllBuckets, BucketStatsPage or
+// Stat, Trash lists them.
+func (tx *Tx) DeleteBucketSoft(name []byte) error {
+	if !tx.write {
+		return ErrWriteInRxTransaction
+	}
+	if isReservedBucketName(name) {
+		return ErrReservedBucketName
+	}
+	bucket, err := tx.GetBucket(name)
+	if err != nil {
+		return err
+	}
+	// the value carries the roots and counters changed earlier in the transaction
+	if err = bucket.spill(); err != nil {
+		return err
+	}
+	value := bucket.serialize().Value
+	if err = tx.removeBucket(name); err != nil {
+		return err
+	}
+	trashed := trashName(name, time.Now())
+	if err = tx.getRootBucket().Put(trashed, value); err != nil {
+		return err
+	}
+	tx.bucketChanged(trashed, true)
+	tx.recordEvent(name, EventTrashed, "")
+	return nil
+}
+
+// RestoreBucket moves the newest trashed copy of the bucket back, ErrBucketNotFound if the
+// trash has none and ErrBucketExists if a bucket of the name was created since
+func (tx *Tx) RestoreBucket(name []byte) error {
+	if !tx.write {
+		return ErrWriteInRxTransaction
+	}
+	var trashed, value []byte
+	prefix := append(append(bytes.Clone(trashPrefix), name...), 0)
+	cursor := tx.getRootBucket().Cursor()
+	for k, v := cursor.seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.next() {
+		if len(k) == len(prefix)+UInt64Size {
+			trashed, value = bytes.Clone(k), bytes.Clone(v)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if trashed == nil {
+		return ErrBucketNotFound
+	}
+	if tx.BucketExists(name) {
+		return ErrBucketExists
+	}
+	rootBucket := tx.getRootBucket()
+	if err := rootBucket.Remove(trashed); err != nil {
+		return err
+	}
+	if err := rootBucket.Put(name, value); err != nil {
+		return err
+	}
+	tx.bucketChanged(trashed, false)
+	tx.bucketChanged(name, true)
+	tx.recordBucket(name)
+	tx.recordEvent(name, EventRestored, "")
+	return nil
+}
+
+// Trash returns the soft deleted buckets ordered by name and deletion time
+func (tx *Tx) Trash() ([]TrashedBucket, error) {
+	if err := tx.enter(); err != nil {
+		return nil, err
+	}
+	defer tx.leave()
+	trash := make([]TrashedBucket, 0)
+	cursor := tx.getRootBucket().Cursor()
+	for k, v := cursor.seek(trashPrefix); k != nil && isTrashName(k); k, v = cursor.next() {
+		name, deletedAt, ok := parseTrashName(k)
+		bucket := newBucket(k)
+		if !ok || bucket.deserialize(v) != nil {
+			logger.Warn("skipping invalid bucket value", "bucket", string(k))
+			continue
+		}
+		trash = append(trash, TrashedBucket{Name: string(name), DeletedAt: deletedAt, BucketStat: *bucket.stat()})
+	}
+	return trash, cursor.Err()
+}
+
+// PurgeTrash deletes the buckets moved to the trash before deletedBefore for good and returns
+// them, a zero deletedBefore empties the trash
+func (tx *Tx) PurgeTrash(deletedBefore time.Time) ([]TrashedBucket, error) {
+	if !tx.write {
+		return nil, ErrWriteInRxTransaction
+	}
+	trash, err := tx.Trash()
+	if err != nil {
+		return nil, err
+	}
+	purged := make([]TrashedBucket, 0, len(trash))
+	for _, trashed := range trash {
+		if !deletedBefore.IsZero() && !trashed.DeletedAt.Before(deletedBefore) {
+			continue
+		}
+		if err = tx.DeleteBucket(trashName([]byte(trashed.Name), trashed.DeletedAt)); err != nil {
+			return nil, err
+		}
+		tx.recordEvent([]byte(trashed.Name), EventDropped, "purged from the trash")
+		purged = append(purged, trashed)
+	}
+	return purged, nil
+}
+
+// PurgeTrash runs Tx.PurgeTrash in a write transaction
+func (db *DB) PurgeTrash(deletedBefore time.Time) ([]TrashedBucket, error) {
+	var purged []TrashedBucket
+	err := db.UpdateLabeled("purge trash", func(tx *Tx) error {
+		var err error
+		purged, err = tx.PurgeTrash(deletedBefore)
+		return err
+	})
+	return purged, err
+}
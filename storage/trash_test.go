@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketTrash(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Put([]byte("orders"), []byte("k1"), []byte("v1")))
+	require.NoError(t, db.Put([]byte("users"), []byte("k1"), []byte("v1")))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("orders"))
+		require.NoError(t, err)
+		require.NoError(t, bucket.SetQuota(BucketQuota{MaxKeys: 10}))
+		// the value of the trashed bucket has the key put in the same transaction
+		require.NoError(t, bucket.Put([]byte("k2"), []byte("v2")))
+		return tx.DeleteBucketSoft([]byte("orders"))
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		require.Equal(t, [][]byte{[]byte("users")}, tx.Buckets())
+		require.False(t, tx.BucketExists([]byte("orders")))
+		stats, _, err := tx.BucketStatsPage(nil, 10)
+		require.NoError(t, err)
+		require.Len(t, stats, 1)
+		trash, err := tx.Trash()
+		require.NoError(t, err)
+		require.Len(t, trash, 1)
+		require.Equal(t, "orders", trash[0].Name)
+		require.EqualValues(t, 2, trash[0].ItemsN)
+		require.WithinDuration(t, time.Now(), trash[0].DeletedAt, time.Minute)
+		return nil
+	}))
+	require.NotContains(t, db.Stat().Buckets, "orders")
+	require.NoError(t, db.Check())
+
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("__trash/orders"))
+		require.ErrorIs(t, err, ErrReservedBucketName)
+		require.ErrorIs(t, tx.RestoreBucket([]byte("users")), ErrBucketNotFound)
+		return tx.RestoreBucket([]byte("orders"))
+	}))
+	value, err := db.Get([]byte("orders"), []byte("k2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), value)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("orders"))
+		require.NoError(t, err)
+		require.EqualValues(t, 10, bucket.Quota().MaxKeys)
+		trash, err := tx.Trash()
+		require.NoError(t, err)
+		require.Empty(t, trash)
+		return nil
+	}))
+
+	// a bucket created under the trashed name blocks the restore
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		return tx.DeleteBucketSoft([]byte("orders"))
+	}))
+	require.NoError(t, db.Put([]byte("orders"), []byte("new"), []byte("v")))
+	require.ErrorIs(t, db.Update(func(tx *Tx) error {
+		return tx.RestoreBucket([]byte("orders"))
+	}), ErrBucketExists)
+
+	purged, err := db.PurgeTrash(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Empty(t, purged)
+	purged, err = db.PurgeTrash(time.Time{})
+	require.NoError(t, err)
+	require.Len(t, purged, 1)
+	require.NoError(t, db.View(func(tx *Tx) error {
+		trash, err := tx.Trash()
+		require.NoError(t, err)
+		require.Empty(t, trash)
+		require.Len(t, tx.Buckets(), 2)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
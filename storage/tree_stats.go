@@ -0,0 +1,97 @@
+package storage
+
+import "encoding/binary"
+
+// LevelStats describes the nodes found at one depth of a bucket B-tree.
+// Fill values are the ratio of serialized node size to the page size.
+type LevelStats struct {
+	NodesN  int
+	AvgFill float64
+	MinFill float64
+}
+
+// TreeStats is a static report about the shape of a bucket B-tree.
+type TreeStats struct {
+	Depth          int
+	Levels         []LevelStats // index 0 is the root level
+	LeafItems      map[int]int  // items per leaf -> number of leaves
+	BlobChainPages map[int]int  // pages per blob -> number of blobs
+}
+
+// TreeStats walks the bucket B-tree inside a read transaction and reports its shape.
+func (db *DB) TreeStats(bucketName []byte) (TreeStats, error) {
+	stats := TreeStats{
+		Levels:         make([]LevelStats, 0),
+		LeafItems:      make(map[int]int),
+		BlobChainPages: make(map[int]int),
+	}
+	err := db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket(bucketName)
+		if err != nil {
+			return err
+		}
+		if err = tx.enter(); err != nil {
+			return err
+		}
+		defer tx.leave()
+		root, err := tx.getNode(bucket.root)
+		if err != nil {
+			return err
+		}
+		return collectTreeStats(tx, root, 0, &stats)
+	})
+	if err != nil {
+		return TreeStats{}, err
+	}
+
+	for idx := range stats.Levels {
+		if stats.Levels[idx].NodesN > 0 {
+			stats.Levels[idx].AvgFill /= float64(stats.Levels[idx].NodesN)
+		}
+	}
+	stats.Depth = len(stats.Levels)
+	return stats, nil
+}
+
+// collectTreeStats accumulates node statistics for the subtree rooted at node.
+// AvgFill holds the sum of fills until TreeStats divides it by the node count.
+func collectTreeStats(tx *Tx, node *BNode, level int, stats *TreeStats) error {
+	if level == len(stats.Levels) {
+		stats.Levels = append(stats.Levels, LevelStats{MinFill: 1})
+	}
+	fill := float64(node.size()) / float64(tx.db.dal.meta.pageSize)
+	levelStats := &stats.Levels[level]
+	levelStats.NodesN++
+	levelStats.AvgFill += fill
+	levelStats.MinFill = min(levelStats.MinFill, fill)
+
+	for _, item := range node.items {
+		if valueType, err := item.valueType(); err != nil || valueType != ValueBlob {
+			continue
+		}
+		payload, err := item.payload()
+		if err != nil {
+			return err
+		}
+		pageCount, err := getBlobPageCount(tx, binary.LittleEndian.Uint64(payload))
+		if err != nil {
+			return err
+		}
+		stats.BlobChainPages[pageCount]++
+	}
+
+	if node.isLeaf() {
+		stats.LeafItems[len(node.items)]++
+		return nil
+	}
+	for _, childPageNum := range node.childNodes {
+		child, err := tx.getNode(childPageNum)
+		if err != nil {
+			return err
+		}
+		if err = collectTreeStats(tx, child, level+1, stats); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreeStats(t *testing.T) {
+	db, _ := createTestDB(t)
+	iterations := 5000
+	err := db.Update(func(tx *Tx) error {
+		bucket, _ := tx.CreateBucket([]byte("foo"))
+		for idx := range iterations {
+			k := fmt.Sprintf("%05d", idx)
+			err := bucket.Put([]byte(k), []byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("blob"), make([]byte, 10000))
+	})
+	require.NoError(t, err)
+
+	stats, err := db.TreeStats([]byte("foo"))
+	require.NoError(t, err)
+	require.Greater(t, stats.Depth, 1)
+	require.Len(t, stats.Levels, stats.Depth)
+	require.Equal(t, 1, stats.Levels[0].NodesN)
+
+	leaves := 0
+	for _, n := range stats.LeafItems {
+		leaves += n
+	}
+	require.Equal(t, stats.Levels[stats.Depth-1].NodesN, leaves)
+	require.Equal(t, map[int]int{calcPageCount(10000): 1}, stats.BlobChainPages)
+	for _, level := range stats.Levels {
+		require.LessOrEqual(t, level.MinFill, level.AvgFill)
+		require.LessOrEqual(t, level.AvgFill, 1.0)
+	}
+
+	_, err = db.TreeStats([]byte("missing"))
+	require.ErrorIs(t, err, ErrBucketNotFound)
+}
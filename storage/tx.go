@@ -2,7 +2,10 @@ package storage
 
 import (
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
+	"time"
 )
 
 type Tx struct {
@@ -14,9 +17,24 @@ type Tx struct {
 	write             bool
 	once              sync.Once
 	db                *DB
+	ownerID           int64
+	reader            readerState
+	snapshot          *snapshotState  // set on the read-only transaction of a bucket snapshot
+	changes           *changeSet      // nil unless the write transaction has commit hooks
+	scope             *bucketScope    // set on the write transaction of UpdateBucket
+	knownBuckets      map[string]bool // bucket names looked up, created or deleted
+	bucketsChanged    bool            // a bucket was created or deleted
+	id                uint64
+	actor             string                    // who makes the changes, see SetActor
+	events            []BucketEvent             // bucket events written on commit
+	validators        map[string]ValueValidator // of the database when the write transaction began
 }
 
-func newTx(db *DB, write bool) *Tx {
+func newTx(db *DB, write bool, ownerID int64) *Tx {
+	var id uint64
+	if write {
+		id = db.lastTxID.Add(1)
+	}
 	return &Tx{
 		map[uint64]*BNode{},
 		map[uint64]*Page{},
@@ -26,29 +44,83 @@ func newTx(db *DB, write bool) *Tx {
 		write,
 		sync.Once{},
 		db,
+		ownerID,
+		readerState{},
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		id,
+		"",
+		nil,
+		nil,
+	}
+}
+
+// ID numbers the write transactions of the DB in the order they began, from 1 after Open.
+// Ids are not stored, a transaction rolled back keeps its id unused. Read transactions have 0.
+func (tx *Tx) ID() uint64 {
+	return tx.id
+}
+
+// allocatePage takes a page for the transaction, it is released if the transaction rolls back
+func (tx *Tx) allocatePage() (*Page, error) {
+	page, err := tx.db.dal.AllocatePage()
+	if err != nil {
+		return nil, err
 	}
+	tx.allocatedPageNums = append(tx.allocatedPageNums, page.PageNumber)
+	return page, nil
+}
+
+// releaseAllocated returns the pages allocated since mark, a length of allocatedPageNums,
+// before anything was written to them
+func (tx *Tx) releaseAllocated(mark int) {
+	tx.db.dal.releasePages(tx.allocatedPageNums[mark:])
+	tx.allocatedPageNums = tx.allocatedPageNums[:mark]
 }
 
-func (tx *Tx) newNode(items []*Item, childNodes []uint64) *BNode {
+func (tx *Tx) newNode(items []*Item, childNodes []uint64, childCounts []uint64) (*BNode, error) {
+	page, err := tx.allocatePage()
+	if err != nil {
+		return nil, err
+	}
 	node := NewBNode()
 	node.items = make([]*Item, len(items))
 	copy(node.items, items)
 	node.childNodes = append([]uint64{}, childNodes...)
-	page, _ := tx.db.dal.AllocatePage()
+	node.childCounts = slices.Clone(childCounts)
 	node.PageNum = page.PageNumber
-	tx.allocatedPageNums = append(tx.allocatedPageNums, page.PageNumber)
-	return node
+	return node, nil
 }
 
 func (tx *Tx) getNode(page uint64) (*BNode, error) {
 	if node, ok := tx.dirtyNodes[page]; ok {
 		return node, nil
 	}
+	if tx.snapshot != nil {
+		return tx.snapshot.getNode(page)
+	}
 
 	node, err := tx.db.dal.getNode(page)
 	return node, err
 }
 
+// getCountedNode returns a node about to be changed by a write with the counts of its children,
+// a node of an older file is counted now and kept dirty so the counts are written with it
+func (tx *Tx) getCountedNode(page uint64) (*BNode, error) {
+	node, err := tx.getNode(page)
+	if err != nil || node.counted() {
+		return node, err
+	}
+	if err = node.ensureCounts(tx); err != nil {
+		return nil, err
+	}
+	tx.setNode(node)
+	return node, nil
+}
+
 func (tx *Tx) setNode(node *BNode) {
 	tx.dirtyNodes[node.PageNum] = node
 }
@@ -61,6 +133,9 @@ func (tx *Tx) getPage(pageNum uint64) (*Page, error) {
 	if page, ok := tx.dirtyPages[pageNum]; ok {
 		return page, nil
 	}
+	if tx.snapshot != nil {
+		return tx.snapshot.getPage(pageNum)
+	}
 	page, err := tx.db.dal.GetPage(pageNum)
 	return page, err
 }
@@ -75,48 +150,101 @@ func (tx *Tx) deletePage(pageNum uint64) {
 	tx.pagesToDelete = append(tx.pagesToDelete, pageNum)
 }
 
+// unlock releases the database lock held by the transaction, must be called once.
+func (tx *Tx) unlock() {
+	if tx.scope != nil {
+		tx.unlockBucket()
+	} else if tx.write {
+		tx.db.setWriter(writerInfo{})
+		tx.db.lock.Unlock()
+		tx.db.bucketWriters.Unlock()
+	} else {
+		tx.db.lock.RUnlock()
+		tx.db.TxN.Add(-1)
+		tx.db.releaseReader(tx)
+	}
+	tx.db.releaseOwner(tx.ownerID)
+}
+
 func (tx *Tx) Rollback() {
 	if !tx.write {
-		tx.once.Do(func() {
-			tx.db.lock.RUnlock()
-			tx.db.TxN.Add(-1)
-		})
+		tx.once.Do(tx.unlock)
 		return
 	}
 	defer func() {
 		tx.allocatedPageNums = nil
 		tx.once.Do(func() {
-			tx.db.lock.Unlock()
+			// a split of the root bucket root moved the in memory meta to a page released
+			// below, an attached blob file stays attached. Bucket transactions write the
+			// root bucket only in their commit.
+			if tx.scope == nil {
+				tx.db.dal.meta.root = tx.db.dal.committedMeta.root
+			}
+			tx.unlock()
 		})
 	}()
 
 	tx.dirtyNodes = nil
 	tx.pagesToDelete = nil
-	for _, pageNum := range tx.allocatedPageNums {
-		tx.db.dal.freelist.ReleasePage(pageNum)
-	}
+	tx.db.dal.releasePages(tx.allocatedPageNums)
 }
 
-func (tx *Tx) Commit() error {
+func (tx *Tx) Commit() (err error) {
 	if !tx.write {
-		tx.once.Do(func() {
-			tx.db.lock.RUnlock()
-			tx.db.TxN.Add(-1)
-		})
+		if tx.isInvalidated() {
+			return ErrTxClosed
+		}
+		tx.once.Do(tx.unlock)
 		return nil
 	}
+	tx.promote()
+	started := time.Now()
 	defer func() {
-		tx.once.Do(func() {
-			tx.db.lock.Unlock()
-		})
+		tx.db.dal.stats.commitNanos.Add(int64(time.Since(started)))
+		if tx.db.stall != nil {
+			tx.db.stall.record(time.Since(started))
+		}
+		if err != nil {
+			// the tx log may hold a record recovery still has to replay
+			tx.db.dal.commitFailed.Store(true)
+			tx.cacheBuckets(false)
+		} else {
+			tx.db.dal.committedMeta = *tx.db.dal.meta
+			tx.db.dal.publishPages()
+			tx.db.dal.usage.lastCommit.Store(time.Now().UnixNano())
+			tx.db.dal.usage.lastCommitDur.Store(int64(time.Since(started)))
+			if tx.db.softLimits != nil {
+				tx.db.softLimits.observe(tx.db.dal)
+			}
+			tx.cacheBuckets(true)
+			tx.runCommitHooks()
+		}
+		tx.once.Do(tx.unlock)
 		tx.dirtyNodes = nil
 		tx.dirtyPages = nil
 		tx.pagesToDelete = nil
 		tx.allocatedPageNums = nil
 	}()
 
+	if !tx.db.dal.snapshots.active() {
+		tx.db.dal.freelist.releaseHeld()
+		if tx.db.dal.blobs != nil {
+			tx.db.dal.blobs.freelist.releaseHeld()
+		}
+	}
+	if tx.db.dal.opts.AutoDeleteEmptyBuckets {
+		if err = tx.deleteEmptyBuckets(); err != nil {
+			return err
+		}
+	}
+	if err = tx.writeEvents(); err != nil {
+		return err
+	}
 	root := tx.getRootBucket()
 	for _, bucket := range tx.dirtyBuckets {
+		if err = bucket.spill(); err != nil {
+			return err
+		}
 		data := bucket.serialize()
 		err := root.Put(bucket.name, data.Value)
 		if err != nil {
@@ -124,67 +252,76 @@ func (tx *Tx) Commit() error {
 		}
 	}
 
-	// First write to physical log
-	err := tx.db.dal.txLog.With(func() error {
-		for _, node := range tx.dirtyNodes {
-			_, err := tx.db.dal.setNode(node)
-			if err != nil {
-				return err
-			}
-		}
-		for _, page := range tx.dirtyPages {
-			err := tx.db.dal.SetPage(page)
-			if err != nil {
-				return err
-			}
-		}
-		for _, pageNum := range tx.pagesToDelete {
-			tx.db.dal.freelist.ReleasePage(pageNum)
-		}
+	dirty := len(tx.dirtyNodes) + len(tx.dirtyPages)
 
-		err := WriteFreelist(tx.db.dal, tx.db.dal.freelist)
-		if err != nil {
-			return err
-		}
-		err = WriteMeta(tx.db.dal, tx.db.dal.meta)
-		if err != nil {
-			return err
-		}
-		return nil
+	// First write to physical log
+	if err := tx.db.dal.failpoint(FailpointBeforeTxLog); err != nil {
+		return err
+	}
+	err = tx.db.dal.txLog.With(func() error {
+		return tx.db.dal.batched(tx.writeDirty)
 	})
 	if err != nil {
 		return err
 	}
+	if err = tx.db.dal.failpoint(FailpointAfterTxLog); err != nil {
+		return err
+	}
 
 	// Second write to the Database storage
+	if err = tx.db.dal.batched(tx.writeDirty); err != nil {
+		return err
+	}
+
+	if tx.db.dal.txLog.syncOnCommit {
+		if err = tx.db.dal.Sync(); err != nil {
+			return err
+		}
+	}
+	tx.db.dal.stats.commits.Add(1)
+	tx.db.dal.stats.dirtyPages.Add(uint64(dirty))
+	if dirty < tx.db.dal.opts.AdvisorTinyPages {
+		tx.db.dal.stats.tinyCommits.Add(1)
+	}
+	if tx.db.advisor != nil {
+		tx.db.advisor.observe(tx.db)
+	}
+	return nil
+}
+
+// writeDirty writes dirty nodes and pages, the freelist and meta. Commit runs it twice,
+// first into the tx log and then into the database file.
+func (tx *Tx) writeDirty() error {
 	for _, node := range tx.dirtyNodes {
-		_, err = tx.db.dal.setNode(node)
+		_, err := tx.db.dal.setNode(node)
 		if err != nil {
 			return err
 		}
 	}
-
 	for _, page := range tx.dirtyPages {
-		err = tx.db.dal.SetPage(page)
+		err := tx.db.dal.SetPage(page)
 		if err != nil {
 			return err
 		}
 	}
+	if tx.db.dal.snapshots.active() {
+		tx.db.dal.holdPages(tx.pagesToDelete) // open snapshots may still read them
+	} else {
+		tx.db.dal.releasePages(tx.pagesToDelete)
+	}
+	tx.pagesToDelete = tx.pagesToDelete[:0] // released once, the second pass must not repeat it
 
-	//for _, pageNum := range tx.pagesToDelete {
-	//	tx.db.dal.freelist.ReleasePage(pageNum)
-	//}
-
-	err = WriteFreelist(tx.db.dal, tx.db.dal.freelist)
-	if err != nil {
-		return err
+	// the blob file freelist takes its pages from the main file, it is written first
+	if blobs := tx.db.dal.blobs; blobs != nil {
+		if err := writeFreelistAt(tx.db.dal, blobs.freelist, tx.db.dal.meta.blobFreelistPage); err != nil {
+			return err
+		}
 	}
-	err = WriteMeta(tx.db.dal, tx.db.dal.meta)
+	err := WriteFreelist(tx.db.dal, tx.db.dal.freelist)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	return WriteMeta(tx.db.dal, tx.db.dal.meta)
 }
 
 func (tx *Tx) getRootBucket() *Bucket {
@@ -206,19 +343,47 @@ func (tx *Tx) createOrUpdateBucket(bucket *Bucket) (*Bucket, error) {
 	return bucket, nil
 }
 
+// GetBucket returns the named bucket. A write transaction returns the same bucket on every
+// call, its metadata is persisted on commit, so reads see roots and counters changed earlier
+// in the transaction.
 func (tx *Tx) GetBucket(name []byte) (*Bucket, error) {
-	rootBucket := tx.getRootBucket()
-	value, found := rootBucket.Get(name)
-	if !found || value == nil {
+	if err := tx.enter(); err != nil {
+		return nil, err
+	}
+	defer tx.leave()
+	return tx.getBucket(name)
+}
+
+// getBucket is GetBucket for callers that entered the transaction
+func (tx *Tx) getBucket(name []byte) (*Bucket, error) {
+	if bucket, ok := tx.dirtyBuckets[string(name)]; ok {
+		return bucket, nil
+	}
+	bucket, err := tx.loadBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	if tx.write {
+		tx.dirtyBuckets[string(name)] = bucket
+	}
+	return bucket, nil
+}
+
+// loadBucket reads the bucket from the root bucket, a write transaction does not persist it
+func (tx *Tx) loadBucket(name []byte) (*Bucket, error) {
+	value, err := tx.bucketValue(name)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
 		return nil, ErrBucketNotFound
 	}
 	bucket := newBucket([]byte{})
-	bucket.deserialize(value)
+	if err = bucket.deserialize(value); err != nil {
+		return nil, fmt.Errorf("bucket %q: %w", name, err)
+	}
 	bucket.tx = tx
 	bucket.name = name
-	if tx.write {
-		tx.dirtyBuckets[string(name)] = bucket
-	}
 	return bucket, nil
 }
 
@@ -226,12 +391,28 @@ func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
 	if !tx.write {
 		return nil, ErrWriteInRxTransaction
 	}
+	if isReservedBucketName(name) {
+		return nil, ErrReservedBucketName
+	}
+	bucket, err := tx.createBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	tx.recordEvent(name, EventCreated, "")
+	return bucket, nil
+}
+
+// createBucket is CreateBucket for the names the storage reserves
+func (tx *Tx) createBucket(name []byte) (*Bucket, error) {
 	bucket, err := tx.GetBucket(name)
 	if err == nil && bucket != nil {
 		return nil, ErrBucketExists
 	}
+	if err != nil && !errors.Is(err, ErrBucketNotFound) {
+		return nil, err
+	}
 	node := NewBNode()
-	page, allocatePageErr := tx.db.dal.AllocatePage()
+	page, allocatePageErr := tx.allocatePage()
 	if allocatePageErr != nil {
 		return nil, allocatePageErr
 	}
@@ -241,6 +422,7 @@ func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
 	bucket.name = name
 	bucket.root = page.PageNumber
 	tx.dirtyBuckets[string(name)] = bucket
+	tx.bucketChanged(name, true)
 	return tx.createOrUpdateBucket(bucket)
 }
 
@@ -248,27 +430,112 @@ func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
 	if !tx.write {
 		return nil, ErrWriteInRxTransaction
 	}
-	bucket, err := tx.CreateBucket(name)
-	if errors.Is(err, ErrBucketExists) {
-		return tx.GetBucket(name)
+	bucket, err := tx.GetBucket(name)
+	if errors.Is(err, ErrBucketNotFound) {
+		return tx.CreateBucket(name)
 	}
 	return bucket, err
 }
 
+// DeleteBucket removes the bucket and releases the pages of its tree, of the blobs of its
+// values and of its nested buckets on commit. An entry that is not a bucket value is removed
+// without releasing anything.
 func (tx *Tx) DeleteBucket(name []byte) error {
 	if !tx.write {
 		return ErrWriteInRxTransaction
 	}
+	bucket, err := tx.GetBucket(name)
+	switch {
+	case errors.Is(err, ErrBadBucketValue):
+		logger.Warn("deleting invalid bucket value, its pages are not released", "bucket", string(name), "error", err)
+	case err != nil:
+		return err
+	default:
+		if err = bucket.release(); err != nil {
+			return err
+		}
+	}
+	if err = tx.removeBucket(name); err != nil {
+		return err
+	}
+	tx.recordEvent(name, EventDropped, "")
+	return nil
+}
+
+// RenameBucket moves the bucket with its keys, sequence, options and quota to newName,
+// ErrBucketExists if a bucket of the new name exists. Its pages are not copied.
+func (tx *Tx) RenameBucket(name, newName []byte) error {
+	if !tx.write {
+		return ErrWriteInRxTransaction
+	}
+	if isReservedBucketName(name) || isReservedBucketName(newName) {
+		return ErrReservedBucketName
+	}
+	if tx.BucketExists(newName) {
+		return ErrBucketExists
+	}
+	bucket, err := tx.GetBucket(name)
+	if err != nil {
+		return err
+	}
+	// the value carries the roots and counters changed earlier in the transaction
+	if err = bucket.spill(); err != nil {
+		return err
+	}
+	value := bucket.serialize().Value
+	if err = tx.removeBucket(name); err != nil {
+		return err
+	}
+	if err = tx.getRootBucket().Put(newName, value); err != nil {
+		return err
+	}
+	tx.bucketChanged(newName, true)
+	tx.recordBucket(newName)
+	tx.recordEvent(name, EventDropped, "renamed to "+string(newName))
+	tx.recordEvent(newName, EventCreated, "renamed from "+string(name))
+	return nil
+}
+
+// removeBucket removes the entry of the bucket from the root bucket, its pages stay in use
+func (tx *Tx) removeBucket(name []byte) error {
+	delete(tx.dirtyBuckets, string(name))
 	rootBucket := tx.getRootBucket()
-	return rootBucket.Remove(name)
+	if err := rootBucket.Remove(name); err != nil {
+		return err
+	}
+	tx.bucketChanged(name, false)
+	tx.recordBucket(name)
+	return nil
 }
 
+// Buckets returns the names of all buckets, root bucket entries that are not bucket values
+// are skipped with a warning. Trashed and internal buckets are not returned, see Trash and
+// IsInternalBucket.
 func (tx *Tx) Buckets() [][]byte {
+	buckets, invalid := tx.bucketNames()
+	for _, name := range invalid {
+		logger.Warn("skipping invalid bucket value", "bucket", string(name))
+	}
+	return slices.DeleteFunc(buckets, IsInternalBucket)
+}
+
+// bucketNames returns the names of valid buckets and of root bucket entries that are not
+// bucket values, trashed buckets included
+func (tx *Tx) bucketNames() (buckets [][]byte, invalid [][]byte) {
+	if tx.enter() != nil {
+		return nil, nil
+	}
+	defer tx.leave()
 	rootBucket := tx.getRootBucket()
 	cursor := rootBucket.Cursor()
-	buckets := make([][]byte, 0)
-	for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+	buckets = make([][]byte, 0)
+	// the root bucket has no prefix rules, the unguarded moves are enough
+	for k, v := cursor.first(); k != nil; k, v = cursor.next() {
+		if _, dirty := tx.dirtyBuckets[string(k)]; !dirty && newBucket(k).deserialize(v) != nil {
+			invalid = append(invalid, k)
+			continue
+		}
 		buckets = append(buckets, k)
 	}
-	return buckets
+	return buckets, invalid
 }
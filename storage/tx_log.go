@@ -7,110 +7,222 @@ import (
 	"hash/crc32"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
 )
 
-// TxLog header map
-// 0            8                    14
-// +------------+------------+--------+
-// | Num Pages  | Page Size  |  CRC   |
-// |  uint8     |  uint16    | uint32 |
-// +------------+------------+--------+
+// The log is a sequence of transaction records, each record is a header followed by runs of pages.
+// In SyncAlways and SyncNever modes the log holds only the last transaction, in SyncInterval
+// mode records are appended until the next background sync rolls the log.
+
+// TxLog record header map, format version 3
+// 0          4           6            10           14                 30         34
+// +----------+-----------+------------+------------+------------------+----------+
+// |  Magic   |  Version  |  Num Runs  | Page Size  |   Database ID    |   CRC    |
+// |  uint32  |  uint16   |  uint32    |  uint32    |    16 bytes      |  uint32  |
+// +----------+-----------+------------+------------+------------------+----------+
+// Version 2 records have no database id, the CRC follows the page size.
 
-// TxLog pages map
-// 0         8              16             page size + header
-// +---------+---------------+--------------------+ ... N pages
-// | offset  | Page Number   |      Page data     |
-// | uint64  |   uint64      |       uint8[]      |
-// +---------+---------------+--------------------+
+// TxLog runs map, a run is a sequence of adjacent pages
+// 0         8                16           20                  20 + num pages * page size
+// +---------+----------------+------------+------------------------+ ... N runs
+// | offset  | First Page Num | Num Pages  |       Pages data       |
+// | uint64  |    uint64      |  uint32    |        uint8[]         |
+// +---------+----------------+------------+------------------------+
+
+// Version 1 records have no magic, they are a header of Num Pages uint64, Page Size uint16
+// and CRC uint32 followed by offset uint64, Page Number uint64 and data of every page.
+// Recover replays all versions, new records are always written as version 3.
 
 const (
-	txLogNumPagesSize   = UInt64Size
-	txLogPageSizeBytes  = UInt16Size
-	txLogCRCSize        = UInt32Size
-	txLogHeaderSize     = txLogNumPagesSize + txLogPageSizeBytes + txLogCRCSize
-	txLogPageOffsetSize = UInt64Size
-	txLogPageNumberSize = UInt64Size
-	txLogPageHeaderSize = txLogPageOffsetSize + txLogPageNumberSize
-
-	txLogNumPages = 0
-	txLogPageSize = txLogNumPages + txLogNumPagesSize
-	txLogCRC      = txLogPageSize + txLogPageSizeBytes
-
-	txLogPageOffset = 0
-	txLogPageNumber = txLogPageOffset + txLogPageOffsetSize
+	txLogMagic   = 0x4c544e50 // "PNTL" in little endian, a version 1 header starts with a small page count
+	txLogVersion = 3
+
+	txLogMagicSize       = UInt32Size
+	txLogVersionSize     = UInt16Size
+	txLogNumRunsSize     = UInt32Size
+	txLogPageSizeBytes   = UInt32Size
+	txLogDbIDSize        = 16 // uuid.UUID
+	txLogCRCSize         = UInt32Size
+	txLogHeaderSize      = txLogMagicSize + txLogVersionSize + txLogNumRunsSize + txLogPageSizeBytes + txLogDbIDSize + txLogCRCSize
+	txLogRunOffsetSize   = UInt64Size
+	txLogRunPageNumSize  = UInt64Size
+	txLogRunNumPagesSize = UInt32Size
+	txLogRunHeaderSize   = txLogRunOffsetSize + txLogRunPageNumSize + txLogRunNumPagesSize
+
+	txLogMagicOffset   = 0
+	txLogVersionOffset = txLogMagicOffset + txLogMagicSize
+	txLogNumRuns       = txLogVersionOffset + txLogVersionSize
+	txLogPageSize      = txLogNumRuns + txLogNumRunsSize
+	txLogDbID          = txLogPageSize + txLogPageSizeBytes
+	txLogCRC           = txLogDbID + txLogDbIDSize
+
+	txLogRunOffset   = 0
+	txLogRunPageNum  = txLogRunOffset + txLogRunOffsetSize
+	txLogRunNumPages = txLogRunPageNum + txLogRunPageNumSize
+
+	// version 2 layout, only read by Recover
+	txLogV2HeaderSize = txLogHeaderSize - txLogDbIDSize
+	txLogV2CRC        = txLogDbID
+
+	// version 1 layout, only read by Recover
+	txLogV1NumPagesSize   = UInt64Size
+	txLogV1PageSizeBytes  = UInt16Size
+	txLogV1HeaderSize     = txLogV1NumPagesSize + txLogV1PageSizeBytes + txLogCRCSize
+	txLogV1PageHeaderSize = UInt64Size + UInt64Size
+
+	txLogV1NumPages = 0
+	txLogV1PageSize = txLogV1NumPages + txLogV1NumPagesSize
+	txLogV1CRC      = txLogV1PageSize + txLogV1PageSizeBytes
 )
 
-type TxLog struct {
-	lock     sync.Mutex
-	file     *os.File
-	numPages int
+// txLogIdentity is the database a log is replayed into. A record of another page size would
+// write its pages at wrong offsets, a record of another database would mix two files.
+type txLogIdentity struct {
 	pageSize int
-	crc      hash.Hash32
-	table    *crc32.Table
-	active   bool
+	dbID     uuid.UUID // zero for a file before 0.9, its records are checked by page size only
+}
+
+// check returns ErrTxLogMismatch if a record of the page size and database id does not belong
+// to the identity, records before version 3 have a zero id
+func (identity *txLogIdentity) check(offset int64, pageSize int, dbID uuid.UUID) error {
+	if pageSize != identity.pageSize {
+		return fmt.Errorf("%w: record at offset %d has page size %d, the database file %d", ErrTxLogMismatch,
+			offset, pageSize, identity.pageSize)
+	}
+	if dbID != (uuid.UUID{}) && identity.dbID != (uuid.UUID{}) && dbID != identity.dbID {
+		return fmt.Errorf("%w: record at offset %d was written for database %s, the database file is %s",
+			ErrTxLogMismatch, offset, dbID, identity.dbID)
+	}
+	return nil
+}
+
+type TxLog struct {
+	lock         sync.Mutex
+	file         *os.File
+	numRuns      int
+	pageSize     int
+	dbID         uuid.UUID      // written to every record, see txLogIdentity
+	identity     *txLogIdentity // checked by Recover, nil replays records of any database
+	crc          hash.Hash32
+	table        *crc32.Table
+	active       bool
+	offset       int64 // start of the current record, end of the last complete one
+	recordSize   int64
+	keepRecords  bool // append records instead of truncating the log on every transaction
+	syncOnCommit bool
+	failpoints   *Failpoints
+	syncs        atomic.Uint64 // fsyncs of the log file
+	lastSync     atomic.Int64  // unix nanoseconds of the last fsync
+	writes       atomic.Uint64 // write calls to the log file, record headers included
+}
+
+// RecoverySummary describes a tx log replay
+type RecoverySummary struct {
+	Records        int   // records replayed
+	Pages          int   // pages written back to the database file
+	SkippedRecords int   // replay stops at the first truncated or corrupted record, so 0 or 1
+	SkippedBytes   int64 // log bytes from the skipped record to the end of the log
 }
 
 type PageRecoveryCallback func(offset uint64, page *Page) error
 
-func NewTxLog(filename string, mode os.FileMode) *TxLog {
+func NewTxLog(filename string, mode os.FileMode) (*TxLog, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, mode)
 	if err != nil {
-		logger.Error("Failed to open log file", "filename", filename, "error", err)
+		return nil, fmt.Errorf("could not open tx log %s: %w", filename, err)
 	}
 	return &TxLog{
-		lock:     sync.Mutex{},
-		file:     file,
-		pageSize: BTreePageSize,
-		table:    crc32.MakeTable(crc32.IEEE),
-	}
+		lock:         sync.Mutex{},
+		file:         file,
+		pageSize:     BTreePageSize,
+		table:        crc32.MakeTable(crc32.IEEE),
+		syncOnCommit: true,
+	}, nil
 }
 
-func (txlog *TxLog) enter() {
-	err := txlog.file.Truncate(0)
-	_, err = txlog.file.Seek(txLogHeaderSize, 0)
+func (txlog *TxLog) enter() error {
+	if !txlog.keepRecords || txlog.offset == 0 {
+		if err := txlog.file.Truncate(0); err != nil {
+			return err
+		}
+		txlog.offset = 0
+	}
 	txlog.active = true
 	txlog.crc = crc32.New(txlog.table)
-	txlog.numPages = 0
-	if err != nil {
-		return
-	}
+	txlog.numRuns = 0
+	txlog.recordSize = txLogHeaderSize
+	_, err := txlog.file.Seek(txlog.offset+txLogHeaderSize, 0)
+	return err
 }
 
 func (txlog *TxLog) leave() error {
 	defer func() {
 		txlog.active = false
 	}()
-	_, err := txlog.file.Seek(0, 0)
 	header := make([]byte, txLogHeaderSize)
-	binary.LittleEndian.PutUint64(header[txLogNumPages:], uint64(txlog.numPages))
-	binary.LittleEndian.PutUint16(header[txLogPageSize:], uint16(txlog.pageSize))
+	binary.LittleEndian.PutUint32(header[txLogMagicOffset:], txLogMagic)
+	binary.LittleEndian.PutUint16(header[txLogVersionOffset:], txLogVersion)
+	binary.LittleEndian.PutUint32(header[txLogNumRuns:], uint32(txlog.numRuns))
+	binary.LittleEndian.PutUint32(header[txLogPageSize:], uint32(txlog.pageSize))
+	copy(header[txLogDbID:], txlog.dbID[:])
 	binary.LittleEndian.PutUint32(header[txLogCRC:], txlog.crc.Sum32())
-	_, err = txlog.file.Write(header)
+	_, err := txlog.file.WriteAt(header, txlog.offset)
 	if err != nil {
 		return err
 	}
-	err = txlog.file.Sync()
-	if err != nil {
-		return err
+	txlog.writes.Add(1)
+	if txlog.syncOnCommit {
+		if err = txlog.failpoints.trigger(FailpointTxLogSync); err != nil {
+			return err
+		}
+		err = txlog.file.Sync()
+		if err != nil {
+			return err
+		}
+		txlog.syncs.Add(1)
+		txlog.lastSync.Store(time.Now().UnixNano())
 	}
+	txlog.offset += txlog.recordSize
 	return nil
 }
 
-func (txlog *TxLog) writePage(offset uint64, page *Page) error {
-	data := make([]byte, txLogPageHeaderSize)
-	binary.LittleEndian.PutUint64(data, offset)
-	binary.LittleEndian.PutUint64(data[txLogPageNumber:], page.PageNumber)
-	_, err := txlog.file.Write(data)
-	if err != nil {
+// abort drops the partially written record, so it is never replayed
+func (txlog *TxLog) abort() {
+	txlog.active = false
+	_ = txlog.file.Truncate(txlog.offset)
+}
+
+// roll drops all records, must be called only after the database file is synced
+func (txlog *TxLog) roll() error {
+	txlog.lock.Lock()
+	defer txlog.lock.Unlock()
+	if err := txlog.file.Truncate(0); err != nil {
 		return err
 	}
-	_, _ = txlog.crc.Write(data)
-	_, err = txlog.file.Write(page.Data)
+	txlog.offset = 0
+	return nil
+}
+
+// writeRun appends adjacent pages starting at firstPage with a single write, data holds
+// whole pages of pageSize bytes
+func (txlog *TxLog) writeRun(offset uint64, firstPage uint64, pageSize int, data []byte) error {
+	buf := make([]byte, txLogRunHeaderSize+len(data))
+	binary.LittleEndian.PutUint64(buf[txLogRunOffset:], offset)
+	binary.LittleEndian.PutUint64(buf[txLogRunPageNum:], firstPage)
+	binary.LittleEndian.PutUint32(buf[txLogRunNumPages:], uint32(len(data)/pageSize))
+	copy(buf[txLogRunHeaderSize:], data)
+	_, err := txlog.file.Write(buf)
 	if err != nil {
 		return err
 	}
-	_, _ = txlog.crc.Write(page.Data)
-	txlog.numPages++
+	txlog.writes.Add(1)
+	_, _ = txlog.crc.Write(buf)
+	txlog.pageSize = pageSize
+	txlog.numRuns++
+	txlog.recordSize += int64(len(buf))
 	return nil
 }
 
@@ -118,47 +230,136 @@ func (txlog *TxLog) With(fn func() error) error {
 	txlog.lock.Lock()
 	defer txlog.lock.Unlock()
 
-	txlog.enter()
-	defer txlog.leave()
-
-	return fn()
+	if err := txlog.enter(); err != nil {
+		txlog.abort()
+		return err
+	}
+	if err := fn(); err != nil {
+		txlog.abort()
+		return err
+	}
+	return txlog.leave()
 }
 
-func (txlog *TxLog) Recover(callback PageRecoveryCallback) error {
+// Recover replays log records in order. Replay stops at the first truncated or
+// corrupted record, records before it are applied and counted in the summary. With an
+// identity a record of another page size or database fails with ErrTxLogMismatch before
+// any of its pages is applied; all records of a log are written by one open database, so a
+// mismatched log is refused as a whole.
+func (txlog *TxLog) Recover(callback PageRecoveryCallback) (RecoverySummary, error) {
 	txlog.lock.Lock()
 	defer txlog.lock.Unlock()
 
+	var summary RecoverySummary
 	info, err := txlog.file.Stat()
 	if err != nil {
-		return err
+		return summary, err
 	}
 
 	totalSize := info.Size()
-	if totalSize == 0 {
-		return nil
+	recordOffset := int64(0)
+	// version 1 headers are the shortest, a shorter tail can't be a record
+	for recordOffset+txLogV1HeaderSize <= totalSize {
+		recordSize, numPages, recoverErr := txlog.recoverRecord(recordOffset, totalSize, callback)
+		if recoverErr != nil {
+			summary.SkippedRecords = 1
+			summary.SkippedBytes = totalSize - recordOffset
+			return summary, recoverErr
+		}
+		summary.Records++
+		summary.Pages += numPages
+		recordOffset += recordSize
 	}
+	summary.SkippedBytes = totalSize - recordOffset // a header cut short by a crash
 
-	// Read header
-	header := make([]byte, 14)
-	_, err = txlog.file.ReadAt(header, 0)
+	return summary, nil
+}
+
+// size returns the size of the log file
+func (txlog *TxLog) size() int64 {
+	info, err := txlog.file.Stat()
 	if err != nil {
-		return err
+		return 0
 	}
+	return info.Size()
+}
 
-	numPages := int(binary.LittleEndian.Uint64(header[txLogNumPages:]))
-	pageSize := int(binary.LittleEndian.Uint16(header[txLogPageSize:]))
-	expectedCRC := binary.LittleEndian.Uint32(header[txLogCRC:])
+// recoverRecord replays a single record of version 2 or 3 starting at offset and returns its
+// size and page count
+func (txlog *TxLog) recoverRecord(offset int64, totalSize int64, callback PageRecoveryCallback) (int64, int, error) {
+	magic := make([]byte, txLogMagicSize)
+	if _, err := txlog.file.ReadAt(magic, offset); err != nil {
+		return 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(magic) != txLogMagic {
+		return txlog.recoverRecordV1(offset, totalSize, callback)
+	}
 
-	// Read rest of the file
+	header := make([]byte, txLogHeaderSize)
+	if offset+txLogV2HeaderSize > totalSize {
+		return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
+	}
+	_, err := txlog.file.ReadAt(header[:txLogV2HeaderSize], offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	var headerSize int64
+	var dbID uuid.UUID
+	var expectedCRC uint32
+	switch version := binary.LittleEndian.Uint16(header[txLogVersionOffset:]); version {
+	case 2:
+		headerSize = txLogV2HeaderSize
+		expectedCRC = binary.LittleEndian.Uint32(header[txLogV2CRC:])
+	case txLogVersion:
+		headerSize = txLogHeaderSize
+		if offset+headerSize > totalSize {
+			return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
+		}
+		if _, err = txlog.file.ReadAt(header, offset); err != nil {
+			return 0, 0, err
+		}
+		copy(dbID[:], header[txLogDbID:])
+		expectedCRC = binary.LittleEndian.Uint32(header[txLogCRC:])
+	default:
+		return 0, 0, fmt.Errorf("%w: unsupported record version %d at offset %d", ErrTxLogCorrupted, version, offset)
+	}
+	numRuns := int(binary.LittleEndian.Uint32(header[txLogNumRuns:]))
+	pageSize := int(binary.LittleEndian.Uint32(header[txLogPageSize:]))
+	if pageSize == 0 || pageSize > maxPageSize {
+		return 0, 0, fmt.Errorf("%w: page size %d at offset %d", ErrTxLogCorrupted, pageSize, offset)
+	}
+	if txlog.identity != nil {
+		if err = txlog.identity.check(offset, pageSize, dbID); err != nil {
+			return 0, 0, err
+		}
+	}
 
-	dataSize := totalSize - txLogHeaderSize
-	if dataSize <= 0 {
-		return nil
+	// Run sizes are known only from their headers, read them one by one before the data
+	dataOffset := offset + headerSize
+	dataSize := int64(0)
+	runHeader := make([]byte, txLogRunHeaderSize)
+	for i := 0; i < numRuns; i++ {
+		runOffset := dataOffset + dataSize
+		if runOffset+txLogRunHeaderSize > totalSize {
+			return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
+		}
+		if _, err = txlog.file.ReadAt(runHeader, runOffset); err != nil {
+			return 0, 0, err
+		}
+		numPages := int64(binary.LittleEndian.Uint32(runHeader[txLogRunNumPages:]))
+		// checked before the multiplication, so a corrupted count can't overflow the size
+		if numPages > (totalSize-runOffset-txLogRunHeaderSize)/int64(pageSize) {
+			return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
+		}
+		dataSize += txLogRunHeaderSize + numPages*int64(pageSize)
+	}
+	if dataOffset+dataSize > totalSize {
+		return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
 	}
 	data := make([]byte, dataSize)
-	_, err = txlog.file.ReadAt(data, txLogHeaderSize)
+	_, err = txlog.file.ReadAt(data, dataOffset)
 	if err != nil {
-		return err
+		return 0, 0, err
 	}
 
 	// Validate CRC
@@ -166,16 +367,81 @@ func (txlog *TxLog) Recover(callback PageRecoveryCallback) error {
 	_, _ = crc.Write(data)
 	actualCRC := crc.Sum32()
 	if actualCRC != expectedCRC {
-		return fmt.Errorf("CRC mismatch: expected %08x, got %08x", expectedCRC, actualCRC)
+		return 0, 0, fmt.Errorf("%w: CRC mismatch at offset %d: expected %08x, got %08x", ErrTxLogCorrupted, offset, expectedCRC, actualCRC)
+	}
+
+	// Split every run into (offset, page)
+	cursor := 0
+	pages := 0
+	for i := 0; i < numRuns; i++ {
+		runOffset := binary.LittleEndian.Uint64(data[cursor+txLogRunOffset:])
+		firstPage := binary.LittleEndian.Uint64(data[cursor+txLogRunPageNum:])
+		numPages := int(binary.LittleEndian.Uint32(data[cursor+txLogRunNumPages:]))
+		cursor += txLogRunHeaderSize
+		for j := 0; j < numPages; j++ {
+			page := &Page{
+				PageNumber: firstPage + uint64(j),
+				Data:       make([]byte, pageSize),
+			}
+			copy(page.Data, data[cursor:cursor+pageSize])
+			cursor += pageSize
+			if err = callback(runOffset+uint64(j*pageSize), page); err != nil {
+				return 0, 0, err
+			}
+		}
+		pages += numPages
+	}
+
+	return headerSize + dataSize, pages, nil
+}
+
+// recoverRecordV1 replays a record written before runs were introduced
+func (txlog *TxLog) recoverRecordV1(offset int64, totalSize int64, callback PageRecoveryCallback) (int64, int, error) {
+	// Read header
+	header := make([]byte, txLogV1HeaderSize)
+	_, err := txlog.file.ReadAt(header, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	numPages := binary.LittleEndian.Uint64(header[txLogV1NumPages:])
+	pageSize := int(binary.LittleEndian.Uint16(header[txLogV1PageSize:]))
+	expectedCRC := binary.LittleEndian.Uint32(header[txLogV1CRC:])
+	if pageSize == 0 {
+		return 0, 0, fmt.Errorf("%w: page size 0 at offset %d", ErrTxLogCorrupted, offset)
+	}
+	if txlog.identity != nil {
+		if err = txlog.identity.check(offset, pageSize, uuid.UUID{}); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	// Read record pages, the count is checked before the multiplication
+	if numPages > uint64(totalSize-offset-txLogV1HeaderSize)/uint64(txLogV1PageHeaderSize+pageSize) {
+		return 0, 0, fmt.Errorf("%w: truncated record at offset %d", ErrTxLogCorrupted, offset)
+	}
+	dataSize := int64(numPages) * int64(txLogV1PageHeaderSize+pageSize)
+	data := make([]byte, dataSize)
+	_, err = txlog.file.ReadAt(data, offset+txLogV1HeaderSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Validate CRC
+	crc := crc32.New(txlog.table)
+	_, _ = crc.Write(data)
+	actualCRC := crc.Sum32()
+	if actualCRC != expectedCRC {
+		return 0, 0, fmt.Errorf("%w: CRC mismatch at offset %d: expected %08x, got %08x", ErrTxLogCorrupted, offset, expectedCRC, actualCRC)
 	}
 
 	// Process each (offset, page)
 	cursor := 0
-	for i := 0; i < numPages; i++ {
-		offset := binary.LittleEndian.Uint64(data[cursor : cursor+txLogPageOffsetSize])
-		cursor += txLogPageOffsetSize
-		pageNum := binary.LittleEndian.Uint64(data[cursor : cursor+txLogPageNumberSize])
-		cursor += txLogPageNumberSize
+	for i := 0; i < int(numPages); i++ {
+		pageOffset := binary.LittleEndian.Uint64(data[cursor : cursor+UInt64Size])
+		cursor += UInt64Size
+		pageNum := binary.LittleEndian.Uint64(data[cursor : cursor+UInt64Size])
+		cursor += UInt64Size
 
 		page := &Page{
 			PageNumber: pageNum, // optional
@@ -184,10 +450,10 @@ func (txlog *TxLog) Recover(callback PageRecoveryCallback) error {
 		copy(page.Data, data[cursor:cursor+pageSize])
 		cursor += pageSize
 
-		if err = callback(offset, page); err != nil {
-			return err
+		if err = callback(pageOffset, page); err != nil {
+			return 0, 0, err
 		}
 	}
 
-	return nil
+	return txLogV1HeaderSize + dataSize, int(numPages), nil
 }
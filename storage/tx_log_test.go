@@ -1,10 +1,16 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_Recovery_AfterSimulatedCrash(t *testing.T) {
@@ -27,19 +33,22 @@ func Test_Recovery_AfterSimulatedCrash(t *testing.T) {
 		})
 	}
 
-	db, filename := createTestDB(t)
-	tx := db.Begin(true)
+	filename := TempFileName(".db")
+	failpoints := NewFailpoints()
+	opts := DefaultOptions().WithFailpoints(failpoints)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
 	bucket, err := tx.CreateBucketIfNotExists([]byte("users"))
 	require.NoError(t, err)
 	err = bucket.Put([]byte("id"), []byte("1234"))
 	require.NoError(t, err)
 	// Inject failure after txLog writes are done
-	db.dal.beforeSetPageHook = func(p *Page) error {
-		if !db.dal.txLog.active {
-			return fmt.Errorf("unable to write pages to db")
-		}
-		return nil
-	}
+	failpoints.Enable(FailpointPageWrite, FailNth(1, fmt.Errorf("unable to write pages to db")))
 
 	err = tx.Commit() // This will crash
 	require.Error(t, err)
@@ -60,3 +69,301 @@ func Test_Recovery_AfterSimulatedCrash(t *testing.T) {
 	err = checkFunc(db)
 	require.NoError(t, err)
 }
+
+func TestRecoveryIntervalSyncMode(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithSyncMode(SyncInterval).WithSyncInterval(time.Hour)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	require.Equal(t, SyncInterval, db.Stat().SyncMode)
+
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("users"))
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.syncAndRoll())
+	dbSnapshot, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// several commits between background syncs are appended to the tx log
+	for i := 0; i < 3; i++ {
+		err = db.Update(func(tx *Tx) error {
+			bucket, err := tx.GetBucket([]byte("users"))
+			if err != nil {
+				return err
+			}
+			return bucket.Put([]byte(fmt.Sprintf("id_%d", i)), []byte(fmt.Sprintf("%d", i)))
+		})
+		require.NoError(t, err)
+	}
+	logSnapshot, err := os.ReadFile(opts.TxLogPath)
+	require.NoError(t, err)
+	closeTestDB(t, db)
+
+	// simulate an OS crash: database writes since the last sync are lost, the tx log survived
+	require.NoError(t, os.WriteFile(filename, dbSnapshot, 0600))
+	require.NoError(t, os.WriteFile(opts.TxLogPath, logSnapshot, 0600))
+
+	db = openTestDB(t, filename, opts)
+	err = db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 3; i++ {
+			value, found := bucket.Get([]byte(fmt.Sprintf("id_%d", i)))
+			if !found {
+				return fmt.Errorf("id_%d not recovered", i)
+			}
+			require.Equal(t, []byte(fmt.Sprintf("%d", i)), value)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
+
+func TestRecoveryRestoresFileGrowth(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithSyncMode(SyncInterval).WithSyncInterval(time.Hour)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	require.NoError(t, db.syncAndRoll())
+	dbSnapshot, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	// the commit grows the file, the crash loses the growth but not the tx log
+	blob := bytes.Repeat([]byte("b"), 40*BTreePageSize)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("blob"), blob)
+	}))
+	logSnapshot, err := os.ReadFile(opts.TxLogPath)
+	require.NoError(t, err)
+	closeTestDB(t, db)
+	require.NoError(t, os.WriteFile(filename, dbSnapshot, 0600))
+	require.NoError(t, os.WriteFile(opts.TxLogPath, logSnapshot, 0600))
+
+	db = openTestDB(t, filename, opts)
+	require.NoError(t, db.Check())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		value, found := bucket.Get([]byte("blob"))
+		require.True(t, found)
+		require.Equal(t, blob, value)
+		return nil
+	}))
+}
+
+func TestSyncNeverRequiresUnsafeOption(t *testing.T) {
+	filename := TempFileName(".db")
+	_, err := Open(filename, DefaultOptions().WithSyncMode(SyncNever))
+	require.ErrorIs(t, err, ErrUnsafeSyncMode)
+
+	opts := DefaultOptions().WithSyncMode(SyncNever).WithUnsafeSync(true)
+	db := openTestDB(t, filename, opts)
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	require.Equal(t, SyncNever, db.Stat().SyncMode)
+}
+
+func TestRecoverVersion1Records(t *testing.T) {
+	path := TempFileName(".tlog")
+	t.Cleanup(func() { _ = os.Remove(path) })
+	txlog, err := NewTxLog(path, 0600)
+	require.NoError(t, err)
+	defer func() { _ = txlog.file.Close() }()
+
+	page := func(fill byte) []byte {
+		return bytes.Repeat([]byte{fill}, BTreePageSize)
+	}
+
+	// a version 1 record of pages 7 and 3, as written before runs were introduced
+	var body []byte
+	for _, pageNum := range []uint64{7, 3} {
+		body = binary.LittleEndian.AppendUint64(body, pageNum*BTreePageSize)
+		body = binary.LittleEndian.AppendUint64(body, pageNum)
+		body = append(body, page(byte(pageNum))...)
+	}
+	header := make([]byte, txLogV1HeaderSize)
+	binary.LittleEndian.PutUint64(header[txLogV1NumPages:], 2)
+	binary.LittleEndian.PutUint16(header[txLogV1PageSize:], BTreePageSize)
+	binary.LittleEndian.PutUint32(header[txLogV1CRC:], crc32.ChecksumIEEE(body))
+	_, err = txlog.file.Write(append(header, body...))
+	require.NoError(t, err)
+
+	// followed by a version 2 record with a run of pages 4 and 5
+	txlog.keepRecords = true
+	txlog.offset = int64(len(header) + len(body))
+	require.NoError(t, txlog.With(func() error {
+		return txlog.writeRun(4*BTreePageSize, 4, BTreePageSize, append(page(4), page(5)...))
+	}))
+
+	recovered := make(map[uint64][]byte)
+	summary, err := txlog.Recover(func(offset uint64, page *Page) error {
+		require.Equal(t, page.PageNumber*BTreePageSize, offset)
+		recovered[page.PageNumber] = page.Data
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, RecoverySummary{Records: 2, Pages: 4}, summary)
+	require.Len(t, recovered, 4)
+	for pageNum, data := range recovered {
+		require.Equal(t, page(byte(pageNum)), data)
+	}
+}
+
+func TestRecoverCorruptedRecord(t *testing.T) {
+	path := TempFileName(".tlog")
+	t.Cleanup(func() { _ = os.Remove(path) })
+	txlog, err := NewTxLog(path, 0600)
+	require.NoError(t, err)
+	defer func() { _ = txlog.file.Close() }()
+
+	txlog.keepRecords = true
+	require.NoError(t, txlog.With(func() error {
+		return txlog.writeRun(4*BTreePageSize, 4, BTreePageSize, bytes.Repeat([]byte{4}, BTreePageSize))
+	}))
+	// flip a byte of the page data so the checksum no longer matches
+	_, err = txlog.file.WriteAt([]byte{5}, txLogHeaderSize+100)
+	require.NoError(t, err)
+
+	_, err = txlog.Recover(func(offset uint64, page *Page) error { return nil })
+	require.ErrorIs(t, err, ErrTxLogCorrupted)
+}
+
+// txLogRecord builds a version 3 record of one run of pages, each page filled with its number
+func txLogRecord(pageSize int, dbID uuid.UUID, firstPage uint64, numPages int) []byte {
+	run := binary.LittleEndian.AppendUint64(nil, firstPage*uint64(pageSize))
+	run = binary.LittleEndian.AppendUint64(run, firstPage)
+	run = binary.LittleEndian.AppendUint32(run, uint32(numPages))
+	for i := range numPages {
+		run = append(run, bytes.Repeat([]byte{byte(firstPage) + byte(i)}, pageSize)...)
+	}
+	header := make([]byte, txLogHeaderSize)
+	binary.LittleEndian.PutUint32(header[txLogMagicOffset:], txLogMagic)
+	binary.LittleEndian.PutUint16(header[txLogVersionOffset:], txLogVersion)
+	binary.LittleEndian.PutUint32(header[txLogNumRuns:], 1)
+	binary.LittleEndian.PutUint32(header[txLogPageSize:], uint32(pageSize))
+	copy(header[txLogDbID:], dbID[:])
+	binary.LittleEndian.PutUint32(header[txLogCRC:], crc32.ChecksumIEEE(run))
+	return append(header, run...)
+}
+
+func TestRecoverMismatchedTxLog(t *testing.T) {
+	filename := TempFileName(".db")
+	opts := DefaultOptions().WithTxLogPath(TempFileName(".tlog"))
+	t.Cleanup(func() {
+		_ = os.Remove(filename)
+		_ = os.Remove(opts.TxLogPath)
+	})
+	db := openTestDB(t, filename, opts)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("users"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("alice"), []byte("admin"))
+	}))
+	dbID := db.dal.meta.id
+	require.NotZero(t, dbID)
+	closeTestDB(t, db)
+	file, err := os.ReadFile(filename)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name     string
+		pageSize int
+		dbID     uuid.UUID
+		message  string
+	}{
+		{"page size", 2 * BTreePageSize, dbID, fmt.Sprintf("page size %d, the database file %d", 2*BTreePageSize, BTreePageSize)},
+		{"database", BTreePageSize, uuid.New(), "the database file is " + dbID.String()},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// the pages would overwrite the meta, the freelist and the root of the file
+			log := txLogRecord(tt.pageSize, tt.dbID, 0, 3)
+			require.NoError(t, os.WriteFile(opts.TxLogPath, log, 0600))
+
+			db := openTestDB(t, filename, opts)
+			require.True(t, db.ReadOnly())
+			recovery := db.Stat().Durability.Recovery
+			require.Zero(t, recovery.Pages)
+			require.Contains(t, recovery.Error, ErrTxLogMismatch.Error())
+			require.Contains(t, recovery.Error, tt.message)
+			require.NoError(t, db.View(func(tx *Tx) error {
+				bucket, err := tx.GetBucket([]byte("users"))
+				require.NoError(t, err)
+				value, found := bucket.Get([]byte("alice"))
+				require.True(t, found)
+				require.Equal(t, []byte("admin"), value)
+				return nil
+			}))
+			err := db.Update(func(tx *Tx) error { return nil })
+			require.ErrorIs(t, err, ErrReadOnly)
+			require.ErrorIs(t, err, ErrTxLogMismatch)
+			closeTestDB(t, db)
+
+			_, err = Open(filename, DefaultOptions().WithTxLogPath(opts.TxLogPath).WithFailOnTxLogMismatch(true))
+			require.ErrorIs(t, err, ErrTxLogMismatch)
+
+			// neither the file nor the log was written
+			after, err := os.ReadFile(filename)
+			require.NoError(t, err)
+			require.True(t, bytes.Equal(file, after), "the database file changed")
+			kept, err := os.ReadFile(opts.TxLogPath)
+			require.NoError(t, err)
+			require.Equal(t, log, kept)
+		})
+	}
+}
+
+func TestCommitCoalescesWrites(t *testing.T) {
+	db, filename := createTestDB(t)
+	t.Cleanup(func() { _ = os.Remove(db.dal.opts.TxLogPath) })
+	before := db.CommitStats()
+	// a bulk load allocates fresh, mostly adjacent pages
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.CreateBucket([]byte("bulk"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 20000; i++ {
+			if err := bucket.Put([]byte(fmt.Sprintf("key-%06d", i)), bytes.Repeat([]byte{'v'}, 100)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	stats := db.CommitStats().Sub(before)
+	t.Logf("pages %d, tx log pages %d, write calls %d", stats.PagesWritten, stats.TxLogPages, stats.WriteCalls)
+	require.Greater(t, stats.PagesWritten, uint64(500))
+	require.Equal(t, stats.TxLogPages, stats.PagesWritten)
+	require.Less(t, stats.WriteCalls*10, stats.PagesWritten+stats.TxLogPages)
+	closeTestDB(t, db)
+
+	db = openTestDB(t, filename, DefaultOptions())
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("bulk"))
+		require.NoError(t, err)
+		value, found := bucket.Get([]byte("key-019999"))
+		require.True(t, found)
+		require.Len(t, value, 100)
+		return nil
+	}))
+	require.NoError(t, db.Check())
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/binary"
 	"fmt"
+	"os"
 	"sync"
 	"testing"
 	"time"
@@ -12,7 +13,8 @@ import (
 
 func TestTxRollbackCreateBucket(t *testing.T) {
 	db, _ := createTestDB(t)
-	tx := db.Begin(true)
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
 	bucket, err := tx.CreateBucket([]byte("test"))
 	require.NoError(t, err)
 
@@ -25,14 +27,16 @@ func TestTxRollbackCreateBucket(t *testing.T) {
 
 	tx.Rollback()
 
-	tx = db.Begin(false)
+	tx, err = db.Begin(false)
+	require.NoError(t, err)
 	bucket, err = tx.GetBucket([]byte("test"))
 	require.Error(t, err)
 }
 
 func TestTxRollbackMultiInserts(t *testing.T) {
 	db, _ := createTestDB(t)
-	tx := db.Begin(true)
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
 	bucket, err := tx.CreateBucket([]byte("test"))
 	require.NoError(t, err)
 	err = bucket.Put([]byte("foo"), []byte("bar"))
@@ -40,7 +44,8 @@ func TestTxRollbackMultiInserts(t *testing.T) {
 	err = tx.Commit()
 	require.NoError(t, err)
 
-	tx = db.Begin(true)
+	tx, err = db.Begin(true)
+	require.NoError(t, err)
 	bucket, err = tx.GetBucket([]byte("test"))
 	require.NoError(t, err)
 	for i := 0; i < 5000; i++ {
@@ -67,6 +72,57 @@ func TestTxRollbackMultiInserts(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestTxBucketMetadataOnCommit(t *testing.T) {
+	db, _ := createTestDB(t)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucket([]byte("test"))
+		return err
+	}))
+
+	tx, err := db.Begin(true)
+	require.NoError(t, err)
+	bucket, err := tx.GetBucket([]byte("test"))
+	require.NoError(t, err)
+	initialRoot := bucket.root
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, bucket.Put([]byte(fmt.Sprintf("test_%05d", i)), []byte("value")))
+	}
+	require.NotEqual(t, initialRoot, bucket.root, "the bucket root must be split")
+
+	// the root bucket record is not rewritten by Put
+	value, found, err := tx.getRootBucket().get([]byte("test"))
+	require.NoError(t, err)
+	require.True(t, found)
+	stored := newBucket([]byte("test"))
+	stored.deserialize(value)
+	require.Equal(t, initialRoot, stored.root)
+
+	// reads in the same transaction see the new root and counters
+	again, err := tx.GetBucket([]byte("test"))
+	require.NoError(t, err)
+	require.Same(t, bucket, again)
+	_, found = again.Get([]byte("test_04999"))
+	require.True(t, found)
+	require.NoError(t, again.Put([]byte("extra"), []byte("value")))
+	require.NoError(t, tx.Commit())
+
+	require.Equal(t, uint64(5001), db.Stat().Buckets["test"].ItemsN)
+	require.NoError(t, db.Check())
+
+	// a bucket deleted after a lookup is not brought back by commit
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		if _, err := tx.GetBucket([]byte("test")); err != nil {
+			return err
+		}
+		return tx.DeleteBucket([]byte("test"))
+	}))
+	require.NoError(t, db.View(func(tx *Tx) error {
+		_, err := tx.GetBucket([]byte("test"))
+		require.ErrorIs(t, err, ErrBucketNotFound)
+		return nil
+	}))
+}
+
 func TestTxIsolation(t *testing.T) {
 	db, _ := createTestDB(t)
 
@@ -232,3 +288,158 @@ func TestTxConcurrencyIsolation(t *testing.T) {
 	})
 	require.NoError(t, err)
 }
+
+func TestTxNestedUpdate(t *testing.T) {
+	db, _ := createTestDB(t)
+
+	err := db.Update(func(tx *Tx) error {
+		return db.Update(func(tx *Tx) error {
+			return nil
+		})
+	})
+	require.ErrorIs(t, err, ErrNestedTransaction)
+
+	err = db.Update(func(tx *Tx) error {
+		return db.View(func(tx *Tx) error {
+			return nil
+		})
+	})
+	require.ErrorIs(t, err, ErrNestedTransaction)
+
+	// locks must be released after the failed nesting
+	err = db.Update(func(tx *Tx) error {
+		_, err = tx.CreateBucket([]byte("foo"))
+		return err
+	})
+	require.NoError(t, err)
+}
+
+func TestTxNestedView(t *testing.T) {
+	db, _ := createTestDB(t)
+
+	err := db.View(func(tx *Tx) error {
+		return db.Update(func(tx *Tx) error {
+			return nil
+		})
+	})
+	require.ErrorIs(t, err, ErrNestedTransaction)
+
+	err = db.View(func(tx *Tx) error {
+		return db.View(func(tx *Tx) error {
+			return nil
+		})
+	})
+	require.ErrorIs(t, err, ErrNestedTransaction)
+
+	// other goroutines are not affected by an open transaction
+	tx, err := db.Begin(false)
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		done <- db.View(func(tx *Tx) error {
+			return nil
+		})
+	}()
+	require.NoError(t, <-done)
+	tx.Rollback()
+	require.Equal(t, int32(0), db.TxN.Load())
+}
+
+func TestTxWriterStat(t *testing.T) {
+	db, _ := createTestDB(t)
+	stat := db.Stat()
+	require.Empty(t, stat.WriterLabel)
+	require.Zero(t, stat.WriterHeldFor)
+
+	holding := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = db.UpdateLabeled("long writer", func(tx *Tx) error {
+			close(holding)
+			<-release
+			return nil
+		})
+	}()
+	<-holding
+
+	queued := make(chan struct{})
+	go func() {
+		_ = db.Update(func(tx *Tx) error { return nil })
+		close(queued)
+	}()
+
+	require.Eventually(t, func() bool {
+		return db.Stat().WriteQueueDepth == 1
+	}, time.Second, 10*time.Millisecond)
+	stat = db.Stat()
+	require.Equal(t, "long writer", stat.WriterLabel)
+	require.Greater(t, stat.WriterHeldFor, time.Duration(0))
+
+	close(release)
+	<-queued
+	stat = db.Stat()
+	require.Zero(t, stat.WriteQueueDepth)
+	require.Empty(t, stat.WriterLabel)
+}
+
+// panicReader panics once the first page of a blob was read
+type panicReader struct{ read int }
+
+func (r *panicReader) Read(p []byte) (int, error) {
+	if r.read > 0 {
+		panic("reader failed")
+	}
+	r.read = len(p)
+	return len(p), nil
+}
+
+func TestTxPanicRollback(t *testing.T) {
+	for _, recoverPanics := range []bool{false, true} {
+		t.Run(fmt.Sprintf("recover=%t", recoverPanics), func(t *testing.T) {
+			filename := TempFileName(".db")
+			t.Cleanup(func() {
+				_ = os.Remove(filename)
+				_ = os.Remove(filename + ".tlog")
+			})
+			db := openTestDB(t, filename, DefaultOptions().WithRecoverPanics(recoverPanics))
+			require.NoError(t, putKey(db, "before"))
+			root := db.dal.meta.root
+
+			update := func() error {
+				return db.Update(func(tx *Tx) error {
+					// enough buckets to split the root of the root bucket, which moves the meta root
+					for i := 0; i < 300; i++ {
+						if _, err := tx.CreateBucket([]byte(fmt.Sprintf("bucket-%03d", i))); err != nil {
+							return err
+						}
+					}
+					require.NotEqual(t, root, tx.db.dal.meta.root)
+					bucket, err := tx.GetBucket([]byte("foo"))
+					if err != nil {
+						return err
+					}
+					return bucket.PutReader([]byte("blob"), &panicReader{}, 3*BTreePageSize)
+				})
+			}
+			if recoverPanics {
+				require.ErrorIs(t, update(), ErrTxPanic)
+			} else {
+				require.PanicsWithValue(t, "reader failed", func() { _ = update() })
+			}
+
+			require.Equal(t, root, db.dal.meta.root)
+			require.NoError(t, db.Check())
+			require.NoError(t, putKey(db, "after"), "the write lock was released")
+			require.NoError(t, db.View(func(tx *Tx) error {
+				require.Len(t, tx.Buckets(), 1)
+				bucket, err := tx.GetBucket([]byte("foo"))
+				require.NoError(t, err)
+				_, found := bucket.Get([]byte("blob"))
+				require.False(t, found)
+				_, found = bucket.Get([]byte("after"))
+				require.True(t, found)
+				return nil
+			}))
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"encoding/binary"
 	"github.com/phsym/console-slog"
 	"os"
+	"runtime"
+	"strconv"
 )
 
 import "log/slog"
@@ -25,3 +28,15 @@ func itob(v uint64) []byte {
 func btoi(b []byte) uint64 {
 	return binary.BigEndian.Uint64(b)
 }
+
+// goroutineID parses the current goroutine id from the "goroutine N [...]" stack header.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if idx := bytes.IndexByte(buf, ' '); idx >= 0 {
+		buf = buf[:idx]
+	}
+	id, _ := strconv.ParseInt(string(buf), 10, 64)
+	return id
+}
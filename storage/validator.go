@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// ValueValidator checks a value before a write stores it, a returned error refuses the write.
+// It gets copies of the key and the value and can not change what is stored.
+type ValueValidator func(key, value []byte) error
+
+// validatorSet holds the validators of a database by bucket name, they are not persisted.
+// The map is replaced on every change, so a write transaction keeps the one it began with.
+type validatorSet struct {
+	lock    sync.RWMutex
+	buckets map[string]ValueValidator
+}
+
+// SetValidator registers fn for the writes of the bucket through Put, PutReader and Merge,
+// a nil fn removes it. A refused write returns ErrValueRejected wrapping the error of fn.
+// Validators live in memory and apply to transactions started after the call, values already
+// stored are not checked.
+func (db *DB) SetValidator(bucket []byte, fn ValueValidator) {
+	db.validators.lock.Lock()
+	defer db.validators.lock.Unlock()
+	buckets := maps.Clone(db.validators.buckets)
+	if fn == nil {
+		delete(buckets, string(bucket))
+	} else {
+		if buckets == nil {
+			buckets = make(map[string]ValueValidator)
+		}
+		buckets[string(bucket)] = fn
+	}
+	db.validators.buckets = buckets
+}
+
+func (db *DB) getValidators() map[string]ValueValidator {
+	db.validators.lock.RLock()
+	defer db.validators.lock.RUnlock()
+	return db.validators.buckets
+}
+
+// validator returns the validator of the bucket, nil for the root bucket of bucket values
+// and for nested buckets
+func (bucket *Bucket) validator() ValueValidator {
+	if len(bucket.name) == 0 || bucket.tx == nil || bucket.parent != nil {
+		return nil
+	}
+	return bucket.tx.validators[string(bucket.name)]
+}
+
+// validate runs the bucket validator on copies of the key and the value
+func (bucket *Bucket) validate(key, value []byte) error {
+	fn := bucket.validator()
+	if fn == nil {
+		return nil
+	}
+	if err := fn(bytes.Clone(key), bytes.Clone(value)); err != nil {
+		return fmt.Errorf("%w: %w", ErrValueRejected, err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var errNotUpper = errors.New("value must start with an upper case letter")
+
+func upperValidator(key, value []byte) error {
+	if len(value) == 0 || value[0] < 'A' || value[0] > 'Z' {
+		return errNotUpper
+	}
+	value[0] = 'x' // a copy, the stored value does not change
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	db, _ := createTestDB(t)
+	db.SetValidator([]byte("checked"), upperValidator)
+	large := append([]byte("B"), bytes.Repeat([]byte("b"), 3*BTreePageSize)...)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		checked, err := tx.CreateBucket([]byte("checked"))
+		require.NoError(t, err)
+		free, err := tx.CreateBucket([]byte("free"))
+		require.NoError(t, err)
+
+		require.NoError(t, checked.Put([]byte("a"), []byte("Apple")))
+		require.ErrorIs(t, checked.Put([]byte("b"), []byte("banana")), ErrValueRejected)
+		require.ErrorIs(t, checked.Put([]byte("b"), []byte("banana")), errNotUpper)
+		require.NoError(t, free.Put([]byte("b"), []byte("banana")), "other buckets are not checked")
+
+		// streamed values are read whole for the validator
+		require.ErrorIs(t, checked.PutReader([]byte("large"), bytes.NewReader(bytes.ToLower(large)), len(large)), ErrValueRejected)
+		require.NoError(t, checked.PutReader([]byte("large"), bytes.NewReader(large), len(large)))
+
+		// a refused merge leaves the old value
+		err = checked.Merge([]byte("a"), func(old []byte) ([]byte, error) { return []byte("apricot"), nil })
+		require.ErrorIs(t, err, ErrValueRejected)
+		require.NoError(t, checked.Merge([]byte("a"), func(old []byte) ([]byte, error) {
+			return append(old, " pie"...), nil
+		}))
+		return nil
+	}))
+
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("checked"))
+		require.NoError(t, err)
+		value, _ := bucket.Get([]byte("a"))
+		require.Equal(t, "Apple pie", string(value))
+		value, _ = bucket.Get([]byte("large"))
+		require.Equal(t, large, value)
+		_, found, err := bucket.Lookup([]byte("b"))
+		require.NoError(t, err)
+		require.False(t, found)
+		return nil
+	}))
+
+	db.SetValidator([]byte("checked"), nil)
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("checked"))
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("b"), []byte("banana"))
+	}))
+}
+
+func TestValidatorStartedTransaction(t *testing.T) {
+	db, _ := createTestDB(t)
+	createBuckets(t, db, "checked")
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("checked"))
+		require.NoError(t, err)
+		// the transaction keeps the validators it began with
+		db.SetValidator([]byte("checked"), upperValidator)
+		require.NoError(t, bucket.Put([]byte("a"), []byte("apple")))
+		return nil
+	}))
+	require.NoError(t, db.Update(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("checked"))
+		require.NoError(t, err)
+		require.ErrorIs(t, bucket.Put([]byte("b"), []byte("banana")), ErrValueRejected)
+		db.SetValidator([]byte("checked"), nil)
+		require.ErrorIs(t, bucket.Put([]byte("b"), []byte("banana")), ErrValueRejected)
+		return nil
+	}))
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Info returns the size of the value of the key without reading the value, see ItemInfo.
+// It is false for a missing key.
+func (bucket *Bucket) Info(key []byte) (ItemInfo, bool, error) {
+	if bucket.tx == nil {
+		return ItemInfo{}, false, ErrTxClosed
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return ItemInfo{}, false, err
+	}
+	defer bucket.tx.leave()
+	item, err := bucket.findItem(key)
+	if err != nil || item == nil {
+		return ItemInfo{}, false, err
+	}
+	info, err := itemInfo(bucket.tx, item)
+	if err != nil {
+		return ItemInfo{}, false, bucket.tx.keyError(key, err)
+	}
+	return info, true, nil
+}
+
+// ReadAt reads the part of the value of the key starting at off into p, as io.ReaderAt does:
+// fewer bytes than len(p) come with io.EOF at the end of the value. A blob is read up to the
+// last page of the range only. The checksum stored with a value covers all of it, a part is
+// not verified. ErrKeyNotFound is returned for a missing key.
+func (bucket *Bucket) ReadAt(key, p []byte, off int64) (int, error) {
+	if bucket.tx == nil {
+		return 0, ErrTxClosed
+	}
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if err := bucket.tx.enter(); err != nil {
+		return 0, err
+	}
+	defer bucket.tx.leave()
+	item, err := bucket.findItem(key)
+	if err != nil {
+		return 0, err
+	}
+	if item == nil {
+		return 0, ErrKeyNotFound
+	}
+	valueType, err := item.valueType()
+	if err != nil {
+		return 0, err
+	}
+	payload, err := item.payload()
+	if err != nil {
+		return 0, err
+	}
+	switch valueType {
+	case ValueSimple:
+		if off >= int64(len(payload)) {
+			return 0, io.EOF
+		}
+		n := copy(p, payload[off:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	case ValueBlob:
+		n, err := readBlobAt(bucket.tx, binary.LittleEndian.Uint64(payload), p, off)
+		if err != nil && err != io.EOF {
+			return n, bucket.tx.keyError(key, err)
+		}
+		return n, err
+	case ValueBucket:
+		return 0, bucket.tx.keyError(key, ErrIncompatibleValue)
+	}
+	return 0, ErrUnknownItemType
+}
+
+// readBlobAt copies the part of the blob starting at off into p. The chain is followed up to
+// the page holding the end of the part, at most as many pages as the blob has.
+func readBlobAt(tx *Tx, startPageNum uint64, p []byte, off int64) (int, error) {
+	page, err := tx.getPage(startPageNum)
+	if err != nil {
+		return 0, err
+	}
+	if page.Data[blobFirstPageTypeOffset] != BlobPage {
+		return 0, fmt.Errorf("%w: page %d is not a blob page", ErrCorrupted, startPageNum)
+	}
+	pageCount := int(binary.LittleEndian.Uint32(page.Data[blobFirstPageTotalPagesOffset:]))
+	dataLen := int64(binary.LittleEndian.Uint32(page.Data[blobFirstPageDataSizeOffset:]))
+	if off >= dataLen {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), dataLen)
+	next := binary.LittleEndian.Uint64(page.Data[blobFirstPageNextPageOffset:])
+	data := page.Data[blobFirstPageDataOffset:]
+	n := 0
+	for i, pageStart := 1, int64(0); ; i++ {
+		pageEnd := pageStart + int64(len(data))
+		if pageEnd > off {
+			n += copy(p[n:], data[max(off, pageStart)-pageStart:min(end, pageEnd)-pageStart])
+		}
+		if pageEnd >= end {
+			break
+		}
+		if i >= pageCount {
+			return n, fmt.Errorf("%w: blob at page %d has %d bytes in %d pages", ErrCorrupted, startPageNum, dataLen, pageCount)
+		}
+		if page, err = tx.getPage(next); err != nil {
+			return n, err
+		}
+		if page.Data[blobExtraPageTypeOffset] != BlobPage {
+			return n, fmt.Errorf("%w: page %d of blob at page %d is not a blob page", ErrCorrupted, page.PageNumber, startPageNum)
+		}
+		next = binary.LittleEndian.Uint64(page.Data[blobExtraPageNextPageOffset:])
+		data = page.Data[blobExtraPageDataOffset:]
+		pageStart = pageEnd
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
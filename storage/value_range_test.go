@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueReadAt(t *testing.T) {
+	db, _ := createTestDB(t)
+	blob := make([]byte, 3*BTreePageSize+100)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	require.NoError(t, db.Put([]byte("b"), []byte("blob"), blob))
+	require.NoError(t, db.Put([]byte("b"), []byte("inline"), []byte("small value")))
+
+	first := BTreePageSize - firstPageHeaderSize // end of the data on the first page
+	second := first + BTreePageSize - pageHeaderSize
+	require.NoError(t, db.View(func(tx *Tx) error {
+		bucket, err := tx.GetBucket([]byte("b"))
+		require.NoError(t, err)
+		info, found, err := bucket.Info([]byte("blob"))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, len(blob), info.Size)
+		info, found, err = bucket.Info([]byte("inline"))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, 11, info.Size)
+		_, found, err = bucket.Info([]byte("missing"))
+		require.NoError(t, err)
+		require.False(t, found)
+
+		for _, tt := range []struct{ off, n int }{
+			{0, 10}, {first - 5, 10}, {first, 1}, {first - 1, second - first + 2},
+			{second - 3, 3}, {0, len(blob)}, {100, 2 * BTreePageSize},
+		} {
+			p := make([]byte, tt.n)
+			n, err := bucket.ReadAt([]byte("blob"), p, int64(tt.off))
+			require.NoError(t, err, "off=%d n=%d", tt.off, tt.n)
+			require.Equal(t, tt.n, n)
+			require.Equal(t, blob[tt.off:tt.off+tt.n], p, fmt.Sprintf("off=%d n=%d", tt.off, tt.n))
+		}
+
+		// a part reaching past the end is short
+		p := make([]byte, 50)
+		n, err := bucket.ReadAt([]byte("blob"), p, int64(len(blob)-20))
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 20, n)
+		require.Equal(t, blob[len(blob)-20:], p[:n])
+		_, err = bucket.ReadAt([]byte("blob"), p, int64(len(blob)))
+		require.ErrorIs(t, err, io.EOF)
+
+		n, err = bucket.ReadAt([]byte("inline"), p[:5], 6)
+		require.NoError(t, err)
+		require.Equal(t, "value", string(p[:n]))
+		n, err = bucket.ReadAt([]byte("inline"), p, 6)
+		require.ErrorIs(t, err, io.EOF)
+		require.Equal(t, 5, n)
+		_, err = bucket.ReadAt([]byte("inline"), p, 11)
+		require.ErrorIs(t, err, io.EOF)
+
+		_, err = bucket.ReadAt([]byte("missing"), p, 0)
+		require.ErrorIs(t, err, ErrKeyNotFound)
+		_, err = bucket.ReadAt([]byte("blob"), p, -1)
+		require.Error(t, err)
+		return nil
+	}))
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH64 with seed 0, the value checksum. It is small enough to keep here instead of
+// adding a dependency, the output matches the reference implementation.
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+
+	xxStripeSize = 32
+)
+
+// xxhash64 is a streaming XXH64 digest
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	buf   [xxStripeSize]byte
+	n     int // buffered bytes
+}
+
+// NewValueHash returns a digest computing the value checksum of the bytes written to it
+func NewValueHash() hash.Hash64 {
+	h := &xxhash64{}
+	h.Reset()
+	return h
+}
+
+// ValueChecksum returns the XXH64 checksum stored with values, see Options.ValueChecksums
+func ValueChecksum(value []byte) uint64 {
+	h := xxhash64{}
+	h.Reset()
+	_, _ = h.Write(value)
+	return h.Sum64()
+}
+
+func (h *xxhash64) Reset() {
+	prime1 := xxPrime1 // the sums wrap around, which constants do not
+	h.v = [4]uint64{prime1 + xxPrime2, xxPrime2, 0, -prime1}
+	h.total = 0
+	h.n = 0
+}
+
+func (h *xxhash64) Size() int { return 8 }
+
+func (h *xxhash64) BlockSize() int { return xxStripeSize }
+
+func (h *xxhash64) Write(p []byte) (int, error) {
+	written := len(p)
+	h.total += uint64(written)
+	if h.n+len(p) < xxStripeSize {
+		h.n += copy(h.buf[h.n:], p)
+		return written, nil
+	}
+	if h.n > 0 {
+		p = p[copy(h.buf[h.n:], p):]
+		h.stripe(h.buf[:])
+		h.n = 0
+	}
+	for ; len(p) >= xxStripeSize; p = p[xxStripeSize:] {
+		h.stripe(p)
+	}
+	h.n = copy(h.buf[:], p)
+	return written, nil
+}
+
+func (h *xxhash64) stripe(p []byte) {
+	for i := range h.v {
+		h.v[i] = xxRound(h.v[i], binary.LittleEndian.Uint64(p[i*8:]))
+	}
+}
+
+func (h *xxhash64) Sum(b []byte) []byte {
+	return binary.BigEndian.AppendUint64(b, h.Sum64())
+}
+
+func (h *xxhash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= xxStripeSize {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc ^= xxRound(0, v)
+			acc = acc*xxPrime1 + xxPrime4
+		}
+	} else {
+		acc = xxPrime5
+	}
+	acc += h.total
+
+	p := h.buf[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		acc ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		acc = bits.RotateLeft64(acc, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		acc = bits.RotateLeft64(acc, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		acc ^= uint64(b) * xxPrime5
+		acc = bits.RotateLeft64(acc, 11) * xxPrime1
+	}
+
+	acc ^= acc >> 33
+	acc *= xxPrime2
+	acc ^= acc >> 29
+	acc *= xxPrime3
+	acc ^= acc >> 32
+	return acc
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueChecksum(t *testing.T) {
+	tests := []struct {
+		input string
+		sum   uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.sum, ValueChecksum([]byte(tt.input)), "input %q", tt.input)
+	}
+
+	// writes split at any point sum the same as one write
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), 10)
+	for _, chunk := range []int{1, 7, 31, 32, 33, 100} {
+		digest := NewValueHash()
+		for rest := data; len(rest) > 0; {
+			n := min(chunk, len(rest))
+			_, _ = digest.Write(rest[:n])
+			rest = rest[n:]
+		}
+		require.Equal(t, ValueChecksum(data), digest.Sum64(), "chunk %d", chunk)
+	}
+}